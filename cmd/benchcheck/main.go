@@ -0,0 +1,73 @@
+// Command benchcheck compares go test -bench output with a baseline and
+// exits with status 1 when a benchmark regressed:
+//
+//	benchcheck -baseline tests/testdata/bench/baseline.txt build/bench.txt
+//
+// make bench-check runs the benchmarks and then benchcheck.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+
+	"github.com/gleicon/go-refluxdb/internal/benchcheck"
+)
+
+func main() {
+	baselinePath := flag.String("baseline", "tests/testdata/bench/baseline.txt", "go test -bench output to compare with")
+	threshold := flag.Float64("threshold", 0.2, "relative slowdown or allocation growth tolerated, 0.2 being 20%")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: benchcheck [flags] current.txt")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	baseline := parse(*baselinePath)
+	current := parse(flag.Arg(0))
+	comparisons, missing, added := benchcheck.Compare(baseline, current, *threshold)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "benchmark\tbaseline\tcurrent\ttime\tallocs\t")
+	regressions := 0
+	for _, c := range comparisons {
+		status := ""
+		if c.Regressed {
+			status = "REGRESSED"
+			regressions++
+		}
+		fmt.Fprintf(w, "%s\t%.0f ns/op\t%.0f ns/op\t%+.1f%%\t%+.1f%%\t%s\n", c.Name, c.Baseline.NsPerOp, c.Current.NsPerOp, 100*c.TimeDelta, 100*c.AllocsDelta, status)
+	}
+	w.Flush()
+	for _, name := range missing {
+		fmt.Printf("%s is in the baseline only\n", name)
+	}
+	for _, name := range added {
+		fmt.Printf("%s has no baseline\n", name)
+	}
+
+	if regressions > 0 {
+		fmt.Printf("%d of %d benchmarks regressed by more than %.0f%%\n", regressions, len(comparisons), 100**threshold)
+		os.Exit(1)
+	}
+}
+
+// parse reads the benchmark results of a file
+func parse(path string) map[string]benchcheck.Result {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatalf("Failed to open benchmark results: %v", err)
+	}
+	defer f.Close()
+	results, err := benchcheck.Parse(f)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", path, err)
+	}
+	return results
+}
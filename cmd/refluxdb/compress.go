@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+)
+
+// runCompress implements "refluxdb compress", re-encoding the fields of
+// existing points with or without zstd compression and reclaiming the
+// space freed by the conversion
+func runCompress(args []string) {
+	fs := flag.NewFlagSet("compress", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the TOML configuration file")
+	dbPath := fs.String("db", "", "database file, defaults to the configured storage path")
+	decompress := fs.Bool("decompress", false, "store fields as plain JSON again")
+	vacuum := fs.Bool("vacuum", true, "run VACUUM afterwards to shrink the database file")
+	fs.Usage = func() {
+		fs.Output().Write([]byte("usage: refluxdb compress [flags]\n"))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db := openDB(*configPath, *dbPath)
+	defer db.Close()
+
+	before, _ := db.Size()
+	n, err := db.RecompressFields(!*decompress)
+	if err != nil {
+		log.Fatalf("Compression failed after %d points: %v", n, err)
+	}
+	if *vacuum {
+		if _, err := db.GetDB().Exec(`VACUUM`); err != nil {
+			log.Fatalf("Failed to vacuum database: %v", err)
+		}
+	}
+	after, _ := db.Size()
+	log.Printf("Rewrote %d points, database size %d -> %d bytes", n, before, after)
+}
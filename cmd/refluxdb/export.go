@@ -0,0 +1,135 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/export"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// openDB opens the database named by -db, falling back to the storage path
+// of the configuration
+func openDB(configPath, dbPath string) *persistence.Manager {
+	cfg := loadConfig(configPath)
+	if dbPath == "" {
+		dbPath = cfg.Storage.Path
+	}
+	db, err := persistence.NewWithOptions(dbPath, cfg.StorageOptions())
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	return db
+}
+
+// parseTimeFlag accepts a nanosecond epoch or an RFC3339 timestamp
+func parseTimeFlag(name, value string, fallback int64) int64 {
+	if value == "" {
+		return fallback
+	}
+	if ns, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ns
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		log.Fatalf("Invalid -%s %q: expected nanoseconds or RFC3339", name, value)
+	}
+	ns, err := persistence.Nanoseconds(t)
+	if err != nil {
+		log.Fatalf("Invalid -%s %q: %v", name, value, err)
+	}
+	return ns
+}
+
+// runExport implements "refluxdb export", writing stored points as line
+// protocol to a file or stdout
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the TOML configuration file")
+	dbPath := fs.String("db", "", "database file, defaults to the configured storage path")
+	database := fs.String("database", "", "database to export, all when empty")
+	measurement := fs.String("measurement", "", "measurement to export, all when empty")
+	start := fs.String("start", "", "earliest timestamp, in nanoseconds or RFC3339")
+	end := fs.String("end", "", "latest timestamp, in nanoseconds or RFC3339")
+	out := fs.String("out", "-", "output file, - for stdout")
+	compress := fs.Bool("gzip", false, "gzip the output, implied by a .gz output file")
+	fs.Parse(args)
+
+	filter := export.Filter{
+		Database:    *database,
+		Measurement: *measurement,
+		Start:       parseTimeFlag("start", *start, 0),
+		End:         parseTimeFlag("end", *end, math.MaxInt64),
+	}
+
+	db := openDB(*configPath, *dbPath)
+	defer db.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			log.Fatalf("Failed to create output file: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if *compress || strings.HasSuffix(*out, ".gz") {
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		w = gz
+	}
+
+	n, err := export.Export(w, db, filter)
+	if err != nil {
+		log.Fatalf("Export failed after %d points: %v", n, err)
+	}
+	log.Printf("Exported %d points", n)
+}
+
+// runImport implements "refluxdb import", loading a line protocol file, plain
+// or gzip compressed, into the database
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the TOML configuration file")
+	dbPath := fs.String("db", "", "database file, defaults to the configured storage path")
+	database := fs.String("database", persistence.DefaultDatabase, "database receiving points not preceded by a CONTEXT-DATABASE comment")
+	batchSize := fs.Int("batch-size", export.DefaultImportBatchSize, "lines stored per transaction")
+	fs.Usage = func() {
+		fs.Output().Write([]byte("usage: refluxdb import [flags] <file|->\n"))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var r io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Failed to open input file: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	db := openDB(*configPath, *dbPath)
+	defer db.Close()
+
+	stats, err := export.Import(r, db, export.ImportOptions{Database: *database, BatchSize: *batchSize})
+	if err != nil {
+		log.Fatalf("Import failed after %d points: %v", stats.Points, err)
+	}
+	log.Printf("Imported %d points, skipped %d lines", stats.Points, stats.Dropped)
+}
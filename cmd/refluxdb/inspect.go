@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// runInspect implements "refluxdb inspect", summarizing the contents and
+// disk usage of a database file without going through the server
+func runInspect(args []string) {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the TOML configuration file")
+	dbPath := fs.String("db", "", "database file, defaults to the configured storage path")
+	database := fs.String("database", "", "database to report, all when empty")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	fs.Usage = func() {
+		fs.Output().Write([]byte("usage: refluxdb inspect [flags]\n"))
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db := openDB(*configPath, *dbPath)
+	defer db.Close()
+
+	report, err := db.Inspect(context.Background())
+	if err != nil {
+		log.Fatalf("Failed to inspect database: %v", err)
+	}
+	if *database != "" {
+		var selected []persistence.DatabaseStats
+		for _, d := range report.Databases {
+			if d.Name == *database {
+				selected = append(selected, d)
+			}
+		}
+		if len(selected) == 0 {
+			log.Fatalf("Database %s not found", *database)
+		}
+		report.Databases = selected
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatalf("Failed to write report: %v", err)
+		}
+		return
+	}
+	printInspection(os.Stdout, report)
+}
+
+// printInspection writes a report as tables
+func printInspection(w io.Writer, report persistence.Inspection) {
+	for _, d := range report.Databases {
+		var series, points int64
+		for _, m := range d.Measurements {
+			series += m.Series
+			points += m.Points
+		}
+		fmt.Fprintf(w, "Database %s: %d measurements, %d series, %d points, %d shards (%d packed, %d tiered)\n",
+			d.Name, len(d.Measurements), series, points, d.Shards, d.PackedShards, d.TieredShards)
+		if len(d.Measurements) == 0 {
+			fmt.Fprintln(w)
+			continue
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "  MEASUREMENT\tSERIES\tPOINTS\tFIRST\tLAST")
+		for _, m := range d.Measurements {
+			fmt.Fprintf(tw, "  %s\t%d\t%d\t%s\t%s\n", m.Name, m.Series, m.Points, formatNanos(m.Points, m.MinTime), formatNanos(m.Points, m.MaxTime))
+		}
+		tw.Flush()
+		fmt.Fprintln(w)
+	}
+
+	disk := report.Disk
+	fmt.Fprintf(w, "Disk usage: %s\n", formatBytes(disk.Total))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, part := range []struct {
+		name string
+		size int64
+	}{
+		{"Point rows", disk.Rows},
+		{"Packed blocks", disk.Blocks},
+		{"Series dictionary", disk.Series},
+		{"Free pages", disk.Free},
+		{"Indexes and overhead", disk.Other},
+	} {
+		percent := 0.0
+		if disk.Total > 0 {
+			percent = float64(part.size) * 100 / float64(disk.Total)
+		}
+		fmt.Fprintf(tw, "  %s\t%10s\t%5.1f%%\n", part.name, formatBytes(part.size), percent)
+	}
+	tw.Flush()
+}
+
+// formatNanos renders a timestamp as RFC3339, or "-" when there are no
+// points
+func formatNanos(points, ns int64) string {
+	if points == 0 {
+		return "-"
+	}
+	return time.Unix(0, ns).UTC().Format(time.RFC3339)
+}
+
+// formatBytes renders a size with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
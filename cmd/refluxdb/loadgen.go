@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/loadgen"
+	"github.com/gleicon/go-refluxdb/pkg/client"
+)
+
+// runLoadgen implements "refluxdb loadgen", writing synthetic points and
+// sending a mix of queries to a running server at fixed rates, then
+// printing the latency percentiles of every operation. It runs for
+// -duration, or until interrupted when it is zero, which makes it usable
+// as a soak test.
+func runLoadgen(args []string) {
+	fs := flag.NewFlagSet("loadgen", flag.ExitOnError)
+	host := fs.String("host", "http://localhost:8086", "URL of the refluxdb server")
+	token := fs.String("token", "", "API token sent with every request")
+	database := fs.String("db", "loadgen", "database written to and queried")
+	series := fs.Int("series", 1000, "number of series written to")
+	rate := fs.Float64("rate", 10000, "points written per second, 0 disables writes")
+	batchSize := fs.Int("batch-size", 1000, "points per write request")
+	writers := fs.Int("writers", 4, "write requests in flight at most")
+	queryRate := fs.Float64("query-rate", 10, "queries per second, 0 disables queries")
+	mix := fs.String("queries", "range=4,last=4,aggregate=1,all-series=1", "weights of the queries sent")
+	queriers := fs.Int("queriers", 4, "queries in flight at most")
+	duration := fs.Duration("duration", time.Minute, "how long to run, until interrupted when 0")
+	timeout := fs.Duration("timeout", client.DefaultTimeout, "timeout of every request")
+	seed := fs.Int64("seed", time.Now().UnixNano(), "seed of the values written and the queries picked")
+	fs.Parse(args)
+
+	queries, err := loadgen.ParseMix(*mix)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := client.New(*host, client.Options{
+		Token: *token,
+		HTTPClient: &http.Client{
+			Timeout: *timeout,
+			// Keep a connection per request in flight
+			Transport: &http.Transport{MaxIdleConnsPerHost: *writers + *queriers},
+		},
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := c.Ping(ctx); err != nil {
+		log.Fatalf("Failed to connect to %s: %v", *host, err)
+	}
+	log.Printf("Writing %.0f points/s to %d series and sending %.1f queries/s to %s", *rate, *series, *queryRate, *host)
+
+	report, err := loadgen.Run(ctx, c, loadgen.Options{
+		Database:  *database,
+		Series:    *series,
+		Rate:      *rate,
+		BatchSize: *batchSize,
+		Writers:   *writers,
+		QueryRate: *queryRate,
+		Mix:       queries,
+		Queriers:  *queriers,
+		Duration:  *duration,
+		Seed:      *seed,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	printLoadReport(report)
+}
+
+// printLoadReport writes the stats of every operation as a table, writes
+// first, followed by the first error of the operations that failed
+func printLoadReport(report *loadgen.Report) {
+	ops := make([]string, 0, len(report.Operations))
+	for op := range report.Operations {
+		if op != "write" {
+			ops = append(ops, op)
+		}
+	}
+	sort.Strings(ops)
+	if _, ok := report.Operations["write"]; ok {
+		ops = append([]string{"write"}, ops...)
+	}
+
+	seconds := report.Elapsed.Seconds()
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "operation\trequests\treq/s\terrors\tmissed\tp50\tp90\tp99\tmax\t")
+	for _, op := range ops {
+		s := report.Operations[op]
+		fmt.Fprintf(tw, "%s\t%d\t%.1f\t%d\t%d\t%s\t%s\t%s\t%s\t\n", op, s.Requests, float64(s.Requests)/seconds, s.Errors, s.Missed,
+			roundLatency(s.Percentile(0.5)), roundLatency(s.Percentile(0.9)), roundLatency(s.Percentile(0.99)), roundLatency(s.Max()))
+	}
+	tw.Flush()
+
+	if w, ok := report.Operations["write"]; ok {
+		fmt.Printf("\n%d points written in %s, %.0f points/s\n", w.Points, report.Elapsed.Round(time.Millisecond), float64(w.Points)/seconds)
+	}
+	for _, op := range ops {
+		if err := report.Operations[op].FirstError; err != nil {
+			fmt.Printf("first %s error: %v\n", op, err)
+		}
+	}
+}
+
+// roundLatency rounds a latency for display
+func roundLatency(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(10 * time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	default:
+		return d.Round(10 * time.Nanosecond)
+	}
+}
@@ -2,58 +2,158 @@ package main
 
 import (
 	"context"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
-	"sync"
+	"runtime/debug"
 	"syscall"
 	"time"
+	// tz() clauses load time zones, which minimal images do not ship
+	_ "time/tzdata"
 
-	"github.com/gleicon/go-refluxdb/internal/persistence"
-	"github.com/gleicon/go-refluxdb/internal/server"
-	"github.com/gleicon/go-refluxdb/internal/udp"
+	"github.com/gleicon/go-refluxdb/internal/config"
+	"github.com/gleicon/go-refluxdb/pkg/refluxdb"
+	"github.com/sirupsen/logrus"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "import":
+			runImport(os.Args[2:])
+			return
+		case "compress":
+			runCompress(os.Args[2:])
+			return
+		case "inspect":
+			runInspect(os.Args[2:])
+			return
+		case "query":
+			runQuery(os.Args[2:])
+			return
+		case "token":
+			runToken(os.Args[2:])
+			return
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "backup":
+			runBackup(os.Args[2:])
+			return
+		case "loadgen":
+			runLoadgen(os.Args[2:])
+			return
+		}
+	}
+
+	configPath := flag.String("config", "", "path to the TOML configuration file")
+	flag.Parse()
+
 	log.Println("Starting go-refluxdb...")
 
-	// Create context for graceful shutdown
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	cfg := loadConfig(*configPath)
 
-	// Initialize persistence layer
-	db, err := persistence.New("timeseries.db")
-	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+	// The UDP listener and storage layer log through the standard logger,
+	// so configuring it covers every component
+	logger := logrus.StandardLogger()
+	if err := cfg.Logging.Configure(logger); err != nil {
+		log.Fatalf("Failed to configure logging: %v", err)
 	}
-	defer db.Close()
 
-	// Initialize servers
-	httpServer := server.New(":8086", db)
-	udpServer := udp.New(":8089", db)
+	// GOMEMLIMIT set in the environment takes precedence, as for any Go
+	// program. The memory budget of the ingest pipeline derives from it.
+	if cfg.Write.MemoryLimit > 0 && os.Getenv("GOMEMLIMIT") == "" {
+		debug.SetMemoryLimit(cfg.Write.MemoryLimit)
+	}
 
-	// WaitGroup for graceful shutdown
-	var wg sync.WaitGroup
+	storage, err := refluxdb.OpenStorageWithOptions(cfg.Storage.Path, refluxdb.StorageOptions{
+		Write:  cfg.IngestOptions(),
+		SQLite: cfg.StorageOptions(),
+	})
+	if err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
 
-	// Start HTTP server
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if err := httpServer.Start(ctx); err != nil {
-			log.Printf("HTTP server error: %v", err)
+	opts := refluxdb.Options{
+		HTTPAddr:               cfg.HTTP.BindAddress,
+		DebugToken:             cfg.HTTP.DebugToken,
+		AuthEnabled:            cfg.HTTP.AuthEnabled,
+		Allow:                  cfg.HTTP.Allow,
+		Deny:                   cfg.HTTP.Deny,
+		Write:                  cfg.IngestOptions(),
+		MemoryBudget:           cfg.Write.MemoryBudget,
+		MaxDeadLetters:         cfg.Write.MaxDeadLetters,
+		DedupWindow:            time.Duration(cfg.Write.DedupWindow),
+		DedupMaxPoints:         cfg.Write.DedupMaxPoints,
+		Tenants:                cfg.Tenants(),
+		TenantIdleTimeout:      time.Duration(cfg.Storage.TenantIdleTimeout),
+		DefaultOrg:             cfg.Org.Default,
+		QueryTimeout:           time.Duration(cfg.Query.Timeout),
+		MaxConcurrentQueries:   cfg.Query.MaxConcurrent,
+		MaxQueuedQueries:       cfg.Query.MaxQueued,
+		QueueTimeout:           time.Duration(cfg.Query.QueueTimeout),
+		RetentionCheckInterval: time.Duration(cfg.Retention.CheckInterval),
+		IntegrityCheckInterval: time.Duration(cfg.Storage.IntegrityCheckInterval),
+		SlowQueryThreshold:     time.Duration(cfg.Query.SlowQueryThreshold),
+		SlowQueryBuffer:        cfg.Query.SlowQueryBuffer,
+		Logger:                 logger,
+	}
+	if cfg.Query.SlowQueryLog != "" {
+		f, err := os.OpenFile(cfg.Query.SlowQueryLog, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatalf("Failed to open slow query log: %v", err)
 		}
-	}()
+		defer f.Close()
+		opts.SlowQueryLog = logrus.New()
+		opts.SlowQueryLog.SetOutput(f)
+		opts.SlowQueryLog.SetFormatter(&logrus.JSONFormatter{})
+	}
+	if cfg.Monitor.StoreEnabled {
+		opts.MonitorInterval = time.Duration(cfg.Monitor.StoreInterval)
+		opts.MonitorDatabase = cfg.Monitor.StoreDatabase
+	}
+	if cfg.Tracing.Endpoint != "" {
+		tracing := cfg.TracingOptions()
+		opts.Tracing = &tracing
+	}
+	// Load validated the schedule already
+	opts.Compaction, _ = cfg.CompactionSchedule()
+	if cfg.Tiering.Age > 0 {
+		opts.TieringInterval = time.Duration(cfg.Tiering.CheckInterval)
+	}
+	opts.Checks, opts.AlertEndpoints = cfg.AlertChecks()
+	opts.Replications = cfg.Replications()
+	opts.Enrichment = cfg.EnrichRules()
+	for _, u := range cfg.UDP {
+		write := cfg.UDPIngestOptions(u)
+		opts.UDP = append(opts.UDP, refluxdb.UDPListener{
+			Addr:              u.BindAddress,
+			Database:          u.Database,
+			MeasurementPrefix: u.MeasurementPrefix,
+			BufferSize:        u.BufferSize,
+			ReadQueue:         u.ReadQueue,
+			Readers:           u.Readers,
+			Parsers:           u.Parsers,
+			Batch:             u.BatchOptions(),
+			Write:             &write,
+			Allow:             u.Allow,
+			Deny:              u.Deny,
+			StatsInterval:     time.Duration(u.StatsInterval),
+		})
+	}
 
-	// Start UDP server
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		if addr, err := udpServer.Start(ctx); err != nil {
-			log.Printf("UDP server error: %v", err)
-		} else {
-			log.Printf("UDP server started on %s", addr)
-		}
-	}()
+	srv, err := refluxdb.NewServer(storage, opts)
+	if err != nil {
+		log.Fatalf("Failed to initialize server: %v", err)
+	}
+	if err := srv.Start(context.Background()); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+	log.Printf("HTTP API listening on %s, UDP listeners on %v", srv.HTTPAddr(), srv.UDPAddrs())
 
 	// Setup signal handling
 	sigChan := make(chan os.Signal, 1)
@@ -62,24 +162,37 @@ func main() {
 	// Wait for shutdown signal
 	sig := <-sigChan
 	log.Printf("Received signal %v, initiating graceful shutdown...", sig)
-
-	// Cancel context to initiate shutdown
-	cancel()
-
-	// Wait for servers to shutdown with timeout
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer shutdownCancel()
-
-	done := make(chan struct{})
 	go func() {
-		wg.Wait()
-		close(done)
+		sig := <-sigChan
+		log.Fatalf("Received signal %v again, exiting without a graceful shutdown", sig)
 	}()
 
-	select {
-	case <-shutdownCtx.Done():
-		log.Println("Shutdown timed out")
-	case <-done:
+	// Stop accepting writes, wait for the ones in flight and flush the
+	// points still being batched before the storage is closed
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancel()
+	shutdownErr := srv.Shutdown(shutdownCtx)
+	if shutdownErr != nil {
+		log.Printf("Shutdown error: %v", shutdownErr)
+	}
+	if err := storage.Close(); err != nil {
+		log.Printf("Failed to close storage: %v", err)
+		return
+	}
+	if shutdownErr == nil {
 		log.Println("Graceful shutdown completed")
 	}
 }
+
+// loadConfig loads the configuration file at path, or the defaults when
+// path is empty
+func loadConfig(path string) *config.Config {
+	if path == "" {
+		return config.Default()
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	return cfg
+}
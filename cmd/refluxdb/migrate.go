@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// runMigrate implements "refluxdb migrate", renaming a measurement or
+// adding, renaming or dropping a tag across the history of a database
+// directly in the database file. An interrupted migration is finished by
+// running it again.
+func runMigrate(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the TOML configuration file")
+	dbPath := fs.String("db", "", "database file, defaults to the configured storage path")
+	database := fs.String("database", "", "database (bucket) to migrate")
+	measurement := fs.String("measurement", "", "measurement to rename, or to limit a tag migration to")
+	tag := fs.String("tag", "", "tag key to add, rename or drop")
+	value := fs.String("value", "", "value of the added tag")
+	to := fs.String("to", "", "new name of the measurement or tag key")
+	fs.Usage = func() {
+		fs.Output().Write([]byte("usage: refluxdb migrate rename-measurement -database <db> -measurement <name> -to <name> [flags]\n" +
+			"       refluxdb migrate add-tag -database <db> -tag <key> -value <value> [flags]\n" +
+			"       refluxdb migrate rename-tag -database <db> -tag <key> -to <key> [flags]\n" +
+			"       refluxdb migrate drop-tag -database <db> -tag <key> [flags]\n"))
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	fs.Parse(args[1:])
+
+	rewrite := persistence.Rewrite{
+		Kind:        args[0],
+		Database:    *database,
+		Measurement: *measurement,
+		Tag:         *tag,
+		Value:       *value,
+		To:          *to,
+	}
+	if err := rewrite.Validate(); fs.NArg() != 0 || err != nil {
+		if err != nil {
+			log.Print(err)
+		}
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	db := openDB(*configPath, *dbPath)
+	defer db.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	p, err := db.RewriteSeries(ctx, rewrite, func(p persistence.RewriteProgress) {
+		log.Printf("%d/%d series examined, %d rewritten, %d merged", p.Done, p.Series, p.Rewritten, p.Merged)
+	})
+	if err != nil {
+		log.Fatalf("Migration failed after %d of %d series, run it again to finish: %v", p.Done, p.Series, err)
+	}
+	log.Printf("Rewrote %d series of %s, %d merged into existing series with %d points moved", p.Rewritten, *database, p.Merged, p.PointsMoved)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/lineedit"
+	"github.com/gleicon/go-refluxdb/pkg/client"
+)
+
+const queryHelp = `Usage:
+  use <db>               run the next statements against <db>
+  precision <format>     show times as rfc3339 or ns
+  history                list the statements entered so far
+  exit, quit             leave the shell
+
+Any other input is sent to the server as an InfluxQL statement.
+`
+
+// queryShell holds the state of a "refluxdb query" session
+type queryShell struct {
+	client    *client.Client
+	database  string
+	precision string
+	out       io.Writer
+}
+
+// runQuery implements "refluxdb query", an interactive InfluxQL shell
+// talking to a running server over HTTP
+func runQuery(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	host := fs.String("host", "http://localhost:8086", "URL of the refluxdb server")
+	database := fs.String("db", "", "database of the statements")
+	token := fs.String("token", "", "API token sent with every request")
+	precision := fs.String("precision", "rfc3339", "format of times: rfc3339 or ns")
+	execute := fs.String("execute", "", "run the statement, print its result and exit")
+	fs.Parse(args)
+
+	sh := &queryShell{
+		client:   client.New(*host, client.Options{Token: *token}),
+		database: *database,
+		out:      os.Stdout,
+	}
+	if err := sh.setPrecision(*precision); err != nil {
+		log.Fatal(err)
+	}
+
+	if *execute != "" {
+		if err := sh.run(*execute); err != nil {
+			log.Fatalf("ERR: %v", err)
+		}
+		return
+	}
+
+	if err := sh.client.Ping(context.Background()); err != nil {
+		log.Fatalf("Failed to connect to %s: %v", *host, err)
+	}
+	fmt.Fprintf(sh.out, "Connected to %s\nType \"help\" for the shell commands.\n", *host)
+
+	reader := lineedit.New(os.Stdin, os.Stdout)
+	historyPath := ""
+	if home, err := os.UserHomeDir(); err == nil {
+		historyPath = filepath.Join(home, ".refluxdb_history")
+		if err := reader.LoadHistory(historyPath); err != nil {
+			log.Printf("Failed to load history: %v", err)
+		}
+	}
+
+	for {
+		line, err := reader.ReadLine("> ")
+		if errors.Is(err, lineedit.ErrInterrupt) {
+			continue
+		}
+		if err != nil {
+			break
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		reader.AddHistory(line)
+
+		switch cmd := strings.ToLower(strings.Fields(line)[0]); cmd {
+		case "exit", "quit":
+			sh.saveHistory(reader, historyPath)
+			return
+		case "help":
+			fmt.Fprint(sh.out, queryHelp)
+		case "history":
+			for _, h := range reader.History() {
+				fmt.Fprintln(sh.out, h)
+			}
+		default:
+			if err := sh.run(line); err != nil {
+				fmt.Fprintf(sh.out, "ERR: %v\n", err)
+			}
+		}
+	}
+	sh.saveHistory(reader, historyPath)
+}
+
+// saveHistory writes the history file, when there is one
+func (sh *queryShell) saveHistory(reader *lineedit.Reader, path string) {
+	if path == "" {
+		return
+	}
+	if err := reader.SaveHistory(path); err != nil {
+		log.Printf("Failed to save history: %v", err)
+	}
+}
+
+// setPrecision changes how time columns are printed
+func (sh *queryShell) setPrecision(precision string) error {
+	switch p := strings.ToLower(precision); p {
+	case "rfc3339", "ns":
+		sh.precision = p
+		return nil
+	default:
+		return fmt.Errorf("unknown precision %q: expected rfc3339 or ns", precision)
+	}
+}
+
+// run executes a shell statement. USE and PRECISION change the session,
+// anything else is sent to the server, and can be interrupted with Ctrl-C.
+func (sh *queryShell) run(line string) error {
+	fields := strings.Fields(line)
+	switch strings.ToLower(fields[0]) {
+	case "precision":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: precision <rfc3339|ns>")
+		}
+		return sh.setPrecision(fields[1])
+	case "use":
+		if len(fields) != 2 {
+			return fmt.Errorf("usage: use <db>")
+		}
+		database := strings.Trim(strings.TrimSuffix(fields[1], ";"), `"`)
+		// The server checks the database exists
+		if _, err := sh.query("", "USE "+database); err != nil {
+			return err
+		}
+		sh.database = database
+		fmt.Fprintf(sh.out, "Using database %s\n", database)
+		return nil
+	}
+
+	series, err := sh.query(sh.database, line)
+	if err != nil {
+		return err
+	}
+	sh.print(series)
+	return nil
+}
+
+// query sends a statement, canceling it when Ctrl-C is pressed
+func (sh *queryShell) query(database, statement string) ([]client.Series, error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	return sh.client.Query(ctx, database, statement)
+}
+
+// print writes series as tables, like the influx CLI
+func (sh *queryShell) print(series []client.Series) {
+	for i, s := range series {
+		if i > 0 {
+			fmt.Fprintln(sh.out)
+		}
+		if s.Name != "" {
+			fmt.Fprintf(sh.out, "name: %s\n", s.Name)
+		}
+		if len(s.Tags) > 0 {
+			keys := make([]string, 0, len(s.Tags))
+			for k := range s.Tags {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			tags := make([]string, len(keys))
+			for j, k := range keys {
+				tags[j] = k + "=" + s.Tags[k]
+			}
+			fmt.Fprintf(sh.out, "tags: %s\n", strings.Join(tags, ", "))
+		}
+
+		tw := tabwriter.NewWriter(sh.out, 0, 0, 1, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(s.Columns, "\t"))
+		underline := make([]string, len(s.Columns))
+		for j, c := range s.Columns {
+			underline[j] = strings.Repeat("-", len(c))
+		}
+		fmt.Fprintln(tw, strings.Join(underline, "\t"))
+		for _, row := range s.Values {
+			cells := make([]string, len(row))
+			for j, v := range row {
+				cells[j] = sh.formatValue(j < len(s.Columns) && s.Columns[j] == "time", v)
+			}
+			fmt.Fprintln(tw, strings.Join(cells, "\t"))
+		}
+		tw.Flush()
+	}
+}
+
+// formatValue renders a cell, converting nanosecond times to RFC3339
+// unless the precision is ns
+func (sh *queryShell) formatValue(isTime bool, v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	if n, ok := v.(json.Number); ok && isTime && sh.precision == "rfc3339" {
+		if ns, err := n.Int64(); err == nil {
+			return time.Unix(0, ns).UTC().Format(time.RFC3339Nano)
+		}
+	}
+	return fmt.Sprint(v)
+}
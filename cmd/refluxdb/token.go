@@ -0,0 +1,118 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// scopeFlags collects the repeated -scope flags
+type scopeFlags []string
+
+func (f *scopeFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *scopeFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// runToken implements "refluxdb token create|list|delete|quota", managing the
+// API tokens directly in the database file, which is how the first admin
+// token is created once authentication is enabled
+func runToken(args []string) {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to the TOML configuration file")
+	dbPath := fs.String("db", "", "database file, defaults to the configured storage path")
+	description := fs.String("description", "", "description of the created token")
+	var scopes scopeFlags
+	fs.Var(&scopes, "scope", "scope of the created token: admin, read:<database> or write:<database>, * matching every database; repeatable")
+	var q persistence.Quota
+	fs.Float64Var(&q.PointsPerSecond, "points-per-second", 0, "points written per second with the token, 0 for unlimited")
+	fs.Int64Var(&q.Burst, "burst", 0, "points written at once above points-per-second, 0 for one second of points")
+	fs.Int64Var(&q.BytesPerDay, "bytes-per-day", 0, "bytes of write bodies per UTC day with the token, 0 for unlimited")
+	fs.Usage = func() {
+		fs.Output().Write([]byte("usage: refluxdb token create -scope <scope> [flags]\n       refluxdb token list [flags]\n       refluxdb token delete [flags] <id>\n       refluxdb token quota [flags] <id>\n"))
+		fs.PrintDefaults()
+	}
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	command := args[0]
+	fs.Parse(args[1:])
+
+	switch {
+	case command == "create" && fs.NArg() == 0 && len(scopes) > 0:
+		db := openDB(*configPath, *dbPath)
+		defer db.Close()
+		if err := q.Validate(); err != nil {
+			log.Fatalf("Failed to create token: %v", err)
+		}
+		token, secret, err := db.AddToken(*description, scopes)
+		if err != nil {
+			log.Fatalf("Failed to create token: %v", err)
+		}
+		if err := db.SetTokenQuota(token.ID, q); err != nil {
+			log.Fatalf("Failed to set token quota: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Created token %s with scopes %s\n", token.ID, strings.Join(token.Scopes, ", "))
+		// The secret alone goes to stdout so that it can be captured
+		fmt.Println(secret)
+	case command == "list" && fs.NArg() == 0:
+		db := openDB(*configPath, *dbPath)
+		defer db.Close()
+		tokens, err := db.Tokens()
+		if err != nil {
+			log.Fatalf("Failed to list tokens: %v", err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tSCOPES\tCREATED\tQUOTA\tDESCRIPTION")
+		for _, t := range tokens {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.ID, strings.Join(t.Scopes, ","), t.CreatedAt.Format(time.RFC3339), formatQuota(t.Quota), t.Description)
+		}
+		w.Flush()
+	case command == "quota" && fs.NArg() == 1:
+		db := openDB(*configPath, *dbPath)
+		defer db.Close()
+		if err := db.SetTokenQuota(fs.Arg(0), q); err != nil {
+			log.Fatalf("Failed to set token quota: %v", err)
+		}
+		fmt.Fprintf(os.Stderr, "Set quota of token %s to %s\n", fs.Arg(0), formatQuota(q))
+	case command == "delete" && fs.NArg() == 1:
+		db := openDB(*configPath, *dbPath)
+		defer db.Close()
+		if err := db.DeleteToken(fs.Arg(0)); err != nil {
+			log.Fatalf("Failed to delete token: %v", err)
+		}
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+// formatQuota describes the limits of q, "-" when it has none
+func formatQuota(q persistence.Quota) string {
+	var limits []string
+	if q.PointsPerSecond > 0 {
+		limit := fmt.Sprintf("%g points/s", q.PointsPerSecond)
+		if q.Burst > 0 {
+			limit += fmt.Sprintf(" (burst %d)", q.Burst)
+		}
+		limits = append(limits, limit)
+	}
+	if q.BytesPerDay > 0 {
+		limits = append(limits, fmt.Sprintf("%d bytes/day", q.BytesPerDay))
+	}
+	if len(limits) == 0 {
+		return "-"
+	}
+	return strings.Join(limits, ", ")
+}
@@ -0,0 +1,100 @@
+// Package acl filters clients by their source address with CIDR allow and
+// deny lists, so that a listener bound to an exposed interface only
+// accepts, for instance, the monitoring subnet.
+package acl
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// List decides which source addresses are accepted. A nil List accepts
+// every address.
+type List struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// New returns a list accepting the addresses matching allow, or every
+// address when allow is empty, except those matching deny. Entries are
+// CIDR prefixes such as 10.0.0.0/8 or single addresses. New returns nil
+// when both lists are empty.
+func New(allow, deny []string) (*List, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	l := &List{}
+	var err error
+	if l.allow, err = parsePrefixes(allow); err != nil {
+		return nil, fmt.Errorf("invalid allow list: %w", err)
+	}
+	if l.deny, err = parsePrefixes(deny); err != nil {
+		return nil, fmt.Errorf("invalid deny list: %w", err)
+	}
+	return l, nil
+}
+
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%q is neither an address nor a CIDR prefix", entry)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither an address nor a CIDR prefix", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Allows reports whether addr is accepted. Deny entries take precedence
+// over allow entries, and IPv4-mapped IPv6 addresses match IPv4 entries.
+func (l *List) Allows(addr netip.Addr) bool {
+	if l == nil {
+		return true
+	}
+	addr = addr.Unmap().WithZone("")
+	for _, p := range l.deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(l.allow) == 0 {
+		return true
+	}
+	for _, p := range l.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsHost reports whether the host of a host:port address, such as
+// the RemoteAddr of an HTTP request, is accepted. Unparsable addresses are
+// only accepted by a nil List.
+func (l *List) AllowsHost(hostport string) bool {
+	if l == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	return l.Allows(addr)
+}
@@ -0,0 +1,50 @@
+package acl
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestList(t *testing.T) {
+	l, err := New([]string{"10.0.0.0/8", "192.168.1.7", "fd00::/8"}, []string{"10.9.0.0/16"})
+	assert.NoError(t, err)
+
+	for addr, allowed := range map[string]bool{
+		"10.1.2.3":        true,
+		"10.9.1.1":        false,
+		"192.168.1.7":     true,
+		"192.168.1.8":     false,
+		"::ffff:10.1.2.3": true,
+		"fd12::1":         true,
+		"fe80::1%eth0":    false,
+		"2001:db8::1":     false,
+		"::ffff:10.9.1.1": false,
+		"127.0.0.1":       false,
+	} {
+		assert.Equal(t, allowed, l.Allows(netip.MustParseAddr(addr)), addr)
+	}
+
+	assert.True(t, l.AllowsHost("10.1.2.3:5000"))
+	assert.True(t, l.AllowsHost("[fd12::1]:5000"))
+	assert.False(t, l.AllowsHost("10.9.1.1:5000"))
+	assert.False(t, l.AllowsHost("bogus"))
+
+	// Deny lists alone accept every other address
+	l, err = New(nil, []string{"0.0.0.0/0"})
+	assert.NoError(t, err)
+	assert.False(t, l.Allows(netip.MustParseAddr("8.8.8.8")))
+	assert.True(t, l.Allows(netip.MustParseAddr("2001:db8::1")))
+
+	l, err = New(nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, l)
+	assert.True(t, l.Allows(netip.MustParseAddr("8.8.8.8")))
+	assert.True(t, l.AllowsHost("bogus"))
+
+	_, err = New([]string{"10.0.0.0/33"}, nil)
+	assert.Error(t, err)
+	_, err = New(nil, []string{"example.com"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,484 @@
+// Package alerts evaluates threshold checks against the stored points on a
+// schedule and notifies webhook and Slack endpoints when a check changes
+// level, a minimal take on what Kapacitor does for InfluxDB.
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	checksEvaluated    = metrics.NewCounter("refluxdb_alerts_checks_evaluated_total", "Check evaluations")
+	notificationsSent  = metrics.NewCounter("refluxdb_alerts_notifications_sent_total", "Notifications delivered to endpoints")
+	notificationErrors = metrics.NewCounter("refluxdb_alerts_notification_errors_total", "Notifications that could not be delivered")
+)
+
+// Check levels, named like the InfluxDB v2 check statuses
+const (
+	LevelOK   = "ok"
+	LevelCrit = "crit"
+	// LevelUnknown is reported when the window holds no points or the
+	// check could not be evaluated
+	LevelUnknown = "unknown"
+)
+
+// Endpoint types
+const (
+	// EndpointWebhook receives a JSON document describing the check
+	EndpointWebhook = "webhook"
+	// EndpointSlack is a Slack incoming webhook receiving the message
+	EndpointSlack = "slack"
+)
+
+// DefaultNotifyTimeout bounds the delivery of a notification
+const DefaultNotifyTimeout = 10 * time.Second
+
+// aggregations lists the supported aggregation functions
+var aggregations = map[string]bool{
+	"mean": true, "sum": true, "count": true, "min": true, "max": true, "first": true, "last": true,
+}
+
+// operators compare the aggregated value with the threshold
+var operators = map[string]func(v, threshold float64) bool{
+	">":  func(v, t float64) bool { return v > t },
+	">=": func(v, t float64) bool { return v >= t },
+	"<":  func(v, t float64) bool { return v < t },
+	"<=": func(v, t float64) bool { return v <= t },
+	"==": func(v, t float64) bool { return v == t },
+	"!=": func(v, t float64) bool { return v != t },
+}
+
+// Check aggregates a field over a trailing window and goes critical when
+// the result crosses a threshold
+type Check struct {
+	// Name identifies the check in the API and notifications
+	Name        string
+	Database    string
+	Measurement string
+	Field       string
+	// Tags restricts the check to the series with these tag values
+	Tags map[string]string
+	// Aggregation is mean, sum, count, min, max, first or last
+	Aggregation string
+	// Operator is >, >=, <, <=, == or !=. The check is critical when
+	// "value Operator Threshold" holds.
+	Operator  string
+	Threshold float64
+	// Window is how far back the points are aggregated
+	Window time.Duration
+	// Every is how often the check runs
+	Every time.Duration
+	// Notify names the endpoints told about level changes
+	Notify []string
+}
+
+// Endpoint receives the notifications of the checks naming it
+type Endpoint struct {
+	Name string
+	// Type is EndpointWebhook or EndpointSlack
+	Type string
+	URL  string
+}
+
+// Status is the outcome of the latest evaluation of a check
+type Status struct {
+	Check Check
+	// Level is LevelOK, LevelCrit or LevelUnknown. It is empty until the
+	// check ran once.
+	Level string
+	// Value is the aggregated value, and HasValue false when the window
+	// held no points
+	Value    float64
+	HasValue bool
+	Message  string
+	// Err is the error of the latest evaluation
+	Err string
+	// LastRun is when the check last ran, and LastChange when its level
+	// last changed
+	LastRun    time.Time
+	LastChange time.Time
+}
+
+// Options configures a Service
+type Options struct {
+	// NotifyTimeout bounds the delivery of a notification
+	NotifyTimeout time.Duration
+	// Logger receives evaluation and delivery errors. The standard logrus
+	// logger is used when nil.
+	Logger *logrus.Logger
+}
+
+// Validate checks that every check is complete and only notifies declared
+// endpoints
+func Validate(checks []Check, endpoints []Endpoint) error {
+	names := make(map[string]bool)
+	for _, e := range endpoints {
+		if e.Name == "" {
+			return fmt.Errorf("endpoint name is required")
+		}
+		if names[e.Name] {
+			return fmt.Errorf("duplicate endpoint %q", e.Name)
+		}
+		names[e.Name] = true
+		if e.Type != EndpointWebhook && e.Type != EndpointSlack {
+			return fmt.Errorf("invalid type %q of endpoint %s: expected webhook or slack", e.Type, e.Name)
+		}
+		u, err := url.Parse(e.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid url %q of endpoint %s: expected an http or https URL", e.URL, e.Name)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, c := range checks {
+		if c.Name == "" {
+			return fmt.Errorf("check name is required")
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("duplicate check %q", c.Name)
+		}
+		seen[c.Name] = true
+		if c.Database == "" || c.Measurement == "" || c.Field == "" {
+			return fmt.Errorf("check %s needs a database, measurement and field", c.Name)
+		}
+		if !aggregations[c.Aggregation] {
+			return fmt.Errorf("invalid aggregation %q of check %s: expected mean, sum, count, min, max, first or last", c.Aggregation, c.Name)
+		}
+		if _, ok := operators[c.Operator]; !ok {
+			return fmt.Errorf("invalid operator %q of check %s: expected >, >=, <, <=, == or !=", c.Operator, c.Name)
+		}
+		if c.Window <= 0 || c.Every <= 0 {
+			return fmt.Errorf("check %s needs a positive window and every", c.Name)
+		}
+		for _, n := range c.Notify {
+			if !names[n] {
+				return fmt.Errorf("check %s notifies unknown endpoint %q", c.Name, n)
+			}
+		}
+	}
+	return nil
+}
+
+// Service runs the checks, each on its own schedule
+type Service struct {
+	db        *persistence.Manager
+	endpoints map[string]Endpoint
+	client    *http.Client
+	log       *logrus.Logger
+	now       func() time.Time
+
+	mu       sync.RWMutex
+	statuses map[string]*Status
+	// order lists the check names in configuration order
+	order []string
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New creates a service running checks against db
+func New(db *persistence.Manager, checks []Check, endpoints []Endpoint, opts Options) (*Service, error) {
+	if err := Validate(checks, endpoints); err != nil {
+		return nil, err
+	}
+	if opts.NotifyTimeout <= 0 {
+		opts.NotifyTimeout = DefaultNotifyTimeout
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+
+	s := &Service{
+		db:        db,
+		endpoints: make(map[string]Endpoint, len(endpoints)),
+		client:    &http.Client{Timeout: opts.NotifyTimeout},
+		log:       logger,
+		now:       time.Now,
+		statuses:  make(map[string]*Status, len(checks)),
+	}
+	for _, e := range endpoints {
+		s.endpoints[e.Name] = e
+	}
+	for _, c := range checks {
+		s.statuses[c.Name] = &Status{Check: c}
+		s.order = append(s.order, c.Name)
+	}
+	return s, nil
+}
+
+// Start runs every check right away, then every Check.Every, until ctx is
+// done or Stop is called
+func (s *Service) Start(ctx context.Context) {
+	ctx, s.cancel = context.WithCancel(ctx)
+	for _, name := range s.order {
+		check := s.statuses[name].Check
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			ticker := time.NewTicker(check.Every)
+			defer ticker.Stop()
+			for {
+				s.Run(ctx, check.Name)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
+			}
+		}()
+	}
+}
+
+// Stop stops the checks and waits for running evaluations
+func (s *Service) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+}
+
+// Statuses returns the status of every check in configuration order
+func (s *Service) Statuses() []Status {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	statuses := make([]Status, 0, len(s.order))
+	for _, name := range s.order {
+		statuses = append(statuses, *s.statuses[name])
+	}
+	return statuses
+}
+
+// Status returns the status of the named check
+func (s *Service) Status(name string) (Status, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	st, ok := s.statuses[name]
+	if !ok {
+		return Status{}, false
+	}
+	return *st, true
+}
+
+// Run evaluates the named check once and notifies its endpoints when its
+// level changed. The first evaluation only notifies a critical level.
+func (s *Service) Run(ctx context.Context, name string) {
+	s.mu.RLock()
+	st, ok := s.statuses[name]
+	s.mu.RUnlock()
+	if !ok {
+		return
+	}
+	check := st.Check
+
+	now := s.now()
+	value, hasValue, err := s.evaluate(ctx, check, now)
+	if ctx.Err() != nil {
+		return
+	}
+	checksEvaluated.Inc()
+
+	next := Status{Check: check, Value: value, HasValue: hasValue, LastRun: now}
+	switch {
+	case err != nil:
+		s.log.Errorf("Failed to evaluate check %s: %v", check.Name, err)
+		next.Level = LevelUnknown
+		next.Err = err.Error()
+	case !hasValue:
+		next.Level = LevelUnknown
+	case operators[check.Operator](value, check.Threshold):
+		next.Level = LevelCrit
+	default:
+		next.Level = LevelOK
+	}
+	next.Message = message(next)
+
+	s.mu.Lock()
+	previous := st.Level
+	next.LastChange = st.LastChange
+	if next.Level != previous {
+		next.LastChange = now
+	}
+	*st = next
+	s.mu.Unlock()
+
+	if next.Level != previous && (previous != "" || next.Level == LevelCrit) {
+		s.notify(ctx, next)
+	}
+}
+
+// evaluate aggregates the field over the window ending at now
+func (s *Service) evaluate(ctx context.Context, check Check, now time.Time) (float64, bool, error) {
+	var agg aggregate
+	agg.fn = check.Aggregation
+	err := s.db.ScanRangeContext(ctx, check.Database, check.Measurement, now.Add(-check.Window).UnixNano(), now.UnixNano(), func(p persistence.Point) error {
+		for k, v := range check.Tags {
+			if p.Tags[k] != v {
+				return nil
+			}
+		}
+		if v, ok := p.Fields[check.Field]; ok && !math.IsNaN(v) {
+			agg.add(p.Timestamp, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	v, ok := agg.value()
+	return v, ok, nil
+}
+
+// aggregate folds the values of a window
+type aggregate struct {
+	fn                  string
+	count               int64
+	sum, min, max       float64
+	first, last         float64
+	firstTime, lastTime int64
+}
+
+func (a *aggregate) add(ts int64, v float64) {
+	if a.count == 0 || ts < a.firstTime {
+		a.first, a.firstTime = v, ts
+	}
+	if a.count == 0 || ts >= a.lastTime {
+		a.last, a.lastTime = v, ts
+	}
+	if a.count == 0 || v < a.min {
+		a.min = v
+	}
+	if a.count == 0 || v > a.max {
+		a.max = v
+	}
+	a.sum += v
+	a.count++
+}
+
+// value returns the aggregated value, and false when nothing was added.
+// count is zero rather than missing over an empty window.
+func (a *aggregate) value() (float64, bool) {
+	if a.fn == "count" {
+		return float64(a.count), true
+	}
+	if a.count == 0 {
+		return 0, false
+	}
+	switch a.fn {
+	case "mean":
+		return a.sum / float64(a.count), true
+	case "sum":
+		return a.sum, true
+	case "min":
+		return a.min, true
+	case "max":
+		return a.max, true
+	case "first":
+		return a.first, true
+	default:
+		return a.last, true
+	}
+}
+
+// message describes a status for humans, e.g.
+// "cpu_high is CRIT: mean(usage) of cpu is 95.5 > 90 over the last 5m0s"
+func message(st Status) string {
+	c := st.Check
+	subject := fmt.Sprintf("%s(%s) of %s", c.Aggregation, c.Field, c.Measurement)
+	switch {
+	case st.Err != "":
+		return fmt.Sprintf("%s is UNKNOWN: %s", c.Name, st.Err)
+	case !st.HasValue:
+		return fmt.Sprintf("%s is UNKNOWN: no points for %s over the last %s", c.Name, subject, c.Window)
+	}
+	value := strconv.FormatFloat(st.Value, 'f', -1, 64)
+	threshold := strconv.FormatFloat(c.Threshold, 'f', -1, 64)
+	if st.Level == LevelCrit {
+		return fmt.Sprintf("%s is CRIT: %s is %s %s %s over the last %s", c.Name, subject, value, c.Operator, threshold, c.Window)
+	}
+	return fmt.Sprintf("%s is OK: %s is %s over the last %s", c.Name, subject, value, c.Window)
+}
+
+// notification is the JSON document posted to webhook endpoints
+type notification struct {
+	Check       string            `json:"check"`
+	Level       string            `json:"level"`
+	Message     string            `json:"message"`
+	Value       *float64          `json:"value"`
+	Threshold   float64           `json:"threshold"`
+	Database    string            `json:"database"`
+	Measurement string            `json:"measurement"`
+	Field       string            `json:"field"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Time        time.Time         `json:"time"`
+}
+
+// notify delivers a status to the endpoints of its check, in name order
+func (s *Service) notify(ctx context.Context, st Status) {
+	names := append([]string(nil), st.Check.Notify...)
+	sort.Strings(names)
+	for _, name := range names {
+		e := s.endpoints[name]
+		var body interface{}
+		if e.Type == EndpointSlack {
+			body = map[string]string{"text": st.Message}
+		} else {
+			n := notification{
+				Check:       st.Check.Name,
+				Level:       st.Level,
+				Message:     st.Message,
+				Threshold:   st.Check.Threshold,
+				Database:    st.Check.Database,
+				Measurement: st.Check.Measurement,
+				Field:       st.Check.Field,
+				Tags:        st.Check.Tags,
+				Time:        st.LastRun.UTC(),
+			}
+			if st.HasValue {
+				n.Value = &st.Value
+			}
+			body = n
+		}
+		if err := s.post(ctx, e.URL, body); err != nil {
+			notificationErrors.Inc()
+			s.log.Errorf("Failed to notify %s of check %s: %v", e.Name, st.Check.Name, err)
+			continue
+		}
+		notificationsSent.Inc()
+	}
+}
+
+func (s *Service) post(ctx context.Context, url string, body interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package alerts
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	endpoints := []Endpoint{{Name: "ops", Type: EndpointSlack, URL: "https://hooks.slack.com/services/x"}}
+	check := Check{Name: "cpu", Database: "db", Measurement: "cpu", Field: "usage", Aggregation: "mean", Operator: ">", Threshold: 90, Window: time.Minute, Every: time.Minute, Notify: []string{"ops"}}
+	assert.NoError(t, Validate([]Check{check}, endpoints))
+
+	for _, tc := range []struct {
+		name   string
+		modify func(*Check)
+	}{
+		{"aggregation", func(c *Check) { c.Aggregation = "median" }},
+		{"operator", func(c *Check) { c.Operator = "=>" }},
+		{"window", func(c *Check) { c.Window = 0 }},
+		{"field", func(c *Check) { c.Field = "" }},
+		{"endpoint", func(c *Check) { c.Notify = []string{"pager"} }},
+	} {
+		c := check
+		tc.modify(&c)
+		assert.Error(t, Validate([]Check{c}, endpoints), tc.name)
+	}
+	assert.Error(t, Validate([]Check{check, check}, endpoints))
+	assert.Error(t, Validate(nil, []Endpoint{{Name: "x", Type: "email", URL: "https://a"}}))
+	assert.Error(t, Validate(nil, []Endpoint{{Name: "x", Type: EndpointWebhook, URL: "ftp://a"}}))
+}
+
+func TestAggregate(t *testing.T) {
+	values := []struct {
+		ts int64
+		v  float64
+	}{{20, 4}, {10, 2}, {30, 6}}
+	want := map[string]float64{"mean": 4, "sum": 12, "count": 3, "min": 2, "max": 6, "first": 2, "last": 6}
+	for fn, expected := range want {
+		a := aggregate{fn: fn}
+		for _, v := range values {
+			a.add(v.ts, v.v)
+		}
+		v, ok := a.value()
+		assert.True(t, ok, fn)
+		assert.Equal(t, expected, v, fn)
+	}
+
+	_, ok := (&aggregate{fn: "mean"}).value()
+	assert.False(t, ok)
+	v, ok := (&aggregate{fn: "count"}).value()
+	assert.True(t, ok)
+	assert.Equal(t, 0.0, v)
+}
+
+func TestRun(t *testing.T) {
+	received := make(chan map[string]interface{}, 10)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var doc map[string]interface{}
+		assert.NoError(t, json.Unmarshal(body, &doc))
+		doc["path"] = r.URL.Path
+		received <- doc
+	}))
+	defer endpoint.Close()
+
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	now := time.Unix(1000, 0)
+	svc, err := New(db, []Check{{
+		Name: "cpu_high", Database: "telegraf", Measurement: "cpu", Field: "usage",
+		Tags:        map[string]string{"host": "a"},
+		Aggregation: "mean", Operator: ">", Threshold: 90,
+		Window: time.Minute, Every: time.Minute,
+		Notify: []string{"hook", "slack"},
+	}}, []Endpoint{
+		{Name: "hook", Type: EndpointWebhook, URL: endpoint.URL + "/hook"},
+		{Name: "slack", Type: EndpointSlack, URL: endpoint.URL + "/slack"},
+	}, Options{})
+	assert.NoError(t, err)
+	svc.now = func() time.Time { return now }
+
+	write := func(host string, value float64, at time.Time) {
+		assert.NoError(t, db.SaveBatch([]persistence.Point{{
+			Database: "telegraf", Measurement: "cpu",
+			Tags:      map[string]string{"host": host},
+			Fields:    map[string]float64{"usage": value},
+			Timestamp: at.UnixNano(),
+		}}))
+	}
+
+	// An empty window is unknown, without notifying on the first run
+	svc.Run(context.Background(), "cpu_high")
+	st, ok := svc.Status("cpu_high")
+	assert.True(t, ok)
+	assert.Equal(t, LevelUnknown, st.Level)
+	assert.False(t, st.HasValue)
+	assert.Empty(t, received)
+
+	// Other hosts and points outside the window are ignored
+	write("a", 95, now.Add(-10*time.Second))
+	write("a", 97, now.Add(-20*time.Second))
+	write("a", 10, now.Add(-2*time.Minute))
+	write("b", 10, now.Add(-10*time.Second))
+	svc.Run(context.Background(), "cpu_high")
+	st, _ = svc.Status("cpu_high")
+	assert.Equal(t, LevelCrit, st.Level)
+	assert.Equal(t, 96.0, st.Value)
+	assert.Equal(t, "cpu_high is CRIT: mean(usage) of cpu is 96 > 90 over the last 1m0s", st.Message)
+	assert.Equal(t, now, st.LastChange)
+
+	hook, slack := <-received, <-received
+	assert.Equal(t, "/hook", hook["path"])
+	assert.Equal(t, "crit", hook["level"])
+	assert.Equal(t, 96.0, hook["value"])
+	assert.Equal(t, "/slack", slack["path"])
+	assert.Equal(t, st.Message, slack["text"])
+
+	// Staying critical does not notify again
+	now = now.Add(time.Second)
+	svc.Run(context.Background(), "cpu_high")
+	assert.Empty(t, received)
+
+	now = now.Add(time.Minute)
+	write("a", 50, now)
+	svc.Run(context.Background(), "cpu_high")
+	st, _ = svc.Status("cpu_high")
+	assert.Equal(t, LevelOK, st.Level)
+	assert.Equal(t, "cpu_high is OK: mean(usage) of cpu is 50 over the last 1m0s", st.Message)
+	assert.Equal(t, "ok", (<-received)["level"])
+	<-received
+}
+
+func TestStart(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	svc, err := New(db, []Check{{
+		Name: "count", Database: "db", Measurement: "m", Field: "f",
+		Aggregation: "count", Operator: "==", Threshold: 0,
+		Window: time.Minute, Every: time.Hour,
+	}}, nil, Options{})
+	assert.NoError(t, err)
+	svc.Start(context.Background())
+
+	// Checks run once right away
+	assert.Eventually(t, func() bool {
+		st, _ := svc.Status("count")
+		return st.Level == LevelCrit
+	}, 2*time.Second, 10*time.Millisecond)
+	svc.Stop()
+	assert.Len(t, svc.Statuses(), 1)
+}
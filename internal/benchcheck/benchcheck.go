@@ -0,0 +1,172 @@
+// Package benchcheck compares the output of go test -bench with a stored
+// baseline, to catch performance regressions.
+//
+// Every benchmark is summarized by the median of its runs, so that
+// -count=5 or more smooths out noisy runs. The GOMAXPROCS suffix of the
+// names is dropped, so that results from machines with a different
+// number of CPUs can be compared, although timings only compare well on
+// similar hardware.
+package benchcheck
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Result is the median of the runs of a benchmark
+type Result struct {
+	Name string
+	// NsPerOp is the time of an operation, AllocsPerOp its allocations,
+	// -1 when the benchmark did not report them
+	NsPerOp     float64
+	AllocsPerOp float64
+}
+
+// procsSuffix is the GOMAXPROCS suffix of benchmark names
+var procsSuffix = regexp.MustCompile(`-\d+$`)
+
+// Parse reads go test -bench output and returns the median of the runs of
+// every benchmark, keyed by name qualified with its package as in
+// internal/persistence.BenchmarkSaveBatch/wal-normal
+func Parse(r io.Reader) (map[string]Result, error) {
+	type runs struct{ ns, allocs []float64 }
+	byName := make(map[string]*runs)
+	pkg := ""
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if p, ok := strings.CutPrefix(line, "pkg: "); ok {
+			pkg = strings.TrimSpace(p)
+			continue
+		}
+		if !strings.HasPrefix(line, "Benchmark") {
+			continue
+		}
+		fields := strings.Fields(line)
+		// A name, the number of iterations, then value and unit pairs
+		if len(fields) < 4 || len(fields)%2 != 0 {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+		name := procsSuffix.ReplaceAllString(fields[0], "")
+		if pkg != "" {
+			name = shortPackage(pkg) + "." + name
+		}
+		r := byName[name]
+		if r == nil {
+			r = &runs{}
+			byName[name] = r
+		}
+		for i := 2; i < len(fields); i += 2 {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %q of %s", fields[i], name)
+			}
+			switch fields[i+1] {
+			case "ns/op":
+				r.ns = append(r.ns, v)
+			case "allocs/op":
+				r.allocs = append(r.allocs, v)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]Result, len(byName))
+	for name, r := range byName {
+		if len(r.ns) == 0 {
+			continue
+		}
+		results[name] = Result{Name: name, NsPerOp: median(r.ns), AllocsPerOp: median(r.allocs)}
+	}
+	return results, nil
+}
+
+// shortPackage drops the module path of a package path, keeping the path
+// from internal/, pkg/ or tests/ on
+func shortPackage(pkg string) string {
+	for _, dir := range []string{"internal/", "pkg/", "tests"} {
+		if i := strings.Index(pkg, "/"+dir); i != -1 {
+			return pkg[i+1:]
+		}
+	}
+	return pkg
+}
+
+// median returns the median of values, -1 when there are none
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return -1
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// Comparison is a benchmark found in both the baseline and the current
+// results
+type Comparison struct {
+	Name              string
+	Baseline, Current Result
+	// TimeDelta and AllocsDelta are the relative changes, 0.1 being 10%
+	// slower or more allocations
+	TimeDelta, AllocsDelta float64
+	// Regressed is set when either delta exceeds the threshold
+	Regressed bool
+}
+
+// Compare compares the benchmarks present in both baseline and current,
+// in name order. A benchmark regresses when it got slower or allocates
+// more than threshold, 0.2 allowing 20%. Benchmarks missing from either
+// side are returned by name in missing and added.
+func Compare(baseline, current map[string]Result, threshold float64) (comparisons []Comparison, missing, added []string) {
+	for name, base := range baseline {
+		cur, ok := current[name]
+		if !ok {
+			missing = append(missing, name)
+			continue
+		}
+		c := Comparison{Name: name, Baseline: base, Current: cur}
+		c.TimeDelta = delta(base.NsPerOp, cur.NsPerOp)
+		c.AllocsDelta = delta(base.AllocsPerOp, cur.AllocsPerOp)
+		c.Regressed = c.TimeDelta > threshold || c.AllocsDelta > threshold
+		comparisons = append(comparisons, c)
+	}
+	for name := range current {
+		if _, ok := baseline[name]; !ok {
+			added = append(added, name)
+		}
+	}
+	sort.Slice(comparisons, func(i, j int) bool { return comparisons[i].Name < comparisons[j].Name })
+	sort.Strings(missing)
+	sort.Strings(added)
+	return comparisons, missing, added
+}
+
+// delta returns the relative change from base to cur, 0 when either is
+// unknown. Allocations growing from none count as doubling.
+func delta(base, cur float64) float64 {
+	switch {
+	case base < 0 || cur < 0:
+		return 0
+	case base == 0 && cur == 0:
+		return 0
+	case base == 0:
+		return 1
+	}
+	return cur/base - 1
+}
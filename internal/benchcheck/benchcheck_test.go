@@ -0,0 +1,64 @@
+package benchcheck
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const baselineOutput = `goos: linux
+goarch: amd64
+pkg: github.com/gleicon/go-refluxdb/internal/protocol
+cpu: Intel(R) Xeon(R) Processor
+BenchmarkTokenizer-8   	    1000	   1000 ns/op	  10.00 MB/s	     7 B/op	       0 allocs/op
+BenchmarkTokenizer-8   	    1000	   1200 ns/op	  10.00 MB/s	     7 B/op	       0 allocs/op
+BenchmarkTokenizer-8   	    1000	   5000 ns/op	  10.00 MB/s	     7 B/op	       0 allocs/op
+PASS
+ok  	github.com/gleicon/go-refluxdb/internal/protocol	1.0s
+pkg: github.com/gleicon/go-refluxdb/internal/persistence
+BenchmarkSaveBatch/wal-normal-8   	10	 7000000 ns/op	 145000 points/s	 1000 B/op	 20000 allocs/op
+BenchmarkScanRange/row-8   	1	 300000000 ns/op
+BenchmarkGone-8   	1	 100 ns/op
+`
+
+func TestParse(t *testing.T) {
+	results, err := Parse(strings.NewReader(baselineOutput))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]Result{
+		"internal/protocol.BenchmarkTokenizer":               {Name: "internal/protocol.BenchmarkTokenizer", NsPerOp: 1200, AllocsPerOp: 0},
+		"internal/persistence.BenchmarkSaveBatch/wal-normal": {Name: "internal/persistence.BenchmarkSaveBatch/wal-normal", NsPerOp: 7000000, AllocsPerOp: 20000},
+		"internal/persistence.BenchmarkScanRange/row":        {Name: "internal/persistence.BenchmarkScanRange/row", NsPerOp: 300000000, AllocsPerOp: -1},
+		"internal/persistence.BenchmarkGone":                 {Name: "internal/persistence.BenchmarkGone", NsPerOp: 100, AllocsPerOp: -1},
+	}, results)
+}
+
+func TestCompare(t *testing.T) {
+	baseline, err := Parse(strings.NewReader(baselineOutput))
+	assert.NoError(t, err)
+	current, err := Parse(strings.NewReader(`pkg: github.com/gleicon/go-refluxdb/internal/protocol
+BenchmarkTokenizer-4   	    1000	   1300 ns/op	     7 B/op	       1 allocs/op
+pkg: github.com/gleicon/go-refluxdb/internal/persistence
+BenchmarkSaveBatch/wal-normal-4   	10	 9000000 ns/op	 1000 B/op	 20000 allocs/op
+BenchmarkScanRange/row-4   	1	 150000000 ns/op
+BenchmarkNew-4   	1	 100 ns/op
+`))
+	assert.NoError(t, err)
+
+	comparisons, missing, added := Compare(baseline, current, 0.2)
+	assert.Equal(t, []string{"internal/persistence.BenchmarkGone"}, missing)
+	assert.Equal(t, []string{"internal/persistence.BenchmarkNew"}, added)
+	if assert.Len(t, comparisons, 3) {
+		// 29% slower
+		assert.Equal(t, "internal/persistence.BenchmarkSaveBatch/wal-normal", comparisons[0].Name)
+		assert.InDelta(t, 0.286, comparisons[0].TimeDelta, 0.001)
+		assert.True(t, comparisons[0].Regressed)
+		// Twice as fast
+		assert.InDelta(t, -0.5, comparisons[1].TimeDelta, 0.001)
+		assert.False(t, comparisons[1].Regressed)
+		// 8% slower, but allocating where it did not
+		assert.Equal(t, "internal/protocol.BenchmarkTokenizer", comparisons[2].Name)
+		assert.Equal(t, 1.0, comparisons[2].AllocsDelta)
+		assert.True(t, comparisons[2].Regressed)
+	}
+}
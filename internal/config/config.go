@@ -0,0 +1,882 @@
+// Package config loads the refluxdb configuration from a TOML file.
+//
+// Every setting has a default, so a configuration file only needs to list
+// the values it changes:
+//
+//	[http]
+//	bind-address = ":8086"
+//
+//	[write]
+//	max-past = "168h"
+//	max-future = "10m"
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/acl"
+	"github.com/gleicon/go-refluxdb/internal/alerts"
+	"github.com/gleicon/go-refluxdb/internal/enrich"
+	"github.com/gleicon/go-refluxdb/internal/ingest"
+	"github.com/gleicon/go-refluxdb/internal/monitor"
+	"github.com/gleicon/go-refluxdb/internal/objectstore"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/protocol"
+	"github.com/gleicon/go-refluxdb/internal/replication"
+	"github.com/gleicon/go-refluxdb/internal/templates"
+	"github.com/gleicon/go-refluxdb/internal/tracing"
+	"github.com/gleicon/go-refluxdb/internal/xform"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// Duration is a time.Duration that is written as a string such as "10m"
+// in the configuration file
+type Duration time.Duration
+
+// UnmarshalText implements encoding.TextUnmarshaler
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %w", string(text), err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Config is the complete refluxdb configuration
+type Config struct {
+	HTTP       HTTPConfig       `toml:"http"`
+	UDP        []UDPConfig      `toml:"udp"`
+	Storage    StorageConfig    `toml:"storage"`
+	Retention  RetentionConfig  `toml:"retention"`
+	Compaction CompactionConfig `toml:"compaction"`
+	Tiering    TieringConfig    `toml:"tiering"`
+	Org        OrgConfig        `toml:"organization"`
+	Write      WriteConfig      `toml:"write"`
+	Query      QueryConfig      `toml:"query"`
+	Logging    LoggingConfig    `toml:"logging"`
+	Alerts     AlertsConfig     `toml:"alerts"`
+	Monitor    MonitorConfig    `toml:"monitor"`
+	Tracing    TracingConfig    `toml:"tracing"`
+	// Replication lists the [[replication]] targets
+	Replication []ReplicationConfig `toml:"replication"`
+	// Enrich lists the [[enrich]] rules, applied in order to the tags of
+	// the written points
+	Enrich []EnrichConfig `toml:"enrich"`
+	// Transform lists the [[transform]] rules, applied in order to the
+	// written points
+	Transform []TransformConfig `toml:"transform"`
+	// Tenant lists the [[tenant]] blocks, each storing the points of its
+	// databases in a file of its own
+	Tenant []TenantConfig `toml:"tenant"`
+}
+
+// HTTPConfig configures the HTTP API server
+type HTTPConfig struct {
+	BindAddress string `toml:"bind-address"`
+	// DebugToken grants access to the /debug endpoints. Empty only serves
+	// them to localhost.
+	DebugToken string `toml:"debug-token"`
+	// AuthEnabled requires a token with the right scope on every endpoint
+	// but the health checks, metrics and /debug
+	AuthEnabled bool `toml:"auth-enabled"`
+	// Allow and Deny are CIDR prefixes or addresses filtering the clients.
+	// Only the clients matching Allow, or every client when it is empty,
+	// are served, except those matching Deny.
+	Allow []string `toml:"allow"`
+	Deny  []string `toml:"deny"`
+}
+
+// UDPConfig configures one UDP line protocol listener. Several listeners
+// can be declared as [[udp]] blocks, each writing to its own database.
+type UDPConfig struct {
+	BindAddress string `toml:"bind-address"`
+	// Database receives the points written to this listener
+	Database string `toml:"database"`
+	// MeasurementPrefix is prepended to every measurement received
+	MeasurementPrefix string `toml:"measurement-prefix"`
+	// BufferSize is the read buffer size in bytes, at most 65536
+	BufferSize int `toml:"buffer-size"`
+	// ReadQueue is the number of packets buffered for parsing
+	ReadQueue int `toml:"read-queue"`
+	// Readers is the number of sockets sharing the address with
+	// SO_REUSEPORT, each with its own reader
+	Readers int `toml:"readers"`
+	// Parsers is the number of goroutines parsing packets, GOMAXPROCS
+	// when zero
+	Parsers int `toml:"parsers"`
+	// BatchSize is the number of points written per transaction
+	BatchSize int `toml:"batch-size"`
+	// BatchTimeout flushes a partial batch after this long
+	BatchTimeout Duration `toml:"batch-timeout"`
+	// BatchPending is the number of packets queued for the batcher, 10
+	// per batch worker when zero
+	BatchPending int `toml:"batch-pending"`
+	// BatchWorkers is the number of batches stored at once, GOMAXPROCS
+	// when zero
+	BatchWorkers int `toml:"batch-workers"`
+	// ParseMode overrides the parse-mode of [write] for this listener
+	ParseMode string `toml:"parse-mode"`
+	// Allow and Deny filter the packet sources like those of [http]
+	Allow []string `toml:"allow"`
+	Deny  []string `toml:"deny"`
+	// StatsInterval is the period of the log summarizing the packets and
+	// points received and lost. Negative disables it.
+	StatsInterval Duration `toml:"stats-interval"`
+}
+
+// maxUDPBufferSize is the largest UDP payload
+const maxUDPBufferSize = 64 * 1024
+
+// StorageConfig configures the storage engine
+type StorageConfig struct {
+	Path string `toml:"path"`
+	// JournalMode is the SQLite journal mode, WAL by default
+	JournalMode string `toml:"journal-mode"`
+	// Synchronous is the SQLite synchronous setting, NORMAL by default
+	Synchronous string `toml:"synchronous"`
+	// Durability is "batch" to flush every batch to disk before
+	// acknowledging it, or "periodic" to flush every fsync-interval
+	Durability    string   `toml:"durability"`
+	FsyncInterval Duration `toml:"fsync-interval"`
+	// BusyTimeout is how long a connection waits for a database lock
+	BusyTimeout Duration `toml:"busy-timeout"`
+	// MaxOpenConns and MaxIdleConns size the connection pool
+	MaxOpenConns int `toml:"max-open-conns"`
+	MaxIdleConns int `toml:"max-idle-conns"`
+	// ShardDuration is the time window stored in each shard
+	ShardDuration Duration `toml:"shard-duration"`
+	// CompressFields stores field sets compressed with zstd
+	CompressFields bool `toml:"compress-fields"`
+	// Engine is the storage engine, "row" or "columnar"
+	Engine string `toml:"engine"`
+	// IntegrityCheckInterval is how often the storage integrity is
+	// verified. Zero disables the periodic checks.
+	IntegrityCheckInterval Duration `toml:"integrity-check-interval"`
+	// TenantIdleTimeout closes the files of the tenants unused for this
+	// long. Zero keeps them open.
+	TenantIdleTimeout Duration `toml:"tenant-idle-timeout"`
+}
+
+// RetentionConfig configures retention policy enforcement
+type RetentionConfig struct {
+	// CheckInterval is how often expired points are deleted. Zero disables
+	// retention enforcement.
+	CheckInterval Duration `toml:"check-interval"`
+}
+
+// CompactionConfig schedules the compaction of the storage, which releases
+// the space left by deleted and expired points to the file system
+type CompactionConfig struct {
+	// QuietHours is the daily window, such as "02:00-05:00" in local
+	// time, during which the storage is compacted. Empty disables the
+	// scheduled compactions.
+	QuietHours string `toml:"quiet-hours"`
+	// MinFreeRatio is the fraction of the database file that must be free
+	// for a compaction to run, from 0 to 1
+	MinFreeRatio float64 `toml:"min-free-ratio"`
+	// MaxPages bounds the pages released by a compaction, every free page
+	// when zero
+	MaxPages int `toml:"max-pages"`
+}
+
+// TieringConfig moves the blocks of old shards to S3 compatible object
+// storage, from which queries download them back
+type TieringConfig struct {
+	// Age is how long after the end of its window a shard is uploaded.
+	// Zero disables tiering.
+	Age Duration `toml:"age"`
+	// CheckInterval is how often the shards past Age are uploaded
+	CheckInterval Duration `toml:"check-interval"`
+	// CacheDir keeps the shards downloaded by queries, tiers next to the
+	// database file by default
+	CacheDir string `toml:"cache-dir"`
+	// CacheSize is the disk space of CacheDir in bytes
+	CacheSize int64 `toml:"cache-size"`
+	// Endpoint is the URL of the S3 API, such as https://s3.amazonaws.com
+	Endpoint string `toml:"endpoint"`
+	Bucket   string `toml:"bucket"`
+	Region   string `toml:"region"`
+	// Prefix is prepended to the object keys
+	Prefix string `toml:"prefix"`
+	// AccessKeyID and SecretAccessKey default to AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY
+	AccessKeyID     string `toml:"access-key-id"`
+	SecretAccessKey string `toml:"secret-access-key"`
+	// PathStyle addresses the bucket in the URL path, as MinIO expects
+	PathStyle bool `toml:"path-style"`
+}
+
+// OrgConfig configures the v2 API organizations
+type OrgConfig struct {
+	// Default is created at startup and owns the buckets created without
+	// an organization. Empty disables it.
+	Default string `toml:"default"`
+}
+
+// WriteConfig configures validation applied on every ingest path
+type WriteConfig struct {
+	// MaxPast rejects points older than this window. Zero disables it.
+	MaxPast Duration `toml:"max-past"`
+	// MaxFuture rejects points further in the future than this window.
+	// Zero disables it.
+	MaxFuture Duration `toml:"max-future"`
+	// WarnOnly accepts out of window points, counting and logging them
+	WarnOnly bool `toml:"warn-only"`
+	// ClampNonFinite stores infinite values as the largest finite ones and
+	// drops NaN fields instead of rejecting their point
+	ClampNonFinite bool `toml:"clamp-non-finite"`
+	// MaxKeyLength is the longest accepted measurement, tag or field name,
+	// in bytes. Zero disables the check.
+	MaxKeyLength int `toml:"max-key-length"`
+	// Templates split dotted measurement names into a measurement, tags
+	// and a field, see the templates package for their syntax
+	Templates []string `toml:"templates"`
+	// MaxBodySize is the largest HTTP write body accepted, in bytes.
+	// Zero disables the limit.
+	MaxBodySize int64 `toml:"max-body-size"`
+	// MaxLines is the number of points accepted in one HTTP write. Zero
+	// disables the limit.
+	MaxLines int `toml:"max-lines"`
+	// ParseMode is how strictly line protocol is checked: "default",
+	// "strict" or "lenient"
+	ParseMode string `toml:"parse-mode"`
+	// MemoryBudget bounds the memory of the points waiting for storage,
+	// in bytes. Zero uses a quarter of the Go memory limit when one is
+	// set, negative disables it.
+	MemoryBudget int64 `toml:"memory-budget"`
+	// MemoryLimit sets the Go memory limit of the process, in bytes, like
+	// GOMEMLIMIT, which takes precedence. Zero leaves it unset.
+	MemoryLimit int64 `toml:"memory-limit"`
+	// MaxDeadLetters is the number of dropped lines kept for inspection
+	// and replay through /api/v2/deadletters. Zero disables them.
+	MaxDeadLetters int `toml:"max-dead-letters"`
+	// DedupWindow drops the points written again with the same series,
+	// timestamp and fields within this window. Zero disables it.
+	DedupWindow Duration `toml:"dedup-window"`
+	// DedupMaxPoints is the number of points remembered over the window.
+	// Zero means ingest.DefaultDedupEntries.
+	DedupMaxPoints int `toml:"dedup-max-points"`
+}
+
+// QueryConfig configures query execution
+type QueryConfig struct {
+	// Timeout aborts queries running longer than this. Zero disables it.
+	Timeout Duration `toml:"timeout"`
+	// MaxConcurrent limits the queries executed at once. Zero means
+	// unlimited.
+	MaxConcurrent int `toml:"max-concurrent"`
+	// MaxQueued is the number of queries waiting for a slot once
+	// MaxConcurrent are running
+	MaxQueued int `toml:"max-queued"`
+	// QueueTimeout is how long a query waits for a slot. Zero waits until
+	// the client gives up.
+	QueueTimeout Duration `toml:"queue-timeout"`
+	// SlowQueryThreshold is the duration past which a query is logged as
+	// slow. Zero disables the slow query log.
+	SlowQueryThreshold Duration `toml:"slow-query-threshold"`
+	// SlowQueryBuffer is the number of slow queries kept for
+	// /debug/queries
+	SlowQueryBuffer int `toml:"slow-query-buffer"`
+	// SlowQueryLog is the file slow queries are logged to as JSON lines.
+	// Empty logs them with the other server logs.
+	SlowQueryLog string `toml:"slow-query-log"`
+}
+
+// AlertsConfig declares the threshold checks and the endpoints they
+// notify, as [[alerts.checks]] and [[alerts.endpoints]] blocks
+type AlertsConfig struct {
+	Endpoints []AlertEndpointConfig `toml:"endpoints"`
+	Checks    []CheckConfig         `toml:"checks"`
+}
+
+// AlertEndpointConfig declares an endpoint receiving notifications
+type AlertEndpointConfig struct {
+	Name string `toml:"name"`
+	// Type is "webhook" or "slack"
+	Type string `toml:"type"`
+	URL  string `toml:"url"`
+}
+
+// CheckConfig declares a threshold check, see alerts.Check
+type CheckConfig struct {
+	Name        string            `toml:"name"`
+	Database    string            `toml:"database"`
+	Measurement string            `toml:"measurement"`
+	Field       string            `toml:"field"`
+	Tags        map[string]string `toml:"tags"`
+	Aggregation string            `toml:"aggregation"`
+	Operator    string            `toml:"operator"`
+	Threshold   float64           `toml:"threshold"`
+	Window      Duration          `toml:"window"`
+	Every       Duration          `toml:"every"`
+	Notify      []string          `toml:"notify"`
+}
+
+// ReplicationConfig declares a remote v2 write API receiving the written
+// points, see replication.Target
+type ReplicationConfig struct {
+	Name   string `toml:"name"`
+	URL    string `toml:"url"`
+	Org    string `toml:"org"`
+	Token  string `toml:"token"`
+	Bucket string `toml:"bucket"`
+	// Databases lists the replicated databases. Empty replicates all.
+	Databases []string `toml:"databases"`
+	// QueueDir stores the undelivered points, replication/<name> next to
+	// the database file by default
+	QueueDir string `toml:"queue-dir"`
+	// MaxQueueSize is the disk space of the queue in bytes
+	MaxQueueSize int64 `toml:"max-queue-size"`
+}
+
+// TenantConfig declares a tenant, see persistence.Tenant
+type TenantConfig struct {
+	Name string `toml:"name"`
+	// Path is the file of the tenant, tenants/<name>.db next to the
+	// database file by default
+	Path      string   `toml:"path"`
+	Databases []string `toml:"databases"`
+}
+
+// EnrichConfig declares a rule setting or rewriting the tags of written
+// points, see enrich.Rule
+type EnrichConfig struct {
+	// Listeners are "http" or the bind-address of [[udp]] listeners.
+	// Empty matches every listener.
+	Listeners []string `toml:"listeners"`
+	// Sources are CIDR prefixes or addresses. Empty matches every source.
+	Sources  []string          `toml:"sources"`
+	Tags     map[string]string `toml:"tags"`
+	Override bool              `toml:"override"`
+	// Tag is rewritten to Replacement when its value matches the Pattern
+	// regular expression
+	Tag         string `toml:"tag"`
+	Pattern     string `toml:"pattern"`
+	Replacement string `toml:"replacement"`
+}
+
+// TransformConfig declares a rule rewriting or dropping written points,
+// see xform.Rule
+type TransformConfig struct {
+	Name string `toml:"name"`
+	// Measurements restricts the rule to these measurements. Empty
+	// matches every point.
+	Measurements []string `toml:"measurements"`
+	// Where is an InfluxQL condition on the tags and fields
+	Where string `toml:"where"`
+	Drop  bool   `toml:"drop"`
+	// Fields maps field names to InfluxQL expressions of their value
+	Fields      map[string]string `toml:"fields"`
+	DropFields  []string          `toml:"drop-fields"`
+	Measurement string            `toml:"measurement"`
+}
+
+// MonitorConfig configures the self-monitoring, stored like the InfluxDB
+// one
+type MonitorConfig struct {
+	// StoreEnabled stores the runtime statistics in StoreDatabase
+	StoreEnabled  bool   `toml:"store-enabled"`
+	StoreDatabase string `toml:"store-database"`
+	// StoreInterval is how often the statistics are stored
+	StoreInterval Duration `toml:"store-interval"`
+}
+
+// TracingConfig configures the export of the write and query spans to an
+// OpenTelemetry collector over OTLP/HTTP
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP URL of the collector, such as
+	// http://localhost:4318. Empty disables tracing.
+	Endpoint string `toml:"endpoint"`
+	// SampleRate is the fraction of the requests traced, from 0 to 1.
+	// Requests traced by the client are always traced.
+	SampleRate float64 `toml:"sample-rate"`
+	// ServiceName names refluxdb in the traces
+	ServiceName string `toml:"service-name"`
+	// Headers are sent with the spans, for collectors requiring
+	// credentials
+	Headers map[string]string `toml:"headers"`
+}
+
+// LoggingConfig configures the process logger
+type LoggingConfig struct {
+	// Level is the minimum level logged: debug, info, warn or error
+	Level string `toml:"level"`
+	// Format is either "text" or "json"
+	Format string `toml:"format"`
+}
+
+// Configure applies the level and format to logger
+func (l LoggingConfig) Configure(logger *logrus.Logger) error {
+	level, err := logrus.ParseLevel(l.Level)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q: %w", l.Level, err)
+	}
+
+	switch l.Format {
+	case "text":
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format %q: expected text or json", l.Format)
+	}
+
+	logger.SetLevel(level)
+	return nil
+}
+
+// Default returns the configuration used when no file is given
+func Default() *Config {
+	return &Config{
+		HTTP:       HTTPConfig{BindAddress: ":8086"},
+		UDP:        []UDPConfig{DefaultUDP()},
+		Storage:    defaultStorage(),
+		Retention:  RetentionConfig{CheckInterval: Duration(30 * time.Minute)},
+		Compaction: CompactionConfig{MinFreeRatio: 0.1},
+		Tiering: TieringConfig{
+			CheckInterval: Duration(time.Hour),
+			CacheSize:     persistence.DefaultTierCacheSize,
+			Region:        objectstore.DefaultRegion,
+		},
+		Org:   OrgConfig{Default: "default"},
+		Write: WriteConfig{MaxKeyLength: 256, MaxBodySize: 25000000},
+		Query: QueryConfig{
+			Timeout:       Duration(time.Minute),
+			MaxConcurrent: 16,
+			MaxQueued:     64,
+			QueueTimeout:  Duration(10 * time.Second),
+
+			SlowQueryThreshold: Duration(time.Second),
+			SlowQueryBuffer:    100,
+		},
+		Logging: LoggingConfig{Level: "info", Format: "text"},
+		Monitor: MonitorConfig{
+			StoreEnabled:  true,
+			StoreDatabase: monitor.DefaultDatabase,
+			StoreInterval: Duration(monitor.DefaultInterval),
+		},
+		Tracing: TracingConfig{SampleRate: 0.1, ServiceName: tracing.DefaultServiceName},
+	}
+}
+
+func defaultStorage() StorageConfig {
+	d := persistence.DefaultOptions()
+	return StorageConfig{
+		Path:          "timeseries.db",
+		JournalMode:   d.JournalMode,
+		Synchronous:   d.Synchronous,
+		Durability:    d.Durability,
+		FsyncInterval: Duration(d.FsyncInterval),
+		BusyTimeout:   Duration(d.BusyTimeout),
+		MaxOpenConns:  d.MaxOpenConns,
+		MaxIdleConns:  d.MaxIdleConns,
+		ShardDuration: Duration(d.ShardDuration),
+		Engine:        d.Engine,
+
+		IntegrityCheckInterval: Duration(24 * time.Hour),
+	}
+}
+
+// DefaultUDP returns the settings of the default UDP listener. Settings
+// left out of a [[udp]] block fall back to these values.
+func DefaultUDP() UDPConfig {
+	return UDPConfig{
+		BindAddress:  ":8089",
+		BufferSize:   maxUDPBufferSize,
+		ReadQueue:    1000,
+		Readers:      1,
+		BatchSize:    5000,
+		BatchTimeout: Duration(time.Second),
+
+		StatsInterval: Duration(time.Minute),
+	}
+}
+
+// Load reads the configuration file at path on top of the defaults
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	// Declared [[udp]] blocks replace the default listener
+	cfg.UDP = nil
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	if err := toml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	if cfg.UDP == nil {
+		cfg.UDP = []UDPConfig{DefaultUDP()}
+	}
+	seen := make(map[string]bool)
+	for i := range cfg.UDP {
+		u := &cfg.UDP[i]
+		u.applyDefaults()
+		if seen[u.BindAddress] {
+			return nil, fmt.Errorf("duplicate udp bind-address %q", u.BindAddress)
+		}
+		seen[u.BindAddress] = true
+		if u.Parsers < 0 || u.BatchWorkers < 0 || u.BatchPending < 0 {
+			return nil, fmt.Errorf("invalid udp listener %s: parsers, batch-workers and batch-pending must not be negative", u.BindAddress)
+		}
+		if u.BufferSize > maxUDPBufferSize {
+			return nil, fmt.Errorf("invalid udp buffer-size %d: must be at most %d", u.BufferSize, maxUDPBufferSize)
+		}
+		if _, err := protocol.LookupMode(u.ParseMode); err != nil {
+			return nil, fmt.Errorf("invalid udp parse-mode: %w", err)
+		}
+		if _, err := acl.New(u.Allow, u.Deny); err != nil {
+			return nil, fmt.Errorf("invalid udp sources of %s: %w", u.BindAddress, err)
+		}
+	}
+
+	if _, err := acl.New(cfg.HTTP.Allow, cfg.HTTP.Deny); err != nil {
+		return nil, fmt.Errorf("invalid http clients: %w", err)
+	}
+
+	if _, err := cfg.TieringOptions(); err != nil {
+		return nil, fmt.Errorf("invalid tiering: %w", err)
+	}
+	if err := cfg.StorageOptions().Validate(); err != nil {
+		return nil, fmt.Errorf("invalid storage settings: %w", err)
+	}
+
+	if cfg.Storage.IntegrityCheckInterval < 0 {
+		return nil, fmt.Errorf("invalid storage integrity-check-interval %s: must not be negative", time.Duration(cfg.Storage.IntegrityCheckInterval))
+	}
+
+	if cfg.Monitor.StoreEnabled && cfg.Monitor.StoreInterval <= 0 {
+		return nil, fmt.Errorf("invalid monitor store-interval %s: must be positive", time.Duration(cfg.Monitor.StoreInterval))
+	}
+	if cfg.Tracing.Endpoint != "" {
+		if err := cfg.TracingOptions().Validate(); err != nil {
+			return nil, fmt.Errorf("invalid tracing: %w", err)
+		}
+	}
+	if _, err := cfg.CompactionSchedule(); err != nil {
+		return nil, fmt.Errorf("invalid compaction: %w", err)
+	}
+	if cfg.Retention.CheckInterval < 0 {
+		return nil, fmt.Errorf("invalid retention check-interval %s: must not be negative", time.Duration(cfg.Retention.CheckInterval))
+	}
+
+	if cfg.Write.MaxKeyLength < 0 {
+		return nil, fmt.Errorf("invalid write max-key-length %d: must not be negative", cfg.Write.MaxKeyLength)
+	}
+	if cfg.Write.MemoryLimit < 0 {
+		return nil, fmt.Errorf("invalid write memory-limit %d: must not be negative", cfg.Write.MemoryLimit)
+	}
+	if cfg.Write.DedupWindow < 0 || cfg.Write.DedupMaxPoints < 0 {
+		return nil, fmt.Errorf("invalid write deduplication: window and max points must not be negative")
+	}
+	if cfg.Write.MaxDeadLetters < 0 {
+		return nil, fmt.Errorf("invalid write max-dead-letters %d: must not be negative", cfg.Write.MaxDeadLetters)
+	}
+	if cfg.Write.MaxBodySize < 0 || cfg.Write.MaxLines < 0 {
+		return nil, fmt.Errorf("invalid write limits: must not be negative")
+	}
+	if _, err := templates.Parse(cfg.Write.Templates); err != nil {
+		return nil, fmt.Errorf("invalid write templates: %w", err)
+	}
+	if _, err := xform.New(cfg.TransformRules()); err != nil {
+		return nil, fmt.Errorf("invalid transform: %w", err)
+	}
+	if _, err := protocol.LookupMode(cfg.Write.ParseMode); err != nil {
+		return nil, fmt.Errorf("invalid write parse-mode: %w", err)
+	}
+
+	if cfg.Query.Timeout < 0 || cfg.Query.QueueTimeout < 0 {
+		return nil, fmt.Errorf("invalid query timeouts: must not be negative")
+	}
+	if cfg.Query.SlowQueryThreshold < 0 {
+		return nil, fmt.Errorf("invalid query slow-query-threshold %s: must not be negative", time.Duration(cfg.Query.SlowQueryThreshold))
+	}
+	if cfg.Query.MaxConcurrent < 0 || cfg.Query.MaxQueued < 0 || cfg.Query.SlowQueryBuffer < 0 {
+		return nil, fmt.Errorf("invalid query limits: must not be negative")
+	}
+
+	if err := alerts.Validate(cfg.AlertChecks()); err != nil {
+		return nil, fmt.Errorf("invalid alerts: %w", err)
+	}
+	if err := replication.Validate(cfg.Replications()); err != nil {
+		return nil, fmt.Errorf("invalid replication: %w", err)
+	}
+	if _, err := enrich.New(cfg.EnrichRules()); err != nil {
+		return nil, fmt.Errorf("invalid enrich: %w", err)
+	}
+	if cfg.Storage.TenantIdleTimeout < 0 {
+		return nil, fmt.Errorf("invalid storage tenant-idle-timeout %s: must not be negative", time.Duration(cfg.Storage.TenantIdleTimeout))
+	}
+	if err := persistence.ValidateTenants(cfg.Storage.Path, cfg.Tenants()); err != nil {
+		return nil, err
+	}
+
+	// Validate the logging settings up front so typos fail at startup
+	if err := cfg.Logging.Configure(logrus.New()); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// CompactionSchedule returns the schedule of the storage compactions, nil
+// when they are disabled
+func (c *Config) CompactionSchedule() (*persistence.CompactionSchedule, error) {
+	if c.Compaction.MinFreeRatio < 0 || c.Compaction.MinFreeRatio > 1 {
+		return nil, fmt.Errorf("invalid min-free-ratio %v: must be between 0 and 1", c.Compaction.MinFreeRatio)
+	}
+	if c.Compaction.MaxPages < 0 {
+		return nil, fmt.Errorf("invalid max-pages %d: must not be negative", c.Compaction.MaxPages)
+	}
+	if c.Compaction.QuietHours == "" {
+		return nil, nil
+	}
+	quiet, err := persistence.ParseQuietHours(c.Compaction.QuietHours)
+	if err != nil {
+		return nil, err
+	}
+	return &persistence.CompactionSchedule{
+		QuietHours:   quiet,
+		MinFreeRatio: c.Compaction.MinFreeRatio,
+		MaxPages:     c.Compaction.MaxPages,
+	}, nil
+}
+
+// TracingOptions returns the span export settings described by the config
+func (c *Config) TracingOptions() tracing.Options {
+	return tracing.Options{
+		Endpoint:    c.Tracing.Endpoint,
+		SampleRate:  c.Tracing.SampleRate,
+		ServiceName: c.Tracing.ServiceName,
+		Headers:     c.Tracing.Headers,
+	}
+}
+
+// IngestOptions returns the write path options described by the config
+func (c *Config) IngestOptions() ingest.Options {
+	// Templates, transforms and the parse mode are validated by Load
+	set, _ := templates.Parse(c.Write.Templates)
+	rules, _ := xform.New(c.TransformRules())
+	mode, _ := protocol.LookupMode(c.Write.ParseMode)
+	return ingest.Options{
+		MaxPast:   time.Duration(c.Write.MaxPast),
+		MaxFuture: time.Duration(c.Write.MaxFuture),
+		WarnOnly:  c.Write.WarnOnly,
+
+		ClampNonFinite: c.Write.ClampNonFinite,
+		MaxKeyLength:   c.Write.MaxKeyLength,
+		Templates:      set,
+		Transforms:     rules,
+		MaxLines:       c.Write.MaxLines,
+		MaxBytes:       c.Write.MaxBodySize,
+		Mode:           mode,
+	}
+}
+
+// UDPIngestOptions returns the write path options of the listener u,
+// which may override the parse mode
+func (c *Config) UDPIngestOptions(u UDPConfig) ingest.Options {
+	opts := c.IngestOptions()
+	if u.ParseMode != "" {
+		// Validated by Load
+		opts.Mode, _ = protocol.LookupMode(u.ParseMode)
+	}
+	return opts
+}
+
+// AlertChecks returns the checks and endpoints described by the config
+func (c *Config) AlertChecks() ([]alerts.Check, []alerts.Endpoint) {
+	endpoints := make([]alerts.Endpoint, 0, len(c.Alerts.Endpoints))
+	for _, e := range c.Alerts.Endpoints {
+		endpoints = append(endpoints, alerts.Endpoint{Name: e.Name, Type: e.Type, URL: e.URL})
+	}
+	checks := make([]alerts.Check, 0, len(c.Alerts.Checks))
+	for _, ch := range c.Alerts.Checks {
+		checks = append(checks, alerts.Check{
+			Name:        ch.Name,
+			Database:    ch.Database,
+			Measurement: ch.Measurement,
+			Field:       ch.Field,
+			Tags:        ch.Tags,
+			Aggregation: ch.Aggregation,
+			Operator:    ch.Operator,
+			Threshold:   ch.Threshold,
+			Window:      time.Duration(ch.Window),
+			Every:       time.Duration(ch.Every),
+			Notify:      ch.Notify,
+		})
+	}
+	return checks, endpoints
+}
+
+// Replications returns the replication targets described by the config
+func (c *Config) Replications() []replication.Target {
+	targets := make([]replication.Target, 0, len(c.Replication))
+	for _, r := range c.Replication {
+		dir := r.QueueDir
+		if dir == "" {
+			dir = filepath.Join(filepath.Dir(c.Storage.Path), "replication", r.Name)
+		}
+		targets = append(targets, replication.Target{
+			Name:         r.Name,
+			URL:          r.URL,
+			Org:          r.Org,
+			Token:        r.Token,
+			Bucket:       r.Bucket,
+			Databases:    r.Databases,
+			QueueDir:     dir,
+			MaxQueueSize: r.MaxQueueSize,
+		})
+	}
+	return targets
+}
+
+// Tenants returns the tenants described by the config
+func (c *Config) Tenants() []persistence.Tenant {
+	tenants := make([]persistence.Tenant, 0, len(c.Tenant))
+	for _, t := range c.Tenant {
+		path := t.Path
+		if path == "" && t.Name != "" {
+			path = filepath.Join(filepath.Dir(c.Storage.Path), "tenants", t.Name+".db")
+		}
+		tenants = append(tenants, persistence.Tenant{Name: t.Name, Path: path, Databases: t.Databases})
+	}
+	return tenants
+}
+
+// TieringOptions returns the tiering of old shards described by the
+// config, nil when it is disabled
+func (c *Config) TieringOptions() (*persistence.TieringOptions, error) {
+	t := c.Tiering
+	if t.Age == 0 {
+		return nil, nil
+	}
+	if t.Age < 0 {
+		return nil, fmt.Errorf("invalid age %s: must not be negative", time.Duration(t.Age))
+	}
+	if t.CheckInterval <= 0 {
+		return nil, fmt.Errorf("invalid check-interval %s: must be positive", time.Duration(t.CheckInterval))
+	}
+	store, err := objectstore.NewS3(objectstore.Options{
+		Endpoint:        t.Endpoint,
+		Bucket:          t.Bucket,
+		Region:          t.Region,
+		Prefix:          t.Prefix,
+		AccessKeyID:     t.AccessKeyID,
+		SecretAccessKey: t.SecretAccessKey,
+		PathStyle:       t.PathStyle,
+	})
+	if err != nil {
+		return nil, err
+	}
+	dir := t.CacheDir
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(c.Storage.Path), "tiers")
+	}
+	opts := &persistence.TieringOptions{Store: store, Age: time.Duration(t.Age), CacheDir: dir, CacheSize: t.CacheSize}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// EnrichRules returns the tag enrichment rules described by the config
+func (c *Config) EnrichRules() []enrich.Rule {
+	rules := make([]enrich.Rule, 0, len(c.Enrich))
+	for _, e := range c.Enrich {
+		rules = append(rules, enrich.Rule{
+			Listeners:   e.Listeners,
+			Sources:     e.Sources,
+			Tags:        e.Tags,
+			Override:    e.Override,
+			Tag:         e.Tag,
+			Pattern:     e.Pattern,
+			Replacement: e.Replacement,
+		})
+	}
+	return rules
+}
+
+// TransformRules returns the transform rules described by the config
+func (c *Config) TransformRules() []xform.Rule {
+	rules := make([]xform.Rule, 0, len(c.Transform))
+	for _, t := range c.Transform {
+		rules = append(rules, xform.Rule{
+			Name:         t.Name,
+			Measurements: t.Measurements,
+			Where:        t.Where,
+			Drop:         t.Drop,
+			Fields:       t.Fields,
+			DropFields:   t.DropFields,
+			Measurement:  t.Measurement,
+		})
+	}
+	return rules
+}
+
+// StorageOptions returns the SQLite settings described by the config
+func (c *Config) StorageOptions() persistence.Options {
+	// The tiering settings are validated by Load
+	tiering, _ := c.TieringOptions()
+	return persistence.Options{
+		JournalMode:    c.Storage.JournalMode,
+		Synchronous:    c.Storage.Synchronous,
+		Durability:     c.Storage.Durability,
+		FsyncInterval:  time.Duration(c.Storage.FsyncInterval),
+		BusyTimeout:    time.Duration(c.Storage.BusyTimeout),
+		MaxOpenConns:   c.Storage.MaxOpenConns,
+		MaxIdleConns:   c.Storage.MaxIdleConns,
+		ShardDuration:  time.Duration(c.Storage.ShardDuration),
+		CompressFields: c.Storage.CompressFields,
+		Engine:         c.Storage.Engine,
+		Tiering:        tiering,
+	}
+}
+
+// applyDefaults fills the settings left out of a [[udp]] block
+func (u *UDPConfig) applyDefaults() {
+	d := DefaultUDP()
+	if u.BindAddress == "" {
+		u.BindAddress = d.BindAddress
+	}
+	if u.BufferSize <= 0 {
+		u.BufferSize = d.BufferSize
+	}
+	if u.ReadQueue <= 0 {
+		u.ReadQueue = d.ReadQueue
+	}
+	if u.Readers <= 0 {
+		u.Readers = d.Readers
+	}
+	if u.BatchSize <= 0 {
+		u.BatchSize = d.BatchSize
+	}
+	if u.BatchTimeout <= 0 {
+		u.BatchTimeout = d.BatchTimeout
+	}
+	if u.StatsInterval == 0 {
+		u.StatsInterval = d.StatsInterval
+	}
+}
+
+// BatchOptions returns the ingest pipeline options of the listener
+func (u UDPConfig) BatchOptions() ingest.BatchOptions {
+	return ingest.BatchOptions{
+		Size:    u.BatchSize,
+		Timeout: time.Duration(u.BatchTimeout),
+		Pending: u.BatchPending,
+		Workers: u.BatchWorkers,
+	}
+}
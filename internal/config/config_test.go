@@ -0,0 +1,431 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/alerts"
+	"github.com/gleicon/go-refluxdb/internal/enrich"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/protocol"
+	"github.com/gleicon/go-refluxdb/internal/replication"
+	"github.com/gleicon/go-refluxdb/internal/xform"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "refluxdb.toml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	cfg, err := Load(writeConfig(t, ""))
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), cfg)
+}
+
+func TestLoadOverrides(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+[http]
+bind-address = ":9086"
+
+[[udp]]
+buffer-size = 8192
+batch-size = 1000
+batch-timeout = "250ms"
+
+[storage]
+journal-mode = "DELETE"
+durability = "batch"
+busy-timeout = "1s"
+max-open-conns = 2
+shard-duration = "168h"
+compress-fields = true
+engine = "columnar"
+
+[retention]
+check-interval = "5m"
+
+[compaction]
+quiet-hours = "02:00-05:00"
+max-pages = 1000
+
+[tiering]
+age = "720h"
+endpoint = "http://minio:9000"
+bucket = "metrics"
+access-key-id = "key"
+secret-access-key = "secret"
+path-style = true
+
+[organization]
+default = "acme"
+
+[write]
+max-past = "168h"
+max-future = "10m"
+warn-only = true
+clamp-non-finite = true
+max-lines = 5000
+parse-mode = "strict"
+
+[query]
+timeout = "30s"
+max-concurrent = 4
+queue-timeout = "2s"
+slow-query-threshold = "250ms"
+slow-query-log = "/var/log/refluxdb/slow.log"
+
+[monitor]
+store-interval = "1m"
+
+[tracing]
+endpoint = "http://otel-collector:4318"
+sample-rate = 0.5
+headers = { Authorization = "Bearer secret" }
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, ":9086", cfg.HTTP.BindAddress)
+	assert.Equal(t, Duration(30*time.Second), cfg.Query.Timeout)
+	assert.Equal(t, 4, cfg.Query.MaxConcurrent)
+	assert.Equal(t, 64, cfg.Query.MaxQueued)
+	assert.Equal(t, Duration(2*time.Second), cfg.Query.QueueTimeout)
+	assert.Equal(t, Duration(250*time.Millisecond), cfg.Query.SlowQueryThreshold)
+	assert.Equal(t, 100, cfg.Query.SlowQueryBuffer)
+	assert.Equal(t, "/var/log/refluxdb/slow.log", cfg.Query.SlowQueryLog)
+	assert.Equal(t, Duration(5*time.Minute), cfg.Retention.CheckInterval)
+	assert.Equal(t, "acme", cfg.Org.Default)
+	assert.True(t, cfg.Monitor.StoreEnabled)
+	assert.Equal(t, "_internal", cfg.Monitor.StoreDatabase)
+	assert.Equal(t, Duration(time.Minute), cfg.Monitor.StoreInterval)
+
+	compaction, err := cfg.CompactionSchedule()
+	assert.NoError(t, err)
+	assert.Equal(t, &persistence.CompactionSchedule{
+		QuietHours:   persistence.QuietHours{Start: 2 * time.Hour, End: 5 * time.Hour},
+		MinFreeRatio: 0.1,
+		MaxPages:     1000,
+	}, compaction)
+
+	tracing := cfg.TracingOptions()
+	assert.Equal(t, "http://otel-collector:4318", tracing.Endpoint)
+	assert.Equal(t, 0.5, tracing.SampleRate)
+	assert.Equal(t, "refluxdb", tracing.ServiceName)
+	assert.Equal(t, map[string]string{"Authorization": "Bearer secret"}, tracing.Headers)
+
+	storage := cfg.StorageOptions()
+	assert.Equal(t, "DELETE", storage.JournalMode)
+	assert.Equal(t, "NORMAL", storage.Synchronous)
+	assert.Equal(t, persistence.DurabilityBatch, storage.Durability)
+	assert.Equal(t, time.Second, storage.BusyTimeout)
+	assert.Equal(t, 2, storage.MaxOpenConns)
+	assert.Equal(t, 168*time.Hour, storage.ShardDuration)
+	assert.True(t, storage.CompressFields)
+	assert.Equal(t, "columnar", storage.Engine)
+	assert.Equal(t, 720*time.Hour, storage.Tiering.Age)
+	assert.Equal(t, "tiers", storage.Tiering.CacheDir)
+	assert.Equal(t, int64(persistence.DefaultTierCacheSize), storage.Tiering.CacheSize)
+	assert.NotNil(t, storage.Tiering.Store)
+	assert.Equal(t, Duration(time.Hour), cfg.Tiering.CheckInterval)
+	assert.Len(t, cfg.UDP, 1)
+	assert.Equal(t, ":8089", cfg.UDP[0].BindAddress)
+	assert.Equal(t, 8192, cfg.UDP[0].BufferSize)
+	assert.Equal(t, 1000, cfg.UDP[0].ReadQueue)
+
+	batch := cfg.UDP[0].BatchOptions()
+	assert.Equal(t, 1000, batch.Size)
+	assert.Equal(t, 250*time.Millisecond, batch.Timeout)
+	// Left to the batcher, which tunes them to GOMAXPROCS
+	assert.Zero(t, batch.Pending)
+	assert.Zero(t, batch.Workers)
+	assert.Zero(t, cfg.UDP[0].Parsers)
+
+	opts := cfg.IngestOptions()
+	assert.Equal(t, 168*time.Hour, opts.MaxPast)
+	assert.Equal(t, 10*time.Minute, opts.MaxFuture)
+	assert.True(t, opts.WarnOnly)
+	assert.True(t, opts.ClampNonFinite)
+	assert.Equal(t, 256, opts.MaxKeyLength)
+	assert.Equal(t, 5000, opts.MaxLines)
+	assert.Equal(t, int64(25000000), opts.MaxBytes)
+	assert.Equal(t, protocol.ModeStrict, opts.Mode)
+}
+
+func TestLoadErrors(t *testing.T) {
+	_, err := Load(filepath.Join(t.TempDir(), "missing.toml"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[write]\nmax-past = \"forever\"\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[[udp]]\nbuffer-size = 100000\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[[udp]]\nbind-address = \":8089\"\n[[udp]]\nbind-address = \":8089\"\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[storage]\njournal-mode = \"fast\"\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[retention]\ncheck-interval = \"-1m\"\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[monitor]\nstore-interval = \"0s\"\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[write]\ntemplates = [\"a.* b.measurement* c.field\"]\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[write]\nparse-mode = \"loose\"\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[[udp]]\nparse-mode = \"loose\"\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[[alerts.checks]]\nname = \"cpu\"\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[query]\ntimeout = \"-1s\"\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[query]\nmax-concurrent = -1\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[logging]\nlevel = \"loud\"\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[logging]\nformat = \"xml\"\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[http]\nallow = [\"10.0.0.0/33\"]\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[[udp]]\ndeny = [\"somewhere\"]\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[[udp]]\nbatch-workers = -1\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[write]\nmemory-limit = -1\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[write]\nmax-dead-letters = -1\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[write]\ndedup-window = \"-1m\"\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[tracing]\nendpoint = \"otel-collector:4318\"\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[tracing]\nendpoint = \"http://otel-collector:4318\"\nsample-rate = 2.0\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[compaction]\nquiet-hours = \"nightly\"\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[compaction]\nmin-free-ratio = 1.5\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[tiering]\nage = \"720h\"\nendpoint = \"http://minio:9000\"\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[tiering]\nage = \"720h\"\nendpoint = \"http://minio:9000\"\nbucket = \"metrics\"\ncheck-interval = \"0s\"\n"))
+	assert.Error(t, err)
+}
+
+func TestLoadUDPListeners(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+[[udp]]
+bind-address = ":8089"
+database = "telegraf"
+
+[[udp]]
+bind-address = ":8090"
+database = "collectd"
+measurement-prefix = "collectd_"
+batch-size = 100
+parse-mode = "lenient"
+stats-interval = "-1s"
+readers = 4
+parsers = 2
+batch-workers = 3
+`))
+	assert.NoError(t, err)
+	assert.Len(t, cfg.UDP, 2)
+
+	assert.Equal(t, "telegraf", cfg.UDP[0].Database)
+	assert.Equal(t, "", cfg.UDP[0].MeasurementPrefix)
+	assert.Equal(t, 5000, cfg.UDP[0].BatchSize)
+	assert.Equal(t, Duration(time.Minute), cfg.UDP[0].StatsInterval)
+	assert.Equal(t, 1, cfg.UDP[0].Readers)
+
+	assert.Equal(t, ":8090", cfg.UDP[1].BindAddress)
+	assert.Equal(t, "collectd", cfg.UDP[1].Database)
+	assert.Equal(t, "collectd_", cfg.UDP[1].MeasurementPrefix)
+	assert.Equal(t, 100, cfg.UDP[1].BatchSize)
+	assert.Equal(t, 65536, cfg.UDP[1].BufferSize)
+	assert.Equal(t, Duration(-time.Second), cfg.UDP[1].StatsInterval)
+	assert.Equal(t, 4, cfg.UDP[1].Readers)
+	assert.Equal(t, 2, cfg.UDP[1].Parsers)
+	assert.Equal(t, 3, cfg.UDP[1].BatchOptions().Workers)
+
+	// Listeners inherit the parse mode of [write] unless they override it
+	assert.Equal(t, protocol.ModeDefault, cfg.UDPIngestOptions(cfg.UDP[0]).Mode)
+	assert.Equal(t, protocol.ModeLenient, cfg.UDPIngestOptions(cfg.UDP[1]).Mode)
+}
+
+func TestLoadAlerts(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+[[alerts.endpoints]]
+name = "ops"
+type = "slack"
+url = "https://hooks.slack.com/services/T000/B000/XXX"
+
+[[alerts.checks]]
+name = "cpu_high"
+database = "telegraf"
+measurement = "cpu"
+field = "usage_user"
+tags = { host = "web-1" }
+aggregation = "mean"
+operator = ">"
+threshold = 90.0
+window = "5m"
+every = "1m"
+notify = ["ops"]
+`))
+	assert.NoError(t, err)
+
+	checks, endpoints := cfg.AlertChecks()
+	assert.Equal(t, []alerts.Endpoint{{Name: "ops", Type: "slack", URL: "https://hooks.slack.com/services/T000/B000/XXX"}}, endpoints)
+	if assert.Len(t, checks, 1) {
+		assert.Equal(t, "cpu_high", checks[0].Name)
+		assert.Equal(t, map[string]string{"host": "web-1"}, checks[0].Tags)
+		assert.Equal(t, 90.0, checks[0].Threshold)
+		assert.Equal(t, 5*time.Minute, checks[0].Window)
+		assert.Equal(t, time.Minute, checks[0].Every)
+		assert.Equal(t, []string{"ops"}, checks[0].Notify)
+	}
+}
+
+func TestLoadReplication(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+[storage]
+path = "/var/lib/refluxdb/timeseries.db"
+
+[[replication]]
+name = "cloud"
+url = "https://influx.example.com"
+org = "acme"
+token = "secret"
+databases = ["telegraf"]
+max-queue-size = 1048576
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []replication.Target{{
+		Name:         "cloud",
+		URL:          "https://influx.example.com",
+		Org:          "acme",
+		Token:        "secret",
+		Databases:    []string{"telegraf"},
+		QueueDir:     "/var/lib/refluxdb/replication/cloud",
+		MaxQueueSize: 1 << 20,
+	}}, cfg.Replications())
+
+	_, err = Load(writeConfig(t, "[[replication]]\nname = \"cloud\"\nurl = \"influx:8086\"\norg = \"acme\"\n"))
+	assert.Error(t, err)
+}
+
+func TestLoadTenants(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+[storage]
+path = "/var/lib/refluxdb/timeseries.db"
+tenant-idle-timeout = "10m"
+
+[[tenant]]
+name = "acme"
+databases = ["acme", "acme_logs"]
+
+[[tenant]]
+name = "globex"
+path = "/data/globex.db"
+databases = ["globex"]
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, Duration(10*time.Minute), cfg.Storage.TenantIdleTimeout)
+	assert.Equal(t, []persistence.Tenant{
+		{Name: "acme", Path: "/var/lib/refluxdb/tenants/acme.db", Databases: []string{"acme", "acme_logs"}},
+		{Name: "globex", Path: "/data/globex.db", Databases: []string{"globex"}},
+	}, cfg.Tenants())
+
+	_, err = Load(writeConfig(t, "[[tenant]]\nname = \"acme\"\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[[tenant]]\nname = \"a\"\ndatabases = [\"shared\"]\n[[tenant]]\nname = \"b\"\ndatabases = [\"shared\"]\n"))
+	assert.Error(t, err)
+
+	_, err = Load(writeConfig(t, "[storage]\ntenant-idle-timeout = \"-1m\"\n"))
+	assert.Error(t, err)
+}
+
+func TestLoadEnrich(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+[[enrich]]
+listeners = [":8089"]
+sources = ["10.1.0.0/16"]
+tags = { datacenter = "eu-west" }
+
+[[enrich]]
+tag = "host"
+pattern = '^([^.]+)\..*$'
+replacement = "$1"
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []enrich.Rule{
+		{Listeners: []string{":8089"}, Sources: []string{"10.1.0.0/16"}, Tags: map[string]string{"datacenter": "eu-west"}},
+		{Tag: "host", Pattern: `^([^.]+)\..*$`, Replacement: "$1"},
+	}, cfg.EnrichRules())
+
+	_, err = Load(writeConfig(t, "[[enrich]]\ntag = \"host\"\npattern = \"(\"\n"))
+	assert.Error(t, err)
+}
+
+func TestLoadTransforms(t *testing.T) {
+	cfg, err := Load(writeConfig(t, `
+[[transform]]
+name = "fahrenheit"
+measurements = ["sensors"]
+where = "unit = 'C'"
+fields = { temp = "temp * 1.8 + 32" }
+drop-fields = ["unit_code"]
+measurement = "sensors_f"
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []xform.Rule{{
+		Name:         "fahrenheit",
+		Measurements: []string{"sensors"},
+		Where:        "unit = 'C'",
+		Fields:       map[string]string{"temp": "temp * 1.8 + 32"},
+		DropFields:   []string{"unit_code"},
+		Measurement:  "sensors_f",
+	}}, cfg.TransformRules())
+	assert.NotNil(t, cfg.IngestOptions().Transforms)
+
+	_, err = Load(writeConfig(t, "[[transform]]\nname = \"x\"\nfields = { a = \"b *\" }\n"))
+	assert.Error(t, err)
+}
+
+func TestLoggingConfigure(t *testing.T) {
+	cfg, err := Load(writeConfig(t, "[logging]\nlevel = \"debug\"\nformat = \"json\"\n"))
+	assert.NoError(t, err)
+
+	logger := logrus.New()
+	assert.NoError(t, cfg.Logging.Configure(logger))
+	assert.Equal(t, logrus.DebugLevel, logger.GetLevel())
+	assert.IsType(t, &logrus.JSONFormatter{}, logger.Formatter)
+}
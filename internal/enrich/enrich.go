@@ -0,0 +1,190 @@
+// Package enrich sets and rewrites the tags of written points with rules
+// declared in the configuration, so that points sent by heterogeneous
+// agents are normalized centrally.
+//
+// A rule selects the writes it applies to by listener and by source
+// address, then sets static tags and rewrites the value of a tag with a
+// regular expression:
+//
+//	[[enrich]]
+//	listeners = [":8089"]
+//	sources = ["10.1.0.0/16"]
+//	tags = { datacenter = "eu-west" }
+//
+//	[[enrich]]
+//	tag = "host"
+//	pattern = '^([^.]+)\..*$'
+//	replacement = "$1"
+//
+// Rules apply in order, each one to the tags left by the previous ones.
+package enrich
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+
+	"github.com/gleicon/go-refluxdb/internal/acl"
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+)
+
+// HTTPListener names the HTTP API in Rule.Listeners
+const HTTPListener = "http"
+
+var pointsEnriched = metrics.NewCounter("refluxdb_ingest_points_enriched_total", "Points whose tags were changed by enrichment rules")
+
+// Rule describes an enrichment rule
+type Rule struct {
+	// Listeners restricts the rule to the writes received by these
+	// listeners: HTTPListener or the bind address of a UDP listener.
+	// Empty matches every listener.
+	Listeners []string
+	// Sources restricts the rule to the writes sent from these CIDR
+	// prefixes or addresses. Empty matches every source.
+	Sources []string
+	// Tags are set on the points, keeping the values the points already
+	// hold unless Override is set
+	Tags     map[string]string
+	Override bool
+	// Tag is rewritten when its value matches Pattern, to Replacement in
+	// which $1 or ${name} expand to the groups of the match. A value
+	// rewritten to an empty string removes the tag.
+	Tag         string
+	Pattern     string
+	Replacement string
+}
+
+// rule is a validated Rule
+type rule struct {
+	listeners map[string]bool
+	sources   *acl.List
+	tags      map[string]string
+	override  bool
+	tag       string
+	pattern   *regexp.Regexp
+	replace   string
+}
+
+// Set is the list of rules applied to written points
+type Set struct {
+	rules []*rule
+}
+
+// New validates rules. It returns nil when there are none.
+func New(rules []Rule) (*Set, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	s := &Set{}
+	for i, r := range rules {
+		compiled, err := compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %d: %w", i+1, err)
+		}
+		s.rules = append(s.rules, compiled)
+	}
+	return s, nil
+}
+
+func compile(r Rule) (*rule, error) {
+	if len(r.Tags) == 0 && r.Tag == "" {
+		return nil, fmt.Errorf("expected tags to set or a tag to rewrite")
+	}
+	for k, v := range r.Tags {
+		if k == "" || v == "" {
+			return nil, fmt.Errorf("invalid tag %q=%q: key and value must not be empty", k, v)
+		}
+	}
+	sources, err := acl.New(r.Sources, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sources: %w", err)
+	}
+	c := &rule{sources: sources, tags: r.Tags, override: r.Override, tag: r.Tag, replace: r.Replacement}
+	if len(r.Listeners) > 0 {
+		c.listeners = make(map[string]bool, len(r.Listeners))
+		for _, l := range r.Listeners {
+			c.listeners[l] = true
+		}
+	}
+	if (r.Tag == "") != (r.Pattern == "") {
+		return nil, fmt.Errorf("tag and pattern must be set together")
+	}
+	if r.Pattern != "" {
+		if c.pattern, err = regexp.Compile(r.Pattern); err != nil {
+			return nil, fmt.Errorf("invalid pattern: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// Chain is the list of rules matching the writes of one listener and
+// source
+type Chain []*rule
+
+// For returns the rules applying to the writes received by listener from
+// source. An invalid source, such as an unknown client address, only
+// matches the rules without sources.
+func (s *Set) For(listener string, source netip.Addr) Chain {
+	if s == nil {
+		return nil
+	}
+	var chain Chain
+	for _, r := range s.rules {
+		if r.listeners != nil && !r.listeners[listener] {
+			continue
+		}
+		if r.sources != nil && (!source.IsValid() || !r.sources.Allows(source)) {
+			continue
+		}
+		chain = append(chain, r)
+	}
+	return chain
+}
+
+// Apply returns the tags of a point enriched by the rules of c. The tags
+// are copied before being changed, so they may be shared between points.
+func (c Chain) Apply(tags map[string]string) map[string]string {
+	changed := false
+	for _, r := range c {
+		for k, v := range r.tags {
+			if old, ok := tags[k]; ok && (old == v || !r.override) {
+				continue
+			}
+			if !changed {
+				tags, changed = clone(tags, len(r.tags)), true
+			}
+			tags[k] = v
+		}
+		if r.pattern == nil {
+			continue
+		}
+		v, ok := tags[r.tag]
+		if !ok || !r.pattern.MatchString(v) {
+			continue
+		}
+		rewritten := r.pattern.ReplaceAllString(v, r.replace)
+		if rewritten == v {
+			continue
+		}
+		if !changed {
+			tags, changed = clone(tags, 0), true
+		}
+		if rewritten == "" {
+			delete(tags, r.tag)
+		} else {
+			tags[r.tag] = rewritten
+		}
+	}
+	if changed {
+		pointsEnriched.Inc()
+	}
+	return tags
+}
+
+func clone(tags map[string]string, extra int) map[string]string {
+	copied := make(map[string]string, len(tags)+extra)
+	for k, v := range tags {
+		copied[k] = v
+	}
+	return copied
+}
@@ -0,0 +1,54 @@
+package enrich
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApply(t *testing.T) {
+	set, err := New([]Rule{
+		{Listeners: []string{":8089"}, Tags: map[string]string{"agent": "collectd"}},
+		{Sources: []string{"10.1.0.0/16"}, Tags: map[string]string{"datacenter": "eu-west", "region": "eu"}, Override: true},
+		{Tags: map[string]string{"region": "unknown"}},
+		{Tag: "host", Pattern: `^([^.]+)\..*$`, Replacement: "$1"},
+		{Tag: "env", Pattern: `^none$`},
+	})
+	assert.NoError(t, err)
+
+	tags := map[string]string{"host": "web1.example.com", "region": "us", "env": "none"}
+	got := set.For(":8089", netip.MustParseAddr("10.1.2.3")).Apply(tags)
+	assert.Equal(t, map[string]string{"host": "web1", "region": "eu", "datacenter": "eu-west", "agent": "collectd"}, got)
+	// The tags of the point are copied
+	assert.Equal(t, "web1.example.com", tags["host"])
+
+	// Static tags keep the values set by the point
+	got = set.For(HTTPListener, netip.MustParseAddr("192.168.1.1")).Apply(map[string]string{"region": "us", "host": "db1"})
+	assert.Equal(t, map[string]string{"region": "us", "host": "db1"}, got)
+	got = set.For(HTTPListener, netip.Addr{}).Apply(nil)
+	assert.Equal(t, map[string]string{"region": "unknown"}, got)
+
+	assert.Len(t, set.For(":8089", netip.MustParseAddr("::ffff:10.1.0.1")), 5)
+	assert.Len(t, set.For(HTTPListener, netip.Addr{}), 3)
+
+	var none *Set
+	assert.Nil(t, none.For(HTTPListener, netip.Addr{}).Apply(nil))
+}
+
+func TestNew(t *testing.T) {
+	set, err := New(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, set)
+
+	for _, r := range []Rule{
+		{},
+		{Tags: map[string]string{"": "x"}},
+		{Tags: map[string]string{"dc": "eu"}, Sources: []string{"somewhere"}},
+		{Tag: "host"},
+		{Tag: "host", Pattern: "("},
+	} {
+		_, err := New([]Rule{r})
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,247 @@
+// Package export moves points in and out of refluxdb as line protocol, the
+// format understood by InfluxDB's write APIs, influx_inspect export and the
+// influx CLI, so data can be migrated in both directions.
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/gleicon/go-refluxdb/internal/ingest"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+// Filter selects the points to export
+type Filter struct {
+	// Database restricts the export to one database. Empty exports every
+	// database.
+	Database string
+	// Measurement restricts the export to one measurement. Empty exports
+	// every measurement.
+	Measurement string
+	// Start and End bound the exported timestamps, in nanoseconds, both
+	// inclusive
+	Start int64
+	End   int64
+}
+
+// EncodePoint adds p to enc as one line protocol line. Fields that cannot
+// be represented in line protocol, such as NaN, are left out, and a point
+// left without fields, or with a name or tag that cannot be written, is
+// reported and dropped by enc.
+func EncodePoint(enc *protocol.Encoder, p persistence.Point) error {
+	enc.StartLine(p.Measurement)
+
+	tagKeys := make([]string, 0, len(p.Tags))
+	for k := range p.Tags {
+		tagKeys = append(tagKeys, k)
+	}
+	sort.Strings(tagKeys)
+	for _, k := range tagKeys {
+		enc.AddTag(k, p.Tags[k])
+	}
+
+	fieldKeys := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		fieldKeys = append(fieldKeys, k)
+	}
+	sort.Strings(fieldKeys)
+	for _, k := range fieldKeys {
+		v := p.Fields[k]
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		enc.AddField(k, v)
+	}
+
+	return enc.EndLineAt(p.Timestamp)
+}
+
+// contextDatabase prefixes the influx_inspect comment naming the database
+// of the lines that follow it
+const contextDatabase = "# CONTEXT-DATABASE:"
+
+// Export writes the points matching f to w, one line per point, and returns
+// the number of points written. The points of each database are preceded by
+// the context comments of influx_inspect export, so the output can be loaded
+// with "influx -import" or Import.
+func Export(w io.Writer, db *persistence.Manager, f Filter) (int, error) {
+	bw := bufio.NewWriter(w)
+	var enc protocol.Encoder
+	n := 0
+	database := ""
+
+	if _, err := bw.WriteString("# DML\n"); err != nil {
+		return 0, fmt.Errorf("failed to write header: %w", err)
+	}
+
+	err := db.ScanRange(f.Database, f.Measurement, f.Start, f.End, func(p persistence.Point) error {
+		if p.Database != database {
+			database = p.Database
+			if _, err := fmt.Fprintf(bw, "%s%s\n# CONTEXT-RETENTION-POLICY:autogen\n", contextDatabase, database); err != nil {
+				return fmt.Errorf("failed to write header: %w", err)
+			}
+		}
+
+		if err := EncodePoint(&enc, p); err != nil {
+			logrus.Warnf("Skipping point of %s at %d: %v", p.Measurement, p.Timestamp, err)
+			return nil
+		}
+		_, err := bw.Write(enc.Bytes())
+		enc.Reset()
+		if err != nil {
+			return fmt.Errorf("failed to write point: %w", err)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+
+	if err := bw.Flush(); err != nil {
+		return n, fmt.Errorf("failed to flush export: %w", err)
+	}
+	return n, nil
+}
+
+// ImportOptions control an import
+type ImportOptions struct {
+	// Database receives the imported points, until a CONTEXT-DATABASE
+	// comment selects another one. Empty means persistence.DefaultDatabase.
+	Database string
+	// BatchSize is the number of lines parsed and stored per transaction
+	BatchSize int
+	// Write controls the validation of imported points
+	Write ingest.Options
+}
+
+// DefaultImportBatchSize is used when ImportOptions.BatchSize is zero
+const DefaultImportBatchSize = 5000
+
+// ImportStats summarizes an import
+type ImportStats struct {
+	// Points is the number of points stored
+	Points int
+	// Dropped is the number of lines rejected by the write path
+	Dropped int
+}
+
+// Import reads line protocol from r and stores it in batches. Gzip
+// compressed input is detected and decompressed. Files produced by
+// influx_inspect export are understood: their DDL section is skipped and
+// their CONTEXT-DATABASE comments route the following points to that
+// database. Rejected lines are logged and counted without stopping the
+// import.
+func Import(r io.Reader, db ingest.Writer, opts ImportOptions) (ImportStats, error) {
+	var stats ImportStats
+
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultImportBatchSize
+	}
+
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return stats, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	parser := ingest.NewParser(opts.Write)
+	var batch bytes.Buffer
+	batchLines, firstLine, lineNo := 0, 1, 0
+	inDDL := false
+	database := opts.Database
+
+	// flush stores the pending batch; next is the input line number the
+	// following batch starts at
+	flush := func(next int) error {
+		if batchLines == 0 {
+			return nil
+		}
+		points, err := parser.Parse(batch.Bytes())
+		for i := range points {
+			points[i].Database = database
+		}
+		var partial *ingest.PartialWriteError
+		if err != nil && !errors.As(err, &partial) {
+			return fmt.Errorf("failed to parse lines %d-%d: %w", firstLine, lineNo, err)
+		}
+		if partial != nil {
+			for _, rej := range partial.Dropped {
+				logrus.Warnf("Skipping line %d (%s): %s", firstLine+rej.Line-1, rej.Text, rej.Reason)
+			}
+			stats.Dropped += len(partial.Dropped)
+		}
+		if err := db.SaveBatch(points); err != nil {
+			return fmt.Errorf("failed to store lines %d-%d: %w", firstLine, lineNo, err)
+		}
+		stats.Points += len(points)
+
+		batch.Reset()
+		batchLines = 0
+		firstLine = next
+		return nil
+	}
+
+	for {
+		text, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return stats, fmt.Errorf("failed to read input: %w", err)
+		}
+		if text == "" && err == io.EOF {
+			break
+		}
+		lineNo++
+
+		trimmed := strings.TrimSpace(text)
+		switch trimmed {
+		case "# DDL":
+			inDDL = true
+		case "# DML":
+			inDDL = false
+		}
+		if inDDL {
+			// Keep the line numbering of the batch aligned with the input
+			trimmed = ""
+		}
+		if name, ok := strings.CutPrefix(trimmed, contextDatabase); ok {
+			// Points of the previous database must be stored before switching
+			if err := flush(lineNo); err != nil {
+				return stats, err
+			}
+			database = strings.TrimSpace(name)
+		}
+
+		batch.WriteString(trimmed)
+		batch.WriteByte('\n')
+		batchLines++
+		if batchLines >= batchSize {
+			if err := flush(lineNo + 1); err != nil {
+				return stats, err
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if err := flush(lineNo + 1); err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
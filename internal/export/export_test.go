@@ -0,0 +1,151 @@
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupTestDB(t *testing.T) *persistence.Manager {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestEncodePoint(t *testing.T) {
+	var enc protocol.Encoder
+	assert.NoError(t, EncodePoint(&enc, persistence.Point{
+		Measurement: "my cpu,1",
+		Tags:        map[string]string{"host": "a b", "region": "us=west", "empty": ""},
+		Fields:      map[string]float64{"user": 1.5, "sys tem": 2, "bad": math.NaN()},
+		Timestamp:   1556813561098000000,
+	}))
+	assert.NoError(t, EncodePoint(&enc, persistence.Point{
+		Measurement: "cpu",
+		Tags:        map[string]string{"host": `a\`},
+		Fields:      map[string]float64{"value": 1},
+	}))
+	assert.Equal(t,
+		`my\ cpu\,1,host=a\ b,region=us\=west sys\ tem=2,user=1.5 1556813561098000000`+"\n"+
+			`cpu,host="a\\" value=1 0`+"\n",
+		string(enc.Bytes()))
+
+	// Points that cannot be written are dropped
+	assert.Error(t, EncodePoint(&enc, persistence.Point{
+		Measurement: "cpu",
+		Tags:        map[string]string{"host": "a\nb"},
+		Fields:      map[string]float64{"value": 1},
+	}))
+	assert.Error(t, EncodePoint(&enc, persistence.Point{
+		Measurement: "cpu",
+		Fields:      map[string]float64{"value": math.Inf(1)},
+	}))
+	assert.Equal(t, 2, strings.Count(string(enc.Bytes()), "\n"))
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	src := setupTestDB(t)
+	ts := time.Unix(0, 1556813561098000000)
+	assert.NoError(t, src.SaveBatch([]persistence.Point{
+		{Measurement: "cpu", Tags: map[string]string{"host": "server 1"}, Fields: map[string]float64{"user": 1.5, "system": 2}, Timestamp: ts.UnixNano()},
+		{Measurement: "cpu", Tags: map[string]string{"host": "server,2"}, Fields: map[string]float64{"user": 3}, Timestamp: ts.UnixNano()},
+		{Measurement: "mem", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"used": 1e12}, Timestamp: ts.Add(time.Second).UnixNano()},
+		{Measurement: "disk", Tags: map[string]string{"path": `C:\`}, Fields: map[string]float64{"free": 1}, Timestamp: ts.UnixNano()},
+	}))
+
+	var buf bytes.Buffer
+	n, err := Export(&buf, src, Filter{End: math.MaxInt64})
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	assert.True(t, strings.HasPrefix(buf.String(), "# DML\n# CONTEXT-DATABASE:default\n"))
+
+	dst := setupTestDB(t)
+	stats, err := Import(&buf, dst, ImportOptions{BatchSize: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, ImportStats{Points: 4}, stats)
+
+	for _, measurement := range []string{"cpu", "mem", "disk"} {
+		want, err := src.GetMeasurementRange(persistence.DefaultDatabase, measurement, 0, math.MaxInt64)
+		assert.NoError(t, err)
+		got, err := dst.GetMeasurementRange(persistence.DefaultDatabase, measurement, 0, math.MaxInt64)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, want, got)
+	}
+
+	// Filters restrict the export
+	buf.Reset()
+	n, err = Export(&buf, src, Filter{Measurement: "mem", Start: ts.Add(time.Second).UnixNano(), End: math.MaxInt64})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.True(t, strings.HasSuffix(buf.String(), "autogen\nmem,host=a used=1e+12 1556813562098000000\n"))
+}
+
+func TestImportInfluxInspectFile(t *testing.T) {
+	input := `# DDL
+CREATE DATABASE telegraf WITH NAME autogen
+# DML
+# CONTEXT-DATABASE:telegraf
+# CONTEXT-RETENTION-POLICY:autogen
+# writes
+cpu,host=a usage=10 1556813561098000000
+not line protocol
+cpu,host=b usage=20 1556813561098000000
+`
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, err := w.Write([]byte(input))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	db := setupTestDB(t)
+	stats, err := Import(&gz, db, ImportOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, ImportStats{Points: 2, Dropped: 1}, stats)
+
+	// The points land in the database named by the export context
+	points, err := db.GetMeasurementRange("telegraf", "cpu", 0, math.MaxInt64)
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+}
+
+func TestExportImportDatabases(t *testing.T) {
+	src := setupTestDB(t)
+	ts := time.Unix(0, 1556813561098000000)
+	assert.NoError(t, src.SaveBatch([]persistence.Point{
+		{Database: "a", Measurement: "cpu", Fields: map[string]float64{"value": 1}, Timestamp: ts.UnixNano()},
+		{Database: "b", Measurement: "cpu", Fields: map[string]float64{"value": 2}, Timestamp: ts.UnixNano()},
+	}))
+
+	var buf bytes.Buffer
+	n, err := Export(&buf, src, Filter{End: math.MaxInt64})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	dst := setupTestDB(t)
+	stats, err := Import(&buf, dst, ImportOptions{Database: "ignored"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Points)
+
+	for db, value := range map[string]float64{"a": 1, "b": 2} {
+		points, err := dst.GetMeasurementRange(db, "cpu", 0, math.MaxInt64)
+		assert.NoError(t, err)
+		assert.Len(t, points, 1)
+		assert.Equal(t, value, points[0].Fields["value"])
+	}
+
+	// Without context comments the target database is used
+	stats, err = Import(strings.NewReader("mem used=1 1556813561098000000\n"), dst, ImportOptions{Database: "plain"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Points)
+	databases, err := dst.ListDatabases()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "plain"}, databases)
+}
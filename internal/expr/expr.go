@@ -0,0 +1,453 @@
+// Package expr parses and evaluates the arithmetic expressions of InfluxQL
+// SELECT clauses over the fields of a point:
+//
+//	value * 100
+//	(used - free) / total
+//	round(abs("temp in") * 1.8 + 32)
+//
+// Operands are numbers, field names, bare or double quoted, and calls to
+// scalar functions. The binary operators +, -, *, / and % follow the usual
+// precedence, and parentheses group. A field name may carry an InfluxQL
+// type cast such as "value"::field, which is ignored since every field
+// holds a float.
+//
+// As in InfluxQL, dividing by zero gives zero. An expression referring to
+// a field missing from the point, or whose result is not a finite number,
+// has no value.
+package expr
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Expr is a parsed expression
+type Expr interface {
+	// Eval returns the value of the expression over fields, and false when
+	// it has none
+	Eval(fields map[string]float64) (float64, bool)
+	// String returns the expression in InfluxQL form
+	String() string
+}
+
+// Number is a numeric literal
+type Number float64
+
+// Field is a reference to the field of a point
+type Field string
+
+// Unary is a negated expression
+type Unary struct {
+	X Expr
+}
+
+// Binary is an arithmetic operation: one of + - * / %
+type Binary struct {
+	Op   byte
+	X, Y Expr
+}
+
+// Call is a call to a scalar function
+type Call struct {
+	Name string
+	Args []Expr
+}
+
+// function is a scalar function over float arguments
+type function struct {
+	args int
+	fn   func(args []float64) float64
+}
+
+// functions are the scalar functions of InfluxQL
+var functions = map[string]function{
+	"abs":   {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"acos":  {1, func(a []float64) float64 { return math.Acos(a[0]) }},
+	"asin":  {1, func(a []float64) float64 { return math.Asin(a[0]) }},
+	"atan":  {1, func(a []float64) float64 { return math.Atan(a[0]) }},
+	"atan2": {2, func(a []float64) float64 { return math.Atan2(a[0], a[1]) }},
+	"ceil":  {1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"cos":   {1, func(a []float64) float64 { return math.Cos(a[0]) }},
+	"exp":   {1, func(a []float64) float64 { return math.Exp(a[0]) }},
+	"floor": {1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"ln":    {1, func(a []float64) float64 { return math.Log(a[0]) }},
+	"log":   {2, func(a []float64) float64 { return math.Log(a[0]) / math.Log(a[1]) }},
+	"log2":  {1, func(a []float64) float64 { return math.Log2(a[0]) }},
+	"log10": {1, func(a []float64) float64 { return math.Log10(a[0]) }},
+	"pow":   {2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+	"round": {1, func(a []float64) float64 { return math.Round(a[0]) }},
+	"sin":   {1, func(a []float64) float64 { return math.Sin(a[0]) }},
+	"sqrt":  {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"tan":   {1, func(a []float64) float64 { return math.Tan(a[0]) }},
+}
+
+// IsFunction reports whether name is a scalar function
+func IsFunction(name string) bool {
+	_, ok := functions[strings.ToLower(name)]
+	return ok
+}
+
+func (n Number) Eval(map[string]float64) (float64, bool) { return float64(n), true }
+
+func (n Number) String() string { return strconv.FormatFloat(float64(n), 'g', -1, 64) }
+
+func (f Field) Eval(fields map[string]float64) (float64, bool) {
+	v, ok := fields[string(f)]
+	return v, ok
+}
+
+func (f Field) String() string {
+	if isBare(string(f)) {
+		return string(f)
+	}
+	return strconv.Quote(string(f))
+}
+
+func (u *Unary) Eval(fields map[string]float64) (float64, bool) {
+	v, ok := u.X.Eval(fields)
+	return -v, ok
+}
+
+func (u *Unary) String() string { return "-" + u.X.String() }
+
+func (b *Binary) Eval(fields map[string]float64) (float64, bool) {
+	x, ok := b.X.Eval(fields)
+	if !ok {
+		return 0, false
+	}
+	y, ok := b.Y.Eval(fields)
+	if !ok {
+		return 0, false
+	}
+
+	var v float64
+	switch b.Op {
+	case '+':
+		v = x + y
+	case '-':
+		v = x - y
+	case '*':
+		v = x * y
+	case '/':
+		if y == 0 {
+			return 0, true
+		}
+		v = x / y
+	case '%':
+		if y == 0 {
+			return 0, true
+		}
+		v = math.Mod(x, y)
+	}
+	return v, finite(v)
+}
+
+func (b *Binary) String() string {
+	return "(" + b.X.String() + " " + string(b.Op) + " " + b.Y.String() + ")"
+}
+
+func (c *Call) Eval(fields map[string]float64) (float64, bool) {
+	args := make([]float64, len(c.Args))
+	for i, a := range c.Args {
+		v, ok := a.Eval(fields)
+		if !ok {
+			return 0, false
+		}
+		args[i] = v
+	}
+	v := functions[c.Name].fn(args)
+	return v, finite(v)
+}
+
+func (c *Call) String() string {
+	args := make([]string, len(c.Args))
+	for i, a := range c.Args {
+		args[i] = a.String()
+	}
+	return c.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// Fields returns the names of the fields e refers to, in order of
+// appearance and without duplicates
+func Fields(e Expr) []string {
+	var names []string
+	seen := make(map[string]bool)
+	var walk func(Expr)
+	walk = func(e Expr) {
+		switch e := e.(type) {
+		case Field:
+			if !seen[string(e)] {
+				seen[string(e)] = true
+				names = append(names, string(e))
+			}
+		case *Unary:
+			walk(e.X)
+		case *Binary:
+			walk(e.X)
+			walk(e.Y)
+		case *Call:
+			for _, a := range e.Args {
+				walk(a)
+			}
+		}
+	}
+	walk(e)
+	return names
+}
+
+// Name returns the column name InfluxDB gives to e: the name of a field,
+// the names of the fields of an operation joined with underscores, or the
+// name of a function
+func Name(e Expr) string {
+	switch e := e.(type) {
+	case Field:
+		return string(e)
+	case *Call:
+		return e.Name
+	}
+	if names := Fields(e); len(names) > 0 {
+		return strings.Join(names, "_")
+	}
+	return e.String()
+}
+
+func finite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// isBare reports whether name can be written without quotes
+func isBare(name string) bool {
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isIdentByte(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isIdentByte(b byte) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
+
+// Parse parses an expression
+func Parse(s string) (Expr, error) {
+	p := &parser{s: s}
+	e, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.s) {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.s[p.pos:], p.pos)
+	}
+	return e, nil
+}
+
+// parser is a recursive descent parser over an expression
+type parser struct {
+	s   string
+	pos int
+}
+
+func (p *parser) skipSpaces() {
+	for p.pos < len(p.s) && strings.IndexByte(" \t\r\n", p.s[p.pos]) != -1 {
+		p.pos++
+	}
+}
+
+// peek returns the next byte past spaces, or 0 at the end
+func (p *parser) peek() byte {
+	p.skipSpaces()
+	if p.pos == len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// expr parses a sum of terms
+func (p *parser) expr() (Expr, error) {
+	x, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		x = &Binary{Op: op, X: x, Y: y}
+	}
+}
+
+// term parses a product of factors
+func (p *parser) term() (Expr, error) {
+	x, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		x = &Binary{Op: op, X: x, Y: y}
+	}
+}
+
+// factor parses a number, a field, a call, a negated factor or an
+// expression between parentheses
+func (p *parser) factor() (Expr, error) {
+	switch b := p.peek(); {
+	case b == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case b == '-':
+		p.pos++
+		x, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		if n, ok := x.(Number); ok {
+			return -n, nil
+		}
+		return &Unary{X: x}, nil
+	case b == '+':
+		p.pos++
+		return p.factor()
+	case b == '(':
+		p.pos++
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at offset %d", p.pos)
+		}
+		p.pos++
+		return x, nil
+	case b == '.' || (b >= '0' && b <= '9'):
+		return p.number()
+	case b == '"':
+		name, err := p.quoted()
+		if err != nil {
+			return nil, err
+		}
+		p.skipCast()
+		return Field(name), nil
+	case isIdentByte(b):
+		start := p.pos
+		for p.pos < len(p.s) && isIdentByte(p.s[p.pos]) {
+			p.pos++
+		}
+		name := p.s[start:p.pos]
+		if p.peek() == '(' {
+			return p.call(name)
+		}
+		p.skipCast()
+		return Field(name), nil
+	default:
+		return nil, fmt.Errorf("unexpected %q at offset %d", b, p.pos)
+	}
+}
+
+func (p *parser) number() (Expr, error) {
+	start := p.pos
+	for p.pos < len(p.s) && (p.s[p.pos] == '.' || (p.s[p.pos] >= '0' && p.s[p.pos] <= '9')) {
+		p.pos++
+	}
+	// An exponent, as in 1e6 or 2.5E-3
+	if p.pos < len(p.s) && (p.s[p.pos] == 'e' || p.s[p.pos] == 'E') {
+		end := p.pos + 1
+		if end < len(p.s) && (p.s[end] == '+' || p.s[end] == '-') {
+			end++
+		}
+		if end < len(p.s) && p.s[end] >= '0' && p.s[end] <= '9' {
+			for end < len(p.s) && p.s[end] >= '0' && p.s[end] <= '9' {
+				end++
+			}
+			p.pos = end
+		}
+	}
+	v, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid number %q", p.s[start:p.pos])
+	}
+	return Number(v), nil
+}
+
+// quoted reads a double quoted identifier, where \" stands for a quote
+func (p *parser) quoted() (string, error) {
+	var b strings.Builder
+	for i := p.pos + 1; i < len(p.s); i++ {
+		switch {
+		case p.s[i] == '\\' && i+1 < len(p.s):
+			i++
+			b.WriteByte(p.s[i])
+		case p.s[i] == '"':
+			p.pos = i + 1
+			return b.String(), nil
+		default:
+			b.WriteByte(p.s[i])
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted identifier at offset %d", p.pos)
+}
+
+// skipCast skips a type cast such as ::field or ::float after a field
+func (p *parser) skipCast() {
+	if !strings.HasPrefix(p.s[p.pos:], "::") {
+		return
+	}
+	p.pos += 2
+	for p.pos < len(p.s) && isIdentByte(p.s[p.pos]) {
+		p.pos++
+	}
+}
+
+// call parses the arguments of a call to the function name, with p at the
+// opening parenthesis
+func (p *parser) call(name string) (Expr, error) {
+	lower := strings.ToLower(name)
+	fn, ok := functions[lower]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+	p.pos++
+
+	var args []Expr
+	if p.peek() != ')' {
+		for {
+			arg, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+	}
+	if p.peek() != ')' {
+		return nil, fmt.Errorf("missing ) after the arguments of %s", name)
+	}
+	p.pos++
+	if len(args) != fn.args {
+		return nil, fmt.Errorf("invalid number of arguments for %s, expected %d, got %d", lower, fn.args, len(args))
+	}
+	return &Call{Name: lower, Args: args}, nil
+}
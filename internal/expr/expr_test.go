@@ -0,0 +1,68 @@
+package expr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEval(t *testing.T) {
+	fields := map[string]float64{"value": 0.42, "used": 6, "free": 2, "total": 8, "temp in": -20, "zero": 0}
+
+	tests := []struct {
+		expr  string
+		want  float64
+		valid bool
+	}{
+		{"value * 100", 42, true},
+		{"(used - free) / total", 0.5, true},
+		{"used - free / total", 5.75, true},
+		{"-used + 2 * 3", 0, true},
+		{"used % 4", 2, true},
+		{`round(abs("temp in") * 1.8 + 32)`, 68, true},
+		{"log(total, 2)", 3, true},
+		{"LOG10(100)", 2, true},
+		{"pow(free, 3) - 1e1", -2, true},
+		{`"used"::field * 2`, 12, true},
+		{"used / zero", 0, true},
+		{"missing + 1", 0, false},
+		{"sqrt(-used)", 0, false},
+		{"ln(zero)", 0, false},
+	}
+	for _, tt := range tests {
+		e, err := Parse(tt.expr)
+		if !assert.NoError(t, err, tt.expr) {
+			continue
+		}
+		got, ok := e.Eval(fields)
+		assert.Equal(t, tt.valid, ok, tt.expr)
+		if tt.valid {
+			assert.InDelta(t, tt.want, got, 1e-9, tt.expr)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{"", "value *", "(value", "value)", "1.2.3", `"value`, "nope(value)", "abs(value, 2)", "log(value)", "value $ 2"} {
+		_, err := Parse(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestNames(t *testing.T) {
+	for s, want := range map[string]string{
+		"value * 100":           "value",
+		"(used - free) / total": "used_free_total",
+		"round(value)":          "round",
+		"1 + 2":                 "(1 + 2)",
+	} {
+		e, err := Parse(s)
+		assert.NoError(t, err)
+		assert.Equal(t, want, Name(e), s)
+	}
+
+	e, err := Parse(`"temp in" * -2 + value`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"temp in", "value"}, Fields(e))
+	assert.Equal(t, `(("temp in" * -2) + value)`, e.String())
+}
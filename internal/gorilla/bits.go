@@ -0,0 +1,70 @@
+package gorilla
+
+import "errors"
+
+var errShortBuffer = errors.New("gorilla: unexpected end of block")
+
+// bitWriter appends bits to a byte slice, most significant bit first
+type bitWriter struct {
+	buf  []byte
+	used uint // bits used in the last byte, 8 when it is full
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if bit {
+		w.writeBits(1, 1)
+	} else {
+		w.writeBits(0, 1)
+	}
+}
+
+// writeBits writes the n low bits of v
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for n > 0 {
+		if len(w.buf) == 0 || w.used == 8 {
+			w.buf = append(w.buf, 0)
+			w.used = 0
+		}
+		free := 8 - w.used
+		take := free
+		if n < take {
+			take = n
+		}
+		bits := byte(v>>(n-take)) & byte(1<<take-1)
+		w.buf[len(w.buf)-1] |= bits << (free - take)
+		w.used += take
+		n -= take
+	}
+}
+
+// bitReader reads bits written by bitWriter
+type bitReader struct {
+	buf []byte
+	pos uint // next bit to read
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	v, err := r.readBits(1)
+	return v == 1, err
+}
+
+// readBits reads n bits into the low bits of the result
+func (r *bitReader) readBits(n uint) (uint64, error) {
+	if r.pos+n > uint(len(r.buf))*8 {
+		return 0, errShortBuffer
+	}
+	var v uint64
+	for n > 0 {
+		offset := r.pos % 8
+		avail := 8 - offset
+		take := avail
+		if n < take {
+			take = n
+		}
+		bits := (r.buf[r.pos/8] >> (avail - take)) & byte(1<<take-1)
+		v = v<<take | uint64(bits)
+		r.pos += take
+		n -= take
+	}
+	return v, nil
+}
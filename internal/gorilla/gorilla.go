@@ -0,0 +1,299 @@
+// Package gorilla packs the points of a series into compact blocks, using
+// the encodings of Facebook's Gorilla paper: timestamps are stored as
+// delta-of-deltas and float values as the XOR with the previous value of
+// the same field. Regular intervals and slowly changing values take a
+// few bits per point instead of the tens of bytes of a row.
+//
+// A block starts with a header of uvarints: the number of points, the
+// number of fields and the length-prefixed field names. A bit stream
+// follows, holding the timestamps and then one value column per field.
+package gorilla
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// missingBits is a NaN payload Go arithmetic never produces
+const missingBits = 0x7ff0dead00000001
+
+// Missing marks a field without a value at a timestamp of the block
+var Missing = math.Float64frombits(missingBits)
+
+// IsMissing reports whether v is the Missing marker
+func IsMissing(v float64) bool {
+	return math.Float64bits(v) == missingBits
+}
+
+// Block holds the points of one series in time order. Every field column
+// has one value per timestamp, Missing where the point lacks the field.
+type Block struct {
+	Timestamps []int64
+	Fields     map[string][]float64
+}
+
+// Len returns the number of points of the block
+func (b Block) Len() int {
+	return len(b.Timestamps)
+}
+
+// Encode packs a block. Timestamps must be sorted.
+func Encode(b Block) ([]byte, error) {
+	names := make([]string, 0, len(b.Fields))
+	for name, values := range b.Fields {
+		if len(values) != len(b.Timestamps) {
+			return nil, fmt.Errorf("gorilla: field %s has %d values for %d timestamps", name, len(values), len(b.Timestamps))
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := binary.AppendUvarint(nil, uint64(len(b.Timestamps)))
+	buf = binary.AppendUvarint(buf, uint64(len(names)))
+	for _, name := range names {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+	}
+
+	w := &bitWriter{buf: buf, used: 8}
+	if err := encodeTimestamps(w, b.Timestamps); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		encodeValues(w, b.Fields[name])
+	}
+	return w.buf, nil
+}
+
+// Decode unpacks a block produced by Encode
+func Decode(data []byte) (Block, error) {
+	n, data, err := readUvarint(data)
+	if err != nil {
+		return Block{}, err
+	}
+	fields, data, err := readUvarint(data)
+	if err != nil {
+		return Block{}, err
+	}
+	// Every point and field takes at least one bit
+	if n > uint64(len(data))*8+1 || fields > uint64(len(data)) {
+		return Block{}, errShortBuffer
+	}
+
+	names := make([]string, fields)
+	for i := range names {
+		var size uint64
+		if size, data, err = readUvarint(data); err != nil {
+			return Block{}, err
+		}
+		if size > uint64(len(data)) {
+			return Block{}, errShortBuffer
+		}
+		names[i] = string(data[:size])
+		data = data[size:]
+	}
+
+	r := &bitReader{buf: data}
+	b := Block{Fields: make(map[string][]float64, len(names))}
+	if b.Timestamps, err = decodeTimestamps(r, int(n)); err != nil {
+		return Block{}, err
+	}
+	for _, name := range names {
+		if b.Fields[name], err = decodeValues(r, int(n)); err != nil {
+			return Block{}, err
+		}
+	}
+	return b, nil
+}
+
+func readUvarint(data []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, errShortBuffer
+	}
+	return v, data[n:], nil
+}
+
+// dodBuckets are the signed widths a delta-of-delta is stored in, after a
+// prefix of as many one bits as its index and a terminating zero bit.
+// The last bucket has no terminating bit.
+var dodBuckets = []uint{0, 7, 9, 12, 32, 64}
+
+func encodeTimestamps(w *bitWriter, timestamps []int64) error {
+	var prev, delta int64
+	for i, ts := range timestamps {
+		if i == 0 {
+			w.writeBits(uint64(ts), 64)
+			prev = ts
+			continue
+		}
+		if ts < prev {
+			return fmt.Errorf("gorilla: timestamps are not sorted")
+		}
+		d := ts - prev
+		dod := d - delta
+		prev, delta = ts, d
+
+		for bucket, width := range dodBuckets {
+			last := bucket == len(dodBuckets)-1
+			if !last && !fitsSigned(dod, width) {
+				continue
+			}
+			w.writeBits(1<<bucket-1, uint(bucket))
+			if !last {
+				w.writeBit(false)
+			}
+			w.writeBits(uint64(dod), width)
+			break
+		}
+	}
+	return nil
+}
+
+func decodeTimestamps(r *bitReader, n int) ([]int64, error) {
+	timestamps := make([]int64, n)
+	var prev, delta int64
+	for i := range timestamps {
+		if i == 0 {
+			v, err := r.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			timestamps[0], prev = int64(v), int64(v)
+			continue
+		}
+
+		bucket := 0
+		for bucket < len(dodBuckets)-1 {
+			one, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if !one {
+				break
+			}
+			bucket++
+		}
+		width := dodBuckets[bucket]
+		v, err := r.readBits(width)
+		if err != nil {
+			return nil, err
+		}
+		delta += signExtend(v, width)
+		prev += delta
+		timestamps[i] = prev
+	}
+	return timestamps, nil
+}
+
+// fitsSigned reports whether v fits in a two's complement integer of width bits
+func fitsSigned(v int64, width uint) bool {
+	if width == 0 {
+		return v == 0
+	}
+	if width >= 64 {
+		return true
+	}
+	limit := int64(1) << (width - 1)
+	return v >= -limit && v < limit
+}
+
+func signExtend(v uint64, width uint) int64 {
+	if width == 0 {
+		return 0
+	}
+	shift := 64 - width
+	return int64(v<<shift) >> shift
+}
+
+func encodeValues(w *bitWriter, values []float64) {
+	var prev uint64
+	// leading and trailing zero bits of the previous stored XOR; a
+	// leading of 65 means there is none yet
+	leading, trailing := uint(65), uint(0)
+	for i, v := range values {
+		cur := math.Float64bits(v)
+		if i == 0 {
+			w.writeBits(cur, 64)
+			prev = cur
+			continue
+		}
+		xor := cur ^ prev
+		prev = cur
+		if xor == 0 {
+			w.writeBit(false)
+			continue
+		}
+		w.writeBit(true)
+
+		l, t := uint(bits.LeadingZeros64(xor)), uint(bits.TrailingZeros64(xor))
+		if l > 31 {
+			l = 31
+		}
+		if leading <= 64 && l >= leading && t >= trailing {
+			// The meaningful bits fit in the previous window
+			w.writeBit(false)
+			w.writeBits(xor>>trailing, 64-leading-trailing)
+			continue
+		}
+		leading, trailing = l, t
+		meaningful := 64 - l - t
+		w.writeBit(true)
+		w.writeBits(uint64(l), 5)
+		w.writeBits(uint64(meaningful-1), 6)
+		w.writeBits(xor>>t, meaningful)
+	}
+}
+
+func decodeValues(r *bitReader, n int) ([]float64, error) {
+	values := make([]float64, n)
+	var prev uint64
+	var leading, trailing uint
+	for i := range values {
+		if i == 0 {
+			v, err := r.readBits(64)
+			if err != nil {
+				return nil, err
+			}
+			prev = v
+			values[0] = math.Float64frombits(v)
+			continue
+		}
+
+		changed, err := r.readBit()
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			newWindow, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if newWindow {
+				l, err := r.readBits(5)
+				if err != nil {
+					return nil, err
+				}
+				m, err := r.readBits(6)
+				if err != nil {
+					return nil, err
+				}
+				if l+m+1 > 64 {
+					return nil, fmt.Errorf("gorilla: corrupt value window")
+				}
+				leading = uint(l)
+				trailing = 64 - leading - uint(m) - 1
+			}
+			xor, err := r.readBits(64 - leading - trailing)
+			if err != nil {
+				return nil, err
+			}
+			prev ^= xor << trailing
+		}
+		values[i] = math.Float64frombits(prev)
+	}
+	return values, nil
+}
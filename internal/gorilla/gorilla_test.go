@@ -0,0 +1,106 @@
+package gorilla
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	base := int64(1742385600000000000)
+
+	var b Block
+	b.Fields = map[string][]float64{"usage": nil, "load": nil, "sparse": nil}
+	ts := base
+	for i := 0; i < 500; i++ {
+		// Mostly regular intervals with some jitter and gaps
+		switch {
+		case i%50 == 0:
+			ts += int64(rng.Intn(1e9))
+		case i%7 == 0:
+			ts += 10e9 + int64(rng.Intn(1000))
+		default:
+			ts += 10e9
+		}
+		b.Timestamps = append(b.Timestamps, ts)
+		b.Fields["usage"] = append(b.Fields["usage"], float64(i%10))
+		b.Fields["load"] = append(b.Fields["load"], rng.NormFloat64()*100)
+		sparse := Missing
+		if i%3 == 0 {
+			sparse = float64(i)
+		}
+		b.Fields["sparse"] = append(b.Fields["sparse"], sparse)
+	}
+
+	data, err := Encode(b)
+	assert.NoError(t, err)
+	got, err := Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, b.Timestamps, got.Timestamps)
+	assert.Equal(t, b.Fields["usage"], got.Fields["usage"])
+	assert.Equal(t, b.Fields["load"], got.Fields["load"])
+	for i, v := range got.Fields["sparse"] {
+		assert.Equal(t, i%3 != 0, IsMissing(v))
+	}
+}
+
+func TestSpecialValues(t *testing.T) {
+	values := []float64{0, math.Copysign(0, -1), math.Inf(1), math.Inf(-1), math.MaxFloat64, math.SmallestNonzeroFloat64, -1, 1, 1, Missing}
+	timestamps := []int64{math.MinInt64, -1, 0, 1, 2, 3, 1 << 40, 1<<40 + 1, math.MaxInt64 - 1, math.MaxInt64}
+	data, err := Encode(Block{Timestamps: timestamps, Fields: map[string][]float64{"v": values}})
+	assert.NoError(t, err)
+
+	got, err := Decode(data)
+	assert.NoError(t, err)
+	assert.Equal(t, timestamps, got.Timestamps)
+	for i, v := range values {
+		assert.Equal(t, math.Float64bits(v), math.Float64bits(got.Fields["v"][i]))
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	_, err := Encode(Block{Timestamps: []int64{2, 1}, Fields: map[string][]float64{"v": {1, 2}}})
+	assert.Error(t, err)
+	_, err = Encode(Block{Timestamps: []int64{1, 2}, Fields: map[string][]float64{"v": {1}}})
+	assert.Error(t, err)
+
+	data, err := Encode(Block{Timestamps: []int64{1, 2, 3}, Fields: map[string][]float64{"v": {1, 2, 3}}})
+	assert.NoError(t, err)
+	for i := 0; i < len(data); i++ {
+		_, err := Decode(data[:i])
+		assert.Error(t, err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	var b Block
+	b.Fields = map[string][]float64{"value": nil}
+	for i := 0; i < 1000; i++ {
+		b.Timestamps = append(b.Timestamps, int64(i)*10e9)
+		b.Fields["value"] = append(b.Fields["value"], float64(50+i%5))
+	}
+	data, err := Encode(b)
+	assert.NoError(t, err)
+	// 16 bytes per raw point
+	assert.Less(t, len(data), 1000*16/4)
+}
+
+func BenchmarkDecode(b *testing.B) {
+	var block Block
+	block.Fields = map[string][]float64{"value": nil}
+	for i := 0; i < 1000; i++ {
+		block.Timestamps = append(block.Timestamps, int64(i)*10e9)
+		block.Fields["value"] = append(block.Fields["value"], float64(i%100)/3)
+	}
+	data, _ := Encode(block)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
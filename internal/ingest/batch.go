@@ -0,0 +1,226 @@
+package ingest
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	batchesFlushed = metrics.NewCounter("refluxdb_ingest_batches_flushed_total", "Batches flushed by the ingest pipeline")
+	batchErrors    = metrics.NewCounter("refluxdb_ingest_batch_errors_total", "Batches the ingest pipeline failed to store")
+	batchesDropped = metrics.NewCounter("refluxdb_ingest_batches_dropped_total", "Point sets dropped because the ingest pipeline was full")
+)
+
+// Writer stores batches of points
+type Writer interface {
+	SaveBatch(points []persistence.Point) error
+}
+
+// BatchOptions control how points are grouped before being written
+type BatchOptions struct {
+	// Size is the number of points that triggers a flush
+	Size int
+	// Timeout flushes a partial batch once it has been pending this long
+	Timeout time.Duration
+	// Pending is the number of point sets that may be queued before Add
+	// starts dropping them
+	Pending int
+	// Workers is the number of batches stored at once. While workers
+	// store batches, the next one keeps filling instead of the queue.
+	// Batches may then be stored out of order, so a point written twice
+	// within a flush may keep either value.
+	Workers int
+	// Budget bounds the memory of the points queued and being stored,
+	// and may be shared with other pipelines. When it is exhausted the
+	// oldest queued point sets are evicted to make room. Nil is unlimited.
+	Budget *Budget
+}
+
+// DefaultBatchOptions are used for any zero BatchOptions field. Workers
+// and Pending are tuned to GOMAXPROCS by AutoWorkers.
+var DefaultBatchOptions = BatchOptions{
+	Size:    5000,
+	Timeout: time.Second,
+	Pending: 10,
+}
+
+// AutoWorkers returns the default number of ingest workers, one per
+// processor Go may use, as set by GOMAXPROCS
+func AutoWorkers() int {
+	return runtime.GOMAXPROCS(0)
+}
+
+// Batcher accumulates points from many writers and stores them in batches,
+// turning a stream of small writes into few large transactions
+type Batcher struct {
+	w    Writer
+	opts BatchOptions
+	in   chan pointSet
+	wg   sync.WaitGroup
+	once sync.Once
+}
+
+// pointSet is a set of points with its size reserved in the budget
+type pointSet struct {
+	points []persistence.Point
+	size   int64
+}
+
+// NewBatcher creates a batcher writing to w. Start must be called before
+// points are added.
+func NewBatcher(w Writer, opts BatchOptions) *Batcher {
+	if opts.Size <= 0 {
+		opts.Size = DefaultBatchOptions.Size
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultBatchOptions.Timeout
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = AutoWorkers()
+	}
+	// Each worker gets its share of the default queue
+	if opts.Pending <= 0 {
+		opts.Pending = DefaultBatchOptions.Pending * opts.Workers
+	}
+	return &Batcher{
+		w:    w,
+		opts: opts,
+		in:   make(chan pointSet, opts.Pending),
+	}
+}
+
+// Start runs the flush loop and its workers
+func (b *Batcher) Start() {
+	b.wg.Add(1)
+	go b.run()
+}
+
+// Options returns the options of the batcher, defaults included
+func (b *Batcher) Options() BatchOptions {
+	return b.opts
+}
+
+// Add queues points for the next batch. It never blocks: when the pipeline
+// is full the points are dropped and Add returns false. When the memory
+// budget is exhausted, the oldest queued point sets are dropped first to
+// make room, as the newest points are usually the most useful.
+func (b *Batcher) Add(points []persistence.Point) bool {
+	if len(points) == 0 {
+		return true
+	}
+	set := pointSet{points: points}
+	if b.opts.Budget != nil {
+		set.size = PointsSize(points)
+		for !b.opts.Budget.Reserve(set.size) {
+			if !b.evictOldest() {
+				batchesDropped.Inc()
+				return false
+			}
+		}
+	}
+	select {
+	case b.in <- set:
+		return true
+	default:
+		b.opts.Budget.Release(set.size)
+		batchesDropped.Inc()
+		return false
+	}
+}
+
+// evictOldest drops the oldest queued point set and reports whether there
+// was one
+func (b *Batcher) evictOldest() bool {
+	select {
+	case set, ok := <-b.in:
+		if !ok {
+			return false
+		}
+		b.opts.Budget.Release(set.size)
+		batchesEvicted.Inc()
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop flushes every queued point and waits for the flush loop to exit.
+// Add must not be called after Stop.
+func (b *Batcher) Stop() {
+	b.once.Do(func() {
+		close(b.in)
+		b.wg.Wait()
+	})
+}
+
+// run assembles the batches and hands them to the workers, waiting for
+// one to be free when they are all storing a batch
+func (b *Batcher) run() {
+	defer b.wg.Done()
+
+	full := make(chan pointSet)
+	var workers sync.WaitGroup
+	for i := 0; i < b.opts.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for batch := range full {
+				b.store(batch)
+			}
+		}()
+	}
+	defer func() {
+		close(full)
+		workers.Wait()
+	}()
+
+	batch := pointSet{points: make([]persistence.Point, 0, b.opts.Size)}
+	timer := time.NewTimer(b.opts.Timeout)
+	timer.Stop()
+
+	flush := func() {
+		timer.Stop()
+		if len(batch.points) == 0 {
+			return
+		}
+		full <- batch
+		batch = pointSet{points: make([]persistence.Point, 0, b.opts.Size)}
+	}
+
+	for {
+		select {
+		case set, ok := <-b.in:
+			if !ok {
+				flush()
+				return
+			}
+			if len(batch.points) == 0 {
+				timer.Reset(b.opts.Timeout)
+			}
+			batch.points = append(batch.points, set.points...)
+			batch.size += set.size
+			if len(batch.points) >= b.opts.Size {
+				flush()
+			}
+		case <-timer.C:
+			flush()
+		}
+	}
+}
+
+// store writes a batch, logging the failures, and returns its memory to
+// the budget
+func (b *Batcher) store(batch pointSet) {
+	defer b.opts.Budget.Release(batch.size)
+	if err := b.w.SaveBatch(batch.points); err != nil {
+		batchErrors.Inc()
+		logrus.Errorf("Failed to write batch of %d points: %v", len(batch.points), err)
+		return
+	}
+	batchesFlushed.Inc()
+}
@@ -0,0 +1,115 @@
+package ingest
+
+import (
+	"math"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+var (
+	budgetUsed     = metrics.NewGauge("refluxdb_ingest_memory_used_bytes", "Estimated memory held by points buffered for storage")
+	budgetLimit    = metrics.NewGauge("refluxdb_ingest_memory_budget_bytes", "Memory budget of the points buffered for storage, 0 when unlimited")
+	budgetRejected = metrics.NewCounter("refluxdb_ingest_memory_rejections_total", "Point sets rejected because the memory budget was exhausted")
+	batchesEvicted = metrics.NewCounter("refluxdb_ingest_batches_evicted_total", "Queued point sets dropped to make room for newer ones within the memory budget")
+)
+
+// Budget bounds the memory held by the points buffered between their
+// parsing and their storage, shared by every ingest path. A nil Budget is
+// unlimited.
+type Budget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// NewBudget returns a budget of limit bytes, or nil when limit is not
+// positive
+func NewBudget(limit int64) *Budget {
+	if limit <= 0 {
+		return nil
+	}
+	budgetLimit.Set(float64(limit))
+	return &Budget{limit: limit}
+}
+
+// AutoBudget returns a quarter of the Go memory limit set by GOMEMLIMIT or
+// debug.SetMemoryLimit, leaving the rest to queries, caches and the
+// garbage collector headroom, or 0 when no limit is set
+func AutoBudget() int64 {
+	limit := debug.SetMemoryLimit(-1)
+	if limit <= 0 || limit == math.MaxInt64 {
+		return 0
+	}
+	return limit / 4
+}
+
+// Reserve accounts for n more bytes and reports whether they fit in the
+// budget. Nothing is reserved when they do not.
+func (b *Budget) Reserve(n int64) bool {
+	if b == nil {
+		return true
+	}
+	for {
+		used := b.used.Load()
+		if used+n > b.limit && used > 0 {
+			budgetRejected.Inc()
+			return false
+		}
+		// A set larger than the whole budget is still accepted when
+		// nothing else is buffered, or it could never be stored
+		if b.used.CompareAndSwap(used, used+n) {
+			budgetUsed.Set(float64(used + n))
+			return true
+		}
+	}
+}
+
+// Release returns n reserved bytes to the budget
+func (b *Budget) Release(n int64) {
+	if b == nil {
+		return
+	}
+	budgetUsed.Set(float64(b.used.Add(-n)))
+}
+
+// Used returns the bytes currently reserved
+func (b *Budget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.used.Load()
+}
+
+// Limit returns the size of the budget, 0 when unlimited
+func (b *Budget) Limit() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.limit
+}
+
+// Estimated sizes of the parts of a point: the struct with its map
+// headers, and each map entry with its string headers and bucket share
+const (
+	pointOverhead = 128
+	tagOverhead   = 48
+	fieldOverhead = 40
+)
+
+// PointsSize estimates the memory held by points
+func PointsSize(points []persistence.Point) int64 {
+	var n int64
+	for i := range points {
+		p := &points[i]
+		n += pointOverhead + int64(len(p.Database)+len(p.Measurement))
+		for k, v := range p.Tags {
+			n += tagOverhead + int64(len(k)+len(v))
+		}
+		for k := range p.Fields {
+			n += fieldOverhead + int64(len(k))
+		}
+	}
+	return n
+}
@@ -0,0 +1,64 @@
+package ingest
+
+import (
+	"errors"
+	"net/netip"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/sirupsen/logrus"
+)
+
+var deadLettersRecorded = metrics.NewCounter("refluxdb_ingest_dead_letters_total", "Dropped lines recorded as dead letters")
+
+// DeadLetters records the lines dropped by the parser, so that they can be
+// inspected and replayed once corrected instead of only being logged
+type DeadLetters struct {
+	db  *persistence.Manager
+	max int
+}
+
+// NewDeadLetters records dropped lines in db, keeping the latest max. It
+// returns nil, which records nothing, when max is not positive.
+func NewDeadLetters(db *persistence.Manager, max int) *DeadLetters {
+	if max <= 0 {
+		return nil
+	}
+	return &DeadLetters{db: db, max: max}
+}
+
+// Record stores the lines dropped according to err, a *PartialWriteError
+// returned by the parser, as written to database by source with
+// timestamps in precision. Other errors are ignored, as they reject whole
+// payloads rather than lines. An empty database is the default one.
+func (d *DeadLetters) Record(database string, source netip.Addr, precision time.Duration, err error) {
+	var partial *PartialWriteError
+	if d == nil || !errors.As(err, &partial) {
+		return
+	}
+	if database == "" {
+		database = persistence.DefaultDatabase
+	}
+	var from string
+	if source.IsValid() {
+		from = source.Unmap().String()
+	}
+	now := time.Now()
+	letters := make([]persistence.DeadLetter, 0, len(partial.Dropped))
+	for _, r := range partial.Dropped {
+		letters = append(letters, persistence.DeadLetter{
+			Time:      now,
+			Database:  database,
+			Source:    from,
+			Precision: precision,
+			Line:      r.Text,
+			Error:     r.Reason,
+		})
+	}
+	if err := d.db.RecordDeadLetters(letters, d.max); err != nil {
+		logrus.Errorf("Failed to record dead letters: %v", err)
+		return
+	}
+	deadLettersRecorded.Add(uint64(len(letters)))
+}
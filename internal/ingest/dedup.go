@@ -0,0 +1,174 @@
+package ingest
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// DefaultDedupEntries is the number of points remembered by a Dedup when
+// none is set
+const DefaultDedupEntries = 1 << 20
+
+var (
+	duplicatesDropped = metrics.NewCounter("refluxdb_ingest_duplicates_dropped_total", "Points dropped because the same point was written within the deduplication window")
+	dedupEntries      = metrics.NewGauge("refluxdb_ingest_dedup_entries", "Points remembered by the deduplication window")
+)
+
+// Dedup drops the points written again within a window of time, such as
+// those of a write retried by an agent after a timeout. Points are
+// duplicates when their database, series, timestamp and fields are all
+// equal. A nil Dedup drops nothing.
+type Dedup struct {
+	window time.Duration
+	max    int
+	now    func() time.Time
+
+	mu sync.Mutex
+	// seen maps the hash of the points remembered to when they were first
+	// written
+	seen map[uint64]int64
+	// order is the queue of the remembered points, oldest first from head
+	order []dedupEntry
+	head  int
+}
+
+type dedupEntry struct {
+	hash uint64
+	at   int64
+}
+
+// NewDedup returns a Dedup remembering the points written over the last
+// window, at most max of them, the oldest being forgotten first. Zero max
+// means DefaultDedupEntries. It returns nil when window is not positive.
+func NewDedup(window time.Duration, max int) *Dedup {
+	if window <= 0 {
+		return nil
+	}
+	if max <= 0 {
+		max = DefaultDedupEntries
+	}
+	return &Dedup{window: window, max: max, now: time.Now, seen: make(map[uint64]int64)}
+}
+
+// Filter returns the points not written within the window, in place of
+// points, and remembers them. Duplicates within points are dropped too.
+func (d *Dedup) Filter(points []persistence.Point) []persistence.Point {
+	if d == nil || len(points) == 0 {
+		return points
+	}
+	hashes := make([]uint64, len(points))
+	for i := range points {
+		hashes[i] = pointHash(&points[i])
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now().UnixNano()
+	d.expire(now - int64(d.window))
+	kept := points[:0]
+	for i, h := range hashes {
+		if _, ok := d.seen[h]; ok {
+			duplicatesDropped.Inc()
+			continue
+		}
+		for len(d.seen) >= d.max {
+			d.evict()
+		}
+		d.seen[h] = now
+		d.order = append(d.order, dedupEntry{hash: h, at: now})
+		kept = append(kept, points[i])
+	}
+	dedupEntries.Set(float64(len(d.seen)))
+	return kept
+}
+
+// Forget forgets points, which Filter kept but could not be stored, so
+// that they are accepted when they are written again
+func (d *Dedup) Forget(points []persistence.Point) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i := range points {
+		delete(d.seen, pointHash(&points[i]))
+	}
+	dedupEntries.Set(float64(len(d.seen)))
+}
+
+// expire forgets the points written before cutoff
+func (d *Dedup) expire(cutoff int64) {
+	for d.head < len(d.order) && d.order[d.head].at <= cutoff {
+		d.evict()
+	}
+	// Reclaim the space of the forgotten entries once they make up half
+	// of the queue
+	if d.head > 0 && d.head >= len(d.order)/2 {
+		n := copy(d.order, d.order[d.head:])
+		d.order = d.order[:n]
+		d.head = 0
+	}
+}
+
+// evict forgets the oldest point, unless it was forgotten and remembered
+// again since
+func (d *Dedup) evict() {
+	if e := d.order[d.head]; d.seen[e.hash] == e.at {
+		delete(d.seen, e.hash)
+	}
+	d.order[d.head] = dedupEntry{}
+	d.head++
+}
+
+// pointHash hashes the database, series, timestamp and fields of p. Tags
+// and fields are hashed in key order, so that their order in the written
+// line does not matter.
+func pointHash(p *persistence.Point) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	write := func(s string) {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	database := p.Database
+	if database == "" {
+		database = persistence.DefaultDatabase
+	}
+	write(database)
+	write(p.Measurement)
+	binary.LittleEndian.PutUint64(buf[:], uint64(len(p.Tags)))
+	h.Write(buf[:])
+	for _, k := range sortedKeys(p.Tags) {
+		write(k)
+		write(p.Tags[k])
+	}
+	binary.LittleEndian.PutUint64(buf[:], uint64(p.Timestamp))
+	h.Write(buf[:])
+	keys := make([]string, 0, len(p.Fields))
+	for k := range p.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		write(k)
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(p.Fields[k]))
+		h.Write(buf[:])
+	}
+	return h.Sum64()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
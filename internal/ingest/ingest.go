@@ -0,0 +1,367 @@
+// Package ingest converts line protocol payloads received by the HTTP and
+// UDP servers into storage points, applying the write-path validation rules
+// shared by every ingest path.
+package ingest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/protocol"
+	"github.com/gleicon/go-refluxdb/internal/templates"
+	"github.com/gleicon/go-refluxdb/internal/xform"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	parseFailures  = metrics.NewCounter("refluxdb_ingest_parse_failures_total", "Lines dropped because they could not be parsed")
+	parseWarnings  = metrics.NewCounter("refluxdb_ingest_parse_warnings_total", "Parts of lines dropped by lenient parsing")
+	pointsRejected = metrics.NewCounterVec("refluxdb_ingest_points_rejected_total", "Points rejected by write validation", "reason")
+)
+
+// Options control the validation applied to ingested points
+type Options struct {
+	// MaxPast is the oldest accepted point age relative to the current time.
+	// Zero disables the check.
+	MaxPast time.Duration
+	// MaxFuture is how far ahead of the current time a point may be.
+	// Zero disables the check.
+	MaxFuture time.Duration
+	// WarnOnly accepts points outside the time window, only counting and
+	// logging them instead of rejecting them
+	WarnOnly bool
+	// ClampNonFinite stores +Inf and -Inf as the largest finite values and
+	// drops NaN fields instead of rejecting the point
+	ClampNonFinite bool
+	// MaxKeyLength is the longest accepted measurement name, tag key, tag
+	// value or field key, in bytes. Zero disables the check.
+	MaxKeyLength int
+	// Templates split dotted measurement names, such as Graphite metric
+	// paths, into a measurement, tags and a field. Nil disables them.
+	Templates *templates.Set
+	// Transforms rewrite or drop the points once templates are applied,
+	// before they are validated. Nil disables them.
+	Transforms *xform.Set
+	// MaxLines is the number of points accepted in one payload read by
+	// ParseReader or ParseJSONReader. Zero disables the limit.
+	MaxLines int
+	// MaxBytes is the size of a payload read by ParseReader or
+	// ParseJSONReader. Zero disables the limit.
+	MaxBytes int64
+	// Mode selects how strictly line protocol is checked. Lenient parsing
+	// logs and counts what it drops from a line.
+	Mode protocol.Mode
+}
+
+// Rejection describes a line dropped by the write path
+type Rejection struct {
+	Line   int
+	Text   string
+	Reason string
+}
+
+// PartialWriteError is returned when some lines of a payload were dropped.
+// The points returned alongside it are still valid and should be stored.
+type PartialWriteError struct {
+	Dropped []Rejection
+}
+
+// Error implements error
+func (e *PartialWriteError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "partial write: %d points dropped", len(e.Dropped))
+	for _, r := range e.Dropped {
+		fmt.Fprintf(&sb, "; line %d (%s): %s", r.Line, r.Text, r.Reason)
+	}
+	return sb.String()
+}
+
+// Stats holds the counters maintained by a Parser
+type Stats struct {
+	// TooOld counts points older than the MaxPast window
+	TooOld uint64
+	// TooNew counts points further in the future than the MaxFuture window
+	TooNew uint64
+}
+
+// Parser turns line protocol payloads into points
+type Parser struct {
+	opts   Options
+	now    func() time.Time
+	tooOld atomic.Uint64
+	tooNew atomic.Uint64
+}
+
+// NewParser creates a parser applying the given options
+func NewParser(opts Options) *Parser {
+	return &Parser{
+		opts: opts,
+		now:  time.Now,
+	}
+}
+
+// Stats returns a snapshot of the parser counters
+func (p *Parser) Stats() Stats {
+	return Stats{
+		TooOld: p.tooOld.Load(),
+		TooNew: p.tooNew.Load(),
+	}
+}
+
+// Parse converts every line of body into a point. Blank lines and comments
+// are skipped. Malformed lines and points outside the accepted time window
+// are dropped and reported through a *PartialWriteError, which is returned
+// together with the points that were accepted.
+func (p *Parser) Parse(body []byte) ([]persistence.Point, error) {
+	return p.parse(protocol.ParseBatch(bytes.NewReader(body), protocol.Limits{}), time.Nanosecond)
+}
+
+// ParseReader is Parse reading the payload from r line by line, so a large
+// request body is never held in memory whole. A payload over the MaxLines
+// or MaxBytes limits is rejected as a whole, with an error wrapping
+// protocol.ErrTooManyLines or protocol.ErrBatchTooLarge.
+func (p *Parser) ParseReader(r io.Reader) ([]persistence.Point, error) {
+	return p.parse(protocol.ParseBatch(r, p.limits()), time.Nanosecond)
+}
+
+// ParseReaderPrecision is ParseReader for a payload whose timestamps count
+// units of precision, such as time.Second for the precision=s parameter of
+// the write endpoints. Lines whose timestamp does not fit in nanoseconds
+// are dropped.
+func (p *Parser) ParseReaderPrecision(r io.Reader, precision time.Duration) ([]persistence.Point, error) {
+	return p.parse(protocol.ParseBatch(r, p.limits()), precision)
+}
+
+func (p *Parser) limits() protocol.Limits {
+	return protocol.Limits{MaxLines: p.opts.MaxLines, MaxBytes: p.opts.MaxBytes}
+}
+
+func (p *Parser) parse(batch *protocol.Batch, precision time.Duration) ([]persistence.Point, error) {
+	now := p.now()
+	var points []persistence.Point
+	var dropped []Rejection
+
+	// The tokenizer reuses its buffers from line to line, so only the
+	// strings and maps kept in the points are allocated. Names repeated
+	// through the payload share a single string.
+	tok := protocol.Tokenizer{Mode: p.opts.Mode}
+	names := make(internTable)
+	for batch.Next() {
+		n := batch.Line()
+		if err := batch.Tokenize(&tok); err != nil {
+			parseFailures.Inc()
+			dropped = append(dropped, Rejection{Line: n, Text: batch.Text(), Reason: fmt.Sprintf("unable to parse: %v", err)})
+			continue
+		}
+		for _, w := range tok.Warnings() {
+			parseWarnings.Inc()
+			logrus.Warnf("Salvaging line %d: %s", n, w)
+		}
+
+		// Points without a timestamp get the server time
+		point := persistence.Point{
+			Measurement: names.get(tok.Measurement()),
+			Fields:      make(map[string]float64, len(tok.Fields())),
+			Timestamp:   now.UnixNano(),
+		}
+		if tags := tok.Tags(); len(tags) > 0 {
+			point.Tags = make(map[string]string, len(tags))
+			for _, tag := range tags {
+				point.Tags[names.get(tag.Key)] = names.get(tag.Value)
+			}
+		}
+		for i, field := range tok.Fields() {
+			point.Fields[names.get(field.Key)] = tok.Float(i)
+		}
+		if ts := tok.Timestamp(); ts != 0 {
+			if ts > math.MaxInt64/int64(precision) || ts < math.MinInt64/int64(precision) {
+				dropped = append(dropped, Rejection{Line: n, Text: batch.Text(), Reason: fmt.Sprintf("timestamp %d is out of range for precision %s", ts, precision)})
+				continue
+			}
+			point.Timestamp = ts * int64(precision)
+		}
+
+		if !p.transform(&point) {
+			continue
+		}
+		if reason := p.check(&point, n, now); reason != "" {
+			dropped = append(dropped, Rejection{Line: n, Text: batch.Text(), Reason: reason})
+			continue
+		}
+		points = append(points, point)
+	}
+	if err := batch.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(dropped) > 0 {
+		return points, &PartialWriteError{Dropped: dropped}
+	}
+	return points, nil
+}
+
+// internTable maps names read from a payload to a single copy
+type internTable map[string]string
+
+// get returns the string holding b, allocating it the first time b is seen
+func (t internTable) get(b []byte) string {
+	if s, ok := t[string(b)]; ok {
+		return s
+	}
+	s := string(b)
+	t[s] = s
+	return s
+}
+
+// transform applies the templates and the transforms to a point and
+// reports whether it is kept
+func (p *Parser) transform(point *persistence.Point) bool {
+	p.applyTemplate(point)
+	return p.opts.Transforms.Apply(point)
+}
+
+// check applies the write validation rules to the point found at line n
+// and returns why it is rejected, or an empty string when it is accepted.
+// Non-finite values may be clamped in place.
+func (p *Parser) check(point *persistence.Point, n int, now time.Time) string {
+	if reason := p.checkKeys(point); reason != "" {
+		pointsRejected.With("key_too_long").Inc()
+		return reason
+	}
+	if reason := p.checkValues(point.Fields); reason != "" {
+		pointsRejected.With("non_finite").Inc()
+		return reason
+	}
+	if reason := p.checkTime(point.Timestamp, now); reason != "" {
+		if !p.opts.WarnOnly {
+			return reason
+		}
+		logrus.Warnf("Accepting point on line %d: %s", n, reason)
+	}
+	return ""
+}
+
+// applyTemplate rewrites a point whose measurement is a dotted name matched
+// by one of the templates. Tags extracted from the name never override the
+// tags of the point. When the template names a field, the "value" field
+// takes that name and other fields are prefixed with it.
+func (p *Parser) applyTemplate(point *persistence.Point) {
+	if !strings.Contains(point.Measurement, ".") {
+		return
+	}
+	r, ok := p.opts.Templates.Apply(point.Measurement)
+	if !ok {
+		return
+	}
+
+	point.Measurement = r.Measurement
+	if len(r.Tags) > 0 {
+		tags := make(map[string]string, len(point.Tags)+len(r.Tags))
+		for k, v := range r.Tags {
+			tags[k] = v
+		}
+		for k, v := range point.Tags {
+			tags[k] = v
+		}
+		point.Tags = tags
+	}
+	if r.Field != "" {
+		fields := make(map[string]float64, len(point.Fields))
+		for k, v := range point.Fields {
+			if k == "value" {
+				fields[r.Field] = v
+			} else {
+				fields[r.Field+"."+k] = v
+			}
+		}
+		point.Fields = fields
+	}
+}
+
+// checkKeys returns why a point has a name longer than MaxKeyLength, or an
+// empty string when every name fits
+func (p *Parser) checkKeys(point *persistence.Point) string {
+	max := p.opts.MaxKeyLength
+	if max <= 0 {
+		return ""
+	}
+	if len(point.Measurement) > max {
+		return fmt.Sprintf("measurement is %d bytes long, more than max-key-length %d", len(point.Measurement), max)
+	}
+	for k, v := range point.Tags {
+		if len(k) > max {
+			return fmt.Sprintf("tag key %q is %d bytes long, more than max-key-length %d", abbreviate(k), len(k), max)
+		}
+		if len(v) > max {
+			return fmt.Sprintf("value of tag %q is %d bytes long, more than max-key-length %d", abbreviate(k), len(v), max)
+		}
+	}
+	for k := range point.Fields {
+		if len(k) > max {
+			return fmt.Sprintf("field key %q is %d bytes long, more than max-key-length %d", abbreviate(k), len(k), max)
+		}
+	}
+	return ""
+}
+
+// abbreviate shortens a name quoted in an error message
+func abbreviate(name string) string {
+	if len(name) <= 32 {
+		return name
+	}
+	return name[:32] + "..."
+}
+
+// checkValues returns why fields hold a NaN or infinite value, which
+// storage and JSON responses cannot represent, or an empty string when
+// they are accepted. With ClampNonFinite, infinities are replaced by the
+// largest finite values and NaN fields are removed instead.
+func (p *Parser) checkValues(fields map[string]float64) string {
+	for k, v := range fields {
+		if !math.IsNaN(v) && !math.IsInf(v, 0) {
+			continue
+		}
+		if !p.opts.ClampNonFinite {
+			return fmt.Sprintf("field %q has non-finite value %v", k, v)
+		}
+		switch {
+		case math.IsNaN(v):
+			delete(fields, k)
+		case v > 0:
+			fields[k] = math.MaxFloat64
+		default:
+			fields[k] = -math.MaxFloat64
+		}
+	}
+	if len(fields) == 0 {
+		return "no finite field values"
+	}
+	return ""
+}
+
+// checkTime returns why the nanosecond timestamp falls outside the accepted
+// window, or an empty string when it is accepted. Out of window points are
+// counted.
+func (p *Parser) checkTime(timestamp int64, now time.Time) string {
+	t := time.Unix(0, timestamp)
+	if p.opts.MaxPast > 0 && t.Before(now.Add(-p.opts.MaxPast)) {
+		p.tooOld.Add(1)
+		pointsRejected.With("too_old").Inc()
+		return fmt.Sprintf("timestamp %s is older than the max-past window of %s",
+			t.UTC().Format(time.RFC3339Nano), p.opts.MaxPast)
+	}
+	if p.opts.MaxFuture > 0 && t.After(now.Add(p.opts.MaxFuture)) {
+		p.tooNew.Add(1)
+		pointsRejected.With("too_new").Inc()
+		return fmt.Sprintf("timestamp %s is further ahead than the max-future window of %s",
+			t.UTC().Format(time.RFC3339Nano), p.opts.MaxFuture)
+	}
+	return ""
+}
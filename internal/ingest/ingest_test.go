@@ -0,0 +1,515 @@
+package ingest
+
+import (
+	"errors"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/protocol"
+	"github.com/gleicon/go-refluxdb/internal/templates"
+	"github.com/stretchr/testify/assert"
+)
+
+var testNow = time.Date(2025, 3, 19, 12, 0, 0, 0, time.UTC)
+
+func newTestParser(opts Options) *Parser {
+	p := NewParser(opts)
+	p.now = func() time.Time { return testNow }
+	return p
+}
+
+func TestParse(t *testing.T) {
+	p := newTestParser(Options{})
+	body := "# comment\ncpu,host=a value=1,temp=2i 1556813561098000000\n\nmem used=3\n"
+
+	points, err := p.Parse([]byte(body))
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+
+	assert.Equal(t, "cpu", points[0].Measurement)
+	assert.Equal(t, map[string]string{"host": "a"}, points[0].Tags)
+	assert.Equal(t, map[string]float64{"value": 1, "temp": 2}, points[0].Fields)
+	assert.Equal(t, int64(1556813561098000000), points[0].Timestamp)
+
+	// Missing timestamps default to the current time
+	assert.Equal(t, testNow.UnixNano(), points[1].Timestamp)
+}
+
+func BenchmarkParse(b *testing.B) {
+	var sb strings.Builder
+	for i := 0; i < 1000; i++ {
+		sb.WriteString("cpu,host=server-" + strconv.Itoa(i%10) + ",region=us-west usage_user=42.5,usage_system=3i,idle=true 1465839830" + strconv.Itoa(100400200+i) + "\n")
+	}
+	body := []byte(sb.String())
+	p := NewParser(Options{})
+
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Parse(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParseInvalidLine(t *testing.T) {
+	p := newTestParser(Options{})
+	points, err := p.Parse([]byte("cpu value=1\ncpu value=abc\n"))
+	assert.Len(t, points, 1)
+
+	var partial *PartialWriteError
+	assert.True(t, errors.As(err, &partial))
+	assert.Len(t, partial.Dropped, 1)
+	assert.Equal(t, 2, partial.Dropped[0].Line)
+	assert.Contains(t, partial.Dropped[0].Reason, "unable to parse")
+}
+
+func TestParseReaderLimits(t *testing.T) {
+	body := "cpu value=1\ncpu value=abc\ncpu value=3\n"
+
+	// Limits only apply to payloads read from a reader
+	p := newTestParser(Options{MaxLines: 2, MaxBytes: 20})
+	points, err := p.Parse([]byte(body))
+	assert.Len(t, points, 2)
+	var partial *PartialWriteError
+	assert.ErrorAs(t, err, &partial)
+
+	// Payloads over a limit are rejected as a whole
+	points, err = p.ParseReader(strings.NewReader(body))
+	assert.ErrorIs(t, err, protocol.ErrBatchTooLarge)
+	assert.Nil(t, points)
+
+	p = newTestParser(Options{MaxLines: 2})
+	_, err = p.ParseReader(strings.NewReader(body))
+	assert.ErrorIs(t, err, protocol.ErrTooManyLines)
+
+	p = newTestParser(Options{MaxLines: 3, MaxBytes: int64(len(body))})
+	points, err = p.ParseReader(strings.NewReader(body))
+	assert.Len(t, points, 2)
+	assert.ErrorAs(t, err, &partial)
+	assert.Equal(t, 2, partial.Dropped[0].Line)
+
+	json := `[{"measurement": "cpu", "fields": {"value": 1}}, {"measurement": "cpu", "fields": {}}]`
+	p = newTestParser(Options{MaxLines: 1})
+	_, err = p.ParseJSONReader(strings.NewReader(json))
+	assert.ErrorIs(t, err, protocol.ErrTooManyLines)
+	p = newTestParser(Options{MaxBytes: 10})
+	_, err = p.ParseJSONReader(strings.NewReader(json))
+	assert.ErrorIs(t, err, protocol.ErrBatchTooLarge)
+	p = newTestParser(Options{MaxLines: 2, MaxBytes: int64(len(json))})
+	points, err = p.ParseJSONReader(strings.NewReader(json))
+	assert.Len(t, points, 1)
+	assert.ErrorAs(t, err, &partial)
+}
+
+func TestParseReaderPrecision(t *testing.T) {
+	p := newTestParser(Options{})
+	points, err := p.ParseReaderPrecision(strings.NewReader("cpu value=1 1742385600\ncpu value=2\ncpu value=3 9300000000000"), time.Second)
+	assert.Len(t, points, 2)
+	assert.Equal(t, testNow.UnixNano(), points[0].Timestamp)
+	assert.Equal(t, testNow.UnixNano(), points[1].Timestamp)
+
+	// Timestamps overflowing nanoseconds are dropped
+	var partial *PartialWriteError
+	if assert.ErrorAs(t, err, &partial) {
+		assert.Equal(t, 3, partial.Dropped[0].Line)
+		assert.Contains(t, partial.Dropped[0].Reason, "out of range")
+	}
+}
+
+func TestParseTimeWindow(t *testing.T) {
+	p := newTestParser(Options{MaxPast: time.Hour, MaxFuture: time.Minute})
+
+	old := testNow.Add(-2 * time.Hour).UnixNano()
+	future := testNow.Add(time.Hour).UnixNano()
+	recent := testNow.Add(-time.Minute).UnixNano()
+
+	body := []byte(
+		"cpu value=1 " + itoa(recent) + "\n" +
+			"cpu value=2 " + itoa(old) + "\n" +
+			"cpu value=3 " + itoa(future) + "\n")
+
+	points, err := p.Parse(body)
+	assert.Len(t, points, 1)
+	assert.Equal(t, recent, points[0].Timestamp)
+
+	var partial *PartialWriteError
+	assert.True(t, errors.As(err, &partial))
+	assert.Len(t, partial.Dropped, 2)
+	assert.Equal(t, 2, partial.Dropped[0].Line)
+	assert.Contains(t, partial.Dropped[0].Reason, "max-past")
+	assert.Equal(t, 3, partial.Dropped[1].Line)
+	assert.Contains(t, partial.Dropped[1].Reason, "max-future")
+	assert.Contains(t, err.Error(), "partial write: 2 points dropped")
+
+	assert.Equal(t, Stats{TooOld: 1, TooNew: 1}, p.Stats())
+}
+
+func TestParseNonFinite(t *testing.T) {
+	body := []byte("cpu value=1\ncpu value=NaN\ncpu value=+Inf,other=2\ncpu value=-Inf\n")
+
+	p := newTestParser(Options{})
+	points, err := p.Parse(body)
+	assert.Len(t, points, 1)
+	var partial *PartialWriteError
+	assert.True(t, errors.As(err, &partial))
+	assert.Len(t, partial.Dropped, 3)
+	assert.Contains(t, partial.Dropped[0].Reason, "non-finite value NaN")
+	assert.Contains(t, partial.Dropped[1].Reason, "non-finite value +Inf")
+
+	p = newTestParser(Options{ClampNonFinite: true})
+	points, err = p.Parse(body)
+	assert.True(t, errors.As(err, &partial))
+	// A point left without any field is still dropped
+	assert.Len(t, partial.Dropped, 1)
+	assert.Equal(t, 2, partial.Dropped[0].Line)
+	assert.Len(t, points, 3)
+	assert.Equal(t, map[string]float64{"value": math.MaxFloat64, "other": 2}, points[1].Fields)
+	assert.Equal(t, -math.MaxFloat64, points[2].Fields["value"])
+}
+
+func TestParseKeyLength(t *testing.T) {
+	p := newTestParser(Options{MaxKeyLength: 8})
+	points, err := p.Parse([]byte("cpu,host=a value=1\nmeasurement value=1\ncpu,hostnames=a value=1\ncpu,host=abcdefghi value=1\ncpu temperature=1\n"))
+	assert.Len(t, points, 1)
+
+	var partial *PartialWriteError
+	assert.True(t, errors.As(err, &partial))
+	assert.Len(t, partial.Dropped, 4)
+	assert.Contains(t, partial.Dropped[0].Reason, "measurement is 11 bytes long")
+	assert.Contains(t, partial.Dropped[1].Reason, `tag key "hostnames"`)
+	assert.Contains(t, partial.Dropped[2].Reason, `value of tag "host"`)
+	assert.Contains(t, partial.Dropped[3].Reason, `field key "temperature"`)
+}
+
+func TestParseTemplates(t *testing.T) {
+	set, err := templates.Parse([]string{"servers.*.cpu.* .host.measurement.field region=us-west"})
+	assert.NoError(t, err)
+	p := newTestParser(Options{Templates: set})
+
+	body := "servers.web1.cpu.idle value=3,max=5\nservers.web2.cpu.user,region=eu value=1\ncpu value=2\n"
+	points, err := p.Parse([]byte(body))
+	assert.NoError(t, err)
+	assert.Len(t, points, 3)
+
+	assert.Equal(t, "cpu", points[0].Measurement)
+	assert.Equal(t, map[string]string{"host": "web1", "region": "us-west"}, points[0].Tags)
+	assert.Equal(t, map[string]float64{"idle": 3, "idle.max": 5}, points[0].Fields)
+
+	// Tags of the point win over extracted ones
+	assert.Equal(t, map[string]string{"host": "web2", "region": "eu"}, points[1].Tags)
+	assert.Equal(t, map[string]float64{"user": 1}, points[1].Fields)
+
+	// Names without a dot are left alone
+	assert.Equal(t, "cpu", points[2].Measurement)
+	assert.Equal(t, map[string]float64{"value": 2}, points[2].Fields)
+
+	points, err = p.ParseJSON([]byte(`[{"measurement": "servers.web3.cpu.system", "fields": {"value": 4}}]`))
+	assert.NoError(t, err)
+	assert.Equal(t, "cpu", points[0].Measurement)
+	assert.Equal(t, "web3", points[0].Tags["host"])
+	assert.Equal(t, map[string]float64{"system": 4}, points[0].Fields)
+}
+
+func TestParseJSON(t *testing.T) {
+	p := newTestParser(Options{})
+	body := `[
+		{"measurement": "cpu", "tags": {"host": "a"}, "fields": {"value": 0.5, "up": true}, "time": 1556813561098000000},
+		{"measurement": "mem", "fields": {"used": 3}, "time": "2025-03-19T11:00:00Z"},
+		{"measurement": "mem", "fields": {"used": 4}},
+		{"measurement": "cpu", "fields": {"value": "high"}},
+		{"fields": {"value": 1}},
+		{"measurement": "cpu", "fields": {"value": 1}, "time": "yesterday"}
+	]`
+
+	points, err := p.ParseJSON([]byte(body))
+	assert.Len(t, points, 3)
+	assert.Equal(t, persistence.Point{
+		Measurement: "cpu",
+		Tags:        map[string]string{"host": "a"},
+		Fields:      map[string]float64{"value": 0.5, "up": 1},
+		Timestamp:   1556813561098000000,
+	}, points[0])
+	assert.Equal(t, testNow.Add(-time.Hour).UnixNano(), points[1].Timestamp)
+	assert.Equal(t, testNow.UnixNano(), points[2].Timestamp)
+
+	var partial *PartialWriteError
+	assert.True(t, errors.As(err, &partial))
+	assert.Len(t, partial.Dropped, 3)
+	assert.Equal(t, 4, partial.Dropped[0].Line)
+	assert.Contains(t, partial.Dropped[0].Reason, `invalid value of field "value"`)
+	assert.Contains(t, partial.Dropped[1].Reason, "missing measurement")
+	assert.Contains(t, partial.Dropped[2].Reason, `invalid time "yesterday"`)
+
+	_, err = p.ParseJSON([]byte(`{"measurement": "cpu"}`))
+	assert.ErrorContains(t, err, "expected an array of points")
+}
+
+func TestParseTimeWindowWarnOnly(t *testing.T) {
+	p := newTestParser(Options{MaxPast: time.Hour, WarnOnly: true})
+
+	points, err := p.Parse([]byte("cpu value=1 " + itoa(testNow.Add(-2*time.Hour).UnixNano())))
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+	assert.Equal(t, Stats{TooOld: 1}, p.Stats())
+}
+
+func TestParseTimeUnits(t *testing.T) {
+	// Timestamps are nanoseconds: one sent in milliseconds or seconds is
+	// not guessed at but lands in January 1970, where max-past catches it
+	seconds := testNow.Unix()
+	millis := testNow.UnixMilli()
+	p := newTestParser(Options{})
+	points, err := p.Parse([]byte("cpu value=1 " + itoa(millis) + "\ncpu value=2 " + itoa(seconds)))
+	assert.NoError(t, err)
+	assert.Equal(t, millis, points[0].Timestamp)
+	assert.Equal(t, time.Date(1970, time.January, 1, 0, 29, 2, 385600000, time.UTC), points[0].Time())
+	assert.Equal(t, seconds, points[1].Timestamp)
+
+	p = newTestParser(Options{MaxPast: 24 * time.Hour})
+	points, err = p.Parse([]byte("cpu value=1 " + itoa(millis)))
+	assert.Empty(t, points)
+	var partial *PartialWriteError
+	assert.True(t, errors.As(err, &partial))
+	assert.Contains(t, partial.Dropped[0].Reason, "timestamp 1970-01-01T00:29:02.3856Z is older")
+
+	// RFC3339 times are converted, unless out of the nanosecond range
+	points, err = p.ParseJSON([]byte(`[{"measurement": "cpu", "fields": {"value": 1}, "time": "2025-03-19T12:00:00.5+01:00"}]`))
+	assert.NoError(t, err)
+	assert.Equal(t, testNow.Add(-time.Hour+500*time.Millisecond).UnixNano(), points[0].Timestamp)
+	_, err = p.ParseJSON([]byte(`[{"measurement": "cpu", "fields": {"value": 1}, "time": "2300-01-01T00:00:00Z"}]`))
+	assert.True(t, errors.As(err, &partial))
+	assert.Contains(t, partial.Dropped[0].Reason, "outside the range of nanosecond timestamps")
+}
+
+func TestParseModes(t *testing.T) {
+	body := []byte("cpu,host=a,host=b value=1\ncpu value=abc,temp=2\n")
+
+	points, err := newTestParser(Options{}).Parse(body)
+	assert.Len(t, points, 1)
+	assert.Equal(t, map[string]string{"host": "b"}, points[0].Tags)
+	var partial *PartialWriteError
+	assert.True(t, errors.As(err, &partial))
+
+	points, err = newTestParser(Options{Mode: protocol.ModeStrict}).Parse(body)
+	assert.Empty(t, points)
+	assert.True(t, errors.As(err, &partial))
+	assert.Len(t, partial.Dropped, 2)
+	assert.Contains(t, partial.Dropped[0].Reason, "duplicate tag host")
+
+	before := parseWarnings.Value()
+	points, err = newTestParser(Options{Mode: protocol.ModeLenient}).Parse(body)
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+	assert.Equal(t, map[string]float64{"temp": 2}, points[1].Fields)
+	assert.Equal(t, before+2, parseWarnings.Value())
+}
+
+func itoa(v int64) string {
+	return strconv.FormatInt(v, 10)
+}
+
+type recordingWriter struct {
+	mu      sync.Mutex
+	batches [][]persistence.Point
+}
+
+func (w *recordingWriter) SaveBatch(points []persistence.Point) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.batches = append(w.batches, points)
+	return nil
+}
+
+func (w *recordingWriter) sizes() []int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var sizes []int
+	for _, b := range w.batches {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+func TestBatcher(t *testing.T) {
+	w := &recordingWriter{}
+	b := NewBatcher(w, BatchOptions{Size: 3, Timeout: time.Hour, Pending: 10})
+	b.Start()
+
+	point := persistence.Point{Measurement: "cpu", Fields: map[string]float64{"value": 1}}
+	assert.True(t, b.Add([]persistence.Point{point, point}))
+	assert.True(t, b.Add([]persistence.Point{point, point}))
+	assert.True(t, b.Add(nil))
+
+	// Reaching the batch size flushes without waiting for the timeout
+	assert.Eventually(t, func() bool { return len(w.sizes()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []int{4}, w.sizes())
+
+	// Stop flushes the remainder
+	assert.True(t, b.Add([]persistence.Point{point}))
+	b.Stop()
+	assert.Equal(t, []int{4, 1}, w.sizes())
+}
+
+func TestBatcherTimeout(t *testing.T) {
+	w := &recordingWriter{}
+	b := NewBatcher(w, BatchOptions{Size: 100, Timeout: 10 * time.Millisecond})
+	b.Start()
+	defer b.Stop()
+
+	assert.True(t, b.Add([]persistence.Point{{Measurement: "cpu", Fields: map[string]float64{"value": 1}}}))
+	assert.Eventually(t, func() bool { return len(w.sizes()) == 1 }, time.Second, time.Millisecond)
+}
+
+func TestBatcherWorkers(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	b := NewBatcher(w, BatchOptions{Size: 1, Timeout: time.Hour, Pending: 1, Workers: 3})
+	b.Start()
+
+	// Three batches are stored at once and a fourth is assembled meanwhile,
+	// so the queue still has room
+	point := []persistence.Point{{Measurement: "cpu", Fields: map[string]float64{"value": 1}}}
+	for i := 0; i < 4; i++ {
+		assert.True(t, b.Add(point))
+		if i < 3 {
+			assert.Eventually(t, func() bool { return w.active.Load() == int32(i+1) }, time.Second, time.Millisecond)
+		}
+	}
+	assert.Eventually(t, func() bool { return len(b.in) == 0 }, time.Second, time.Millisecond)
+	assert.True(t, b.Add(point))
+	assert.False(t, b.Add(point))
+
+	close(w.release)
+	b.Stop()
+	assert.Equal(t, int32(5), w.stored.Load())
+
+	// Workers and the queue default to GOMAXPROCS
+	b = NewBatcher(w, BatchOptions{})
+	assert.Equal(t, runtime.GOMAXPROCS(0), b.Options().Workers)
+	assert.Equal(t, 10*runtime.GOMAXPROCS(0), b.Options().Pending)
+}
+
+// blockingWriter stores batches once release is closed
+type blockingWriter struct {
+	release chan struct{}
+	active  atomic.Int32
+	stored  atomic.Int32
+}
+
+func (w *blockingWriter) SaveBatch(points []persistence.Point) error {
+	w.active.Add(1)
+	<-w.release
+	w.stored.Add(int32(len(points)))
+	return nil
+}
+
+func TestBudget(t *testing.T) {
+	var unlimited *Budget
+	assert.True(t, unlimited.Reserve(1<<40))
+	unlimited.Release(1 << 40)
+	assert.Nil(t, NewBudget(0))
+
+	b := NewBudget(100)
+	assert.True(t, b.Reserve(60))
+	assert.False(t, b.Reserve(50))
+	assert.True(t, b.Reserve(40))
+	assert.Equal(t, int64(100), b.Used())
+	b.Release(100)
+
+	// A set larger than the budget fits when nothing else is buffered
+	assert.True(t, b.Reserve(500))
+	assert.False(t, b.Reserve(1))
+	b.Release(500)
+	assert.Zero(t, b.Used())
+
+	point := persistence.Point{Measurement: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"value": 1}}
+	assert.Equal(t, int64(pointOverhead+3+tagOverhead+5+fieldOverhead+5), PointsSize([]persistence.Point{point}))
+
+	previous := debug.SetMemoryLimit(400 << 20)
+	defer debug.SetMemoryLimit(previous)
+	assert.Equal(t, int64(100<<20), AutoBudget())
+}
+
+func TestDedup(t *testing.T) {
+	var disabled *Dedup
+	assert.Len(t, disabled.Filter(make([]persistence.Point, 2)), 2)
+	assert.Nil(t, NewDedup(0, 0))
+
+	now := testNow
+	d := NewDedup(time.Minute, 0)
+	d.now = func() time.Time { return now }
+	point := func(host string, ts int64, value float64) persistence.Point {
+		return persistence.Point{Measurement: "cpu", Tags: map[string]string{"host": host, "dc": "eu"}, Fields: map[string]float64{"value": value, "idle": 1}, Timestamp: ts}
+	}
+
+	kept := d.Filter([]persistence.Point{point("a", 1, 1), point("a", 1, 1), point("b", 1, 1)})
+	assert.Equal(t, []persistence.Point{point("a", 1, 1), point("b", 1, 1)}, kept)
+	// Another database, timestamp or field value is not a duplicate
+	other := point("a", 1, 1)
+	other.Database = "other"
+	now = now.Add(30 * time.Second)
+	kept = d.Filter([]persistence.Point{point("a", 1, 1), point("a", 2, 1), point("a", 1, 2), other})
+	assert.Equal(t, []persistence.Point{point("a", 2, 1), point("a", 1, 2), other}, kept)
+
+	// The first points are forgotten once the window has passed
+	now = now.Add(31 * time.Second)
+	kept = d.Filter([]persistence.Point{point("a", 1, 1), point("a", 2, 1)})
+	assert.Equal(t, []persistence.Point{point("a", 1, 1)}, kept)
+	assert.Len(t, d.seen, 4)
+
+	// Forgotten points are kept when written again
+	d.Forget([]persistence.Point{point("a", 2, 1)})
+	assert.Len(t, d.Filter([]persistence.Point{point("a", 2, 1)}), 1)
+
+	// The oldest points are forgotten past the maximum
+	d = NewDedup(time.Minute, 2)
+	assert.Len(t, d.Filter([]persistence.Point{point("a", 1, 1), point("b", 1, 1), point("c", 1, 1)}), 3)
+	assert.Len(t, d.seen, 2)
+	assert.Len(t, d.Filter([]persistence.Point{point("a", 1, 1), point("c", 1, 1)}), 1)
+}
+
+func TestBatcherBudget(t *testing.T) {
+	point := persistence.Point{Measurement: "cpu", Fields: map[string]float64{"value": 1}}
+	set := func(n int) []persistence.Point {
+		points := make([]persistence.Point, n)
+		for i := range points {
+			points[i] = point
+		}
+		return points
+	}
+	size := PointsSize(set(1))
+	budget := NewBudget(5 * size)
+	w := &recordingWriter{}
+	b := NewBatcher(w, BatchOptions{Size: 100, Timeout: time.Hour, Pending: 10, Budget: budget})
+
+	// Before the flush loop runs, sets stay queued and the oldest ones are
+	// evicted to fit the newer ones
+	assert.True(t, b.Add(set(2)))
+	assert.True(t, b.Add(set(2)))
+	assert.True(t, b.Add(set(3)))
+	assert.Equal(t, 2, len(b.in))
+	assert.Equal(t, 5*size, budget.Used())
+
+	// Stored points return their memory to the budget
+	b.Start()
+	b.Stop()
+	assert.Equal(t, []int{5}, w.sizes())
+	assert.Zero(t, budget.Used())
+}
+
+func TestBatcherFull(t *testing.T) {
+	// Without a running flush loop the queue fills up and Add drops points
+	b := NewBatcher(&recordingWriter{}, BatchOptions{Pending: 1})
+	point := []persistence.Point{{Measurement: "cpu", Fields: map[string]float64{"value": 1}}}
+	assert.True(t, b.Add(point))
+	assert.False(t, b.Add(point))
+}
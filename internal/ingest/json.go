@@ -0,0 +1,160 @@
+package ingest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/protocol"
+)
+
+// JSONPoint is a point of a JSON write body:
+//
+//	[{"measurement": "cpu", "tags": {"host": "a"}, "fields": {"value": 0.5}, "time": 1700000000000000000}]
+//
+// Time is either a nanosecond epoch or an RFC3339 string, and defaults to
+// the server time. Field values are numbers or booleans, stored as 1 or 0.
+type JSONPoint struct {
+	Measurement string                     `json:"measurement"`
+	Tags        map[string]string          `json:"tags"`
+	Fields      map[string]json.RawMessage `json:"fields"`
+	Time        json.RawMessage            `json:"time"`
+}
+
+// ParseJSON converts a JSON array of points into points, applying the same
+// validation as Parse. Invalid points are dropped and reported through a
+// *PartialWriteError, with their index in the array, starting at 1, as
+// their line number.
+func (p *Parser) ParseJSON(body []byte) ([]persistence.Point, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		parseFailures.Inc()
+		return nil, fmt.Errorf("invalid JSON body: expected an array of points: %w", err)
+	}
+
+	now := p.now()
+	var points []persistence.Point
+	var dropped []Rejection
+	for i, data := range raw {
+		point, err := decodeJSONPoint(data, now)
+		if err != nil {
+			parseFailures.Inc()
+			dropped = append(dropped, Rejection{Line: i + 1, Text: compactJSON(data), Reason: err.Error()})
+			continue
+		}
+		if !p.transform(&point) {
+			continue
+		}
+		if reason := p.check(&point, i+1, now); reason != "" {
+			dropped = append(dropped, Rejection{Line: i + 1, Text: compactJSON(data), Reason: reason})
+			continue
+		}
+		points = append(points, point)
+	}
+
+	if len(dropped) > 0 {
+		return points, &PartialWriteError{Dropped: dropped}
+	}
+	return points, nil
+}
+
+// ParseJSONReader is ParseJSON reading the payload from r, rejecting it as
+// a whole when it is over the MaxBytes or MaxLines limits
+func (p *Parser) ParseJSONReader(r io.Reader) ([]persistence.Point, error) {
+	limits := p.limits()
+	if limits.MaxBytes > 0 {
+		r = io.LimitReader(r, limits.MaxBytes+1)
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	if limits.MaxBytes > 0 && int64(len(body)) > limits.MaxBytes {
+		return nil, fmt.Errorf("%w: more than %d bytes", protocol.ErrBatchTooLarge, limits.MaxBytes)
+	}
+
+	points, err := p.ParseJSON(body)
+	n := len(points)
+	var partial *PartialWriteError
+	if errors.As(err, &partial) {
+		n += len(partial.Dropped)
+	}
+	if limits.MaxLines > 0 && n > limits.MaxLines {
+		return nil, fmt.Errorf("%w: more than %d points in the batch", protocol.ErrTooManyLines, limits.MaxLines)
+	}
+	return points, err
+}
+
+func decodeJSONPoint(data []byte, now time.Time) (persistence.Point, error) {
+	var jp JSONPoint
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&jp); err != nil {
+		return persistence.Point{}, fmt.Errorf("unable to parse: %v", err)
+	}
+	if jp.Measurement == "" {
+		return persistence.Point{}, fmt.Errorf("missing measurement")
+	}
+	if len(jp.Fields) == 0 {
+		return persistence.Point{}, fmt.Errorf("missing fields")
+	}
+
+	point := persistence.Point{
+		Measurement: jp.Measurement,
+		Tags:        jp.Tags,
+		Fields:      make(map[string]float64, len(jp.Fields)),
+		Timestamp:   now.UnixNano(),
+	}
+	for k, raw := range jp.Fields {
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return persistence.Point{}, fmt.Errorf("invalid value of field %q: %v", k, err)
+		}
+		switch v := value.(type) {
+		case float64:
+			point.Fields[k] = v
+		case bool:
+			if v {
+				point.Fields[k] = 1
+			} else {
+				point.Fields[k] = 0
+			}
+		default:
+			return persistence.Point{}, fmt.Errorf("invalid value of field %q: expected a number or a boolean", k)
+		}
+	}
+
+	if len(jp.Time) > 0 && string(jp.Time) != "null" {
+		var ns int64
+		var text string
+		switch {
+		case json.Unmarshal(jp.Time, &ns) == nil:
+			point.Timestamp = ns
+		case json.Unmarshal(jp.Time, &text) == nil:
+			t, err := time.Parse(time.RFC3339Nano, text)
+			if err != nil {
+				return persistence.Point{}, fmt.Errorf("invalid time %q: expected nanoseconds or RFC3339", text)
+			}
+			if point.Timestamp, err = persistence.Nanoseconds(t); err != nil {
+				return persistence.Point{}, err
+			}
+		default:
+			return persistence.Point{}, fmt.Errorf("invalid time %s: expected nanoseconds or RFC3339", jp.Time)
+		}
+	}
+	return point, nil
+}
+
+// compactJSON returns data without insignificant whitespace, for error
+// messages
+func compactJSON(data []byte) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return string(data)
+	}
+	return buf.String()
+}
@@ -0,0 +1,147 @@
+package lineedit
+
+import "unicode"
+
+// Keys without a character are mapped to negative runes
+const (
+	keyNone rune = -iota - 1
+	keyUp
+	keyDown
+	keyLeft
+	keyRight
+	keyHome
+	keyEnd
+	keyDelete
+)
+
+// Control characters understood by the editor
+const (
+	ctrlA     = 0x01
+	ctrlB     = 0x02
+	ctrlC     = 0x03
+	ctrlD     = 0x04
+	ctrlE     = 0x05
+	ctrlF     = 0x06
+	ctrlH     = 0x08
+	ctrlK     = 0x0b
+	ctrlL     = 0x0c
+	ctrlN     = 0x0e
+	ctrlP     = 0x10
+	ctrlU     = 0x15
+	ctrlW     = 0x17
+	backspace = 0x7f
+)
+
+// action tells ReadLine what to do after a key
+type action int
+
+const (
+	actionNone action = iota
+	actionDone
+	actionInterrupt
+	actionEOF
+	actionClear
+)
+
+// editor holds the line being edited and the history position
+type editor struct {
+	line    []rune
+	pos     int
+	history []string
+	// index is the history line shown, len(history) for the new line
+	index int
+	// draft keeps the new line while browsing the history
+	draft []rune
+}
+
+func newEditor(history []string) *editor {
+	return &editor{history: history, index: len(history)}
+}
+
+// handle applies a key to the line
+func (e *editor) handle(k rune) action {
+	switch k {
+	case '\r', '\n':
+		return actionDone
+	case ctrlC:
+		return actionInterrupt
+	case ctrlD:
+		if len(e.line) == 0 {
+			return actionEOF
+		}
+		e.delete(e.pos, e.pos+1)
+	case keyDelete:
+		e.delete(e.pos, e.pos+1)
+	case backspace, ctrlH:
+		e.delete(e.pos-1, e.pos)
+	case keyLeft, ctrlB:
+		if e.pos > 0 {
+			e.pos--
+		}
+	case keyRight, ctrlF:
+		if e.pos < len(e.line) {
+			e.pos++
+		}
+	case keyHome, ctrlA:
+		e.pos = 0
+	case keyEnd, ctrlE:
+		e.pos = len(e.line)
+	case ctrlK:
+		e.line = e.line[:e.pos]
+	case ctrlU:
+		e.delete(0, e.pos)
+	case ctrlW:
+		start := e.pos
+		for start > 0 && unicode.IsSpace(e.line[start-1]) {
+			start--
+		}
+		for start > 0 && !unicode.IsSpace(e.line[start-1]) {
+			start--
+		}
+		e.delete(start, e.pos)
+	case keyUp, ctrlP:
+		e.recall(e.index - 1)
+	case keyDown, ctrlN:
+		e.recall(e.index + 1)
+	case ctrlL:
+		return actionClear
+	default:
+		if k >= ' ' {
+			e.line = append(e.line[:e.pos], append([]rune{k}, e.line[e.pos:]...)...)
+			e.pos++
+		}
+	}
+	return actionNone
+}
+
+// delete removes the runes between from and to, clamped to the line
+func (e *editor) delete(from, to int) {
+	if from < 0 {
+		from = 0
+	}
+	if to > len(e.line) {
+		to = len(e.line)
+	}
+	if from >= to {
+		return
+	}
+	e.line = append(e.line[:from], e.line[to:]...)
+	e.pos = from
+}
+
+// recall shows the history line at index, or the draft past the end
+func (e *editor) recall(index int) {
+	if index < 0 || index > len(e.history) || index == e.index {
+		return
+	}
+	if e.index == len(e.history) {
+		e.draft = e.line
+	}
+	e.index = index
+	if index == len(e.history) {
+		e.line = e.draft
+	} else {
+		e.line = []rune(e.history[index])
+	}
+	e.pos = len(e.line)
+}
@@ -0,0 +1,197 @@
+// Package lineedit reads lines from a terminal with basic editing and
+// history recall, for the interactive commands of the refluxdb binary.
+//
+// When the input is a terminal it is switched to raw mode while a line is
+// read, and the usual readline keys are supported: arrows, Home, End,
+// Delete, Ctrl-A, Ctrl-E, Ctrl-B, Ctrl-F, Ctrl-K, Ctrl-U, Ctrl-W, Ctrl-P,
+// Ctrl-N and Ctrl-L. Other inputs, such as pipes, are read line by line.
+package lineedit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrInterrupt is returned by ReadLine when Ctrl-C is pressed. The line
+// being edited is discarded.
+var ErrInterrupt = errors.New("interrupted")
+
+// Reader reads lines from a terminal
+type Reader struct {
+	in      *os.File
+	out     io.Writer
+	keys    *bufio.Reader
+	history []string
+	// MaxHistory is the number of lines kept in the history
+	MaxHistory int
+}
+
+// New creates a reader of in, echoing to out
+func New(in *os.File, out io.Writer) *Reader {
+	return &Reader{
+		in:         in,
+		out:        out,
+		keys:       bufio.NewReader(in),
+		MaxHistory: 1000,
+	}
+}
+
+// History returns the lines added to the history, oldest first
+func (r *Reader) History() []string {
+	return r.history
+}
+
+// AddHistory appends line to the history, skipping blank lines and
+// repetitions of the previous line
+func (r *Reader) AddHistory(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if n := len(r.history); n > 0 && r.history[n-1] == line {
+		return
+	}
+	r.history = append(r.history, line)
+	if r.MaxHistory > 0 && len(r.history) > r.MaxHistory {
+		r.history = r.history[len(r.history)-r.MaxHistory:]
+	}
+}
+
+// LoadHistory appends the lines of the history file at path. A missing
+// file is not an error.
+func (r *Reader) LoadHistory(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read history: %w", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		r.AddHistory(line)
+	}
+	return nil
+}
+
+// SaveHistory writes the history to the file at path
+func (r *Reader) SaveHistory(path string) error {
+	var sb strings.Builder
+	for _, line := range r.history {
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+	if err := os.WriteFile(path, []byte(sb.String()), 0600); err != nil {
+		return fmt.Errorf("failed to write history: %w", err)
+	}
+	return nil
+}
+
+// ReadLine prints prompt and returns the next line, without its line
+// ending. It returns io.EOF at the end of the input, or when Ctrl-D is
+// pressed on an empty line.
+func (r *Reader) ReadLine(prompt string) (string, error) {
+	restore, err := makeRaw(int(r.in.Fd()))
+	if err != nil {
+		return r.readPlain(prompt)
+	}
+	defer restore()
+
+	e := newEditor(r.history)
+	r.render(prompt, e)
+	for {
+		k, err := r.readKey()
+		if err != nil {
+			fmt.Fprint(r.out, "\r\n")
+			return "", err
+		}
+		switch e.handle(k) {
+		case actionDone:
+			fmt.Fprint(r.out, "\r\n")
+			return string(e.line), nil
+		case actionInterrupt:
+			fmt.Fprint(r.out, "^C\r\n")
+			return "", ErrInterrupt
+		case actionEOF:
+			fmt.Fprint(r.out, "\r\n")
+			return "", io.EOF
+		case actionClear:
+			fmt.Fprint(r.out, "\x1b[H\x1b[2J")
+		}
+		r.render(prompt, e)
+	}
+}
+
+// readPlain reads a line from an input that is not a terminal
+func (r *Reader) readPlain(prompt string) (string, error) {
+	fmt.Fprint(r.out, prompt)
+	line, err := r.keys.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// render redraws the prompt and the line, and places the cursor
+func (r *Reader) render(prompt string, e *editor) {
+	fmt.Fprintf(r.out, "\r%s%s\x1b[K", prompt, string(e.line))
+	if back := len(e.line) - e.pos; back > 0 {
+		fmt.Fprintf(r.out, "\x1b[%dD", back)
+	}
+}
+
+// readKey decodes the next key, turning escape sequences into the key
+// constants of the editor
+func (r *Reader) readKey() (rune, error) {
+	c, _, err := r.keys.ReadRune()
+	if err != nil || c != 0x1b {
+		return c, err
+	}
+
+	// Escape sequences are ESC [ or ESC O, followed by parameters and a
+	// final letter or ~
+	next, _, err := r.keys.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	if next != '[' && next != 'O' {
+		return keyNone, nil
+	}
+	var params []rune
+	for {
+		c, _, err = r.keys.ReadRune()
+		if err != nil {
+			return 0, err
+		}
+		if c < '0' || c > '9' {
+			break
+		}
+		params = append(params, c)
+	}
+	switch c {
+	case 'A':
+		return keyUp, nil
+	case 'B':
+		return keyDown, nil
+	case 'C':
+		return keyRight, nil
+	case 'D':
+		return keyLeft, nil
+	case 'H':
+		return keyHome, nil
+	case 'F':
+		return keyEnd, nil
+	case '~':
+		switch string(params) {
+		case "1", "7":
+			return keyHome, nil
+		case "4", "8":
+			return keyEnd, nil
+		case "3":
+			return keyDelete, nil
+		}
+	}
+	return keyNone, nil
+}
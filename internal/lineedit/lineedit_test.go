@@ -0,0 +1,115 @@
+package lineedit
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// typeKeys feeds keys to a new editor and returns it with the last action
+func typeKeys(history []string, keys ...rune) (*editor, action) {
+	e := newEditor(history)
+	var a action
+	for _, k := range keys {
+		a = e.handle(k)
+	}
+	return e, a
+}
+
+func TestEditor(t *testing.T) {
+	e, a := typeKeys(nil, []rune("selct")...)
+	assert.Equal(t, actionNone, a)
+	e.handle(keyLeft)
+	e.handle(keyLeft)
+	e.handle('e')
+	assert.Equal(t, "select", string(e.line))
+	assert.Equal(t, 4, e.pos)
+
+	e.handle(ctrlA)
+	e.handle(keyDelete)
+	e.handle(keyEnd)
+	e.handle(backspace)
+	assert.Equal(t, "elec", string(e.line))
+	assert.Equal(t, actionDone, e.handle('\r'))
+
+	e, _ = typeKeys(nil, []rune("show series from cpu")...)
+	e.handle(ctrlW)
+	assert.Equal(t, "show series from ", string(e.line))
+	e.handle(keyLeft)
+	e.handle(ctrlU)
+	assert.Equal(t, " ", string(e.line))
+	e.handle(ctrlK)
+	assert.Equal(t, "", string(e.line))
+
+	_, a = typeKeys(nil, 'x', ctrlC)
+	assert.Equal(t, actionInterrupt, a)
+	_, a = typeKeys(nil, ctrlD)
+	assert.Equal(t, actionEOF, a)
+	e, a = typeKeys(nil, 'x', keyHome, ctrlD)
+	assert.Equal(t, actionNone, a)
+	assert.Equal(t, "", string(e.line))
+}
+
+func TestEditorHistory(t *testing.T) {
+	history := []string{"show databases", "show measurements"}
+
+	e, _ := typeKeys(history, 'd', keyUp)
+	assert.Equal(t, "show measurements", string(e.line))
+	e.handle(keyUp)
+	e.handle(keyUp)
+	assert.Equal(t, "show databases", string(e.line))
+
+	// Going past the newest entry restores the line being typed
+	e.handle(keyDown)
+	e.handle(keyDown)
+	assert.Equal(t, "d", string(e.line))
+	e.handle(keyDown)
+	assert.Equal(t, "d", string(e.line))
+
+	// Recalled lines can be edited without changing the history
+	e.handle(keyUp)
+	e.handle(backspace)
+	assert.Equal(t, "show measurement", string(e.line))
+	assert.Equal(t, "show measurements", history[1])
+}
+
+func TestReaderHistory(t *testing.T) {
+	r := New(os.Stdin, io.Discard)
+	r.MaxHistory = 2
+	for _, line := range []string{"a", "", "b", "b", "c"} {
+		r.AddHistory(line)
+	}
+	assert.Equal(t, []string{"b", "c"}, r.History())
+
+	path := filepath.Join(t.TempDir(), "history")
+	assert.NoError(t, r.LoadHistory(path))
+	assert.NoError(t, r.SaveHistory(path))
+
+	loaded := New(os.Stdin, io.Discard)
+	assert.NoError(t, loaded.LoadHistory(path))
+	assert.Equal(t, []string{"b", "c"}, loaded.History())
+}
+
+func TestReadLinePlain(t *testing.T) {
+	in, err := os.CreateTemp(t.TempDir(), "input")
+	assert.NoError(t, err)
+	defer in.Close()
+	_, err = in.WriteString("show databases\r\nuse mydb")
+	assert.NoError(t, err)
+	_, err = in.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+
+	// Files are not terminals, so lines are read as is
+	r := New(in, io.Discard)
+	line, err := r.ReadLine("> ")
+	assert.NoError(t, err)
+	assert.Equal(t, "show databases", line)
+	line, err = r.ReadLine("> ")
+	assert.NoError(t, err)
+	assert.Equal(t, "use mydb", line)
+	_, err = r.ReadLine("> ")
+	assert.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,11 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package lineedit
+
+import "errors"
+
+// makeRaw is not supported on this platform, so lines are read without
+// editing
+func makeRaw(fd int) (func(), error) {
+	return nil, errors.New("raw terminal mode is not supported")
+}
@@ -0,0 +1,370 @@
+// Package loadgen runs synthetic workloads against a refluxdb server over
+// its HTTP API: points written at a steady rate across a number of series,
+// and a weighted mix of queries over them, while the latency of every
+// request is recorded.
+//
+// The load is open: batches and queries are sent on a fixed schedule
+// whatever the latency of the previous ones, up to a number of requests in
+// flight. Requests that could not be sent on time because every worker
+// was busy are counted as missed instead of being delayed, so that a
+// saturated server shows in the report rather than in a lower rate.
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/tdigest"
+	"github.com/gleicon/go-refluxdb/pkg/client"
+)
+
+// Measurement is the measurement the points are written to
+const Measurement = "loadgen"
+
+// Queries are the statements of the query mix by name. %[1]s is replaced
+// by the host tag of a random series.
+var Queries = map[string]string{
+	// The latest minute of a series
+	"range": `SELECT * FROM ` + Measurement + ` WHERE host = '%[1]s' AND time > now() - 1m`,
+	// The last value of a series
+	"last": `SELECT last(value) FROM ` + Measurement + ` WHERE host = '%[1]s'`,
+	// The latest hour of a series in minute buckets
+	"aggregate": `SELECT mean(value), max(value) FROM ` + Measurement + ` WHERE host = '%[1]s' AND time > now() - 1h GROUP BY time(1m)`,
+	// The latest 5 minutes of every series in 10s buckets
+	"all-series": `SELECT mean(value), count(value) FROM ` + Measurement + ` WHERE time > now() - 5m GROUP BY time(10s)`,
+}
+
+// Options describes a workload
+type Options struct {
+	// Database receives the points and is queried
+	Database string
+	// Series is the number of series written to, with host tags host-0
+	// to host-<Series-1>
+	Series int
+	// Rate is the number of points written per second, in batches of
+	// BatchSize points. Zero disables writes.
+	Rate      float64
+	BatchSize int
+	// Writers is the number of write requests in flight at most
+	Writers int
+	// QueryRate is the number of queries sent per second, picked from
+	// Mix. Zero disables queries.
+	QueryRate float64
+	Mix       Mix
+	// Queriers is the number of queries in flight at most
+	Queriers int
+	// Duration is how long the workload runs, until ctx is done when zero
+	Duration time.Duration
+	// Seed seeds the values written and the queries picked
+	Seed int64
+}
+
+// Mix is a weighted set of the Queries
+type Mix map[string]int
+
+// ParseMix parses a query mix such as "range=4,last=2,aggregate=1",
+// whose names are keys of Queries and weights are not negative
+func ParseMix(s string) (Mix, error) {
+	mix := make(Mix)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, weight, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid query mix %q: expected name=weight", part)
+		}
+		if _, ok := Queries[name]; !ok {
+			return nil, fmt.Errorf("unknown query %q: expected one of %s", name, strings.Join(queryNames(), ", "))
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil || w < 0 {
+			return nil, fmt.Errorf("invalid weight %q of query %s", weight, name)
+		}
+		mix[name] = w
+	}
+	return mix, nil
+}
+
+// queryNames returns the names of the Queries, sorted
+func queryNames() []string {
+	names := make([]string, 0, len(Queries))
+	for name := range Queries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pick returns the name of a query of the mix, chosen by weight, or ""
+// when every weight is zero
+func (m Mix) pick(rnd *rand.Rand) string {
+	names := make([]string, 0, len(m))
+	total := 0
+	for name, w := range m {
+		if w > 0 {
+			names = append(names, name)
+			total += w
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+	// Map iteration order is random, the draw must not be
+	sort.Strings(names)
+	n := rnd.Intn(total)
+	for _, name := range names {
+		if n < m[name] {
+			return name
+		}
+		n -= m[name]
+	}
+	return ""
+}
+
+// Stats are the requests of an operation and their latency
+type Stats struct {
+	Requests int64
+	Errors   int64
+	// Missed counts the requests not sent on schedule because every
+	// worker was busy
+	Missed int64
+	// Points is the number of points written, by the write operation
+	Points int64
+	// FirstError is the first error returned by the server
+	FirstError error
+	// Latency holds the latency of the successful requests, in seconds
+	Latency *tdigest.TDigest
+}
+
+// Percentile returns the latency below which q of the successful requests
+// completed, 0.99 being the 99th percentile
+func (s *Stats) Percentile(q float64) time.Duration {
+	if s.Latency.Count() == 0 {
+		return 0
+	}
+	return time.Duration(s.Latency.Quantile(q) * float64(time.Second))
+}
+
+// Max returns the latency of the slowest successful request
+func (s *Stats) Max() time.Duration {
+	if s.Latency.Count() == 0 {
+		return 0
+	}
+	return time.Duration(s.Latency.Max() * float64(time.Second))
+}
+
+// Report is the outcome of a workload
+type Report struct {
+	Elapsed time.Duration
+	// Operations holds the stats of the writes under "write" and of every
+	// query under its name. Queries missed, whose name was not picked yet,
+	// are counted under "query".
+	Operations map[string]*Stats
+}
+
+// recorder collects the stats of the operations of a run
+type recorder struct {
+	mu  sync.Mutex
+	ops map[string]*Stats
+}
+
+func (r *recorder) stats(op string) *Stats {
+	s, ok := r.ops[op]
+	if !ok {
+		s = &Stats{Latency: tdigest.New(tdigest.DefaultCompression)}
+		r.ops[op] = s
+	}
+	return s
+}
+
+func (r *recorder) record(op string, points int, latency time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.stats(op)
+	s.Requests++
+	if err != nil {
+		s.Errors++
+		if s.FirstError == nil {
+			s.FirstError = err
+		}
+		return
+	}
+	s.Points += int64(points)
+	s.Latency.Add(latency.Seconds())
+}
+
+func (r *recorder) miss(op string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats(op).Missed++
+}
+
+// Run runs the workload against the server of c until opts.Duration
+// elapsed or ctx is done. Requests in flight then are waited for. Writes
+// start with a batch sent before any query, and Run fails when the server
+// rejects it.
+func Run(ctx context.Context, c *client.Client, opts Options) (*Report, error) {
+	if opts.Series <= 0 {
+		return nil, fmt.Errorf("series must be positive")
+	}
+	if opts.Rate < 0 || opts.QueryRate < 0 {
+		return nil, fmt.Errorf("rates must not be negative")
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 1
+	}
+	if opts.Writers <= 0 {
+		opts.Writers = 1
+	}
+	if opts.Queriers <= 0 {
+		opts.Queriers = 1
+	}
+	if opts.QueryRate > 0 && opts.Mix.pick(rand.New(rand.NewSource(0))) == "" {
+		return nil, fmt.Errorf("the query mix has no query")
+	}
+	if opts.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Duration)
+		defer cancel()
+	}
+
+	rec := &recorder{ops: make(map[string]*Stats)}
+	var wg sync.WaitGroup
+	started := time.Now()
+
+	if opts.Rate > 0 {
+		w := &writer{opts: opts, rnd: rand.New(rand.NewSource(opts.Seed)), values: make([]float64, opts.Series)}
+		// The first batch creates the database, which queries would
+		// otherwise fail to find, and checks the server accepts writes
+		begin := time.Now()
+		points := w.batch()
+		if err := c.WriteBatch(ctx, opts.Database, points); err != nil {
+			return nil, fmt.Errorf("failed to write the first batch: %w", err)
+		}
+		rec.record("write", len(points), time.Since(begin), nil)
+		interval := time.Duration(float64(opts.BatchSize) / opts.Rate * float64(time.Second))
+		tokens := schedule(ctx, &wg, interval, opts.Writers, func() { rec.miss("write") })
+		for i := 0; i < opts.Writers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range tokens {
+					// Tokens still queued at the end are dropped
+					if ctx.Err() != nil {
+						continue
+					}
+					points := w.batch()
+					begin := time.Now()
+					// Batches scheduled before the end are sent in full
+					err := c.WriteBatch(context.WithoutCancel(ctx), opts.Database, points)
+					rec.record("write", len(points), time.Since(begin), err)
+				}
+			}()
+		}
+	}
+
+	if opts.QueryRate > 0 {
+		var mu sync.Mutex
+		rnd := rand.New(rand.NewSource(opts.Seed + 1))
+		interval := time.Duration(float64(time.Second) / opts.QueryRate)
+		tokens := schedule(ctx, &wg, interval, opts.Queriers, func() { rec.miss("query") })
+		for i := 0; i < opts.Queriers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range tokens {
+					if ctx.Err() != nil {
+						continue
+					}
+					mu.Lock()
+					name := opts.Mix.pick(rnd)
+					host := "host-" + strconv.Itoa(rnd.Intn(opts.Series))
+					mu.Unlock()
+					begin := time.Now()
+					_, err := c.Query(context.WithoutCancel(ctx), opts.Database, fmt.Sprintf(Queries[name], host))
+					rec.record(name, 0, time.Since(begin), err)
+				}
+			}()
+		}
+	}
+
+	<-ctx.Done()
+	wg.Wait()
+	return &Report{Elapsed: time.Since(started), Operations: rec.ops}, nil
+}
+
+// schedule sends a token every interval until ctx is done, then closes
+// the channel. Up to workers tokens are queued; a token that finds the
+// queue full calls missed instead.
+func schedule(ctx context.Context, wg *sync.WaitGroup, interval time.Duration, workers int, missed func()) <-chan struct{} {
+	tokens := make(chan struct{}, workers)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(tokens)
+		// Rates above a request per millisecond are sent in bursts
+		burst := 1
+		if interval < time.Millisecond {
+			burst = int(math.Ceil(float64(time.Millisecond) / float64(max(interval, 1))))
+			interval = time.Duration(burst) * interval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for i := 0; i < burst; i++ {
+				select {
+				case tokens <- struct{}{}:
+				default:
+					missed()
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return tokens
+}
+
+// writer builds the batches of points, going through the series in turn.
+// The value field of every series is a random walk.
+type writer struct {
+	opts Options
+
+	mu     sync.Mutex
+	rnd    *rand.Rand
+	values []float64
+	next   int
+}
+
+func (w *writer) batch() []client.Point {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := time.Now()
+	points := make([]client.Point, w.opts.BatchSize)
+	for i := range points {
+		s := w.next
+		w.next = (w.next + 1) % w.opts.Series
+		w.values[s] += w.rnd.NormFloat64()
+		points[i] = client.Point{
+			Measurement: Measurement,
+			Tags:        map[string]string{"host": "host-" + strconv.Itoa(s)},
+			Fields:      map[string]float64{"value": w.values[s]},
+			// Batches larger than the series count write them more than
+			// once, a nanosecond apart
+			Time: now.Add(time.Duration(i / w.opts.Series)),
+		}
+	}
+	return points
+}
@@ -0,0 +1,97 @@
+package loadgen
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/pkg/client"
+	"github.com/gleicon/go-refluxdb/pkg/refluxdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMix(t *testing.T) {
+	mix, err := ParseMix("range=4, last=2,aggregate=0,")
+	assert.NoError(t, err)
+	assert.Equal(t, Mix{"range": 4, "last": 2, "aggregate": 0}, mix)
+
+	for _, s := range []string{"range", "range=x", "range=-1", "delete=1"} {
+		_, err := ParseMix(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestMixPick(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	counts := make(map[string]int)
+	mix := Mix{"range": 3, "last": 1, "aggregate": 0}
+	for i := 0; i < 4000; i++ {
+		counts[mix.pick(rnd)]++
+	}
+	assert.Len(t, counts, 2)
+	assert.InDelta(t, 3000, counts["range"], 150)
+	assert.InDelta(t, 1000, counts["last"], 150)
+	assert.Equal(t, "", Mix{"range": 0}.pick(rnd))
+}
+
+func TestRun(t *testing.T) {
+	storage, err := refluxdb.OpenStorage(":memory:")
+	assert.NoError(t, err)
+	srv, err := refluxdb.NewServer(storage, refluxdb.Options{HTTPAddr: "127.0.0.1:0"})
+	assert.NoError(t, err)
+	assert.NoError(t, srv.Start(context.Background()))
+	defer func() {
+		srv.Shutdown(context.Background())
+		storage.Close()
+	}()
+	c := client.New("http://"+srv.HTTPAddr(), client.Options{})
+
+	report, err := Run(context.Background(), c, Options{
+		Database:  "load",
+		Series:    5,
+		Rate:      1000,
+		BatchSize: 50,
+		Writers:   2,
+		QueryRate: 50,
+		Mix:       Mix{"range": 1, "last": 1, "aggregate": 1, "all-series": 1},
+		Queriers:  2,
+		Duration:  500 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+
+	write := report.Operations["write"]
+	if assert.NotNil(t, write) {
+		assert.NoError(t, write.FirstError)
+		assert.Greater(t, write.Requests, int64(0))
+		assert.Equal(t, 50*(write.Requests-write.Errors), write.Points)
+		assert.Greater(t, write.Percentile(0.99), time.Duration(0))
+		assert.GreaterOrEqual(t, write.Max(), write.Percentile(0.5))
+	}
+	queries := int64(0)
+	for name := range Queries {
+		if s := report.Operations[name]; s != nil {
+			assert.NoError(t, s.FirstError, name)
+			queries += s.Requests
+		}
+	}
+	assert.Greater(t, queries, int64(0))
+
+	// Every series got its share of the points
+	for _, host := range []string{"host-0", "host-4"} {
+		series, err := c.Query(context.Background(), "load", "SELECT count(value) FROM loadgen WHERE host = '"+host+"'")
+		assert.NoError(t, err)
+		if assert.Len(t, series, 1) && assert.Len(t, series[0].Values, 1) {
+			assert.Equal(t, fmt.Sprint(write.Points/5), fmt.Sprint(series[0].Values[0][1]))
+		}
+	}
+}
+
+func TestRunValidates(t *testing.T) {
+	c := client.New("http://127.0.0.1:0", client.Options{})
+	_, err := Run(context.Background(), c, Options{Series: 0, Rate: 1})
+	assert.Error(t, err)
+	_, err = Run(context.Background(), c, Options{Series: 1, QueryRate: 1, Mix: Mix{"range": 0}})
+	assert.Error(t, err)
+}
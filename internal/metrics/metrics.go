@@ -0,0 +1,450 @@
+// Package metrics implements the counters, gauges and histograms refluxdb
+// uses to report its own telemetry, and renders them in the Prometheus text
+// exposition format.
+//
+// Metrics are registered in the Default registry when they are created, so
+// instrumented packages declare them as package level variables:
+//
+//	var pointsWritten = metrics.NewCounter("refluxdb_points_written_total", "Points written")
+package metrics
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultBuckets are the histogram buckets, in seconds, used for latencies
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// collector is implemented by every metric family
+type collector interface {
+	name() string
+	write(w io.Writer) error
+	// value returns the current value, keyed by label set when the metric
+	// has labels
+	value() interface{}
+}
+
+// Registry holds a set of metric families
+type Registry struct {
+	mu         sync.RWMutex
+	collectors map[string]collector
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]collector)}
+}
+
+// Default is the registry used by the package level constructors
+var Default = NewRegistry()
+
+// register adds c to the registry, replacing any metric with the same name
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors[c.name()] = c
+}
+
+// Write renders every metric in the Prometheus text format, sorted by name
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]collector, len(names))
+	for i, name := range names {
+		collectors[i] = r.collectors[name]
+	}
+	r.mu.RUnlock()
+
+	for _, c := range collectors {
+		if err := c.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Snapshot returns the current value of every metric by name. Metrics
+// with labels map each label set, such as reason="partial", to its value;
+// histograms report their count and sum.
+func (r *Registry) Snapshot() map[string]interface{} {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	values := make(map[string]interface{}, len(r.collectors))
+	for name, c := range r.collectors {
+		values[name] = c.value()
+	}
+	return values
+}
+
+// Handler returns an http.Handler serving the Default registry
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := Default.Write(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	v atomic.Uint64
+}
+
+// Inc increments the counter by one
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+// Add increments the counter by n
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+// Value returns the current counter value
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+// Set replaces the gauge value
+func (g *Gauge) Set(v float64) {
+	g.bits.Store(math.Float64bits(v))
+}
+
+// Add adds delta to the gauge value
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := g.bits.Load()
+		if g.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+// Value returns the current gauge value
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	buckets []float64
+	counts  []atomic.Uint64
+	count   atomic.Uint64
+	sum     Gauge
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		buckets: buckets,
+		counts:  make([]atomic.Uint64, len(buckets)),
+	}
+}
+
+// Observe records a single observation
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	h.sum.Add(v)
+}
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	return h.count.Load()
+}
+
+// family is a named metric with zero or more labeled children
+type family[T any] struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+	newChild   func() *T
+	writeChild func(w io.Writer, name, labels string, child *T) error
+	valueChild func(child *T) interface{}
+
+	mu       sync.RWMutex
+	children map[string]*T
+	order    []string
+}
+
+func (f *family[T]) name() string {
+	return f.metricName
+}
+
+// with returns the child for the given label values, creating it if needed
+func (f *family[T]) with(values ...string) *T {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.metricName, len(f.labels), len(values)))
+	}
+	key := formatLabels(f.labels, values)
+
+	f.mu.RLock()
+	child, ok := f.children[key]
+	f.mu.RUnlock()
+	if ok {
+		return child
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if child, ok := f.children[key]; ok {
+		return child
+	}
+	child = f.newChild()
+	f.children[key] = child
+	f.order = append(f.order, key)
+	sort.Strings(f.order)
+	return child
+}
+
+func (f *family[T]) write(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.metricName, escapeHelp(f.help), f.metricName, f.kind); err != nil {
+		return err
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, key := range f.order {
+		if err := f.writeChild(w, f.metricName, key, f.children[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *family[T]) value() interface{} {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if len(f.labels) == 0 {
+		if child, ok := f.children[""]; ok {
+			return f.valueChild(child)
+		}
+		return nil
+	}
+	values := make(map[string]interface{}, len(f.children))
+	for key, child := range f.children {
+		values[strings.Trim(key, "{}")] = f.valueChild(child)
+	}
+	return values
+}
+
+func newFamily[T any](name, help, kind string, labels []string, newChild func() *T, writeChild func(io.Writer, string, string, *T) error, valueChild func(*T) interface{}) *family[T] {
+	f := &family[T]{
+		metricName: name,
+		help:       help,
+		kind:       kind,
+		labels:     labels,
+		newChild:   newChild,
+		writeChild: writeChild,
+		valueChild: valueChild,
+		children:   make(map[string]*T),
+	}
+	Default.register(f)
+	return f
+}
+
+func writeCounter(w io.Writer, name, labels string, c *Counter) error {
+	_, err := fmt.Fprintf(w, "%s%s %d\n", name, labels, c.Value())
+	return err
+}
+
+func writeGauge(w io.Writer, name, labels string, g *Gauge) error {
+	_, err := fmt.Fprintf(w, "%s%s %s\n", name, labels, formatFloat(g.Value()))
+	return err
+}
+
+// CounterVec is a counter partitioned by label values
+type CounterVec struct {
+	f *family[Counter]
+}
+
+// NewCounter creates and registers a counter without labels
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+// NewCounterVec creates and registers a counter partitioned by labels
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{f: newFamily(name, help, "counter", labels, func() *Counter { return &Counter{} }, writeCounter,
+		func(c *Counter) interface{} { return c.Value() })}
+}
+
+// With returns the counter for the given label values
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.f.with(values...)
+}
+
+// GaugeVec is a gauge partitioned by label values
+type GaugeVec struct {
+	f *family[Gauge]
+}
+
+// NewGauge creates and registers a gauge without labels
+func NewGauge(name, help string) *Gauge {
+	return NewGaugeVec(name, help).With()
+}
+
+// NewGaugeVec creates and registers a gauge partitioned by labels
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{f: newFamily(name, help, "gauge", labels, func() *Gauge { return &Gauge{} }, writeGauge,
+		func(g *Gauge) interface{} { return snapshotFloat(g.Value()) })}
+}
+
+// With returns the gauge for the given label values
+func (v *GaugeVec) With(values ...string) *Gauge {
+	return v.f.with(values...)
+}
+
+// gaugeFunc is a gauge whose value is computed when metrics are collected
+type gaugeFunc struct {
+	metricName string
+	help       string
+	fn         func() float64
+}
+
+func (g *gaugeFunc) name() string {
+	return g.metricName
+}
+
+func (g *gaugeFunc) value() interface{} {
+	return snapshotFloat(g.fn())
+}
+
+func (g *gaugeFunc) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n",
+		g.metricName, escapeHelp(g.help), g.metricName, g.metricName, formatFloat(g.fn()))
+	return err
+}
+
+// NewGaugeFunc registers a gauge computed by fn at collection time. A later
+// registration with the same name replaces the previous function.
+func NewGaugeFunc(name, help string, fn func() float64) {
+	Default.register(&gaugeFunc{metricName: name, help: help, fn: fn})
+}
+
+// HistogramVec is a histogram partitioned by label values
+type HistogramVec struct {
+	f *family[Histogram]
+}
+
+// NewHistogram creates and registers a histogram without labels
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return NewHistogramVec(name, help, buckets).With()
+}
+
+// NewHistogramVec creates and registers a histogram partitioned by labels
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+	return &HistogramVec{f: newFamily(name, help, "histogram", labels,
+		func() *Histogram { return newHistogram(buckets) }, writeHistogram, histogramValue)}
+}
+
+// With returns the histogram for the given label values
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.f.with(values...)
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *Histogram) error {
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i].Load()
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", formatFloat(bound)), cumulative); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), h.Count()); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.sum.Value())); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.Count())
+	return err
+}
+
+func histogramValue(h *Histogram) interface{} {
+	return map[string]interface{}{"count": h.Count(), "sum": snapshotFloat(h.sum.Value())}
+}
+
+// snapshotFloat returns v, or its text form when JSON cannot represent it
+func snapshotFloat(v float64) interface{} {
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return formatFloat(v)
+	}
+	return v
+}
+
+// formatLabels renders label pairs as {a="1",b="2"}, or "" without labels
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = names[i] + "=" + strconv.Quote(values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel appends one label pair to an already formatted label set
+func withLabel(labels, name, value string) string {
+	pair := name + "=" + strconv.Quote(value)
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func init() {
+	// /debug/vars serves the Default registry next to the Go runtime
+	// variables
+	expvar.Publish("refluxdb", expvar.Func(func() interface{} { return Default.Snapshot() }))
+
+	NewGaugeFunc("refluxdb_goroutines", "Number of goroutines that currently exist", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+	NewGaugeFunc("refluxdb_heap_alloc_bytes", "Bytes of allocated heap objects", func() float64 {
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		return float64(ms.HeapAlloc)
+	})
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"bytes"
+	"expvar"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func render(t *testing.T) string {
+	var buf bytes.Buffer
+	assert.NoError(t, Default.Write(&buf))
+	return buf.String()
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_counter_total", "A test counter")
+	c.Inc()
+	c.Add(2)
+	assert.Equal(t, uint64(3), c.Value())
+
+	out := render(t)
+	assert.Contains(t, out, "# HELP test_counter_total A test counter\n# TYPE test_counter_total counter\ntest_counter_total 3\n")
+}
+
+func TestCounterVec(t *testing.T) {
+	v := NewCounterVec("test_labeled_total", "Labeled", "path", "code")
+	v.With("/write", "204").Inc()
+	v.With("/write", "204").Inc()
+	v.With("/query", `a"b`).Inc()
+	assert.Same(t, v.With("/write", "204"), v.With("/write", "204"))
+
+	out := render(t)
+	assert.Contains(t, out, `test_labeled_total{path="/write",code="204"} 2`)
+	assert.Contains(t, out, `test_labeled_total{path="/query",code="a\"b"} 1`)
+	assert.Panics(t, func() { v.With("/write") })
+}
+
+func TestGauge(t *testing.T) {
+	g := NewGauge("test_gauge", "A test gauge")
+	g.Set(1.5)
+	g.Add(-0.5)
+	assert.Equal(t, 1.0, g.Value())
+	assert.Contains(t, render(t), "test_gauge 1\n")
+
+	g.Set(math.Inf(1))
+	assert.Contains(t, render(t), "test_gauge +Inf\n")
+
+	NewGaugeFunc("test_gauge_func", "Computed", func() float64 { return 42 })
+	assert.Contains(t, render(t), "# TYPE test_gauge_func gauge\ntest_gauge_func 42\n")
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogramVec("test_latency_seconds", "Latency", []float64{1, 0.1}, "api")
+	h.With("v1").Observe(0.05)
+	h.With("v1").Observe(0.5)
+	h.With("v1").Observe(5)
+	assert.Equal(t, uint64(3), h.With("v1").Count())
+
+	out := render(t)
+	assert.Contains(t, out, "# TYPE test_latency_seconds histogram\n")
+	assert.Contains(t, out, strings.Join([]string{
+		`test_latency_seconds_bucket{api="v1",le="0.1"} 1`,
+		`test_latency_seconds_bucket{api="v1",le="1"} 2`,
+		`test_latency_seconds_bucket{api="v1",le="+Inf"} 3`,
+		`test_latency_seconds_sum{api="v1"} 5.55`,
+		`test_latency_seconds_count{api="v1"} 3`,
+	}, "\n"))
+}
+
+func TestHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "refluxdb_goroutines ")
+	assert.Contains(t, w.Body.String(), "refluxdb_heap_alloc_bytes ")
+}
+
+func TestSnapshot(t *testing.T) {
+	NewCounter("test_snapshot_total", "Snapshot").Add(4)
+	NewGaugeVec("test_snapshot_queue", "Snapshot", "name").With("cloud").Set(1.5)
+	NewHistogram("test_snapshot_seconds", "Snapshot", DefaultBuckets).Observe(0.5)
+
+	values := Default.Snapshot()
+	assert.Equal(t, uint64(4), values["test_snapshot_total"])
+	assert.Equal(t, map[string]interface{}{`name="cloud"`: 1.5}, values["test_snapshot_queue"])
+	assert.Equal(t, map[string]interface{}{"count": uint64(1), "sum": 0.5}, values["test_snapshot_seconds"])
+	assert.Contains(t, values, "refluxdb_goroutines")
+
+	// Published for /debug/vars
+	w := httptest.NewRecorder()
+	expvar.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/vars", nil))
+	assert.Contains(t, w.Body.String(), `"test_snapshot_total":4`)
+}
@@ -0,0 +1,251 @@
+// Package monitor periodically writes the runtime statistics of refluxdb
+// into the _internal database, with the measurements and field names of
+// the InfluxDB 1.x self-monitoring, so that dashboards built for it keep
+// working.
+package monitor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultDatabase receives the statistics, as in InfluxDB
+const DefaultDatabase = "_internal"
+
+// DefaultInterval is how often the statistics are stored
+const DefaultInterval = 10 * time.Second
+
+// DefaultRetention is the retention period of the database created for
+// the statistics, the one of the InfluxDB monitor retention policy
+const DefaultRetention = 7 * 24 * time.Hour
+
+// Options configures a Service
+type Options struct {
+	// Database receives the statistics, DefaultDatabase when empty. It is
+	// created with DefaultRetention when it does not exist.
+	Database string
+	// Interval is how often the statistics are stored, DefaultInterval
+	// when zero
+	Interval time.Duration
+	// Hostname tags every point, the host name of the machine when empty
+	Hostname string
+	// Logger receives storage errors. The standard logrus logger is used
+	// when nil.
+	Logger *logrus.Logger
+}
+
+// Service stores the statistics on a schedule
+type Service struct {
+	db   *persistence.Manager
+	opts Options
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New creates a service storing the statistics into db
+func New(db *persistence.Manager, opts Options) *Service {
+	if opts.Database == "" {
+		opts.Database = DefaultDatabase
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+	if opts.Hostname == "" {
+		opts.Hostname, _ = os.Hostname()
+	}
+	if opts.Logger == nil {
+		opts.Logger = logrus.StandardLogger()
+	}
+	return &Service{db: db, opts: opts}
+}
+
+// Start creates the database when needed and stores the statistics every
+// interval until ctx is done or Stop is called
+func (s *Service) Start(ctx context.Context) error {
+	_, err := s.db.AddDatabase(persistence.Database{
+		Name:            s.opts.Database,
+		Description:     "refluxdb self-monitoring",
+		RetentionPeriod: DefaultRetention,
+	})
+	if err != nil && !errors.Is(err, persistence.ErrDatabaseExists) {
+		return fmt.Errorf("failed to create monitor database %s: %w", s.opts.Database, err)
+	}
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if err := s.Store(now); err != nil {
+					s.opts.Logger.Errorf("Failed to store monitor statistics: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops storing the statistics
+func (s *Service) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+}
+
+// Store writes the statistics as of now
+func (s *Service) Store(now time.Time) error {
+	points, err := s.collect(now)
+	if err != nil {
+		return err
+	}
+	return s.db.SaveBatch(points)
+}
+
+// collect gathers the statistics as points. Counters are totals since the
+// server started, like those of InfluxDB, so dashboards derive rates from
+// them with non_negative_derivative().
+func (s *Service) collect(now time.Time) ([]persistence.Point, error) {
+	values := metrics.Default.Snapshot()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	queries, queryDuration := histogram(values["refluxdb_query_duration_seconds"])
+	batches, _ := histogram(values["refluxdb_storage_batch_duration_seconds"])
+	writeErrors := total(values["refluxdb_storage_write_errors_total"])
+
+	points := []persistence.Point{
+		s.point(now, "runtime", nil, map[string]float64{
+			"Alloc":        float64(ms.Alloc),
+			"Frees":        float64(ms.Frees),
+			"HeapAlloc":    float64(ms.HeapAlloc),
+			"HeapIdle":     float64(ms.HeapIdle),
+			"HeapInUse":    float64(ms.HeapInuse),
+			"HeapObjects":  float64(ms.HeapObjects),
+			"HeapReleased": float64(ms.HeapReleased),
+			"HeapSys":      float64(ms.HeapSys),
+			"Lookups":      float64(ms.Lookups),
+			"Mallocs":      float64(ms.Mallocs),
+			"NumGC":        float64(ms.NumGC),
+			"NumGoroutine": float64(runtime.NumGoroutine()),
+			"PauseTotalNs": float64(ms.PauseTotalNs),
+			"Sys":          float64(ms.Sys),
+			"TotalAlloc":   float64(ms.TotalAlloc),
+		}),
+		s.point(now, "write", nil, map[string]float64{
+			"pointReq":   total(values["refluxdb_storage_points_written_total"]),
+			"writeOk":    batches - writeErrors,
+			"writeError": writeErrors,
+			"writeDrop":  total(values["refluxdb_ingest_batches_dropped_total"]) + total(values["refluxdb_ingest_batches_evicted_total"]),
+		}),
+		s.point(now, "httpd", nil, map[string]float64{
+			"writeReq":           total(values["refluxdb_http_write_requests_total"]),
+			"writeReqErrors":     total(values["refluxdb_http_write_errors_total"]),
+			"pointsWrittenOK":    total(values["refluxdb_http_points_written_total"]),
+			"queryReq":           queries,
+			"queryReqDurationNs": queryDuration * 1e9,
+		}),
+		s.point(now, "queryExecutor", nil, map[string]float64{
+			"queriesActive":   total(values["refluxdb_queries_active"]),
+			"queriesExecuted": queries,
+			"queriesFinished": queries,
+			"queryDurationNs": queryDuration * 1e9,
+		}),
+		s.point(now, "udp", nil, map[string]float64{
+			"pointsRx":        total(values["refluxdb_udp_points_received_total"]),
+			"bytesRx":         total(values["refluxdb_udp_bytes_received_total"]),
+			"packetsRx":       total(values["refluxdb_udp_packets_received_total"]),
+			"pointsParseFail": total(values["refluxdb_udp_parse_errors_total"]),
+			"readFail":        label(values["refluxdb_udp_packets_dropped_total"], `reason="read"`),
+			"pointsDropped":   total(values["refluxdb_udp_points_dropped_total"]),
+		}),
+	}
+
+	cardinality, err := s.db.Cardinality()
+	if err != nil {
+		return nil, err
+	}
+	for database, c := range cardinality {
+		points = append(points, s.point(now, "database", map[string]string{"database": database}, map[string]float64{
+			"numMeasurements": float64(c.Measurements),
+			"numSeries":       float64(c.Series),
+		}))
+	}
+	return points, nil
+}
+
+// point builds a point of the monitor database tagged with the host name
+func (s *Service) point(now time.Time, measurement string, tags map[string]string, fields map[string]float64) persistence.Point {
+	if tags == nil {
+		tags = make(map[string]string, 1)
+	}
+	tags["hostname"] = s.opts.Hostname
+	return persistence.Point{
+		Database:    s.opts.Database,
+		Measurement: measurement,
+		Tags:        tags,
+		Fields:      fields,
+		Timestamp:   now.UnixNano(),
+	}
+}
+
+// total returns the value of a counter or gauge of a metrics snapshot,
+// summed over its label sets
+func total(v interface{}) float64 {
+	switch v := v.(type) {
+	case uint64:
+		return float64(v)
+	case float64:
+		return v
+	case map[string]interface{}:
+		var sum float64
+		for _, child := range v {
+			sum += total(child)
+		}
+		return sum
+	}
+	return 0
+}
+
+// label returns the value of a label set of a metric, such as
+// reason="read"
+func label(v interface{}, labels string) float64 {
+	if m, ok := v.(map[string]interface{}); ok {
+		return total(m[labels])
+	}
+	return 0
+}
+
+// histogram returns the count and sum of a histogram of a metrics
+// snapshot, summed over its label sets
+func histogram(v interface{}) (count, sum float64) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return 0, 0
+	}
+	if _, ok := m["count"]; ok {
+		return total(m["count"]), total(m["sum"])
+	}
+	for _, child := range m {
+		c, s := histogram(child)
+		count += c
+		sum += s
+	}
+	return count, sum
+}
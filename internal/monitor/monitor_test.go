@@ -0,0 +1,69 @@
+package monitor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStore(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.SaveMeasurement("mydb", "cpu", map[string]float64{"value": 1}, map[string]string{"host": "a"}, time.Now().UnixNano()))
+
+	s := New(db, Options{Hostname: "server1", Interval: time.Hour})
+	assert.NoError(t, s.Start(context.Background()))
+	defer s.Stop()
+
+	d, err := db.GetDatabase(DefaultDatabase)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultRetention, d.RetentionPeriod)
+
+	now := time.Now()
+	assert.NoError(t, s.Store(now))
+
+	runtimeStats, err := db.GetMeasurementRange(DefaultDatabase, "runtime", now.Add(-time.Second).UnixNano(), now.Add(time.Second).UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, runtimeStats, 1)
+	assert.Equal(t, "server1", runtimeStats[0].Tags["hostname"])
+	assert.Greater(t, runtimeStats[0].Fields["HeapAlloc"], 0.0)
+	assert.Greater(t, runtimeStats[0].Fields["NumGoroutine"], 0.0)
+
+	write, err := db.GetMeasurementRange(DefaultDatabase, "write", now.Add(-time.Second).UnixNano(), now.Add(time.Second).UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, write, 1)
+	assert.GreaterOrEqual(t, write[0].Fields["pointReq"], 1.0)
+
+	databases, err := db.GetMeasurementRange(DefaultDatabase, "database", now.Add(-time.Second).UnixNano(), now.Add(time.Second).UnixNano())
+	assert.NoError(t, err)
+	found := false
+	for _, p := range databases {
+		if p.Tags["database"] == "mydb" {
+			found = true
+			assert.Equal(t, 1.0, p.Fields["numMeasurements"])
+			assert.Equal(t, 1.0, p.Fields["numSeries"])
+		}
+	}
+	assert.True(t, found)
+
+	// The database is only created once
+	s.Stop()
+	assert.NoError(t, New(db, Options{Interval: time.Hour}).Start(context.Background()))
+}
+
+func TestSnapshotValues(t *testing.T) {
+	assert.Equal(t, 3.0, total(uint64(3)))
+	assert.Equal(t, 5.0, total(map[string]interface{}{`reason="a"`: uint64(2), `reason="b"`: uint64(3)}))
+	assert.Equal(t, 2.0, label(map[string]interface{}{`reason="read"`: uint64(2)}, `reason="read"`))
+
+	count, sum := histogram(map[string]interface{}{
+		`api="v1"`: map[string]interface{}{"count": uint64(2), "sum": 0.5},
+		`api="v2"`: map[string]interface{}{"count": uint64(1), "sum": 0.25},
+	})
+	assert.Equal(t, 3.0, count)
+	assert.Equal(t, 0.75, sum)
+}
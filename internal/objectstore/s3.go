@@ -0,0 +1,297 @@
+// Package objectstore stores files in S3 compatible object storage, such
+// as AWS S3, MinIO or Ceph, with requests signed with AWS Signature
+// Version 4. Only the operations refluxdb needs are implemented: storing,
+// reading and deleting an object.
+package objectstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRegion is the region signed into the requests when none is set
+	DefaultRegion = "us-east-1"
+	// unsignedPayload lets object bodies be streamed instead of hashed
+	// before the request is sent
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	// emptyPayload is the SHA-256 of an empty body
+	emptyPayload  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	amzDateFormat = "20060102T150405Z"
+)
+
+// ErrNotFound is returned by Get for a missing object
+var ErrNotFound = errors.New("object not found")
+
+// Options configures an S3 store
+type Options struct {
+	// Endpoint is the URL of the S3 API, such as https://s3.amazonaws.com
+	// or http://localhost:9000 for MinIO
+	Endpoint string
+	Bucket   string
+	// Region is signed into the requests, DefaultRegion when empty
+	Region string
+	// Prefix is prepended to every object key, such as "refluxdb/"
+	Prefix string
+	// AccessKeyID and SecretAccessKey sign the requests. When both are
+	// empty they are read from AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY, along with AWS_SESSION_TOKEN.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// PathStyle addresses the bucket in the path of the URL rather than
+	// in its host name, as most S3 compatible servers expect
+	PathStyle bool
+	// HTTPClient sends the requests, http.DefaultClient when nil
+	HTTPClient *http.Client
+}
+
+// Validate checks the endpoint, bucket and credentials
+func (o Options) Validate() error {
+	u, err := url.Parse(o.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q: expected an http or https URL", o.Endpoint)
+	}
+	if o.Bucket == "" {
+		return fmt.Errorf("missing bucket")
+	}
+	if (o.AccessKeyID == "") != (o.SecretAccessKey == "") {
+		return fmt.Errorf("access key ID and secret access key must be set together")
+	}
+	return nil
+}
+
+// S3 is an S3 compatible bucket
+type S3 struct {
+	opts     Options
+	endpoint *url.URL
+	client   *http.Client
+}
+
+// NewS3 returns a store of the objects of a bucket
+func NewS3(opts Options) (*S3, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Region == "" {
+		opts.Region = DefaultRegion
+	}
+	if opts.AccessKeyID == "" {
+		opts.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		opts.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		opts.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	client := opts.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	endpoint, _ := url.Parse(opts.Endpoint)
+	return &S3{opts: opts, endpoint: endpoint, client: client}, nil
+}
+
+// Put stores the size bytes of r as the object key
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	req, err := s.request(ctx, http.MethodPut, key, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := s.do(req, unsignedPayload)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get returns the content of the object key, which the caller must close
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := s.request(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req, emptyPayload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	return resp.Body, nil
+}
+
+// Delete removes the object key. Deleting a missing object succeeds.
+func (s *S3) Delete(ctx context.Context, key string) error {
+	req, err := s.request(ctx, http.MethodDelete, key, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req, emptyPayload)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// request builds the request of an operation on the object key
+func (s *S3) request(ctx context.Context, method, key string, body io.Reader) (*http.Request, error) {
+	u := *s.endpoint
+	path := strings.TrimSuffix(u.Path, "/") + "/" + s.opts.Prefix + key
+	if s.opts.PathStyle {
+		path = strings.TrimSuffix(u.Path, "/") + "/" + s.opts.Bucket + "/" + s.opts.Prefix + key
+	} else {
+		u.Host = s.opts.Bucket + "." + u.Host
+	}
+	u.Path, u.RawPath = path, escapePath(path)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	return req, nil
+}
+
+// do signs and sends req, turning error responses into errors
+func (s *S3) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.opts.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.opts.SessionToken)
+	}
+	if s.opts.AccessKeyID != "" {
+		sign(req, s.opts.AccessKeyID, s.opts.SecretAccessKey, s.opts.Region, payloadHash, time.Now())
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	// Errors are described by an XML document
+	var apiErr struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(body, &apiErr) == nil && apiErr.Code != "" {
+		return nil, fmt.Errorf("%s: %s: %s", resp.Status, apiErr.Code, apiErr.Message)
+	}
+	return nil, fmt.Errorf("%s", resp.Status)
+}
+
+// sign adds the AWS Signature Version 4 authorization of req, signing the
+// host, the range and every x-amz- header
+func sign(req *http.Request, accessKeyID, secret, region, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secret), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+// canonicalQuery sorts and encodes the query parameters
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// escapePath encodes every segment of an object path as S3 signs it
+func escapePath(path string) string {
+	return uriEncode(path, false)
+}
+
+// uriEncode percent-encodes every byte but the unreserved characters, and
+// slashes unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,73 @@
+package persistence
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// AuditEntry is a record of the audit log
+type AuditEntry struct {
+	ID   int64
+	Time time.Time
+	// Actor is the token ID or "user:<name>" that performed the
+	// operation, or "anonymous" when authentication is disabled
+	Actor string
+	// Source is the address of the client
+	Source string
+	// Action names the operation, such as "database.create"
+	Action string
+	// Target is the object of the operation, such as a database name
+	Target string
+	Detail string
+}
+
+// RecordAudit appends e to the audit log. A zero Time is set to now.
+func (m *Manager) RecordAudit(e AuditEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.db.Exec(`INSERT INTO audit_log (time, actor, source, action, target, detail) VALUES (?, ?, ?, ?, ?, ?)`,
+		e.Time.UnixNano(), e.Actor, e.Source, e.Action, e.Target, e.Detail)
+	if err != nil {
+		return fmt.Errorf("failed to record audit entry: %w", err)
+	}
+	return nil
+}
+
+// AuditLog returns the entries recorded at or after since, oldest first,
+// and at most limit of them when limit is positive. A zero since returns
+// the whole log.
+func (m *Manager) AuditLog(since time.Time, limit int) ([]AuditEntry, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	from := int64(math.MinInt64)
+	if !since.IsZero() {
+		from = since.UnixNano()
+	}
+	rows, err := m.db.Query(`SELECT id, time, actor, source, action, target, detail FROM audit_log
+		WHERE time >= ? ORDER BY id LIMIT ?`, from, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var t int64
+		if err := rows.Scan(&e.ID, &t, &e.Actor, &e.Source, &e.Action, &e.Target, &e.Detail); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		e.Time = time.Unix(0, t).UTC()
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return entries, nil
+}
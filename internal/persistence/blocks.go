@@ -0,0 +1,354 @@
+package persistence
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/gorilla"
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+)
+
+// blockSize is the maximum number of points packed in a block
+const blockSize = 1000
+
+var shardsPacked = metrics.NewCounter("refluxdb_storage_shards_packed_total", "Shards packed into compressed blocks by the columnar engine")
+
+// blockPoint is a point of a series being packed
+type blockPoint struct {
+	timestamp int64
+	fields    map[string]float64
+}
+
+// PackShards packs the rows of every shard whose window ended before now
+// into compressed per-series blocks, and returns how many shards were
+// packed. Rows written to a shard after it was packed are merged into its
+// blocks by the next call, unless the shard was tiered meanwhile.
+func (m *Manager) PackShards(now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n := 0
+	for databaseID, shards := range m.shards.all() {
+		for _, s := range shards {
+			// The rows of tiered shards are left as they are, their blocks
+			// being in object storage
+			if s.end > now.UnixNano() || s.object != "" {
+				continue
+			}
+			var hasRows bool
+			if err := m.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM ` + s.table() + `)`).Scan(&hasRows); err != nil {
+				return n, fmt.Errorf("failed to inspect shard %s: %w", s.table(), err)
+			}
+			if !hasRows {
+				continue
+			}
+			if err := m.packShard(s); err != nil {
+				return n, err
+			}
+			m.shards.markPacked(databaseID, map[int64]bool{s.id: true})
+			shardsPacked.Inc()
+			n++
+		}
+	}
+	return n, nil
+}
+
+// packShard moves the rows of a shard into its blocks table
+func (m *Manager) packShard(s shard) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(blocksTableDDL(s.blocksTable()))
+	if err != nil {
+		return fmt.Errorf("failed to create blocks of shard %s: %w", s.table(), err)
+	}
+	if _, err := tx.Exec(`UPDATE shards SET packed = 1 WHERE id = ?`, s.id); err != nil {
+		return fmt.Errorf("failed to pack shard %s: %w", s.table(), err)
+	}
+
+	series, err := queryInt64s(tx, `SELECT DISTINCT series_id FROM `+s.table())
+	if err != nil {
+		return fmt.Errorf("failed to list series of shard %s: %w", s.table(), err)
+	}
+	for _, id := range series {
+		if err := packSeries(tx, s, id); err != nil {
+			return fmt.Errorf("failed to pack shard %s: %w", s.table(), err)
+		}
+	}
+	return tx.Commit()
+}
+
+// packSeries merges the rows of a series into its blocks in shard s,
+// the rows winning over block values with the same timestamp
+func packSeries(tx *sql.Tx, s shard, seriesID int64) error {
+	packed, err := readBlocks(tx, `SELECT data FROM `+s.blocksTable()+` WHERE series_id = ? ORDER BY min_time`, seriesID)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT timestamp, fields FROM `+s.table()+` WHERE series_id = ? ORDER BY timestamp`, seriesID)
+	if err != nil {
+		return err
+	}
+	var written []blockPoint
+	for rows.Next() {
+		var p blockPoint
+		var data []byte
+		if err := rows.Scan(&p.timestamp, &data); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		if p.fields, err = decodeFields(data); err != nil {
+			rows.Close()
+			return err
+		}
+		written = append(written, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM `+s.blocksTable()+` WHERE series_id = ?`, seriesID); err != nil {
+		return err
+	}
+	if err := writeBlocks(tx, s, seriesID, mergeBlockPoints(packed, written)); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM `+s.table()+` WHERE series_id = ?`, seriesID)
+	return err
+}
+
+// mergeBlockPoints merges two time ordered lists of points, the fields of
+// b overriding those of a at the same timestamp
+func mergeBlockPoints(a, b []blockPoint) []blockPoint {
+	merged := make([]blockPoint, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0].timestamp < b[0].timestamp:
+			merged, a = append(merged, a[0]), a[1:]
+		case a[0].timestamp > b[0].timestamp:
+			merged, b = append(merged, b[0]), b[1:]
+		default:
+			for k, v := range b[0].fields {
+				a[0].fields[k] = v
+			}
+			merged, a, b = append(merged, a[0]), a[1:], b[1:]
+		}
+	}
+	return append(append(merged, a...), b...)
+}
+
+// writeBlocks packs time ordered points of a series into blocks of shard s
+func writeBlocks(tx *sql.Tx, s shard, seriesID int64, points []blockPoint) error {
+	for len(points) > 0 {
+		chunk := points
+		if len(chunk) > blockSize {
+			chunk = chunk[:blockSize]
+		}
+		points = points[len(chunk):]
+
+		b := gorilla.Block{Fields: make(map[string][]float64)}
+		for i, p := range chunk {
+			b.Timestamps = append(b.Timestamps, p.timestamp)
+			for k, v := range p.fields {
+				column, ok := b.Fields[k]
+				if !ok {
+					column = make([]float64, len(chunk))
+					for j := range column {
+						column[j] = gorilla.Missing
+					}
+					b.Fields[k] = column
+				}
+				column[i] = v
+			}
+		}
+		data, err := gorilla.Encode(b)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO `+s.blocksTable()+` (series_id, min_time, max_time, count, data) VALUES (?, ?, ?, ?, ?)`,
+			seriesID, chunk[0].timestamp, chunk[len(chunk)-1].timestamp, len(chunk), data)
+		if err != nil {
+			return fmt.Errorf("failed to write block: %w", err)
+		}
+	}
+	return nil
+}
+
+// readBlocks decodes the points of the blocks selected by query, which
+// must select the block data
+func readBlocks(tx *sql.Tx, query string, args ...interface{}) ([]blockPoint, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var points []blockPoint
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		b, err := gorilla.Decode(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode block: %w", err)
+		}
+		for i, ts := range b.Timestamps {
+			points = append(points, blockPoint{timestamp: ts, fields: blockFields(b, i)})
+		}
+	}
+	return points, rows.Err()
+}
+
+// unpackBlock returns the points of a block within [start, end]
+func unpackBlock(data []byte, database, measurement string, tags map[string]string, start, end int64) ([]Point, error) {
+	b, err := gorilla.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode block: %w", err)
+	}
+	from := sort.Search(b.Len(), func(i int) bool { return b.Timestamps[i] >= start })
+	to := sort.Search(b.Len(), func(i int) bool { return b.Timestamps[i] > end })
+
+	points := make([]Point, 0, to-from)
+	for i := from; i < to; i++ {
+		points = append(points, Point{
+			Database:    database,
+			Measurement: measurement,
+			Tags:        tags,
+			Fields:      blockFields(b, i),
+			Timestamp:   b.Timestamps[i],
+		})
+	}
+	return points, nil
+}
+
+// blockFields returns the fields of the point at index i of a block
+func blockFields(b gorilla.Block, i int) map[string]float64 {
+	fields := make(map[string]float64, len(b.Fields))
+	for k, column := range b.Fields {
+		if v := column[i]; !gorilla.IsMissing(v) {
+			fields[k] = v
+		}
+	}
+	return fields
+}
+
+// trimBlocks deletes the packed points of shard s older than cutoff and
+// returns how many were deleted
+func trimBlocks(tx *sql.Tx, s shard, cutoff int64) (int64, error) {
+	var deleted int64
+	err := tx.QueryRow(`SELECT COALESCE(SUM(count), 0) FROM `+s.blocksTable()+` WHERE max_time < ?`, cutoff).Scan(&deleted)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM `+s.blocksTable()+` WHERE max_time < ?`, cutoff); err != nil {
+		return 0, err
+	}
+
+	series, err := queryInt64s(tx, `SELECT series_id FROM `+s.blocksTable()+` WHERE min_time < ?`, cutoff)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range series {
+		points, err := readBlocks(tx, `SELECT data FROM `+s.blocksTable()+` WHERE series_id = ? AND min_time < ?`, id, cutoff)
+		if err != nil {
+			return 0, err
+		}
+		expired := sort.Search(len(points), func(i int) bool { return points[i].timestamp >= cutoff })
+		deleted += int64(expired)
+		if _, err := tx.Exec(`DELETE FROM `+s.blocksTable()+` WHERE series_id = ? AND min_time < ?`, id, cutoff); err != nil {
+			return 0, err
+		}
+		if err := writeBlocks(tx, s, id, points[expired:]); err != nil {
+			return 0, err
+		}
+	}
+	return deleted, nil
+}
+
+// deleteBlocks deletes the packed points of the series of ids in shard s
+// timestamped from start to end, inclusive, and returns how many were
+// deleted. The blocks holding them are rewritten with the points kept.
+func deleteBlocks(tx *sql.Tx, s shard, ids []int64, start, end int64) (int64, error) {
+	var deleted int64
+	for _, chunk := range seriesChunks(ids) {
+		in, args := inList(chunk)
+		series, err := queryInt64s(tx, `SELECT DISTINCT series_id FROM `+s.blocksTable()+` WHERE series_id IN (`+in+`) AND max_time >= ? AND min_time <= ?`,
+			append(args, start, end)...)
+		if err != nil {
+			return 0, err
+		}
+		for _, id := range series {
+			points, err := readBlocks(tx, `SELECT data FROM `+s.blocksTable()+` WHERE series_id = ? AND max_time >= ? AND min_time <= ? ORDER BY min_time`, id, start, end)
+			if err != nil {
+				return 0, err
+			}
+			kept := points[:0]
+			for _, p := range points {
+				if p.timestamp < start || p.timestamp > end {
+					kept = append(kept, p)
+				}
+			}
+			deleted += int64(len(points) - len(kept))
+			if _, err := tx.Exec(`DELETE FROM `+s.blocksTable()+` WHERE series_id = ? AND max_time >= ? AND min_time <= ?`, id, start, end); err != nil {
+				return 0, err
+			}
+			if err := writeBlocks(tx, s, id, kept); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// countPoints returns the number of points stored in shard s
+func countPoints(tx *sql.Tx, s shard) (int64, error) {
+	query := `SELECT COUNT(*) FROM ` + s.table()
+	if s.packed {
+		query = `SELECT (` + query + `) + (SELECT COALESCE(SUM(count), 0) FROM ` + s.blocksTable() + `)`
+	}
+	var n int64
+	if err := tx.QueryRow(query).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count points of shard %s: %w", s.table(), err)
+	}
+	return n, nil
+}
+
+// shardEmpty reports whether shard s holds no points
+func shardEmpty(tx *sql.Tx, s shard) (bool, error) {
+	query := `SELECT NOT EXISTS(SELECT 1 FROM ` + s.table() + `)`
+	if s.packed {
+		query += ` AND NOT EXISTS(SELECT 1 FROM ` + s.blocksTable() + `)`
+	}
+	var empty bool
+	if err := tx.QueryRow(query).Scan(&empty); err != nil {
+		return false, fmt.Errorf("failed to inspect shard %s: %w", s.table(), err)
+	}
+	return empty, nil
+}
+
+// queryInt64s returns the single integer column selected by query
+func queryInt64s(tx *sql.Tx, query string, args ...interface{}) ([]int64, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []int64
+	for rows.Next() {
+		var v int64
+		if err := rows.Scan(&v); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
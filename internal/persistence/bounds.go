@@ -0,0 +1,224 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var scansSkipped = metrics.NewCounter("refluxdb_storage_scans_skipped_total", "Range scans answered without reading storage, the range being outside the stored or retained points")
+
+// timeRange is the oldest and newest timestamp of the points of a
+// measurement. An empty range has min > max.
+type timeRange struct {
+	min, max int64
+}
+
+var emptyRange = timeRange{min: math.MaxInt64, max: math.MinInt64}
+
+func (r timeRange) overlaps(start, end int64) bool {
+	return r.min <= end && r.max >= start
+}
+
+// boundsCache keeps the time range of the measurements queried so far,
+// so that queries outside of it are answered without a scan. A
+// measurement is loaded from storage on its first query and then extended
+// by writes. Deletes reset the cache, since they can only narrow ranges.
+type boundsCache struct {
+	mu     sync.Mutex
+	ranges map[measurementRef]timeRange
+	// version changes with every write and reset, so that a range loaded
+	// while points were written is not kept
+	version uint64
+}
+
+func newBoundsCache() *boundsCache {
+	return &boundsCache{ranges: make(map[measurementRef]timeRange)}
+}
+
+// observe extends the ranges of the loaded measurements to the points
+func (c *boundsCache) observe(points []Point) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.version++
+	if len(c.ranges) == 0 {
+		return
+	}
+	for _, p := range points {
+		ref := measurementRef{database: p.Database, measurement: p.Measurement}
+		if ref.database == "" {
+			ref.database = DefaultDatabase
+		}
+		r, ok := c.ranges[ref]
+		if !ok {
+			continue
+		}
+		ts := p.Timestamp
+		r.min, r.max = min(r.min, ts), max(r.max, ts)
+		c.ranges[ref] = r
+	}
+}
+
+// get returns the range of a loaded measurement, or the current version
+// to store it with once loaded
+func (c *boundsCache) get(ref measurementRef) (timeRange, bool, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.ranges[ref]
+	return r, ok, c.version
+}
+
+// store keeps the range of a measurement loaded at version, unless points
+// were written since
+func (c *boundsCache) store(ref measurementRef, r timeRange, version uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.version == version {
+		c.ranges[ref] = r
+	}
+}
+
+func (c *boundsCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version++
+	c.ranges = make(map[measurementRef]timeRange)
+}
+
+// TimeBounds returns the oldest and newest timestamps of the points of a
+// measurement, and false when it has none. They are kept in memory once
+// read, so the measurement is only scanned on its first call.
+func (m *Manager) TimeBounds(ctx context.Context, database, measurement string) (int64, int64, bool, error) {
+	ref := measurementRef{database: database, measurement: measurement}
+	r, ok, version := m.bounds.get(ref)
+	if !ok {
+		var err error
+		if r, err = m.loadBounds(ctx, ref); err != nil {
+			return 0, 0, false, err
+		}
+		m.bounds.store(ref, r, version)
+	}
+	if r.min > r.max {
+		return 0, 0, false, nil
+	}
+	return r.min, r.max, true, nil
+}
+
+// loadBounds reads the time range of a measurement from storage. It does
+// not hold off writers, as it runs within scans that may already do so;
+// the cache drops ranges loaded while points were written instead.
+func (m *Manager) loadBounds(ctx context.Context, ref measurementRef) (timeRange, error) {
+	r := emptyRange
+	id, ok, err := m.databaseID(nil, ref.database)
+	if err != nil {
+		return timeRange{}, err
+	}
+	if ok {
+		// Shards are ordered by time window, so the oldest point is in the
+		// first shard holding the measurement and the newest in the last
+		shards := m.shards.overlapping(id, math.MinInt64, math.MaxInt64)
+		for _, s := range shards {
+			sr, err := shardBounds(ctx, m.db, s, id, ref.measurement)
+			if err != nil {
+				return timeRange{}, err
+			}
+			if sr.min <= sr.max {
+				r.min = sr.min
+				break
+			}
+		}
+		for i := len(shards) - 1; i >= 0; i-- {
+			sr, err := shardBounds(ctx, m.db, shards[i], id, ref.measurement)
+			if err != nil {
+				return timeRange{}, err
+			}
+			if sr.min <= sr.max {
+				r.max = sr.max
+				break
+			}
+		}
+	}
+	return r, nil
+}
+
+// shardBounds returns the time range of the points of a measurement in a
+// shard, empty when it holds none
+func shardBounds(ctx context.Context, db *sql.DB, s shard, databaseID, measurement string) (timeRange, error) {
+	query := `SELECT MIN(p.timestamp), MAX(p.timestamp) FROM ` + s.table() + ` p JOIN series s ON s.id = p.series_id
+		WHERE s.database_id = ? AND s.measurement = ?`
+	args := []interface{}{databaseID, measurement}
+	if s.packed {
+		query = `SELECT MIN(lo), MAX(hi) FROM (` +
+			`SELECT MIN(p.timestamp) AS lo, MAX(p.timestamp) AS hi FROM ` + s.table() + ` p JOIN series s ON s.id = p.series_id
+			WHERE s.database_id = ? AND s.measurement = ?
+			UNION ALL
+			SELECT MIN(b.min_time), MAX(b.max_time) FROM ` + s.blocksTable() + ` b JOIN series s ON s.id = b.series_id
+			WHERE s.database_id = ? AND s.measurement = ?)`
+		args = append(args, databaseID, measurement)
+	}
+	var lo, hi sql.NullInt64
+	err := db.QueryRowContext(ctx, query, args...).Scan(&lo, &hi)
+	if isMissingTable(err) || errors.Is(err, sql.ErrNoRows) {
+		return emptyRange, nil
+	}
+	if err != nil {
+		return timeRange{}, fmt.Errorf("failed to read time range of %s: %w", measurement, err)
+	}
+	if !lo.Valid || !hi.Valid {
+		return emptyRange, nil
+	}
+	return timeRange{min: lo.Int64, max: hi.Int64}, nil
+}
+
+// pruneRange narrows a scan of measurements of a database within
+// [start, end] to the measurements holding points in the range, and
+// returns false when none is left or the range ended before the retention
+// period of the database. Expired points that retention enforcement did
+// not delete yet are still returned by ranges reaching into the retention
+// period. No measurements stands for all of them, which are only pruned
+// by retention.
+func (m *Manager) pruneRange(ctx context.Context, database string, retention time.Duration, measurements []string, start, end int64) ([]string, bool, error) {
+	if start > end || (retention > 0 && end < time.Now().Add(-retention).UnixNano()) {
+		return nil, false, nil
+	}
+	if len(measurements) == 0 {
+		return nil, true, nil
+	}
+
+	kept := measurements[:0:0]
+	for _, name := range measurements {
+		lo, hi, ok, err := m.TimeBounds(ctx, database, name)
+		if err != nil {
+			return nil, false, err
+		}
+		if ok && (timeRange{min: lo, max: hi}).overlaps(start, end) {
+			kept = append(kept, name)
+		}
+	}
+	return kept, len(kept) > 0, nil
+}
+
+// traceRange logs a range query along with the cached time range of its
+// measurement. It never reads storage, the range being only known once a
+// query loaded it.
+func (m *Manager) traceRange(database, measurement string, start, end int64) {
+	format := func(ts int64) string {
+		return time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
+	}
+	stored := "not loaded"
+	if r, ok, _ := m.bounds.get(measurementRef{database: database, measurement: measurement}); ok {
+		stored = "empty"
+		if r.min <= r.max {
+			stored = format(r.min) + " to " + format(r.max)
+		}
+	}
+	log.Tracef("Querying %s.%s from %s to %s, stored points: %s", database, measurement, format(start), format(end), stored)
+}
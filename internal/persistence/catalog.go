@@ -0,0 +1,527 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The specific errors of the catalog, which match ErrNotFound or
+// ErrConflict too
+var (
+	// ErrDatabaseNotFound is returned when a database does not exist
+	ErrDatabaseNotFound = newClassError("database not found", ErrNotFound)
+	// ErrDatabaseExists is returned when creating a database whose name is taken
+	ErrDatabaseExists = newClassError("database already exists", ErrConflict)
+	// ErrOrganizationNotFound is returned when an organization does not exist
+	ErrOrganizationNotFound = newClassError("organization not found", ErrNotFound)
+	// ErrOrganizationExists is returned when creating an organization whose
+	// name is taken
+	ErrOrganizationExists = newClassError("organization already exists", ErrConflict)
+	// ErrSubscriptionNotFound is returned when a subscription does not exist
+	ErrSubscriptionNotFound = newClassError("subscription not found", ErrNotFound)
+	// ErrSubscriptionExists is returned when creating a subscription whose
+	// name is taken in its database
+	ErrSubscriptionExists = newClassError("subscription already exists", ErrConflict)
+	// ErrTaskNotFound is returned when a task does not exist
+	ErrTaskNotFound = newClassError("task not found", ErrNotFound)
+	// ErrTaskRunNotFound is returned when a run does not exist in the
+	// history of its task
+	ErrTaskRunNotFound = newClassError("run not found", ErrNotFound)
+	// ErrTokenNotFound is returned when a token does not exist
+	ErrTokenNotFound = newClassError("token not found", ErrNotFound)
+	// ErrUserNotFound is returned when a user does not exist
+	ErrUserNotFound = newClassError("user not found", ErrNotFound)
+	// ErrUserExists is returned when creating a user whose name is taken
+	ErrUserExists = newClassError("user already exists", ErrConflict)
+	// ErrInvalidPassword is returned when authenticating a user with the
+	// wrong password
+	ErrInvalidPassword = errors.New("invalid password")
+)
+
+// Database is the catalog entry of a database. The v2 API exposes
+// databases as buckets, so the entry carries the bucket metadata too.
+type Database struct {
+	Name        string
+	ID          string
+	OrgID       string
+	Description string
+	// RetentionPeriod is how long points are kept. Zero keeps them forever.
+	RetentionPeriod time.Duration
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// DatabaseUpdate lists the catalog fields to change. Nil fields are kept.
+type DatabaseUpdate struct {
+	Name            *string
+	Description     *string
+	RetentionPeriod *time.Duration
+}
+
+const databaseColumns = `name, id, org_id, description, retention_period, created_at, updated_at`
+
+func scanDatabase(row interface{ Scan(...interface{}) error }) (Database, error) {
+	var d Database
+	var retention, created, updated int64
+	if err := row.Scan(&d.Name, &d.ID, &d.OrgID, &d.Description, &retention, &created, &updated); err != nil {
+		return Database{}, err
+	}
+	d.RetentionPeriod = time.Duration(retention)
+	d.CreatedAt = time.Unix(0, created).UTC()
+	d.UpdatedAt = time.Unix(0, updated).UTC()
+	return d, nil
+}
+
+// Databases returns the catalog entry of every database, sorted by name
+func (m *Manager) Databases() ([]Database, error) {
+	rows, err := m.db.Query(`SELECT ` + databaseColumns + ` FROM databases ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+	defer rows.Close()
+
+	var databases []Database
+	for rows.Next() {
+		d, err := scanDatabase(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		databases = append(databases, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return databases, nil
+}
+
+// GetDatabase returns the catalog entry of the named database
+func (m *Manager) GetDatabase(name string) (Database, error) {
+	return m.getDatabase(`name = ?`, name)
+}
+
+// GetDatabaseByID returns the catalog entry of the database with the given ID
+func (m *Manager) GetDatabaseByID(id string) (Database, error) {
+	return m.getDatabase(`id = ?`, id)
+}
+
+func (m *Manager) getDatabase(where string, arg string) (Database, error) {
+	d, err := scanDatabase(m.db.QueryRow(`SELECT `+databaseColumns+` FROM databases WHERE `+where, arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Database{}, ErrDatabaseNotFound
+	}
+	if err != nil {
+		return Database{}, fmt.Errorf("failed to look up database %s: %w", arg, err)
+	}
+	return d, nil
+}
+
+// AddDatabase creates a database from a catalog entry and returns the
+// stored entry with its generated ID and timestamps. Unlike CreateDatabase
+// it fails with ErrDatabaseExists when the name is taken. An empty OrgID
+// assigns the database to the default organization.
+func (m *Manager) AddDatabase(d Database) (Database, error) {
+	if d.Name == "" {
+		return Database{}, fmt.Errorf("database name is required")
+	}
+
+	m.mu.Lock()
+	if d.OrgID == "" {
+		d.OrgID = m.defaultOrgID
+	}
+	now := time.Now().UnixNano()
+	res, err := m.db.Exec(`INSERT OR IGNORE INTO databases (name, id, org_id, description, retention_period, created_at, updated_at)
+		VALUES (?, lower(hex(randomblob(8))), ?, ?, ?, ?, ?)`,
+		d.Name, d.OrgID, d.Description, int64(d.RetentionPeriod), now, now)
+	m.mu.Unlock()
+	if err != nil {
+		return Database{}, fmt.Errorf("failed to create database %s: %w", d.Name, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Database{}, ErrDatabaseExists
+	}
+	return m.GetDatabase(d.Name)
+}
+
+// UpdateDatabase changes the catalog entry of the database with the given
+// ID. Shards belong to the database ID, so renaming keeps the points.
+func (m *Manager) UpdateDatabase(id string, update DatabaseUpdate) (Database, error) {
+	current, err := m.GetDatabaseByID(id)
+	if err != nil {
+		return Database{}, err
+	}
+
+	m.mu.Lock()
+	err = m.updateDatabase(current, update)
+	m.mu.Unlock()
+	if err != nil {
+		return Database{}, err
+	}
+	return m.GetDatabaseByID(id)
+}
+
+func (m *Manager) updateDatabase(current Database, update DatabaseUpdate) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	next := current
+	if update.Name != nil && *update.Name != current.Name {
+		if *update.Name == "" {
+			return fmt.Errorf("database name is required")
+		}
+		var taken bool
+		if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM databases WHERE name = ?)`, *update.Name).Scan(&taken); err != nil {
+			return fmt.Errorf("failed to look up database %s: %w", *update.Name, err)
+		}
+		if taken {
+			return ErrDatabaseExists
+		}
+		next.Name = *update.Name
+		// The state cache, series index and write statistics are keyed by
+		// database name
+		defer m.state.reset()
+		defer m.bounds.reset()
+		defer m.hours.reset()
+		defer m.seriesIndex.reset()
+		defer m.writeStats.forget(current.Name)
+	}
+	if update.Description != nil {
+		next.Description = *update.Description
+	}
+	if update.RetentionPeriod != nil {
+		next.RetentionPeriod = *update.RetentionPeriod
+	}
+
+	_, err = tx.Exec(`UPDATE databases SET name = ?, description = ?, retention_period = ?, updated_at = ? WHERE id = ?`,
+		next.Name, next.Description, int64(next.RetentionPeriod), time.Now().UnixNano(), current.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update database %s: %w", current.Name, err)
+	}
+	return tx.Commit()
+}
+
+// DeleteBefore removes every point of a database older than ts and returns
+// how many were deleted. Shards entirely older than ts are dropped whole,
+// along with their copy in object storage once tiered.
+func (m *Manager) DeleteBefore(database string, ts time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, ok, err := m.databaseID(nil, database)
+	if err != nil || !ok {
+		return 0, err
+	}
+	cutoff := ts.UnixNano()
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var deleted int64
+	dropped := make(map[int64]bool)
+	var tiered []shard
+	for _, s := range m.shards.overlapping(id, math.MinInt64, cutoff-1) {
+		if s.end <= cutoff {
+			n, err := countPoints(tx, s)
+			if err != nil {
+				return 0, err
+			}
+			if err := dropShard(tx, s); err != nil {
+				return 0, err
+			}
+			dropped[s.id] = true
+			if s.object != "" {
+				tiered = append(tiered, s)
+			}
+			deleted += n
+			continue
+		}
+		res, err := tx.Exec(`DELETE FROM `+s.table()+` WHERE timestamp < ?`, cutoff)
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete points of database %s: %w", database, err)
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+		// The blocks of a tiered shard expire with the whole shard, rather
+		// than being downloaded to be trimmed
+		if s.packed && s.object == "" {
+			if n, err = trimBlocks(tx, s, cutoff); err != nil {
+				return 0, fmt.Errorf("failed to delete points of database %s: %w", database, err)
+			}
+			deleted += n
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit delete: %w", err)
+	}
+	m.shards.remove(id, dropped)
+	m.forgetObjects(tiered)
+	if deleted > 0 {
+		m.state.reset()
+		m.bounds.reset()
+		m.hours.reset()
+	}
+	return deleted, nil
+}
+
+// DeleteRange removes the points of a database timestamped from start to
+// end, inclusive, that belong to the series of measurement, or of every
+// measurement when it is empty, and carry every tag of tags. An empty tag
+// value matches the series without the tag, as in queries. It returns how
+// many points were deleted. Series left without points are removed from
+// the series dictionary, so their tag values are gone too. Tiered shards
+// holding points to delete are copied back to the database file first.
+func (m *Manager) DeleteRange(database string, start, end int64, measurement string, tags map[string]string) (int64, error) {
+	return m.DeleteRangeContext(context.Background(), database, start, end, measurement, tags)
+}
+
+// DeleteRangeContext is DeleteRange giving up once ctx is done, in which
+// case no point is deleted
+func (m *Manager) DeleteRangeContext(ctx context.Context, database string, start, end int64, measurement string, tags map[string]string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, ok, err := m.databaseID(nil, database)
+	if err != nil || !ok {
+		return 0, classify(err)
+	}
+	deleted, err := m.deleteRange(ctx, id, database, start, end, measurement, tags)
+	return deleted, classify(err)
+}
+
+// deleteRange is DeleteRange on the database of ID id, first restoring
+// the tiered shards holding points to delete. The caller must hold m.mu.
+func (m *Manager) deleteRange(ctx context.Context, id, database string, start, end int64, measurement string, tags map[string]string) (int64, error) {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	series, err := matchingSeries(tx, id, measurement, tags)
+	if err != nil || len(series) == 0 {
+		return 0, err
+	}
+	tiered, err := tieredBlocks(tx, m.shards.overlapping(id, start, end), series, start, end)
+	if err != nil {
+		return 0, err
+	}
+	if len(tiered) > 0 {
+		tx.Rollback()
+		if err := m.restoreShards(ctx, id, tiered); err != nil {
+			return 0, err
+		}
+		return m.deleteRange(ctx, id, database, start, end, measurement, tags)
+	}
+
+	var deleted int64
+	for _, s := range m.shards.overlapping(id, start, end) {
+		for _, chunk := range seriesChunks(series) {
+			in, args := inList(chunk)
+			res, err := tx.ExecContext(ctx, `DELETE FROM `+s.table()+` WHERE series_id IN (`+in+`) AND timestamp >= ? AND timestamp <= ?`, append(args, start, end)...)
+			if err != nil {
+				return 0, fmt.Errorf("failed to delete points of database %s: %w", database, err)
+			}
+			n, _ := res.RowsAffected()
+			deleted += n
+		}
+		if s.packed {
+			n, err := deleteBlocks(tx, s, series, start, end)
+			if err != nil {
+				return 0, fmt.Errorf("failed to delete points of database %s: %w", database, err)
+			}
+			deleted += n
+		}
+	}
+
+	removed, err := dropEmptySeries(tx, m.shards.all()[id], series)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit delete: %w", err)
+	}
+	if removed > 0 {
+		m.seriesIDs = make(map[seriesRef]int64)
+	}
+	if deleted > 0 {
+		m.state.reset()
+		m.bounds.reset()
+		m.hours.reset()
+	}
+	return deleted, nil
+}
+
+// matchingSeries returns the IDs of the series of a database matching
+// measurement and tags as described by DeleteRange
+func matchingSeries(tx *sql.Tx, databaseID, measurement string, tags map[string]string) ([]int64, error) {
+	query := `SELECT id, tags FROM series WHERE database_id = ?`
+	args := []interface{}{databaseID}
+	if measurement != "" {
+		query += ` AND measurement = ?`
+		args = append(args, measurement)
+	}
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list series: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		var tagsJSON string
+		if err := rows.Scan(&id, &tagsJSON); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		var stored map[string]string
+		if err := json.Unmarshal([]byte(tagsJSON), &stored); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal tags: %w", err)
+		}
+		matches := true
+		for k, v := range tags {
+			if stored[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			ids = append(ids, id)
+		}
+	}
+	return ids, rows.Err()
+}
+
+// dropEmptySeries removes from the series dictionary the series of ids
+// holding no point in shards, and returns how many were removed
+func dropEmptySeries(tx *sql.Tx, shards []shard, ids []int64) (int, error) {
+	kept := make(map[int64]bool)
+	for _, s := range shards {
+		tables := []string{s.table()}
+		if s.packed {
+			tables = append(tables, s.blocksTable())
+		}
+		for _, table := range tables {
+			for _, chunk := range seriesChunks(ids) {
+				in, args := inList(chunk)
+				found, err := queryInt64s(tx, `SELECT DISTINCT series_id FROM `+table+` WHERE series_id IN (`+in+`)`, args...)
+				if err != nil {
+					return 0, fmt.Errorf("failed to inspect shard %s: %w", s.table(), err)
+				}
+				for _, id := range found {
+					kept[id] = true
+				}
+			}
+		}
+	}
+
+	removed := 0
+	for _, id := range ids {
+		if kept[id] {
+			continue
+		}
+		if _, err := tx.Exec(`DELETE FROM series WHERE id = ?`, id); err != nil {
+			return 0, fmt.Errorf("failed to remove series %d: %w", id, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// seriesChunks splits series IDs into lists short enough to be bound to a
+// single statement
+func seriesChunks(ids []int64) [][]int64 {
+	const size = 500
+	var chunks [][]int64
+	for len(ids) > 0 {
+		n := min(size, len(ids))
+		chunks = append(chunks, ids[:n])
+		ids = ids[n:]
+	}
+	return chunks
+}
+
+// inList returns the placeholders and arguments of an IN list of ids
+func inList(ids []int64) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return "?" + strings.Repeat(", ?", len(ids)-1), args
+}
+
+// EnforceRetention deletes the points that fell out of the retention
+// period of their database, drops the shards left empty, packs the ended
+// shards when the columnar engine is enabled and returns how many points
+// were deleted
+func (m *Manager) EnforceRetention(now time.Time) (int64, error) {
+	databases, err := m.Databases()
+	if err != nil {
+		return 0, err
+	}
+	return m.enforceRetention(now, databases)
+}
+
+// enforceRetention is EnforceRetention with the retention periods of
+// databases, which come from the catalog for the file of a tenant
+func (m *Manager) enforceRetention(now time.Time, databases []Database) (int64, error) {
+	var total int64
+	for _, d := range databases {
+		if d.RetentionPeriod <= 0 {
+			continue
+		}
+		n, err := m.DeleteBefore(d.Name, now.Add(-d.RetentionPeriod))
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	if total > 0 {
+		pointsExpired.Add(uint64(total))
+	}
+
+	if _, err := m.CompactShards(); err != nil {
+		return total, err
+	}
+	if m.columnar {
+		if _, err := m.PackShards(now); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// RunRetention enforces retention every interval until ctx is done
+func (m *Manager) RunRetention(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := m.EnforceRetention(now)
+			if err != nil {
+				log.Errorf("Failed to enforce retention: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Infof("Retention deleted %d expired points", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	compactions    = metrics.NewCounter("refluxdb_storage_compactions_total", "Storage compactions run")
+	bytesReclaimed = metrics.NewCounter("refluxdb_storage_compaction_reclaimed_bytes_total", "Bytes of free pages returned to the file system by storage compactions")
+	freeBytes      = metrics.NewGauge("refluxdb_storage_free_bytes", "Size of the free pages of the database file after the latest compaction")
+)
+
+// autoVacuumIncremental is the auto_vacuum mode letting incremental_vacuum
+// release free pages
+const autoVacuumIncremental = 2
+
+// compactionCheck is how often the compaction schedule is checked
+const compactionCheck = time.Minute
+
+// CompactOptions tunes a compaction
+type CompactOptions struct {
+	// Full rebuilds the database file with VACUUM, which also defragments
+	// the tables but needs as much free disk space as the file. Files
+	// created before incremental auto vacuum was enabled always get a
+	// full compaction, which enables it.
+	Full bool
+	// MaxPages bounds the free pages released by an incremental
+	// compaction, every free page when zero
+	MaxPages int
+}
+
+// Compaction reports what a compaction did
+type Compaction struct {
+	Full bool
+	// SizeBefore and SizeAfter are the size of the database file, and
+	// FreeBefore and FreeAfter that of its free pages, in bytes
+	SizeBefore int64
+	SizeAfter  int64
+	FreeBefore int64
+	FreeAfter  int64
+	Duration   time.Duration
+}
+
+// Reclaimed returns the bytes returned to the file system
+func (c Compaction) Reclaimed() int64 {
+	return max(c.SizeBefore-c.SizeAfter, 0)
+}
+
+// Compact releases the free pages left by deleted and expired points to
+// the file system and refreshes the query planner statistics. Writers are
+// held off while it runs.
+func (m *Manager) Compact(ctx context.Context, opts CompactOptions) (Compaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	start := time.Now()
+	// Pragmas apply to their connection, so every statement runs on one
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return Compaction{}, fmt.Errorf("failed to open connection: %w", err)
+	}
+	defer conn.Close()
+
+	var c Compaction
+	if c.SizeBefore, c.FreeBefore, err = pageUsage(ctx, conn); err != nil {
+		return Compaction{}, err
+	}
+	var mode int
+	if err := conn.QueryRowContext(ctx, `PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		return Compaction{}, fmt.Errorf("failed to read auto vacuum mode: %w", err)
+	}
+
+	c.Full = opts.Full || mode != autoVacuumIncremental
+	if c.Full {
+		if _, err := conn.ExecContext(ctx, `PRAGMA auto_vacuum = INCREMENTAL`); err != nil {
+			return Compaction{}, fmt.Errorf("failed to enable incremental vacuum: %w", err)
+		}
+		if _, err := conn.ExecContext(ctx, `VACUUM`); err != nil {
+			return Compaction{}, fmt.Errorf("failed to vacuum database: %w", err)
+		}
+	} else {
+		query := `PRAGMA incremental_vacuum`
+		if opts.MaxPages > 0 {
+			query += fmt.Sprintf(`(%d)`, opts.MaxPages)
+		}
+		// Every step of the statement releases one page, so it is read to
+		// the end rather than executed
+		rows, err := conn.QueryContext(ctx, query)
+		if err != nil {
+			return Compaction{}, fmt.Errorf("failed to vacuum database: %w", err)
+		}
+		for rows.Next() {
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return Compaction{}, fmt.Errorf("failed to vacuum database: %w", err)
+		}
+	}
+	if err := optimize(ctx, conn); err != nil {
+		return Compaction{}, err
+	}
+
+	if c.SizeAfter, c.FreeAfter, err = pageUsage(ctx, conn); err != nil {
+		return Compaction{}, err
+	}
+	c.Duration = time.Since(start)
+	compactions.Inc()
+	bytesReclaimed.Add(uint64(c.Reclaimed()))
+	freeBytes.Set(float64(c.FreeAfter))
+	return c, nil
+}
+
+// optimize refreshes the query planner statistics and, in WAL mode,
+// truncates the write-ahead log so the file system gets its space back
+func optimize(ctx context.Context, conn interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+}) error {
+	if _, err := conn.ExecContext(ctx, `PRAGMA optimize`); err != nil {
+		return fmt.Errorf("failed to optimize database: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return fmt.Errorf("failed to checkpoint database: %w", err)
+	}
+	return nil
+}
+
+// pageUsage returns the size of the database file and of its free pages
+func pageUsage(ctx context.Context, conn *sql.Conn) (size, free int64, err error) {
+	var pages, freePages, pageSize int64
+	if err := conn.QueryRowContext(ctx, `PRAGMA page_count`).Scan(&pages); err != nil {
+		return 0, 0, fmt.Errorf("failed to read page count: %w", err)
+	}
+	if err := conn.QueryRowContext(ctx, `PRAGMA freelist_count`).Scan(&freePages); err != nil {
+		return 0, 0, fmt.Errorf("failed to read free pages: %w", err)
+	}
+	if err := conn.QueryRowContext(ctx, `PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return 0, 0, fmt.Errorf("failed to read page size: %w", err)
+	}
+	return pages * pageSize, freePages * pageSize, nil
+}
+
+// QuietHours is a daily window of local time, such as 02:00-05:00, as
+// offsets from midnight. A window ending before it starts spans midnight.
+type QuietHours struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseQuietHours parses a window written as HH:MM-HH:MM
+func ParseQuietHours(s string) (QuietHours, error) {
+	var q QuietHours
+	var startH, startM, endH, endM int
+	n, err := fmt.Sscanf(s, "%d:%d-%d:%d", &startH, &startM, &endH, &endM)
+	if err != nil || n != 4 || !validClock(startH, startM) || !validClock(endH, endM) {
+		return q, fmt.Errorf("invalid quiet hours %q: expected HH:MM-HH:MM", s)
+	}
+	q.Start = time.Duration(startH)*time.Hour + time.Duration(startM)*time.Minute
+	q.End = time.Duration(endH)*time.Hour + time.Duration(endM)*time.Minute
+	if q.Start == q.End {
+		return q, fmt.Errorf("invalid quiet hours %q: the window is empty", s)
+	}
+	return q, nil
+}
+
+func validClock(hour, minute int) bool {
+	return hour >= 0 && hour < 24 && minute >= 0 && minute < 60
+}
+
+// Contains reports whether t, in its location, falls within the window
+func (q QuietHours) Contains(t time.Time) bool {
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if q.Start < q.End {
+		return offset >= q.Start && offset < q.End
+	}
+	return offset >= q.Start || offset < q.End
+}
+
+// String returns the window as HH:MM-HH:MM
+func (q QuietHours) String() string {
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return clock(q.Start) + "-" + clock(q.End)
+}
+
+// CompactionSchedule configures the compactions run by RunCompactions
+type CompactionSchedule struct {
+	// QuietHours is the daily window, in local time, during which the
+	// storage is compacted once
+	QuietHours QuietHours
+	// MinFreeRatio skips the vacuum while the free pages are a smaller
+	// fraction of the database file, only refreshing the planner
+	// statistics
+	MinFreeRatio float64
+	// MaxPages bounds the free pages released by each compaction, every
+	// free page when zero
+	MaxPages int
+}
+
+// RunCompactions compacts the storage once in every quiet hours window of
+// schedule until ctx is done
+func (m *Manager) RunCompactions(ctx context.Context, schedule CompactionSchedule) {
+	ticker := time.NewTicker(compactionCheck)
+	defer ticker.Stop()
+
+	done := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !schedule.QuietHours.Contains(now) {
+				done = false
+				continue
+			}
+			if done {
+				continue
+			}
+			done = true
+			if err := m.scheduledCompaction(ctx, schedule); err != nil && ctx.Err() == nil {
+				log.Errorf("Failed to compact storage: %v", err)
+			}
+		}
+	}
+}
+
+// scheduledCompaction compacts the storage when enough of it is free, and
+// only optimizes it otherwise
+func (m *Manager) scheduledCompaction(ctx context.Context, schedule CompactionSchedule) error {
+	size, err := m.Size()
+	if err != nil {
+		return err
+	}
+	var freePages, pageSize int64
+	if err := m.db.QueryRowContext(ctx, `PRAGMA freelist_count`).Scan(&freePages); err != nil {
+		return fmt.Errorf("failed to read free pages: %w", err)
+	}
+	if err := m.db.QueryRowContext(ctx, `PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return fmt.Errorf("failed to read page size: %w", err)
+	}
+	if size == 0 || float64(freePages*pageSize)/float64(size) < schedule.MinFreeRatio {
+		freeBytes.Set(float64(freePages * pageSize))
+		return optimize(ctx, m.db)
+	}
+
+	c, err := m.Compact(ctx, CompactOptions{MaxPages: schedule.MaxPages})
+	if err != nil {
+		return err
+	}
+	log.Infof("Compacted storage in %s: %d bytes reclaimed, %d bytes still free", c.Duration.Round(time.Millisecond), c.Reclaimed(), c.FreeAfter)
+	return nil
+}
@@ -0,0 +1,155 @@
+package persistence
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+)
+
+// DeadLetter is a line dropped by the write path, kept so that it can be
+// inspected, corrected and replayed
+type DeadLetter struct {
+	ID   int64
+	Time time.Time
+	// Database is the database the line was written to
+	Database string
+	// Source is the address of the client that sent the line
+	Source string
+	// Precision is the unit of the timestamp of the line
+	Precision time.Duration
+	Line      string
+	// Error is why the line was dropped
+	Error string
+}
+
+// DeadLetterFilter selects dead letters. Zero values select everything.
+type DeadLetterFilter struct {
+	Database string
+	Since    time.Time
+	// Limit bounds the number of dead letters returned when positive
+	Limit int
+}
+
+// RecordDeadLetters stores letters, then removes the oldest dead letters
+// so that at most max are kept. A zero Time is set to now.
+func (m *Manager) RecordDeadLetters(letters []DeadLetter, max int) error {
+	if len(letters) == 0 {
+		return nil
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(`INSERT INTO dead_letters (time, database, source, precision, line, error) VALUES (?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+	var last int64
+	for _, l := range letters {
+		if l.Time.IsZero() {
+			l.Time = now
+		}
+		res, err := stmt.Exec(l.Time.UnixNano(), l.Database, l.Source, int64(l.Precision), l.Line, l.Error)
+		if err != nil {
+			return fmt.Errorf("failed to record dead letter: %w", err)
+		}
+		if last, err = res.LastInsertId(); err != nil {
+			return fmt.Errorf("failed to record dead letter: %w", err)
+		}
+	}
+	// IDs only grow, so the newest max letters have IDs above last - max
+	if _, err := tx.Exec(`DELETE FROM dead_letters WHERE id <= ?`, last-int64(max)); err != nil {
+		return fmt.Errorf("failed to trim dead letters: %w", err)
+	}
+	return tx.Commit()
+}
+
+// DeadLetters returns the dead letters selected by f, oldest first
+func (m *Manager) DeadLetters(f DeadLetterFilter) ([]DeadLetter, error) {
+	limit := f.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	from := int64(math.MinInt64)
+	if !f.Since.IsZero() {
+		from = f.Since.UnixNano()
+	}
+	rows, err := m.db.Query(`SELECT id, time, database, source, precision, line, error FROM dead_letters
+		WHERE time >= ? AND (? = '' OR database = ?) ORDER BY id LIMIT ?`, from, f.Database, f.Database, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+	defer rows.Close()
+
+	var letters []DeadLetter
+	for rows.Next() {
+		var l DeadLetter
+		var t, precision int64
+		if err := rows.Scan(&l.ID, &t, &l.Database, &l.Source, &precision, &l.Line, &l.Error); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		l.Time = time.Unix(0, t).UTC()
+		l.Precision = time.Duration(precision)
+		letters = append(letters, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return letters, nil
+}
+
+// DeadLetter returns the dead letter id, and false when there is none
+func (m *Manager) DeadLetter(id int64) (DeadLetter, bool, error) {
+	var l DeadLetter
+	var t, precision int64
+	err := m.db.QueryRow(`SELECT id, time, database, source, precision, line, error FROM dead_letters WHERE id = ?`, id).
+		Scan(&l.ID, &t, &l.Database, &l.Source, &precision, &l.Line, &l.Error)
+	if err == sql.ErrNoRows {
+		return DeadLetter{}, false, nil
+	}
+	if err != nil {
+		return DeadLetter{}, false, fmt.Errorf("failed to read dead letter: %w", err)
+	}
+	l.Time = time.Unix(0, t).UTC()
+	l.Precision = time.Duration(precision)
+	return l, true, nil
+}
+
+// DeleteDeadLetters removes the dead letters selected by f, every one of
+// them when ids is empty or those of ids otherwise, and returns how many
+// were removed. The Limit of f is ignored.
+func (m *Manager) DeleteDeadLetters(f DeadLetterFilter, ids []int64) (int64, error) {
+	from := int64(math.MinInt64)
+	if !f.Since.IsZero() {
+		from = f.Since.UnixNano()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	query := `DELETE FROM dead_letters WHERE time >= ? AND (? = '' OR database = ?)`
+	if len(ids) == 0 {
+		res, err := m.db.Exec(query, from, f.Database, f.Database)
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete dead letters: %w", err)
+		}
+		return res.RowsAffected()
+	}
+	var deleted int64
+	for _, chunk := range seriesChunks(ids) {
+		in, args := inList(chunk)
+		res, err := m.db.Exec(query+` AND id IN (`+in+`)`, append([]interface{}{from, f.Database, f.Database}, args...)...)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete dead letters: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+	return deleted, nil
+}
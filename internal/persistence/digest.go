@@ -0,0 +1,68 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/gleicon/go-refluxdb/internal/tdigest"
+)
+
+// FieldDigest summarizes the values of a field within a time bucket
+type FieldDigest struct {
+	// Start is the start of the bucket, in nanoseconds
+	Start  int64
+	Digest *tdigest.TDigest
+}
+
+// DigestRange returns t-digests of the values of field in measurement
+// within [start, end], one per bucket of interval nanoseconds aligned on
+// the epoch, or a single one starting at start when interval is zero.
+// Buckets without values are left out.
+//
+// Points are added to the digest of their bucket as the shards are
+// scanned, so only the digests are kept in memory: percentiles of
+// arbitrarily large ranges cost memory in proportion to the number of
+// buckets, not of points. The scan stops once ctx is done, in which case
+// the returned error wraps ctx.Err().
+func (m *Manager) DigestRange(ctx context.Context, database, measurement, field string, start, end, interval int64) ([]FieldDigest, error) {
+	var bucket func(int64) int64
+	if interval > 0 {
+		bucket = func(ts int64) int64 { return ts - ts%interval }
+	}
+	return m.DigestRangeFilter(ctx, database, measurement, field, start, end, bucket, nil)
+}
+
+// DigestRangeFilter is DigestRange over the points for which keep returns
+// true, or all of them when keep is nil, with bucket returning the start
+// of the bucket of a timestamp, or a single bucket when bucket is nil
+func (m *Manager) DigestRangeFilter(ctx context.Context, database, measurement, field string, start, end int64, bucket func(int64) int64, keep func(Point) bool) ([]FieldDigest, error) {
+	buckets := make(map[int64]*tdigest.TDigest)
+	err := m.queryShards(ctx, database, measurement, start, end, func(p Point) error {
+		v, ok := p.Fields[field]
+		if !ok || (keep != nil && !keep(p)) {
+			return nil
+		}
+		from := start
+		if bucket != nil {
+			from = bucket(p.Timestamp)
+		}
+		d, ok := buckets[from]
+		if !ok {
+			d = tdigest.New(tdigest.DefaultCompression)
+			buckets[from] = d
+		}
+		d.Add(v)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query measurements: %w", err)
+	}
+
+	digests := make([]FieldDigest, 0, len(buckets))
+	for bucket, d := range buckets {
+		digests = append(digests, FieldDigest{Start: bucket, Digest: d})
+	}
+	sort.Slice(digests, func(i, j int) bool { return digests[i].Start < digests[j].Start })
+	return digests, nil
+}
@@ -0,0 +1,115 @@
+package persistence
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	fsyncs      = metrics.NewCounter("refluxdb_storage_fsyncs_total", "Periodic flushes of the database files to disk")
+	fsyncErrors = metrics.NewCounter("refluxdb_storage_fsync_errors_total", "Periodic flushes of the database files that failed")
+)
+
+// Sync flushes the database file and its write-ahead log to disk, so that
+// every transaction committed so far survives a power loss. It does
+// nothing for in-memory databases.
+func (m *Manager) Sync() error {
+	if isMemory(m.path) {
+		return nil
+	}
+	path := filePath(m.path)
+	for _, p := range []string{path, path + "-wal"} {
+		if err := syncFile(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checkpoint moves the transactions of the write-ahead log into the
+// database file and flushes both to disk, so that the file alone holds
+// every transaction committed so far. It does nothing for in-memory
+// databases.
+func (m *Manager) Checkpoint() error {
+	if isMemory(m.path) {
+		return nil
+	}
+	// Readers still in the log keep it from being truncated, which only
+	// costs space: the transactions are in the file either way
+	if _, err := m.db.Exec(`PRAGMA wal_checkpoint(TRUNCATE)`); err != nil {
+		return classify(fmt.Errorf("failed to checkpoint: %w", err))
+	}
+	return m.Sync()
+}
+
+// syncFile flushes a file to disk, if it exists
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	// Files this process cannot write hold none of its writes
+	if os.IsNotExist(err) || os.IsPermission(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer f.Close()
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", path, err)
+	}
+	return nil
+}
+
+// filePath returns the file of a database path, which may be a URI such
+// as file:refluxdb.db?mode=ro
+func filePath(path string) string {
+	if p, ok := strings.CutPrefix(path, "file:"); ok {
+		p, _, _ = strings.Cut(p, "?")
+		return p
+	}
+	return path
+}
+
+// syncer flushes the files of a Manager every interval until stopped, for
+// DurabilityPeriodic
+type syncer struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func (m *Manager) startSyncer(interval time.Duration) *syncer {
+	s := &syncer{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				fsyncs.Inc()
+				if err := m.Sync(); err != nil {
+					fsyncErrors.Inc()
+					log.Errorf("Failed to flush storage to disk: %v", err)
+				}
+			}
+		}
+	}()
+	return s
+}
+
+// close stops the syncer, waiting for a flush in progress
+func (s *syncer) close() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() { close(s.stop) })
+	<-s.done
+}
@@ -0,0 +1,74 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Classes of the errors returned by the Manager, for callers to tell them
+// apart with errors.Is without knowing every specific error, as HTTP
+// handlers do to pick a status code
+var (
+	// ErrNotFound is matched by the errors of things that do not exist,
+	// such as ErrDatabaseNotFound
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is matched by the errors of things that already exist,
+	// such as ErrDatabaseExists
+	ErrConflict = errors.New("conflict")
+	// ErrTimeout is matched by the errors of operations that gave up
+	// waiting, for a lock held by another connection or past the deadline
+	// of their context. They may succeed when retried.
+	ErrTimeout = errors.New("timeout")
+)
+
+// classError is a specific error belonging to a class such as ErrNotFound
+type classError struct {
+	msg   string
+	class error
+}
+
+func newClassError(msg string, class error) error {
+	return &classError{msg: msg, class: class}
+}
+
+func (e *classError) Error() string {
+	return e.msg
+}
+
+func (e *classError) Is(target error) bool {
+	return target == e.class
+}
+
+// timeoutError is an error that matches ErrTimeout, keeping its cause
+type timeoutError struct {
+	err error
+}
+
+func (e *timeoutError) Error() string {
+	return e.err.Error()
+}
+
+func (e *timeoutError) Unwrap() error {
+	return e.err
+}
+
+func (e *timeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// classify makes err match ErrTimeout when SQLite gave up on a lock, with
+// "database is locked" once the busy timeout elapsed, or the deadline of
+// the context was exceeded. Other errors are returned unchanged.
+func classify(err error) error {
+	if err == nil || errors.Is(err, ErrTimeout) {
+		return err
+	}
+	var sqliteErr sqlite3.Error
+	if errors.Is(err, context.DeadlineExceeded) ||
+		errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked) {
+		return &timeoutError{err: err}
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package persistence
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdMagic starts every zstd frame. JSON objects start with '{', so
+// compressed and plain field sets can be told apart.
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+var (
+	fieldEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	fieldDecoder, _ = zstd.NewReader(nil)
+)
+
+// encodeFields returns the stored form of a field set: JSON text, or a
+// zstd compressed BLOB when compress is set and compression makes it
+// smaller. Small field sets are usually kept as text.
+func encodeFields(fields map[string]float64, compress bool) (interface{}, error) {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal fields: %w", err)
+	}
+	if compress {
+		if compressed := fieldEncoder.EncodeAll(data, nil); len(compressed) < len(data) {
+			return compressed, nil
+		}
+	}
+	return string(data), nil
+}
+
+// decodeFields decodes a field set stored by encodeFields
+func decodeFields(data []byte) (map[string]float64, error) {
+	if bytes.HasPrefix(data, zstdMagic) {
+		var err error
+		if data, err = fieldDecoder.DecodeAll(data, nil); err != nil {
+			return nil, fmt.Errorf("failed to decompress fields: %w", err)
+		}
+	}
+	var fields map[string]float64
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal fields: %w", err)
+	}
+	return fields, nil
+}
+
+// RecompressFields re-encodes the field sets of every stored point,
+// compressing them when compress is set and restoring JSON text otherwise,
+// and returns how many points were rewritten. Shards are converted one
+// transaction at a time. New writes follow the CompressFields option.
+func (m *Manager) RecompressFields(compress bool) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rows, err := m.db.Query(`SELECT id FROM shards ORDER BY id`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list shards: %w", err)
+	}
+	var shards []shard
+	for rows.Next() {
+		var s shard
+		if err := rows.Scan(&s.id); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan row: %w", err)
+		}
+		shards = append(shards, s)
+	}
+	rows.Close()
+
+	var total int64
+	for _, s := range shards {
+		n, err := recompressShard(m.db, s, compress)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// recompressShard re-encodes the field sets of one shard
+func recompressShard(db *sql.DB, s shard, compress bool) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	type row struct {
+		seriesID, timestamp int64
+		fields              interface{}
+	}
+	rows, err := tx.Query(`SELECT series_id, timestamp, fields FROM ` + s.table())
+	if err != nil {
+		return 0, fmt.Errorf("failed to read shard %s: %w", s.table(), err)
+	}
+	var changed []row
+	for rows.Next() {
+		var r row
+		var stored []byte
+		if err := rows.Scan(&r.seriesID, &r.timestamp, &stored); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if bytes.HasPrefix(stored, zstdMagic) == compress {
+			continue
+		}
+		fields, err := decodeFields(stored)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if r.fields, err = encodeFields(fields, compress); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		// Field sets that do not shrink stay as text
+		if _, text := r.fields.(string); compress && text {
+			continue
+		}
+		changed = append(changed, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`UPDATE ` + s.table() + ` SET fields = ? WHERE series_id = ? AND timestamp = ?`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prepare update: %w", err)
+	}
+	defer stmt.Close()
+	for _, r := range changed {
+		if _, err := stmt.Exec(r.fields, r.seriesID, r.timestamp); err != nil {
+			return 0, fmt.Errorf("failed to rewrite point: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit shard %s: %w", s.table(), err)
+	}
+	return int64(len(changed)), nil
+}
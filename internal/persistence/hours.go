@@ -0,0 +1,181 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// HourCount is the number of points of a measurement within the hour
+// starting at Start, in nanoseconds
+type HourCount struct {
+	Start  int64
+	Points int64
+}
+
+// hourOf returns the start of the UTC hour holding ts
+func hourOf(ts int64) int64 {
+	r := ts % int64(time.Hour)
+	if r < 0 {
+		r += int64(time.Hour)
+	}
+	return ts - r
+}
+
+// hourIndex keeps the number of points of every hour of the measurements
+// queried so far, so that aggregations skip the hours without points and
+// size their buckets. A measurement is loaded from storage on its first
+// query and then extended by writes. Points written again at the same
+// time are counted again, so counts are upper bounds until the
+// measurement is loaded again. Deletes reset the index.
+type hourIndex struct {
+	mu    sync.Mutex
+	hours map[measurementRef]map[int64]int64
+	// version changes with every write and reset, so that counts loaded
+	// while points were written are not kept
+	version uint64
+}
+
+func newHourIndex() *hourIndex {
+	return &hourIndex{hours: make(map[measurementRef]map[int64]int64)}
+}
+
+// observe counts the points of the loaded measurements
+func (x *hourIndex) observe(points []Point) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.version++
+	if len(x.hours) == 0 {
+		return
+	}
+	for _, p := range points {
+		ref := measurementRef{database: p.Database, measurement: p.Measurement}
+		if ref.database == "" {
+			ref.database = DefaultDatabase
+		}
+		if hours, ok := x.hours[ref]; ok {
+			hours[hourOf(p.Timestamp)]++
+		}
+	}
+}
+
+// get returns the counts of the hours of a loaded measurement within
+// [start, end], or the current version to store it with once loaded
+func (x *hourIndex) get(ref measurementRef, start, end int64) ([]HourCount, bool, uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	hours, ok := x.hours[ref]
+	if !ok {
+		return nil, false, x.version
+	}
+	return hourCounts(hours, start, end), true, x.version
+}
+
+// store keeps the counts of a measurement loaded at version, unless
+// points were written since
+func (x *hourIndex) store(ref measurementRef, hours map[int64]int64, version uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.version == version {
+		x.hours[ref] = hours
+	}
+}
+
+func (x *hourIndex) reset() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.version++
+	x.hours = make(map[measurementRef]map[int64]int64)
+}
+
+// hourCounts returns the hours overlapping [start, end] with points, in
+// time order
+func hourCounts(hours map[int64]int64, start, end int64) []HourCount {
+	var counts []HourCount
+	for hour, n := range hours {
+		if n > 0 && hour <= end && (hour > math.MaxInt64-int64(time.Hour) || hour+int64(time.Hour) > start) {
+			counts = append(counts, HourCount{Start: hour, Points: n})
+		}
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Start < counts[j].Start })
+	return counts
+}
+
+// HourCounts returns the number of points of a measurement in every hour
+// overlapping [start, end] that holds some, in time order. Hours are
+// counted whole, so the first and last ones may count points outside of
+// the range. The counts are kept in memory once read, so the measurement
+// is only scanned on its first call.
+func (m *Manager) HourCounts(ctx context.Context, database, measurement string, start, end int64) ([]HourCount, error) {
+	ref := measurementRef{database: database, measurement: measurement}
+	counts, ok, version := m.hours.get(ref, start, end)
+	if ok {
+		return counts, nil
+	}
+	hours, err := m.loadHours(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	m.hours.store(ref, hours, version)
+	return hourCounts(hours, start, end), nil
+}
+
+// loadHours counts the points of a measurement by hour. The rows of a
+// shard are counted by SQLite, while its blocks are decoded. Like
+// loadBounds, it does not hold off writers.
+func (m *Manager) loadHours(ctx context.Context, ref measurementRef) (map[int64]int64, error) {
+	hours := make(map[int64]int64)
+	id, ok, err := m.databaseID(nil, ref.database)
+	if err != nil || !ok {
+		return hours, err
+	}
+
+	for _, s := range m.shards.overlapping(id, math.MinInt64, math.MaxInt64) {
+		if s.packed {
+			err := m.queryShard(ctx, s, id, ref.database, []string{ref.measurement}, math.MinInt64, math.MaxInt64, func(p Point) error {
+				hours[hourOf(p.Timestamp)]++
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := m.shardHours(ctx, s, id, ref.measurement, hours); err != nil {
+			return nil, err
+		}
+	}
+	return hours, nil
+}
+
+// shardHours adds the rows of a measurement in a shard to hours, their
+// hour being computed by SQLite, whose % truncates towards zero
+func (m *Manager) shardHours(ctx context.Context, s shard, databaseID, measurement string, hours map[int64]int64) error {
+	hour := fmt.Sprint(int64(time.Hour))
+	query := `SELECT p.timestamp - ((p.timestamp % ` + hour + `) + ` + hour + `) % ` + hour + ` AS hour, COUNT(*)
+		FROM ` + s.table() + ` p JOIN series s ON s.id = p.series_id
+		WHERE s.database_id = ? AND s.measurement = ? GROUP BY hour`
+	rows, err := m.db.QueryContext(ctx, query, databaseID, measurement)
+	if isMissingTable(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to count points of %s: %w", measurement, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var start, n int64
+		if err := rows.Scan(&start, &n); err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		hours[start] += n
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+	return nil
+}
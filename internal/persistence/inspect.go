@@ -0,0 +1,213 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// MeasurementStats describes the points stored for a measurement
+type MeasurementStats struct {
+	Name string
+	// Series is the number of series registered for the measurement
+	Series int64
+	// Points counts stored rows and packed points. A point rewritten after
+	// its shard was packed is counted twice until the shard is packed again.
+	Points int64
+	// MinTime and MaxTime bound the timestamps of the points, in
+	// nanoseconds. They are zero when there are no points.
+	MinTime int64
+	MaxTime int64
+}
+
+// DatabaseStats describes the contents of a database
+type DatabaseStats struct {
+	Name         string
+	Shards       int
+	PackedShards int
+	// TieredShards counts the shards whose blocks are in object storage
+	TieredShards int
+	// Measurements are sorted by name
+	Measurements []MeasurementStats
+}
+
+// DiskUsage splits the size of the database file, in bytes. Data sizes
+// count the stored payloads, and Other covers indexes, the catalog and
+// page overhead.
+type DiskUsage struct {
+	Total int64
+	// Rows holds the fields of points stored one per row
+	Rows int64
+	// Blocks holds the points packed by the columnar engine
+	Blocks int64
+	// Series holds the series dictionary keys and tags
+	Series int64
+	// Free is the size of the pages left unused by deletes, reclaimed by
+	// VACUUM
+	Free  int64
+	Other int64
+}
+
+// Inspection is a summary of everything stored in the database
+type Inspection struct {
+	// Databases are sorted by name
+	Databases []DatabaseStats
+	Disk      DiskUsage
+}
+
+// Inspect reads the catalog, series dictionary and shards to summarize
+// what is stored. Writers are held off while it runs.
+func (m *Manager) Inspect(ctx context.Context) (Inspection, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	databases, err := m.Databases()
+	if err != nil {
+		return Inspection{}, err
+	}
+
+	var report Inspection
+	if report.Disk, err = m.diskUsage(ctx); err != nil {
+		return Inspection{}, err
+	}
+	all := m.shards.all()
+	for _, d := range databases {
+		stats := DatabaseStats{Name: d.Name, Shards: len(all[d.ID])}
+		measurements, err := m.seriesCounts(ctx, d.ID)
+		if err != nil {
+			return Inspection{}, err
+		}
+		for _, s := range all[d.ID] {
+			if s.packed {
+				stats.PackedShards++
+			}
+			if s.object != "" {
+				stats.TieredShards++
+			}
+			if err := m.countShard(ctx, s, d.ID, measurements); err != nil {
+				return Inspection{}, err
+			}
+		}
+
+		for _, ms := range measurements {
+			if ms.Points == 0 {
+				ms.MinTime, ms.MaxTime = 0, 0
+			}
+			stats.Measurements = append(stats.Measurements, *ms)
+		}
+		sort.Slice(stats.Measurements, func(i, j int) bool {
+			return stats.Measurements[i].Name < stats.Measurements[j].Name
+		})
+		report.Databases = append(report.Databases, stats)
+	}
+	return report, nil
+}
+
+// seriesCounts returns the measurements of a database with their number
+// of series, ready to accumulate the points of every shard
+func (m *Manager) seriesCounts(ctx context.Context, databaseID string) (map[string]*MeasurementStats, error) {
+	rows, err := m.db.QueryContext(ctx, `SELECT measurement, COUNT(*) FROM series WHERE database_id = ? GROUP BY measurement`, databaseID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count series: %w", err)
+	}
+	defer rows.Close()
+
+	measurements := make(map[string]*MeasurementStats)
+	for rows.Next() {
+		ms := &MeasurementStats{MinTime: math.MaxInt64, MaxTime: math.MinInt64}
+		if err := rows.Scan(&ms.Name, &ms.Series); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		measurements[ms.Name] = ms
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return measurements, nil
+}
+
+// countShard adds the points of shard s to the stats of their measurement
+func (m *Manager) countShard(ctx context.Context, s shard, databaseID string, measurements map[string]*MeasurementStats) error {
+	queries := []string{`
+		SELECT s.measurement, COUNT(*), MIN(p.timestamp), MAX(p.timestamp)
+		FROM ` + s.table() + ` p JOIN series s ON s.id = p.series_id
+		WHERE s.database_id = ? GROUP BY s.measurement`}
+	if s.packed {
+		queries = append(queries, `
+		SELECT s.measurement, SUM(b.count), MIN(b.min_time), MAX(b.max_time)
+		FROM `+s.blocksTable()+` b JOIN series s ON s.id = b.series_id
+		WHERE s.database_id = ? GROUP BY s.measurement`)
+	}
+
+	for _, query := range queries {
+		rows, err := m.db.QueryContext(ctx, query, databaseID)
+		if err != nil {
+			return fmt.Errorf("failed to inspect shard %s: %w", s.table(), err)
+		}
+		for rows.Next() {
+			var name string
+			var points, minTime, maxTime int64
+			if err := rows.Scan(&name, &points, &minTime, &maxTime); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan row: %w", err)
+			}
+			ms, ok := measurements[name]
+			if !ok {
+				continue
+			}
+			ms.Points += points
+			ms.MinTime = min(ms.MinTime, minTime)
+			ms.MaxTime = max(ms.MaxTime, maxTime)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return fmt.Errorf("error iterating rows: %w", err)
+		}
+	}
+	return nil
+}
+
+// diskUsage splits the size of the database file by kind of data
+func (m *Manager) diskUsage(ctx context.Context) (DiskUsage, error) {
+	var usage DiskUsage
+	var err error
+	if usage.Total, err = m.Size(); err != nil {
+		return DiskUsage{}, err
+	}
+
+	var freePages, pageSize int64
+	if err := m.db.QueryRowContext(ctx, `PRAGMA freelist_count`).Scan(&freePages); err != nil {
+		return DiskUsage{}, fmt.Errorf("failed to read free pages: %w", err)
+	}
+	if err := m.db.QueryRowContext(ctx, `PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return DiskUsage{}, fmt.Errorf("failed to read page size: %w", err)
+	}
+	usage.Free = freePages * pageSize
+
+	err = m.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(LENGTH(key) + LENGTH(tags) + LENGTH(measurement)), 0) FROM series`).Scan(&usage.Series)
+	if err != nil {
+		return DiskUsage{}, fmt.Errorf("failed to measure series: %w", err)
+	}
+
+	for _, shards := range m.shards.all() {
+		for _, s := range shards {
+			var n int64
+			if err := m.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(LENGTH(fields)), 0) FROM `+s.table()).Scan(&n); err != nil {
+				return DiskUsage{}, fmt.Errorf("failed to measure shard %s: %w", s.table(), err)
+			}
+			usage.Rows += n
+			if !s.packed {
+				continue
+			}
+			if err := m.db.QueryRowContext(ctx, `SELECT COALESCE(SUM(LENGTH(data)), 0) FROM `+s.blocksTable()).Scan(&n); err != nil {
+				return DiskUsage{}, fmt.Errorf("failed to measure shard %s: %w", s.table(), err)
+			}
+			usage.Blocks += n
+		}
+	}
+
+	usage.Other = max(usage.Total-usage.Rows-usage.Blocks-usage.Series-usage.Free, 0)
+	return usage, nil
+}
@@ -0,0 +1,439 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	integrityChecks = metrics.NewCounter("refluxdb_storage_integrity_checks_total", "Storage integrity checks run")
+	integrityIssues = metrics.NewGauge("refluxdb_storage_integrity_issues", "Issues found by the latest storage integrity check")
+)
+
+// Integrity issue kinds
+const (
+	// IssueSQLite is a problem reported by the SQLite quick_check
+	IssueSQLite = "sqlite"
+	// IssueShardIndex is a shard whose in-memory index entry differs from
+	// the shard catalog, hiding committed points from queries
+	IssueShardIndex = "shard_index"
+	// IssueMissingTable is a registered shard without its table
+	IssueMissingTable = "missing_table"
+	// IssueUnregisteredTable is a shard table missing from the catalog,
+	// whose points are never queried
+	IssueUnregisteredTable = "unregistered_table"
+	// IssueUnknownDatabase is a shard of a database that does not exist
+	IssueUnknownDatabase = "unknown_database"
+	// IssueUnknownSeries counts the points of a shard referencing a series
+	// missing from the series dictionary of its database
+	IssueUnknownSeries = "unknown_series"
+	// IssueOutOfWindow counts the points of a shard outside its time window
+	IssueOutOfWindow = "out_of_window"
+	// IssueSeriesCache is a cached series ID that is not in the series
+	// dictionary, so new points would be written to a missing series
+	IssueSeriesCache = "series_cache"
+)
+
+// IntegrityIssue is an inconsistency found between the in-memory indexes,
+// the catalog and the stored points
+type IntegrityIssue struct {
+	Kind string `json:"kind"`
+	// Table is the affected shard table, if any
+	Table   string `json:"table,omitempty"`
+	Message string `json:"message"`
+	// Repaired is set when the check was asked to repair and fixed it
+	Repaired bool `json:"repaired"`
+}
+
+// IntegrityReport is the outcome of an integrity check
+type IntegrityReport struct {
+	CheckedAt time.Time        `json:"checkedAt"`
+	Duration  time.Duration    `json:"duration"`
+	Shards    int              `json:"shards"`
+	Issues    []IntegrityIssue `json:"issues"`
+}
+
+// integrityState keeps the latest integrity report
+type integrityState struct {
+	mu     sync.Mutex
+	latest *IntegrityReport
+}
+
+// shardTableName matches the names of shard and blocks tables
+var shardTableName = regexp.MustCompile(`^shard_(\d+)(_blocks)?$`)
+
+// CheckIntegrity verifies that the shard index and the series cache kept
+// in memory match what is committed, that every shard has its tables and
+// every shard table is registered, that the points of every shard belong
+// to known series and to its time window, and runs the SQLite
+// quick_check. With repair, the in-memory state is reloaded from the
+// catalog and missing shard tables are recreated empty; other issues are
+// only reported since fixing them would delete points.
+func (m *Manager) CheckIntegrity(ctx context.Context, repair bool) (IntegrityReport, error) {
+	report := IntegrityReport{CheckedAt: time.Now().UTC(), Issues: []IntegrityIssue{}}
+	shards, err := m.checkCatalog(ctx, repair, &report)
+	if err != nil {
+		return IntegrityReport{}, err
+	}
+
+	// The scans below only read committed data, so writers are not held
+	// off. Shards dropped meanwhile are skipped.
+	for _, s := range shards {
+		if err := m.checkShardPoints(ctx, s, &report); err != nil {
+			return IntegrityReport{}, err
+		}
+	}
+	if err := m.quickCheck(ctx, &report); err != nil {
+		return IntegrityReport{}, err
+	}
+
+	report.Duration = time.Since(report.CheckedAt)
+	integrityChecks.Inc()
+	integrityIssues.Set(float64(len(report.Issues)))
+	m.integrity.mu.Lock()
+	m.integrity.latest = &report
+	m.integrity.mu.Unlock()
+	return report, nil
+}
+
+// LatestIntegrityReport returns the report of the latest integrity check,
+// and false if none ran yet
+func (m *Manager) LatestIntegrityReport() (IntegrityReport, bool) {
+	m.integrity.mu.Lock()
+	defer m.integrity.mu.Unlock()
+	if m.integrity.latest == nil {
+		return IntegrityReport{}, false
+	}
+	return *m.integrity.latest, true
+}
+
+// RunIntegrityChecks checks the storage integrity every interval until ctx
+// is done, logging the issues found
+func (m *Manager) RunIntegrityChecks(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := m.CheckIntegrity(ctx, false)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Errorf("Failed to check storage integrity: %v", err)
+				}
+				continue
+			}
+			for _, issue := range report.Issues {
+				log.Warnf("Storage integrity issue (%s): %s", issue.Kind, issue.Message)
+			}
+		}
+	}
+}
+
+// registeredShard is a row of the shard catalog
+type registeredShard struct {
+	shard
+	databaseID string
+}
+
+// checkCatalog compares the in-memory state with the catalog, holding
+// writers off, and returns the registered shards that have a table
+func (m *Manager) checkCatalog(ctx context.Context, repair bool, report *IntegrityReport) ([]registeredShard, error) {
+	if repair {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+	} else {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+	}
+
+	registered, err := m.registeredShards(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report.Shards = len(registered)
+	tables, err := m.shardTables(ctx)
+	if err != nil {
+		return nil, err
+	}
+	databases := make(map[string]bool)
+	ids, err := m.db.QueryContext(ctx, `SELECT id FROM databases`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+	for ids.Next() {
+		var id string
+		if err := ids.Scan(&id); err != nil {
+			ids.Close()
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		databases[id] = true
+	}
+	ids.Close()
+
+	// Shard index
+	indexed := make(map[int64]registeredShard)
+	for databaseID, shards := range m.shards.all() {
+		for _, s := range shards {
+			indexed[s.id] = registeredShard{shard: s, databaseID: databaseID}
+		}
+	}
+	indexIssues := 0
+	for _, r := range registered {
+		i, ok := indexed[r.id]
+		switch {
+		case !ok:
+			report.add(IntegrityIssue{Kind: IssueShardIndex, Table: r.table(), Message: fmt.Sprintf("shard %s is missing from the shard index", r.table())})
+		case i != r:
+			report.add(IntegrityIssue{Kind: IssueShardIndex, Table: r.table(), Message: fmt.Sprintf("shard %s differs between the shard index and the catalog", r.table())})
+		default:
+			delete(indexed, r.id)
+			continue
+		}
+		delete(indexed, r.id)
+		indexIssues++
+	}
+	for _, i := range indexed {
+		report.add(IntegrityIssue{Kind: IssueShardIndex, Table: i.table(), Message: fmt.Sprintf("shard %s is indexed but not registered", i.table())})
+		indexIssues++
+	}
+	if repair && indexIssues > 0 {
+		set, err := loadShards(m.db)
+		if err != nil {
+			return nil, err
+		}
+		m.shards.mu.Lock()
+		m.shards.byDatabase = set.byDatabase
+		m.shards.mu.Unlock()
+		report.markRepaired(IssueShardIndex)
+	}
+
+	// Shard tables
+	var present []registeredShard
+	for _, r := range registered {
+		if !databases[r.databaseID] {
+			report.add(IntegrityIssue{Kind: IssueUnknownDatabase, Table: r.table(), Message: fmt.Sprintf("shard %s belongs to unknown database %s", r.table(), r.databaseID)})
+		}
+		missing := []string{}
+		if !tables[r.table()] {
+			missing = append(missing, r.table())
+		}
+		if r.packed && !tables[r.blocksTable()] {
+			missing = append(missing, r.blocksTable())
+		}
+		delete(tables, r.table())
+		delete(tables, r.blocksTable())
+		if len(missing) == 0 {
+			present = append(present, r)
+			continue
+		}
+		issue := IntegrityIssue{Kind: IssueMissingTable, Table: r.table(), Message: fmt.Sprintf("shard %s is missing table %s", r.table(), strings.Join(missing, ", "))}
+		if repair {
+			if err := m.recreateShardTables(r.shard, missing); err != nil {
+				return nil, err
+			}
+			issue.Repaired = true
+			present = append(present, r)
+		}
+		report.add(issue)
+	}
+	unregistered := make([]string, 0, len(tables))
+	for table := range tables {
+		unregistered = append(unregistered, table)
+	}
+	sort.Strings(unregistered)
+	for _, table := range unregistered {
+		report.add(IntegrityIssue{Kind: IssueUnregisteredTable, Table: table, Message: fmt.Sprintf("table %s is not a registered shard", table)})
+	}
+
+	// Series cache
+	stale, err := m.staleSeriesIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if stale > 0 {
+		issue := IntegrityIssue{Kind: IssueSeriesCache, Message: fmt.Sprintf("%d cached series IDs are not in the series dictionary", stale)}
+		if repair {
+			m.seriesIDs = make(map[seriesRef]int64)
+			issue.Repaired = true
+		}
+		report.add(issue)
+	}
+	return present, nil
+}
+
+// registeredShards reads the shard catalog
+func (m *Manager) registeredShards(ctx context.Context) ([]registeredShard, error) {
+	rows, err := m.db.QueryContext(ctx, `SELECT id, database_id, start_time, end_time, packed, object FROM shards ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shards: %w", err)
+	}
+	defer rows.Close()
+
+	var shards []registeredShard
+	for rows.Next() {
+		var r registeredShard
+		if err := rows.Scan(&r.id, &r.databaseID, &r.start, &r.end, &r.packed, &r.object); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		shards = append(shards, r)
+	}
+	return shards, rows.Err()
+}
+
+// shardTables returns the names of the shard and blocks tables
+func (m *Manager) shardTables(ctx context.Context) (map[string]bool, error) {
+	rows, err := m.db.QueryContext(ctx, `SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE 'shard\_%' ESCAPE '\'`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	defer rows.Close()
+
+	tables := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if shardTableName.MatchString(name) {
+			tables[name] = true
+		}
+	}
+	return tables, rows.Err()
+}
+
+// recreateShardTables creates the missing tables of a shard, empty
+func (m *Manager) recreateShardTables(s shard, missing []string) error {
+	for _, table := range missing {
+		ddl := shardTable(table)
+		if table == s.blocksTable() {
+			ddl = blocksTableDDL(table)
+		}
+		if _, err := m.db.Exec(ddl); err != nil {
+			return fmt.Errorf("failed to recreate table %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// staleSeriesIDs counts the cached series IDs that do not match the series
+// dictionary. The caller must hold m.mu.
+func (m *Manager) staleSeriesIDs(ctx context.Context) (int, error) {
+	const chunk = 500
+	refs := make([]seriesRef, 0, len(m.seriesIDs))
+	for ref := range m.seriesIDs {
+		refs = append(refs, ref)
+	}
+
+	stale := 0
+	for len(refs) > 0 {
+		n := min(chunk, len(refs))
+		batch := refs[:n]
+		refs = refs[n:]
+
+		args := make([]interface{}, 0, n)
+		for _, ref := range batch {
+			args = append(args, m.seriesIDs[ref])
+		}
+		rows, err := m.db.QueryContext(ctx, `SELECT id, database_id, key FROM series WHERE id IN (?`+strings.Repeat(", ?", n-1)+`)`, args...)
+		if err != nil {
+			return 0, fmt.Errorf("failed to look up series: %w", err)
+		}
+		stored := make(map[int64]seriesRef, n)
+		for rows.Next() {
+			var id int64
+			var ref seriesRef
+			if err := rows.Scan(&id, &ref.databaseID, &ref.key); err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("failed to scan row: %w", err)
+			}
+			stored[id] = ref
+		}
+		rows.Close()
+		for _, ref := range batch {
+			if stored[m.seriesIDs[ref]] != ref {
+				stale++
+			}
+		}
+	}
+	return stale, nil
+}
+
+// checkShardPoints counts the points of a shard that reference unknown
+// series or fall outside its time window
+func (m *Manager) checkShardPoints(ctx context.Context, s registeredShard, report *IntegrityReport) error {
+	type check struct {
+		kind, query, message string
+		args                 []interface{}
+	}
+	checks := []check{
+		{IssueUnknownSeries, `SELECT COUNT(*) FROM ` + s.table() + ` p LEFT JOIN series s ON s.id = p.series_id AND s.database_id = ? WHERE s.id IS NULL`,
+			"%d points of shard %s reference unknown series", []interface{}{s.databaseID}},
+		{IssueOutOfWindow, `SELECT COUNT(*) FROM ` + s.table() + ` WHERE timestamp < ? OR timestamp >= ?`,
+			"%d points of shard %s are outside its time window", []interface{}{s.start, s.end}},
+	}
+	if s.packed {
+		checks = append(checks,
+			check{IssueUnknownSeries, `SELECT COUNT(*) FROM ` + s.blocksTable() + ` b LEFT JOIN series s ON s.id = b.series_id AND s.database_id = ? WHERE s.id IS NULL`,
+				"%d blocks of shard %s reference unknown series", []interface{}{s.databaseID}},
+			check{IssueOutOfWindow, `SELECT COUNT(*) FROM ` + s.blocksTable() + ` WHERE min_time < ? OR max_time >= ?`,
+				"%d blocks of shard %s are outside its time window", []interface{}{s.start, s.end}})
+	}
+	for _, c := range checks {
+		var n int64
+		err := m.db.QueryRowContext(ctx, c.query, c.args...).Scan(&n)
+		if isMissingTable(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check shard %s: %w", s.table(), err)
+		}
+		if n > 0 {
+			report.add(IntegrityIssue{Kind: c.kind, Table: s.table(), Message: fmt.Sprintf(c.message, n, s.table())})
+		}
+	}
+	return nil
+}
+
+// quickCheck runs the SQLite quick_check, which verifies the pages and
+// indexes of the database file
+func (m *Manager) quickCheck(ctx context.Context, report *IntegrityReport) error {
+	rows, err := m.db.QueryContext(ctx, `PRAGMA quick_check`)
+	if err != nil {
+		return fmt.Errorf("failed to run quick_check: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		if msg != "ok" {
+			report.add(IntegrityIssue{Kind: IssueSQLite, Message: msg})
+		}
+	}
+	return rows.Err()
+}
+
+func (r *IntegrityReport) add(issue IntegrityIssue) {
+	r.Issues = append(r.Issues, issue)
+}
+
+// markRepaired flags the issues of a kind as repaired
+func (r *IntegrityReport) markRepaired(kind string) {
+	for i := range r.Issues {
+		if r.Issues[i].Kind == kind {
+			r.Issues[i].Repaired = true
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package persistence
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Storage engines
+const (
+	// EngineRow stores every point as a row
+	EngineRow = "row"
+	// EngineColumnar packs the points of shards whose window has ended into
+	// compressed per-series blocks
+	EngineColumnar = "columnar"
+)
+
+// Durability modes
+const (
+	// DurabilityBatch waits for every batch to reach the disk before it is
+	// acknowledged, so acknowledged points survive a power loss
+	DurabilityBatch = "batch"
+	// DurabilityPeriodic flushes the files to disk every FsyncInterval.
+	// Acknowledged points survive a crash of the process, while a power
+	// loss may lose the points acknowledged during the last interval.
+	DurabilityPeriodic = "periodic"
+)
+
+// DefaultFsyncInterval is the flush period of DurabilityPeriodic
+const DefaultFsyncInterval = time.Second
+
+// Options tunes the SQLite connection pool and durability settings
+type Options struct {
+	// JournalMode is the SQLite journal mode. WAL lets queries run while a
+	// batch is being written instead of failing with "database is locked".
+	JournalMode string
+	// Synchronous controls how often SQLite waits for data to reach the
+	// disk. NORMAL is safe in WAL mode: a power loss may roll back the
+	// last transactions but never corrupts the database.
+	Synchronous string
+	// Durability is DurabilityBatch or DurabilityPeriodic. Empty means
+	// DurabilityPeriodic. DurabilityBatch raises Synchronous to FULL.
+	Durability string
+	// FsyncInterval is the flush period of DurabilityPeriodic. Zero means
+	// DefaultFsyncInterval.
+	FsyncInterval time.Duration
+	// BusyTimeout is how long a connection waits for a lock held by
+	// another connection before failing
+	BusyTimeout time.Duration
+	// MaxOpenConns limits the open connections. Zero means unlimited.
+	MaxOpenConns int
+	// MaxIdleConns is the number of connections kept open between queries
+	MaxIdleConns int
+	// ShardDuration is the time window covered by each shard. Zero means
+	// DefaultShardDuration. Changing it only affects new shards.
+	ShardDuration time.Duration
+	// CompressFields stores field sets compressed with zstd when it makes
+	// them smaller. Changing it only affects new writes; RecompressFields
+	// re-encodes existing points.
+	CompressFields bool
+	// Engine is the storage engine, EngineRow or EngineColumnar. Empty means
+	// EngineRow. Switching to EngineRow keeps existing blocks readable.
+	Engine string
+	// Tiering uploads the blocks of old shards to object storage. It is
+	// needed to read the shards tiered before, even when TierShards is not
+	// run.
+	Tiering *TieringOptions
+}
+
+// DefaultOptions returns the settings used by New
+func DefaultOptions() Options {
+	return Options{
+		JournalMode:   "WAL",
+		Synchronous:   "NORMAL",
+		Durability:    DurabilityPeriodic,
+		FsyncInterval: DefaultFsyncInterval,
+		BusyTimeout:   5 * time.Second,
+		MaxOpenConns:  8,
+		MaxIdleConns:  8,
+		ShardDuration: DefaultShardDuration,
+		Engine:        EngineRow,
+	}
+}
+
+var (
+	engines      = []string{EngineRow, EngineColumnar}
+	durabilities = []string{DurabilityBatch, DurabilityPeriodic}
+	journalModes = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+	syncModes    = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+)
+
+// Validate reports settings SQLite would reject
+func (o Options) Validate() error {
+	if o.JournalMode != "" && !contains(journalModes, o.JournalMode) {
+		return fmt.Errorf("invalid journal mode %q: expected one of %s", o.JournalMode, strings.Join(journalModes, ", "))
+	}
+	if o.Synchronous != "" && !contains(syncModes, o.Synchronous) {
+		return fmt.Errorf("invalid synchronous mode %q: expected one of %s", o.Synchronous, strings.Join(syncModes, ", "))
+	}
+	if o.Durability != "" && !contains(durabilities, o.Durability) {
+		return fmt.Errorf("invalid durability %q: expected one of %s", o.Durability, strings.Join(durabilities, ", "))
+	}
+	if o.BusyTimeout < 0 || o.MaxOpenConns < 0 || o.MaxIdleConns < 0 || o.FsyncInterval < 0 {
+		return fmt.Errorf("busy timeout, fsync interval and connection limits must not be negative")
+	}
+	if o.ShardDuration != 0 && o.ShardDuration < time.Minute {
+		return fmt.Errorf("invalid shard duration %s: must be at least 1m", o.ShardDuration)
+	}
+	if o.Engine != "" && !contains(engines, o.Engine) {
+		return fmt.Errorf("invalid storage engine %q: expected one of %s", o.Engine, strings.Join(engines, ", "))
+	}
+	if o.Tiering != nil {
+		if err := o.Tiering.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dsn appends the settings to path as go-sqlite3 connection parameters, so
+// they apply to every connection of the pool
+func (o Options) dsn(path string) string {
+	params := url.Values{}
+	// New files release free pages through Compact without a full VACUUM.
+	// The setting has no effect on files that already have tables.
+	params.Set("_auto_vacuum", "incremental")
+	if o.JournalMode != "" && !isMemory(path) {
+		params.Set("_journal_mode", o.JournalMode)
+	}
+	if sync := o.synchronous(); sync != "" {
+		params.Set("_synchronous", sync)
+	}
+	if o.BusyTimeout > 0 {
+		params.Set("_busy_timeout", fmt.Sprint(o.BusyTimeout.Milliseconds()))
+	}
+	if len(params) == 0 {
+		return path
+	}
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + params.Encode()
+}
+
+// synchronous returns the SQLite synchronous setting, FULL at least with
+// DurabilityBatch so that commits wait for the disk
+func (o Options) synchronous() string {
+	if strings.EqualFold(o.Durability, DurabilityBatch) && !strings.EqualFold(o.Synchronous, "FULL") && !strings.EqualFold(o.Synchronous, "EXTRA") {
+		return "FULL"
+	}
+	return o.Synchronous
+}
+
+// isMemory reports whether path names an in-memory database
+func isMemory(path string) bool {
+	return path == ":memory:" || strings.Contains(path, "mode=memory")
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if strings.EqualFold(value, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,246 @@
+package persistence
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Organization is a v2 API organization. Every database belongs to one.
+type Organization struct {
+	ID          string
+	Name        string
+	Description string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// OrganizationUpdate lists the organization fields to change. Nil fields
+// are kept.
+type OrganizationUpdate struct {
+	Name        *string
+	Description *string
+}
+
+const organizationColumns = `id, name, description, created_at, updated_at`
+
+func scanOrganization(row interface{ Scan(...interface{}) error }) (Organization, error) {
+	var o Organization
+	var created, updated int64
+	if err := row.Scan(&o.ID, &o.Name, &o.Description, &created, &updated); err != nil {
+		return Organization{}, err
+	}
+	o.CreatedAt = time.Unix(0, created).UTC()
+	o.UpdatedAt = time.Unix(0, updated).UTC()
+	return o, nil
+}
+
+// Organizations returns every organization, sorted by name
+func (m *Manager) Organizations() ([]Organization, error) {
+	rows, err := m.db.Query(`SELECT ` + organizationColumns + ` FROM organizations ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list organizations: %w", err)
+	}
+	defer rows.Close()
+
+	var orgs []Organization
+	for rows.Next() {
+		o, err := scanOrganization(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		orgs = append(orgs, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return orgs, nil
+}
+
+// GetOrganization returns the named organization
+func (m *Manager) GetOrganization(name string) (Organization, error) {
+	return m.getOrganization(`name = ?`, name)
+}
+
+// GetOrganizationByID returns the organization with the given ID
+func (m *Manager) GetOrganizationByID(id string) (Organization, error) {
+	return m.getOrganization(`id = ?`, id)
+}
+
+func (m *Manager) getOrganization(where string, arg string) (Organization, error) {
+	o, err := scanOrganization(m.db.QueryRow(`SELECT `+organizationColumns+` FROM organizations WHERE `+where, arg))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Organization{}, ErrOrganizationNotFound
+	}
+	if err != nil {
+		return Organization{}, fmt.Errorf("failed to look up organization %s: %w", arg, err)
+	}
+	return o, nil
+}
+
+// AddOrganization creates an organization and returns it with its
+// generated ID and timestamps
+func (m *Manager) AddOrganization(o Organization) (Organization, error) {
+	return m.addOrganization(o, "")
+}
+
+// addOrganization creates an organization with the given ID, or a random
+// one when id is empty or taken
+func (m *Manager) addOrganization(o Organization, id string) (Organization, error) {
+	if o.Name == "" {
+		return Organization{}, fmt.Errorf("organization name is required")
+	}
+
+	m.mu.Lock()
+	now := time.Now().UnixNano()
+	res, err := m.db.Exec(`INSERT OR IGNORE INTO organizations (id, name, description, created_at, updated_at)
+		SELECT CASE WHEN ?1 = '' OR EXISTS(SELECT 1 FROM organizations WHERE id = ?1) THEN lower(hex(randomblob(8))) ELSE ?1 END, ?2, ?3, ?4, ?4`,
+		id, o.Name, o.Description, now)
+	m.mu.Unlock()
+	if err != nil {
+		return Organization{}, fmt.Errorf("failed to create organization %s: %w", o.Name, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Organization{}, ErrOrganizationExists
+	}
+	return m.GetOrganization(o.Name)
+}
+
+// UpdateOrganization changes the organization with the given ID
+func (m *Manager) UpdateOrganization(id string, update OrganizationUpdate) (Organization, error) {
+	current, err := m.GetOrganizationByID(id)
+	if err != nil {
+		return Organization{}, err
+	}
+	if update.Name != nil {
+		if *update.Name == "" {
+			return Organization{}, fmt.Errorf("organization name is required")
+		}
+		current.Name = *update.Name
+	}
+	if update.Description != nil {
+		current.Description = *update.Description
+	}
+
+	m.mu.Lock()
+	var taken bool
+	err = m.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM organizations WHERE name = ? AND id != ?)`, current.Name, id).Scan(&taken)
+	if err == nil && !taken {
+		_, err = m.db.Exec(`UPDATE organizations SET name = ?, description = ?, updated_at = ? WHERE id = ?`,
+			current.Name, current.Description, time.Now().UnixNano(), id)
+	}
+	m.mu.Unlock()
+	if err != nil {
+		return Organization{}, fmt.Errorf("failed to update organization %s: %w", id, err)
+	}
+	if taken {
+		return Organization{}, ErrOrganizationExists
+	}
+	return m.GetOrganizationByID(id)
+}
+
+// DeleteOrganization removes an organization together with its databases,
+// their points and its tasks
+func (m *Manager) DeleteOrganization(id string) error {
+	if _, err := m.GetOrganizationByID(id); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT id FROM databases WHERE org_id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to list databases of organization %s: %w", id, err)
+	}
+	var databases []string
+	for rows.Next() {
+		var databaseID string
+		if err := rows.Scan(&databaseID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		databases = append(databases, databaseID)
+	}
+	rows.Close()
+
+	for _, databaseID := range databases {
+		if err := dropDatabase(tx, databaseID); err != nil {
+			return fmt.Errorf("failed to delete organization %s: %w", id, err)
+		}
+	}
+	for _, stmt := range []string{
+		`DELETE FROM task_runs WHERE task_id IN (SELECT id FROM tasks WHERE org_id = ?)`,
+		`DELETE FROM tasks WHERE org_id = ?`,
+		`DELETE FROM organizations WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(stmt, id); err != nil {
+			return fmt.Errorf("failed to delete organization %s: %w", id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to delete organization %s: %w", id, err)
+	}
+	for _, databaseID := range databases {
+		m.forgetObjects(m.shards.overlapping(databaseID, math.MinInt64, math.MaxInt64))
+		m.shards.removeDatabase(databaseID)
+	}
+	m.seriesIDs = make(map[seriesRef]int64)
+	m.state.reset()
+	m.bounds.reset()
+	m.hours.reset()
+	m.seriesIndex.reset()
+	if id == m.defaultOrgID {
+		m.defaultOrgID = ""
+	}
+	return nil
+}
+
+// SetDefaultOrganization creates the named organization if needed and makes
+// it the owner of databases created without an organization, including
+// the existing ones. Like the databases created by writes, an organization
+// created here gets an ID derived from its name.
+func (m *Manager) SetDefaultOrganization(name string) (Organization, error) {
+	org, err := m.addOrganization(Organization{Name: name}, derivedID("org", name))
+	if errors.Is(err, ErrOrganizationExists) {
+		org, err = m.GetOrganization(name)
+	}
+	if err != nil {
+		return Organization{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, err := m.db.Exec(`UPDATE databases SET org_id = ? WHERE org_id = ''`, org.ID); err != nil {
+		return Organization{}, fmt.Errorf("failed to assign databases to organization %s: %w", name, err)
+	}
+	m.defaultOrgID = org.ID
+	return org, nil
+}
+
+// DefaultOrganizationID returns the ID of the default organization, or an
+// empty string when none is set
+func (m *Manager) DefaultOrganizationID() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.defaultOrgID
+}
+
+// derivedID returns the ID of an organization or database of the given
+// kind created implicitly under name: the first 8 bytes of a hash of both,
+// in the hexadecimal form of random IDs
+func derivedID(kind, name string) string {
+	sum := sha256.Sum256([]byte(kind + "\x00" + name))
+	return hex.EncodeToString(sum[:8])
+}
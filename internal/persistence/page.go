@@ -0,0 +1,177 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// PageCursor is the position of the last point of a page: pages are
+// ordered by timestamp, then by series key
+type PageCursor struct {
+	Timestamp int64
+	SeriesKey string
+}
+
+// after reports whether the point at ts in series key comes after c
+func (c *PageCursor) after(ts int64, key string) bool {
+	return c == nil || ts > c.Timestamp || (ts == c.Timestamp && key > c.SeriesKey)
+}
+
+// GetMeasurementPage returns up to limit points of a measurement within
+// [start, end] that come after cursor, or from the start of the range
+// when cursor is nil. Points are ordered by timestamp, then by series key.
+// The returned cursor is the position of the last point, or nil when no
+// point follows the page.
+//
+// Only the points of the page are loaded: on unpacked shards the cursor
+// and the limit are part of the SQL query. The blocks of a packed shard
+// are selected from the cursor timestamp on and sorted in memory.
+func (m *Manager) GetMeasurementPage(ctx context.Context, database, measurement string, start, end int64, cursor *PageCursor, limit int) ([]Point, *PageCursor, error) {
+	if limit <= 0 {
+		return nil, nil, fmt.Errorf("invalid page limit %d: must be positive", limit)
+	}
+	if cursor != nil && cursor.Timestamp > start {
+		start = cursor.Timestamp
+	}
+
+	id, ok, err := m.databaseID(nil, database)
+	if err != nil || !ok {
+		return nil, nil, err
+	}
+
+	// One point past the limit tells whether another page follows
+	var points []Point
+	var keys []string
+	for _, s := range m.shards.overlapping(id, start, end) {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, fmt.Errorf("query aborted: %w", err)
+		}
+		want := limit + 1 - len(points)
+		var page []Point
+		var pageKeys []string
+		if s.packed {
+			page, pageKeys, err = m.packedShardPage(ctx, s, id, database, measurement, start, end, cursor, want)
+		} else {
+			page, pageKeys, err = m.shardPage(ctx, s, id, database, measurement, start, end, cursor, want)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to query measurements: %w", err)
+		}
+		points, keys = append(points, page...), append(keys, pageKeys...)
+		if len(points) > limit {
+			break
+		}
+	}
+
+	if len(points) <= limit {
+		return points, nil, nil
+	}
+	points, keys = points[:limit], keys[:limit]
+	last := points[limit-1]
+	return points, &PageCursor{Timestamp: last.Timestamp, SeriesKey: keys[limit-1]}, nil
+}
+
+// shardPage selects up to limit points of an unpacked shard after cursor
+func (m *Manager) shardPage(ctx context.Context, s shard, databaseID, database, measurement string, start, end int64, cursor *PageCursor, limit int) ([]Point, []string, error) {
+	query := `
+		SELECT s.key, s.measurement, s.tags, p.timestamp, p.fields
+		FROM ` + s.table() + ` p JOIN series s ON s.id = p.series_id
+		WHERE s.database_id = ? AND s.measurement = ? AND p.timestamp >= ? AND p.timestamp <= ?`
+	args := []interface{}{databaseID, measurement, start, end}
+	if cursor != nil {
+		query += ` AND (p.timestamp > ? OR (p.timestamp = ? AND s.key > ?))`
+		args = append(args, cursor.Timestamp, cursor.Timestamp, cursor.SeriesKey)
+	}
+	query += ` ORDER BY p.timestamp, s.key LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := m.db.QueryContext(ctx, query, args...)
+	if isMissingTable(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var points []Point
+	var keys []string
+	for rows.Next() {
+		var key, name, tagsJSON string
+		var timestamp int64
+		var data []byte
+		if err := rows.Scan(&key, &name, &tagsJSON, &timestamp, &data); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		var tags map[string]string
+		if err := json.Unmarshal([]byte(tagsJSON), &tags); err != nil {
+			return nil, nil, fmt.Errorf("failed to unmarshal tags: %w", err)
+		}
+		fields, err := decodeFields(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		points = append(points, Point{Database: database, Measurement: name, Tags: tags, Fields: fields, Timestamp: timestamp})
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return points, keys, nil
+}
+
+// packedShardPage selects up to limit points of a packed shard after
+// cursor. Blocks hold many points each, so the points from the cursor
+// timestamp on are read and sorted before the page is cut.
+func (m *Manager) packedShardPage(ctx context.Context, s shard, databaseID, database, measurement string, start, end int64, cursor *PageCursor, limit int) ([]Point, []string, error) {
+	reader, release, err := m.blocksReader(ctx, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+	query, args := shardQuery(s, databaseID, []string{measurement}, start, end)
+	rows, err := reader.QueryContext(ctx, query, args...)
+	if isMissingTable(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var points []Point
+	var keys []string
+	err = scanPoints(rows, database, start, end, func(p Point) error {
+		key := SeriesKey(p.Measurement, p.Tags)
+		if cursor.after(p.Timestamp, key) {
+			points = append(points, p)
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	order := make([]int, len(points))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if points[a].Timestamp != points[b].Timestamp {
+			return points[a].Timestamp < points[b].Timestamp
+		}
+		return keys[a] < keys[b]
+	})
+	if len(order) > limit {
+		order = order[:limit]
+	}
+	page := make([]Point, len(order))
+	pageKeys := make([]string, len(order))
+	for i, j := range order {
+		page[i], pageKeys[i] = points[j], keys[j]
+	}
+	return page, pageKeys, nil
+}
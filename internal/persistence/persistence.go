@@ -1,220 +1,880 @@
 package persistence
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	"github.com/gleicon/go-refluxdb/internal/tracing"
 	log "github.com/sirupsen/logrus"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
+var (
+	pointsWritten = metrics.NewCounter("refluxdb_storage_points_written_total", "Points written to storage")
+	writeErrors   = metrics.NewCounter("refluxdb_storage_write_errors_total", "Batches that failed to be written to storage")
+	pointsExpired = metrics.NewCounter("refluxdb_storage_points_expired_total", "Points deleted by retention enforcement")
+	batchDuration = metrics.NewHistogram("refluxdb_storage_batch_duration_seconds", "Time spent writing a batch of points", metrics.DefaultBuckets)
+)
+
 // Manager handles database operations for time series data
 type Manager struct {
-	db   *sql.DB
+	db *sql.DB
+	// mu serializes writers. Readers rely on SQLite isolation instead, so
+	// in WAL mode queries run while a batch is being written.
 	mu   sync.RWMutex
 	path string
+	// defaultOrgID owns the databases created without an organization
+	defaultOrgID string
+	// shards indexes the shard tables holding the points
+	shards        *shardSet
+	shardDuration time.Duration
+	// compressFields stores field sets as zstd compressed BLOBs
+	compressFields bool
+	// columnar packs shards into blocks once their window has ended
+	columnar bool
+	// seriesIDs caches the IDs of the series dictionary by database ID and
+	// series key. It is only used by writers, under mu.
+	seriesIDs map[seriesRef]int64
+	// state caches the first and last values of the queried series
+	state *stateCache
+	// bounds caches the time range of the queried measurements
+	bounds *boundsCache
+	// hours counts the points of the queried measurements by hour
+	hours *hourIndex
+	// seriesIndex filters the tags of the series of the queried
+	// measurements
+	seriesIndex *seriesIndex
+	// writeStats counts the points written by measurement
+	writeStats *writeStats
+	// stmts caches the prepared statements of the write and query paths
+	stmts *stmtCache
+	// observers are called with every batch once it is committed,
+	// registered under obsMu
+	observers []func([]Point)
+	obsMu     sync.RWMutex
+	// catalog is the main file for the file of a tenant, whose observers
+	// are called with the batches of the tenant too
+	catalog *Manager
+	// integrity keeps the latest integrity report
+	integrity integrityState
+	// credentials remembers the verified user passwords
+	credentials credentialCache
+	// tiering and tier, its cache of downloaded shards, are nil unless
+	// shards are tiered to object storage
+	tiering *TieringOptions
+	tier    *tierCache
+	// syncer flushes the files to disk with DurabilityPeriodic, nil
+	// otherwise
+	syncer *syncer
+}
+
+// seriesRef identifies a series within the series dictionary
+type seriesRef struct {
+	databaseID string
+	key        string
 }
 
+// maxCachedSeries bounds the series ID cache, which is reset when full
+const maxCachedSeries = 100000
+
+// DefaultDatabase receives points written without a database
+const DefaultDatabase = "default"
+
 // Point represents a single time series data point
 type Point struct {
+	// Database is the namespace the point belongs to. Empty means
+	// DefaultDatabase.
+	Database    string
 	Measurement string
 	Tags        map[string]string
 	Fields      map[string]float64
-	Timestamp   time.Time
+	// Timestamp is in nanoseconds since the Unix epoch, the unit of every
+	// timestamp of the storage API. Conversions from and to other units
+	// happen where points are parsed and serialized.
+	Timestamp int64
+}
+
+// The range of times representable as timestamps, from 1677 to 2262
+var (
+	MinTime = time.Unix(0, math.MinInt64).UTC()
+	MaxTime = time.Unix(0, math.MaxInt64).UTC()
+)
+
+// Time returns the timestamp of p as a UTC time
+func (p Point) Time() time.Time {
+	return time.Unix(0, p.Timestamp).UTC()
+}
+
+// Nanoseconds converts t to a timestamp, failing for times outside of
+// MinTime and MaxTime that time.UnixNano would silently wrap
+func Nanoseconds(t time.Time) (int64, error) {
+	if t.Before(MinTime) || t.After(MaxTime) {
+		return 0, fmt.Errorf("time %s is outside the range of nanosecond timestamps", t.UTC().Format(time.RFC3339Nano))
+	}
+	return t.UnixNano(), nil
+}
+
+// SeriesKey returns the canonical key identifying the series of a point:
+// the measurement followed by its tags sorted by key, using the line
+// protocol escaping rules so that distinct tag sets never collide.
+func SeriesKey(measurement string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(seriesEscaper.Replace(measurement))
+	for _, k := range keys {
+		sb.WriteByte(',')
+		sb.WriteString(seriesEscaper.Replace(k))
+		sb.WriteByte('=')
+		sb.WriteString(seriesEscaper.Replace(tags[k]))
+	}
+	return sb.String()
 }
 
-// New creates a new persistence manager
+var seriesEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// New creates a new persistence manager with DefaultOptions
 func New(dbPath string) (*Manager, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+	return NewWithOptions(dbPath, DefaultOptions())
+}
+
+// NewWithOptions creates a new persistence manager with the given SQLite
+// settings
+func NewWithOptions(dbPath string, opts Options) (*Manager, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", opts.dsn(dbPath))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
+	// Every connection to an in-memory database opens a new, empty database,
+	// so it must be limited to a single connection
+	if isMemory(dbPath) {
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+	} else {
+		db.SetMaxOpenConns(opts.MaxOpenConns)
+		db.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+
 	// Create tables if they don't exist
 	if err := createSchema(db); err != nil {
 		db.Close()
 		return nil, fmt.Errorf("failed to create schema: %w", err)
 	}
 
-	return &Manager{
-		db:   db,
-		path: dbPath,
-	}, nil
-}
+	shards, err := loadShards(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-func createSchema(db *sql.DB) error {
-	schema := `
-    CREATE TABLE IF NOT EXISTS points (
-        id INTEGER PRIMARY KEY,
-        measurement TEXT NOT NULL,
-        timestamp INTEGER NOT NULL,
-        tags TEXT NOT NULL,
-        fields TEXT NOT NULL
-    );
-    CREATE INDEX IF NOT EXISTS idx_measurement ON points(measurement);
-    CREATE INDEX IF NOT EXISTS idx_timestamp ON points(timestamp);
-    `
+	shardDuration := opts.ShardDuration
+	if shardDuration <= 0 {
+		shardDuration = DefaultShardDuration
+	}
 
-	_, err := db.Exec(schema)
-	return err
+	stmts, err := newStmtCache(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	var tier *tierCache
+	if opts.Tiering != nil {
+		if tier, err = newTierCache(opts.Tiering.Store, opts.Tiering.CacheDir, opts.Tiering.CacheSize); err != nil {
+			stmts.close()
+			db.Close()
+			return nil, err
+		}
+	}
+
+	m := &Manager{
+		db:             db,
+		path:           dbPath,
+		shards:         shards,
+		shardDuration:  shardDuration,
+		compressFields: opts.CompressFields,
+		columnar:       strings.EqualFold(opts.Engine, EngineColumnar),
+		seriesIDs:      make(map[seriesRef]int64),
+		state:          newStateCache(),
+		bounds:         newBoundsCache(),
+		seriesIndex:    newSeriesIndex(),
+		hours:          newHourIndex(),
+		writeStats:     newWriteStats(),
+		stmts:          stmts,
+		tiering:        opts.Tiering,
+		tier:           tier,
+	}
+	if !isMemory(dbPath) && !strings.EqualFold(opts.Durability, DurabilityBatch) {
+		interval := opts.FsyncInterval
+		if interval <= 0 {
+			interval = DefaultFsyncInterval
+		}
+		m.syncer = m.startSyncer(interval)
+	}
+	return m, nil
 }
 
-// Close closes the database connection
+// Close flushes the files to disk and closes the database connection
 func (m *Manager) Close() error {
-	return m.db.Close()
+	m.syncer.close()
+	err := m.Sync()
+	m.stmts.close()
+	if cerr := m.db.Close(); cerr != nil {
+		return cerr
+	}
+	return err
 }
 
-// SaveMeasurement saves a single measurement to the database
-func (m *Manager) SaveMeasurement(measurement, field string, value float64, tags map[string]string, timestamp int64) error {
+// SaveMeasurement saves a single point holding all of its fields to the database
+func (m *Manager) SaveMeasurement(database, measurement string, fields map[string]float64, tags map[string]string, timestamp int64) error {
+	return m.SaveBatch([]Point{{
+		Database:    database,
+		Measurement: measurement,
+		Tags:        tags,
+		Fields:      fields,
+		Timestamp:   timestamp,
+	}})
+}
+
+// SaveBatch saves a set of points in a single transaction. Every point is
+// stored as one row carrying all of its fields. Databases that do not exist
+// yet are created.
+func (m *Manager) SaveBatch(points []Point) error {
+	return m.SaveBatchContext(context.Background(), points)
+}
+
+// SaveBatchContext is SaveBatch recording the wait for the writer lock and
+// the transaction as spans of the trace carried by ctx
+func (m *Manager) SaveBatchContext(ctx context.Context, points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+
+	start := time.Now()
+	err := m.saveBatch(ctx, points)
+	batchDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		writeErrors.Inc()
+		return classify(err)
+	}
+	pointsWritten.Add(uint64(len(points)))
+	return nil
+}
+
+func (m *Manager) saveBatch(ctx context.Context, points []Point) (err error) {
+	_, queued := tracing.Start(ctx, "storage.enqueue")
 	m.mu.Lock()
+	queued.End()
 	defer m.mu.Unlock()
 
-	tagsJSON, err := json.Marshal(tags)
+	_, span := tracing.Start(ctx, "storage.commit")
+	span.SetAttribute("points", len(points))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
+	tx, err := m.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("failed to marshal tags: %w", err)
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	databases := make(map[string]string)
+	series := make(map[seriesRef]int64)
+	created := make(map[string][]shard)
+	current := make(map[string]shard)
+	// The insert statements of the shards written, bound to tx
+	stmts := make(map[int64]*sql.Stmt)
+	var releases []func()
+	defer func() {
+		for _, release := range releases {
+			release()
+		}
+	}()
+
+	for _, p := range points {
+		database := p.Database
+		if database == "" {
+			database = DefaultDatabase
+		}
+		databaseID, ok := databases[database]
+		if !ok {
+			if databaseID, err = m.createDatabase(tx, database); err != nil {
+				return err
+			}
+			databases[database] = databaseID
+		}
+
+		if len(p.Fields) == 0 {
+			return fmt.Errorf("point for measurement %s has no fields", p.Measurement)
+		}
+
+		ref := seriesRef{databaseID: databaseID, key: SeriesKey(p.Measurement, p.Tags)}
+		seriesID, ok := series[ref]
+		if !ok {
+			if seriesID, err = m.seriesID(tx, ref, p.Measurement, p.Tags); err != nil {
+				return err
+			}
+			series[ref] = seriesID
+		}
+
+		fields, err := encodeFields(p.Fields, m.compressFields)
+		if err != nil {
+			return err
+		}
+
+		// Batches are usually ordered by time, so the shard of the previous
+		// point of the database is tried first
+		ts := p.Timestamp
+		s, ok := current[databaseID]
+		if !ok || ts < s.start || ts >= s.end {
+			if s, err = m.shardFor(tx, databaseID, ts, created); err != nil {
+				return err
+			}
+			current[databaseID] = s
+		}
+
+		// Writing the same series and timestamp twice merges the field
+		// sets, with the newest values winning, so re-sent batches are
+		// idempotent. SQLite merges JSON text; compressed field sets are
+		// merged by mergeFields instead.
+		stmt, ok := stmts[s.id]
+		if !ok {
+			var release func()
+			stmt, release, err = m.stmts.tx(tx, `
+        INSERT INTO `+s.table()+` (series_id, timestamp, fields)
+        VALUES (?, ?, ?)
+        ON CONFLICT(series_id, timestamp) DO UPDATE SET fields = json_patch(fields, excluded.fields)
+        WHERE typeof(fields) = 'text' AND typeof(excluded.fields) = 'text'
+    `)
+			if err != nil {
+				return fmt.Errorf("failed to prepare insert: %w", err)
+			}
+			stmts[s.id] = stmt
+			releases = append(releases, release)
+		}
+
+		res, err := stmt.Exec(seriesID, ts, fields)
+		if err != nil {
+			return fmt.Errorf("failed to insert measurement: %w", err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			if err := m.mergeFields(tx, s, seriesID, ts, p.Fields); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit batch: %w", err)
+	}
+	m.stmts.fill()
+	for databaseID, shards := range created {
+		m.shards.add(databaseID, shards...)
+	}
+	if len(m.seriesIDs)+len(series) > maxCachedSeries {
+		m.seriesIDs = make(map[seriesRef]int64)
+	}
+	for ref, id := range series {
+		m.seriesIDs[ref] = id
+	}
+	m.state.observe(points)
+	m.bounds.observe(points)
+	m.hours.observe(points)
+	m.seriesIndex.observe(points)
+	m.writeStats.observe(points, time.Now())
+	m.notify(points)
+
+	return nil
+}
+
+// OnWrite registers fn to be called with every batch of points once it is
+// stored. Points without a database belong to DefaultDatabase. fn is
+// called while writers are held off, so it must not block nor write.
+func (m *Manager) OnWrite(fn func([]Point)) {
+	m.obsMu.Lock()
+	defer m.obsMu.Unlock()
+	m.observers = append(m.observers, fn)
+}
+
+// notify calls the observers of m with a stored batch, and those of the
+// catalog for the file of a tenant
+func (m *Manager) notify(points []Point) {
+	m.obsMu.RLock()
+	for _, fn := range m.observers {
+		fn(points)
+	}
+	m.obsMu.RUnlock()
+	if m.catalog != nil {
+		m.catalog.notify(points)
+	}
+}
+
+// seriesID returns the ID of a series in the dictionary, adding it inside
+// tx if needed. The caller must hold m.mu.
+func (m *Manager) seriesID(tx *sql.Tx, ref seriesRef, measurement string, tags map[string]string) (int64, error) {
+	if id, ok := m.seriesIDs[ref]; ok {
+		return id, nil
 	}
 
-	fields := map[string]float64{field: value}
-	fieldsJSON, err := json.Marshal(fields)
+	tagsJSON, err := json.Marshal(tags)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal tags: %w", err)
+	}
+	insert, release, err := m.stmts.tx(tx, insertSeriesQuery)
 	if err != nil {
-		return fmt.Errorf("failed to marshal fields: %w", err)
+		return 0, err
+	}
+	defer release()
+	if _, err = insert.Exec(ref.databaseID, measurement, ref.key, string(tagsJSON)); err != nil {
+		return 0, fmt.Errorf("failed to add series %s: %w", ref.key, err)
 	}
 
-	query := `
-        INSERT INTO points (measurement, timestamp, tags, fields)
-        VALUES (?, ?, ?, ?)
-    `
+	sel, release, err := m.stmts.tx(tx, selectSeriesQuery)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	var id int64
+	if err = sel.QueryRow(ref.databaseID, ref.key).Scan(&id); err != nil {
+		return 0, fmt.Errorf("failed to look up series %s: %w", ref.key, err)
+	}
+	return id, nil
+}
 
-	_, err = m.db.Exec(query, measurement, timestamp, string(tagsJSON), string(fieldsJSON))
+// mergeFields merges fields into the stored point of a series at ts when
+// either side is compressed, which json_patch cannot read
+func (m *Manager) mergeFields(tx *sql.Tx, s shard, seriesID, ts int64, fields map[string]float64) error {
+	var stored []byte
+	err := tx.QueryRow(`SELECT fields FROM `+s.table()+` WHERE series_id = ? AND timestamp = ?`, seriesID, ts).Scan(&stored)
+	if err != nil {
+		return fmt.Errorf("failed to read point to merge: %w", err)
+	}
+	merged, err := decodeFields(stored)
 	if err != nil {
-		return fmt.Errorf("failed to insert measurement: %w", err)
+		return err
+	}
+	for k, v := range fields {
+		merged[k] = v
 	}
 
+	encoded, err := encodeFields(merged, m.compressFields)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE `+s.table()+` SET fields = ? WHERE series_id = ? AND timestamp = ?`, encoded, seriesID, ts)
+	if err != nil {
+		return fmt.Errorf("failed to merge point: %w", err)
+	}
 	return nil
 }
 
-// GetMeasurementRange retrieves measurements within a time range
-func (m *Manager) GetMeasurementRange(measurement string, start, end int64) ([]Point, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+// shardFor returns the shard of a database receiving ts, creating it inside
+// tx if needed. Shards created by the transaction are recorded in created
+// and only become visible to queries once it commits.
+func (m *Manager) shardFor(tx *sql.Tx, databaseID string, ts int64, created map[string][]shard) (shard, error) {
+	existing := append(m.shards.overlapping(databaseID, math.MinInt64, math.MaxInt64), created[databaseID]...)
+	for _, s := range existing {
+		if ts >= s.start && ts < s.end {
+			return s, nil
+		}
+	}
+
+	start, end := shardWindow(ts, m.shardDuration, existing)
+	s, err := createShard(tx, databaseID, start, end)
+	if err != nil {
+		return shard{}, err
+	}
+	created[databaseID] = append(created[databaseID], s)
+	return s, nil
+}
+
+// GetMeasurementRange retrieves the points of a measurement within a time
+// range from one database, ordered by time. Only the shards overlapping
+// the range are read.
+func (m *Manager) GetMeasurementRange(database, measurement string, start, end int64) ([]Point, error) {
+	return m.GetMeasurementRangeContext(context.Background(), database, measurement, start, end)
+}
+
+// GetMeasurementRangeContext is GetMeasurementRange aborting the scan once
+// ctx is done, in which case the returned error wraps ctx.Err()
+func (m *Manager) GetMeasurementRangeContext(ctx context.Context, database, measurement string, start, end int64) ([]Point, error) {
+	if log.IsLevelEnabled(log.TraceLevel) {
+		m.traceRange(database, measurement, start, end)
+	}
 
-	// First, let's check if we have any data for this measurement at all
-	countQuery := `SELECT COUNT(*) FROM points WHERE measurement = ?`
-	var count int
-	err := m.db.QueryRow(countQuery, measurement).Scan(&count)
+	var points []Point
+	err := m.queryShards(ctx, database, measurement, start, end, func(p Point) error {
+		points = append(points, p)
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to count measurements: %w", err)
+		return nil, classify(fmt.Errorf("failed to query measurements: %w", err))
 	}
-	log.Debugf("Total points for measurement %s: %d\n", measurement, count)
+	sort.SliceStable(points, func(i, j int) bool { return points[i].Timestamp < points[j].Timestamp })
+	return points, nil
+}
 
-	// Get the min and max timestamps for this measurement
-	timeRangeQuery := `SELECT MIN(timestamp), MAX(timestamp) FROM points WHERE measurement = ?`
-	var minTime, maxTime int64
-	err = m.db.QueryRow(timeRangeQuery, measurement).Scan(&minTime, &maxTime)
+// GetMeasurementsRange returns the points of several measurements within
+// [start, end], keyed by measurement and each sorted by time like
+// GetMeasurementRange. The measurements are read together, with one query
+// per shard. Measurements without points are left out.
+func (m *Manager) GetMeasurementsRange(database string, measurements []string, start, end int64) (map[string][]Point, error) {
+	return m.GetMeasurementsRangeContext(context.Background(), database, measurements, start, end)
+}
+
+// GetMeasurementsRangeContext is GetMeasurementsRange aborting the scan
+// once ctx is done, in which case the returned error wraps ctx.Err()
+func (m *Manager) GetMeasurementsRangeContext(ctx context.Context, database string, measurements []string, start, end int64) (map[string][]Point, error) {
+	points := make(map[string][]Point, len(measurements))
+	if len(measurements) == 0 {
+		return points, nil
+	}
+	err := m.queryMeasurements(ctx, database, measurements, start, end, func(p Point) error {
+		points[p.Measurement] = append(points[p.Measurement], p)
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get time range: %w", err)
+		return nil, classify(fmt.Errorf("failed to query measurements: %w", err))
+	}
+	for _, list := range points {
+		sort.SliceStable(list, func(i, j int) bool { return list[i].Timestamp < list[j].Timestamp })
+	}
+	return points, nil
+}
+
+// ScanRange calls fn for every point stored between start and end, both
+// inclusive. Points are ordered by database, then by shard time window,
+// then by measurement, series and time. An empty database or measurement
+// scans all of them. Rows are streamed, so arbitrarily large ranges can be
+// walked without loading them in memory. Iteration stops at the first
+// error returned by fn.
+func (m *Manager) ScanRange(database, measurement string, start, end int64, fn func(Point) error) error {
+	return m.ScanRangeContext(context.Background(), database, measurement, start, end, fn)
+}
+
+// ScanRangeContext is ScanRange stopping once ctx is done
+func (m *Manager) ScanRangeContext(ctx context.Context, database, measurement string, start, end int64, fn func(Point) error) error {
+	databases := []string{database}
+	if database == "" {
+		var err error
+		if databases, err = m.ListDatabasesContext(ctx); err != nil {
+			return err
+		}
 	}
-	log.Debugf("Time range for measurement %s: min=%d (UTC: %s), max=%d (UTC: %s)\n",
-		measurement,
-		minTime,
-		time.Unix(0, minTime).UTC().Format(time.RFC3339Nano),
-		maxTime,
-		time.Unix(0, maxTime).UTC().Format(time.RFC3339Nano))
 
-	query := `
-        SELECT timestamp, tags, fields
-        FROM points
-        WHERE measurement = ? AND timestamp >= ? AND timestamp <= ?
-        ORDER BY timestamp
-    `
+	for _, name := range databases {
+		if err := m.queryShards(ctx, name, measurement, start, end, fn); err != nil {
+			return classify(err)
+		}
+	}
+	return nil
+}
 
-	// Log the query parameters
-	log.Debugf("Executing query: %s with params: measurement=%s, start=%d (UTC: %s), end=%d (UTC: %s)\n",
-		query,
-		measurement,
-		start,
-		time.Unix(0, start).UTC().Format(time.RFC3339Nano),
-		end,
-		time.Unix(0, end).UTC().Format(time.RFC3339Nano))
+// ListTimeseries returns the names of the measurements of a database
+func (m *Manager) ListTimeseries(database string) ([]string, error) {
+	return m.ListTimeseriesContext(context.Background(), database)
+}
 
-	rows, err := m.db.Query(query, measurement, start, end)
+// ListTimeseriesContext is ListTimeseries aborting once ctx is done
+func (m *Manager) ListTimeseriesContext(ctx context.Context, database string) ([]string, error) {
+	measurements, err := m.listSeries(ctx, database, "measurement", "")
 	if err != nil {
-		return nil, fmt.Errorf("failed to query measurements: %w", err)
+		return nil, classify(fmt.Errorf("failed to query measurements: %w", err))
 	}
-	defer rows.Close()
+	return measurements, nil
+}
 
-	var points []Point
+// ListSeries returns the keys of the series of a database holding points,
+// sorted. A non-empty measurement restricts them to that measurement.
+func (m *Manager) ListSeries(ctx context.Context, database, measurement string) ([]string, error) {
+	keys, err := m.listSeries(ctx, database, "key", measurement)
+	if err != nil {
+		return nil, classify(fmt.Errorf("failed to query series: %w", err))
+	}
+	return keys, nil
+}
+
+// scanValues adds the string values selected by stmt to set
+func scanValues(ctx context.Context, stmt *sql.Stmt, args []interface{}, set map[string]bool) error {
+	rows, err := stmt.QueryContext(ctx, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 	for rows.Next() {
-		var timestamp int64
-		var tagsJSON, fieldsJSON string
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		set[value] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+	return nil
+}
+
+// listSeries returns the distinct values of a column of the series
+// dictionary over the series of a database that still hold points
+func (m *Manager) listSeries(ctx context.Context, database, column, measurement string) ([]string, error) {
+	id, ok, err := m.databaseID(nil, database)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	filter := `database_id = ?`
+	args := []interface{}{id}
+	if measurement != "" {
+		filter += ` AND measurement = ?`
+		args = append(args, measurement)
+	}
 
-		err := rows.Scan(&timestamp, &tagsJSON, &fieldsJSON)
+	set := make(map[string]bool)
+	for _, s := range m.shards.overlapping(id, math.MinInt64, math.MaxInt64) {
+		exists := `EXISTS (SELECT 1 FROM ` + s.table() + ` p WHERE p.series_id = s.id)`
+		if s.packed {
+			exists += ` OR EXISTS (SELECT 1 FROM ` + s.blocksTable() + ` b WHERE b.series_id = s.id)`
+		}
+		stmt, release, err := m.stmts.get(ctx, `SELECT DISTINCT `+column+` FROM series s WHERE `+filter+` AND (`+exists+`)`)
+		if isMissingTable(err) {
+			continue
+		}
 		if err != nil {
-			return nil, fmt.Errorf("failed to scan row: %w", err)
+			return nil, err
+		}
+		err = scanValues(ctx, stmt, args, set)
+		release()
+		if isMissingTable(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	var values []string
+	for value := range set {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	return values, nil
+}
 
-		// Log each point's timestamp
-		log.Debugf("Found point with timestamp: %d (UTC: %s)\n",
-			timestamp,
-			time.Unix(0, timestamp).UTC().Format(time.RFC3339Nano))
+// createDatabase registers a database inside tx if it does not exist yet
+// and returns its ID. The ID is derived from the name, so a client
+// configured with the ID of a database created by writes keeps reaching
+// it when the database is created again, on this server or another. The
+// caller must hold m.mu.
+func (m *Manager) createDatabase(tx *sql.Tx, name string) (string, error) {
+	stmt, release, err := m.stmts.tx(tx, insertDatabaseQuery)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	now := time.Now().UnixNano()
+	if _, err := stmt.Exec(name, derivedID("bucket", name), m.defaultOrgID, now); err != nil {
+		return "", fmt.Errorf("failed to create database %s: %w", name, err)
+	}
+	id, _, err := m.databaseID(tx, name)
+	return id, err
+}
 
-		var tags map[string]string
-		var fields map[string]float64
+// CreateDatabase creates an empty database. Creating an existing database
+// is a no-op, as in InfluxDB.
+func (m *Manager) CreateDatabase(name string) error {
+	return m.CreateDatabaseContext(context.Background(), name)
+}
 
-		if err := json.Unmarshal([]byte(tagsJSON), &tags); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal tags: %w", err)
-		}
+// CreateDatabaseContext is CreateDatabase giving up once ctx is done
+func (m *Manager) CreateDatabaseContext(ctx context.Context, name string) error {
+	if name == "" {
+		return fmt.Errorf("database name is required")
+	}
 
-		if err := json.Unmarshal([]byte(fieldsJSON), &fields); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal fields: %w", err)
-		}
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-		points = append(points, Point{
-			Measurement: measurement,
-			Tags:        tags,
-			Fields:      fields,
-			Timestamp:   time.Unix(0, timestamp),
-		})
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return classify(fmt.Errorf("failed to begin transaction: %w", err))
+	}
+	if _, err := m.createDatabase(tx, name); err != nil {
+		tx.Rollback()
+		return classify(err)
 	}
+	return classify(tx.Commit())
+}
 
-	if err = rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating rows: %w", err)
+// DropDatabase removes a database and every point it holds. Dropping a
+// database that does not exist is a no-op.
+func (m *Manager) DropDatabase(name string) error {
+	return m.DropDatabaseContext(context.Background(), name)
+}
+
+// DropDatabaseContext is DropDatabase giving up once ctx is done
+func (m *Manager) DropDatabaseContext(ctx context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return classify(fmt.Errorf("failed to begin transaction: %w", err))
 	}
+	defer tx.Rollback()
 
-	return points, nil
+	id, ok, err := m.databaseID(tx, name)
+	if err != nil || !ok {
+		return classify(err)
+	}
+	if err := dropDatabase(tx, id); err != nil {
+		return classify(fmt.Errorf("failed to drop database %s: %w", name, err))
+	}
+	if err := tx.Commit(); err != nil {
+		return classify(fmt.Errorf("failed to drop database %s: %w", name, err))
+	}
+	m.forgetObjects(m.shards.overlapping(id, math.MinInt64, math.MaxInt64))
+	m.shards.removeDatabase(id)
+	m.seriesIDs = make(map[seriesRef]int64)
+	m.state.reset()
+	m.bounds.reset()
+	m.hours.reset()
+	m.seriesIndex.reset()
+	m.writeStats.forget(name)
+	return nil
 }
 
-// ListTimeseries returns a list of all measurement names
-func (m *Manager) ListTimeseries() ([]string, error) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+// dropDatabase drops the shards, series, subscriptions and catalog entry
+// of a database inside tx. The caller must reset the series ID cache once
+// tx commits.
+func dropDatabase(tx *sql.Tx, id string) error {
+	shards, err := databaseShards(tx, id)
+	if err != nil {
+		return err
+	}
+	for _, s := range shards {
+		if err := dropShard(tx, s); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM series WHERE database_id = ?`, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM subscriptions WHERE database_id = ?`, id); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM databases WHERE id = ?`, id)
+	return err
+}
 
-	query := `SELECT DISTINCT measurement FROM points`
+// ListDatabases returns the names of every database, sorted
+func (m *Manager) ListDatabases() ([]string, error) {
+	return m.ListDatabasesContext(context.Background())
+}
 
-	rows, err := m.db.Query(query)
+// ListDatabasesContext is ListDatabases giving up once ctx is done
+func (m *Manager) ListDatabasesContext(ctx context.Context) ([]string, error) {
+	stmt, release, err := m.stmts.get(ctx, listDatabasesQuery)
 	if err != nil {
-		return nil, fmt.Errorf("failed to query measurements: %w", err)
+		return nil, classify(err)
+	}
+	defer release()
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, classify(fmt.Errorf("failed to list databases: %w", err))
 	}
 	defer rows.Close()
 
-	var measurements []string
+	var names []string
 	for rows.Next() {
-		var measurement string
-		if err := rows.Scan(&measurement); err != nil {
+		var name string
+		if err := rows.Scan(&name); err != nil {
 			return nil, fmt.Errorf("failed to scan row: %w", err)
 		}
-		measurements = append(measurements, measurement)
+		names = append(names, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
 	}
+	return names, nil
+}
+
+// Cardinality is the number of measurements and series of a database
+type Cardinality struct {
+	Measurements int64
+	Series       int64
+}
+
+// Cardinality returns the cardinality of every database by name, counted
+// from the series dictionary, so series whose points were all deleted are
+// still counted
+func (m *Manager) Cardinality() (map[string]Cardinality, error) {
+	rows, err := m.db.Query(`SELECT d.name, COUNT(DISTINCT s.measurement), COUNT(s.id)
+		FROM databases d LEFT JOIN series s ON s.database_id = d.id GROUP BY d.name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count series: %w", err)
+	}
+	defer rows.Close()
 
-	if err = rows.Err(); err != nil {
+	counts := make(map[string]Cardinality)
+	for rows.Next() {
+		var name string
+		var c Cardinality
+		if err := rows.Scan(&name, &c.Measurements, &c.Series); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		counts[name] = c
+	}
+	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("error iterating rows: %w", err)
 	}
+	return counts, nil
+}
 
-	return measurements, nil
+// HasDatabase reports whether a database exists
+func (m *Manager) HasDatabase(name string) (bool, error) {
+	var exists bool
+	err := m.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM databases WHERE name = ?)`, name).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up database %s: %w", name, err)
+	}
+	return exists, nil
+}
+
+// ShardDuration returns the time window covered by new shards
+func (m *Manager) ShardDuration() time.Duration {
+	return m.shardDuration
+}
+
+// Size returns the size of the database in bytes
+func (m *Manager) Size() (int64, error) {
+	var pages, pageSize int64
+	if err := m.db.QueryRow(`PRAGMA page_count`).Scan(&pages); err != nil {
+		return 0, fmt.Errorf("failed to read page count: %w", err)
+	}
+	if err := m.db.QueryRow(`PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return 0, fmt.Errorf("failed to read page size: %w", err)
+	}
+	return pages * pageSize, nil
 }
 
 // GetDB returns the underlying database connection
@@ -0,0 +1,2379 @@
+package persistence
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupTestManager(t *testing.T) *Manager {
+	m, err := New(":memory:")
+	assert.NoError(t, err)
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestSeriesKey(t *testing.T) {
+	assert.Equal(t, "cpu", SeriesKey("cpu", nil))
+	assert.Equal(t, "cpu,host=a,region=us", SeriesKey("cpu", map[string]string{"region": "us", "host": "a"}))
+	assert.Equal(t, `my\ cpu,host=a\,b\=c`, SeriesKey("my cpu", map[string]string{"host": "a,b=c"}))
+	assert.NotEqual(t,
+		SeriesKey("cpu", map[string]string{"a": "b,c=d"}),
+		SeriesKey("cpu", map[string]string{"a": "b", "c": "d"}))
+}
+
+func TestSaveBatchUpsert(t *testing.T) {
+	m := setupTestManager(t)
+	ts := time.Unix(0, 1556813561098000000)
+	tags := map[string]string{"host": "server1"}
+
+	batch := []Point{
+		{Measurement: "cpu", Tags: tags, Fields: map[string]float64{"user": 1, "system": 2}, Timestamp: ts.UnixNano()},
+		{Measurement: "cpu", Tags: map[string]string{"host": "server2"}, Fields: map[string]float64{"user": 5}, Timestamp: ts.UnixNano()},
+	}
+
+	// Re-sending the same batch must not create duplicates
+	assert.NoError(t, m.SaveBatch(batch))
+	assert.NoError(t, m.SaveBatch(batch))
+
+	points, err := m.GetMeasurementRange(DefaultDatabase, "cpu", 0, ts.UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+
+	// Writing a new field set for an existing point merges the fields
+	assert.NoError(t, m.SaveMeasurement(DefaultDatabase, "cpu", map[string]float64{"user": 3, "idle": 95}, tags, ts.UnixNano()))
+
+	points, err = m.GetMeasurementRange(DefaultDatabase, "cpu", 0, ts.UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+	for _, p := range points {
+		if p.Tags["host"] == "server1" {
+			assert.Equal(t, map[string]float64{"user": 3, "system": 2, "idle": 95}, p.Fields)
+		}
+	}
+}
+
+func TestGetMeasurementsRange(t *testing.T) {
+	m := setupTestManager(t)
+	ts := time.Unix(0, 1556813561098000000)
+	assert.NoError(t, m.SaveBatch([]Point{
+		{Measurement: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"user": 2}, Timestamp: ts.Add(time.Second).UnixNano()},
+		{Measurement: "cpu", Tags: map[string]string{"host": "b"}, Fields: map[string]float64{"user": 1}, Timestamp: ts.UnixNano()},
+		{Measurement: "mem", Fields: map[string]float64{"used": 3}, Timestamp: ts.UnixNano()},
+		{Measurement: "disk", Fields: map[string]float64{"free": 4}, Timestamp: ts.UnixNano()},
+	}))
+
+	got, err := m.GetMeasurementsRange(DefaultDatabase, []string{"cpu", "mem", "missing"}, 0, ts.Add(time.Second).UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, got, 2)
+	if assert.Len(t, got["cpu"], 2) {
+		assert.Equal(t, "b", got["cpu"][0].Tags["host"])
+		assert.Equal(t, "a", got["cpu"][1].Tags["host"])
+	}
+	assert.Len(t, got["mem"], 1)
+
+	got, err = m.GetMeasurementsRange(DefaultDatabase, nil, 0, ts.UnixNano())
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestMigrateLegacySchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+
+	legacy, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	_, err = legacy.Exec(`
+    CREATE TABLE points (
+        id INTEGER PRIMARY KEY,
+        measurement TEXT NOT NULL,
+        timestamp INTEGER NOT NULL,
+        tags TEXT NOT NULL,
+        fields TEXT NOT NULL
+    );
+    INSERT INTO points (measurement, timestamp, tags, fields) VALUES
+        ('memory', 100, '{"host":"a"}', '{"used":1}'),
+        ('memory', 100, '{"host":"a"}', '{"free":2}'),
+        ('memory', 100, '{"host":"a"}', '{"used":3}'),
+        ('memory', 200, '{"host":"a"}', '{"used":4}'),
+        ('memory', 100, 'null', '{"used":5}');
+    `)
+	assert.NoError(t, err)
+	assert.NoError(t, legacy.Close())
+
+	m, err := New(path)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	points, err := m.GetMeasurementRange(DefaultDatabase, "memory", 0, 300)
+	assert.NoError(t, err)
+	assert.Len(t, points, 3)
+	for _, p := range points {
+		if p.Tags["host"] == "a" && p.Timestamp == 100 {
+			assert.Equal(t, map[string]float64{"used": 3, "free": 2}, p.Fields)
+		}
+	}
+
+	var version int
+	assert.NoError(t, m.GetDB().QueryRow(`PRAGMA user_version`).Scan(&version))
+	assert.Equal(t, len(migrations), version)
+
+	// Reopening an up to date database is a no-op
+	assert.NoError(t, m.Close())
+	m, err = New(path)
+	assert.NoError(t, err)
+	points, err = m.GetMeasurementRange(DefaultDatabase, "memory", 0, 300)
+	assert.NoError(t, err)
+	assert.Len(t, points, 3)
+}
+
+func TestScanRange(t *testing.T) {
+	m := setupTestManager(t)
+	assert.NoError(t, m.SaveBatch([]Point{
+		{Measurement: "mem", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"used": 1}, Timestamp: 300},
+		{Measurement: "cpu", Tags: map[string]string{"host": "b"}, Fields: map[string]float64{"user": 2}, Timestamp: 100},
+		{Measurement: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"user": 3}, Timestamp: 200},
+		{Measurement: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"user": 4}, Timestamp: 100},
+	}))
+
+	var got []string
+	collect := func(p Point) error {
+		got = append(got, fmt.Sprintf("%s %d", SeriesKey(p.Measurement, p.Tags), p.Timestamp))
+		return nil
+	}
+
+	assert.NoError(t, m.ScanRange("", "", 0, 1000, collect))
+	assert.Equal(t, []string{"cpu,host=a 100", "cpu,host=a 200", "cpu,host=b 100", "mem,host=a 300"}, got)
+
+	got = nil
+	assert.NoError(t, m.ScanRange("", "cpu", 150, 1000, collect))
+	assert.Equal(t, []string{"cpu,host=a 200"}, got)
+
+	stop := errors.New("stop")
+	assert.ErrorIs(t, m.ScanRange("", "", 0, 1000, func(Point) error { return stop }), stop)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, m.ScanRangeContext(ctx, "", "", 0, 1000, collect), context.Canceled)
+	_, err := m.GetMeasurementRangeContext(ctx, DefaultDatabase, "cpu", 0, 1000)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestSeriesState(t *testing.T) {
+	m := setupTestManager(t)
+	ctx := context.Background()
+	cpu := func(host string, ts int64, v float64) Point {
+		return Point{Measurement: "cpu", Tags: map[string]string{"host": host}, Fields: map[string]float64{"value": v}, Timestamp: ts}
+	}
+	assert.NoError(t, m.SaveBatch([]Point{cpu("a", 100, 1), cpu("b", 200, 2), cpu("a", 300, 3)}))
+
+	// The first query loads the measurement
+	ts, v, ok, err := m.LastValue(ctx, DefaultDatabase, "cpu", "value", 0, 1000)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(300), ts)
+	assert.Equal(t, 3.0, v)
+
+	// Writes then keep it up to date
+	assert.NoError(t, m.SaveBatch([]Point{cpu("b", 400, 4), cpu("c", 50, 5)}))
+	hits := stateHits.Value()
+	ts, v, ok, err = m.LastValue(ctx, DefaultDatabase, "cpu", "value", 0, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(400), 4.0, true}, []interface{}{ts, v, ok})
+	ts, v, ok, err = m.FirstValue(ctx, DefaultDatabase, "cpu", "value", 0, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(50), 5.0, true}, []interface{}{ts, v, ok})
+	assert.Equal(t, hits+2, stateHits.Value())
+
+	// Ranges ending before the newest value scan storage
+	ts, v, ok, err = m.LastValue(ctx, DefaultDatabase, "cpu", "value", 0, 250)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(200), 2.0, true}, []interface{}{ts, v, ok})
+	_, _, ok, err = m.LastValue(ctx, DefaultDatabase, "cpu", "value", 500, 1000)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	_, _, ok, err = m.LastValue(ctx, DefaultDatabase, "cpu", "missing", 0, 1000)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Deletes reset the cache
+	_, err = m.DeleteBefore(DefaultDatabase, time.Unix(0, 150))
+	assert.NoError(t, err)
+	ts, v, ok, err = m.FirstValue(ctx, DefaultDatabase, "cpu", "value", 0, 1000)
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(200), 2.0, true}, []interface{}{ts, v, ok})
+}
+
+func TestDatabases(t *testing.T) {
+	m := setupTestManager(t)
+	ts := time.Unix(0, 100)
+	fields := map[string]float64{"value": 1}
+
+	// Writes create their database, and identical series stay isolated
+	assert.NoError(t, m.SaveBatch([]Point{
+		{Database: "telegraf", Measurement: "cpu", Fields: fields, Timestamp: ts.UnixNano()},
+		{Database: "collectd", Measurement: "cpu", Fields: map[string]float64{"value": 2}, Timestamp: ts.UnixNano()},
+		{Measurement: "mem", Fields: fields, Timestamp: ts.UnixNano()},
+	}))
+	assert.NoError(t, m.CreateDatabase("empty"))
+	assert.NoError(t, m.CreateDatabase("empty"))
+
+	names, err := m.ListDatabases()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"collectd", DefaultDatabase, "empty", "telegraf"}, names)
+
+	points, err := m.GetMeasurementRange("telegraf", "cpu", 0, 1000)
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+	assert.Equal(t, 1.0, points[0].Fields["value"])
+	assert.Equal(t, "telegraf", points[0].Database)
+
+	measurements, err := m.ListTimeseries(DefaultDatabase)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mem"}, measurements)
+
+	assert.NoError(t, m.DropDatabase("collectd"))
+	exists, err := m.HasDatabase("collectd")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	points, err = m.GetMeasurementRange("collectd", "cpu", 0, 1000)
+	assert.NoError(t, err)
+	assert.Empty(t, points)
+
+	exists, err = m.HasDatabase("telegraf")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Error(t, m.CreateDatabase(""))
+}
+
+func TestSubscriptions(t *testing.T) {
+	m := setupTestManager(t)
+	assert.NoError(t, m.CreateDatabase("mydb"))
+
+	var observed []Point
+	m.OnWrite(func(points []Point) { observed = append(observed, points...) })
+
+	sub := Subscription{Name: "mirror", Database: "mydb", Mode: SubscriptionAll, Destinations: []string{"http://a:8086", "udp://b:8089"}}
+	assert.NoError(t, m.AddSubscription(sub))
+	assert.ErrorIs(t, m.AddSubscription(sub), ErrSubscriptionExists)
+	assert.ErrorIs(t, m.AddSubscription(Subscription{Name: "x", Database: "missing", Mode: SubscriptionAny, Destinations: []string{"udp://b:8089"}}), ErrDatabaseNotFound)
+	assert.Error(t, m.AddSubscription(Subscription{Name: "x", Database: "mydb", Mode: "SOME", Destinations: []string{"udp://b:8089"}}))
+
+	subs, err := m.Subscriptions()
+	assert.NoError(t, err)
+	if assert.Len(t, subs, 1) {
+		assert.Equal(t, sub.Destinations, subs[0].Destinations)
+		assert.Equal(t, SubscriptionAll, subs[0].Mode)
+		assert.Empty(t, subs[0].Measurements)
+	}
+
+	// Observers see committed batches
+	assert.NoError(t, m.SaveBatch([]Point{{Database: "mydb", Measurement: "cpu", Fields: map[string]float64{"value": 1}, Timestamp: 100}}))
+	assert.Len(t, observed, 1)
+
+	assert.NoError(t, m.DropSubscription("mydb", "mirror"))
+	assert.ErrorIs(t, m.DropSubscription("mydb", "mirror"), ErrSubscriptionNotFound)
+
+	// Dropping a database drops its subscriptions
+	assert.NoError(t, m.AddSubscription(sub))
+	assert.NoError(t, m.DropDatabase("mydb"))
+	subs, err = m.Subscriptions()
+	assert.NoError(t, err)
+	assert.Empty(t, subs)
+}
+
+func TestTasks(t *testing.T) {
+	m := setupTestManager(t)
+	org, err := m.AddOrganization(Organization{Name: "acme"})
+	assert.NoError(t, err)
+
+	latest := time.Unix(3600, 0).UTC()
+	task, err := m.AddTask(Task{
+		OrgID: org.ID, Name: "downsample", Status: TaskActive,
+		Query: "SELECT mean(value) FROM cpu", Database: "raw", Destination: "hourly",
+		Every: time.Hour, Offset: time.Minute, MaxRetries: 2, LatestCompleted: latest,
+	})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, task.ID)
+	assert.Equal(t, time.Hour, task.Every)
+	assert.Equal(t, latest, task.LatestCompleted)
+
+	task.Query = "SELECT max(value) FROM cpu"
+	task.Status = TaskInactive
+	updated, err := m.UpdateTask(task)
+	assert.NoError(t, err)
+	assert.Equal(t, "SELECT max(value) FROM cpu", updated.Query)
+	assert.Equal(t, TaskInactive, updated.Status)
+	_, err = m.UpdateTask(Task{ID: "missing", Name: "x"})
+	assert.ErrorIs(t, err, ErrTaskNotFound)
+
+	assert.NoError(t, m.SetTaskCompleted(task.ID, latest.Add(time.Hour)))
+	task, err = m.GetTask(task.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, latest.Add(time.Hour), task.LatestCompleted)
+
+	// The history keeps the latest runs, newest first
+	for i := 0; i < maxTaskRuns+5; i++ {
+		_, err := m.AddTaskRun(TaskRun{TaskID: task.ID, Status: RunSuccess, StartedAt: time.Unix(int64(i), 0), Attempts: 1})
+		assert.NoError(t, err)
+	}
+	runs, err := m.TaskRuns(task.ID, 0)
+	assert.NoError(t, err)
+	assert.Len(t, runs, maxTaskRuns)
+	assert.Equal(t, time.Unix(maxTaskRuns+4, 0).UTC(), runs[0].StartedAt)
+	run, err := m.GetTaskRun(task.ID, runs[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, runs[0], run)
+	_, err = m.GetTaskRun("other", runs[0].ID)
+	assert.ErrorIs(t, err, ErrTaskRunNotFound)
+
+	assert.NoError(t, m.DeleteTask(task.ID))
+	assert.ErrorIs(t, m.DeleteTask(task.ID), ErrTaskNotFound)
+	runs, err = m.TaskRuns(task.ID, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, runs)
+
+	// Deleting an organization deletes its tasks
+	_, err = m.AddTask(Task{OrgID: org.ID, Name: "other", Status: TaskActive, Every: time.Minute})
+	assert.NoError(t, err)
+	assert.NoError(t, m.DeleteOrganization(org.ID))
+	tasks, err := m.Tasks()
+	assert.NoError(t, err)
+	assert.Empty(t, tasks)
+}
+
+func TestDatabaseCatalog(t *testing.T) {
+	m := setupTestManager(t)
+
+	d, err := m.AddDatabase(Database{Name: "metrics", OrgID: "org1", Description: "app metrics", RetentionPeriod: time.Hour})
+	assert.NoError(t, err)
+	assert.Len(t, d.ID, 16)
+	assert.Equal(t, "org1", d.OrgID)
+	assert.Equal(t, time.Hour, d.RetentionPeriod)
+	assert.False(t, d.CreatedAt.IsZero())
+
+	_, err = m.AddDatabase(Database{Name: "metrics"})
+	assert.ErrorIs(t, err, ErrDatabaseExists)
+
+	byID, err := m.GetDatabaseByID(d.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, d, byID)
+	_, err = m.GetDatabase("missing")
+	assert.ErrorIs(t, err, ErrDatabaseNotFound)
+
+	// Renaming moves the points along with the catalog entry
+	now := time.Now()
+	assert.NoError(t, m.SaveBatch([]Point{
+		{Database: "metrics", Measurement: "cpu", Fields: map[string]float64{"value": 1}, Timestamp: now.Add(-2 * time.Hour).UnixNano()},
+		{Database: "metrics", Measurement: "cpu", Fields: map[string]float64{"value": 2}, Timestamp: now.UnixNano()},
+		{Database: "other", Measurement: "cpu", Fields: map[string]float64{"value": 3}, Timestamp: now.Add(-2 * time.Hour).UnixNano()},
+	}))
+	name, forever := "app", time.Duration(0)
+	_, err = m.UpdateDatabase(d.ID, DatabaseUpdate{Name: &name})
+	assert.NoError(t, err)
+	points, err := m.GetMeasurementRange("app", "cpu", 0, now.UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+
+	taken := "other"
+	_, err = m.UpdateDatabase(d.ID, DatabaseUpdate{Name: &taken})
+	assert.ErrorIs(t, err, ErrDatabaseExists)
+	_, err = m.UpdateDatabase("missing", DatabaseUpdate{Name: &name})
+	assert.ErrorIs(t, err, ErrDatabaseNotFound)
+
+	// Retention only expires points of databases with a retention period
+	deleted, err := m.EnforceRetention(now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	points, err = m.GetMeasurementRange("other", "cpu", 0, now.UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+
+	updated, err := m.UpdateDatabase(d.ID, DatabaseUpdate{RetentionPeriod: &forever})
+	assert.NoError(t, err)
+	assert.Equal(t, "app", updated.Name)
+	assert.Equal(t, "app metrics", updated.Description)
+	assert.Zero(t, updated.RetentionPeriod)
+}
+
+func TestOrganizations(t *testing.T) {
+	m := setupTestManager(t)
+	assert.NoError(t, m.CreateDatabase("legacy"))
+
+	// The default org adopts existing databases and the ones created later
+	org, err := m.SetDefaultOrganization("my-org")
+	assert.NoError(t, err)
+	assert.Equal(t, org.ID, m.DefaultOrganizationID())
+	again, err := m.SetDefaultOrganization("my-org")
+	assert.NoError(t, err)
+	assert.Equal(t, org.ID, again.ID)
+
+	assert.NoError(t, m.CreateDatabase("created"))
+	for _, name := range []string{"legacy", "created"} {
+		d, err := m.GetDatabase(name)
+		assert.NoError(t, err)
+		assert.Equal(t, org.ID, d.OrgID)
+	}
+
+	acme, err := m.AddOrganization(Organization{Name: "acme"})
+	assert.NoError(t, err)
+	_, err = m.AddOrganization(Organization{Name: "acme"})
+	assert.ErrorIs(t, err, ErrOrganizationExists)
+
+	taken := "my-org"
+	_, err = m.UpdateOrganization(acme.ID, OrganizationUpdate{Name: &taken})
+	assert.ErrorIs(t, err, ErrOrganizationExists)
+	description := "tenant"
+	acme, err = m.UpdateOrganization(acme.ID, OrganizationUpdate{Description: &description})
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant", acme.Description)
+
+	_, err = m.AddDatabase(Database{Name: "acme-data", OrgID: acme.ID})
+	assert.NoError(t, err)
+	assert.NoError(t, m.DeleteOrganization(acme.ID))
+	_, err = m.GetDatabase("acme-data")
+	assert.ErrorIs(t, err, ErrDatabaseNotFound)
+	_, err = m.GetOrganizationByID(acme.ID)
+	assert.ErrorIs(t, err, ErrOrganizationNotFound)
+
+	orgs, err := m.Organizations()
+	assert.NoError(t, err)
+	assert.Len(t, orgs, 1)
+}
+
+func TestDerivedIDs(t *testing.T) {
+	// Implicitly created organizations and databases get the same ID on
+	// every server
+	ids := func() (string, string) {
+		m := setupTestManager(t)
+		org, err := m.SetDefaultOrganization("my-org")
+		assert.NoError(t, err)
+		assert.NoError(t, m.CreateDatabase("telegraf"))
+		d, err := m.GetDatabase("telegraf")
+		assert.NoError(t, err)
+		return org.ID, d.ID
+	}
+	orgID, databaseID := ids()
+	againOrg, againDatabase := ids()
+	assert.Equal(t, orgID, againOrg)
+	assert.Equal(t, databaseID, againDatabase)
+	assert.Len(t, databaseID, 16)
+	assert.NotEqual(t, orgID, databaseID)
+
+	// A renamed database keeps its ID, so the database created again
+	// under the old name gets another one
+	m := setupTestManager(t)
+	assert.NoError(t, m.CreateDatabase("telegraf"))
+	renamed := "renamed"
+	_, err := m.UpdateDatabase(databaseID, DatabaseUpdate{Name: &renamed})
+	assert.NoError(t, err)
+	assert.NoError(t, m.CreateDatabase("telegraf"))
+	d, err := m.GetDatabase("telegraf")
+	assert.NoError(t, err)
+	assert.NotEqual(t, databaseID, d.ID)
+
+	// Explicitly created organizations keep random IDs
+	acme, err := m.AddOrganization(Organization{Name: "acme"})
+	assert.NoError(t, err)
+	assert.NotEqual(t, derivedID("org", "acme"), acme.ID)
+}
+
+func TestOptions(t *testing.T) {
+	m, err := NewWithOptions(filepath.Join(t.TempDir(), "wal.db"), DefaultOptions())
+	assert.NoError(t, err)
+	defer m.Close()
+
+	var mode string
+	var timeout int
+	assert.NoError(t, m.db.QueryRow(`PRAGMA journal_mode`).Scan(&mode))
+	assert.NoError(t, m.db.QueryRow(`PRAGMA busy_timeout`).Scan(&timeout))
+	assert.Equal(t, "wal", mode)
+	assert.Equal(t, 5000, timeout)
+	var autoVacuum int
+	assert.NoError(t, m.db.QueryRow(`PRAGMA auto_vacuum`).Scan(&autoVacuum))
+	assert.Equal(t, autoVacuumIncremental, autoVacuum)
+
+	assert.Error(t, Options{JournalMode: "fast"}.Validate())
+	assert.Error(t, Options{Synchronous: "sometimes"}.Validate())
+	assert.Error(t, Options{MaxOpenConns: -1}.Validate())
+	assert.Equal(t, "file:x.db?mode=ro&_auto_vacuum=incremental&_busy_timeout=1000", Options{BusyTimeout: time.Second}.dsn("file:x.db?mode=ro"))
+}
+
+func TestDurability(t *testing.T) {
+	assert.Error(t, Options{Durability: "never"}.Validate())
+	assert.Error(t, Options{FsyncInterval: -time.Second}.Validate())
+	assert.Equal(t, "FULL", Options{Durability: DurabilityBatch, Synchronous: "NORMAL"}.synchronous())
+	assert.Equal(t, "EXTRA", Options{Durability: DurabilityBatch, Synchronous: "EXTRA"}.synchronous())
+	assert.Equal(t, "NORMAL", Options{Durability: DurabilityPeriodic, Synchronous: "NORMAL"}.synchronous())
+	assert.Equal(t, "x.db", filePath("file:x.db?mode=ro"))
+
+	// Batches wait for the disk, without a periodic flush
+	opts := DefaultOptions()
+	opts.Durability = DurabilityBatch
+	m, err := NewWithOptions(filepath.Join(t.TempDir(), "batch.db"), opts)
+	assert.NoError(t, err)
+	var sync int
+	assert.NoError(t, m.db.QueryRow(`PRAGMA synchronous`).Scan(&sync))
+	assert.Equal(t, 2, sync) // FULL
+	assert.Nil(t, m.syncer)
+	assert.NoError(t, m.Close())
+
+	// Files are flushed every interval and when closed
+	opts = DefaultOptions()
+	opts.FsyncInterval = 10 * time.Millisecond
+	m, err = NewWithOptions(filepath.Join(t.TempDir(), "periodic.db"), opts)
+	assert.NoError(t, err)
+	assert.NoError(t, m.db.QueryRow(`PRAGMA synchronous`).Scan(&sync))
+	assert.Equal(t, 1, sync) // NORMAL
+	before := fsyncs.Value()
+	assert.NoError(t, m.SaveBatch(benchmarkBatch("a", 0, 10)))
+	assert.Eventually(t, func() bool { return fsyncs.Value() > before }, time.Second, 5*time.Millisecond)
+	assert.NoError(t, m.Sync())
+	assert.NoError(t, m.Close())
+}
+
+func TestErrorClasses(t *testing.T) {
+	m := setupTestManager(t)
+	_, err := m.GetDatabaseByID("missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+	assert.ErrorIs(t, err, ErrDatabaseNotFound)
+	_, err = m.AddDatabase(Database{Name: "db"})
+	assert.NoError(t, err)
+	_, err = m.AddDatabase(Database{Name: "db"})
+	assert.ErrorIs(t, err, ErrConflict)
+	assert.NotErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, "database already exists", err.Error())
+
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	err = m.SaveBatchContext(ctx, benchmarkBatch("db", 0, 1))
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.NoError(t, classify(nil))
+	assert.NotErrorIs(t, classify(context.Canceled), ErrTimeout)
+
+	// A write waiting for the lock of another connection gives up after
+	// the busy timeout
+	path := filepath.Join(t.TempDir(), "locked.db")
+	opts := DefaultOptions()
+	opts.BusyTimeout = 10 * time.Millisecond
+	m, err = NewWithOptions(path, opts)
+	assert.NoError(t, err)
+	defer m.Close()
+	other, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	defer other.Close()
+	tx, err := other.Begin()
+	assert.NoError(t, err)
+	_, err = tx.Exec(`CREATE TABLE lock (x INTEGER)`)
+	assert.NoError(t, err)
+	err = m.SaveBatch(benchmarkBatch("db", 0, 1))
+	assert.ErrorIs(t, err, ErrTimeout)
+	assert.NoError(t, tx.Rollback())
+	assert.NoError(t, m.SaveBatch(benchmarkBatch("db", 0, 1)))
+}
+
+func TestConcurrentReadWrite(t *testing.T) {
+	m, err := NewWithOptions(filepath.Join(t.TempDir(), "concurrent.db"), DefaultOptions())
+	assert.NoError(t, err)
+	defer m.Close()
+
+	// Readers on their own connections run while batches are written,
+	// which used to fail with "database is locked"
+	errs := make(chan error, 16)
+	done := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		go func(w int) {
+			for i := 0; i < 20; i++ {
+				errs <- m.SaveBatch(benchmarkBatch(fmt.Sprintf("host%d", w), int64(i*100), 100))
+			}
+		}(w)
+	}
+	for r := 0; r < 4; r++ {
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if _, err := m.GetMeasurementRange(DefaultDatabase, "cpu", 0, 1<<62); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 80; i++ {
+		assert.NoError(t, <-errs)
+	}
+	close(done)
+
+	points, err := m.GetMeasurementRange(DefaultDatabase, "cpu", 0, 1<<62)
+	assert.NoError(t, err)
+	assert.Len(t, points, 4*20*100)
+}
+
+func benchmarkBatch(host string, start int64, n int) []Point {
+	points := make([]Point, n)
+	for i := range points {
+		points[i] = Point{
+			Measurement: "cpu",
+			Tags:        map[string]string{"host": host},
+			Fields:      map[string]float64{"value": float64(i)},
+			Timestamp:   start + int64(i),
+		}
+	}
+	return points
+}
+
+// benchmarkOptions compares the SQLite defaults of earlier releases with
+// the current ones
+var benchmarkOptions = []struct {
+	name string
+	opts Options
+}{
+	{"delete-full", Options{JournalMode: "DELETE", Synchronous: "FULL", BusyTimeout: 5 * time.Second, MaxOpenConns: 8, MaxIdleConns: 8}},
+	{"wal-normal", DefaultOptions()},
+}
+
+func BenchmarkSaveBatch(b *testing.B) {
+	for _, bo := range benchmarkOptions {
+		b.Run(bo.name, func(b *testing.B) {
+			m, err := NewWithOptions(filepath.Join(b.TempDir(), "bench.db"), bo.opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer m.Close()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := m.SaveBatch(benchmarkBatch("a", int64(i)*1000, 1000)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N*1000)/b.Elapsed().Seconds(), "points/s")
+		})
+	}
+}
+
+// BenchmarkWritePath measures the small writes and queries whose cost is
+// dominated by statement preparation rather than by the rows themselves
+func BenchmarkWritePath(b *testing.B) {
+	setup := func(b *testing.B) *Manager {
+		m, err := NewWithOptions(filepath.Join(b.TempDir(), "bench.db"), DefaultOptions())
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Cleanup(func() { m.Close() })
+		return m
+	}
+	hosts := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+
+	b.Run("SaveMeasurement", func(b *testing.B) {
+		m := setup(b)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			tags := map[string]string{"host": hosts[i%len(hosts)]}
+			if err := m.SaveMeasurement("db", "cpu", map[string]float64{"value": float64(i)}, tags, int64(i)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "points/s")
+	})
+
+	b.Run("SaveBatch-10", func(b *testing.B) {
+		m := setup(b)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := m.SaveBatch(benchmarkBatch(hosts[i%len(hosts)], int64(i)*10, 10)); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(b.N*10)/b.Elapsed().Seconds(), "points/s")
+	})
+
+	b.Run("GetMeasurementRange", func(b *testing.B) {
+		m := setup(b)
+		if err := m.SaveBatch(benchmarkBatch("a", 0, 1000)); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			start := int64(i % 990)
+			if _, err := m.GetMeasurementRange(DefaultDatabase, "cpu", start, start+9); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// The statement alone, prepared on every call as before the cache or
+	// taken from it once, within a transaction so that commits do not
+	// dominate
+	for _, cached := range []bool{false, true} {
+		name := "InsertSeries/Prepared"
+		if cached {
+			name = "InsertSeries/Cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			m := setup(b)
+			tx, err := m.db.Begin()
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer tx.Rollback()
+			stmt, release, err := m.stmts.tx(tx, insertSeriesQuery)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer release()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				key := fmt.Sprintf("cpu,host=%d", i)
+				if cached {
+					_, err = stmt.Exec("db", "cpu", key, "{}")
+				} else {
+					_, err = tx.Exec(insertSeriesQuery, "db", "cpu", key, "{}")
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkQueryDuringWrites(b *testing.B) {
+	for _, bo := range benchmarkOptions {
+		b.Run(bo.name, func(b *testing.B) {
+			m, err := NewWithOptions(filepath.Join(b.TempDir(), "bench.db"), bo.opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer m.Close()
+			if err := m.SaveBatch(benchmarkBatch("a", 0, 1000)); err != nil {
+				b.Fatal(err)
+			}
+
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				for i := int64(1); ; i++ {
+					select {
+					case <-done:
+						return
+					default:
+						m.SaveBatch(benchmarkBatch("b", i*1000, 1000))
+					}
+				}
+			}()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := m.GetMeasurementRange(DefaultDatabase, "cpu", 0, 999); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestShardWindow(t *testing.T) {
+	hour := int64(time.Hour)
+	start, end := shardWindow(90*int64(time.Minute), time.Hour, nil)
+	assert.Equal(t, []int64{hour, 2 * hour}, []int64{start, end})
+
+	// Negative timestamps align down as well
+	start, end = shardWindow(-1, time.Hour, nil)
+	assert.Equal(t, []int64{-hour, 0}, []int64{start, end})
+
+	// Windows are clipped around shards created with another duration
+	existing := []shard{{start: 0, end: hour}, {start: 3 * hour, end: 4 * hour}}
+	start, end = shardWindow(2*hour, 24*time.Hour, existing)
+	assert.Equal(t, []int64{hour, 3 * hour}, []int64{start, end})
+}
+
+func TestShards(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ShardDuration = time.Hour
+	path := filepath.Join(t.TempDir(), "shards.db")
+	m, err := NewWithOptions(path, opts)
+	assert.NoError(t, err)
+	defer func() { m.Close() }()
+
+	base := time.Date(2025, 3, 19, 0, 0, 0, 0, time.UTC)
+	var points []Point
+	for i := 0; i < 6; i++ {
+		points = append(points, Point{Database: "metrics", Measurement: "cpu", Fields: map[string]float64{"value": float64(i)}, Timestamp: base.Add(time.Duration(i) * 30 * time.Minute).UnixNano()})
+	}
+	assert.NoError(t, m.SaveBatch(points))
+	assert.Equal(t, 3, m.ShardCount())
+
+	// Queries spanning shards return points in time order
+	got, err := m.GetMeasurementRange("metrics", "cpu", base.Add(45*time.Minute).UnixNano(), base.Add(3*time.Hour).UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, got, 4)
+	assert.Equal(t, 2.0, got[0].Fields["value"])
+	assert.Equal(t, 5.0, got[3].Fields["value"])
+
+	// Whole shards older than the cutoff are dropped, the one holding the
+	// cutoff is trimmed
+	deleted, err := m.DeleteBefore("metrics", base.Add(90*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), deleted)
+	assert.Equal(t, 2, m.ShardCount())
+
+	// Renaming keeps the shards, and a new duration only affects new shards
+	d, err := m.GetDatabase("metrics")
+	assert.NoError(t, err)
+	name := "renamed"
+	_, err = m.UpdateDatabase(d.ID, DatabaseUpdate{Name: &name})
+	assert.NoError(t, err)
+	assert.NoError(t, m.Close())
+
+	opts.ShardDuration = 24 * time.Hour
+	m, err = NewWithOptions(path, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, m.SaveBatch([]Point{{Database: "renamed", Measurement: "cpu", Fields: map[string]float64{"value": 6}, Timestamp: base.Add(5 * time.Hour).UnixNano()}}))
+	assert.Equal(t, 3, m.ShardCount())
+	got, err = m.GetMeasurementRange("renamed", "cpu", 0, base.Add(24*time.Hour).UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, got, 4)
+
+	// Compaction drops shards emptied by deletes
+	deleted, err = m.DeleteBefore("renamed", base.Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	remaining := m.shards.overlapping(d.ID, base.Add(2*time.Hour).UnixNano(), base.Add(2*time.Hour).UnixNano())
+	assert.Len(t, remaining, 1)
+	dropped, err := m.CompactShards()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, dropped)
+	_, err = m.GetDB().Exec(`DELETE FROM ` + remaining[0].table())
+	assert.NoError(t, err)
+	dropped, err = m.CompactShards()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dropped)
+	assert.Equal(t, 1, m.ShardCount())
+
+	assert.NoError(t, m.DropDatabase("renamed"))
+	assert.Equal(t, 0, m.ShardCount())
+}
+
+func TestSeriesDictionary(t *testing.T) {
+	m := setupTestManager(t)
+	defer m.Close()
+
+	ts := time.Unix(0, 1000)
+	tags := map[string]string{"host": "a", "region": "us"}
+	assert.NoError(t, m.SaveBatch([]Point{
+		{Database: "db1", Measurement: "cpu", Tags: tags, Fields: map[string]float64{"value": 1}, Timestamp: ts.UnixNano()},
+		{Database: "db1", Measurement: "cpu", Tags: tags, Fields: map[string]float64{"value": 2}, Timestamp: ts.Add(time.Second).UnixNano()},
+		{Database: "db2", Measurement: "cpu", Tags: tags, Fields: map[string]float64{"value": 3}, Timestamp: ts.UnixNano()},
+	}))
+
+	// Points of a series share one dictionary entry per database
+	var n int
+	assert.NoError(t, m.db.QueryRow(`SELECT COUNT(*) FROM series`).Scan(&n))
+	assert.Equal(t, 2, n)
+
+	got, err := m.GetMeasurementRange("db1", "cpu", 0, ts.Add(time.Minute).UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, got, 2)
+	assert.Equal(t, tags, got[1].Tags)
+
+	assert.NoError(t, m.DropDatabase("db1"))
+	assert.NoError(t, m.db.QueryRow(`SELECT COUNT(*) FROM series`).Scan(&n))
+	assert.Equal(t, 1, n)
+
+	// Dropped series IDs are not served from the cache
+	assert.NoError(t, m.SaveBatch([]Point{{Database: "db1", Measurement: "cpu", Tags: tags, Fields: map[string]float64{"value": 4}, Timestamp: ts.UnixNano()}}))
+	got, err = m.GetMeasurementRange("db1", "cpu", 0, ts.UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, got, 1)
+	assert.Equal(t, tags, got[0].Tags)
+}
+
+func TestFieldCompression(t *testing.T) {
+	opts := DefaultOptions()
+	opts.CompressFields = true
+	m, err := NewWithOptions(filepath.Join(t.TempDir(), "compressed.db"), opts)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	large := make(map[string]float64)
+	for i := 0; i < 20; i++ {
+		large[fmt.Sprintf("field_%02d", i)] = 1.5
+	}
+	ts := time.Unix(0, 1000)
+	assert.NoError(t, m.SaveBatch([]Point{
+		{Measurement: "cpu", Fields: large, Timestamp: ts.UnixNano()},
+		{Measurement: "mem", Fields: map[string]float64{"used": 1}, Timestamp: ts.UnixNano()},
+	}))
+
+	countBlobs := func() int {
+		var n int
+		for _, s := range m.shards.overlapping(testDatabaseID(t, m, DefaultDatabase), math.MinInt64, math.MaxInt64) {
+			var c int
+			assert.NoError(t, m.db.QueryRow(`SELECT COUNT(*) FROM `+s.table()+` WHERE typeof(fields) = 'blob'`).Scan(&c))
+			n += c
+		}
+		return n
+	}
+	// Only field sets that shrink are compressed
+	assert.Equal(t, 1, countBlobs())
+
+	// Writes to a compressed point are merged
+	assert.NoError(t, m.SaveMeasurement("", "cpu", map[string]float64{"field_00": 2, "extra": 3}, nil, ts.UnixNano()))
+	got, err := m.GetMeasurementRange(DefaultDatabase, "cpu", 0, ts.UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, got, 1)
+	assert.Len(t, got[0].Fields, 21)
+	assert.Equal(t, 2.0, got[0].Fields["field_00"])
+	assert.Equal(t, 1.5, got[0].Fields["field_19"])
+
+	n, err := m.RecompressFields(false)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Equal(t, 0, countBlobs())
+
+	n, err = m.RecompressFields(true)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Equal(t, 1, countBlobs())
+
+	got, err = m.GetMeasurementRange(DefaultDatabase, "cpu", 0, ts.UnixNano())
+	assert.NoError(t, err)
+	assert.Equal(t, 2.0, got[0].Fields["field_00"])
+}
+
+func testDatabaseID(t *testing.T, m *Manager, name string) string {
+	id, ok, err := m.databaseID(nil, name)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	return id
+}
+
+func TestColumnarEngine(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ShardDuration = time.Hour
+	opts.Engine = EngineColumnar
+	m, err := NewWithOptions(filepath.Join(t.TempDir(), "columnar.db"), opts)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	base := time.Date(2025, 3, 19, 0, 0, 0, 0, time.UTC)
+	var points []Point
+	for i := 0; i < 360; i++ {
+		for _, host := range []string{"a", "b"} {
+			fields := map[string]float64{"usage": float64(i % 7)}
+			if i%3 == 0 {
+				fields["load"] = float64(i) / 10
+			}
+			points = append(points, Point{Measurement: "cpu", Tags: map[string]string{"host": host}, Fields: fields, Timestamp: base.Add(time.Duration(i) * 30 * time.Second).UnixNano()})
+		}
+	}
+	points = append(points, Point{Measurement: "mem", Fields: map[string]float64{"used": 1}, Timestamp: base.UnixNano()})
+	assert.NoError(t, m.SaveBatch(points))
+
+	scan := func(start, end time.Time) []Point {
+		var got []Point
+		assert.NoError(t, m.ScanRange("", "", start.UnixNano(), end.UnixNano(), func(p Point) error {
+			got = append(got, p)
+			return nil
+		}))
+		return got
+	}
+	start, end := base.Add(10*time.Minute), base.Add(2*time.Hour+10*time.Minute)
+	rows := scan(start, end)
+	rangeRows, err := m.GetMeasurementRange(DefaultDatabase, "cpu", start.UnixNano(), end.UnixNano())
+	assert.NoError(t, err)
+
+	// Only shards whose window has ended are packed
+	packed, err := m.PackShards(base.Add(2 * time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, packed)
+	assert.Equal(t, rows, scan(start, end))
+	got, err := m.GetMeasurementRange(DefaultDatabase, "cpu", start.UnixNano(), end.UnixNano())
+	assert.NoError(t, err)
+	assert.Equal(t, rangeRows, got)
+	measurements, err := m.ListTimeseries(DefaultDatabase)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cpu", "mem"}, measurements)
+
+	// Late writes to a packed shard are merged at query time, then packed
+	late := base.Add(6 * time.Minute)
+	assert.NoError(t, m.SaveBatch([]Point{
+		{Measurement: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"usage": 42}, Timestamp: late.UnixNano()},
+		{Measurement: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"usage": 43}, Timestamp: late.Add(time.Second).UnixNano()},
+	}))
+	check := func() {
+		got, err := m.GetMeasurementRange(DefaultDatabase, "cpu", late.UnixNano(), late.Add(time.Second).UnixNano())
+		assert.NoError(t, err)
+		if assert.Len(t, got, 3) {
+			assert.Equal(t, map[string]float64{"usage": 42, "load": 1.2}, got[0].Fields)
+			assert.Equal(t, "a", got[0].Tags["host"])
+			assert.Equal(t, map[string]float64{"usage": 43}, got[2].Fields)
+		}
+	}
+	check()
+	packed, err = m.PackShards(base.Add(3 * time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, packed)
+	check()
+
+	// Deletes trim the packed points
+	deleted, err := m.DeleteBefore(DefaultDatabase, base.Add(90*time.Minute))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(180*2+1+1), deleted)
+	assert.Len(t, scan(base, base.Add(3*time.Hour)), 180*2)
+	assert.Equal(t, 2, m.ShardCount())
+
+	deleted, err = m.DeleteBefore(DefaultDatabase, base.Add(3*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(180*2), deleted)
+	dropped, err := m.CompactShards()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, dropped)
+	assert.Equal(t, 0, m.ShardCount())
+}
+
+func TestDeleteRange(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ShardDuration = time.Hour
+	opts.Engine = EngineColumnar
+	m, err := NewWithOptions(filepath.Join(t.TempDir(), "delete.db"), opts)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	base := time.Date(2025, 3, 19, 0, 0, 0, 0, time.UTC)
+	var points []Point
+	for i := 0; i < 180; i++ {
+		ts := base.Add(time.Duration(i) * time.Minute).UnixNano()
+		points = append(points,
+			Point{Database: "mydb", Measurement: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"usage": float64(i)}, Timestamp: ts},
+			Point{Database: "mydb", Measurement: "cpu", Tags: map[string]string{"host": "b"}, Fields: map[string]float64{"usage": float64(i)}, Timestamp: ts},
+			Point{Database: "mydb", Measurement: "cpu", Fields: map[string]float64{"usage": float64(i)}, Timestamp: ts},
+			Point{Database: "mydb", Measurement: "mem", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"used": float64(i)}, Timestamp: ts})
+	}
+	assert.NoError(t, m.SaveBatch(points))
+	// The first two shards are packed, the third holds rows
+	_, err = m.PackShards(base.Add(2 * time.Hour))
+	assert.NoError(t, err)
+
+	count := func(measurement string) int {
+		got, err := m.GetMeasurementRange("mydb", measurement, base.UnixNano(), base.Add(3*time.Hour).UnixNano())
+		assert.NoError(t, err)
+		return len(got)
+	}
+
+	// Across packed and unpacked shards, both bounds included
+	deleted, err := m.DeleteRange("mydb", base.Add(30*time.Minute).UnixNano(), base.Add(150*time.Minute).UnixNano(), "cpu", map[string]string{"host": "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(121), deleted)
+	assert.Equal(t, 180*3-121, count("cpu"))
+	assert.Equal(t, 180, count("mem"))
+	got, err := m.GetMeasurementRange("mydb", "cpu", base.Add(29*time.Minute).UnixNano(), base.Add(31*time.Minute).UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, got, 3*3-2)
+
+	// An empty tag value matches the series without the tag
+	deleted, err = m.DeleteRange("mydb", base.UnixNano(), base.UnixNano(), "cpu", map[string]string{"host": ""})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+
+	// Series left without points leave the dictionary
+	deleted, err = m.DeleteRange("mydb", MinTime.UnixNano(), MaxTime.UnixNano(), "", map[string]string{"host": "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(180-121+180), deleted)
+	series, err := m.ListSeries(context.Background(), "mydb", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cpu", "cpu,host=b"}, series)
+	assert.Zero(t, count("mem"))
+
+	// Writes after the series were removed add them back
+	assert.NoError(t, m.SaveBatch([]Point{{Database: "mydb", Measurement: "mem", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"used": 1}, Timestamp: base.UnixNano()}}))
+	assert.Equal(t, 1, count("mem"))
+
+	deleted, err = m.DeleteRange("missing", MinTime.UnixNano(), MaxTime.UnixNano(), "", nil)
+	assert.NoError(t, err)
+	assert.Zero(t, deleted)
+}
+
+func TestRewriteSeries(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ShardDuration = time.Hour
+	opts.Engine = EngineColumnar
+	m, err := NewWithOptions(filepath.Join(t.TempDir(), "rewrite.db"), opts)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	base := time.Date(2025, 3, 19, 0, 0, 0, 0, time.UTC)
+	var points []Point
+	for i := 0; i < 180; i++ {
+		ts := base.Add(time.Duration(i) * time.Minute).UnixNano()
+		points = append(points,
+			Point{Database: "mydb", Measurement: "cpu", Tags: map[string]string{"hostname": "a"}, Fields: map[string]float64{"usage": float64(i)}, Timestamp: ts},
+			Point{Database: "mydb", Measurement: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"system": 1}, Timestamp: ts})
+	}
+	assert.NoError(t, m.SaveBatch(points))
+	// The first two shards are packed, the third holds rows
+	_, err = m.PackShards(base.Add(2 * time.Hour))
+	assert.NoError(t, err)
+
+	rewrite := func(r Rewrite) RewriteProgress {
+		r.Database = "mydb"
+		var reported []RewriteProgress
+		p, err := m.RewriteSeries(context.Background(), r, func(p RewriteProgress) { reported = append(reported, p) })
+		assert.NoError(t, err)
+		assert.NotEmpty(t, reported)
+		return p
+	}
+	fetch := func(measurement string) []Point {
+		got, err := m.GetMeasurementRange("mydb", measurement, base.UnixNano(), base.Add(3*time.Hour).UnixNano())
+		assert.NoError(t, err)
+		return got
+	}
+	series := func() []string {
+		keys, err := m.ListSeries(context.Background(), "mydb", "")
+		assert.NoError(t, err)
+		return keys
+	}
+
+	// Renaming a tag onto an existing series merges the points
+	p := rewrite(Rewrite{Kind: RewriteRenameTag, Measurement: "cpu", Tag: "hostname", To: "host"})
+	assert.Equal(t, RewriteProgress{Series: 2, Done: 2, Rewritten: 1, Merged: 1, PointsMoved: 180}, p)
+	assert.Equal(t, []string{"cpu,host=a"}, series())
+	got := fetch("cpu")
+	assert.Len(t, got, 180)
+	assert.Equal(t, map[string]float64{"usage": 179, "system": 1}, got[179].Fields)
+
+	p = rewrite(Rewrite{Kind: RewriteRenameMeasurement, Measurement: "cpu", To: "cpu_total"})
+	assert.Equal(t, int64(1), p.Rewritten)
+	assert.Empty(t, fetch("cpu"))
+	assert.Len(t, fetch("cpu_total"), 180)
+
+	rewrite(Rewrite{Kind: RewriteAddTag, Tag: "region", Value: "eu"})
+	rewrite(Rewrite{Kind: RewriteDropTag, Measurement: "cpu_total", Tag: "host"})
+	assert.Equal(t, []string{"cpu_total,region=eu"}, series())
+	got = fetch("cpu_total")
+	assert.Len(t, got, 180)
+	assert.Equal(t, map[string]string{"region": "eu"}, got[0].Tags)
+
+	// Rewrites are idempotent
+	p = rewrite(Rewrite{Kind: RewriteAddTag, Tag: "region", Value: "us"})
+	assert.Equal(t, RewriteProgress{Series: 1, Done: 1}, p)
+
+	// Writes reach the rewritten series
+	assert.NoError(t, m.SaveBatch([]Point{{Database: "mydb", Measurement: "cpu_total", Tags: map[string]string{"region": "eu"}, Fields: map[string]float64{"idle": 2}, Timestamp: base.UnixNano()}}))
+	got = fetch("cpu_total")
+	assert.Len(t, got, 180)
+	assert.Equal(t, map[string]float64{"usage": 0, "system": 1, "idle": 2}, got[0].Fields)
+
+	_, err = m.RewriteSeries(context.Background(), Rewrite{Kind: RewriteRenameMeasurement, Database: "mydb", Measurement: "cpu"}, nil)
+	assert.Error(t, err)
+	_, err = m.RewriteSeries(context.Background(), Rewrite{Kind: RewriteDropTag, Database: "missing", Tag: "host"}, nil)
+	assert.Error(t, err)
+}
+
+func TestMeasurementPage(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ShardDuration = time.Hour
+	opts.Engine = EngineColumnar
+	m, err := NewWithOptions(filepath.Join(t.TempDir(), "page.db"), opts)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	base := time.Date(2025, 3, 19, 0, 0, 0, 0, time.UTC)
+	var points []Point
+	for i := 0; i < 180; i++ {
+		for _, host := range []string{"c", "a", "b"} {
+			points = append(points, Point{Measurement: "cpu", Tags: map[string]string{"host": host}, Fields: map[string]float64{"usage": float64(i)}, Timestamp: base.Add(time.Duration(i) * time.Minute).UnixNano()})
+		}
+	}
+	assert.NoError(t, m.SaveBatch(points))
+	_, err = m.PackShards(base.Add(2 * time.Hour))
+	assert.NoError(t, err)
+
+	// Pages cross from packed to unpacked shards in timestamp, host order
+	ctx := context.Background()
+	start, end := base.Add(50*time.Minute).UnixNano(), base.Add(130*time.Minute).UnixNano()
+	var got []Point
+	var cursor *PageCursor
+	for pages := 0; ; pages++ {
+		assert.Less(t, pages, 100)
+		page, next, err := m.GetMeasurementPage(ctx, DefaultDatabase, "cpu", start, end, cursor, 7)
+		assert.NoError(t, err)
+		got = append(got, page...)
+		if next == nil {
+			break
+		}
+		assert.Len(t, page, 7)
+		cursor = next
+	}
+	if assert.Len(t, got, 81*3) {
+		for i, p := range got {
+			assert.Equal(t, base.Add(time.Duration(50+i/3)*time.Minute).UnixNano(), p.Timestamp)
+			assert.Equal(t, string(rune('a'+i%3)), p.Tags["host"])
+			assert.Equal(t, map[string]float64{"usage": float64(50 + i/3)}, p.Fields)
+		}
+	}
+
+	// A page ending on the last point has no next cursor
+	page, next, err := m.GetMeasurementPage(ctx, DefaultDatabase, "cpu", start, start, nil, 3)
+	assert.NoError(t, err)
+	assert.Len(t, page, 3)
+	assert.Nil(t, next)
+
+	page, next, err = m.GetMeasurementPage(ctx, "missing", "cpu", start, end, nil, 3)
+	assert.NoError(t, err)
+	assert.Empty(t, page)
+	assert.Nil(t, next)
+
+	_, _, err = m.GetMeasurementPage(ctx, DefaultDatabase, "cpu", start, end, nil, 0)
+	assert.Error(t, err)
+}
+
+func TestDigestRange(t *testing.T) {
+	m := setupTestManager(t)
+	defer m.Close()
+
+	base := time.Date(2025, 3, 19, 0, 0, 0, 0, time.UTC)
+	var points []Point
+	for i := 0; i < 1000; i++ {
+		points = append(points, Point{Measurement: "latency", Fields: map[string]float64{"ms": float64(i % 100)}, Timestamp: base.Add(time.Duration(i) * time.Second).UnixNano()})
+	}
+	points = append(points, Point{Measurement: "latency", Fields: map[string]float64{"other": 1}, Timestamp: base.UnixNano()})
+	assert.NoError(t, m.SaveBatch(points))
+
+	ctx := context.Background()
+	start, end := base.UnixNano(), base.Add(time.Hour).UnixNano()
+	digests, err := m.DigestRange(ctx, DefaultDatabase, "latency", "ms", start, end, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, digests, 1) {
+		assert.Equal(t, start, digests[0].Start)
+		assert.Equal(t, float64(1000), digests[0].Digest.Count())
+		assert.InDelta(t, 49.5, digests[0].Digest.Quantile(0.5), 1)
+		assert.InDelta(t, 99, digests[0].Digest.Quantile(0.99), 1)
+	}
+
+	// Buckets are aligned on the epoch and returned in time order
+	digests, err = m.DigestRange(ctx, DefaultDatabase, "latency", "ms", start, end, int64(5*time.Minute))
+	assert.NoError(t, err)
+	if assert.Len(t, digests, 4) {
+		for i, d := range digests {
+			assert.Equal(t, base.Add(time.Duration(i)*5*time.Minute).UnixNano(), d.Start)
+		}
+		assert.Equal(t, float64(300), digests[0].Digest.Count())
+		assert.Equal(t, float64(100), digests[3].Digest.Count())
+	}
+
+	digests, err = m.DigestRange(ctx, DefaultDatabase, "latency", "missing", start, end, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, digests)
+}
+
+func TestTokens(t *testing.T) {
+	m := setupTestManager(t)
+	defer m.Close()
+
+	_, _, err := m.AddToken("", nil)
+	assert.Error(t, err)
+	_, _, err = m.AddToken("", []string{"read"})
+	assert.Error(t, err)
+	_, _, err = m.AddToken("", []string{"drop:mydb"})
+	assert.Error(t, err)
+
+	token, secret, err := m.AddToken("telegraf", []string{"write:telegraf", "read:*"})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, secret)
+
+	got, err := m.Authorize(secret)
+	assert.NoError(t, err)
+	assert.Equal(t, token, got)
+	assert.True(t, got.Allows(ScopeWrite, "telegraf"))
+	assert.False(t, got.Allows(ScopeWrite, "other"))
+	assert.True(t, got.Allows(ScopeRead, "other"))
+	assert.True(t, got.Allows(ScopeRead, ""))
+	assert.False(t, got.Allows(ScopeWrite, ""))
+	assert.False(t, got.Allows(ScopeAdmin, ""))
+	assert.True(t, Token{Scopes: []string{ScopeAdmin}}.Allows(ScopeWrite, ""))
+
+	_, err = m.Authorize("wrong")
+	assert.ErrorIs(t, err, ErrTokenNotFound)
+
+	tokens, err := m.Tokens()
+	assert.NoError(t, err)
+	assert.Equal(t, []Token{token}, tokens)
+
+	assert.NoError(t, m.DeleteToken(token.ID))
+	assert.ErrorIs(t, m.DeleteToken(token.ID), ErrTokenNotFound)
+	_, err = m.Authorize(secret)
+	assert.ErrorIs(t, err, ErrTokenNotFound)
+}
+
+func TestTokenQuotas(t *testing.T) {
+	m := setupTestManager(t)
+	defer m.Close()
+
+	token, secret, err := m.AddToken("telegraf", []string{"write:telegraf"})
+	assert.NoError(t, err)
+	q := Quota{PointsPerSecond: 100, Burst: 500, BytesPerDay: 1000}
+	assert.Error(t, m.SetTokenQuota(token.ID, Quota{BytesPerDay: -1}))
+	assert.ErrorIs(t, m.SetTokenQuota("unknown", q), ErrTokenNotFound)
+	assert.NoError(t, m.SetTokenQuota(token.ID, q))
+	got, err := m.Authorize(secret)
+	assert.NoError(t, err)
+	assert.Equal(t, q, got.Quota)
+	got, err = m.Token(token.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, q, got.Quota)
+
+	day := time.Date(2025, 3, 19, 23, 0, 0, 0, time.UTC)
+	used, ok, err := m.AddTokenUsage(token.ID, day, 600, q.BytesPerDay)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.EqualValues(t, 600, used)
+	// Bytes over the limit are not counted
+	used, ok, err = m.AddTokenUsage(token.ID, day.Add(30*time.Minute), 500, q.BytesPerDay)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.EqualValues(t, 600, used)
+	used, err = m.TokenUsage(token.ID, day)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 600, used)
+
+	// The usage starts over every UTC day
+	used, ok, err = m.AddTokenUsage(token.ID, day.Add(time.Hour), 500, q.BytesPerDay)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.EqualValues(t, 500, used)
+	used, err = m.TokenUsage(token.ID, day)
+	assert.NoError(t, err)
+	assert.Zero(t, used)
+
+	assert.NoError(t, m.DeleteToken(token.ID))
+	used, err = m.TokenUsage(token.ID, day.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Zero(t, used)
+}
+
+func TestUsers(t *testing.T) {
+	m := setupTestManager(t)
+	defer m.Close()
+
+	assert.Error(t, m.AddUser("bob", "", false))
+	assert.NoError(t, m.AddUser("bob", "secret", false))
+	assert.ErrorIs(t, m.AddUser("bob", "other", false), ErrUserExists)
+	assert.NoError(t, m.AddUser("alice", "secret", true))
+
+	admin, err := m.HasAdminUser()
+	assert.NoError(t, err)
+	assert.True(t, admin)
+
+	_, err = m.AuthenticateUser("bob", "wrong")
+	assert.ErrorIs(t, err, ErrInvalidPassword)
+	_, err = m.AuthenticateUser("carol", "secret")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+	for i := 0; i < 2; i++ {
+		u, err := m.AuthenticateUser("bob", "secret")
+		assert.NoError(t, err)
+		assert.Equal(t, "bob", u.Name)
+	}
+
+	// A new password invalidates the verified one
+	assert.NoError(t, m.SetPassword("bob", "changed"))
+	_, err = m.AuthenticateUser("bob", "secret")
+	assert.ErrorIs(t, err, ErrInvalidPassword)
+	_, err = m.AuthenticateUser("bob", "changed")
+	assert.NoError(t, err)
+
+	assert.NoError(t, m.GrantPrivilege("bob", "mydb", PrivilegeAll))
+	assert.NoError(t, m.GrantPrivilege("bob", "logs", PrivilegeRead))
+	assert.NoError(t, m.RevokePrivilege("bob", "mydb", PrivilegeRead))
+	assert.ErrorIs(t, m.GrantPrivilege("carol", "mydb", PrivilegeRead), ErrUserNotFound)
+	u, err := m.GetUser("bob")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]Privilege{"mydb": PrivilegeWrite, "logs": PrivilegeRead}, u.Privileges)
+	assert.Equal(t, []string{"read:logs", "write:mydb"}, u.Scopes())
+
+	assert.NoError(t, m.RevokePrivilege("bob", "logs", PrivilegeAll))
+	assert.NoError(t, m.SetAdmin("bob", true))
+	u, err = m.GetUser("bob")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"admin"}, u.Scopes())
+
+	users, err := m.Users()
+	assert.NoError(t, err)
+	if assert.Len(t, users, 2) {
+		assert.Equal(t, "alice", users[0].Name)
+		assert.Equal(t, map[string]Privilege{"mydb": PrivilegeWrite}, users[1].Privileges)
+	}
+
+	assert.NoError(t, m.DropUser("bob"))
+	assert.ErrorIs(t, m.DropUser("bob"), ErrUserNotFound)
+	_, err = m.AuthenticateUser("bob", "changed")
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestAuditLog(t *testing.T) {
+	m := setupTestManager(t)
+
+	start := time.Unix(1700000000, 0)
+	for i, action := range []string{"database.create", "token.create", "database.drop"} {
+		assert.NoError(t, m.RecordAudit(AuditEntry{
+			Time:   start.Add(time.Duration(i) * time.Minute),
+			Actor:  "admin",
+			Source: "10.0.0.1",
+			Action: action,
+			Target: "mydb",
+		}))
+	}
+	assert.NoError(t, m.RecordAudit(AuditEntry{Actor: "anonymous", Source: "127.0.0.1", Action: "org.delete", Target: "o"}))
+
+	entries, err := m.AuditLog(time.Time{}, 0)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 4)
+	assert.Equal(t, "database.create", entries[0].Action)
+	assert.Equal(t, start.UTC(), entries[0].Time)
+	assert.WithinDuration(t, time.Now(), entries[3].Time, time.Minute)
+
+	entries, err = m.AuditLog(start.Add(time.Minute), 2)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "token.create", entries[0].Action)
+	assert.Equal(t, "database.drop", entries[1].Action)
+
+	// Entries cannot be changed or removed
+	_, err = m.db.Exec(`UPDATE audit_log SET actor = 'someone else'`)
+	assert.Error(t, err)
+	_, err = m.db.Exec(`DELETE FROM audit_log`)
+	assert.Error(t, err)
+	entries, err = m.AuditLog(time.Time{}, 0)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 4)
+}
+
+func TestDeadLetters(t *testing.T) {
+	m := setupTestManager(t)
+
+	start := time.Unix(1700000000, 0)
+	var letters []DeadLetter
+	for i, line := range []string{"cpu value=", "cpu,host", "mem free=x"} {
+		letters = append(letters, DeadLetter{
+			Time:      start.Add(time.Duration(i) * time.Minute),
+			Database:  []string{"mydb", "other", "mydb"}[i],
+			Source:    "10.0.0.1",
+			Precision: time.Second,
+			Line:      line,
+			Error:     "unable to parse",
+		})
+	}
+	assert.NoError(t, m.RecordDeadLetters(letters, 10))
+
+	got, err := m.DeadLetters(DeadLetterFilter{})
+	assert.NoError(t, err)
+	if assert.Len(t, got, 3) {
+		assert.Equal(t, "cpu value=", got[0].Line)
+		assert.Equal(t, start.UTC(), got[0].Time)
+		assert.Equal(t, time.Second, got[0].Precision)
+	}
+	got, err = m.DeadLetters(DeadLetterFilter{Database: "mydb", Since: start.Add(time.Second)})
+	assert.NoError(t, err)
+	if assert.Len(t, got, 1) {
+		assert.Equal(t, "mem free=x", got[0].Line)
+	}
+	letter, ok, err := m.DeadLetter(got[0].ID)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, got[0], letter)
+
+	// The oldest letters are removed past the maximum
+	assert.NoError(t, m.RecordDeadLetters([]DeadLetter{{Database: "mydb", Line: "disk used=", Error: "unable to parse"}}, 2))
+	got, err = m.DeadLetters(DeadLetterFilter{Limit: 10})
+	assert.NoError(t, err)
+	if assert.Len(t, got, 2) {
+		assert.Equal(t, "mem free=x", got[0].Line)
+		assert.Equal(t, "disk used=", got[1].Line)
+		assert.WithinDuration(t, time.Now(), got[1].Time, time.Minute)
+	}
+
+	n, err := m.DeleteDeadLetters(DeadLetterFilter{Database: "other"}, []int64{got[0].ID})
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+	n, err = m.DeleteDeadLetters(DeadLetterFilter{}, []int64{got[0].ID})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, n)
+	_, ok, err = m.DeadLetter(got[0].ID)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	n, err = m.DeleteDeadLetters(DeadLetterFilter{Database: "mydb"}, nil)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, n)
+	got, err = m.DeadLetters(DeadLetterFilter{})
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestWriteStats(t *testing.T) {
+	m := setupTestManager(t)
+
+	ts := time.Unix(1700000000, 0)
+	cpu := Point{Database: "mydb", Measurement: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"value": 1.5}, Timestamp: ts.UnixNano()}
+	assert.NoError(t, m.SaveBatch([]Point{cpu, cpu}))
+	assert.NoError(t, m.SaveBatch([]Point{{Measurement: "mem", Fields: map[string]float64{"used": 10}, Timestamp: ts.UnixNano()}}))
+
+	stats := m.WriteStats()
+	assert.Len(t, stats, 2)
+	assert.Equal(t, DefaultDatabase, stats[0].Database)
+	assert.Equal(t, "mem", stats[0].Measurement)
+	assert.Equal(t, uint64(1), stats[0].Points)
+	assert.Equal(t, uint64(len("mem used=10 1700000000000000000\n")), stats[0].Bytes)
+	assert.Equal(t, "cpu", stats[1].Measurement)
+	assert.Equal(t, uint64(2), stats[1].Points)
+	assert.Equal(t, uint64(2*len("cpu,host=a value=1.5 1700000000000000000\n")), stats[1].Bytes)
+	assert.WithinDuration(t, time.Now(), stats[1].LastWrite, time.Minute)
+	assert.Greater(t, stats[1].PointsPerSecond, 0.0)
+
+	// Rates decay once writes stop
+	w := newWriteStats()
+	now := time.Unix(1700000000, 0)
+	w.observe(make([]Point, 60), now)
+	assert.InDelta(t, 1, w.snapshot(now)[0].PointsPerSecond, 1e-9)
+	assert.InDelta(t, math.Exp(-1), w.snapshot(now.Add(rateWindow))[0].PointsPerSecond, 1e-9)
+
+	assert.NoError(t, m.DropDatabase("mydb"))
+	stats = m.WriteStats()
+	assert.Len(t, stats, 1)
+	assert.Equal(t, "mem", stats[0].Measurement)
+}
+
+func TestMayHaveTags(t *testing.T) {
+	m, err := New(":memory:")
+	assert.NoError(t, err)
+	defer m.Close()
+	ctx := context.Background()
+
+	cpu := func(host, region string) Point {
+		return Point{Database: "mydb", Measurement: "cpu", Tags: map[string]string{"host": host, "region": region}, Fields: map[string]float64{"value": 1}, Timestamp: 1}
+	}
+	assert.NoError(t, m.SaveBatch([]Point{cpu("a", "eu"), cpu("b", "us")}))
+
+	for _, c := range []struct {
+		tags map[string]string
+		want bool
+	}{
+		{nil, true},
+		{map[string]string{"host": "a"}, true},
+		{map[string]string{"host": "a", "region": "eu"}, true},
+		{map[string]string{"host": "c"}, false},
+		// Both tags exist, but not on the same series
+		{map[string]string{"host": "a", "region": "us"}, false},
+		// Missing tags are not indexed
+		{map[string]string{"host": "a", "rack": ""}, true},
+	} {
+		ok, err := m.MayHaveTags(ctx, "mydb", "cpu", c.tags)
+		assert.NoError(t, err)
+		assert.Equal(t, c.want, ok, c.tags)
+	}
+	ok, err := m.MayHaveTags(ctx, "mydb", "mem", map[string]string{"host": "a"})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Writes extend the index once loaded
+	assert.NoError(t, m.SaveBatch([]Point{cpu("c", "us")}))
+	ok, err = m.MayHaveTags(ctx, "mydb", "cpu", map[string]string{"host": "c", "region": "us"})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// Series with more tags than are paired are still found
+	tags := map[string]string{}
+	for i := 0; i < maxPairedTags+1; i++ {
+		tags[fmt.Sprintf("t%d", i)] = "x"
+	}
+	assert.NoError(t, m.SaveBatch([]Point{{Database: "mydb", Measurement: "cpu", Tags: tags, Fields: map[string]float64{"value": 1}, Timestamp: 1}}))
+	ok, err = m.MayHaveTags(ctx, "mydb", "cpu", map[string]string{"t0": "x", "t8": "x"})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// Dropping the database resets the index
+	assert.NoError(t, m.DropDatabase("mydb"))
+	ok, err = m.MayHaveTags(ctx, "mydb", "cpu", map[string]string{"host": "a"})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestHourCounts(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ShardDuration = time.Hour
+	opts.Engine = EngineColumnar
+	m, err := NewWithOptions(filepath.Join(t.TempDir(), "hours.db"), opts)
+	assert.NoError(t, err)
+	defer m.Close()
+	ctx := context.Background()
+
+	base := time.Date(2025, 3, 19, 0, 0, 0, 0, time.UTC)
+	cpu := func(ts time.Time) Point {
+		return Point{Database: "mydb", Measurement: "cpu", Fields: map[string]float64{"value": 1}, Timestamp: ts.UnixNano()}
+	}
+	hour := func(h int) int64 { return base.Add(time.Duration(h) * time.Hour).UnixNano() }
+	assert.NoError(t, m.SaveBatch([]Point{cpu(base.Add(10 * time.Minute)), cpu(base.Add(20 * time.Minute)), cpu(base.Add(150 * time.Minute))}))
+	// The first hour is read from blocks, the third one from rows
+	_, err = m.PackShards(base.Add(time.Hour))
+	assert.NoError(t, err)
+	// Times before the epoch belong to the hour before them
+	assert.NoError(t, m.SaveBatch([]Point{cpu(time.Unix(0, -1))}))
+
+	counts, err := m.HourCounts(ctx, "mydb", "cpu", math.MinInt64, math.MaxInt64)
+	assert.NoError(t, err)
+	assert.Equal(t, []HourCount{{Start: -int64(time.Hour), Points: 1}, {Start: hour(0), Points: 2}, {Start: hour(2), Points: 1}}, counts)
+
+	// Hours overlapping the range are returned whole
+	counts, err = m.HourCounts(ctx, "mydb", "cpu", hour(0)+1, hour(2))
+	assert.NoError(t, err)
+	assert.Equal(t, []HourCount{{Start: hour(0), Points: 2}, {Start: hour(2), Points: 1}}, counts)
+	counts, err = m.HourCounts(ctx, "mydb", "cpu", hour(1), hour(2)-1)
+	assert.NoError(t, err)
+	assert.Empty(t, counts)
+
+	// Writes extend the loaded counts, and deletes reset them
+	assert.NoError(t, m.SaveBatch([]Point{cpu(base.Add(90 * time.Minute))}))
+	counts, err = m.HourCounts(ctx, "mydb", "cpu", hour(1), hour(2)-1)
+	assert.NoError(t, err)
+	assert.Equal(t, []HourCount{{Start: hour(1), Points: 1}}, counts)
+	_, err = m.DeleteBefore("mydb", base.Add(2*time.Hour))
+	assert.NoError(t, err)
+	counts, err = m.HourCounts(ctx, "mydb", "cpu", math.MinInt64, math.MaxInt64)
+	assert.NoError(t, err)
+	assert.Equal(t, []HourCount{{Start: hour(2), Points: 1}}, counts)
+
+	counts, err = m.HourCounts(ctx, "mydb", "mem", math.MinInt64, math.MaxInt64)
+	assert.NoError(t, err)
+	assert.Empty(t, counts)
+}
+
+func TestTimeBounds(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ShardDuration = time.Hour
+	opts.Engine = EngineColumnar
+	m, err := NewWithOptions(filepath.Join(t.TempDir(), "bounds.db"), opts)
+	assert.NoError(t, err)
+	defer m.Close()
+	ctx := context.Background()
+
+	base := time.Date(2025, 3, 19, 0, 0, 0, 0, time.UTC)
+	cpu := func(ts time.Time) Point {
+		return Point{Database: "mydb", Measurement: "cpu", Fields: map[string]float64{"value": 1}, Timestamp: ts.UnixNano()}
+	}
+	assert.NoError(t, m.SaveBatch([]Point{cpu(base.Add(10 * time.Minute)), cpu(base.Add(150 * time.Minute))}))
+	_, err = m.PackShards(base.Add(2 * time.Hour))
+	assert.NoError(t, err)
+
+	lo, hi, ok, err := m.TimeBounds(ctx, "mydb", "cpu")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, base.Add(10*time.Minute).UnixNano(), lo)
+	assert.Equal(t, base.Add(150*time.Minute).UnixNano(), hi)
+	_, _, ok, err = m.TimeBounds(ctx, "mydb", "mem")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Writes extend the cached range
+	assert.NoError(t, m.SaveBatch([]Point{cpu(base.Add(-time.Hour))}))
+	lo, _, _, err = m.TimeBounds(ctx, "mydb", "cpu")
+	assert.NoError(t, err)
+	assert.Equal(t, base.Add(-time.Hour).UnixNano(), lo)
+
+	// Ranges outside of the points are answered without a scan
+	skipped := scansSkipped.Value()
+	points, err := m.GetMeasurementRange("mydb", "cpu", base.Add(3*time.Hour).UnixNano(), base.Add(4*time.Hour).UnixNano())
+	assert.NoError(t, err)
+	assert.Empty(t, points)
+	assert.Equal(t, skipped+1, scansSkipped.Value())
+	points, err = m.GetMeasurementRange("mydb", "cpu", base.UnixNano(), base.Add(4*time.Hour).UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+	assert.Equal(t, skipped+1, scansSkipped.Value())
+
+	// Deletes reset the cache
+	_, err = m.DeleteBefore("mydb", base)
+	assert.NoError(t, err)
+	lo, _, _, err = m.TimeBounds(ctx, "mydb", "cpu")
+	assert.NoError(t, err)
+	assert.Equal(t, base.Add(10*time.Minute).UnixNano(), lo)
+
+	// Ranges ending before the retention period are skipped, even when
+	// retention enforcement did not delete the points yet
+	_, err = m.AddDatabase(Database{Name: "recent", RetentionPeriod: time.Hour})
+	assert.NoError(t, err)
+	now := time.Now()
+	assert.NoError(t, m.SaveBatch([]Point{{Database: "recent", Measurement: "cpu", Fields: map[string]float64{"value": 1}, Timestamp: now.Add(-3 * time.Hour).UnixNano()}}))
+	points, err = m.GetMeasurementRange("recent", "cpu", 0, now.Add(-2*time.Hour).UnixNano())
+	assert.NoError(t, err)
+	assert.Empty(t, points)
+	assert.Equal(t, skipped+2, scansSkipped.Value())
+	points, err = m.GetMeasurementRange("recent", "cpu", 0, now.UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+
+	// A range loaded while points were written is not kept
+	c := newBoundsCache()
+	ref := measurementRef{database: "mydb", measurement: "cpu"}
+	_, _, version := c.get(ref)
+	c.observe([]Point{cpu(base)})
+	c.store(ref, timeRange{min: 1, max: 2}, version)
+	_, ok, _ = c.get(ref)
+	assert.False(t, ok)
+}
+
+func TestTraceRange(t *testing.T) {
+	m := setupTestManager(t)
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+	level := log.GetLevel()
+	t.Cleanup(func() { log.SetLevel(level) })
+	log.SetLevel(log.TraceLevel)
+
+	ts := time.Date(2025, 3, 19, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, m.SaveMeasurement("mydb", "cpu", map[string]float64{"value": 1}, nil, ts.UnixNano()))
+
+	// The first query loads the range of the measurement, later ones log it
+	_, err := m.GetMeasurementRange("mydb", "cpu", ts.UnixNano(), ts.UnixNano())
+	assert.NoError(t, err)
+	assert.Contains(t, hook.LastEntry().Message, "stored points: not loaded")
+	_, err = m.GetMeasurementRange("mydb", "cpu", ts.UnixNano(), ts.UnixNano())
+	assert.NoError(t, err)
+	assert.Equal(t, log.TraceLevel, hook.LastEntry().Level)
+	assert.Contains(t, hook.LastEntry().Message, "stored points: 2025-03-19T00:00:00Z to 2025-03-19T00:00:00Z")
+}
+
+func TestTimestampUnits(t *testing.T) {
+	ns, err := Nanoseconds(time.Date(2025, time.March, 19, 12, 0, 0, 1, time.UTC))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1742385600000000001), ns)
+	ns, err = Nanoseconds(MinTime)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(math.MinInt64), ns)
+	_, err = Nanoseconds(MaxTime.Add(time.Nanosecond))
+	assert.ErrorContains(t, err, "outside the range")
+	_, err = Nanoseconds(time.Time{})
+	assert.ErrorContains(t, err, "0001-01-01T00:00:00Z")
+
+	// Timestamps are stored and read back to the nanosecond, before the
+	// epoch too, and ranges are in the same unit
+	m := setupTestManager(t)
+	timestamps := []int64{-1, 1742385600000000001, 7258118400000000000}
+	for _, ts := range timestamps {
+		assert.NoError(t, m.SaveMeasurement("db", "cpu", map[string]float64{"value": 1}, nil, ts))
+	}
+	points, err := m.GetMeasurementRange("db", "cpu", math.MinInt64, math.MaxInt64)
+	assert.NoError(t, err)
+	assert.Len(t, points, len(timestamps))
+	for i, p := range points {
+		assert.Equal(t, timestamps[i], p.Timestamp)
+		assert.Equal(t, time.Unix(0, timestamps[i]).UTC(), p.Time())
+	}
+
+	// A range in milliseconds misses points stored in nanoseconds
+	points, err = m.GetMeasurementRange("db", "cpu", 1742385600000, 1742385600001)
+	assert.NoError(t, err)
+	assert.Empty(t, points)
+}
+
+func TestStmtCache(t *testing.T) {
+	m := setupTestManager(t)
+
+	// A query first used within a transaction is cached once it ends,
+	// without waiting for the single connection of the in-memory database
+	const query = `SELECT COUNT(*) FROM series`
+	tx, err := m.db.Begin()
+	assert.NoError(t, err)
+	stmt, release, err := m.stmts.tx(tx, query)
+	assert.NoError(t, err)
+	var n int
+	assert.NoError(t, stmt.QueryRow().Scan(&n))
+	release()
+	assert.NoError(t, tx.Commit())
+	assert.NotContains(t, m.stmts.stmts, query)
+	m.stmts.fill()
+	assert.Contains(t, m.stmts.stmts, query)
+
+	// Statements in use when the cache is reset stay open until released
+	stmt, release, err = m.stmts.get(context.Background(), query)
+	assert.NoError(t, err)
+	m.stmts.mu.Lock()
+	m.stmts.evictLocked()
+	m.stmts.mu.Unlock()
+	assert.NoError(t, stmt.QueryRow().Scan(&n))
+	release()
+	assert.Error(t, stmt.QueryRow().Scan(&n))
+
+	// Writes and reads prepare the statements again
+	assert.NoError(t, m.SaveMeasurement("db", "cpu", map[string]float64{"value": 1}, nil, 1))
+	points, err := m.GetMeasurementRange("db", "cpu", 0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+}
+
+func TestInspect(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ShardDuration = time.Hour
+	opts.Engine = EngineColumnar
+	m, err := NewWithOptions(filepath.Join(t.TempDir(), "inspect.db"), opts)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	base := time.Date(2025, 3, 19, 0, 0, 0, 0, time.UTC)
+	var points []Point
+	for i := 0; i < 120; i++ {
+		for _, host := range []string{"a", "b"} {
+			points = append(points, Point{Measurement: "cpu", Tags: map[string]string{"host": host}, Fields: map[string]float64{"usage": float64(i)}, Timestamp: base.Add(time.Duration(i) * time.Minute).UnixNano()})
+		}
+	}
+	points = append(points, Point{Database: "other", Measurement: "mem", Fields: map[string]float64{"used": 1}, Timestamp: base.UnixNano()})
+	assert.NoError(t, m.SaveBatch(points))
+	_, err = m.PackShards(base.Add(time.Hour))
+	assert.NoError(t, err)
+
+	report, err := m.Inspect(context.Background())
+	assert.NoError(t, err)
+	if assert.Len(t, report.Databases, 2) {
+		assert.Equal(t, DatabaseStats{
+			Name:         DefaultDatabase,
+			Shards:       2,
+			PackedShards: 1,
+			Measurements: []MeasurementStats{{
+				Name:    "cpu",
+				Series:  2,
+				Points:  240,
+				MinTime: base.UnixNano(),
+				MaxTime: base.Add(119 * time.Minute).UnixNano(),
+			}},
+		}, report.Databases[0])
+		assert.Equal(t, "other", report.Databases[1].Name)
+		assert.Equal(t, int64(1), report.Databases[1].Measurements[0].Points)
+	}
+
+	disk := report.Disk
+	assert.Greater(t, disk.Rows, int64(0))
+	assert.Greater(t, disk.Blocks, int64(0))
+	assert.Greater(t, disk.Series, int64(0))
+	assert.Equal(t, disk.Total, disk.Rows+disk.Blocks+disk.Series+disk.Free+disk.Other)
+}
+
+func TestIntegrity(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ShardDuration = time.Hour
+	m, err := NewWithOptions(filepath.Join(t.TempDir(), "integrity.db"), opts)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	_, ok := m.LatestIntegrityReport()
+	assert.False(t, ok)
+
+	base := time.Date(2025, 3, 19, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, m.SaveBatch([]Point{
+		{Database: "metrics", Measurement: "cpu", Fields: map[string]float64{"value": 1}, Timestamp: base.UnixNano()},
+		{Database: "metrics", Measurement: "cpu", Fields: map[string]float64{"value": 2}, Timestamp: base.Add(time.Hour).UnixNano()},
+	}))
+	report, err := m.CheckIntegrity(context.Background(), false)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Shards)
+	assert.Empty(t, report.Issues)
+
+	kinds := func(r IntegrityReport) map[string]bool {
+		got := make(map[string]bool)
+		for _, issue := range r.Issues {
+			got[issue.Kind] = issue.Repaired
+		}
+		return got
+	}
+
+	// Break the storage behind the manager's back
+	var databaseID string
+	var shards []shard
+	for id, s := range m.shards.all() {
+		databaseID, shards = id, s
+	}
+	assert.Len(t, shards, 2)
+	db := m.GetDB()
+	_, err = db.Exec(`DROP TABLE ` + shards[0].table())
+	assert.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO `+shards[1].table()+` (series_id, timestamp, fields) SELECT series_id, ?, fields FROM `+shards[1].table(), base.UnixNano())
+	assert.NoError(t, err)
+	_, err = db.Exec(shardTable("shard_999"))
+	assert.NoError(t, err)
+	m.shards.remove(databaseID, map[int64]bool{shards[1].id: true})
+
+	report, err = m.CheckIntegrity(context.Background(), false)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{
+		IssueMissingTable:      false,
+		IssueShardIndex:        false,
+		IssueOutOfWindow:       false,
+		IssueUnregisteredTable: false,
+	}, kinds(report))
+	latest, ok := m.LatestIntegrityReport()
+	assert.True(t, ok)
+	assert.Equal(t, report.CheckedAt, latest.CheckedAt)
+
+	// Repairs restore the in-memory index and the missing table, the other
+	// issues would lose points and are only reported
+	report, err = m.CheckIntegrity(context.Background(), true)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{
+		IssueMissingTable:      true,
+		IssueShardIndex:        true,
+		IssueOutOfWindow:       false,
+		IssueUnregisteredTable: false,
+	}, kinds(report))
+	assert.Equal(t, 2, m.ShardCount())
+
+	report, err = m.CheckIntegrity(context.Background(), false)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{IssueOutOfWindow: false, IssueUnregisteredTable: false}, kinds(report))
+
+	// Cached series IDs missing from the dictionary are dropped
+	_, err = db.Exec(`DELETE FROM series`)
+	assert.NoError(t, err)
+	report, err = m.CheckIntegrity(context.Background(), true)
+	assert.NoError(t, err)
+	assert.True(t, kinds(report)[IssueSeriesCache])
+	_, found := kinds(report)[IssueUnknownSeries]
+	assert.True(t, found)
+	assert.Empty(t, m.seriesIDs)
+}
+
+func BenchmarkScanRange(b *testing.B) {
+	for _, engine := range []string{EngineRow, EngineColumnar} {
+		b.Run(engine, func(b *testing.B) {
+			opts := DefaultOptions()
+			opts.Engine = engine
+			path := filepath.Join(b.TempDir(), "bench.db")
+			m, err := NewWithOptions(path, opts)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer m.Close()
+
+			// A day of 10s samples for 10 hosts
+			base := time.Date(2025, 3, 19, 0, 0, 0, 0, time.UTC).UnixNano()
+			for h := 0; h < 10; h++ {
+				points := make([]Point, 8640)
+				for i := range points {
+					points[i] = Point{
+						Measurement: "cpu",
+						Tags:        map[string]string{"host": fmt.Sprintf("host%d", h)},
+						Fields:      map[string]float64{"usage": float64(i%100) / 4, "idle": float64(100 - i%100)},
+						Timestamp:   base + int64(i)*10e9,
+					}
+				}
+				if err := m.SaveBatch(points); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if _, err := m.EnforceRetention(time.Unix(0, base).Add(48 * time.Hour)); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := m.GetDB().Exec(`VACUUM`); err != nil {
+				b.Fatal(err)
+			}
+			size, _ := m.Size()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				n := 0
+				err := m.ScanRange(DefaultDatabase, "cpu", math.MinInt64, math.MaxInt64, func(Point) error {
+					n++
+					return nil
+				})
+				if err != nil || n != 86400 {
+					b.Fatal(n, err)
+				}
+			}
+			b.ReportMetric(float64(size)/86400, "bytes/point")
+		})
+	}
+}
+
+func TestCompact(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ShardDuration = time.Hour
+	m, err := NewWithOptions(filepath.Join(t.TempDir(), "compact.db"), opts)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	base := time.Date(2025, 3, 19, 0, 0, 0, 0, time.UTC)
+	var points []Point
+	for i := 0; i < 5000; i++ {
+		points = append(points, Point{Database: "metrics", Measurement: "cpu", Tags: map[string]string{"host": fmt.Sprint(i % 10)}, Fields: map[string]float64{"value": float64(i)}, Timestamp: base.Add(time.Duration(i) * time.Second).UnixNano()})
+	}
+	assert.NoError(t, m.SaveBatch(points))
+	_, err = m.DeleteRange("metrics", MinTime.UnixNano(), MaxTime.UnixNano(), "", map[string]string{"host": "1"})
+	assert.NoError(t, err)
+	_, err = m.DeleteBefore("metrics", base.Add(time.Hour))
+	assert.NoError(t, err)
+
+	// New files vacuum incrementally
+	reclaimed := bytesReclaimed.Value()
+	c, err := m.Compact(context.Background(), CompactOptions{})
+	assert.NoError(t, err)
+	assert.False(t, c.Full)
+	assert.Positive(t, c.FreeBefore)
+	assert.Zero(t, c.FreeAfter)
+	assert.Positive(t, c.Reclaimed())
+	assert.Equal(t, reclaimed+uint64(c.Reclaimed()), bytesReclaimed.Value())
+	size, err := m.Size()
+	assert.NoError(t, err)
+	assert.Equal(t, c.SizeAfter, size)
+
+	got, err := m.GetMeasurementRange("metrics", "cpu", base.UnixNano(), base.Add(2*time.Hour).UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, got, (5000-3600)*9/10)
+
+	c, err = m.Compact(context.Background(), CompactOptions{Full: true})
+	assert.NoError(t, err)
+	assert.True(t, c.Full)
+	assert.Zero(t, c.FreeAfter)
+}
+
+func TestCompactLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.db")
+	legacy, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	_, err = legacy.Exec(`CREATE TABLE filler (data BLOB)`)
+	assert.NoError(t, err)
+	_, err = legacy.Exec(`INSERT INTO filler SELECT zeroblob(4096) FROM (WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 100) SELECT i FROM n)`)
+	assert.NoError(t, err)
+	_, err = legacy.Exec(`DROP TABLE filler`)
+	assert.NoError(t, err)
+	legacy.Close()
+
+	m, err := New(path)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	// Files without incremental auto vacuum get a full compaction, after
+	// which they vacuum incrementally
+	c, err := m.Compact(context.Background(), CompactOptions{})
+	assert.NoError(t, err)
+	assert.True(t, c.Full)
+	assert.Positive(t, c.Reclaimed())
+	assert.Zero(t, c.FreeAfter)
+	var mode int
+	assert.NoError(t, m.GetDB().QueryRow(`PRAGMA auto_vacuum`).Scan(&mode))
+	assert.Equal(t, autoVacuumIncremental, mode)
+
+	c, err = m.Compact(context.Background(), CompactOptions{})
+	assert.NoError(t, err)
+	assert.False(t, c.Full)
+}
+
+func TestQuietHours(t *testing.T) {
+	at := func(hour, minute int) time.Time {
+		return time.Date(2025, 3, 19, hour, minute, 0, 0, time.UTC)
+	}
+	q, err := ParseQuietHours("02:00-05:30")
+	assert.NoError(t, err)
+	assert.Equal(t, "02:00-05:30", q.String())
+	assert.True(t, q.Contains(at(2, 0)))
+	assert.True(t, q.Contains(at(5, 29)))
+	assert.False(t, q.Contains(at(5, 30)))
+	assert.False(t, q.Contains(at(1, 59)))
+
+	// Windows may span midnight
+	q, err = ParseQuietHours("23:00-01:00")
+	assert.NoError(t, err)
+	assert.True(t, q.Contains(at(23, 30)))
+	assert.True(t, q.Contains(at(0, 30)))
+	assert.False(t, q.Contains(at(1, 0)))
+	assert.False(t, q.Contains(at(12, 0)))
+
+	for _, s := range []string{"", "2am-5am", "02:00", "24:00-01:00", "02:60-03:00", "03:00-03:00"} {
+		_, err := ParseQuietHours(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions()
+	opts.ShardDuration = time.Hour
+	m, err := NewWithOptions(filepath.Join(dir, "source.db"), opts)
+	assert.NoError(t, err)
+	defer m.Close()
+
+	base := time.Date(2025, 3, 19, 0, 0, 0, 0, time.UTC)
+	write := func(from, to int) {
+		var points []Point
+		for i := from; i < to; i++ {
+			points = append(points, Point{Database: "metrics", Measurement: "cpu", Fields: map[string]float64{"value": float64(i)}, Timestamp: base.Add(time.Duration(i) * time.Minute).UnixNano()})
+		}
+		assert.NoError(t, m.SaveBatch(points))
+	}
+	write(0, 180)
+
+	// Writes go on while snapshots are taken
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 180; i < 200; i++ {
+			write(i, i+1)
+		}
+	}()
+	path := filepath.Join(dir, "snapshot.db")
+	s, err := m.Snapshot(context.Background(), path)
+	assert.NoError(t, err)
+	<-done
+	assert.Equal(t, path, s.Path)
+	assert.Positive(t, s.Size)
+	assert.NoFileExists(t, path+".tmp")
+
+	_, err = m.Snapshot(context.Background(), path)
+	assert.Error(t, err)
+
+	copied, err := NewWithOptions(path, opts)
+	assert.NoError(t, err)
+	defer copied.Close()
+	got, err := copied.GetMeasurementRange("metrics", "cpu", base.UnixNano(), base.Add(4*time.Hour).UnixNano())
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, len(got), 180)
+	assert.LessOrEqual(t, len(got), 200)
+	// Points are copied in commit order, so the copy holds a prefix of them
+	for i, p := range got {
+		assert.Equal(t, float64(i), p.Fields["value"])
+	}
+	report, err := copied.CheckIntegrity(context.Background(), false)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Issues)
+}
+
+// memoryStore is an ObjectStore keeping its objects in memory
+type memoryStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	gets    int
+}
+
+func (s *memoryStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("object %s not found", key)
+	}
+	s.gets++
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *memoryStore) Delete(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func TestPool(t *testing.T) {
+	dir := t.TempDir()
+	catalog, err := New(filepath.Join(dir, "main.db"))
+	assert.NoError(t, err)
+	defer catalog.Close()
+
+	_, err = NewPool(catalog, PoolOptions{Tenants: []Tenant{
+		{Name: "acme", Path: filepath.Join(dir, "acme.db"), Databases: []string{"acme"}},
+		{Name: "globex", Path: filepath.Join(dir, "globex.db"), Databases: []string{"acme"}},
+	}})
+	assert.Error(t, err)
+
+	pool, err := NewPool(catalog, PoolOptions{
+		Tenants:     []Tenant{{Name: "acme", Path: filepath.Join(dir, "acme.db"), Databases: []string{"acme", "acme_logs"}}},
+		Options:     DefaultOptions(),
+		IdleTimeout: time.Minute,
+	})
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	var observed int
+	catalog.OnWrite(func(points []Point) { observed += len(points) })
+	now := time.Now()
+	assert.NoError(t, pool.SaveBatchContext(context.Background(), []Point{
+		{Database: "acme", Measurement: "cpu", Fields: map[string]float64{"value": 1}, Timestamp: now.Add(-2 * time.Hour).UnixNano()},
+		{Database: "acme", Measurement: "cpu", Fields: map[string]float64{"value": 2}, Timestamp: now.UnixNano()},
+		{Database: "other", Measurement: "cpu", Fields: map[string]float64{"value": 3}, Timestamp: now.UnixNano()},
+	}))
+	assert.Equal(t, 3, observed)
+
+	// The points of the tenant are in its file, its database in the
+	// catalog
+	points, err := catalog.GetMeasurementRange("acme", "cpu", 0, math.MaxInt64)
+	assert.NoError(t, err)
+	assert.Empty(t, points)
+	exists, err := catalog.HasDatabase("acme")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	m, release, err := pool.For("acme")
+	assert.NoError(t, err)
+	points, err = m.GetMeasurementRange("acme", "cpu", 0, math.MaxInt64)
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+	release()
+	m, release, err = pool.For("other")
+	assert.NoError(t, err)
+	assert.Same(t, catalog, m)
+	release()
+
+	// Retention periods come from the catalog
+	d, err := catalog.GetDatabase("acme")
+	assert.NoError(t, err)
+	period := time.Hour
+	_, err = catalog.UpdateDatabase(d.ID, DatabaseUpdate{RetentionPeriod: &period})
+	assert.NoError(t, err)
+	n, err := pool.EnforceRetention(now)
+	assert.NoError(t, err)
+	assert.EqualValues(t, 1, n)
+
+	// Files are closed once idle and reopened when used
+	assert.Zero(t, pool.CloseIdle(now))
+	m, err = pool.Acquire("acme")
+	assert.NoError(t, err)
+	assert.Zero(t, pool.CloseIdle(now.Add(time.Hour)))
+	pool.Release("acme")
+	assert.Equal(t, 1, pool.CloseIdle(time.Now().Add(time.Hour)))
+	m, release, err = pool.For("acme")
+	assert.NoError(t, err)
+	points, err = m.GetMeasurementRange("acme", "cpu", 0, math.MaxInt64)
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+	release()
+
+	assert.NoError(t, pool.DropDatabase("acme"))
+	m, release, err = pool.For("acme")
+	assert.NoError(t, err)
+	defer release()
+	points, err = m.GetMeasurementRange("acme", "cpu", 0, math.MaxInt64)
+	assert.NoError(t, err)
+	assert.Empty(t, points)
+}
+
+func TestTierShards(t *testing.T) {
+	dir := t.TempDir()
+	store := &memoryStore{objects: make(map[string][]byte)}
+	opts := DefaultOptions()
+	opts.ShardDuration = time.Hour
+	opts.Engine = EngineColumnar
+	opts.Tiering = &TieringOptions{Store: store, Age: 24 * time.Hour, CacheDir: filepath.Join(dir, "tiers")}
+	m, err := NewWithOptions(filepath.Join(dir, "tier.db"), opts)
+	assert.NoError(t, err)
+	defer m.Close()
+	ctx := context.Background()
+
+	base := time.Date(2025, 3, 19, 0, 0, 0, 0, time.UTC)
+	var points []Point
+	for i := 0; i < 180; i++ {
+		ts := base.Add(time.Duration(i) * time.Minute).UnixNano()
+		points = append(points,
+			Point{Database: "mydb", Measurement: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"usage": float64(i)}, Timestamp: ts},
+			Point{Database: "mydb", Measurement: "cpu", Tags: map[string]string{"host": "b"}, Fields: map[string]float64{"usage": float64(i)}, Timestamp: ts})
+	}
+	assert.NoError(t, m.SaveBatch(points))
+	count := func() int {
+		got, err := m.GetMeasurementRange("mydb", "cpu", base.UnixNano(), base.Add(3*time.Hour).UnixNano())
+		assert.NoError(t, err)
+		return len(got)
+	}
+
+	// Only the shards past the tiering age are uploaded
+	n, err := m.TierShards(ctx, base.Add(26*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Len(t, store.objects, 2)
+	n, err = m.TierShards(ctx, base.Add(26*time.Hour))
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+	var local int64
+	assert.NoError(t, m.db.QueryRow(`SELECT SUM(LENGTH(data)) FROM shard_1_blocks`).Scan(&local))
+	assert.Zero(t, local)
+
+	stats, err := m.Inspect(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stats.Databases[0].TieredShards)
+	report, err := m.CheckIntegrity(ctx, false)
+	assert.NoError(t, err)
+	assert.Empty(t, report.Issues)
+
+	// Queries read the cached copies, then download them once evicted
+	assert.Equal(t, 360, count())
+	assert.Zero(t, store.gets)
+	for key := range store.objects {
+		m.tier.discard(key)
+	}
+	assert.Equal(t, 360, count())
+	assert.Equal(t, 2, store.gets)
+	assert.Equal(t, 360, count())
+	assert.Equal(t, 2, store.gets)
+
+	// Points written late stay in the database file
+	assert.NoError(t, m.SaveBatch([]Point{{Database: "mydb", Measurement: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"usage": 1}, Timestamp: base.Add(30 * time.Second).UnixNano()}}))
+	assert.Equal(t, 361, count())
+
+	// Deletes restore the shards they rewrite
+	deleted, err := m.DeleteRange("mydb", base.UnixNano(), base.Add(30*time.Minute).UnixNano(), "cpu", map[string]string{"host": "b"})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(31), deleted)
+	assert.Equal(t, 330, count())
+	assert.Len(t, store.objects, 1)
+
+	// Retention drops tiered shards with their objects
+	_, err = m.DeleteBefore("mydb", base.Add(2*time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, store.objects)
+	assert.Equal(t, 120, count())
+
+	// The cache keeps the most recently read shards within its size
+	c, err := newTierCache(store, filepath.Join(dir, "small"), 10)
+	assert.NoError(t, err)
+	store.objects["a"], store.objects["b"] = []byte("01234"), []byte("01234567")
+	path, done, err := c.acquire(ctx, "a")
+	assert.NoError(t, err)
+	done()
+	_, done, err = c.acquire(ctx, "b")
+	assert.NoError(t, err)
+	// Shards being read are not evicted
+	_, release, err := c.acquire(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(13), c.size)
+	release()
+	assert.NoFileExists(t, path)
+	done()
+	assert.Equal(t, int64(8), c.size)
+}
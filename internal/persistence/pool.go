@@ -0,0 +1,433 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	tenantsOpen   = metrics.NewGauge("refluxdb_tenants_open", "Tenant database files open")
+	tenantOpens   = metrics.NewCounter("refluxdb_tenant_opens_total", "Tenant database files opened")
+	tenantsClosed = metrics.NewCounter("refluxdb_tenant_idle_closes_total", "Tenant database files closed after being idle")
+)
+
+// Tenant stores the points of its databases in a file of its own, so that
+// its writes, locks and growth do not affect the other tenants
+type Tenant struct {
+	Name string
+	// Path is the database file of the tenant
+	Path string
+	// Databases are the databases whose points are stored in Path
+	Databases []string
+}
+
+// PoolOptions configures a Pool
+type PoolOptions struct {
+	Tenants []Tenant
+	// Options opens the files of the tenants. Tiering is ignored, tenant
+	// files are never tiered.
+	Options Options
+	// IdleTimeout closes the files of the tenants unused for this long.
+	// Zero keeps them open once opened.
+	IdleTimeout time.Duration
+}
+
+// Pool routes the points of the databases of tenants to the files of the
+// tenants, opened on first use and closed once idle, and the points of
+// the other databases to the catalog, the main file. The catalog keeps
+// the entries of every database, so that they are listed, configured and
+// secured as usual.
+type Pool struct {
+	catalog *Manager
+	opts    PoolOptions
+	tenants map[string]Tenant
+	// owners maps the databases of the tenants to their tenant
+	owners map[string]string
+
+	mu   sync.Mutex
+	open map[string]*tenantFile
+	// known are the tenant databases present in the catalog
+	known map[string]bool
+}
+
+// tenantFile is the file of a tenant, opened by the first user while the
+// others wait for ready
+type tenantFile struct {
+	m     *Manager
+	err   error
+	ready chan struct{}
+	refs  int
+	used  time.Time
+}
+
+// NewPool validates the tenants of opts and returns a pool storing the
+// points of their databases in their files, and those of the other
+// databases in catalog. No file is opened until it is used.
+func NewPool(catalog *Manager, opts PoolOptions) (*Pool, error) {
+	if err := ValidateTenants(catalog.path, opts.Tenants); err != nil {
+		return nil, err
+	}
+	p := &Pool{
+		catalog: catalog,
+		opts:    opts,
+		tenants: make(map[string]Tenant),
+		owners:  make(map[string]string),
+		open:    make(map[string]*tenantFile),
+		known:   make(map[string]bool),
+	}
+	for _, t := range opts.Tenants {
+		for _, d := range t.Databases {
+			p.owners[d] = t.Name
+		}
+		p.tenants[t.Name] = t
+	}
+	return p, nil
+}
+
+// ValidateTenants checks that tenants have a name, a file other than the
+// catalog at path and databases, none of them shared
+func ValidateTenants(path string, tenants []Tenant) error {
+	names := make(map[string]bool)
+	paths := make(map[string]bool)
+	owners := make(map[string]string)
+	for _, t := range tenants {
+		if t.Name == "" || t.Path == "" {
+			return fmt.Errorf("invalid tenant %q: name and path are required", t.Name)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate tenant %q", t.Name)
+		}
+		if paths[t.Path] || t.Path == path {
+			return fmt.Errorf("invalid tenant %q: file %s is already used", t.Name, t.Path)
+		}
+		if len(t.Databases) == 0 {
+			return fmt.Errorf("invalid tenant %q: expected databases", t.Name)
+		}
+		for _, d := range t.Databases {
+			if owner, ok := owners[d]; ok {
+				return fmt.Errorf("invalid tenant %q: database %s already belongs to tenant %q", t.Name, d, owner)
+			}
+			owners[d] = t.Name
+		}
+		names[t.Name] = true
+		paths[t.Path] = true
+	}
+	return nil
+}
+
+// Catalog returns the main file
+func (p *Pool) Catalog() *Manager {
+	return p.catalog
+}
+
+// TenantOf returns the tenant owning database, and false when the
+// database is stored in the catalog
+func (p *Pool) TenantOf(database string) (string, bool) {
+	if database == "" {
+		database = DefaultDatabase
+	}
+	tenant, ok := p.owners[database]
+	return tenant, ok
+}
+
+// For returns the file storing the points of database and the function
+// to call once done with it, which lets the file of a tenant be closed
+func (p *Pool) For(database string) (*Manager, func(), error) {
+	tenant, ok := p.TenantOf(database)
+	if !ok {
+		return p.catalog, func() {}, nil
+	}
+	m, err := p.Acquire(tenant)
+	if err != nil {
+		return nil, nil, err
+	}
+	return m, func() { p.Release(tenant) }, nil
+}
+
+// Acquire returns the file of tenant, opening it when needed. It stays
+// open until Release is called as many times.
+func (p *Pool) Acquire(tenant string) (*Manager, error) {
+	p.mu.Lock()
+	f, ok := p.open[tenant]
+	if ok {
+		f.refs++
+		p.mu.Unlock()
+		<-f.ready
+		return f.m, f.err
+	}
+	t, ok := p.tenants[tenant]
+	if !ok {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("unknown tenant %q", tenant)
+	}
+	// Other tenants are served while the file is opened and migrated
+	f = &tenantFile{ready: make(chan struct{}), refs: 1}
+	p.open[tenant] = f
+	p.mu.Unlock()
+
+	f.m, f.err = p.openFile(t)
+	if f.err != nil {
+		p.mu.Lock()
+		delete(p.open, tenant)
+		p.mu.Unlock()
+	}
+	close(f.ready)
+	return f.m, f.err
+}
+
+func (p *Pool) openFile(t Tenant) (*Manager, error) {
+	opts := p.opts.Options
+	opts.Tiering = nil
+	if err := os.MkdirAll(filepath.Dir(t.Path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create directory of tenant %q: %w", t.Name, err)
+	}
+	m, err := NewWithOptions(t.Path, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file of tenant %q: %w", t.Name, err)
+	}
+	m.catalog = p.catalog
+	tenantOpens.Inc()
+	tenantsOpen.Add(1)
+	return m, nil
+}
+
+// Release ends a use of the file of tenant started by Acquire
+func (p *Pool) Release(tenant string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if f, ok := p.open[tenant]; ok {
+		f.refs--
+		f.used = time.Now()
+	}
+}
+
+// CloseIdle closes the files unused since IdleTimeout before now and
+// returns how many were closed
+func (p *Pool) CloseIdle(now time.Time) int {
+	if p.opts.IdleTimeout <= 0 {
+		return 0
+	}
+	var idle []*Manager
+	p.mu.Lock()
+	for tenant, f := range p.open {
+		if f.refs > 0 || f.m == nil || now.Sub(f.used) < p.opts.IdleTimeout {
+			continue
+		}
+		delete(p.open, tenant)
+		idle = append(idle, f.m)
+	}
+	p.mu.Unlock()
+
+	for _, m := range idle {
+		if err := m.Close(); err != nil {
+			log.Errorf("Failed to close tenant file %s: %v", m.path, err)
+		}
+		tenantsOpen.Add(-1)
+		tenantsClosed.Inc()
+	}
+	return len(idle)
+}
+
+// RunIdleClose closes the idle files every half IdleTimeout until ctx is
+// done
+func (p *Pool) RunIdleClose(ctx context.Context) {
+	if p.opts.IdleTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.opts.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			p.CloseIdle(now)
+		}
+	}
+}
+
+// SaveBatchContext stores points in the files of their databases, one
+// transaction per file. The databases of the tenants are added to the
+// catalog as they are written.
+func (p *Pool) SaveBatchContext(ctx context.Context, points []Point) error {
+	byTenant := make(map[string][]Point)
+	var main []Point
+	for _, pt := range points {
+		if tenant, ok := p.TenantOf(pt.Database); ok {
+			byTenant[tenant] = append(byTenant[tenant], pt)
+		} else {
+			main = append(main, pt)
+		}
+	}
+	if len(byTenant) == 0 {
+		return p.catalog.SaveBatchContext(ctx, points)
+	}
+	if len(main) > 0 {
+		if err := p.catalog.SaveBatchContext(ctx, main); err != nil {
+			return err
+		}
+	}
+	for tenant, points := range byTenant {
+		if err := p.register(points); err != nil {
+			return err
+		}
+		m, err := p.Acquire(tenant)
+		if err != nil {
+			return err
+		}
+		err = m.SaveBatchContext(ctx, points)
+		p.Release(tenant)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveBatch stores points as SaveBatchContext does
+func (p *Pool) SaveBatch(points []Point) error {
+	return p.SaveBatchContext(context.Background(), points)
+}
+
+// register adds the databases of points to the catalog
+func (p *Pool) register(points []Point) error {
+	for _, pt := range points {
+		name := pt.Database
+		if name == "" {
+			name = DefaultDatabase
+		}
+		p.mu.Lock()
+		known := p.known[name]
+		p.mu.Unlock()
+		if known {
+			continue
+		}
+		if err := p.catalog.CreateDatabase(name); err != nil {
+			return err
+		}
+		p.mu.Lock()
+		p.known[name] = true
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+// DropDatabase removes database from the catalog and its points from the
+// file storing them
+func (p *Pool) DropDatabase(name string) error {
+	return p.DropDatabaseContext(context.Background(), name)
+}
+
+// DropDatabaseContext is DropDatabase giving up once ctx is done
+func (p *Pool) DropDatabaseContext(ctx context.Context, name string) error {
+	if err := p.catalog.DropDatabaseContext(ctx, name); err != nil {
+		return err
+	}
+	tenant, ok := p.TenantOf(name)
+	if !ok {
+		return nil
+	}
+	p.mu.Lock()
+	delete(p.known, name)
+	p.mu.Unlock()
+	m, err := p.Acquire(tenant)
+	if err != nil {
+		return err
+	}
+	defer p.Release(tenant)
+	return m.DropDatabaseContext(ctx, name)
+}
+
+// EnforceRetention applies the retention periods of the catalog to the
+// files of the tenants, as Manager.EnforceRetention does to the catalog,
+// and returns how many points were deleted
+func (p *Pool) EnforceRetention(now time.Time) (int64, error) {
+	databases, err := p.catalog.Databases()
+	if err != nil {
+		return 0, err
+	}
+	names := make([]string, 0, len(p.tenants))
+	for name := range p.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var total int64
+	for _, tenant := range names {
+		var owned []Database
+		for _, d := range databases {
+			if p.owners[d.Name] == tenant {
+				owned = append(owned, d)
+			}
+		}
+		m, err := p.Acquire(tenant)
+		if err != nil {
+			return total, err
+		}
+		n, err := m.enforceRetention(now, owned)
+		p.Release(tenant)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("failed to enforce retention of tenant %q: %w", tenant, err)
+		}
+	}
+	return total, nil
+}
+
+// RunRetention enforces retention on the catalog and the files of the
+// tenants every interval until ctx is done
+func (p *Pool) RunRetention(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := p.catalog.EnforceRetention(now)
+			if err == nil {
+				var tenants int64
+				tenants, err = p.EnforceRetention(now)
+				n += tenants
+			}
+			if err != nil {
+				log.Errorf("Failed to enforce retention: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Infof("Retention deleted %d expired points", n)
+			}
+		}
+	}
+}
+
+// Close closes the files of the tenants, not the catalog
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	open := p.open
+	p.open = make(map[string]*tenantFile)
+	p.mu.Unlock()
+
+	var first error
+	for _, f := range open {
+		<-f.ready
+		if f.m == nil {
+			continue
+		}
+		if err := f.m.Close(); err != nil && first == nil {
+			first = err
+		}
+		tenantsOpen.Add(-1)
+	}
+	return first
+}
@@ -0,0 +1,114 @@
+package persistence
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Quota limits the writes of a token. Zero values are unlimited.
+type Quota struct {
+	// PointsPerSecond is the sustained rate of points written
+	PointsPerSecond float64
+	// Burst is the number of points written at once above the sustained
+	// rate. Zero allows one second of points.
+	Burst int64
+	// BytesPerDay is the size of the write bodies of a UTC day
+	BytesPerDay int64
+}
+
+// Validate checks that the limits of q are not negative
+func (q Quota) Validate() error {
+	if q.PointsPerSecond < 0 || q.Burst < 0 || q.BytesPerDay < 0 {
+		return fmt.Errorf("invalid quota: limits must not be negative")
+	}
+	return nil
+}
+
+// Token returns the token with the given ID, or ErrTokenNotFound
+func (m *Manager) Token(id string) (Token, error) {
+	t, err := scanToken(m.db.QueryRow(`SELECT `+tokenColumns+` FROM tokens WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Token{}, ErrTokenNotFound
+	}
+	if err != nil {
+		return Token{}, fmt.Errorf("failed to look up token: %w", err)
+	}
+	return t, nil
+}
+
+// SetTokenQuota replaces the quota of the token with the given ID
+func (m *Manager) SetTokenQuota(id string, q Quota) error {
+	if err := q.Validate(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res, err := m.db.Exec(`UPDATE tokens SET points_per_second = ?, burst = ?, bytes_per_day = ? WHERE id = ?`,
+		q.PointsPerSecond, q.Burst, q.BytesPerDay, id)
+	if err != nil {
+		return fmt.Errorf("failed to set quota of token %s: %w", id, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTokenNotFound
+	}
+	return nil
+}
+
+// usageDay is the UTC day of t, counted from the Unix epoch
+func usageDay(t time.Time) int64 {
+	return t.Unix() / 86400
+}
+
+// TokenUsage returns the bytes written with the token id during the UTC
+// day of t
+func (m *Manager) TokenUsage(id string, t time.Time) (int64, error) {
+	var bytes int64
+	err := m.db.QueryRow(`SELECT bytes FROM token_usage WHERE token_id = ? AND day = ?`, id, usageDay(t)).Scan(&bytes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read usage of token %s: %w", id, err)
+	}
+	return bytes, nil
+}
+
+// AddTokenUsage counts n bytes written with the token id during the UTC
+// day of t, unless they would take the usage of the day over limit, and
+// returns the usage of the day and whether they were counted. Limit is
+// ignored when it is not positive, and a negative n gives bytes back. The
+// usage of the previous days is forgotten.
+func (m *Manager) AddTokenUsage(id string, t time.Time, n, limit int64) (int64, bool, error) {
+	day := usageDay(t)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	var used int64
+	err = tx.QueryRow(`SELECT bytes FROM token_usage WHERE token_id = ? AND day = ?`, id, day).Scan(&used)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, false, fmt.Errorf("failed to read usage of token %s: %w", id, err)
+	}
+	if limit > 0 && used+n > limit {
+		return used, false, nil
+	}
+	if _, err := tx.Exec(`DELETE FROM token_usage WHERE token_id = ? AND day < ?`, id, day); err != nil {
+		return 0, false, fmt.Errorf("failed to update usage of token %s: %w", id, err)
+	}
+	_, err = tx.Exec(`INSERT INTO token_usage (token_id, day, bytes) VALUES (?, ?, ?)
+		ON CONFLICT(token_id, day) DO UPDATE SET bytes = bytes + excluded.bytes`, id, day, n)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to update usage of token %s: %w", id, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, false, fmt.Errorf("failed to update usage of token %s: %w", id, err)
+	}
+	return used + n, true, nil
+}
@@ -0,0 +1,378 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// The kinds of series rewrites
+const (
+	// RewriteRenameMeasurement renames Measurement to To
+	RewriteRenameMeasurement = "rename-measurement"
+	// RewriteAddTag adds Tag with Value to the series without it
+	RewriteAddTag = "add-tag"
+	// RewriteRenameTag renames the tag key Tag to To
+	RewriteRenameTag = "rename-tag"
+	// RewriteDropTag removes Tag from the series
+	RewriteDropTag = "drop-tag"
+)
+
+// rewriteBatch is the number of series rewritten by a transaction.
+// Writers wait for the batch in progress only.
+const rewriteBatch = 100
+
+// Rewrite changes the measurement or tags of the series of a database,
+// moving their historical points along
+type Rewrite struct {
+	Kind     string
+	Database string
+	// Measurement limits the rewrite to the series of one measurement,
+	// every measurement when empty. It is required to rename a
+	// measurement.
+	Measurement string
+	// Tag is the tag key added, renamed or dropped
+	Tag string
+	// Value is the value of an added tag. Series already carrying the tag
+	// keep theirs.
+	Value string
+	// To is the new name of the measurement or tag key. Series already
+	// carrying a tag named To keep their tags.
+	To string
+}
+
+// Validate checks that the fields required by the kind are set
+func (r Rewrite) Validate() error {
+	if r.Database == "" {
+		return errors.New("database is required")
+	}
+	switch r.Kind {
+	case RewriteRenameMeasurement:
+		if r.Measurement == "" || r.To == "" {
+			return errors.New("rename-measurement requires the measurement and its new name")
+		}
+		if r.Measurement == r.To {
+			return errors.New("the new measurement name must differ from the current one")
+		}
+	case RewriteAddTag:
+		if r.Tag == "" || r.Value == "" {
+			return errors.New("add-tag requires the tag key and value")
+		}
+	case RewriteRenameTag:
+		if r.Tag == "" || r.To == "" {
+			return errors.New("rename-tag requires the tag key and its new name")
+		}
+		if r.Tag == r.To {
+			return errors.New("the new tag key must differ from the current one")
+		}
+	case RewriteDropTag:
+		if r.Tag == "" {
+			return errors.New("drop-tag requires the tag key")
+		}
+	default:
+		return fmt.Errorf("unknown rewrite %q: expected rename-measurement, add-tag, rename-tag or drop-tag", r.Kind)
+	}
+	return nil
+}
+
+// apply returns the measurement and tags of a series once rewritten, and
+// whether they changed
+func (r Rewrite) apply(measurement string, tags map[string]string) (string, map[string]string, bool) {
+	rewritten := make(map[string]string, len(tags)+1)
+	for k, v := range tags {
+		rewritten[k] = v
+	}
+	switch r.Kind {
+	case RewriteRenameMeasurement:
+		return r.To, rewritten, true
+	case RewriteAddTag:
+		if _, ok := tags[r.Tag]; ok {
+			return measurement, tags, false
+		}
+		rewritten[r.Tag] = r.Value
+	case RewriteRenameTag:
+		v, ok := tags[r.Tag]
+		if _, taken := tags[r.To]; !ok || taken {
+			return measurement, tags, false
+		}
+		delete(rewritten, r.Tag)
+		rewritten[r.To] = v
+	case RewriteDropTag:
+		if _, ok := tags[r.Tag]; !ok {
+			return measurement, tags, false
+		}
+		delete(rewritten, r.Tag)
+	}
+	return measurement, rewritten, true
+}
+
+// RewriteProgress reports how far a rewrite went
+type RewriteProgress struct {
+	// Series is the number of series of the database the rewrite applies
+	// to, and Done the number examined so far
+	Series int64
+	Done   int64
+	// Rewritten counts the series whose key changed, Merged those among
+	// them whose new key was already taken by a series they were merged
+	// into
+	Rewritten int64
+	Merged    int64
+	// PointsMoved counts the points moved to another series by merges
+	PointsMoved int64
+}
+
+// RewriteSeries applies r to the series of its database in batches,
+// calling progress, when not nil, after each one. Series whose new key is
+// taken by another series are merged into it, their points winning over
+// those of the other series at the same timestamp. Rewrites are
+// idempotent, so one that failed or was cancelled through ctx can be run
+// again to finish.
+func (m *Manager) RewriteSeries(ctx context.Context, r Rewrite, progress func(RewriteProgress)) (RewriteProgress, error) {
+	var p RewriteProgress
+	if err := r.Validate(); err != nil {
+		return p, err
+	}
+	id, ok, err := m.databaseID(nil, r.Database)
+	if err != nil {
+		return p, err
+	}
+	if !ok {
+		return p, fmt.Errorf("database %s not found", r.Database)
+	}
+
+	count := `SELECT COUNT(*) FROM series WHERE database_id = ?`
+	args := []interface{}{id}
+	if r.Measurement != "" {
+		count += ` AND measurement = ?`
+		args = append(args, r.Measurement)
+	}
+	if err := m.db.QueryRowContext(ctx, count, args...).Scan(&p.Series); err != nil {
+		return p, fmt.Errorf("failed to count series: %w", err)
+	}
+
+	var last int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return p, err
+		}
+		n, err := m.rewriteBatch(id, r, &last, &p)
+		if err != nil {
+			return p, err
+		}
+		if n == 0 {
+			return p, nil
+		}
+		if progress != nil {
+			progress(p)
+		}
+	}
+}
+
+// rewriteBatch rewrites the next batch of series after *last inside one
+// transaction and returns how many series it examined
+func (m *Manager) rewriteBatch(databaseID string, r Rewrite, last *int64, p *RewriteProgress) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for {
+		n, tiered, err := m.tryRewriteBatch(databaseID, r, last, p)
+		if err != nil || len(tiered) == 0 {
+			return n, err
+		}
+		// The blocks of merged series are moved within the database file
+		if err := m.restoreShards(context.Background(), databaseID, tiered); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// tryRewriteBatch is rewriteBatch without the writer lock. It stops
+// before merging a series with blocks in tiered shards, returning them.
+func (m *Manager) tryRewriteBatch(databaseID string, r Rewrite, last *int64, p *RewriteProgress) (int, []shard, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, measurement, tags FROM series WHERE database_id = ? AND id > ?`
+	args := []interface{}{databaseID, *last}
+	if r.Measurement != "" {
+		query += ` AND measurement = ?`
+		args = append(args, r.Measurement)
+	}
+	rows, err := tx.Query(query+` ORDER BY id LIMIT ?`, append(args, rewriteBatch)...)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to list series: %w", err)
+	}
+	type series struct {
+		id          int64
+		measurement string
+		tags        map[string]string
+	}
+	var batch []series
+	for rows.Next() {
+		var s series
+		var tagsJSON string
+		if err := rows.Scan(&s.id, &s.measurement, &tagsJSON); err != nil {
+			rows.Close()
+			return 0, nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if err := json.Unmarshal([]byte(tagsJSON), &s.tags); err != nil {
+			rows.Close()
+			return 0, nil, fmt.Errorf("failed to unmarshal tags: %w", err)
+		}
+		batch = append(batch, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	if len(batch) == 0 {
+		return 0, nil, nil
+	}
+
+	progress := *p
+	shards := m.shards.all()[databaseID]
+	for _, s := range batch {
+		progress.Done++
+		measurement, tags, changed := r.apply(s.measurement, s.tags)
+		if !changed {
+			continue
+		}
+		progress.Rewritten++
+		key := SeriesKey(measurement, tags)
+
+		var target int64
+		err := tx.QueryRow(`SELECT id FROM series WHERE database_id = ? AND key = ?`, databaseID, key).Scan(&target)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			tagsJSON, err := json.Marshal(tags)
+			if err != nil {
+				return 0, nil, fmt.Errorf("failed to marshal tags: %w", err)
+			}
+			if _, err := tx.Exec(`UPDATE series SET measurement = ?, key = ?, tags = ? WHERE id = ?`, measurement, key, string(tagsJSON), s.id); err != nil {
+				return 0, nil, fmt.Errorf("failed to rewrite series %d: %w", s.id, err)
+			}
+		case err != nil:
+			return 0, nil, fmt.Errorf("failed to look up series %s: %w", key, err)
+		default:
+			tiered, err := tieredBlocks(tx, shards, []int64{s.id}, math.MinInt64, math.MaxInt64)
+			if err != nil || len(tiered) > 0 {
+				return 0, tiered, err
+			}
+			moved, err := m.mergeSeries(tx, shards, s.id, target)
+			if err != nil {
+				return 0, nil, err
+			}
+			progress.Merged++
+			progress.PointsMoved += moved
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, nil, fmt.Errorf("failed to commit rewrite: %w", err)
+	}
+	*last = batch[len(batch)-1].id
+	*p = progress
+	m.seriesIDs = make(map[seriesRef]int64)
+	m.state.reset()
+	m.bounds.reset()
+	m.hours.reset()
+	m.seriesIndex.reset()
+	return len(batch), nil, nil
+}
+
+// mergeSeries moves the points of series source to series target in
+// every shard, merging the fields of the points they share, then removes
+// source from the series dictionary. It returns how many points moved.
+func (m *Manager) mergeSeries(tx *sql.Tx, shards []shard, source, target int64) (int64, error) {
+	var moved int64
+	for _, s := range shards {
+		// Points at timestamps free in target move in place, the others
+		// are merged one by one
+		res, err := tx.Exec(`UPDATE OR IGNORE `+s.table()+` SET series_id = ? WHERE series_id = ?`, target, source)
+		if err != nil {
+			return 0, fmt.Errorf("failed to move points of shard %s: %w", s.table(), err)
+		}
+		n, _ := res.RowsAffected()
+		moved += n
+
+		rows, err := tx.Query(`SELECT timestamp, fields FROM `+s.table()+` WHERE series_id = ?`, source)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read shard %s: %w", s.table(), err)
+		}
+		var shared []blockPoint
+		for rows.Next() {
+			var p blockPoint
+			var data []byte
+			if err := rows.Scan(&p.timestamp, &data); err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("failed to scan row: %w", err)
+			}
+			if p.fields, err = decodeFields(data); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			shared = append(shared, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, fmt.Errorf("error iterating rows: %w", err)
+		}
+		for _, p := range shared {
+			if err := m.mergeFields(tx, s, target, p.timestamp, p.fields); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := tx.Exec(`DELETE FROM `+s.table()+` WHERE series_id = ?`, source); err != nil {
+			return 0, fmt.Errorf("failed to move points of shard %s: %w", s.table(), err)
+		}
+		moved += int64(len(shared))
+
+		if s.packed {
+			n, err := mergeSeriesBlocks(tx, s, source, target)
+			if err != nil {
+				return 0, fmt.Errorf("failed to move points of shard %s: %w", s.table(), err)
+			}
+			moved += n
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM series WHERE id = ?`, source); err != nil {
+		return 0, fmt.Errorf("failed to remove series %d: %w", source, err)
+	}
+	return moved, nil
+}
+
+// mergeSeriesBlocks moves the blocks of series source in packed shard s
+// to series target, repacking both when target has blocks too, and
+// returns how many points moved
+func mergeSeriesBlocks(tx *sql.Tx, s shard, source, target int64) (int64, error) {
+	var moved, existing int64
+	err := tx.QueryRow(`SELECT COALESCE(SUM(CASE WHEN series_id = ? THEN count END), 0), COUNT(CASE WHEN series_id = ? THEN 1 END) FROM `+s.blocksTable()+` WHERE series_id IN (?, ?)`,
+		source, target, source, target).Scan(&moved, &existing)
+	if err != nil || moved == 0 {
+		return 0, err
+	}
+	if existing == 0 {
+		_, err := tx.Exec(`UPDATE `+s.blocksTable()+` SET series_id = ? WHERE series_id = ?`, target, source)
+		return moved, err
+	}
+
+	query := `SELECT data FROM ` + s.blocksTable() + ` WHERE series_id = ? ORDER BY min_time`
+	kept, err := readBlocks(tx, query, target)
+	if err != nil {
+		return 0, err
+	}
+	added, err := readBlocks(tx, query, source)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM `+s.blocksTable()+` WHERE series_id IN (?, ?)`, source, target); err != nil {
+		return 0, err
+	}
+	return moved, writeBlocks(tx, s, target, mergeBlockPoints(kept, added))
+}
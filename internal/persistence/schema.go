@@ -0,0 +1,594 @@
+package persistence
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// migrations upgrade the schema of existing databases. Entry i moves a
+// database from user_version i to i+1, so new entries must only be appended.
+var migrations = []func(tx *sql.Tx) error{
+	migrateSeriesKey,
+	migrateDatabases,
+	migrateCatalog,
+	migrateOrganizations,
+	migrateShards,
+	migrateSeriesDictionary,
+	migrateShardBlocks,
+	migrateSubscriptions,
+	migrateTasks,
+	migrateTokens,
+	migrateUsers,
+	migrateAudit,
+	migrateTieredShards,
+	migrateDeadLetters,
+	migrateTokenQuotas,
+}
+
+func createSchema(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	// The original points table is the starting point of the migrations,
+	// which end up moving its rows into shards
+	if version == 0 {
+		schema := `
+    CREATE TABLE IF NOT EXISTS points (
+        id INTEGER PRIMARY KEY,
+        measurement TEXT NOT NULL,
+        timestamp INTEGER NOT NULL,
+        tags TEXT NOT NULL,
+        fields TEXT NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS idx_measurement ON points(measurement);
+    CREATE INDEX IF NOT EXISTS idx_timestamp ON points(timestamp);
+    `
+		if _, err := db.Exec(schema); err != nil {
+			return err
+		}
+	}
+
+	return migrate(db)
+}
+
+// migrate applies every migration newer than the database user_version
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %w", version+1, err)
+		}
+		if err := migrations[version](tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", version+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to update schema version: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %d: %w", version+1, err)
+		}
+	}
+
+	return nil
+}
+
+// migrateSeriesKey adds the series key column, merges points that share a
+// series and timestamp (older databases stored one row per field) and
+// enforces uniqueness of (series, timestamp).
+func migrateSeriesKey(tx *sql.Tx) error {
+	if _, err := tx.Exec(`ALTER TABLE points ADD COLUMN series TEXT NOT NULL DEFAULT ''`); err != nil {
+		return fmt.Errorf("failed to add series column: %w", err)
+	}
+
+	rows, err := tx.Query(`SELECT id, measurement, tags FROM points`)
+	if err != nil {
+		return fmt.Errorf("failed to read points: %w", err)
+	}
+	keys := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var measurement, tagsJSON string
+		if err := rows.Scan(&id, &measurement, &tagsJSON); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		var tags map[string]string
+		if err := json.Unmarshal([]byte(tagsJSON), &tags); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to unmarshal tags: %w", err)
+		}
+		keys[id] = SeriesKey(measurement, tags)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	for id, key := range keys {
+		if _, err := tx.Exec(`UPDATE points SET series = ? WHERE id = ?`, key, id); err != nil {
+			return fmt.Errorf("failed to set series key: %w", err)
+		}
+	}
+
+	if err := mergeDuplicates(tx); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_series_timestamp ON points(series, timestamp)`)
+	return err
+}
+
+// mergeDuplicates folds rows sharing a series and timestamp into the most
+// recently inserted one, merging their fields in insertion order
+func mergeDuplicates(tx *sql.Tx) error {
+	rows, err := tx.Query(`
+        SELECT id, series, timestamp, fields
+        FROM points
+        WHERE (series, timestamp) IN (
+            SELECT series, timestamp FROM points GROUP BY series, timestamp HAVING COUNT(*) > 1
+        )
+        ORDER BY series, timestamp, id
+    `)
+	if err != nil {
+		return fmt.Errorf("failed to find duplicate points: %w", err)
+	}
+
+	type merged struct {
+		keep   int64
+		drop   []int64
+		fields map[string]float64
+	}
+	var groups []*merged
+	var current *merged
+	var lastSeries string
+	var lastTimestamp int64
+
+	for rows.Next() {
+		var id, timestamp int64
+		var series, fieldsJSON string
+		if err := rows.Scan(&id, &series, &timestamp, &fieldsJSON); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		var fields map[string]float64
+		if err := json.Unmarshal([]byte(fieldsJSON), &fields); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to unmarshal fields: %w", err)
+		}
+
+		if current == nil || series != lastSeries || timestamp != lastTimestamp {
+			current = &merged{fields: make(map[string]float64)}
+			groups = append(groups, current)
+			lastSeries, lastTimestamp = series, timestamp
+		} else {
+			current.drop = append(current.drop, current.keep)
+		}
+		current.keep = id
+		for k, v := range fields {
+			current.fields[k] = v
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	for _, g := range groups {
+		fieldsJSON, err := json.Marshal(g.fields)
+		if err != nil {
+			return fmt.Errorf("failed to marshal fields: %w", err)
+		}
+		if _, err := tx.Exec(`UPDATE points SET fields = ? WHERE id = ?`, string(fieldsJSON), g.keep); err != nil {
+			return fmt.Errorf("failed to merge point: %w", err)
+		}
+		for _, id := range g.drop {
+			if _, err := tx.Exec(`DELETE FROM points WHERE id = ?`, id); err != nil {
+				return fmt.Errorf("failed to remove duplicate point: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// migrateDatabases scopes points to a database. Existing points are moved
+// to DefaultDatabase, and the databases table records every namespace so
+// empty databases can exist.
+func migrateDatabases(tx *sql.Tx) error {
+	stmts := []string{
+		fmt.Sprintf(`ALTER TABLE points ADD COLUMN database TEXT NOT NULL DEFAULT '%s'`, DefaultDatabase),
+		`DROP INDEX IF EXISTS idx_series_timestamp`,
+		`CREATE UNIQUE INDEX idx_database_series_timestamp ON points(database, series, timestamp)`,
+		`CREATE INDEX idx_database_measurement_timestamp ON points(database, measurement, timestamp)`,
+		`CREATE TABLE databases (
+            name TEXT PRIMARY KEY,
+            created_at INTEGER NOT NULL
+        )`,
+		`INSERT INTO databases (name, created_at)
+            SELECT DISTINCT database, CAST(strftime('%s', 'now') AS INTEGER) * 1000000000 FROM points`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to scope points by database: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateCatalog adds the bucket metadata of the v2 API to databases: a
+// stable ID, the owning organization, a description and a retention period
+func migrateCatalog(tx *sql.Tx) error {
+	stmts := []string{
+		`ALTER TABLE databases ADD COLUMN id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE databases ADD COLUMN org_id TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE databases ADD COLUMN description TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE databases ADD COLUMN retention_period INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE databases ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE databases SET id = lower(hex(randomblob(8))), updated_at = created_at`,
+		`CREATE UNIQUE INDEX idx_databases_id ON databases(id)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to add database metadata: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateOrganizations adds the organizations of the v2 API
+func migrateOrganizations(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE organizations (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL UNIQUE,
+			description TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create organizations table: %w", err)
+	}
+	return nil
+}
+
+// migrateShards moves the points table into one shard table per database
+// and DefaultShardDuration window
+func migrateShards(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE shards (
+			id INTEGER PRIMARY KEY,
+			database_id TEXT NOT NULL,
+			start_time INTEGER NOT NULL,
+			end_time INTEGER NOT NULL
+		);
+		CREATE INDEX idx_shards_database ON shards(database_id, start_time);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create shards table: %w", err)
+	}
+
+	duration := int64(DefaultShardDuration)
+	rows, err := tx.Query(`
+		SELECT DISTINCT d.id, p.timestamp - ((p.timestamp % ?) + ?) % ?
+		FROM points p JOIN databases d ON d.name = p.database`, duration, duration, duration)
+	if err != nil {
+		return fmt.Errorf("failed to read shard windows: %w", err)
+	}
+	type window struct {
+		databaseID string
+		start      int64
+	}
+	var windows []window
+	for rows.Next() {
+		var w window
+		if err := rows.Scan(&w.databaseID, &w.start); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		windows = append(windows, w)
+	}
+	rows.Close()
+
+	for _, w := range windows {
+		s, err := registerShard(tx, w.databaseID, w.start, w.start+duration)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			CREATE TABLE ` + s.table() + ` (
+				measurement TEXT NOT NULL,
+				series TEXT NOT NULL,
+				timestamp INTEGER NOT NULL,
+				tags TEXT NOT NULL,
+				fields TEXT NOT NULL,
+				UNIQUE (series, timestamp)
+			)`)
+		if err != nil {
+			return fmt.Errorf("failed to create shard %s: %w", s.table(), err)
+		}
+		_, err = tx.Exec(`
+			INSERT INTO `+s.table()+` (measurement, series, timestamp, tags, fields)
+			SELECT p.measurement, p.series, p.timestamp, p.tags, p.fields
+			FROM points p JOIN databases d ON d.name = p.database
+			WHERE d.id = ? AND p.timestamp >= ? AND p.timestamp < ?`, w.databaseID, s.start, s.end)
+		if err != nil {
+			return fmt.Errorf("failed to move points to shard %s: %w", s.table(), err)
+		}
+	}
+
+	if _, err := tx.Exec(`DROP TABLE points`); err != nil {
+		return fmt.Errorf("failed to drop points table: %w", err)
+	}
+	return nil
+}
+
+// migrateSeriesDictionary moves the measurement and tags of every point
+// into the series table, so shard rows only hold a series ID, a timestamp
+// and the fields
+func migrateSeriesDictionary(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE series (
+			id INTEGER PRIMARY KEY,
+			database_id TEXT NOT NULL,
+			measurement TEXT NOT NULL,
+			key TEXT NOT NULL,
+			tags TEXT NOT NULL,
+			UNIQUE (database_id, key)
+		);
+		CREATE INDEX idx_series_measurement ON series(database_id, measurement);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create series table: %w", err)
+	}
+
+	rows, err := tx.Query(`SELECT id, database_id FROM shards`)
+	if err != nil {
+		return fmt.Errorf("failed to list shards: %w", err)
+	}
+	databases := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var databaseID string
+		if err := rows.Scan(&id, &databaseID); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		databases[id] = databaseID
+	}
+	rows.Close()
+
+	for id, databaseID := range databases {
+		table := shard{id: id}.table()
+		stmts := []struct {
+			query string
+			args  []interface{}
+		}{
+			{`INSERT OR IGNORE INTO series (database_id, measurement, key, tags)
+				SELECT ?, measurement, series, tags FROM ` + table, []interface{}{databaseID}},
+			{`ALTER TABLE ` + table + ` RENAME TO ` + table + `_old`, nil},
+			{`CREATE TABLE ` + table + ` (
+				series_id INTEGER NOT NULL,
+				timestamp INTEGER NOT NULL,
+				fields BLOB NOT NULL,
+				PRIMARY KEY (series_id, timestamp)
+			) WITHOUT ROWID`, nil},
+			{`INSERT INTO ` + table + ` (series_id, timestamp, fields)
+				SELECT s.id, p.timestamp, p.fields
+				FROM ` + table + `_old p JOIN series s ON s.database_id = ? AND s.key = p.series`, []interface{}{databaseID}},
+			{`DROP TABLE ` + table + `_old`, nil},
+		}
+		for _, stmt := range stmts {
+			if _, err := tx.Exec(stmt.query, stmt.args...); err != nil {
+				return fmt.Errorf("failed to convert shard %s: %w", table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// migrateShardBlocks records which shards were packed into blocks by the
+// columnar engine
+func migrateShardBlocks(tx *sql.Tx) error {
+	if _, err := tx.Exec(`ALTER TABLE shards ADD COLUMN packed INTEGER NOT NULL DEFAULT 0`); err != nil {
+		return fmt.Errorf("failed to add packed column: %w", err)
+	}
+	return nil
+}
+
+// migrateSubscriptions adds the subscriptions forwarding written points to
+// other servers
+func migrateSubscriptions(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE subscriptions (
+			database_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			mode TEXT NOT NULL,
+			destinations TEXT NOT NULL,
+			measurements TEXT NOT NULL DEFAULT '[]',
+			created_at INTEGER NOT NULL,
+			PRIMARY KEY (database_id, name)
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create subscriptions table: %w", err)
+	}
+	return nil
+}
+
+// migrateTasks adds the tasks running queries on a schedule and their run
+// history
+func migrateTasks(tx *sql.Tx) error {
+	stmts := []string{`
+		CREATE TABLE tasks (
+			id TEXT PRIMARY KEY,
+			org_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			status TEXT NOT NULL,
+			query TEXT NOT NULL,
+			source_database TEXT NOT NULL,
+			destination TEXT NOT NULL,
+			every INTEGER NOT NULL DEFAULT 0,
+			cron TEXT NOT NULL DEFAULT '',
+			run_offset INTEGER NOT NULL DEFAULT 0,
+			max_retries INTEGER NOT NULL DEFAULT 0,
+			latest_completed INTEGER NOT NULL,
+			created_at INTEGER NOT NULL,
+			updated_at INTEGER NOT NULL
+		)`, `
+		CREATE TABLE task_runs (
+			id TEXT PRIMARY KEY,
+			task_id TEXT NOT NULL,
+			status TEXT NOT NULL,
+			range_start INTEGER NOT NULL,
+			scheduled_for INTEGER NOT NULL,
+			started_at INTEGER NOT NULL,
+			finished_at INTEGER NOT NULL,
+			attempts INTEGER NOT NULL,
+			points_written INTEGER NOT NULL,
+			error TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX idx_task_runs_task ON task_runs (task_id, started_at)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to create tasks tables: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateTokens adds the API tokens and their scopes. Only a hash of each
+// token is stored.
+func migrateTokens(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+		CREATE TABLE tokens (
+			id TEXT PRIMARY KEY,
+			hash TEXT NOT NULL UNIQUE,
+			description TEXT NOT NULL DEFAULT '',
+			scopes TEXT NOT NULL,
+			created_at INTEGER NOT NULL
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to create tokens table: %w", err)
+	}
+	return nil
+}
+
+// migrateUsers adds the v1 users, with bcrypt hashes of their passwords,
+// and their privileges on databases
+func migrateUsers(tx *sql.Tx) error {
+	stmts := []string{`
+		CREATE TABLE users (
+			name TEXT PRIMARY KEY,
+			hash TEXT NOT NULL,
+			admin INTEGER NOT NULL DEFAULT 0,
+			created_at INTEGER NOT NULL
+		)`, `
+		CREATE TABLE user_privileges (
+			user TEXT NOT NULL,
+			database TEXT NOT NULL,
+			privilege INTEGER NOT NULL,
+			PRIMARY KEY (user, database)
+		)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to create users tables: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateAudit adds the audit log of administrative operations. Triggers
+// reject updates and deletions so that entries can only be appended.
+func migrateAudit(tx *sql.Tx) error {
+	stmts := []string{`
+		CREATE TABLE audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			time INTEGER NOT NULL,
+			actor TEXT NOT NULL,
+			source TEXT NOT NULL,
+			action TEXT NOT NULL,
+			target TEXT NOT NULL,
+			detail TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX audit_log_time ON audit_log (time)`, `
+		CREATE TRIGGER audit_log_no_update BEFORE UPDATE ON audit_log
+		BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END`, `
+		CREATE TRIGGER audit_log_no_delete BEFORE DELETE ON audit_log
+		BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to create audit log table: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateTieredShards records the object holding the blocks of the shards
+// uploaded to object storage
+func migrateTieredShards(tx *sql.Tx) error {
+	if _, err := tx.Exec(`ALTER TABLE shards ADD COLUMN object TEXT NOT NULL DEFAULT ''`); err != nil {
+		return fmt.Errorf("failed to add object column: %w", err)
+	}
+	return nil
+}
+
+// migrateDeadLetters adds the lines dropped by the write path, kept to be
+// inspected and replayed
+func migrateDeadLetters(tx *sql.Tx) error {
+	stmts := []string{`
+		CREATE TABLE dead_letters (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			time INTEGER NOT NULL,
+			database TEXT NOT NULL,
+			source TEXT NOT NULL,
+			precision INTEGER NOT NULL,
+			line TEXT NOT NULL,
+			error TEXT NOT NULL
+		)`,
+		`CREATE INDEX dead_letters_database ON dead_letters (database, id)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to create dead letters table: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateTokenQuotas adds the write quotas of the tokens and the bytes
+// they wrote each day
+func migrateTokenQuotas(tx *sql.Tx) error {
+	stmts := []string{
+		`ALTER TABLE tokens ADD COLUMN points_per_second REAL NOT NULL DEFAULT 0`,
+		`ALTER TABLE tokens ADD COLUMN burst INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE tokens ADD COLUMN bytes_per_day INTEGER NOT NULL DEFAULT 0`,
+		`CREATE TABLE token_usage (
+			token_id TEXT NOT NULL,
+			day INTEGER NOT NULL,
+			bytes INTEGER NOT NULL,
+			PRIMARY KEY (token_id, day)
+		)`,
+	}
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to add token quotas: %w", err)
+		}
+	}
+	return nil
+}
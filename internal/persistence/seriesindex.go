@@ -0,0 +1,301 @@
+package persistence
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+)
+
+var seriesIndexSkips = metrics.NewCounter("refluxdb_storage_series_index_skips_total", "Measurements left out of scans, the series index showing no series carries the tags queried")
+
+const (
+	// bloomBitsPerEntry and bloomHashes give a false positive rate of
+	// about 1%
+	bloomBitsPerEntry = 10
+	bloomHashes       = 7
+	// minBloomEntries is the capacity of the filters of small measurements
+	minBloomEntries = 1024
+	// maxPairedTags is the number of tags of a series up to which its
+	// pairs of tags are indexed, series with more tags only having their
+	// tags indexed one by one
+	maxPairedTags = 8
+)
+
+// bloomFilter is a set of strings that may report strings it does not
+// hold, but never misses one it holds
+type bloomFilter struct {
+	bits []uint64
+	// entries is the number of strings added and capacity the number up
+	// to which the false positive rate holds
+	entries, capacity int
+}
+
+func newBloomFilter(capacity int) *bloomFilter {
+	capacity = max(capacity, minBloomEntries)
+	return &bloomFilter{bits: make([]uint64, (capacity*bloomBitsPerEntry+63)/64), capacity: capacity}
+}
+
+// positions calls fn with the bits of s, derived from one 64-bit hash by
+// double hashing
+func (f *bloomFilter) positions(s string, fn func(uint64)) {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	sum := h.Sum64()
+	h1, h2 := sum&math.MaxUint32, sum>>32|1
+	n := uint64(len(f.bits) * 64)
+	for i := uint64(0); i < bloomHashes; i++ {
+		fn((h1 + i*h2) % n)
+	}
+}
+
+// add adds s to the filter. Strings already reported as present are not
+// counted as entries, so that indexing a series again does not fill it.
+func (f *bloomFilter) add(s string) {
+	added := false
+	f.positions(s, func(bit uint64) {
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			f.bits[bit/64] |= 1 << (bit % 64)
+			added = true
+		}
+	})
+	if added {
+		f.entries++
+	}
+}
+
+func (f *bloomFilter) mayContain(s string) bool {
+	found := true
+	f.positions(s, func(bit uint64) {
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+// full reports whether the filter holds more strings than it was sized
+// for, its false positive rate growing past the expected one
+func (f *bloomFilter) full() bool {
+	return f.entries > f.capacity
+}
+
+// tagEntry is the entry of a tag in the filter of a measurement
+func tagEntry(key, value string) string {
+	return key + "\x00" + value
+}
+
+// tagPairEntry is the entry of two tags of a series, whose keys are in
+// order
+func tagPairEntry(k1, v1, k2, v2 string) string {
+	return k1 + "\x00" + v1 + "\x01" + k2 + "\x00" + v2
+}
+
+// seriesFilter indexes the tags of the series of a measurement
+type seriesFilter struct {
+	tags *bloomFilter
+	// paired is false when a series had more than maxPairedTags tags, so
+	// that pairs of tags cannot be looked up
+	paired bool
+}
+
+// add indexes the tags of a series, one by one and in pairs
+func (f *seriesFilter) add(tags map[string]string) {
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		f.tags.add(tagEntry(k, tags[k]))
+	}
+	if len(keys) > maxPairedTags {
+		f.paired = false
+		return
+	}
+	for i, k1 := range keys {
+		for _, k2 := range keys[i+1:] {
+			f.tags.add(tagPairEntry(k1, tags[k1], k2, tags[k2]))
+		}
+	}
+}
+
+// mayHave reports whether a series may carry every tag of tags, and false
+// when none does. Empty values stand for missing tags and are ignored.
+func (f *seriesFilter) mayHave(tags map[string]string) bool {
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !f.tags.mayContain(tagEntry(k, tags[k])) {
+			return false
+		}
+	}
+	if !f.paired {
+		return true
+	}
+	for i, k1 := range keys {
+		for _, k2 := range keys[i+1:] {
+			if !f.tags.mayContain(tagPairEntry(k1, tags[k1], k2, tags[k2])) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// seriesIndex keeps a bloom filter of the tags of the series of the
+// measurements queried so far, so that queries on tags no series carries
+// are answered without a scan. A measurement is loaded from the series
+// dictionary on its first query and then extended by writes. A filter
+// grown past its capacity is dropped, to be loaded again with a size
+// fitting its series. Series are never removed from the filters: deleted
+// series are only reported as possibly present.
+type seriesIndex struct {
+	mu      sync.Mutex
+	filters map[measurementRef]*seriesFilter
+	// version changes with every write and reset, so that a filter loaded
+	// while series were added is not kept
+	version uint64
+}
+
+func newSeriesIndex() *seriesIndex {
+	return &seriesIndex{filters: make(map[measurementRef]*seriesFilter)}
+}
+
+// observe indexes the series of the points of the loaded measurements
+func (x *seriesIndex) observe(points []Point) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.version++
+	if len(x.filters) == 0 {
+		return
+	}
+	for _, p := range points {
+		ref := measurementRef{database: p.Database, measurement: p.Measurement}
+		if ref.database == "" {
+			ref.database = DefaultDatabase
+		}
+		f, ok := x.filters[ref]
+		if !ok {
+			continue
+		}
+		f.add(p.Tags)
+		if f.tags.full() {
+			delete(x.filters, ref)
+		}
+	}
+}
+
+// get returns the filter of a loaded measurement, or the current version
+// to store it with once loaded
+func (x *seriesIndex) get(ref measurementRef) (*seriesFilter, bool, uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	f, ok := x.filters[ref]
+	return f, ok, x.version
+}
+
+// mayHave looks tags up in the filter of a loaded measurement
+func (x *seriesIndex) mayHave(f *seriesFilter, tags map[string]string) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return f.mayHave(tags)
+}
+
+// store keeps the filter of a measurement loaded at version, unless
+// points were written since
+func (x *seriesIndex) store(ref measurementRef, f *seriesFilter, version uint64) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.version == version {
+		x.filters[ref] = f
+	}
+}
+
+func (x *seriesIndex) reset() {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.version++
+	x.filters = make(map[measurementRef]*seriesFilter)
+}
+
+// MayHaveTags reports whether a series of a measurement may carry every
+// tag of tags, and false when none does, in which case a query filtered
+// on those tags returns no points. Empty values stand for missing tags
+// and are ignored. The series of the measurement are indexed in memory
+// once read, so the series dictionary is only read on its first call.
+func (m *Manager) MayHaveTags(ctx context.Context, database, measurement string, tags map[string]string) (bool, error) {
+	if len(tags) == 0 {
+		return true, nil
+	}
+	ref := measurementRef{database: database, measurement: measurement}
+	f, ok, version := m.seriesIndex.get(ref)
+	if !ok {
+		var err error
+		if f, err = m.loadSeriesFilter(ctx, ref); err != nil {
+			return false, err
+		}
+		m.seriesIndex.store(ref, f, version)
+	}
+	if !m.seriesIndex.mayHave(f, tags) {
+		seriesIndexSkips.Inc()
+		return false, nil
+	}
+	return true, nil
+}
+
+// loadSeriesFilter indexes the series of a measurement read from the
+// series dictionary
+func (m *Manager) loadSeriesFilter(ctx context.Context, ref measurementRef) (*seriesFilter, error) {
+	id, ok, err := m.databaseID(nil, ref.database)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return &seriesFilter{tags: newBloomFilter(0), paired: true}, nil
+	}
+
+	rows, err := m.db.QueryContext(ctx, `SELECT tags FROM series WHERE database_id = ? AND measurement = ?`, id, ref.measurement)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read series of %s: %w", ref.measurement, err)
+	}
+	defer rows.Close()
+	var series []map[string]string
+	entries := 0
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		var tags map[string]string
+		if err := json.Unmarshal([]byte(raw), &tags); err != nil {
+			return nil, fmt.Errorf("failed to decode tags of %s: %w", ref.measurement, err)
+		}
+		series = append(series, tags)
+		n := min(len(tags), maxPairedTags)
+		entries += len(tags) + n*(n-1)/2
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+
+	// The filter is sized with room for the series written next
+	f := &seriesFilter{tags: newBloomFilter(2 * entries), paired: true}
+	for _, tags := range series {
+		f.add(tags)
+	}
+	return f, nil
+}
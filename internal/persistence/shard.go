@@ -0,0 +1,595 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+)
+
+// DefaultShardDuration is the time window covered by a shard
+const DefaultShardDuration = 24 * time.Hour
+
+var (
+	shardsCreated = metrics.NewCounter("refluxdb_storage_shards_created_total", "Shards created")
+	shardsDropped = metrics.NewCounter("refluxdb_storage_shards_dropped_total", "Shards dropped by retention, compaction or database deletion")
+)
+
+// shard is a table holding the points of one database within a time
+// window. Windows of a database never overlap.
+type shard struct {
+	id    int64
+	start int64 // inclusive, in nanoseconds
+	end   int64 // exclusive, in nanoseconds
+	// packed shards also store points in a table of compressed blocks
+	packed bool
+	// object is the key of the copy of the blocks in object storage once
+	// the shard is tiered, the blocks table only keeping their time ranges
+	object string
+}
+
+func (s shard) table() string {
+	return fmt.Sprintf("shard_%d", s.id)
+}
+
+func (s shard) blocksTable() string {
+	return fmt.Sprintf("shard_%d_blocks", s.id)
+}
+
+// blocksSource is the table the data of the blocks is read from, which
+// for a tiered shard is its copy attached by tieredConn
+func (s shard) blocksSource() string {
+	if s.object != "" {
+		return tieredSchema + "." + s.blocksTable()
+	}
+	return s.blocksTable()
+}
+
+// overlaps reports whether the shard holds timestamps within [start, end]
+func (s shard) overlaps(start, end int64) bool {
+	return s.start <= end && s.end > start
+}
+
+// shardSet is the in-memory index of the shards of every database, keyed
+// by database ID and sorted by start time
+type shardSet struct {
+	mu         sync.RWMutex
+	byDatabase map[string][]shard
+}
+
+func loadShards(db *sql.DB) (*shardSet, error) {
+	rows, err := db.Query(`SELECT id, database_id, start_time, end_time, packed, object FROM shards ORDER BY start_time`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load shards: %w", err)
+	}
+	defer rows.Close()
+
+	set := &shardSet{byDatabase: make(map[string][]shard)}
+	for rows.Next() {
+		var s shard
+		var databaseID string
+		if err := rows.Scan(&s.id, &databaseID, &s.start, &s.end, &s.packed, &s.object); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		set.byDatabase[databaseID] = append(set.byDatabase[databaseID], s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return set, nil
+}
+
+// overlapping returns the shards of a database holding timestamps within
+// [start, end], in time order
+func (set *shardSet) overlapping(databaseID string, start, end int64) []shard {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+
+	var shards []shard
+	for _, s := range set.byDatabase[databaseID] {
+		if s.overlaps(start, end) {
+			shards = append(shards, s)
+		}
+	}
+	return shards
+}
+
+func (set *shardSet) add(databaseID string, shards ...shard) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	all := append(set.byDatabase[databaseID], shards...)
+	sort.Slice(all, func(i, j int) bool { return all[i].start < all[j].start })
+	set.byDatabase[databaseID] = all
+}
+
+func (set *shardSet) remove(databaseID string, ids map[int64]bool) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	kept := set.byDatabase[databaseID][:0]
+	for _, s := range set.byDatabase[databaseID] {
+		if !ids[s.id] {
+			kept = append(kept, s)
+		}
+	}
+	if len(kept) == 0 {
+		delete(set.byDatabase, databaseID)
+		return
+	}
+	set.byDatabase[databaseID] = kept
+}
+
+// markPacked records that shards of a database have a blocks table
+func (set *shardSet) markPacked(databaseID string, ids map[int64]bool) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	for i, s := range set.byDatabase[databaseID] {
+		if ids[s.id] {
+			set.byDatabase[databaseID][i].packed = true
+		}
+	}
+}
+
+// get returns a shard of a database
+func (set *shardSet) get(databaseID string, id int64) (shard, bool) {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+
+	for _, s := range set.byDatabase[databaseID] {
+		if s.id == id {
+			return s, true
+		}
+	}
+	return shard{}, false
+}
+
+// setObject records the object holding the blocks of a shard, empty
+// once they are restored
+func (set *shardSet) setObject(databaseID string, id int64, object string) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	for i, s := range set.byDatabase[databaseID] {
+		if s.id == id {
+			set.byDatabase[databaseID][i].object = object
+		}
+	}
+}
+
+func (set *shardSet) removeDatabase(databaseID string) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	delete(set.byDatabase, databaseID)
+}
+
+// all returns a copy of the shards of every database
+func (set *shardSet) all() map[string][]shard {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+
+	all := make(map[string][]shard, len(set.byDatabase))
+	for databaseID, shards := range set.byDatabase {
+		all[databaseID] = append([]shard(nil), shards...)
+	}
+	return all
+}
+
+// count returns the number of shards of every database
+func (set *shardSet) count() int {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+
+	n := 0
+	for _, shards := range set.byDatabase {
+		n += len(shards)
+	}
+	return n
+}
+
+// shardWindow returns the window of the shard receiving ts: aligned to
+// duration, and clipped so it does not overlap the existing shards, which
+// may have been created with another duration
+func shardWindow(ts int64, duration time.Duration, existing []shard) (int64, int64) {
+	d := int64(duration)
+	start := ts - ((ts%d)+d)%d
+	end := start + d
+	for _, s := range existing {
+		if s.start > ts && s.start < end {
+			end = s.start
+		}
+		if s.end <= ts && s.end > start {
+			start = s.end
+		}
+	}
+	return start, end
+}
+
+// registerShard records a new shard of a database inside tx
+func registerShard(tx *sql.Tx, databaseID string, start, end int64) (shard, error) {
+	res, err := tx.Exec(`INSERT INTO shards (database_id, start_time, end_time) VALUES (?, ?, ?)`, databaseID, start, end)
+	if err != nil {
+		return shard{}, fmt.Errorf("failed to register shard: %w", err)
+	}
+	s := shard{start: start, end: end}
+	if s.id, err = res.LastInsertId(); err != nil {
+		return shard{}, fmt.Errorf("failed to register shard: %w", err)
+	}
+	return s, nil
+}
+
+// createShard registers a new shard and creates its table inside tx.
+// Points reference their series by ID, so the measurement and tags are
+// stored once per series rather than once per point.
+func createShard(tx *sql.Tx, databaseID string, start, end int64) (shard, error) {
+	s, err := registerShard(tx, databaseID, start, end)
+	if err != nil {
+		return shard{}, err
+	}
+	if _, err := tx.Exec(shardTable(s.table())); err != nil {
+		return shard{}, fmt.Errorf("failed to create shard %s: %w", s.table(), err)
+	}
+	shardsCreated.Inc()
+	return s, nil
+}
+
+// shardTable returns the DDL of a shard table. Fields hold JSON text, or a
+// zstd compressed BLOB when field compression is enabled.
+func shardTable(table string) string {
+	return `CREATE TABLE ` + table + ` (
+		series_id INTEGER NOT NULL,
+		timestamp INTEGER NOT NULL,
+		fields BLOB NOT NULL,
+		PRIMARY KEY (series_id, timestamp)
+	) WITHOUT ROWID`
+}
+
+// blocksTableDDL returns the DDL of the blocks table of a packed shard,
+// each block holding up to blockSize points of a series
+func blocksTableDDL(table string) string {
+	return `CREATE TABLE IF NOT EXISTS ` + table + ` (
+		series_id INTEGER NOT NULL,
+		min_time INTEGER NOT NULL,
+		max_time INTEGER NOT NULL,
+		count INTEGER NOT NULL,
+		data BLOB NOT NULL,
+		PRIMARY KEY (series_id, min_time)
+	) WITHOUT ROWID`
+}
+
+// dropShard removes a shard and its points inside tx
+func dropShard(tx *sql.Tx, s shard) error {
+	for _, table := range []string{s.table(), s.blocksTable()} {
+		if _, err := tx.Exec(`DROP TABLE IF EXISTS ` + table); err != nil {
+			return fmt.Errorf("failed to drop shard %s: %w", s.table(), err)
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM shards WHERE id = ?`, s.id); err != nil {
+		return fmt.Errorf("failed to unregister shard %s: %w", s.table(), err)
+	}
+	shardsDropped.Inc()
+	return nil
+}
+
+// databaseShards returns every shard of a database inside tx
+func databaseShards(tx *sql.Tx, databaseID string) ([]shard, error) {
+	rows, err := tx.Query(`SELECT id, start_time, end_time, packed, object FROM shards WHERE database_id = ? ORDER BY start_time`, databaseID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list shards: %w", err)
+	}
+	defer rows.Close()
+
+	var shards []shard
+	for rows.Next() {
+		var s shard
+		if err := rows.Scan(&s.id, &s.start, &s.end, &s.packed, &s.object); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		shards = append(shards, s)
+	}
+	return shards, rows.Err()
+}
+
+// databaseID returns the ID of the named database, and false if it does
+// not exist. It is read within tx unless tx is nil.
+func (m *Manager) databaseID(tx *sql.Tx, name string) (string, bool, error) {
+	id, _, ok, err := m.retainedDatabase(tx, name)
+	return id, ok, err
+}
+
+// retainedDatabase returns the ID and retention period of the named
+// database, and false if it does not exist. It is read within tx unless
+// tx is nil.
+func (m *Manager) retainedDatabase(tx *sql.Tx, name string) (string, time.Duration, bool, error) {
+	var stmt *sql.Stmt
+	var release func()
+	var err error
+	if tx != nil {
+		stmt, release, err = m.stmts.tx(tx, selectDatabaseQuery)
+	} else {
+		stmt, release, err = m.stmts.get(context.Background(), selectDatabaseQuery)
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
+	defer release()
+
+	var id string
+	var retention int64
+	err = stmt.QueryRow(name).Scan(&id, &retention)
+	if err == sql.ErrNoRows {
+		return "", 0, false, nil
+	}
+	if err != nil {
+		return "", 0, false, fmt.Errorf("failed to look up database %s: %w", name, err)
+	}
+	return id, time.Duration(retention), true, nil
+}
+
+// isMissingTable reports whether err comes from querying a shard dropped
+// after the shard list was read
+func isMissingTable(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "no such table")
+}
+
+// queryShards calls fn for every point of a database within [start, end],
+// ordered by shard time window, then by measurement, series and time. An
+// empty measurement selects all of them. The scan is interrupted once ctx
+// is done.
+func (m *Manager) queryShards(ctx context.Context, database, measurement string, start, end int64, fn func(Point) error) error {
+	var measurements []string
+	if measurement != "" {
+		measurements = []string{measurement}
+	}
+	return m.queryMeasurements(ctx, database, measurements, start, end, fn)
+}
+
+// queryMeasurements is queryShards selecting the points of several
+// measurements with one query per shard. No measurements selects all of
+// them. No shard is read when the range holds no point or ended before
+// the retention period of the database.
+func (m *Manager) queryMeasurements(ctx context.Context, database string, measurements []string, start, end int64, fn func(Point) error) error {
+	id, retention, ok, err := m.retainedDatabase(nil, database)
+	if err != nil || !ok {
+		return err
+	}
+	measurements, ok, err = m.pruneRange(ctx, database, retention, measurements, start, end)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		scansSkipped.Inc()
+		return nil
+	}
+
+	for _, s := range m.shards.overlapping(id, start, end) {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("query aborted: %w", err)
+		}
+		if err := m.queryShard(ctx, s, id, database, measurements, start, end, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryShard runs the query of shardQuery on a shard with its cached
+// statement, or on a connection with its copy attached once tiered. A
+// shard dropped since the shard list was read holds no point.
+func (m *Manager) queryShard(ctx context.Context, s shard, databaseID, database string, measurements []string, start, end int64, fn func(Point) error) error {
+	query, args := shardQuery(s, databaseID, measurements, start, end)
+	if s.object != "" {
+		conn, release, err := m.tieredConn(ctx, s)
+		if err != nil {
+			return err
+		}
+		defer release()
+		rows, err := conn.QueryContext(ctx, query, args...)
+		if isMissingTable(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to query points: %w", err)
+		}
+		return scanPoints(rows, database, start, end, fn)
+	}
+
+	stmt, release, err := m.stmts.get(ctx, query)
+	if isMissingTable(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query points: %w", err)
+	}
+	defer release()
+
+	rows, err := stmt.QueryContext(ctx, args...)
+	if isMissingTable(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to query points: %w", err)
+	}
+	return scanPoints(rows, database, start, end, fn)
+}
+
+// shardQuery selects the points of measurements in a shard, or of all of
+// them when there are none, in measurement, series and time order. The
+// blocks of packed shards are selected along with the rows, each sorted at
+// its first timestamp and before a row with the same timestamp.
+func shardQuery(s shard, databaseID string, measurements []string, start, end int64) (string, []interface{}) {
+	filter := `s.database_id = ?`
+	args := []interface{}{databaseID}
+	switch len(measurements) {
+	case 0:
+	case 1:
+		filter += ` AND s.measurement = ?`
+		args = append(args, measurements[0])
+	default:
+		filter += ` AND s.measurement IN (?` + strings.Repeat(`, ?`, len(measurements)-1) + `)`
+		for _, name := range measurements {
+			args = append(args, name)
+		}
+	}
+
+	query := `
+		SELECT s.measurement, s.key, p.timestamp, s.tags, p.fields, 0
+		FROM ` + s.table() + ` p JOIN series s ON s.id = p.series_id
+		WHERE ` + filter + ` AND p.timestamp >= ? AND p.timestamp <= ?`
+	all := append(append([]interface{}{}, args...), start, end)
+	if s.packed {
+		query += `
+		UNION ALL
+		SELECT s.measurement, s.key, b.min_time, s.tags, b.data, 1
+		FROM ` + s.blocksSource() + ` b JOIN series s ON s.id = b.series_id
+		WHERE ` + filter + ` AND b.max_time >= ? AND b.min_time <= ?`
+		all = append(append(all, args...), start, end)
+	}
+	return query + ` ORDER BY 1, 2, 3, 6 DESC`, all
+}
+
+// scanPoints calls fn for every point selected by shardQuery, keeping
+// only the points of blocks within [start, end], and closes rows. Rows
+// written after a shard was packed are merged into the block points with
+// the same series and timestamp.
+func scanPoints(rows *sql.Rows, database string, start, end int64, fn func(Point) error) error {
+	defer rows.Close()
+
+	// pending holds the points of the last block not passed to fn yet
+	var pending []Point
+	var pendingKey string
+	flush := func(measurement, key string, ts int64) error {
+		for len(pending) > 0 {
+			p := pending[0]
+			if p.Measurement == measurement && pendingKey == key && p.Timestamp >= ts {
+				break
+			}
+			pending = pending[1:]
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for rows.Next() {
+		var measurement, key, tagsJSON string
+		var timestamp int64
+		var data []byte
+		var block bool
+		if err := rows.Scan(&measurement, &key, &timestamp, &tagsJSON, &data, &block); err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+		if err := flush(measurement, key, timestamp); err != nil {
+			return err
+		}
+
+		var tags map[string]string
+		if err := json.Unmarshal([]byte(tagsJSON), &tags); err != nil {
+			return fmt.Errorf("failed to unmarshal tags: %w", err)
+		}
+		if block {
+			points, err := unpackBlock(data, database, measurement, tags, start, end)
+			if err != nil {
+				return err
+			}
+			pending, pendingKey = points, key
+			continue
+		}
+
+		fields, err := decodeFields(data)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 && pendingKey == key && pending[0].Timestamp == timestamp {
+			for k, v := range fields {
+				pending[0].Fields[k] = v
+			}
+			continue
+		}
+		p := Point{Database: database, Measurement: measurement, Tags: tags, Fields: fields, Timestamp: timestamp}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating rows: %w", err)
+	}
+	for _, p := range pending {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShardCount returns the number of shards of every database
+func (m *Manager) ShardCount() int {
+	return m.shards.count()
+}
+
+// CompactShards drops the shards left empty by deletes and returns how
+// many were dropped
+func (m *Manager) CompactShards() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	rows, err := m.db.Query(`SELECT id, database_id, start_time, end_time, packed, object FROM shards`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list shards: %w", err)
+	}
+	type owned struct {
+		shard
+		databaseID string
+	}
+	var all []owned
+	for rows.Next() {
+		var o owned
+		if err := rows.Scan(&o.id, &o.databaseID, &o.start, &o.end, &o.packed, &o.object); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan row: %w", err)
+		}
+		all = append(all, o)
+	}
+	rows.Close()
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	dropped := make(map[string]map[int64]bool)
+	n := 0
+	for _, o := range all {
+		empty, err := shardEmpty(tx, o.shard)
+		if err != nil {
+			return 0, err
+		}
+		if !empty {
+			continue
+		}
+		if err := dropShard(tx, o.shard); err != nil {
+			return 0, err
+		}
+		if dropped[o.databaseID] == nil {
+			dropped[o.databaseID] = make(map[int64]bool)
+		}
+		dropped[o.databaseID][o.id] = true
+		n++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit compaction: %w", err)
+	}
+	for id, ids := range dropped {
+		m.shards.remove(id, ids)
+	}
+	return n, nil
+}
@@ -0,0 +1,97 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Snapshot describes a copy of the database written by Snapshot
+type Snapshot struct {
+	Path string
+	// Size is the size of the copy in bytes
+	Size     int64
+	Duration time.Duration
+}
+
+// Snapshot writes a consistent copy of the database to path, which must
+// not exist, using the SQLite online backup API. The copy is read in a
+// single read transaction, so it holds every point committed when the
+// snapshot started and none written after, while writes go on meanwhile
+// in WAL mode. The copy is written next to path and renamed once
+// complete, so path never holds a partial snapshot.
+func (m *Manager) Snapshot(ctx context.Context, path string) (Snapshot, error) {
+	start := time.Now()
+	if _, err := os.Stat(path); err == nil {
+		return Snapshot{}, fmt.Errorf("snapshot %s already exists", path)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return Snapshot{}, fmt.Errorf("failed to check snapshot %s: %w", path, err)
+	}
+
+	tmp := path + ".tmp"
+	os.Remove(tmp)
+	if err := m.backup(ctx, tmp); err != nil {
+		os.Remove(tmp)
+		return Snapshot{}, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return Snapshot{}, fmt.Errorf("failed to move snapshot to %s: %w", path, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return Snapshot{}, fmt.Errorf("failed to read snapshot %s: %w", path, err)
+	}
+	return Snapshot{Path: path, Size: info.Size(), Duration: time.Since(start)}, nil
+}
+
+// backup copies the database to a new file at path
+func (m *Manager) backup(ctx context.Context, path string) error {
+	// The copy is a standalone file, without a write-ahead log to ship
+	dst, err := sql.Open("sqlite3", path+"?_journal_mode=DELETE")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer dst.Close()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer dstConn.Close()
+	srcConn, err := m.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open connection: %w", err)
+	}
+	defer srcConn.Close()
+
+	err = dstConn.Raw(func(d interface{}) error {
+		return srcConn.Raw(func(s interface{}) error {
+			to, ok := d.(*sqlite3.SQLiteConn)
+			from, ok2 := s.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return errors.New("unexpected SQLite driver connection")
+			}
+			b, err := to.Backup("main", from, "main")
+			if err != nil {
+				return err
+			}
+			// A single step copies every page within one read
+			// transaction, which is what makes the copy consistent
+			if _, err := b.Step(-1); err != nil {
+				b.Finish()
+				return err
+			}
+			return b.Finish()
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy database: %w", err)
+	}
+	return nil
+}
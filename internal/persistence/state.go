@@ -0,0 +1,219 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+)
+
+var (
+	stateHits   = metrics.NewCounter("refluxdb_storage_state_cache_hits_total", "first and last queries answered from the series state cache")
+	stateMisses = metrics.NewCounter("refluxdb_storage_state_cache_misses_total", "first and last queries that had to scan storage")
+)
+
+// fieldState is the oldest and newest value of a field of a series
+type fieldState struct {
+	firstTime, lastTime int64
+	first, last         float64
+}
+
+// measurementRef identifies a measurement of a database by name
+type measurementRef struct {
+	database    string
+	measurement string
+}
+
+// stateCache keeps the first and last value of every field of the series
+// of the measurements queried so far, so first() and last() do not scan
+// storage. A measurement is loaded from storage on its first query and then
+// kept up to date by writes. Deletes reset the cache.
+type stateCache struct {
+	mu sync.Mutex
+	// series holds the field states by series key of the loaded
+	// measurements
+	series map[measurementRef]map[string]map[string]*fieldState
+}
+
+func newStateCache() *stateCache {
+	return &stateCache{series: make(map[measurementRef]map[string]map[string]*fieldState)}
+}
+
+// observe records the fields of the points of loaded measurements
+func (c *stateCache) observe(points []Point) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.series) == 0 {
+		return
+	}
+	for _, p := range points {
+		ref := measurementRef{database: p.Database, measurement: p.Measurement}
+		if ref.database == "" {
+			ref.database = DefaultDatabase
+		}
+		if series, ok := c.series[ref]; ok {
+			observeFields(series, SeriesKey(p.Measurement, p.Tags), p)
+		}
+	}
+}
+
+func observeFields(series map[string]map[string]*fieldState, key string, p Point) {
+	fields, ok := series[key]
+	if !ok {
+		fields = make(map[string]*fieldState, len(p.Fields))
+		series[key] = fields
+	}
+
+	ts := p.Timestamp
+	for k, v := range p.Fields {
+		f, ok := fields[k]
+		if !ok {
+			fields[k] = &fieldState{firstTime: ts, lastTime: ts, first: v, last: v}
+			continue
+		}
+		if ts <= f.firstTime {
+			f.firstTime, f.first = ts, v
+		}
+		if ts >= f.lastTime {
+			f.lastTime, f.last = ts, v
+		}
+	}
+}
+
+// field returns the state of a field across the series of a loaded
+// measurement: its oldest and newest values in any series
+func (c *stateCache) field(ref measurementRef, field string) (fieldState, bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	series, loaded := c.series[ref]
+	if !loaded {
+		return fieldState{}, false, false
+	}
+
+	state := fieldState{firstTime: math.MaxInt64, lastTime: math.MinInt64}
+	found := false
+	for _, fields := range series {
+		f, ok := fields[field]
+		if !ok {
+			continue
+		}
+		found = true
+		if f.firstTime < state.firstTime {
+			state.firstTime, state.first = f.firstTime, f.first
+		}
+		if f.lastTime > state.lastTime {
+			state.lastTime, state.last = f.lastTime, f.last
+		}
+	}
+	return state, found, true
+}
+
+func (c *stateCache) store(ref measurementRef, series map[string]map[string]*fieldState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.series[ref] = series
+}
+
+func (c *stateCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.series = make(map[measurementRef]map[string]map[string]*fieldState)
+}
+
+// loadState scans a measurement into the state cache unless it is
+// already loaded. Writers are held off during the scan so none of their
+// points is missed.
+func (m *Manager) loadState(ctx context.Context, ref measurementRef) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, _, loaded := m.state.field(ref, ""); loaded {
+		return nil
+	}
+	series := make(map[string]map[string]*fieldState)
+	err := m.queryShards(ctx, ref.database, ref.measurement, math.MinInt64, math.MaxInt64, func(p Point) error {
+		observeFields(series, SeriesKey(p.Measurement, p.Tags), p)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load series state: %w", err)
+	}
+	m.state.store(ref, series)
+	return nil
+}
+
+// FirstValue returns the timestamp and value of the oldest value of field
+// in any series of a measurement within [start, end], and false when there
+// is none. It is answered from the series state cache unless older values
+// exist before start.
+func (m *Manager) FirstValue(ctx context.Context, database, measurement, field string, start, end int64) (int64, float64, bool, error) {
+	state, found, err := m.fieldState(ctx, database, measurement, field)
+	if err != nil || !found || state.firstTime > end {
+		return 0, 0, false, err
+	}
+	if state.firstTime >= start {
+		stateHits.Inc()
+		return state.firstTime, state.first, true, nil
+	}
+	stateMisses.Inc()
+	return m.scanFirstLast(ctx, database, measurement, field, start, end, true)
+}
+
+// LastValue returns the timestamp and value of the newest value of field
+// in any series of a measurement within [start, end], and false when there
+// is none. It is answered from the series state cache unless newer values
+// exist after end.
+func (m *Manager) LastValue(ctx context.Context, database, measurement, field string, start, end int64) (int64, float64, bool, error) {
+	state, found, err := m.fieldState(ctx, database, measurement, field)
+	if err != nil || !found || state.lastTime < start {
+		return 0, 0, false, err
+	}
+	if state.lastTime <= end {
+		stateHits.Inc()
+		return state.lastTime, state.last, true, nil
+	}
+	stateMisses.Inc()
+	return m.scanFirstLast(ctx, database, measurement, field, start, end, false)
+}
+
+// fieldState returns the cached state of a field, loading its measurement
+// first if needed
+func (m *Manager) fieldState(ctx context.Context, database, measurement, field string) (fieldState, bool, error) {
+	ref := measurementRef{database: database, measurement: measurement}
+	state, found, loaded := m.state.field(ref, field)
+	if loaded {
+		return state, found, nil
+	}
+	if err := m.loadState(ctx, ref); err != nil {
+		return fieldState{}, false, err
+	}
+	state, found, _ = m.state.field(ref, field)
+	return state, found, nil
+}
+
+// scanFirstLast finds the oldest or newest value of field within
+// [start, end] by scanning storage
+func (m *Manager) scanFirstLast(ctx context.Context, database, measurement, field string, start, end int64, first bool) (int64, float64, bool, error) {
+	var ts int64
+	var value float64
+	found := false
+	err := m.queryShards(ctx, database, measurement, start, end, func(p Point) error {
+		v, ok := p.Fields[field]
+		if !ok {
+			return nil
+		}
+		t := p.Timestamp
+		if !found || (first && t < ts) || (!first && t > ts) {
+			ts, value, found = t, v, true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, false, fmt.Errorf("failed to query measurements: %w", err)
+	}
+	return ts, value, found, nil
+}
@@ -0,0 +1,161 @@
+package persistence
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// Statements prepared when a Manager is created
+const (
+	insertSeriesQuery   = `INSERT OR IGNORE INTO series (database_id, measurement, key, tags) VALUES (?, ?, ?, ?)`
+	selectSeriesQuery   = `SELECT id FROM series WHERE database_id = ? AND key = ?`
+	insertDatabaseQuery = `INSERT OR IGNORE INTO databases (name, id, org_id, created_at, updated_at)
+		SELECT ?1, CASE WHEN EXISTS(SELECT 1 FROM databases WHERE id = ?2) THEN lower(hex(randomblob(8))) ELSE ?2 END, ?3, ?4, ?4`
+	selectDatabaseQuery = `SELECT id, retention_period FROM databases WHERE name = ?`
+	listDatabasesQuery  = `SELECT name FROM databases ORDER BY name`
+)
+
+// maxCachedStmts bounds the statement cache, which is reset when full.
+// Shard statements accumulate as shards are created.
+const maxCachedStmts = 1000
+
+// stmtCache keeps prepared statements by query, so that SQLite parses
+// the statements of the write and query paths once per connection instead
+// of on every call. Statements on dropped shards stay in the cache until
+// it is reset: SQLite prepares them again if their table is ever created
+// anew.
+type stmtCache struct {
+	db    *sql.DB
+	mu    sync.Mutex
+	stmts map[string]*cachedStmt
+	// missing holds the queries used within transactions before they were
+	// cached, which fill prepares
+	missing map[string]bool
+}
+
+type cachedStmt struct {
+	stmt *sql.Stmt
+	// users is the number of callers that did not release the statement
+	// yet. Evicted statements are closed once it drops to zero.
+	users   int
+	evicted bool
+}
+
+// newStmtCache prepares the statements used by every write and listing
+func newStmtCache(db *sql.DB) (*stmtCache, error) {
+	c := &stmtCache{db: db, stmts: make(map[string]*cachedStmt), missing: make(map[string]bool)}
+	for _, query := range []string{insertSeriesQuery, selectSeriesQuery, insertDatabaseQuery, selectDatabaseQuery, listDatabasesQuery} {
+		_, release, err := c.get(context.Background(), query)
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+		release()
+	}
+	return c, nil
+}
+
+// get returns the prepared statement of query, preparing it on first use.
+// release must be called once the statement and its rows are no longer
+// used.
+func (c *stmtCache) get(ctx context.Context, query string) (*sql.Stmt, func(), error) {
+	c.mu.Lock()
+	entry, ok := c.stmts[query]
+	if ok {
+		entry.users++
+		c.mu.Unlock()
+		return entry.stmt, c.releaser(entry), nil
+	}
+	c.mu.Unlock()
+
+	// Preparing waits for a connection, which a writer holding one may
+	// need the cache to release
+	stmt, err := c.db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok = c.stmts[query]; ok {
+		stmt.Close()
+	} else {
+		if len(c.stmts) >= maxCachedStmts {
+			c.evictLocked()
+		}
+		entry = &cachedStmt{stmt: stmt}
+		c.stmts[query] = entry
+	}
+	entry.users++
+	return entry.stmt, c.releaser(entry), nil
+}
+
+// releaser returns the function releasing a use of entry
+func (c *stmtCache) releaser(entry *cachedStmt) func() {
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		entry.users--
+		if entry.evicted && entry.users == 0 {
+			entry.stmt.Close()
+		}
+	}
+}
+
+// tx returns the prepared statement of query bound to tx. The statement
+// is closed along with tx, but release must still be called once tx ends.
+//
+// A query that is not cached yet is only prepared within tx: preparing it
+// on another connection could wait for the one held by tx, and would not
+// see the tables created by tx. The next call to fill caches it.
+func (c *stmtCache) tx(tx *sql.Tx, query string) (*sql.Stmt, func(), error) {
+	c.mu.Lock()
+	entry, ok := c.stmts[query]
+	if !ok {
+		c.missing[query] = true
+		c.mu.Unlock()
+		stmt, err := tx.Prepare(query)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to prepare statement: %w", err)
+		}
+		return stmt, func() {}, nil
+	}
+	entry.users++
+	c.mu.Unlock()
+	return tx.Stmt(entry.stmt), c.releaser(entry), nil
+}
+
+// fill caches the queries used within transactions since its last call.
+// It must not be called within a transaction.
+func (c *stmtCache) fill() {
+	c.mu.Lock()
+	missing := c.missing
+	c.missing = make(map[string]bool)
+	c.mu.Unlock()
+	for query := range missing {
+		// A query failing to prepare stays uncached, the next transaction
+		// using it prepares it again
+		if _, release, err := c.get(context.Background(), query); err == nil {
+			release()
+		}
+	}
+}
+
+// evictLocked empties the cache, closing the statements not in use
+func (c *stmtCache) evictLocked() {
+	for _, entry := range c.stmts {
+		entry.evicted = true
+		if entry.users == 0 {
+			entry.stmt.Close()
+		}
+	}
+	c.stmts = make(map[string]*cachedStmt)
+}
+
+func (c *stmtCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evictLocked()
+}
@@ -0,0 +1,130 @@
+package persistence
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Subscription modes
+const (
+	// SubscriptionAll sends every point to all destinations
+	SubscriptionAll = "ALL"
+	// SubscriptionAny sends every point to one of the destinations,
+	// rotating between them
+	SubscriptionAny = "ANY"
+)
+
+// Subscription forwards the points written to a database to other servers
+type Subscription struct {
+	Name     string
+	Database string
+	// Mode is SubscriptionAll or SubscriptionAny
+	Mode string
+	// Destinations are http://, https:// or udp:// URLs
+	Destinations []string
+	// Measurements restricts the forwarded points to these measurements.
+	// Empty forwards every point of the database.
+	Measurements []string
+	CreatedAt    time.Time
+}
+
+// Subscriptions returns every subscription, sorted by database then name
+func (m *Manager) Subscriptions() ([]Subscription, error) {
+	rows, err := m.db.Query(`
+		SELECT s.name, d.name, s.mode, s.destinations, s.measurements, s.created_at
+		FROM subscriptions s JOIN databases d ON d.id = s.database_id
+		ORDER BY d.name, s.name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list subscriptions: %w", err)
+	}
+	defer rows.Close()
+
+	var subs []Subscription
+	for rows.Next() {
+		var sub Subscription
+		var destinations, measurements string
+		var created int64
+		if err := rows.Scan(&sub.Name, &sub.Database, &sub.Mode, &destinations, &measurements, &created); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		if err := json.Unmarshal([]byte(destinations), &sub.Destinations); err != nil {
+			return nil, fmt.Errorf("invalid destinations of subscription %s: %w", sub.Name, err)
+		}
+		if err := json.Unmarshal([]byte(measurements), &sub.Measurements); err != nil {
+			return nil, fmt.Errorf("invalid measurements of subscription %s: %w", sub.Name, err)
+		}
+		sub.CreatedAt = time.Unix(0, created).UTC()
+		subs = append(subs, sub)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return subs, nil
+}
+
+// AddSubscription creates a subscription on an existing database
+func (m *Manager) AddSubscription(sub Subscription) error {
+	if sub.Name == "" {
+		return fmt.Errorf("subscription name is required")
+	}
+	if sub.Mode != SubscriptionAll && sub.Mode != SubscriptionAny {
+		return fmt.Errorf("invalid subscription mode %q: expected ALL or ANY", sub.Mode)
+	}
+	if len(sub.Destinations) == 0 {
+		return fmt.Errorf("subscription %s has no destinations", sub.Name)
+	}
+	destinations, err := json.Marshal(sub.Destinations)
+	if err != nil {
+		return fmt.Errorf("failed to encode destinations: %w", err)
+	}
+	if sub.Measurements == nil {
+		sub.Measurements = []string{}
+	}
+	measurements, err := json.Marshal(sub.Measurements)
+	if err != nil {
+		return fmt.Errorf("failed to encode measurements: %w", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, ok, err := m.databaseID(nil, sub.Database)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrDatabaseNotFound
+	}
+	res, err := m.db.Exec(`INSERT OR IGNORE INTO subscriptions (database_id, name, mode, destinations, measurements, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)`, id, sub.Name, sub.Mode, string(destinations), string(measurements), time.Now().UnixNano())
+	if err != nil {
+		return fmt.Errorf("failed to create subscription %s: %w", sub.Name, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSubscriptionExists
+	}
+	return nil
+}
+
+// DropSubscription removes the named subscription of a database
+func (m *Manager) DropSubscription(database, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id, ok, err := m.databaseID(nil, database)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrDatabaseNotFound
+	}
+	res, err := m.db.Exec(`DELETE FROM subscriptions WHERE database_id = ? AND name = ?`, id, name)
+	if err != nil {
+		return fmt.Errorf("failed to drop subscription %s: %w", name, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrSubscriptionNotFound
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package persistence
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Task statuses
+const (
+	TaskActive   = "active"
+	TaskInactive = "inactive"
+)
+
+// Task run statuses
+const (
+	RunSuccess = "success"
+	RunFailed  = "failed"
+)
+
+// maxTaskRuns is the number of runs kept in the history of each task
+const maxTaskRuns = 100
+
+// Task runs a query on a schedule and writes its results to a database
+type Task struct {
+	ID          string
+	OrgID       string
+	Name        string
+	Description string
+	// Status is TaskActive or TaskInactive
+	Status string
+	// Query is the InfluxQL statement run against Database
+	Query    string
+	Database string
+	// Destination receives the points returned by the query
+	Destination string
+	// Every runs the task at a fixed interval, and Cron on a cron
+	// schedule. Only one of them is set.
+	Every time.Duration
+	Cron  string
+	// Offset delays every run past its scheduled time
+	Offset time.Duration
+	// MaxRetries is the number of times a failed run is retried
+	MaxRetries int
+	// LatestCompleted is the scheduled time of the latest run
+	LatestCompleted time.Time
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// TaskRun is the outcome of one execution of a task
+type TaskRun struct {
+	ID     string
+	TaskID string
+	// Status is RunSuccess or RunFailed
+	Status string
+	// RangeStart and ScheduledFor bound the time range the query covered
+	RangeStart   time.Time
+	ScheduledFor time.Time
+	StartedAt    time.Time
+	FinishedAt   time.Time
+	// Attempts counts the executions, retries included
+	Attempts      int
+	PointsWritten int64
+	// Error is the error of the last attempt of a failed run
+	Error string
+}
+
+const taskColumns = `id, org_id, name, description, status, query, source_database, destination,
+	every, cron, run_offset, max_retries, latest_completed, created_at, updated_at`
+
+func scanTask(row interface{ Scan(...interface{}) error }) (Task, error) {
+	var t Task
+	var every, offset, latest, created, updated int64
+	err := row.Scan(&t.ID, &t.OrgID, &t.Name, &t.Description, &t.Status, &t.Query, &t.Database, &t.Destination,
+		&every, &t.Cron, &offset, &t.MaxRetries, &latest, &created, &updated)
+	if err != nil {
+		return Task{}, err
+	}
+	t.Every = time.Duration(every)
+	t.Offset = time.Duration(offset)
+	t.LatestCompleted = time.Unix(0, latest).UTC()
+	t.CreatedAt = time.Unix(0, created).UTC()
+	t.UpdatedAt = time.Unix(0, updated).UTC()
+	return t, nil
+}
+
+// Tasks returns every task, sorted by name then ID
+func (m *Manager) Tasks() ([]Task, error) {
+	rows, err := m.db.Query(`SELECT ` + taskColumns + ` FROM tasks ORDER BY name, id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tasks: %w", err)
+	}
+	defer rows.Close()
+
+	var tasks []Task
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		tasks = append(tasks, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return tasks, nil
+}
+
+// GetTask returns the task with the given ID
+func (m *Manager) GetTask(id string) (Task, error) {
+	t, err := scanTask(m.db.QueryRow(`SELECT `+taskColumns+` FROM tasks WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Task{}, ErrTaskNotFound
+	}
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to look up task %s: %w", id, err)
+	}
+	return t, nil
+}
+
+// AddTask stores a task and returns it with its generated ID and
+// timestamps
+func (m *Manager) AddTask(t Task) (Task, error) {
+	if t.Name == "" {
+		return Task{}, fmt.Errorf("task name is required")
+	}
+
+	m.mu.Lock()
+	now := time.Now().UnixNano()
+	var id string
+	err := m.db.QueryRow(`INSERT INTO tasks (`+taskColumns+`)
+		VALUES (lower(hex(randomblob(8))), ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		t.OrgID, t.Name, t.Description, t.Status, t.Query, t.Database, t.Destination,
+		int64(t.Every), t.Cron, int64(t.Offset), t.MaxRetries, t.LatestCompleted.UnixNano(), now, now).Scan(&id)
+	m.mu.Unlock()
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to create task %s: %w", t.Name, err)
+	}
+	return m.GetTask(id)
+}
+
+// UpdateTask stores the definition of an existing task. The organization,
+// latest completed time and creation time are kept.
+func (m *Manager) UpdateTask(t Task) (Task, error) {
+	if t.Name == "" {
+		return Task{}, fmt.Errorf("task name is required")
+	}
+
+	m.mu.Lock()
+	res, err := m.db.Exec(`UPDATE tasks SET name = ?, description = ?, status = ?, query = ?, source_database = ?,
+		destination = ?, every = ?, cron = ?, run_offset = ?, max_retries = ?, updated_at = ? WHERE id = ?`,
+		t.Name, t.Description, t.Status, t.Query, t.Database, t.Destination,
+		int64(t.Every), t.Cron, int64(t.Offset), t.MaxRetries, time.Now().UnixNano(), t.ID)
+	m.mu.Unlock()
+	if err != nil {
+		return Task{}, fmt.Errorf("failed to update task %s: %w", t.ID, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Task{}, ErrTaskNotFound
+	}
+	return m.GetTask(t.ID)
+}
+
+// SetTaskCompleted records the scheduled time of the latest run of a task
+func (m *Manager) SetTaskCompleted(id string, scheduledFor time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.db.Exec(`UPDATE tasks SET latest_completed = ? WHERE id = ?`, scheduledFor.UnixNano(), id); err != nil {
+		return fmt.Errorf("failed to update task %s: %w", id, err)
+	}
+	return nil
+}
+
+// DeleteTask removes a task and its run history
+func (m *Manager) DeleteTask(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res, err := m.db.Exec(`DELETE FROM tasks WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete task %s: %w", id, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTaskNotFound
+	}
+	if _, err := m.db.Exec(`DELETE FROM task_runs WHERE task_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete runs of task %s: %w", id, err)
+	}
+	return nil
+}
+
+const taskRunColumns = `id, task_id, status, range_start, scheduled_for, started_at, finished_at, attempts, points_written, error`
+
+func scanTaskRun(row interface{ Scan(...interface{}) error }) (TaskRun, error) {
+	var r TaskRun
+	var rangeStart, scheduled, started, finished int64
+	err := row.Scan(&r.ID, &r.TaskID, &r.Status, &rangeStart, &scheduled, &started, &finished, &r.Attempts, &r.PointsWritten, &r.Error)
+	if err != nil {
+		return TaskRun{}, err
+	}
+	r.RangeStart = time.Unix(0, rangeStart).UTC()
+	r.ScheduledFor = time.Unix(0, scheduled).UTC()
+	r.StartedAt = time.Unix(0, started).UTC()
+	r.FinishedAt = time.Unix(0, finished).UTC()
+	return r, nil
+}
+
+// AddTaskRun records a run in the history of its task, which keeps the
+// latest 100 runs, and returns it with its generated ID
+func (m *Manager) AddTaskRun(r TaskRun) (TaskRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return TaskRun{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`INSERT INTO task_runs (`+taskRunColumns+`)
+		VALUES (lower(hex(randomblob(8))), ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`,
+		r.TaskID, r.Status, r.RangeStart.UnixNano(), r.ScheduledFor.UnixNano(), r.StartedAt.UnixNano(),
+		r.FinishedAt.UnixNano(), r.Attempts, r.PointsWritten, r.Error).Scan(&r.ID)
+	if err != nil {
+		return TaskRun{}, fmt.Errorf("failed to record run of task %s: %w", r.TaskID, err)
+	}
+	_, err = tx.Exec(`DELETE FROM task_runs WHERE task_id = ? AND id NOT IN (
+		SELECT id FROM task_runs WHERE task_id = ? ORDER BY started_at DESC, rowid DESC LIMIT ?)`, r.TaskID, r.TaskID, maxTaskRuns)
+	if err != nil {
+		return TaskRun{}, fmt.Errorf("failed to trim runs of task %s: %w", r.TaskID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return TaskRun{}, fmt.Errorf("failed to record run of task %s: %w", r.TaskID, err)
+	}
+	return r, nil
+}
+
+// TaskRuns returns the history of a task, newest run first. A positive
+// limit returns at most that many runs.
+func (m *Manager) TaskRuns(taskID string, limit int) ([]TaskRun, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	rows, err := m.db.Query(`SELECT `+taskRunColumns+` FROM task_runs WHERE task_id = ?
+		ORDER BY started_at DESC, rowid DESC LIMIT ?`, taskID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list runs of task %s: %w", taskID, err)
+	}
+	defer rows.Close()
+
+	var runs []TaskRun
+	for rows.Next() {
+		r, err := scanTaskRun(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		runs = append(runs, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return runs, nil
+}
+
+// GetTaskRun returns a run from the history of a task
+func (m *Manager) GetTaskRun(taskID, runID string) (TaskRun, error) {
+	r, err := scanTaskRun(m.db.QueryRow(`SELECT `+taskRunColumns+` FROM task_runs WHERE task_id = ? AND id = ?`, taskID, runID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return TaskRun{}, ErrTaskRunNotFound
+	}
+	if err != nil {
+		return TaskRun{}, fmt.Errorf("failed to look up run %s: %w", runID, err)
+	}
+	return r, nil
+}
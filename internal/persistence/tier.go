@@ -0,0 +1,631 @@
+package persistence
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultTierCacheSize is the disk space of the cache of tiered shards
+const DefaultTierCacheSize = 1 << 30
+
+// tieredSchema is the name the copy of a tiered shard is attached as
+const tieredSchema = "tiered"
+
+var (
+	shardsTiered   = metrics.NewCounter("refluxdb_storage_shards_tiered_total", "Shards uploaded to object storage")
+	shardsRestored = metrics.NewCounter("refluxdb_storage_shards_restored_total", "Tiered shards copied back to the database file to be rewritten")
+	tierFetches    = metrics.NewCounter("refluxdb_storage_tier_fetches_total", "Tiered shards downloaded from object storage")
+	tierCacheHits  = metrics.NewCounter("refluxdb_storage_tier_cache_hits_total", "Reads of tiered shards served by the local cache")
+	tierCacheBytes = metrics.NewGauge("refluxdb_storage_tier_cache_bytes", "Disk space of the tiered shards cached locally")
+)
+
+// ObjectStore keeps the blocks of tiered shards, such as an S3 bucket
+type ObjectStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// TieringOptions moves the blocks of old shards to object storage
+type TieringOptions struct {
+	Store ObjectStore
+	// Age is how long after the end of its window a shard is uploaded
+	Age time.Duration
+	// CacheDir keeps the tiered shards downloaded by queries
+	CacheDir string
+	// CacheSize bounds the disk space of CacheDir in bytes,
+	// DefaultTierCacheSize when zero. The least recently read shards are
+	// removed first.
+	CacheSize int64
+}
+
+// Validate checks the store, age and cache
+func (o TieringOptions) Validate() error {
+	if o.Store == nil {
+		return fmt.Errorf("missing object store")
+	}
+	if o.Age <= 0 {
+		return fmt.Errorf("invalid tiering age %s: must be positive", o.Age)
+	}
+	if o.CacheDir == "" {
+		return fmt.Errorf("missing tiering cache directory")
+	}
+	if o.CacheSize < 0 {
+		return fmt.Errorf("invalid tiering cache size %d: must not be negative", o.CacheSize)
+	}
+	return nil
+}
+
+// TierShards uploads to object storage the blocks of the shards whose
+// window ended more than the tiering age before now, packing them first,
+// and returns how many were uploaded. Tiered shards keep the time range
+// of their blocks in the database file, so that they are only downloaded
+// by the queries reading their points. Points written to them afterwards
+// stay in the database file.
+func (m *Manager) TierShards(ctx context.Context, now time.Time) (int, error) {
+	if m.tier == nil {
+		return 0, nil
+	}
+	if err := m.emptyTieredBlocks(); err != nil {
+		return 0, err
+	}
+
+	cutoff := now.Add(-m.tiering.Age).UnixNano()
+	n := 0
+	for databaseID, shards := range m.shards.all() {
+		for _, s := range shards {
+			if s.object != "" || s.end > cutoff {
+				continue
+			}
+			if err := ctx.Err(); err != nil {
+				return n, err
+			}
+			tiered, err := m.tierShard(ctx, databaseID, s)
+			if err != nil {
+				return n, err
+			}
+			if tiered {
+				shardsTiered.Inc()
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// RunTiering calls TierShards every interval until ctx is done
+func (m *Manager) RunTiering(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n, err := m.TierShards(ctx, now)
+			if err != nil {
+				log.Errorf("Failed to tier shards: %v", err)
+				continue
+			}
+			if n > 0 {
+				log.Infof("Uploaded %d shards to object storage", n)
+			}
+		}
+	}
+}
+
+// tierShard uploads the blocks of shard s and reports whether it was
+// tiered. Writers only wait while the blocks are copied to a file and
+// while the shard is switched to the uploaded copy, which is abandoned
+// when the blocks changed during the upload.
+func (m *Manager) tierShard(ctx context.Context, databaseID string, s shard) (bool, error) {
+	key := fmt.Sprintf("%s/%s-%d.db", databaseID, s.table(), time.Now().UnixNano())
+	staged := m.tier.path(key) + ".upload"
+	defer os.Remove(staged)
+
+	staging, err := m.stageShard(ctx, databaseID, s, staged)
+	if err != nil || !staging {
+		return false, err
+	}
+
+	f, err := os.Open(staged)
+	if err != nil {
+		return false, fmt.Errorf("failed to open shard copy: %w", err)
+	}
+	info, err := f.Stat()
+	if err == nil {
+		err = m.tiering.Store.Put(ctx, key, f, info.Size())
+	}
+	f.Close()
+	if err != nil {
+		return false, fmt.Errorf("failed to upload shard %s: %w", s.table(), err)
+	}
+
+	switched, err := m.switchShard(ctx, databaseID, s, key, staged)
+	if err != nil || !switched {
+		m.deleteObject(key)
+		return false, err
+	}
+	m.tier.add(key, staged, info.Size())
+	return true, nil
+}
+
+// stageShard packs shard s and copies its blocks to a new database file
+// at path. It reports false when the shard is gone, already tiered or
+// holds no block.
+func (m *Manager) stageShard(ctx context.Context, databaseID string, s shard, path string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.shards.get(databaseID, s.id)
+	if !ok || s.object != "" {
+		return false, nil
+	}
+	var hasRows bool
+	if err := m.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM `+s.table()+`)`).Scan(&hasRows); err != nil {
+		return false, fmt.Errorf("failed to inspect shard %s: %w", s.table(), err)
+	}
+	if hasRows || !s.packed {
+		if err := m.packShard(s); err != nil {
+			return false, err
+		}
+		m.shards.markPacked(databaseID, map[int64]bool{s.id: true})
+	}
+	var hasBlocks bool
+	if err := m.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM `+s.blocksTable()+`)`).Scan(&hasBlocks); err != nil {
+		return false, fmt.Errorf("failed to inspect shard %s: %w", s.table(), err)
+	}
+	if !hasBlocks {
+		return false, nil
+	}
+
+	conn, err := m.attach(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	defer detach(conn)
+	copied := tieredSchema + "." + s.blocksTable()
+	if _, err := conn.ExecContext(ctx, blocksTableDDL(copied)); err != nil {
+		return false, fmt.Errorf("failed to copy shard %s: %w", s.table(), err)
+	}
+	if _, err := conn.ExecContext(ctx, `INSERT INTO `+copied+` SELECT * FROM main.`+s.blocksTable()); err != nil {
+		return false, fmt.Errorf("failed to copy shard %s: %w", s.table(), err)
+	}
+	return true, nil
+}
+
+// switchShard makes the uploaded copy at path the source of the blocks of
+// shard s, unless they changed since they were copied. The blocks table
+// keeps its data until the next call to TierShards, for the queries that
+// read the shard list before the switch.
+func (m *Manager) switchShard(ctx context.Context, databaseID string, s shard, key, path string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s, ok := m.shards.get(databaseID, s.id)
+	if !ok || s.object != "" {
+		return false, nil
+	}
+	conn, err := m.attach(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	defer detach(conn)
+
+	local, copied := `main.`+s.blocksTable(), tieredSchema+`.`+s.blocksTable()
+	var changed bool
+	err = conn.QueryRowContext(ctx, `SELECT EXISTS(SELECT * FROM `+local+` EXCEPT SELECT * FROM `+copied+`)
+		OR EXISTS(SELECT * FROM `+copied+` EXCEPT SELECT * FROM `+local+`)`).Scan(&changed)
+	if err != nil {
+		return false, fmt.Errorf("failed to compare shard %s to its copy: %w", s.table(), err)
+	}
+	if changed {
+		log.Infof("Shard %s changed during its upload, it will be uploaded again", s.table())
+		return false, nil
+	}
+	if _, err := conn.ExecContext(ctx, `UPDATE shards SET object = ? WHERE id = ?`, key, s.id); err != nil {
+		return false, fmt.Errorf("failed to tier shard %s: %w", s.table(), err)
+	}
+	m.shards.setObject(databaseID, s.id, key)
+	return true, nil
+}
+
+// emptyTieredBlocks removes the data of the blocks of the tiered shards
+// from the database file, leaving their time ranges
+func (m *Manager) emptyTieredBlocks() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, shards := range m.shards.all() {
+		for _, s := range shards {
+			if s.object == "" {
+				continue
+			}
+			if _, err := m.db.Exec(`UPDATE ` + s.blocksTable() + ` SET data = X'' WHERE data != X''`); err != nil {
+				return fmt.Errorf("failed to empty the blocks of shard %s: %w", s.table(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// restoreShards copies the blocks of the tiered shards among shards back
+// to the database file, so that they can be rewritten, and removes their
+// uploaded copy. The caller must hold m.mu.
+func (m *Manager) restoreShards(ctx context.Context, databaseID string, shards []shard) error {
+	for _, s := range shards {
+		if s.object == "" {
+			continue
+		}
+		if err := m.restoreShard(ctx, s); err != nil {
+			return fmt.Errorf("failed to restore shard %s: %w", s.table(), err)
+		}
+		m.shards.setObject(databaseID, s.id, "")
+		m.forgetObjects([]shard{s})
+		shardsRestored.Inc()
+	}
+	return nil
+}
+
+func (m *Manager) restoreShard(ctx context.Context, s shard) error {
+	conn, release, err := m.tieredConn(ctx, s)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM main.`+s.blocksTable()); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO main.`+s.blocksTable()+` SELECT * FROM `+s.blocksSource()); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE shards SET object = '' WHERE id = ?`, s.id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// tieredBlocks returns the tiered shards among shards holding blocks of
+// the series of ids within [start, end]
+func tieredBlocks(tx *sql.Tx, shards []shard, ids []int64, start, end int64) ([]shard, error) {
+	var tiered []shard
+	for _, s := range shards {
+		if s.object == "" {
+			continue
+		}
+		for _, chunk := range seriesChunks(ids) {
+			in, args := inList(chunk)
+			var found bool
+			err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM `+s.blocksTable()+` WHERE series_id IN (`+in+`) AND max_time >= ? AND min_time <= ?)`,
+				append(args, start, end)...).Scan(&found)
+			if err != nil {
+				return nil, fmt.Errorf("failed to inspect shard %s: %w", s.table(), err)
+			}
+			if found {
+				tiered = append(tiered, s)
+				break
+			}
+		}
+	}
+	return tiered, nil
+}
+
+// forgetObjects removes the uploaded copies of the tiered shards among
+// shards, which were dropped or restored
+func (m *Manager) forgetObjects(shards []shard) {
+	for _, s := range shards {
+		if s.object == "" {
+			continue
+		}
+		if m.tier != nil {
+			m.tier.discard(s.object)
+		}
+		m.deleteObject(s.object)
+	}
+}
+
+// deleteObject removes an object from the object store. Failures are only
+// logged, leaving an unused object behind.
+func (m *Manager) deleteObject(key string) {
+	if m.tiering == nil {
+		log.Warnf("Object %s is no longer used but object storage is not configured to delete it", key)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := m.tiering.Store.Delete(ctx, key); err != nil {
+		log.Warnf("Failed to delete unused object %s: %v", key, err)
+	}
+}
+
+// tieredConn returns a connection with the copy of the blocks of tiered
+// shard s attached, downloading it when it is not cached. The returned
+// function detaches it and releases the connection.
+func (m *Manager) tieredConn(ctx context.Context, s shard) (*sql.Conn, func(), error) {
+	if m.tier == nil {
+		return nil, nil, fmt.Errorf("shard %s is tiered to object storage, which is not configured", s.table())
+	}
+	path, done, err := m.tier.acquire(ctx, s.object)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch shard %s: %w", s.table(), err)
+	}
+	conn, err := m.attach(ctx, path)
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	return conn, func() {
+		detach(conn)
+		done()
+	}, nil
+}
+
+// rowsQuerier is a connection pool or a single connection
+type rowsQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// blocksReader returns where the blocks of shard s are read from: the
+// connection pool, or a connection with its tiered copy attached. The
+// returned function must be called once the rows read are closed.
+func (m *Manager) blocksReader(ctx context.Context, s shard) (rowsQuerier, func(), error) {
+	if s.object == "" {
+		return m.db, func() {}, nil
+	}
+	return m.tieredConn(ctx, s)
+}
+
+// attach returns a connection with the database file at path attached as
+// tieredSchema, creating the file if needed
+func (m *Manager) attach(ctx context.Context, path string) (*sql.Conn, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open connection: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS `+tieredSchema, path); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to attach %s: %w", path, err)
+	}
+	return conn, nil
+}
+
+// detach detaches the file attached by attach and releases conn, which is
+// discarded when the file cannot be detached
+func detach(conn *sql.Conn) {
+	if _, err := conn.ExecContext(context.Background(), `DETACH DATABASE `+tieredSchema); err != nil {
+		conn.Raw(func(interface{}) error { return driver.ErrBadConn })
+	}
+	conn.Close()
+}
+
+// tierCache keeps the most recently read tiered shards on disk, named
+// after their object key
+type tierCache struct {
+	store   ObjectStore
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*tierEntry
+	// lru orders the entries from the most recently read
+	lru *list.List
+}
+
+// tierEntry is a cached shard, being downloaded until ready is closed
+type tierEntry struct {
+	key, path string
+	size      int64
+	users     int
+	ready     chan struct{}
+	err       error
+	elem      *list.Element
+	// removed entries are deleted from disk once their last user is done
+	removed bool
+}
+
+// newTierCache returns the cache of dir, keeping the shards cached by the
+// previous runs
+func newTierCache(store ObjectStore, dir string, maxSize int64) (*tierCache, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultTierCacheSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create tiering cache: %w", err)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tiering cache: %w", err)
+	}
+
+	c := &tierCache{store: store, dir: dir, maxSize: maxSize, entries: make(map[string]*tierEntry), lru: list.New()}
+	type cached struct {
+		entry   *tierEntry
+		modTime time.Time
+	}
+	var found []cached
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		if strings.HasSuffix(f.Name(), ".tmp") || strings.HasSuffix(f.Name(), ".upload") {
+			os.Remove(path)
+			continue
+		}
+		key, err := url.PathUnescape(f.Name())
+		info, ierr := f.Info()
+		if err != nil || ierr != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		e := &tierEntry{key: key, path: path, size: info.Size(), ready: make(chan struct{})}
+		close(e.ready)
+		found = append(found, cached{entry: e, modTime: info.ModTime()})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime.After(found[j].modTime) })
+	for _, f := range found {
+		f.entry.elem = c.lru.PushBack(f.entry)
+		c.entries[f.entry.key] = f.entry
+		c.size += f.entry.size
+	}
+	c.evict()
+	return c, nil
+}
+
+// path returns the file caching the object key
+func (c *tierCache) path(key string) string {
+	return filepath.Join(c.dir, url.PathEscape(key))
+}
+
+// acquire returns the path of the cached copy of the object key,
+// downloading it if needed. It stays on disk until the returned function
+// is called.
+func (c *tierCache) acquire(ctx context.Context, key string) (string, func(), error) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		e.users++
+		c.lru.MoveToFront(e.elem)
+		c.mu.Unlock()
+		select {
+		case <-e.ready:
+		case <-ctx.Done():
+			c.release(e)
+			return "", nil, ctx.Err()
+		}
+		if e.err != nil {
+			c.release(e)
+			return "", nil, e.err
+		}
+		tierCacheHits.Inc()
+		return e.path, func() { c.release(e) }, nil
+	}
+	e = &tierEntry{key: key, path: c.path(key), users: 1, ready: make(chan struct{})}
+	e.elem = c.lru.PushFront(e)
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	size, err := c.fetch(ctx, key, e.path)
+	c.mu.Lock()
+	e.size, e.err = size, err
+	close(e.ready)
+	if err != nil {
+		c.remove(e)
+		c.mu.Unlock()
+		c.release(e)
+		return "", nil, err
+	}
+	c.size += size
+	tierCacheBytes.Set(float64(c.size))
+	c.mu.Unlock()
+	return e.path, func() { c.release(e) }, nil
+}
+
+// fetch downloads the object key to path and returns its size
+func (c *tierCache) fetch(ctx context.Context, key, path string) (int64, error) {
+	r, err := c.store.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	tierFetches.Inc()
+
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, fmt.Errorf("failed to cache %s: %w", key, err)
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return 0, fmt.Errorf("failed to cache %s: %w", key, err)
+	}
+	return n, nil
+}
+
+// add moves the file at path, holding the object key, into the cache
+func (c *tierCache) add(key, path string, size int64) {
+	if err := os.Rename(path, c.path(key)); err != nil {
+		log.Warnf("Failed to cache %s: %v", key, err)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &tierEntry{key: key, path: c.path(key), size: size, ready: make(chan struct{})}
+	close(e.ready)
+	e.elem = c.lru.PushFront(e)
+	c.entries[key] = e
+	c.size += size
+	c.evict()
+}
+
+// discard removes the object key from the cache
+func (c *tierCache) discard(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+}
+
+func (c *tierCache) release(e *tierEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.users--
+	if e.removed && e.users == 0 {
+		os.Remove(e.path)
+	}
+	c.evict()
+}
+
+// remove takes e out of the cache, deleting its file unless it is in use.
+// The caller must hold c.mu.
+func (c *tierCache) remove(e *tierEntry) {
+	if e.removed {
+		return
+	}
+	e.removed = true
+	delete(c.entries, e.key)
+	c.lru.Remove(e.elem)
+	c.size -= e.size
+	tierCacheBytes.Set(float64(c.size))
+	if e.users == 0 {
+		os.Remove(e.path)
+	}
+}
+
+// evict removes the least recently read shards not in use until the
+// cache fits its size. The caller must hold c.mu.
+func (c *tierCache) evict() {
+	for elem := c.lru.Back(); elem != nil && c.size > c.maxSize; {
+		prev := elem.Prev()
+		if e := elem.Value.(*tierEntry); e.users == 0 {
+			c.remove(e)
+		}
+		elem = prev
+	}
+	tierCacheBytes.Set(float64(c.size))
+}
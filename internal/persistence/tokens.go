@@ -0,0 +1,175 @@
+package persistence
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Token scope actions. A scope is ScopeAdmin or an action and a database
+// joined by a colon, as in read:telegraf. The database * stands for every
+// database.
+const (
+	// ScopeRead allows queries and SHOW statements on a database
+	ScopeRead = "read"
+	// ScopeWrite allows writes to a database
+	ScopeWrite = "write"
+	// ScopeAdmin allows everything, including creating and dropping
+	// databases and managing tokens
+	ScopeAdmin = "admin"
+)
+
+// Token is an API token. Requests are allowed what its scopes allow.
+type Token struct {
+	ID          string
+	Description string
+	Scopes      []string
+	CreatedAt   time.Time
+	// Quota limits the points and bytes written with the token
+	Quota Quota
+}
+
+// ValidateScope reports whether scope is admin, read:<database> or
+// write:<database>
+func ValidateScope(scope string) error {
+	if scope == ScopeAdmin {
+		return nil
+	}
+	action, database, ok := strings.Cut(scope, ":")
+	if !ok || (action != ScopeRead && action != ScopeWrite) || database == "" {
+		return fmt.Errorf("invalid scope %q: expected admin, read:<database> or write:<database>", scope)
+	}
+	return nil
+}
+
+// Allows reports whether the token may perform action on database. An
+// empty database stands for every database, which only admin tokens and
+// scopes on * allow.
+func (t Token) Allows(action, database string) bool {
+	for _, scope := range t.Scopes {
+		if scope == ScopeAdmin {
+			return true
+		}
+		a, d, _ := strings.Cut(scope, ":")
+		if a == action && action != ScopeAdmin && (d == "*" || (d == database && database != "")) {
+			return true
+		}
+	}
+	return false
+}
+
+// hashToken returns the stored form of a token
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenColumns are the columns read by scanToken
+const tokenColumns = `id, description, scopes, created_at, points_per_second, burst, bytes_per_day`
+
+func scanToken(row interface{ Scan(...interface{}) error }) (Token, error) {
+	var t Token
+	var scopes string
+	var created int64
+	if err := row.Scan(&t.ID, &t.Description, &scopes, &created, &t.Quota.PointsPerSecond, &t.Quota.Burst, &t.Quota.BytesPerDay); err != nil {
+		return Token{}, err
+	}
+	if err := json.Unmarshal([]byte(scopes), &t.Scopes); err != nil {
+		return Token{}, fmt.Errorf("invalid scopes of token %s: %w", t.ID, err)
+	}
+	t.CreatedAt = time.Unix(0, created).UTC()
+	return t, nil
+}
+
+// Tokens returns every token, oldest first
+func (m *Manager) Tokens() ([]Token, error) {
+	rows, err := m.db.Query(`SELECT ` + tokenColumns + ` FROM tokens ORDER BY created_at, id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []Token
+	for rows.Next() {
+		t, err := scanToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return tokens, nil
+}
+
+// AddToken creates a token with the given scopes and returns it with its
+// secret, which is not stored and cannot be retrieved later
+func (m *Manager) AddToken(description string, scopes []string) (Token, string, error) {
+	if len(scopes) == 0 {
+		return Token{}, "", fmt.Errorf("token requires at least one scope")
+	}
+	for _, scope := range scopes {
+		if err := ValidateScope(scope); err != nil {
+			return Token{}, "", err
+		}
+	}
+	encoded, err := json.Marshal(scopes)
+	if err != nil {
+		return Token{}, "", fmt.Errorf("failed to encode scopes: %w", err)
+	}
+
+	random := make([]byte, 40)
+	if _, err := rand.Read(random); err != nil {
+		return Token{}, "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	id, secret := hex.EncodeToString(random[:8]), base64.RawURLEncoding.EncodeToString(random[8:])
+
+	m.mu.Lock()
+	now := time.Now()
+	_, err = m.db.Exec(`INSERT INTO tokens (id, hash, description, scopes, created_at) VALUES (?, ?, ?, ?, ?)`,
+		id, hashToken(secret), description, string(encoded), now.UnixNano())
+	m.mu.Unlock()
+	if err != nil {
+		return Token{}, "", fmt.Errorf("failed to create token: %w", err)
+	}
+	return Token{ID: id, Description: description, Scopes: scopes, CreatedAt: time.Unix(0, now.UnixNano()).UTC()}, secret, nil
+}
+
+// Authorize returns the token whose secret is secret, or
+// ErrTokenNotFound
+func (m *Manager) Authorize(secret string) (Token, error) {
+	t, err := scanToken(m.db.QueryRow(`SELECT `+tokenColumns+` FROM tokens WHERE hash = ?`, hashToken(secret)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Token{}, ErrTokenNotFound
+	}
+	if err != nil {
+		return Token{}, fmt.Errorf("failed to look up token: %w", err)
+	}
+	return t, nil
+}
+
+// DeleteToken revokes the token with the given ID
+func (m *Manager) DeleteToken(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res, err := m.db.Exec(`DELETE FROM tokens WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete token %s: %w", id, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrTokenNotFound
+	}
+	if _, err := m.db.Exec(`DELETE FROM token_usage WHERE token_id = ?`, id); err != nil {
+		return fmt.Errorf("failed to delete usage of token %s: %w", id, err)
+	}
+	return nil
+}
@@ -0,0 +1,331 @@
+package persistence
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Privilege is a set of rights of a user on a database
+type Privilege int
+
+// Privileges granted with GRANT READ, WRITE or ALL
+const (
+	PrivilegeRead Privilege = 1 << iota
+	PrivilegeWrite
+	PrivilegeAll = PrivilegeRead | PrivilegeWrite
+)
+
+// String returns the privilege as SHOW GRANTS lists it
+func (p Privilege) String() string {
+	switch p {
+	case PrivilegeRead:
+		return "READ"
+	case PrivilegeWrite:
+		return "WRITE"
+	case PrivilegeAll:
+		return "ALL PRIVILEGES"
+	}
+	return "NO PRIVILEGES"
+}
+
+// User is a v1 user, authenticating with a name and password
+type User struct {
+	Name string
+	// Admin users are allowed everything
+	Admin bool
+	// Privileges are the rights of the user by database name
+	Privileges map[string]Privilege
+	CreatedAt  time.Time
+}
+
+// Scopes returns the token scopes equivalent to the rights of the user
+func (u User) Scopes() []string {
+	if u.Admin {
+		return []string{ScopeAdmin}
+	}
+	databases := make([]string, 0, len(u.Privileges))
+	for d := range u.Privileges {
+		databases = append(databases, d)
+	}
+	sort.Strings(databases)
+
+	var scopes []string
+	for _, d := range databases {
+		if u.Privileges[d]&PrivilegeRead != 0 {
+			scopes = append(scopes, ScopeRead+":"+d)
+		}
+		if u.Privileges[d]&PrivilegeWrite != 0 {
+			scopes = append(scopes, ScopeWrite+":"+d)
+		}
+	}
+	return scopes
+}
+
+// credentialCache remembers the SHA-256 of the last password verified
+// against the bcrypt hash of each user, so that clients sending their
+// password with every request do not pay for a bcrypt comparison each
+// time. Entries only match the hash they were verified against, so a
+// password change invalidates them.
+type credentialCache struct {
+	mu       sync.Mutex
+	verified map[string]verifiedPassword
+}
+
+type verifiedPassword struct {
+	hash string
+	sum  [sha256.Size]byte
+}
+
+func (c *credentialCache) check(name, hash, password string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.verified[name]
+	return ok && v.hash == hash && v.sum == sha256.Sum256([]byte(password))
+}
+
+func (c *credentialCache) store(name, hash, password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.verified == nil {
+		c.verified = make(map[string]verifiedPassword)
+	}
+	c.verified[name] = verifiedPassword{hash: hash, sum: sha256.Sum256([]byte(password))}
+}
+
+func (c *credentialCache) forget(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.verified, name)
+}
+
+// Users returns every user with its privileges, sorted by name
+func (m *Manager) Users() ([]User, error) {
+	rows, err := m.db.Query(`SELECT name, admin, created_at FROM users ORDER BY name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		var created int64
+		if err := rows.Scan(&u.Name, &u.Admin, &created); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		u.CreatedAt = time.Unix(0, created).UTC()
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	rows.Close()
+
+	for i := range users {
+		if users[i].Privileges, err = m.userPrivileges(users[i].Name); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// GetUser returns the named user with its privileges
+func (m *Manager) GetUser(name string) (User, error) {
+	u, _, err := m.getUser(name)
+	return u, err
+}
+
+func (m *Manager) getUser(name string) (User, string, error) {
+	u := User{Name: name}
+	var hash string
+	var created int64
+	err := m.db.QueryRow(`SELECT hash, admin, created_at FROM users WHERE name = ?`, name).Scan(&hash, &u.Admin, &created)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, "", ErrUserNotFound
+	}
+	if err != nil {
+		return User{}, "", fmt.Errorf("failed to look up user %s: %w", name, err)
+	}
+	u.CreatedAt = time.Unix(0, created).UTC()
+	if u.Privileges, err = m.userPrivileges(name); err != nil {
+		return User{}, "", err
+	}
+	return u, hash, nil
+}
+
+func (m *Manager) userPrivileges(name string) (map[string]Privilege, error) {
+	rows, err := m.db.Query(`SELECT database, privilege FROM user_privileges WHERE user = ?`, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list privileges of user %s: %w", name, err)
+	}
+	defer rows.Close()
+
+	privileges := make(map[string]Privilege)
+	for rows.Next() {
+		var database string
+		var p Privilege
+		if err := rows.Scan(&database, &p); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		privileges[database] = p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating rows: %w", err)
+	}
+	return privileges, nil
+}
+
+// HasAdminUser reports whether at least one user is an admin
+func (m *Manager) HasAdminUser() (bool, error) {
+	var exists bool
+	if err := m.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE admin = 1)`).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to look up admin users: %w", err)
+	}
+	return exists, nil
+}
+
+func hashPassword(password string) (string, error) {
+	if password == "" {
+		return "", fmt.Errorf("password must not be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+// AddUser creates a user, an admin one when admin is set
+func (m *Manager) AddUser(name, password string, admin bool) error {
+	if name == "" {
+		return fmt.Errorf("user name is required")
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res, err := m.db.Exec(`INSERT OR IGNORE INTO users (name, hash, admin, created_at) VALUES (?, ?, ?, ?)`,
+		name, hash, admin, time.Now().UnixNano())
+	if err != nil {
+		return fmt.Errorf("failed to create user %s: %w", name, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserExists
+	}
+	return nil
+}
+
+// SetPassword changes the password of a user
+func (m *Manager) SetPassword(name, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	return m.updateUser(name, `UPDATE users SET hash = ? WHERE name = ?`, hash, name)
+}
+
+// SetAdmin grants or revokes the admin rights of a user
+func (m *Manager) SetAdmin(name string, admin bool) error {
+	return m.updateUser(name, `UPDATE users SET admin = ? WHERE name = ?`, admin, name)
+}
+
+// DropUser removes a user and its privileges
+func (m *Manager) DropUser(name string) error {
+	if err := m.updateUser(name, `DELETE FROM users WHERE name = ?`, name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, err := m.db.Exec(`DELETE FROM user_privileges WHERE user = ?`, name); err != nil {
+		return fmt.Errorf("failed to drop privileges of user %s: %w", name, err)
+	}
+	return nil
+}
+
+// updateUser runs a statement changing the user row of name
+func (m *Manager) updateUser(name, stmt string, args ...interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res, err := m.db.Exec(stmt, args...)
+	if err != nil {
+		return fmt.Errorf("failed to update user %s: %w", name, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrUserNotFound
+	}
+	m.credentials.forget(name)
+	return nil
+}
+
+// GrantPrivilege adds p to the privileges of a user on database
+func (m *Manager) GrantPrivilege(name, database string, p Privilege) error {
+	return m.changePrivilege(name, database, func(current Privilege) Privilege { return current | p })
+}
+
+// RevokePrivilege removes p from the privileges of a user on database
+func (m *Manager) RevokePrivilege(name, database string, p Privilege) error {
+	return m.changePrivilege(name, database, func(current Privilege) Privilege { return current &^ p })
+}
+
+func (m *Manager) changePrivilege(name, database string, change func(Privilege) Privilege) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tx, err := m.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM users WHERE name = ?)`, name).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to look up user %s: %w", name, err)
+	}
+	if !exists {
+		return ErrUserNotFound
+	}
+	var current Privilege
+	err = tx.QueryRow(`SELECT privilege FROM user_privileges WHERE user = ? AND database = ?`, name, database).Scan(&current)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to look up privileges of user %s: %w", name, err)
+	}
+
+	if next := change(current); next == 0 {
+		_, err = tx.Exec(`DELETE FROM user_privileges WHERE user = ? AND database = ?`, name, database)
+	} else {
+		_, err = tx.Exec(`INSERT OR REPLACE INTO user_privileges (user, database, privilege) VALUES (?, ?, ?)`, name, database, next)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to change privileges of user %s: %w", name, err)
+	}
+	return tx.Commit()
+}
+
+// AuthenticateUser returns the named user when password is its password,
+// and otherwise ErrUserNotFound or ErrInvalidPassword
+func (m *Manager) AuthenticateUser(name, password string) (User, error) {
+	u, hash, err := m.getUser(name)
+	if err != nil {
+		return User{}, err
+	}
+	if m.credentials.check(name, hash, password) {
+		return u, nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		return User{}, ErrInvalidPassword
+	}
+	m.credentials.store(name, hash, password)
+	return u, nil
+}
@@ -0,0 +1,159 @@
+package persistence
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateWindow is the time constant of the write rates: a rate mostly
+// reflects the writes of the last rateWindow
+const rateWindow = time.Minute
+
+// WriteStats are the write statistics of a measurement since the server
+// started
+type WriteStats struct {
+	Database    string
+	Measurement string
+	// Points and Bytes count the points stored and their size in line
+	// protocol
+	Points uint64
+	Bytes  uint64
+	// LastWrite is when the last batch holding the measurement was stored
+	LastWrite time.Time
+	// PointsPerSecond and BytesPerSecond are exponentially weighted
+	// moving averages over rateWindow
+	PointsPerSecond float64
+	BytesPerSecond  float64
+}
+
+// rate is an exponentially weighted moving average of events per second
+type rate struct {
+	value float64
+	at    time.Time
+}
+
+// add decays the rate to now and adds n events
+func (r *rate) add(now time.Time, n float64) {
+	r.value = r.valueAt(now) + n/rateWindow.Seconds()
+	r.at = now
+}
+
+// valueAt returns the rate decayed to now, without adding events
+func (r *rate) valueAt(now time.Time) float64 {
+	if r.at.IsZero() || !now.After(r.at) {
+		return r.value
+	}
+	return r.value * math.Exp(-now.Sub(r.at).Seconds()/rateWindow.Seconds())
+}
+
+type writeCounter struct {
+	points, bytes        uint64
+	last                 time.Time
+	pointRate, bytesRate rate
+}
+
+// writeStats counts the points stored by measurement. Counting only takes
+// a map lookup per measurement of a batch, so statistics never need a
+// scan of storage.
+type writeStats struct {
+	mu       sync.Mutex
+	counters map[measurementRef]*writeCounter
+}
+
+func newWriteStats() *writeStats {
+	return &writeStats{counters: make(map[measurementRef]*writeCounter)}
+}
+
+// observe counts a batch of points stored at now
+func (w *writeStats) observe(points []Point, now time.Time) {
+	type total struct{ points, bytes uint64 }
+	totals := make(map[measurementRef]total)
+	for _, p := range points {
+		database := p.Database
+		if database == "" {
+			database = DefaultDatabase
+		}
+		ref := measurementRef{database: database, measurement: p.Measurement}
+		t := totals[ref]
+		t.points++
+		t.bytes += uint64(lineSize(p))
+		totals[ref] = t
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ref, t := range totals {
+		c := w.counters[ref]
+		if c == nil {
+			c = &writeCounter{}
+			w.counters[ref] = c
+		}
+		c.points += t.points
+		c.bytes += t.bytes
+		c.last = now
+		c.pointRate.add(now, float64(t.points))
+		c.bytesRate.add(now, float64(t.bytes))
+	}
+}
+
+// forget drops the statistics of a database
+func (w *writeStats) forget(database string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ref := range w.counters {
+		if ref.database == database {
+			delete(w.counters, ref)
+		}
+	}
+}
+
+// snapshot returns the statistics with their rates at now, sorted by
+// database and measurement
+func (w *writeStats) snapshot(now time.Time) []WriteStats {
+	w.mu.Lock()
+	stats := make([]WriteStats, 0, len(w.counters))
+	for ref, c := range w.counters {
+		stats = append(stats, WriteStats{
+			Database:        ref.database,
+			Measurement:     ref.measurement,
+			Points:          c.points,
+			Bytes:           c.bytes,
+			LastWrite:       c.last,
+			PointsPerSecond: c.pointRate.valueAt(now),
+			BytesPerSecond:  c.bytesRate.valueAt(now),
+		})
+	}
+	w.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Database != stats[j].Database {
+			return stats[i].Database < stats[j].Database
+		}
+		return stats[i].Measurement < stats[j].Measurement
+	})
+	return stats
+}
+
+// lineSize returns the length of the line protocol line of p, ignoring
+// escaping
+func lineSize(p Point) int {
+	var buf [32]byte
+	n := len(p.Measurement)
+	for k, v := range p.Tags {
+		n += len(k) + len(v) + 2
+	}
+	for k, v := range p.Fields {
+		n += len(k) + 2 + len(strconv.AppendFloat(buf[:0], v, 'g', -1, 64))
+	}
+	n += len(strconv.AppendInt(buf[:0], p.Timestamp, 10)) + 2
+	return n
+}
+
+// WriteStats returns the write statistics of every measurement written
+// since the server started, sorted by database and measurement
+func (m *Manager) WriteStats() []WriteStats {
+	return m.writeStats.snapshot(time.Now())
+}
@@ -0,0 +1,657 @@
+// Package predicate parses and evaluates the conditions of InfluxQL WHERE
+// clauses over the time, tags and fields of a point:
+//
+//	time >= now() - 1h AND host = 'a'
+//	(value > 90 OR load >= 4) AND region =~ /^eu-/
+//	"temp in"::field < -10 OR time = '2025-03-19T12:00:00Z'
+//
+// A comparison is on time when its key is time, on a tag when it compares
+// with a string or a regular expression, and on a field when it compares
+// with a number or a boolean. A key may carry an InfluxQL type cast, ::tag
+// or ::field, which must agree with the value compared. As in InfluxQL, a
+// missing tag has the empty string as value and a comparison on a missing
+// field is false. AND binds tighter than OR, and parentheses group.
+package predicate
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Expr is a parsed condition
+type Expr interface {
+	// Eval reports whether a point with the nanosecond timestamp ts, tags
+	// and fields satisfies the condition
+	Eval(ts int64, tags map[string]string, fields map[string]float64) bool
+	// String returns the condition in InfluxQL form
+	String() string
+}
+
+// And holds when both conditions hold
+type And struct {
+	X, Y Expr
+}
+
+// Or holds when either condition holds
+type Or struct {
+	X, Y Expr
+}
+
+// Kind is what a comparison applies to
+type Kind int
+
+const (
+	Time Kind = iota
+	Tag
+	Field
+)
+
+// Comparison compares the time, a tag or a field of a point with a value
+type Comparison struct {
+	Kind Kind
+	// Key is the tag or field compared, "time" for time
+	Key string
+	// Op is one of = != <> < <= > >= =~ !~
+	Op string
+	// Number is the value compared with a field, Time the nanosecond
+	// timestamp compared with time, and Text or Regex the value compared
+	// with a tag
+	Number float64
+	Time   int64
+	Text   string
+	Regex  *regexp.Regexp
+}
+
+func (e *And) Eval(ts int64, tags map[string]string, fields map[string]float64) bool {
+	return e.X.Eval(ts, tags, fields) && e.Y.Eval(ts, tags, fields)
+}
+
+func (e *And) String() string { return e.X.String() + " AND " + e.Y.String() }
+
+func (e *Or) Eval(ts int64, tags map[string]string, fields map[string]float64) bool {
+	return e.X.Eval(ts, tags, fields) || e.Y.Eval(ts, tags, fields)
+}
+
+func (e *Or) String() string { return "(" + e.X.String() + " OR " + e.Y.String() + ")" }
+
+func (c *Comparison) Eval(ts int64, tags map[string]string, fields map[string]float64) bool {
+	switch c.Kind {
+	case Time:
+		return compare(c.Op, float64(0), float64(0), ts, c.Time)
+	case Tag:
+		v := tags[c.Key]
+		switch c.Op {
+		case "=":
+			return v == c.Text
+		case "!=", "<>":
+			return v != c.Text
+		case "=~":
+			return c.Regex.MatchString(v)
+		case "!~":
+			return !c.Regex.MatchString(v)
+		}
+		return false
+	default:
+		v, ok := fields[c.Key]
+		return ok && compare(c.Op, v, c.Number, 0, 0)
+	}
+}
+
+// compare applies op to the floats x and y, or to the integers a and b
+// when the floats are equal. Timestamps are compared as integers, which
+// floats would round.
+func compare(op string, x, y float64, a, b int64) bool {
+	if x == y {
+		x, y = 0, 0
+		switch {
+		case a < b:
+			x = -1
+		case a > b:
+			x = 1
+		}
+	}
+	switch op {
+	case "=":
+		return x == y
+	case "!=", "<>":
+		return x != y
+	case "<":
+		return x < y
+	case "<=":
+		return x <= y
+	case ">":
+		return x > y
+	case ">=":
+		return x >= y
+	}
+	return false
+}
+
+func (c *Comparison) String() string {
+	key := quoteIdent(c.Key)
+	switch c.Kind {
+	case Time:
+		return "time " + c.Op + " " + strconv.FormatInt(c.Time, 10)
+	case Tag:
+		if c.Regex != nil {
+			return key + " " + c.Op + " /" + strings.ReplaceAll(c.Regex.String(), "/", `\/`) + "/"
+		}
+		return key + " " + c.Op + " '" + strings.ReplaceAll(c.Text, "'", `\'`) + "'"
+	default:
+		return key + " " + c.Op + " " + strconv.FormatFloat(c.Number, 'g', -1, 64)
+	}
+}
+
+// quoteIdent returns name, double quoted unless it is a bare identifier
+func quoteIdent(name string) string {
+	for i := 0; i < len(name); i++ {
+		if !isIdentByte(name[i]) {
+			return strconv.Quote(name)
+		}
+	}
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		return strconv.Quote(name)
+	}
+	return name
+}
+
+// TimeRange returns the smallest range [start, end] holding every
+// timestamp for which e may hold, math.MinInt64 and math.MaxInt64 standing
+// for unbounded ends. start > end when no timestamp satisfies e. A nil e
+// is unbounded.
+func TimeRange(e Expr) (start, end int64) {
+	switch e := e.(type) {
+	case *And:
+		xs, xe := TimeRange(e.X)
+		ys, ye := TimeRange(e.Y)
+		return max(xs, ys), min(xe, ye)
+	case *Or:
+		xs, xe := TimeRange(e.X)
+		ys, ye := TimeRange(e.Y)
+		if xs > xe {
+			return ys, ye
+		}
+		if ys > ye {
+			return xs, xe
+		}
+		return min(xs, ys), max(xe, ye)
+	case *Comparison:
+		if e.Kind != Time {
+			break
+		}
+		switch e.Op {
+		case "=":
+			return e.Time, e.Time
+		case ">=":
+			return e.Time, math.MaxInt64
+		case ">":
+			if e.Time == math.MaxInt64 {
+				return 1, 0
+			}
+			return e.Time + 1, math.MaxInt64
+		case "<=":
+			return math.MinInt64, e.Time
+		case "<":
+			if e.Time == math.MinInt64 {
+				return 1, 0
+			}
+			return math.MinInt64, e.Time - 1
+		}
+	}
+	return math.MinInt64, math.MaxInt64
+}
+
+// TimeOnly reports whether e only bounds time, so that TimeRange selects
+// exactly the points satisfying it
+func TimeOnly(e Expr) bool {
+	switch e := e.(type) {
+	case nil:
+		return true
+	case *And:
+		return TimeOnly(e.X) && TimeOnly(e.Y)
+	case *Comparison:
+		return e.Kind == Time && e.Op != "!=" && e.Op != "<>"
+	}
+	return false
+}
+
+// RequiredTags returns the tags e compares for equality with a non-empty
+// string on every path, which a point must carry for e to hold. Tags only
+// compared under OR are left out. A nil e requires no tags.
+func RequiredTags(e Expr) map[string]string {
+	tags := make(map[string]string)
+	requiredTags(e, tags)
+	return tags
+}
+
+func requiredTags(e Expr, tags map[string]string) {
+	switch e := e.(type) {
+	case *And:
+		requiredTags(e.X, tags)
+		requiredTags(e.Y, tags)
+	case *Comparison:
+		if e.Kind == Tag && e.Op == "=" && e.Text != "" {
+			if _, ok := tags[e.Key]; !ok {
+				tags[e.Key] = e.Text
+			}
+		}
+	}
+}
+
+// Parse parses the conditions of a WHERE clause. now() stands for now.
+// An empty clause returns a nil Expr.
+func Parse(s string, now time.Time) (Expr, error) {
+	p := &parser{s: s, now: now}
+	if p.peek() == 0 {
+		return nil, nil
+	}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != 0 {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.s[p.pos:], p.pos)
+	}
+	return e, nil
+}
+
+// parser is a recursive descent parser over a WHERE clause
+type parser struct {
+	s   string
+	pos int
+	now time.Time
+}
+
+func (p *parser) skipSpaces() {
+	for p.pos < len(p.s) && strings.IndexByte(" \t\r\n", p.s[p.pos]) != -1 {
+		p.pos++
+	}
+}
+
+// peek returns the next byte past spaces, or 0 at the end
+func (p *parser) peek() byte {
+	p.skipSpaces()
+	if p.pos == len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// keyword consumes the keyword, in any case, if it comes next
+func (p *parser) keyword(word string) bool {
+	p.skipSpaces()
+	end := p.pos + len(word)
+	if end > len(p.s) || !strings.EqualFold(p.s[p.pos:end], word) || (end < len(p.s) && isIdentByte(p.s[end])) {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+// or parses conditions joined by OR
+func (p *parser) or() (Expr, error) {
+	x, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		y, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		x = &Or{X: x, Y: y}
+	}
+	return x, nil
+}
+
+// and parses conditions joined by AND
+func (p *parser) and() (Expr, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		y, err := p.primary()
+		if err != nil {
+			return nil, err
+		}
+		x = &And{X: x, Y: y}
+	}
+	return x, nil
+}
+
+// primary parses a comparison or conditions between parentheses
+func (p *parser) primary() (Expr, error) {
+	switch p.peek() {
+	case 0:
+		return nil, fmt.Errorf("unexpected end of condition")
+	case '(':
+		p.pos++
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ) at offset %d", p.pos)
+		}
+		p.pos++
+		return x, nil
+	}
+	return p.comparison()
+}
+
+// comparison parses a key, an operator and the value compared
+func (p *parser) comparison() (Expr, error) {
+	start := p.pos
+	key, cast, err := p.key()
+	if err != nil {
+		return nil, err
+	}
+	op, err := p.operator()
+	if err != nil {
+		return nil, err
+	}
+	c := &Comparison{Key: key, Op: op}
+
+	if strings.EqualFold(key, "time") && p.s[start] != '"' && cast == "" {
+		if op == "=~" || op == "!~" {
+			return nil, fmt.Errorf("unsupported operator %s on time", op)
+		}
+		c.Kind, c.Key = Time, "time"
+		if c.Time, err = p.timeValue(); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+
+	switch b := p.peek(); {
+	case b == '\'':
+		c.Kind = Tag
+		if c.Text, err = p.quoted('\''); err != nil {
+			return nil, err
+		}
+		if op != "=" && op != "!=" && op != "<>" {
+			return nil, fmt.Errorf("unsupported operator %s on tag %s", op, key)
+		}
+	case b == '/':
+		c.Kind = Tag
+		text, err := p.quoted('/')
+		if err != nil {
+			return nil, err
+		}
+		if c.Regex, err = regexp.Compile(text); err != nil {
+			return nil, fmt.Errorf("invalid regular expression /%s/: %w", text, err)
+		}
+		if op != "=~" && op != "!~" {
+			return nil, fmt.Errorf("operator %s does not apply to a regular expression", op)
+		}
+	default:
+		c.Kind = Field
+		if c.Number, err = p.number(); err != nil {
+			return nil, err
+		}
+		if op == "=~" || op == "!~" {
+			return nil, fmt.Errorf("operator %s requires a regular expression", op)
+		}
+	}
+	if c.Regex == nil && (op == "=~" || op == "!~") {
+		return nil, fmt.Errorf("operator %s requires a regular expression", op)
+	}
+	switch {
+	case cast == "tag" && c.Kind != Tag:
+		return nil, fmt.Errorf("tag %s must be compared with a string", key)
+	case cast == "field" && c.Kind != Field:
+		return nil, fmt.Errorf("field %s must be compared with a number", key)
+	}
+	return c, nil
+}
+
+// key parses a bare or double quoted key and its type cast, if any
+func (p *parser) key() (string, string, error) {
+	var key string
+	switch b := p.peek(); {
+	case b == '"':
+		var err error
+		if key, err = p.quoted('"'); err != nil {
+			return "", "", err
+		}
+	case isIdentByte(b) && !(b >= '0' && b <= '9'):
+		start := p.pos
+		for p.pos < len(p.s) && isIdentByte(p.s[p.pos]) {
+			p.pos++
+		}
+		key = p.s[start:p.pos]
+	case b == 0:
+		return "", "", fmt.Errorf("unexpected end of condition")
+	default:
+		return "", "", fmt.Errorf("expected a tag, field or time at offset %d, got %q", p.pos, p.s[p.pos:])
+	}
+
+	if !strings.HasPrefix(p.s[p.pos:], "::") {
+		return key, "", nil
+	}
+	p.pos += 2
+	start := p.pos
+	for p.pos < len(p.s) && isIdentByte(p.s[p.pos]) {
+		p.pos++
+	}
+	cast := strings.ToLower(p.s[start:p.pos])
+	switch cast {
+	case "tag", "field":
+		return key, cast, nil
+	case "float", "integer", "unsigned", "boolean":
+		return key, "field", nil
+	}
+	return "", "", fmt.Errorf("unknown type cast ::%s", cast)
+}
+
+// operators are the comparison operators, the two byte ones first
+var operators = []string{"<=", ">=", "!=", "<>", "=~", "!~", "=", "<", ">"}
+
+func (p *parser) operator() (string, error) {
+	p.skipSpaces()
+	for _, op := range operators {
+		if strings.HasPrefix(p.s[p.pos:], op) {
+			p.pos += len(op)
+			return op, nil
+		}
+	}
+	if p.pos == len(p.s) {
+		return "", fmt.Errorf("unexpected end of condition, expected an operator")
+	}
+	return "", fmt.Errorf("expected an operator at offset %d, got %q", p.pos, p.s[p.pos:])
+}
+
+// quoted reads a literal between quote bytes, where a backslash escapes
+// the quote. Other escapes are kept, as regular expressions need them.
+func (p *parser) quoted(quote byte) (string, error) {
+	start := p.pos
+	var b strings.Builder
+	for i := p.pos + 1; i < len(p.s); i++ {
+		switch {
+		case p.s[i] == '\\' && i+1 < len(p.s):
+			i++
+			if p.s[i] != quote && quote == '/' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(p.s[i])
+		case p.s[i] == quote:
+			p.pos = i + 1
+			return b.String(), nil
+		default:
+			b.WriteByte(p.s[i])
+		}
+	}
+	return "", fmt.Errorf("unterminated %c at offset %d", quote, start)
+}
+
+// number reads a possibly signed number, or true and false as 1 and 0,
+// which is how boolean fields are stored
+func (p *parser) number() (float64, error) {
+	switch {
+	case p.keyword("true"):
+		return 1, nil
+	case p.keyword("false"):
+		return 0, nil
+	}
+	start := p.pos
+	if p.pos < len(p.s) && (p.s[p.pos] == '-' || p.s[p.pos] == '+') {
+		p.pos++
+	}
+	for p.pos < len(p.s) && (isIdentByte(p.s[p.pos]) || p.s[p.pos] == '.' ||
+		((p.s[p.pos] == '-' || p.s[p.pos] == '+') && (p.s[p.pos-1] == 'e' || p.s[p.pos-1] == 'E'))) {
+		p.pos++
+	}
+	text := p.s[start:p.pos]
+	v, err := strconv.ParseFloat(text, 64)
+	if err != nil || text == "" || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, fmt.Errorf("expected a number, a string or a regular expression at offset %d", start)
+	}
+	return v, nil
+}
+
+// timeValue reads the time compared with time: a nanosecond epoch, a
+// duration since the epoch such as 1556813561098ms, an RFC3339 string, or
+// now() possibly offset by a duration
+func (p *parser) timeValue() (int64, error) {
+	p.skipSpaces()
+	start := p.pos
+	if p.peek() == '\'' {
+		text, err := p.quoted('\'')
+		if err != nil {
+			return 0, err
+		}
+		t, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time '%s': expected RFC3339", text)
+		}
+		if t.Before(minTime) || t.After(maxTime) {
+			return 0, fmt.Errorf("time '%s' is outside the range of nanosecond timestamps", text)
+		}
+		return t.UnixNano(), nil
+	}
+
+	if p.keyword("now") {
+		if !strings.HasPrefix(p.s[p.pos:], "()") {
+			return 0, fmt.Errorf("expected now() at offset %d", start)
+		}
+		p.pos += 2
+		ts := p.now.UnixNano()
+		switch p.peek() {
+		case '-', '+':
+			sign := int64(1)
+			if p.s[p.pos] == '-' {
+				sign = -1
+			}
+			p.pos++
+			d, err := p.duration()
+			if err != nil {
+				return 0, err
+			}
+			ts += sign * int64(d)
+		}
+		return ts, nil
+	}
+
+	sign := int64(1)
+	if p.peek() == '-' {
+		sign = -1
+		p.pos++
+	}
+	digits := p.pos
+	for p.pos < len(p.s) && p.s[p.pos] >= '0' && p.s[p.pos] <= '9' {
+		p.pos++
+	}
+	if p.pos == digits {
+		return 0, fmt.Errorf("expected a time at offset %d, got %q", start, p.s[start:])
+	}
+	if p.pos == len(p.s) || !isIdentByte(p.s[p.pos]) {
+		ns, err := strconv.ParseInt(p.s[digits:p.pos], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid time %q", p.s[start:p.pos])
+		}
+		return sign * ns, nil
+	}
+	p.pos = digits
+	d, err := p.duration()
+	return sign * int64(d), err
+}
+
+// duration reads a duration literal
+func (p *parser) duration() (time.Duration, error) {
+	p.skipSpaces()
+	start := p.pos
+	for p.pos < len(p.s) && isIdentByte(p.s[p.pos]) {
+		p.pos++
+	}
+	return ParseDuration(p.s[start:p.pos])
+}
+
+// The range of times representable as nanosecond timestamps
+var (
+	minTime = time.Unix(0, math.MinInt64)
+	maxTime = time.Unix(0, math.MaxInt64)
+)
+
+// durationUnits are the units of InfluxQL duration literals, longest
+// first so that "ms" is not read as minutes
+var durationUnits = []struct {
+	name string
+	unit time.Duration
+}{
+	{"ns", time.Nanosecond},
+	{"ms", time.Millisecond},
+	{"u", time.Microsecond},
+	{"µ", time.Microsecond},
+	{"s", time.Second},
+	{"m", time.Minute},
+	{"h", time.Hour},
+	{"d", 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+}
+
+// ParseDuration reads an InfluxQL duration literal such as 10s, 1h30m or
+// 500ms
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+	var d time.Duration
+	for rest := s; rest != ""; {
+		i := 0
+		for i < len(rest) && rest[i] >= '0' && rest[i] <= '9' {
+			i++
+		}
+		if i == 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		n, err := strconv.ParseInt(rest[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		rest = rest[i:]
+
+		matched := false
+		for _, u := range durationUnits {
+			if strings.HasPrefix(rest, u.name) {
+				d += time.Duration(n) * u.unit
+				rest = rest[len(u.name):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+	return d, nil
+}
+
+func isIdentByte(b byte) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
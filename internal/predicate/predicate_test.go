@@ -0,0 +1,157 @@
+package predicate
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEval(t *testing.T) {
+	tags := map[string]string{"host": "a", "region": "eu-west", "path": "/var/log"}
+	fields := map[string]float64{"value": 95, "load": 2, "temp in": -20, "up": 1}
+	ts := int64(1000)
+
+	tests := []struct {
+		cond string
+		want bool
+	}{
+		{"value > 90", true},
+		{`"value" <= 90`, false},
+		{"value != 95", false},
+		{"value <> 94", true},
+		{"missing < 1", false},
+		{"missing != 1", false},
+		{"host = 'a'", true},
+		{"host != 'a'", false},
+		{"zone = ''", true},
+		{"region =~ /^eu-/", true},
+		{"region !~ /^eu-/", false},
+		{`path =~ /^\/var/`, true},
+		{`"temp in"::field < -10`, true},
+		{"host::tag = 'a'", true},
+		{"up = true AND load::integer = 2", true},
+		{"time = 1000", true},
+		{"time > 1000", false},
+		{"time != 1000", false},
+		{"value > 90 AND host = 'b'", false},
+		{"value > 90 OR host = 'b'", true},
+		{"host = 'b' AND value > 90 OR load = 2", true},
+		{"host = 'b' AND (value > 90 OR load = 2)", false},
+		{"((host = 'a')) and (time >= 1000 or value < 0)", true},
+	}
+	for _, tt := range tests {
+		e, err := Parse(tt.cond, time.Unix(0, 0))
+		if !assert.NoError(t, err, tt.cond) {
+			continue
+		}
+		assert.Equal(t, tt.want, e.Eval(ts, tags, fields), tt.cond)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, cond := range []string{
+		"value >",
+		"value > 90 AND",
+		"(value > 90",
+		"value > 90)",
+		"host > 'a'",
+		"host = /a/",
+		"value =~ 3",
+		"host =~ /(/",
+		"host::field = 'a'",
+		"value::tag > 1",
+		"value::text > 1",
+		"time =~ /x/",
+		"time >= now() * 2",
+		"time >= '1st of May'",
+		"time >= 10x",
+		"host = 'a",
+		"42 = value",
+	} {
+		_, err := Parse(cond, time.Unix(0, 0))
+		assert.Error(t, err, cond)
+	}
+
+	e, err := Parse("  ", time.Unix(0, 0))
+	assert.NoError(t, err)
+	assert.Nil(t, e)
+}
+
+func TestTimeRange(t *testing.T) {
+	now := time.Unix(3600, 0)
+	for cond, want := range map[string][2]int64{
+		`time >= 1000000ms and time <= 2000000ms`:       {1e12, 2e12},
+		`time > 10 AND time < 20`:                       {11, 19},
+		`time = 5`:                                      {5, 5},
+		`time >= now() - 1h and time <= now() + 30s`:    {0, 3630e9},
+		`time >= '1970-01-01T00:00:01Z' AND host = 'x'`: {1e9, math.MaxInt64},
+		`time < 10 OR time > 20`:                        {math.MinInt64, math.MaxInt64},
+		`(time >= 10 AND time <= 20) OR time = 30`:      {10, 30},
+		`time >= 10 AND (value > 1 OR time <= 20)`:      {10, math.MaxInt64},
+		`time > 20 AND time < 10 OR time = 5`:           {5, 5},
+		`value > 1`:                                     {math.MinInt64, math.MaxInt64},
+	} {
+		e, err := Parse(cond, now)
+		if !assert.NoError(t, err, cond) {
+			continue
+		}
+		start, end := TimeRange(e)
+		assert.Equal(t, want, [2]int64{start, end}, cond)
+	}
+}
+
+func TestTimeOnly(t *testing.T) {
+	for cond, want := range map[string]bool{
+		"":                            true,
+		"time >= 10 AND time <= 20":   true,
+		"time >= 10 AND value > 1":    false,
+		"time = 10 OR time = 20":      false,
+		"time != 10":                  false,
+		"host = 'a' AND time > now()": false,
+	} {
+		e, err := Parse(cond, time.Unix(0, 0))
+		assert.NoError(t, err, cond)
+		assert.Equal(t, want, TimeOnly(e), cond)
+	}
+}
+
+func TestRequiredTags(t *testing.T) {
+	for cond, want := range map[string]map[string]string{
+		"":                            {},
+		"host = 'a' AND time > now()": {"host": "a"},
+		"host = 'a' AND (region = 'eu' OR x > 1)": {"host": "a"},
+		"host = 'a' OR region = 'eu'":             {},
+		"host != 'a' AND region =~ /eu/":          {},
+		"host = '' AND region = 'eu'":             {"region": "eu"},
+	} {
+		e, err := Parse(cond, time.Unix(0, 0))
+		assert.NoError(t, err, cond)
+		assert.Equal(t, want, RequiredTags(e), cond)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"10s":   10 * time.Second,
+		"1h30m": 90 * time.Minute,
+		"500ms": 500 * time.Millisecond,
+		"2w":    14 * 24 * time.Hour,
+		"3u":    3 * time.Microsecond,
+	} {
+		d, err := ParseDuration(s)
+		assert.NoError(t, err, s)
+		assert.Equal(t, want, d, s)
+	}
+	for _, s := range []string{"", "10", "h", "10x"} {
+		_, err := ParseDuration(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestString(t *testing.T) {
+	e, err := Parse(`host = 'a' AND ("temp in" < -10 OR region =~ /eu\/w/)`, time.Unix(0, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, `host = 'a' AND ("temp in" < -10 OR region =~ /eu\/w/)`, e.String())
+}
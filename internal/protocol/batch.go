@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrTooManyLines is returned by a Batch holding more points than its
+	// MaxLines limit
+	ErrTooManyLines = errors.New("too many lines")
+	// ErrBatchTooLarge is returned by a Batch longer than its MaxBytes
+	// limit, or holding a line longer than a Batch can buffer
+	ErrBatchTooLarge = errors.New("batch too large")
+)
+
+// maxLineSize is the longest line a Batch reads
+const maxLineSize = 16 << 20
+
+// Limits bound the size of a batch. A zero value disables a limit.
+type Limits struct {
+	// MaxLines is the number of points, blank lines and comments excluded
+	MaxLines int
+	// MaxBytes is the size of the batch, newlines included
+	MaxBytes int64
+}
+
+// Batch reads the lines of a line protocol payload one at a time, so a
+// large request body is parsed without holding it in memory whole:
+//
+//	batch := protocol.ParseBatch(r, protocol.Limits{MaxBytes: 25 << 20})
+//	for batch.Next() {
+//		lp, err := batch.Point()
+//		...
+//	}
+//	if err := batch.Err(); err != nil {
+//		...
+//	}
+//
+// Once a limit is exceeded, Next returns false and Err wraps
+// ErrTooManyLines or ErrBatchTooLarge.
+type Batch struct {
+	scanner *bufio.Scanner
+	counter *countingReader
+	limits  Limits
+	// line is the number of the current line, blank lines included
+	line   int
+	bytes  []byte
+	points int
+	err    error
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// ParseBatch returns a Batch reading the lines of r within limits. With
+// MaxBytes set, at most one byte past the limit is read from r.
+func ParseBatch(r io.Reader, limits Limits) *Batch {
+	if limits.MaxBytes > 0 {
+		r = io.LimitReader(r, limits.MaxBytes+1)
+	}
+	counter := &countingReader{r: r}
+	scanner := bufio.NewScanner(counter)
+	scanner.Buffer(nil, maxLineSize)
+	return &Batch{scanner: scanner, counter: counter, limits: limits}
+}
+
+// Next advances to the next line holding a point, skipping blank lines
+// and comments. It returns false at the end of the batch, when reading
+// fails or when a limit is exceeded.
+func (b *Batch) Next() bool {
+	if b.err != nil {
+		return false
+	}
+	for b.scanner.Scan() {
+		b.line++
+		if b.tooLarge() {
+			return false
+		}
+		line := bytes.TrimSpace(b.scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		b.points++
+		if b.limits.MaxLines > 0 && b.points > b.limits.MaxLines {
+			b.err = fmt.Errorf("%w: more than %d points in the batch", ErrTooManyLines, b.limits.MaxLines)
+			return false
+		}
+		b.bytes = line
+		return true
+	}
+
+	err := b.scanner.Err()
+	switch {
+	case errors.Is(err, bufio.ErrTooLong):
+		b.err = fmt.Errorf("%w: line %d is longer than %d bytes", ErrBatchTooLarge, b.line+1, maxLineSize)
+	case err != nil:
+		b.err = fmt.Errorf("failed to read batch: %w", err)
+	default:
+		b.tooLarge()
+	}
+	return false
+}
+
+// tooLarge records an error and returns true once more than MaxBytes were
+// read
+func (b *Batch) tooLarge() bool {
+	if b.limits.MaxBytes > 0 && b.counter.n > b.limits.MaxBytes {
+		b.err = fmt.Errorf("%w: more than %d bytes", ErrBatchTooLarge, b.limits.MaxBytes)
+		return true
+	}
+	return false
+}
+
+// Line returns the number of the current line, counting from 1
+func (b *Batch) Line() int {
+	return b.line
+}
+
+// Text returns the current line, without surrounding spaces
+func (b *Batch) Text() string {
+	return string(b.bytes)
+}
+
+// Bytes returns the current line, without surrounding spaces. The slice
+// is only valid until the next call to Next.
+func (b *Batch) Bytes() []byte {
+	return b.bytes
+}
+
+// Point parses the current line
+func (b *Batch) Point() (*LineProtocol, error) {
+	var t Tokenizer
+	if err := t.Parse(b.bytes); err != nil {
+		return nil, err
+	}
+	return t.lineProtocol(), nil
+}
+
+// Tokenize parses the current line with t, without allocating once t has
+// grown to the size of the lines read
+func (b *Batch) Tokenize(t *Tokenizer) error {
+	return t.Parse(b.bytes)
+}
+
+// Err returns the error that stopped the batch, or nil when every line
+// was read
+func (b *Batch) Err() error {
+	return b.err
+}
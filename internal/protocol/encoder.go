@@ -0,0 +1,344 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Encoder builds line protocol lines, escaping measurements, keys and
+// values so that every line it produces is read back unchanged by Parse:
+//
+//	enc := protocol.NewEncoder(w)
+//	enc.StartLine("cpu")
+//	enc.AddTag("host", "server 1")
+//	enc.AddField("usage", 42.5)
+//	enc.AddField("cores", int64(8))
+//	if err := enc.EndLine(ts); err != nil {
+//		...
+//	}
+//
+// Commas and spaces are escaped in measurements, commas, equal signs and
+// spaces in tag keys, tag values and field keys, and double quotes and
+// backslashes in string field values. A measurement or tag value that
+// cannot be written plainly, such as one ending with a backslash, is
+// written in its double quoted form instead.
+//
+// A line that cannot be encoded is dropped and EndLine returns why; the
+// Encoder is then ready for the next line. Newlines are rejected
+// everywhere, since a line must fit on one line.
+//
+// An Encoder created with NewEncoder writes each line to its writer when
+// the line ends. The zero value keeps the lines in memory for Bytes.
+type Encoder struct {
+	w   io.Writer
+	buf []byte
+	// start is the offset of the current line in buf
+	start  int
+	inLine bool
+	fields int
+	err    error
+	// werr is the error returned by w, after which nothing is written
+	werr error
+}
+
+// NewEncoder returns an Encoder writing lines to w. Wrap w in a
+// bufio.Writer when writing many small lines to a file or a socket.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// StartLine begins a line for measurement. A line that was not ended is
+// dropped.
+func (e *Encoder) StartLine(measurement string) {
+	e.buf = e.buf[:e.start]
+	e.inLine, e.fields, e.err = true, 0, nil
+
+	switch {
+	case measurement == "":
+		e.err = fmt.Errorf("empty measurement")
+	case strings.IndexByte(measurement, '\n') != -1:
+		e.err = fmt.Errorf("invalid measurement %q: newlines are not allowed", measurement)
+	case needsQuotes(measurement) || measurement[0] == '#' || strings.TrimLeftFunc(measurement, unicode.IsSpace) != measurement:
+		// A leading # would make the line a comment, and leading spaces
+		// would be trimmed with the line
+		e.buf = appendQuoted(e.buf, measurement)
+	default:
+		e.buf = appendEscaped(e.buf, measurement, ", ")
+	}
+}
+
+// AddTag adds a tag to the current line. Tags must be added before the
+// fields. A tag with an empty value is left out, as line protocol cannot
+// represent it.
+func (e *Encoder) AddTag(key, value string) {
+	if !e.adding() {
+		return
+	}
+	if e.fields > 0 {
+		e.err = fmt.Errorf("tag %s added after the fields", key)
+		return
+	}
+	if value == "" {
+		return
+	}
+	if err := checkKey("tag key", key); err != nil {
+		e.err = err
+		return
+	}
+	if strings.IndexByte(value, '\n') != -1 {
+		e.err = fmt.Errorf("invalid value for tag %s: newlines are not allowed", key)
+		return
+	}
+
+	e.buf = append(e.buf, ',')
+	e.buf = appendEscaped(e.buf, key, ",= ")
+	e.buf = append(e.buf, '=')
+	if needsQuotes(value) {
+		e.buf = appendQuoted(e.buf, value)
+	} else {
+		e.buf = appendEscaped(e.buf, value, ",= ")
+	}
+}
+
+// AddField adds a field to the current line. value is a float64, float32,
+// int, int32, int64, uint, uint32, uint64, string or bool. Floats must be
+// finite.
+func (e *Encoder) AddField(key string, value interface{}) {
+	if !e.adding() {
+		return
+	}
+	if err := checkKey("field key", key); err != nil {
+		e.err = err
+		return
+	}
+
+	mark := len(e.buf)
+	e.addFieldKey(key)
+	switch v := value.(type) {
+	case float64:
+		e.appendFloat(key, v, 64)
+	case float32:
+		e.appendFloat(key, float64(v), 32)
+	case int:
+		e.buf = append(strconv.AppendInt(e.buf, int64(v), 10), 'i')
+	case int32:
+		e.buf = append(strconv.AppendInt(e.buf, int64(v), 10), 'i')
+	case int64:
+		e.buf = append(strconv.AppendInt(e.buf, v, 10), 'i')
+	case uint:
+		e.buf = append(strconv.AppendUint(e.buf, uint64(v), 10), 'u')
+	case uint32:
+		e.buf = append(strconv.AppendUint(e.buf, uint64(v), 10), 'u')
+	case uint64:
+		e.buf = append(strconv.AppendUint(e.buf, v, 10), 'u')
+	case bool:
+		e.buf = strconv.AppendBool(e.buf, v)
+	case string:
+		if strings.IndexByte(v, '\n') != -1 {
+			e.err = fmt.Errorf("invalid value for field %s: newlines are not allowed", key)
+			break
+		}
+		e.buf = appendQuoted(e.buf, v)
+	default:
+		e.err = fmt.Errorf("unsupported value type %T for field %s", value, key)
+	}
+	if e.err != nil {
+		e.buf = e.buf[:mark]
+		return
+	}
+	e.fields++
+}
+
+// addRawField adds a field whose value is already in its line protocol
+// form, as kept in LineProtocol.Fields
+func (e *Encoder) addRawField(key, raw string) {
+	if !e.adding() {
+		return
+	}
+	if err := checkKey("field key", key); err != nil {
+		e.err = err
+		return
+	}
+	if raw == "" {
+		e.err = fmt.Errorf("missing field value for %s", key)
+		return
+	}
+	if _, err := FieldValue(raw); err != nil {
+		e.err = err
+		return
+	}
+	if strings.IndexByte(raw, '\n') != -1 {
+		e.err = fmt.Errorf("invalid value for field %s: newlines are not allowed", key)
+		return
+	}
+	e.addFieldKey(key)
+	e.buf = append(e.buf, raw...)
+	e.fields++
+}
+
+// EndLine completes the current line with timestamp, in nanoseconds, or
+// without a timestamp when it is 0. It returns why the line was dropped,
+// or the error of the writer.
+func (e *Encoder) EndLine(timestamp int64) error {
+	return e.endLine(timestamp, timestamp != 0)
+}
+
+// EndLineAt completes the current line like EndLine, but always writes
+// timestamp, so a point stored at the epoch keeps it
+func (e *Encoder) EndLineAt(timestamp int64) error {
+	return e.endLine(timestamp, true)
+}
+
+func (e *Encoder) endLine(timestamp int64, stamped bool) error {
+	if e.werr != nil {
+		return e.werr
+	}
+	if !e.inLine {
+		return fmt.Errorf("no line started")
+	}
+	e.inLine = false
+	if e.err == nil && e.fields == 0 {
+		e.err = fmt.Errorf("missing fields")
+	}
+	if err := e.err; err != nil {
+		e.buf, e.err = e.buf[:e.start], nil
+		return err
+	}
+
+	if stamped {
+		e.buf = append(e.buf, ' ')
+		e.buf = strconv.AppendInt(e.buf, timestamp, 10)
+	}
+	e.buf = append(e.buf, '\n')
+
+	if e.w == nil {
+		e.start = len(e.buf)
+		return nil
+	}
+	_, err := e.w.Write(e.buf)
+	e.buf = e.buf[:0]
+	if err != nil {
+		e.werr = fmt.Errorf("failed to write line: %w", err)
+		return e.werr
+	}
+	return nil
+}
+
+// Encode writes lp as one line. Tags are written in the order they were
+// parsed, or sorted by key when lp was built by hand, and field values
+// are written in their raw form.
+func (e *Encoder) Encode(lp *LineProtocol) error {
+	e.StartLine(lp.Measurement)
+	for _, k := range orderedKeys(lp.Tags, lp.tagOrder) {
+		e.AddTag(k, lp.Tags[k])
+	}
+	for _, k := range orderedKeys(lp.Fields, lp.fieldOrder) {
+		e.addRawField(k, lp.Fields[k])
+	}
+	return e.EndLine(lp.Timestamp)
+}
+
+// Bytes returns the lines encoded so far by an Encoder without a writer
+func (e *Encoder) Bytes() []byte {
+	return e.buf[:e.start]
+}
+
+// Reset discards the lines encoded so far, keeping the buffer for reuse
+func (e *Encoder) Reset() {
+	e.buf, e.start = e.buf[:0], 0
+	e.inLine, e.fields, e.err = false, 0, nil
+}
+
+// adding reports whether a tag or a field can be added to the line
+func (e *Encoder) adding() bool {
+	if !e.inLine {
+		if e.err == nil {
+			e.err = fmt.Errorf("no line started")
+		}
+		return false
+	}
+	return e.err == nil
+}
+
+func (e *Encoder) addFieldKey(key string) {
+	if e.fields == 0 {
+		e.buf = append(e.buf, ' ')
+	} else {
+		e.buf = append(e.buf, ',')
+	}
+	e.buf = appendEscaped(e.buf, key, ",= ")
+	e.buf = append(e.buf, '=')
+}
+
+func (e *Encoder) appendFloat(key string, v float64, bitSize int) {
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		e.err = fmt.Errorf("invalid value for field %s: %v cannot be represented", key, v)
+		return
+	}
+	e.buf = strconv.AppendFloat(e.buf, v, 'g', -1, bitSize)
+}
+
+// checkKey rejects the tag and field keys that cannot be written. A
+// trailing backslash would escape the separator that follows the key.
+func checkKey(kind, key string) error {
+	switch {
+	case key == "":
+		return fmt.Errorf("empty %s", kind)
+	case strings.IndexByte(key, '\n') != -1:
+		return fmt.Errorf("invalid %s %q: newlines are not allowed", kind, key)
+	case key[len(key)-1] == '\\':
+		return fmt.Errorf("invalid %s %q: keys cannot end with a backslash", kind, key)
+	}
+	return nil
+}
+
+// needsQuotes reports whether a measurement or tag value must be written
+// in its double quoted form: a leading quote would be read as the start
+// of one, and a trailing backslash would escape the separator that
+// follows
+func needsQuotes(s string) bool {
+	return s[0] == '"' || s[len(s)-1] == '\\'
+}
+
+// appendEscaped appends s to dst, escaping the bytes found in chars
+func appendEscaped(dst []byte, s, chars string) []byte {
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(chars, s[i]) != -1 {
+			dst = append(dst, '\\')
+		}
+		dst = append(dst, s[i])
+	}
+	return dst
+}
+
+// appendQuoted appends s to dst between double quotes, escaping double
+// quotes and backslashes
+func appendQuoted(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	for i := 0; i < len(s); i++ {
+		if s[i] == '"' || s[i] == '\\' {
+			dst = append(dst, '\\')
+		}
+		dst = append(dst, s[i])
+	}
+	return append(dst, '"')
+}
+
+// orderedKeys returns the keys of m in the given order, or sorted when no
+// order was recorded
+func orderedKeys(m map[string]string, order []string) []string {
+	if len(order) > 0 {
+		return order
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -27,7 +27,6 @@ package protocol
 
 import (
 	"fmt"
-	"sort"
 	"strconv"
 	"strings"
 )
@@ -42,249 +41,198 @@ type LineProtocol struct {
 	tagOrder    []string // to preserve tag order
 }
 
-// Parse parses a line protocol string into a LineProtocol struct
-func Parse(line string) (*LineProtocol, error) {
-	lp := New("")
+// parseState is the current position of the line parser
+type parseState int
 
-	// Trim any whitespace and newlines
-	line = strings.TrimSpace(line)
+const (
+	stateMeasurement parseState = iota
+	stateTagKey
+	stateTagValue
+	stateFieldKey
+	stateFieldValue
+	stateTimestamp
+)
 
-	// Split into measurement+tags and fields+timestamp
-	parts := strings.SplitN(line, " ", 2)
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("invalid line protocol format")
+// Parse parses a line protocol string into a LineProtocol struct.
+//
+// The line is scanned once, byte by byte, following the InfluxDB escaping
+// rules: commas and spaces may be escaped with a backslash in measurement
+// names; commas, equal signs and spaces may be escaped in tag keys, tag
+// values and field keys; and double quotes and backslashes may be escaped
+// inside string field values. String field values are kept in their raw,
+// quoted form; use FieldValue to decode them.
+//
+// For compatibility with older refluxdb clients a measurement name or a tag
+// value may also be wrapped in double quotes.
+func Parse(line string) (*LineProtocol, error) {
+	var t Tokenizer
+	if err := t.Parse([]byte(line)); err != nil {
+		return nil, err
 	}
+	return t.lineProtocol(), nil
+}
 
-	// Parse measurement and tags
-	measurementAndTags := parts[0]
-	var measurement string
-	var tags string
-
-	// Handle quoted measurement
-	if strings.HasPrefix(measurementAndTags, "\"") {
-		// Find the closing quote
-		var i int
-		var inEscape bool
-		for i = 1; i < len(measurementAndTags); i++ {
-			if inEscape {
-				inEscape = false
-				continue
-			}
-			if measurementAndTags[i] == '\\' {
-				inEscape = true
-				continue
-			}
-			if measurementAndTags[i] == '"' {
-				break
-			}
-		}
-		if i >= len(measurementAndTags) {
-			return nil, fmt.Errorf("unterminated quoted measurement")
-		}
-		measurement = measurementAndTags[1:i]
-		if i+1 < len(measurementAndTags) {
-			if measurementAndTags[i+1] != ',' {
-				return nil, fmt.Errorf("invalid character after quoted measurement")
-			}
-			tags = measurementAndTags[i+2:]
-		}
-	} else {
-		// Unquoted measurement
-		measurementParts := strings.SplitN(measurementAndTags, ",", 2)
-		measurement = measurementParts[0]
-		if len(measurementParts) > 1 {
-			tags = measurementParts[1]
-		}
+// ParseWithMode is Parse checking the line as strictly as mode requires.
+// It also returns the warnings of ModeLenient, one per part of the line
+// that was dropped.
+func ParseWithMode(line string, mode Mode) (*LineProtocol, []string, error) {
+	t := Tokenizer{Mode: mode}
+	if err := t.Parse([]byte(line)); err != nil {
+		return nil, nil, err
 	}
+	return t.lineProtocol(), t.Warnings(), nil
+}
 
-	if measurement == "" {
-		return nil, fmt.Errorf("empty measurement")
+// FieldValue decodes a raw field value as stored in LineProtocol.Fields.
+// It returns a float64, int64, uint64, string or bool depending on the
+// line protocol type of the value.
+func FieldValue(raw string) (interface{}, error) {
+	if raw == "" {
+		return nil, fmt.Errorf("empty field value")
 	}
 
-	lp.Measurement = measurement
-
-	// Parse tags
-	if tags != "" {
-		lp.Tags = make(map[string]string)
-		tagPairs := strings.Split(tags, ",")
-		for _, pair := range tagPairs {
-			kv := strings.SplitN(pair, "=", 2)
-			if len(kv) != 2 {
-				return nil, fmt.Errorf("invalid tag format: %s", pair)
-			}
-			key := strings.TrimSpace(kv[0])
-			value := strings.TrimSpace(kv[1])
-
-			// Handle quoted tag values
-			if strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
-				value = value[1 : len(value)-1]
-			}
-
-			if key == "" {
-				return nil, fmt.Errorf("empty tag key")
-			}
-			if value == "" {
-				return nil, fmt.Errorf("empty tag value")
-			}
-
-			lp.Tags[key] = value
-			lp.tagOrder = append(lp.tagOrder, key)
+	if raw[0] == '"' {
+		if len(raw) < 2 || raw[len(raw)-1] != '"' {
+			return nil, fmt.Errorf("invalid string field value: %s", raw)
 		}
-	} else {
-		lp.Tags = nil
-		lp.tagOrder = nil
+		return unescapeString(raw[1 : len(raw)-1]), nil
 	}
 
-	// Split fields and timestamp
-	fieldsAndTime := strings.SplitN(parts[1], " ", 2)
-	if len(fieldsAndTime) == 0 {
-		return nil, fmt.Errorf("missing fields")
+	if b, ok := parseBool(raw); ok {
+		return b, nil
 	}
 
-	// Parse fields
-	lp.Fields = make(map[string]string)
-	fields := strings.Split(fieldsAndTime[0], ",")
-	for _, field := range fields {
-		kv := strings.SplitN(field, "=", 2)
-		if len(kv) != 2 {
-			return nil, fmt.Errorf("invalid field format: %s", field)
+	switch raw[len(raw)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer field value: %s", raw)
 		}
-		key := strings.TrimSpace(kv[0])
-		value := strings.TrimSpace(kv[1])
-
-		if key == "" {
-			return nil, fmt.Errorf("empty field key")
+		return v, nil
+	case 'u':
+		v, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid unsigned field value: %s", raw)
 		}
+		return v, nil
+	}
 
-		// Handle field value types
-		if strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
-			// String value - validate it's properly quoted
-			if len(value) < 2 {
-				return nil, fmt.Errorf("invalid string field value: %s", value)
-			}
-			lp.Fields[key] = value
-		} else if strings.HasSuffix(value, "i") {
-			// Integer value
-			numStr := value[:len(value)-1]
-			if _, err := strconv.ParseInt(numStr, 10, 64); err != nil {
-				return nil, fmt.Errorf("invalid integer field value: %s", value)
-			}
-			lp.Fields[key] = value
-		} else if strings.ToLower(value) == "true" || strings.ToLower(value) == "false" {
-			// Boolean value
-			lp.Fields[key] = strings.ToLower(value)
-		} else {
-			// Try to parse as float (default numeric type)
-			if _, err := strconv.ParseFloat(value, 64); err != nil {
-				return nil, fmt.Errorf("invalid numeric field value: %s", value)
-			}
-			lp.Fields[key] = value
-		}
-		lp.fieldOrder = append(lp.fieldOrder, key)
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid numeric field value: %s", raw)
 	}
+	return v, nil
+}
 
-	// Parse timestamp if present
-	if len(fieldsAndTime) > 1 {
-		timestamp, err := strconv.ParseInt(fieldsAndTime[1], 10, 64)
+// FloatFields decodes every field of the line as a float64. Integers are
+// converted, booleans become 1 or 0 and string values are recorded as 1 to
+// mark their presence.
+func (lp *LineProtocol) FloatFields() (map[string]float64, error) {
+	fields := make(map[string]float64, len(lp.Fields))
+	for key, raw := range lp.Fields {
+		value, err := FieldValue(raw)
 		if err != nil {
-			return nil, fmt.Errorf("invalid timestamp: %s", fieldsAndTime[1])
+			return nil, err
+		}
+		switch v := value.(type) {
+		case float64:
+			fields[key] = v
+		case int64:
+			fields[key] = float64(v)
+		case uint64:
+			fields[key] = float64(v)
+		case bool:
+			if v {
+				fields[key] = 1.0
+			} else {
+				fields[key] = 0.0
+			}
+		case string:
+			fields[key] = 1.0
 		}
-		lp.Timestamp = timestamp
 	}
-
-	return lp, nil
+	return fields, nil
 }
 
-// String converts the LineProtocol struct to a line protocol string
-func (lp *LineProtocol) String() string {
-	if lp == nil {
-		return ""
+// parseBool recognizes the boolean literals accepted by line protocol
+func parseBool(s string) (bool, bool) {
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return true, true
+	case "f", "F", "false", "False", "FALSE":
+		return false, true
 	}
+	return false, false
+}
 
-	var sb strings.Builder
+// isEscapable reports whether c can follow a backslash in the current context
+func isEscapable(c byte, chars string) bool {
+	return strings.IndexByte(chars, c) != -1
+}
 
-	// Write measurement
-	if strings.Contains(lp.Measurement, " ") || strings.Contains(lp.Measurement, ",") {
-		sb.WriteString("\"")
-		sb.WriteString(strings.ReplaceAll(lp.Measurement, "\"", "\\\""))
-		sb.WriteString("\"")
-	} else {
-		sb.WriteString(lp.Measurement)
+// skipSpaces returns the index of the first non-space byte at or after i
+func skipSpaces(line []byte, i int) int {
+	for i < len(line) && line[i] == ' ' {
+		i++
 	}
+	return i
+}
 
-	// Write tags in order
-	if lp.Tags != nil && len(lp.tagOrder) > 0 {
-		for _, k := range lp.tagOrder {
-			v := lp.Tags[k]
-			sb.WriteString(",")
-			sb.WriteString(k)
-			sb.WriteString("=")
-			if strings.Contains(v, " ") {
-				sb.WriteString("\"")
-				sb.WriteString(strings.ReplaceAll(v, "\"", "\\\""))
-				sb.WriteString("\"")
-			} else {
-				sb.WriteString(v)
-			}
-		}
-	} else if lp.Tags != nil {
-		// Fallback to sorted order if no order is preserved
-		keys := make([]string, 0, len(lp.Tags))
-		for k := range lp.Tags {
-			keys = append(keys, k)
-		}
-		sort.Strings(keys)
-		for _, k := range keys {
-			v := lp.Tags[k]
-			sb.WriteString(",")
-			sb.WriteString(k)
-			sb.WriteString("=")
-			if strings.Contains(v, " ") {
-				sb.WriteString("\"")
-				sb.WriteString(strings.ReplaceAll(v, "\"", "\\\""))
-				sb.WriteString("\"")
-			} else {
-				sb.WriteString(v)
-			}
+// scanString returns the index just past the closing quote of the string
+// field value starting at line[start]. Backslash escapes are skipped over.
+func scanString(line []byte, start int) (int, error) {
+	for i := start + 1; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			return i + 1, nil
 		}
 	}
+	return 0, fmt.Errorf("unterminated string")
+}
 
-	// Write fields in order
-	sb.WriteString(" ")
-	if lp.Fields != nil && len(lp.fieldOrder) > 0 {
-		first := true
-		for _, k := range lp.fieldOrder {
-			if !first {
-				sb.WriteString(",")
-			}
-			first = false
-			sb.WriteString(k)
-			sb.WriteString("=")
-			sb.WriteString(lp.Fields[k])
-		}
-	} else if lp.Fields != nil {
-		// Fallback to unordered if no order is preserved
-		first := true
-		for k, v := range lp.Fields {
-			if !first {
-				sb.WriteString(",")
-			}
-			first = false
-			sb.WriteString(k)
-			sb.WriteString("=")
-			sb.WriteString(v)
+// appendUnescaped appends s to dst, removing the backslash escapes allowed
+// in string values
+func appendUnescaped(dst, s []byte) []byte {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+			i++
 		}
+		dst = append(dst, s[i])
 	}
+	return dst
+}
 
-	// Write timestamp
-	if lp.Timestamp > 0 {
-		sb.WriteString(" ")
-		sb.WriteString(strconv.FormatInt(lp.Timestamp, 10))
+// unescapeString removes the backslash escapes allowed in string values
+func unescapeString(s string) string {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+			i++
+		}
+		sb.WriteByte(s[i])
 	}
-
 	return sb.String()
 }
 
+// String converts the LineProtocol struct to a line protocol string. It
+// returns an empty string when lp cannot be encoded; use an Encoder to
+// learn why.
+func (lp *LineProtocol) String() string {
+	if lp == nil {
+		return ""
+	}
+	var e Encoder
+	if err := e.Encode(lp); err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(string(e.Bytes()), "\n")
+}
+
 // isNumeric checks if a string represents a numeric value
 func isNumeric(s string) bool {
 	if _, err := strconv.ParseFloat(s, 64); err == nil {
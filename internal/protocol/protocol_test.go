@@ -1,6 +1,12 @@
 package protocol
 
 import (
+	"bytes"
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -106,6 +112,275 @@ func TestParseBasic(t *testing.T) {
 	}
 }
 
+func TestParseEscapes(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected *LineProtocol
+	}{
+		{
+			name:  "escaped space in tag value",
+			input: `cpu,host=us\ west value=1`,
+			expected: &LineProtocol{
+				Measurement: "cpu",
+				Tags:        map[string]string{"host": "us west"},
+				Fields:      map[string]string{"value": "1"},
+			},
+		},
+		{
+			name:  "escaped comma and equals in tag",
+			input: `cpu,tag\,key=a\=b\,c value=1`,
+			expected: &LineProtocol{
+				Measurement: "cpu",
+				Tags:        map[string]string{"tag,key": "a=b,c"},
+				Fields:      map[string]string{"value": "1"},
+			},
+		},
+		{
+			name:  "escaped space and comma in measurement",
+			input: `my\ cpu\,total value=1`,
+			expected: &LineProtocol{
+				Measurement: "my cpu,total",
+				Fields:      map[string]string{"value": "1"},
+			},
+		},
+		{
+			name:  "comma and equals inside string field",
+			input: `log msg="a,b=c d",level="warn" 10`,
+			expected: &LineProtocol{
+				Measurement: "log",
+				Fields:      map[string]string{"msg": `"a,b=c d"`, "level": `"warn"`},
+				Timestamp:   10,
+			},
+		},
+		{
+			name:  "escaped quote inside string field",
+			input: `log msg="say \"hi\" \\o/"`,
+			expected: &LineProtocol{
+				Measurement: "log",
+				Fields:      map[string]string{"msg": `"say \"hi\" \\o/"`},
+			},
+		},
+		{
+			name:  "escaped field key",
+			input: `cpu usage\ user=1,a\=b=2i`,
+			expected: &LineProtocol{
+				Measurement: "cpu",
+				Fields:      map[string]string{"usage user": "1", "a=b": "2i"},
+			},
+		},
+		{
+			name:  "literal backslash in tag value",
+			input: `path,dir=C:\temp value=1`,
+			expected: &LineProtocol{
+				Measurement: "path",
+				Tags:        map[string]string{"dir": `C:\temp`},
+				Fields:      map[string]string{"value": "1"},
+			},
+		},
+		{
+			name:  "boolean literals are normalized",
+			input: `flags a=t,b=FALSE,c=True`,
+			expected: &LineProtocol{
+				Measurement: "flags",
+				Fields:      map[string]string{"a": "true", "b": "false", "c": "true"},
+			},
+		},
+		{
+			name:  "multiple spaces between sections",
+			input: "cpu,host=a  value=1   1465839830100400200",
+			expected: &LineProtocol{
+				Measurement: "cpu",
+				Tags:        map[string]string{"host": "a"},
+				Fields:      map[string]string{"value": "1"},
+				Timestamp:   1465839830100400200,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.input)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.expected.Measurement, got.Measurement)
+			assert.Equal(t, tt.expected.Tags, got.Tags)
+			assert.Equal(t, tt.expected.Fields, got.Fields)
+			assert.Equal(t, tt.expected.Timestamp, got.Timestamp)
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	inputs := []string{
+		"cpu,host value=1",
+		"cpu,host= value=1",
+		"cpu,=a value=1",
+		",host=a value=1",
+		"cpu,host=a=b value=1",
+		"cpu value",
+		"cpu value=",
+		"cpu =1",
+		"cpu value=abc",
+		"cpu value=1x",
+		"cpu value=1.5i",
+		`cpu value="unterminated`,
+		`cpu value="a"b`,
+		"cpu value=1 notatime",
+		"cpu value=1 123 456",
+		"cpu,host=a",
+	}
+
+	for _, input := range inputs {
+		t.Run(input, func(t *testing.T) {
+			_, err := Parse(input)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestParseModes(t *testing.T) {
+	// Accepted by default, rejected in strict mode
+	for _, line := range []string{
+		"cpu,host=a,host=b value=1",
+		"_internal value=1",
+		"cpu,host=\xff value=1",
+		"cpu msg=\"\xff\"",
+	} {
+		_, _, err := ParseWithMode(line, ModeDefault)
+		assert.NoError(t, err, line)
+		_, _, err = ParseWithMode(line, ModeStrict)
+		assert.Error(t, err, line)
+	}
+
+	lp, warnings, err := ParseWithMode("cpu,host=a value=1", ModeStrict)
+	assert.NoError(t, err)
+	assert.Empty(t, warnings)
+	assert.Equal(t, "a", lp.Tags["host"])
+
+	// Rejected by default, salvaged in lenient mode
+	tests := []struct {
+		line     string
+		expected string
+		warnings int
+	}{
+		{"cpu value=abc,temp=2", "cpu temp=2", 1},
+		{"cpu value=,temp=2 10", "cpu temp=2 10", 1},
+		{"cpu,host=,region=eu value=1", "cpu,region=eu value=1", 1},
+		{"cpu,path=a=b value=1", `cpu,path=a\=b value=1`, 1},
+		{"cpu value=1 notatime", "cpu value=1", 1},
+		{"cpu value=1 10 20", "cpu value=1 10", 1},
+		{"cpu,host=a,host=b value=1i,value=2x", "cpu,host=b value=1i", 2},
+	}
+	for _, tt := range tests {
+		_, _, err := ParseWithMode(tt.line, ModeDefault)
+		assert.Error(t, err, tt.line)
+
+		lp, warnings, err := ParseWithMode(tt.line, ModeLenient)
+		if assert.NoError(t, err, tt.line) {
+			assert.Equal(t, tt.expected, lp.String(), tt.line)
+			assert.Len(t, warnings, tt.warnings, tt.line)
+		}
+	}
+
+	// Nothing left to store
+	_, _, err = ParseWithMode("cpu value=abc", ModeLenient)
+	assert.Error(t, err)
+
+	for _, name := range []string{"", "default", "strict", "lenient"} {
+		mode, err := LookupMode(name)
+		assert.NoError(t, err)
+		if name != "" {
+			assert.Equal(t, name, mode.String())
+		}
+	}
+	_, err = LookupMode("loose")
+	assert.Error(t, err)
+}
+
+func TestFieldValue(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected interface{}
+	}{
+		{"42", 42.0},
+		{"-1.5e3", -1500.0},
+		{"42i", int64(42)},
+		{"42u", uint64(42)},
+		{"true", true},
+		{"F", false},
+		{`"hello"`, "hello"},
+		{`"say \"hi\""`, `say "hi"`},
+		{`"C:\\temp"`, `C:\temp`},
+		{`""`, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			v, err := FieldValue(tt.raw)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, v)
+		})
+	}
+
+	for _, raw := range []string{"", `"`, "abc", "1.5i", "-1u"} {
+		_, err := FieldValue(raw)
+		assert.Error(t, err, raw)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	seeds := []string{
+		"cpu value=42",
+		"cpu,host=server1,region=us-west value=42i,temp=23.4 1465839830100400200",
+		`"my measurement",foo=bar value="string field"`,
+		`cpu,host=us\ west value=1`,
+		`log msg="a,b=c \"d\"" 1`,
+		"cpu,host=\"server 1\" value=42",
+	}
+	for _, seed := range seeds {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, line string) {
+		lp, err := Parse(line)
+		if err != nil {
+			return
+		}
+		if lp.Measurement == "" {
+			t.Fatalf("parsed %q with empty measurement", line)
+		}
+		if len(lp.Fields) == 0 {
+			t.Fatalf("parsed %q without fields", line)
+		}
+		for k, v := range lp.Fields {
+			if _, err := FieldValue(v); err != nil {
+				t.Fatalf("parsed %q with invalid field %s=%s: %v", line, k, v, err)
+			}
+		}
+		for k, v := range lp.Tags {
+			if k == "" || v == "" {
+				t.Fatalf("parsed %q with empty tag %q=%q", line, k, v)
+			}
+		}
+
+		// Serialized lines are read back unchanged. Newlines, which Parse
+		// accepts inside a single line, cannot be encoded.
+		if strings.ContainsRune(line, '\n') {
+			return
+		}
+		again, err := Parse(lp.String())
+		if err != nil {
+			t.Fatalf("serialized %q as %q, which does not parse: %v", line, lp.String(), err)
+		}
+		if again.Measurement != lp.Measurement || !reflect.DeepEqual(again.Tags, lp.Tags) ||
+			!reflect.DeepEqual(again.Fields, lp.Fields) || again.Timestamp != lp.Timestamp {
+			t.Fatalf("serialized %q as %q, which parses as %+v instead of %+v", line, lp.String(), again, lp)
+		}
+	})
+}
+
 func TestSerialize(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -125,7 +400,17 @@ func TestSerialize(t *testing.T) {
 		{
 			name:     "measurement with quoted tag value",
 			input:    "cpu,host=\"server 1\" value=42",
-			expected: "cpu,host=\"server 1\" value=42",
+			expected: `cpu,host=server\ 1 value=42`,
+		},
+		{
+			name:     "escaped names",
+			input:    `my\ cpu,tag\,key=a\=b\,c usage\ user=1 10`,
+			expected: `my\ cpu,tag\,key=a\=b\,c usage\ user=1 10`,
+		},
+		{
+			name:     "string field with escapes",
+			input:    `log msg="say \"hi\" \\o/"`,
+			expected: `log msg="say \"hi\" \\o/"`,
 		},
 		{
 			name:     "measurement with multiple fields",
@@ -143,6 +428,81 @@ func TestSerialize(t *testing.T) {
 	}
 }
 
+func TestEncoder(t *testing.T) {
+	var buf strings.Builder
+	enc := NewEncoder(&buf)
+
+	enc.StartLine("cpu load")
+	enc.AddTag("host", "server 1")
+	enc.AddTag("path", `C:\temp\`)
+	enc.AddTag("empty", "")
+	enc.AddField("a=b", 1.5)
+	enc.AddField("count", int64(3))
+	enc.AddField("free", uint64(4))
+	enc.AddField("ok", true)
+	enc.AddField("msg", `say "hi" \o/`)
+	assert.NoError(t, enc.EndLine(10))
+
+	enc.StartLine("#comment")
+	enc.AddField("value", 1)
+	assert.NoError(t, enc.EndLine(0))
+
+	assert.Equal(t, `cpu\ load,host=server\ 1,path="C:\\temp\\" a\=b=1.5,count=3i,free=4u,ok=true,msg="say \"hi\" \\o/" 10`+"\n"+
+		`"#comment" value=1i`+"\n", buf.String())
+
+	batch := ParseBatch(strings.NewReader(buf.String()), Limits{})
+	assert.True(t, batch.Next())
+	lp, err := batch.Point()
+	assert.NoError(t, err)
+	assert.Equal(t, "cpu load", lp.Measurement)
+	assert.Equal(t, map[string]string{"host": "server 1", "path": `C:\temp\`}, lp.Tags)
+	assert.Equal(t, `"say \"hi\" \\o/"`, lp.Fields["msg"])
+	assert.True(t, batch.Next())
+	lp, err = batch.Point()
+	assert.NoError(t, err)
+	assert.Equal(t, "#comment", lp.Measurement)
+	assert.False(t, batch.Next())
+
+	// Invalid lines are dropped and the encoder moves on
+	var mem Encoder
+	for _, build := range []func(){
+		func() { mem.StartLine("") },
+		func() { mem.StartLine("cpu") },
+		func() { mem.StartLine("cpu"); mem.AddField("value", math.NaN()) },
+		func() { mem.StartLine("cpu"); mem.AddField(`key\`, 1) },
+		func() { mem.StartLine("cpu"); mem.AddField("value", "a\nb") },
+		func() { mem.StartLine("cpu"); mem.AddField("value", 1); mem.AddTag("host", "a") },
+		func() { mem.StartLine("cpu"); mem.AddField("value", []int{1}) },
+	} {
+		build()
+		assert.Error(t, mem.EndLine(0))
+	}
+	mem.StartLine("cpu")
+	mem.AddField("value", 1.0)
+	assert.NoError(t, mem.EndLine(0))
+	mem.StartLine("cpu")
+	mem.AddField("value", 2.0)
+	assert.NoError(t, mem.EndLineAt(0))
+	assert.Equal(t, "cpu value=1\ncpu value=2 0\n", string(mem.Bytes()))
+	mem.Reset()
+	assert.Empty(t, mem.Bytes())
+
+	// Writer errors stop the encoder
+	enc = NewEncoder(failingWriter{})
+	enc.StartLine("cpu")
+	enc.AddField("value", 1.0)
+	assert.Error(t, enc.EndLine(0))
+	enc.StartLine("cpu")
+	enc.AddField("value", 1.0)
+	assert.Error(t, enc.EndLine(0))
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
 func TestNewLineProtocol(t *testing.T) {
 	proto := New("cpu")
 	assert.NotNil(t, proto)
@@ -151,3 +511,157 @@ func TestNewLineProtocol(t *testing.T) {
 	assert.Nil(t, proto.Fields)
 	assert.Equal(t, int64(0), proto.Timestamp)
 }
+
+func TestParseBatch(t *testing.T) {
+	body := "cpu value=1\n\n# comment\r\n  mem value=2  \r\ndisk"
+	batch := ParseBatch(strings.NewReader(body), Limits{})
+	var lines []int
+	var texts []string
+	for batch.Next() {
+		lines = append(lines, batch.Line())
+		texts = append(texts, batch.Text())
+	}
+	assert.NoError(t, batch.Err())
+	assert.Equal(t, []int{1, 4, 5}, lines)
+	assert.Equal(t, []string{"cpu value=1", "mem value=2", "disk"}, texts)
+
+	batch = ParseBatch(strings.NewReader("cpu,host=a value=1 10"), Limits{})
+	assert.True(t, batch.Next())
+	lp, err := batch.Point()
+	assert.NoError(t, err)
+	assert.Equal(t, "a", lp.Tags["host"])
+	assert.False(t, batch.Next())
+}
+
+func TestParseBatchLimits(t *testing.T) {
+	body := "cpu value=1\n# comment\ncpu value=2\ncpu value=3\n"
+
+	// Comments do not count as lines
+	batch := ParseBatch(strings.NewReader(body), Limits{MaxLines: 2})
+	n := 0
+	for batch.Next() {
+		n++
+	}
+	assert.Equal(t, 2, n)
+	assert.ErrorIs(t, batch.Err(), ErrTooManyLines)
+
+	batch = ParseBatch(strings.NewReader(body), Limits{MaxLines: 3, MaxBytes: int64(len(body))})
+	for batch.Next() {
+	}
+	assert.NoError(t, batch.Err())
+
+	batch = ParseBatch(strings.NewReader(body), Limits{MaxBytes: int64(len(body)) - 1})
+	for batch.Next() {
+	}
+	assert.ErrorIs(t, batch.Err(), ErrBatchTooLarge)
+
+	// Lines longer than a batch can buffer
+	batch = ParseBatch(strings.NewReader("cpu value=\""+strings.Repeat("x", maxLineSize)+"\""), Limits{})
+	assert.False(t, batch.Next())
+	assert.ErrorIs(t, batch.Err(), ErrBatchTooLarge)
+}
+
+func TestTokenizer(t *testing.T) {
+	var tok Tokenizer
+	assert.NoError(t, tok.Parse([]byte(`my\ cpu,host=us\ west,region="eu 1",host=b usage\ user=1.5,count=2i,ok=t,msg="a \"b\"",count=3i 10`)))
+	assert.Equal(t, "my cpu", string(tok.Measurement()))
+	assert.Len(t, tok.Tags(), 2)
+	assert.Equal(t, "host", string(tok.Tags()[0].Key))
+	assert.Equal(t, "b", string(tok.Tags()[0].Value))
+	assert.Equal(t, "region", string(tok.Tags()[1].Key))
+	assert.Equal(t, "eu 1", string(tok.Tags()[1].Value))
+
+	var keys, values []string
+	var floats []float64
+	for i, f := range tok.Fields() {
+		keys = append(keys, string(f.Key))
+		values = append(values, string(f.Value))
+		floats = append(floats, tok.Float(i))
+	}
+	assert.Equal(t, []string{"usage user", "count", "ok", "msg"}, keys)
+	assert.Equal(t, []string{"1.5", "3i", "t", `"a \"b\""`}, values)
+	assert.Equal(t, []float64{1.5, 3, 1, 1}, floats)
+	assert.Equal(t, int64(10), tok.Timestamp())
+
+	// State is reset from one line to the next
+	assert.NoError(t, tok.Parse([]byte("mem free=1")))
+	assert.Equal(t, "mem", string(tok.Measurement()))
+	assert.Empty(t, tok.Tags())
+	assert.Len(t, tok.Fields(), 1)
+	assert.Zero(t, tok.Timestamp())
+
+	assert.Error(t, tok.Parse([]byte("cpu value=abc")))
+	assert.Error(t, tok.Parse(nil))
+}
+
+func TestTokenizerAllocations(t *testing.T) {
+	line := []byte(`cpu,host=server\ 1,region=us-west usage_user=42.5,usage_system=3i,idle=true,note="ok" 1465839830100400200`)
+	var tok Tokenizer
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := tok.Parse(line); err != nil {
+			t.Fatal(err)
+		}
+	})
+	assert.Zero(t, allocs)
+}
+
+// benchmarkLines is a batch of points shaped like the output of a metrics
+// agent
+var benchmarkLines = func() []byte {
+	var sb strings.Builder
+	for i := 0; i < 1000; i++ {
+		sb.WriteString(`cpu,host=server-`)
+		sb.WriteString(strconv.Itoa(i % 10))
+		sb.WriteString(`,region=us-west,cpu=cpu-total usage_user=42.5,usage_system=3.25,usage_idle=54.25,usage_iowait=0i,guest=false 1465839830`)
+		sb.WriteString(strconv.Itoa(100400200 + i))
+		sb.WriteString("\n")
+	}
+	return []byte(sb.String())
+}()
+
+func BenchmarkParse(b *testing.B) {
+	lines := strings.Split(strings.TrimSpace(string(benchmarkLines)), "\n")
+	b.SetBytes(int64(len(benchmarkLines)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, line := range lines {
+			if _, err := Parse(line); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkTokenizer(b *testing.B) {
+	lines := bytes.Split(bytes.TrimSpace(benchmarkLines), []byte("\n"))
+	var tok Tokenizer
+	b.SetBytes(int64(len(benchmarkLines)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, line := range lines {
+			if err := tok.Parse(line); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkBatchTokenize(b *testing.B) {
+	var tok Tokenizer
+	b.SetBytes(int64(len(benchmarkLines)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		batch := ParseBatch(bytes.NewReader(benchmarkLines), Limits{})
+		for batch.Next() {
+			if err := batch.Tokenize(&tok); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := batch.Err(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
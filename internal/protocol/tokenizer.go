@@ -0,0 +1,502 @@
+package protocol
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Mode selects how strictly lines are checked
+type Mode int
+
+const (
+	// ModeDefault accepts what InfluxDB accepts, and a few forms older
+	// refluxdb clients send
+	ModeDefault Mode = iota
+	// ModeStrict also enforces the InfluxDB naming rules: tags are not
+	// repeated, names and string values are valid UTF-8 and measurements
+	// do not start with an underscore, which is reserved for internal
+	// measurements
+	ModeStrict
+	// ModeLenient salvages what it can of a malformed line, dropping the
+	// invalid tags, fields or timestamp and reporting each of them as a
+	// warning. A line left without a measurement or fields is still an
+	// error.
+	ModeLenient
+)
+
+// LookupMode returns the mode called name: "default", "strict" or
+// "lenient". An empty name is the default mode.
+func LookupMode(name string) (Mode, error) {
+	switch name {
+	case "", "default":
+		return ModeDefault, nil
+	case "strict":
+		return ModeStrict, nil
+	case "lenient":
+		return ModeLenient, nil
+	}
+	return ModeDefault, fmt.Errorf("unknown parse mode %q", name)
+}
+
+// String returns the name of the mode
+func (m Mode) String() string {
+	switch m {
+	case ModeStrict:
+		return "strict"
+	case ModeLenient:
+		return "lenient"
+	}
+	return "default"
+}
+
+// Pair is a tag or a field of a line read by a Tokenizer
+type Pair struct {
+	Key   []byte
+	Value []byte
+}
+
+// Tokenizer parses line protocol lines held in byte slices without
+// allocating: the measurement, tags and fields it returns are slices of a
+// buffer reused from one line to the next, so they are only valid until
+// the following call to Parse. Copy what must be kept.
+//
+// A Tokenizer follows the same rules as Parse, which is built on it:
+//
+//	var t protocol.Tokenizer
+//	for batch.Next() {
+//		if err := batch.Tokenize(&t); err != nil {
+//			...
+//		}
+//		for i, f := range t.Fields() {
+//			store(t.Measurement(), t.Tags(), f.Key, t.Float(i), t.Timestamp())
+//		}
+//	}
+//
+// The zero value is ready to use and parses in ModeDefault. A Tokenizer
+// must not be used by several goroutines at once.
+type Tokenizer struct {
+	// Mode selects how strictly lines are checked
+	Mode Mode
+
+	// buf holds the unescaped measurement, keys and values of the line
+	buf         []byte
+	measurement []byte
+	tags        []Pair
+	fields      []Pair
+	floats      []float64
+	timestamp   int64
+	warnings    []string
+}
+
+// Measurement returns the measurement of the last line parsed
+func (t *Tokenizer) Measurement() []byte {
+	return t.measurement
+}
+
+// Tags returns the tags of the last line parsed, in the order they first
+// appear. A tag repeated on the line keeps its last value.
+func (t *Tokenizer) Tags() []Pair {
+	return t.tags
+}
+
+// Fields returns the fields of the last line parsed, in the order they
+// first appear. A field repeated on the line keeps its last value. Values
+// are raw: string values keep their quotes and escapes.
+func (t *Tokenizer) Fields() []Pair {
+	return t.fields
+}
+
+// Float returns the value of the i-th field decoded as a float64, the way
+// LineProtocol.FloatFields decodes it
+func (t *Tokenizer) Float(i int) float64 {
+	return t.floats[i]
+}
+
+// Timestamp returns the timestamp of the last line parsed, or 0 when the
+// line has none
+func (t *Tokenizer) Timestamp() int64 {
+	return t.timestamp
+}
+
+// Warnings returns what was dropped from the last line parsed in
+// ModeLenient
+func (t *Tokenizer) Warnings() []string {
+	return t.warnings
+}
+
+// Parse reads a single line. On error, the measurement, tags and fields
+// are left incomplete.
+func (t *Tokenizer) Parse(line []byte) error {
+	if err := t.parse(line); err != nil {
+		return err
+	}
+	if t.Mode == ModeStrict {
+		return t.checkStrict()
+	}
+	return nil
+}
+
+func (t *Tokenizer) parse(line []byte) error {
+	t.buf = t.buf[:0]
+	t.measurement = nil
+	t.tags = t.tags[:0]
+	t.fields = t.fields[:0]
+	t.floats = t.floats[:0]
+	t.timestamp = 0
+	t.warnings = t.warnings[:0]
+
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return fmt.Errorf("invalid line protocol format")
+	}
+
+	var (
+		state = stateMeasurement
+		// start is the offset in buf of the token being read
+		start int
+		key   []byte
+		i     int
+	)
+
+	if line[0] == '"' {
+		end, err := scanString(line, 0)
+		if err != nil {
+			return fmt.Errorf("unterminated quoted measurement")
+		}
+		if end < len(line) && line[end] != ',' && line[end] != ' ' {
+			return fmt.Errorf("invalid character after quoted measurement")
+		}
+		t.buf = appendUnescaped(t.buf, line[1:end-1])
+		i = end
+	}
+
+	for i < len(line) {
+		ch := line[i]
+
+		switch state {
+		case stateMeasurement:
+			switch {
+			case ch == '\\' && i+1 < len(line) && isEscapable(line[i+1], ", "):
+				t.buf = append(t.buf, line[i+1])
+				i++
+			case ch == ',' || ch == ' ':
+				if len(t.buf) == start {
+					return fmt.Errorf("empty measurement")
+				}
+				t.measurement, start = t.token(start)
+				if ch == ' ' {
+					i = skipSpaces(line, i)
+					state = stateFieldKey
+					continue
+				}
+				state = stateTagKey
+			default:
+				t.buf = append(t.buf, ch)
+			}
+
+		case stateTagKey:
+			switch {
+			case ch == '\\' && i+1 < len(line) && isEscapable(line[i+1], ",= "):
+				t.buf = append(t.buf, line[i+1])
+				i++
+			case ch == '=':
+				if len(t.buf) == start {
+					return fmt.Errorf("empty tag key")
+				}
+				key, start = t.token(start)
+				state = stateTagValue
+				if i+1 < len(line) && line[i+1] == '"' {
+					end, err := scanString(line, i+1)
+					if err != nil {
+						return fmt.Errorf("unterminated quoted tag value for %s", key)
+					}
+					t.buf = appendUnescaped(t.buf, line[i+2:end-1])
+					i = end
+					continue
+				}
+			case ch == ',' || ch == ' ':
+				return fmt.Errorf("invalid tag format: %s", t.buf[start:])
+			default:
+				t.buf = append(t.buf, ch)
+			}
+
+		case stateTagValue:
+			switch {
+			case ch == '\\' && i+1 < len(line) && isEscapable(line[i+1], ",= "):
+				t.buf = append(t.buf, line[i+1])
+				i++
+			case ch == ',' || ch == ' ':
+				var value []byte
+				switch {
+				case len(t.buf) > start:
+					value, start = t.token(start)
+					if err := t.addTag(key, value); err != nil {
+						return err
+					}
+				case t.Mode == ModeLenient:
+					t.warn("dropped tag %s without a value", key)
+				default:
+					return fmt.Errorf("empty tag value")
+				}
+				if ch == ' ' {
+					i = skipSpaces(line, i)
+					state = stateFieldKey
+					continue
+				}
+				state = stateTagKey
+			case ch == '=':
+				if t.Mode != ModeLenient {
+					return fmt.Errorf("invalid tag format: unescaped '=' in value of %s", key)
+				}
+				t.warn("kept unescaped '=' in value of tag %s", key)
+				t.buf = append(t.buf, ch)
+			default:
+				t.buf = append(t.buf, ch)
+			}
+
+		case stateFieldKey:
+			switch {
+			case ch == '\\' && i+1 < len(line) && isEscapable(line[i+1], ",= "):
+				t.buf = append(t.buf, line[i+1])
+				i++
+			case ch == '=':
+				if len(t.buf) == start {
+					return fmt.Errorf("empty field key")
+				}
+				key, start = t.token(start)
+				state = stateFieldValue
+				if i+1 < len(line) && line[i+1] == '"' {
+					end, err := scanString(line, i+1)
+					if err != nil {
+						return fmt.Errorf("unterminated string field value for %s", key)
+					}
+					t.buf = append(t.buf, line[i+1:end]...)
+					i = end
+					continue
+				}
+			case ch == ',' || ch == ' ':
+				return fmt.Errorf("invalid field format: %s", t.buf[start:])
+			default:
+				t.buf = append(t.buf, ch)
+			}
+
+		case stateFieldValue:
+			switch ch {
+			case ',', ' ':
+				var value []byte
+				value, start = t.token(start)
+				if err := t.addField(key, value); err != nil {
+					return err
+				}
+				if ch == ' ' {
+					i = skipSpaces(line, i)
+					state = stateTimestamp
+					continue
+				}
+				state = stateFieldKey
+			default:
+				t.buf = append(t.buf, ch)
+			}
+
+		case stateTimestamp:
+			if ch == ' ' {
+				if t.Mode != ModeLenient {
+					return fmt.Errorf("invalid timestamp: %s", line[i-(len(t.buf)-start):])
+				}
+				t.warn("dropped trailing data %q", bytes.TrimSpace(line[i:]))
+				i = len(line)
+				continue
+			}
+			t.buf = append(t.buf, ch)
+		}
+		i++
+	}
+
+	// Flush the token that was being read when the line ended
+	switch state {
+	case stateMeasurement:
+		return fmt.Errorf("invalid line protocol format")
+	case stateTagKey:
+		return fmt.Errorf("invalid tag format: %s", t.buf[start:])
+	case stateTagValue:
+		return fmt.Errorf("missing fields")
+	case stateFieldKey:
+		if len(t.buf) == start && len(t.fields) == 0 {
+			return fmt.Errorf("missing fields")
+		}
+		return fmt.Errorf("invalid field format: %s", t.buf[start:])
+	case stateFieldValue:
+		value, _ := t.token(start)
+		if err := t.addField(key, value); err != nil {
+			return err
+		}
+	case stateTimestamp:
+		if len(t.buf) > start {
+			timestamp, err := strconv.ParseInt(string(t.buf[start:]), 10, 64)
+			switch {
+			case err == nil:
+				t.timestamp = timestamp
+			case t.Mode == ModeLenient:
+				t.warn("dropped invalid timestamp %s", t.buf[start:])
+			default:
+				return fmt.Errorf("invalid timestamp: %s", t.buf[start:])
+			}
+		}
+	}
+
+	// Invalid fields dropped in lenient mode may leave none
+	if len(t.fields) == 0 {
+		return fmt.Errorf("missing fields")
+	}
+	return nil
+}
+
+// checkStrict enforces the InfluxDB naming rules of ModeStrict
+func (t *Tokenizer) checkStrict() error {
+	if t.measurement[0] == '_' {
+		return fmt.Errorf("measurement %s starts with an underscore, which is reserved", t.measurement)
+	}
+	if !utf8.Valid(t.measurement) {
+		return fmt.Errorf("invalid UTF-8 in measurement %q", t.measurement)
+	}
+	for _, tag := range t.tags {
+		if !utf8.Valid(tag.Key) || !utf8.Valid(tag.Value) {
+			return fmt.Errorf("invalid UTF-8 in tag %q", tag.Key)
+		}
+	}
+	for _, field := range t.fields {
+		if !utf8.Valid(field.Key) || !utf8.Valid(field.Value) {
+			return fmt.Errorf("invalid UTF-8 in field %q", field.Key)
+		}
+	}
+	return nil
+}
+
+// warn records what lenient parsing dropped from the line
+func (t *Tokenizer) warn(format string, args ...interface{}) {
+	t.warnings = append(t.warnings, fmt.Sprintf(format, args...))
+}
+
+// token returns the token read into buf since start and the start of the
+// next one
+func (t *Tokenizer) token(start int) ([]byte, int) {
+	end := len(t.buf)
+	return t.buf[start:end:end], end
+}
+
+// addTag stores a tag. A repeated key is rejected in ModeStrict and
+// replaces the previous value otherwise.
+func (t *Tokenizer) addTag(key, value []byte) error {
+	for i := range t.tags {
+		if bytes.Equal(t.tags[i].Key, key) {
+			switch t.Mode {
+			case ModeStrict:
+				return fmt.Errorf("duplicate tag %s", key)
+			case ModeLenient:
+				t.warn("kept the last value of duplicate tag %s", key)
+			}
+			t.tags[i].Value = value
+			return nil
+		}
+	}
+	t.tags = append(t.tags, Pair{Key: key, Value: value})
+	return nil
+}
+
+// addField validates a raw field value and stores it, replacing the value
+// of a repeated key
+func (t *Tokenizer) addField(key, value []byte) error {
+	var (
+		f   float64
+		err error
+	)
+	if len(value) == 0 {
+		err = fmt.Errorf("missing field value for %s", key)
+	} else {
+		f, err = floatValue(value)
+	}
+	if err != nil {
+		if t.Mode == ModeLenient {
+			t.warn("dropped field %s: %v", key, err)
+			return nil
+		}
+		return err
+	}
+	for i := range t.fields {
+		if bytes.Equal(t.fields[i].Key, key) {
+			t.fields[i].Value, t.floats[i] = value, f
+			return nil
+		}
+	}
+	t.fields = append(t.fields, Pair{Key: key, Value: value})
+	t.floats = append(t.floats, f)
+	return nil
+}
+
+// lineProtocol copies the last line parsed into a LineProtocol
+func (t *Tokenizer) lineProtocol() *LineProtocol {
+	lp := New(string(t.measurement))
+	if len(t.tags) > 0 {
+		lp.Tags = make(map[string]string, len(t.tags))
+		for _, tag := range t.tags {
+			key := string(tag.Key)
+			lp.Tags[key] = string(tag.Value)
+			lp.tagOrder = append(lp.tagOrder, key)
+		}
+	}
+	lp.Fields = make(map[string]string, len(t.fields))
+	for _, field := range t.fields {
+		key := string(field.Key)
+		value := string(field.Value)
+		// Booleans are normalized so that serialized lines are stable
+		if b, ok := parseBool(value); ok {
+			value = strconv.FormatBool(b)
+		}
+		lp.Fields[key] = value
+		lp.fieldOrder = append(lp.fieldOrder, key)
+	}
+	lp.Timestamp = t.timestamp
+	return lp
+}
+
+// floatValue validates a raw field value and decodes it as a float64:
+// integers are converted, booleans become 1 or 0 and string values 1. The
+// errors are those of FieldValue.
+func floatValue(raw []byte) (float64, error) {
+	if raw[0] == '"' {
+		if len(raw) < 2 || raw[len(raw)-1] != '"' {
+			return 0, fmt.Errorf("invalid string field value: %s", raw)
+		}
+		return 1, nil
+	}
+
+	if b, ok := parseBool(string(raw)); ok {
+		if b {
+			return 1, nil
+		}
+		return 0, nil
+	}
+
+	switch raw[len(raw)-1] {
+	case 'i':
+		v, err := strconv.ParseInt(string(raw[:len(raw)-1]), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid integer field value: %s", raw)
+		}
+		return float64(v), nil
+	case 'u':
+		v, err := strconv.ParseUint(string(raw[:len(raw)-1]), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid unsigned field value: %s", raw)
+		}
+		return float64(v), nil
+	}
+
+	v, err := strconv.ParseFloat(string(raw), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid numeric field value: %s", raw)
+	}
+	return v, nil
+}
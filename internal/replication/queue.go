@@ -0,0 +1,365 @@
+package replication
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// recordHeaderSize is the length and CRC-32 preceding every record
+	recordHeaderSize = 8
+	// positionFile records the segment and offset of the next unread record
+	positionFile = "position"
+	segmentExt   = ".seg"
+)
+
+var (
+	// errQueueFull is returned by append when the record would make the
+	// queue exceed its maximum size
+	errQueueFull = errors.New("replication queue is full")
+	// errCorrupt is returned by peek when a record fails its checksum. The
+	// rest of its segment is skipped.
+	errCorrupt = errors.New("corrupt record in replication queue")
+)
+
+// queue is a durable FIFO of records stored in the segment files of a
+// directory. Writers append records to the newest segment; a single reader
+// consumes them in order and records its position after every record, so
+// delivery resumes where it stopped after a restart. Fully read segments
+// are deleted.
+type queue struct {
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	mu sync.Mutex
+	// segments holds the segment IDs, oldest first. The reader reads the
+	// first one and writers append to the last one.
+	segments []uint64
+	w        *os.File
+	wsize    int64
+	r        *os.File
+	rsize    int64
+	roff     int64
+	// size is the number of unread bytes, record headers included
+	size int64
+	// pending is the size of the record returned by the last peek
+	pending int64
+	// notify is signaled when a record is appended
+	notify chan struct{}
+}
+
+// openQueue opens the queue stored in dir, creating it if needed. A record
+// cut short by a crash at the end of the newest segment is discarded.
+func openQueue(dir string, maxSize, segmentSize int64) (*queue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory: %w", err)
+	}
+	q := &queue{dir: dir, maxSize: maxSize, segmentSize: segmentSize, notify: make(chan struct{}, 1)}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue directory: %w", err)
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, id)
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	// Segments before the recorded position were read before a crash
+	// prevented their removal
+	seg, off := q.readPosition()
+	for len(q.segments) > 0 && q.segments[0] < seg {
+		os.Remove(q.segmentPath(q.segments[0]))
+		q.segments = q.segments[1:]
+	}
+	if len(q.segments) == 0 || q.segments[0] != seg {
+		off = 0
+	}
+	if len(q.segments) == 0 {
+		q.segments = []uint64{seg + 1}
+	}
+
+	last := q.segments[len(q.segments)-1]
+	q.w, err = os.OpenFile(q.segmentPath(last), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open queue segment: %w", err)
+	}
+	if q.wsize, err = validEnd(q.w); err != nil {
+		q.w.Close()
+		return nil, err
+	}
+	if err := q.w.Truncate(q.wsize); err != nil {
+		q.w.Close()
+		return nil, fmt.Errorf("failed to truncate queue segment: %w", err)
+	}
+	if _, err := q.w.Seek(q.wsize, io.SeekStart); err != nil {
+		q.w.Close()
+		return nil, fmt.Errorf("failed to open queue segment: %w", err)
+	}
+
+	for _, id := range q.segments[:len(q.segments)-1] {
+		info, err := os.Stat(q.segmentPath(id))
+		if err != nil {
+			q.w.Close()
+			return nil, fmt.Errorf("failed to open queue segment: %w", err)
+		}
+		q.size += info.Size()
+	}
+	q.size += q.wsize
+	if len(q.segments) == 1 && off > q.wsize {
+		off = q.wsize
+	}
+	q.roff = off
+	q.size -= off
+	return q, nil
+}
+
+func (q *queue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// readPosition returns the recorded reader position, or the start of the
+// first segment
+func (q *queue) readPosition() (uint64, int64) {
+	data, err := os.ReadFile(filepath.Join(q.dir, positionFile))
+	if err == nil {
+		var seg uint64
+		var off int64
+		if _, err := fmt.Sscanf(string(data), "%d %d", &seg, &off); err == nil {
+			return seg, off
+		}
+	}
+	if len(q.segments) > 0 {
+		return q.segments[0], 0
+	}
+	return 0, 0
+}
+
+// savePosition records the reader position, replacing the file so it is
+// never seen half written
+func (q *queue) savePosition() error {
+	path := filepath.Join(q.dir, positionFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", q.segments[0], q.roff)), 0644); err != nil {
+		return fmt.Errorf("failed to save queue position: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to save queue position: %w", err)
+	}
+	return nil
+}
+
+// validEnd returns the offset following the last complete record of a
+// segment
+func validEnd(f *os.File) (int64, error) {
+	var off int64
+	for {
+		n, err := readRecord(f, off, nil)
+		if errors.Is(err, io.EOF) || errors.Is(err, errCorrupt) {
+			return off, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read queue segment: %w", err)
+		}
+		off += n
+	}
+}
+
+// readRecord reads the record at off, returning its size and, when data
+// is not nil, appending its payload to *data. io.EOF means there is no
+// complete record at off.
+func readRecord(f *os.File, off int64, data *[]byte) (int64, error) {
+	var header [recordHeaderSize]byte
+	if _, err := f.ReadAt(header[:], off); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	payload := make([]byte, length)
+	if _, err := f.ReadAt(payload, off+recordHeaderSize); err != nil {
+		if errors.Is(err, io.EOF) {
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+		return 0, errCorrupt
+	}
+	if data != nil {
+		*data = payload
+	}
+	return recordHeaderSize + int64(length), nil
+}
+
+// append adds a record to the queue. The record reaches the operating
+// system before append returns, so it survives the process crashing.
+func (q *queue) append(payload []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.w == nil {
+		return os.ErrClosed
+	}
+
+	n := recordHeaderSize + int64(len(payload))
+	if q.size+n > q.maxSize {
+		return errQueueFull
+	}
+	if q.wsize > 0 && q.wsize+n > q.segmentSize {
+		if err := q.rotate(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, recordHeaderSize, n)
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+	buf = append(buf, payload...)
+	if _, err := q.w.Write(buf); err != nil {
+		// Drop the partial record so the segment stays readable
+		q.w.Truncate(q.wsize)
+		q.w.Seek(q.wsize, io.SeekStart)
+		return fmt.Errorf("failed to append to replication queue: %w", err)
+	}
+	q.wsize += n
+	q.size += n
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// rotate starts a new segment for writers
+func (q *queue) rotate() error {
+	id := q.segments[len(q.segments)-1] + 1
+	w, err := os.OpenFile(q.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create queue segment: %w", err)
+	}
+	// The reader still needs the size of the segment it may be reading
+	if q.r != nil && q.segments[0] == q.segments[len(q.segments)-1] {
+		q.rsize = q.wsize
+	}
+	q.w.Close()
+	q.w, q.wsize = w, 0
+	q.segments = append(q.segments, id)
+	return nil
+}
+
+// peek returns the oldest unread record without consuming it, or false
+// when the queue is empty
+func (q *queue) peek() ([]byte, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.w == nil {
+		return nil, false, os.ErrClosed
+	}
+
+	for {
+		tail := len(q.segments) == 1
+		if q.r == nil {
+			r, err := os.Open(q.segmentPath(q.segments[0]))
+			if err != nil {
+				return nil, false, fmt.Errorf("failed to open queue segment: %w", err)
+			}
+			q.r = r
+			if !tail {
+				info, err := r.Stat()
+				if err != nil {
+					return nil, false, fmt.Errorf("failed to open queue segment: %w", err)
+				}
+				q.rsize = info.Size()
+			}
+		}
+		end := q.rsize
+		if tail {
+			end = q.wsize
+		}
+
+		if q.roff >= end {
+			if tail {
+				return nil, false, nil
+			}
+			// Move on to the next segment
+			q.r.Close()
+			q.r = nil
+			os.Remove(q.segmentPath(q.segments[0]))
+			q.segments = q.segments[1:]
+			q.roff = 0
+			if err := q.savePosition(); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+
+		var payload []byte
+		n, err := readRecord(q.r, q.roff, &payload)
+		if err == nil {
+			q.pending = n
+			return payload, true, nil
+		}
+		if errors.Is(err, errCorrupt) || errors.Is(err, io.EOF) {
+			q.size -= end - q.roff
+			q.roff = end
+			return nil, false, errCorrupt
+		}
+		return nil, false, fmt.Errorf("failed to read replication queue: %w", err)
+	}
+}
+
+// advance consumes the record returned by the last peek
+func (q *queue) advance() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending == 0 {
+		return nil
+	}
+	q.roff += q.pending
+	q.size -= q.pending
+	q.pending = 0
+	return q.savePosition()
+}
+
+// bytes returns the number of unread bytes
+func (q *queue) bytes() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// close closes the segment files. The queue cannot be used afterwards.
+func (q *queue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.r != nil {
+		q.r.Close()
+		q.r = nil
+	}
+	if q.w == nil {
+		return nil
+	}
+	err := q.w.Close()
+	q.w = nil
+	return err
+}
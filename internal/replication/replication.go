@@ -0,0 +1,413 @@
+// Package replication mirrors the points written to refluxdb to the v2
+// write API of another refluxdb or InfluxDB instance. Written batches are
+// appended to a durable on-disk queue per target and delivered in the
+// background, retrying with exponential backoff, so the remote can be down
+// or slow without losing or delaying writes.
+package replication
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/export"
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	pointsSent    = metrics.NewCounterVec("refluxdb_replication_points_sent_total", "Points delivered to replication targets", "replication")
+	writeErrors   = metrics.NewCounterVec("refluxdb_replication_write_errors_total", "Writes to replication targets that failed", "replication")
+	pointsDropped = metrics.NewCounterVec("refluxdb_replication_points_dropped_total", "Points not replicated because the queue was full or the target rejected them", "replication")
+	queueBytes    = metrics.NewGaugeVec("refluxdb_replication_queue_bytes", "Bytes waiting in the replication queue", "replication")
+)
+
+const (
+	// DefaultMaxQueueSize is the disk space used by the queue of a target
+	// before new points are dropped
+	DefaultMaxQueueSize = 1 << 30
+	// DefaultWriteTimeout bounds every write to a target
+	DefaultWriteTimeout = 30 * time.Second
+	// DefaultInitialBackoff is the wait before the first retry of a failed
+	// write, doubled for every further retry
+	DefaultInitialBackoff = time.Second
+	// DefaultMaxBackoff caps the wait between retries
+	DefaultMaxBackoff = 5 * time.Minute
+	// segmentSize is the size at which queue segments are rotated
+	segmentSize = 16 << 20
+)
+
+// Target is a remote v2 write API receiving the points of some databases
+type Target struct {
+	// Name identifies the target in logs and metrics
+	Name string
+	// URL is the base URL of the remote server, such as
+	// http://influxdb:8086
+	URL string
+	// Org and Token authenticate the writes
+	Org   string
+	Token string
+	// Bucket receives the points. Empty writes every database to the
+	// bucket of the same name.
+	Bucket string
+	// Databases lists the replicated databases. Empty replicates all.
+	Databases []string
+	// QueueDir stores the queue of the target
+	QueueDir string
+	// MaxQueueSize is the disk space of the queue in bytes
+	MaxQueueSize int64
+}
+
+// Options configures a Service
+type Options struct {
+	// WriteTimeout bounds every write to a target
+	WriteTimeout time.Duration
+	// InitialBackoff and MaxBackoff bound the wait between retries
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Logger receives delivery errors. The standard logrus logger is used
+	// when nil.
+	Logger *logrus.Logger
+}
+
+// Validate checks the replication targets
+func Validate(targets []Target) error {
+	names := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		if t.Name == "" {
+			return fmt.Errorf("replication name is required")
+		}
+		if names[t.Name] {
+			return fmt.Errorf("duplicate replication %q", t.Name)
+		}
+		names[t.Name] = true
+		u, err := url.Parse(t.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("replication %s: invalid url %q: expected an http or https URL", t.Name, t.URL)
+		}
+		if t.Org == "" {
+			return fmt.Errorf("replication %s: org is required", t.Name)
+		}
+		if t.QueueDir == "" {
+			return fmt.Errorf("replication %s: queue directory is required", t.Name)
+		}
+		if t.MaxQueueSize < 0 {
+			return fmt.Errorf("replication %s: max queue size must not be negative", t.Name)
+		}
+	}
+	return nil
+}
+
+// Service replicates the written points to its targets
+type Service struct {
+	db      *persistence.Manager
+	opts    Options
+	log     *logrus.Logger
+	client  *http.Client
+	targets []*target
+
+	// mu guards running. observe holds it for reading while queueing.
+	mu       sync.RWMutex
+	running  bool
+	register sync.Once
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// New opens the queues of the targets, which keep the points not yet
+// delivered when the server stopped
+func New(db *persistence.Manager, targets []Target, opts Options) (*Service, error) {
+	if err := Validate(targets); err != nil {
+		return nil, err
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = DefaultWriteTimeout
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = DefaultInitialBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = DefaultMaxBackoff
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+
+	s := &Service{
+		db:     db,
+		opts:   opts,
+		log:    logger,
+		client: &http.Client{Timeout: opts.WriteTimeout},
+	}
+	for _, cfg := range targets {
+		if cfg.MaxQueueSize == 0 {
+			cfg.MaxQueueSize = DefaultMaxQueueSize
+		}
+		q, err := openQueue(filepath.Clean(cfg.QueueDir), cfg.MaxQueueSize, segmentSize)
+		if err != nil {
+			s.closeQueues()
+			return nil, fmt.Errorf("replication %s: %w", cfg.Name, err)
+		}
+		t := &target{config: cfg, queue: q}
+		if len(cfg.Databases) > 0 {
+			t.databases = make(map[string]bool, len(cfg.Databases))
+			for _, d := range cfg.Databases {
+				t.databases[d] = true
+			}
+		}
+		s.targets = append(s.targets, t)
+		queueBytes.With(cfg.Name).Set(float64(q.bytes()))
+	}
+	return s, nil
+}
+
+// Start starts queueing the written points and delivering the queues
+func (s *Service) Start() {
+	if len(s.targets) == 0 {
+		return
+	}
+	// Registered outside s.mu: writers call observe holding the storage
+	// lock, which OnWrite takes
+	s.register.Do(func() { s.db.OnWrite(s.observe) })
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return
+	}
+	s.running = true
+	var ctx context.Context
+	ctx, s.cancel = context.WithCancel(context.Background())
+	for _, t := range s.targets {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.deliver(ctx, t)
+		}()
+	}
+}
+
+// Stop stops replicating and closes the queues. Undelivered points stay
+// queued on disk for the next service opening the same queue directories.
+func (s *Service) Stop() {
+	s.mu.Lock()
+	s.running = false
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	s.closeQueues()
+}
+
+func (s *Service) closeQueues() {
+	for _, t := range s.targets {
+		if err := t.queue.close(); err != nil {
+			s.log.Errorf("Failed to close replication queue %s: %v", t.config.Name, err)
+		}
+	}
+}
+
+// observe appends a stored batch to the queues of the targets replicating
+// its databases. It runs while writers are held off, so points are dropped
+// rather than waiting when a queue is full.
+func (s *Service) observe(points []persistence.Point) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.running {
+		return
+	}
+
+	byDatabase := make(map[string][]persistence.Point)
+	for _, p := range points {
+		database := p.Database
+		if database == "" {
+			database = persistence.DefaultDatabase
+		}
+		byDatabase[database] = append(byDatabase[database], p)
+	}
+
+	// Records are shared by the targets replicating the same database
+	records := make(map[string][]byte, len(byDatabase))
+	for database, points := range byDatabase {
+		records[database] = encode(database, points)
+	}
+	for _, t := range s.targets {
+		for database, record := range records {
+			if t.databases != nil && !t.databases[database] {
+				continue
+			}
+			if err := t.queue.append(record); err != nil {
+				pointsDropped.With(t.config.Name).Add(uint64(len(byDatabase[database])))
+				s.log.Errorf("Replication %s dropped %d points: %v", t.config.Name, len(byDatabase[database]), err)
+				continue
+			}
+			queueBytes.With(t.config.Name).Set(float64(t.queue.bytes()))
+		}
+	}
+}
+
+// encode renders a queue record: the database name on the first line,
+// followed by the points as line protocol. Points that cannot be written
+// as line protocol are left out.
+func encode(database string, points []persistence.Point) []byte {
+	var enc protocol.Encoder
+	for _, p := range points {
+		export.EncodePoint(&enc, p)
+	}
+	return append(append([]byte(database), '\n'), enc.Bytes()...)
+}
+
+// decode splits a queue record into its database and line protocol
+func decode(record []byte) (string, []byte) {
+	i := bytes.IndexByte(record, '\n')
+	if i < 0 {
+		return string(record), nil
+	}
+	return string(record[:i]), record[i+1:]
+}
+
+// target is a replication target with its queue
+type target struct {
+	config    Target
+	databases map[string]bool
+	queue     *queue
+}
+
+// deliver sends the queued records of a target in order until ctx is
+// done. A failed write is retried, waiting longer after every failure,
+// so later records are never delivered before it.
+func (s *Service) deliver(ctx context.Context, t *target) {
+	name := t.config.Name
+	backoff := s.opts.InitialBackoff
+	for {
+		record, ok, err := t.queue.peek()
+		if errors.Is(err, errCorrupt) {
+			writeErrors.With(name).Inc()
+			s.log.Errorf("Replication %s skipped a damaged part of its queue", name)
+			continue
+		}
+		if err != nil {
+			s.log.Errorf("Replication %s failed to read its queue: %v", name, err)
+			if !sleep(ctx, backoff) {
+				return
+			}
+			continue
+		}
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.queue.notify:
+			}
+			continue
+		}
+
+		database, lines := decode(record)
+		points := bytes.Count(lines, []byte{'\n'})
+		retryAfter, err := s.write(ctx, t, database, lines)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			writeErrors.With(name).Inc()
+			var rejected rejectedError
+			if !errors.As(err, &rejected) {
+				wait := backoff
+				if retryAfter > wait {
+					wait = retryAfter
+				}
+				s.log.Warnf("Replication %s failed to write to %s, retrying in %s: %v", name, t.config.URL, wait, err)
+				if !sleep(ctx, wait) {
+					return
+				}
+				backoff = min(backoff*2, s.opts.MaxBackoff)
+				continue
+			}
+			// Retrying points the target refuses would block the queue
+			pointsDropped.With(name).Add(uint64(points))
+			s.log.Errorf("Replication %s dropped %d points rejected by %s: %v", name, points, t.config.URL, err)
+		} else {
+			pointsSent.With(name).Add(uint64(points))
+		}
+
+		backoff = s.opts.InitialBackoff
+		if err := t.queue.advance(); err != nil {
+			s.log.Errorf("Replication %s failed to update its queue: %v", name, err)
+		}
+		queueBytes.With(name).Set(float64(t.queue.bytes()))
+	}
+}
+
+// rejectedError is a write refused because of its content, which fails
+// again when retried
+type rejectedError struct {
+	status string
+}
+
+func (e rejectedError) Error() string {
+	return "points rejected with status " + e.status
+}
+
+// write sends line protocol to the v2 write API of a target. It returns
+// the wait requested by a Retry-After header along with errors.
+func (s *Service) write(ctx context.Context, t *target, database string, lines []byte) (time.Duration, error) {
+	bucket := t.config.Bucket
+	if bucket == "" {
+		bucket = database
+	}
+	u := strings.TrimSuffix(t.config.URL, "/") + "/api/v2/write?" + url.Values{
+		"org":       {t.config.Org},
+		"bucket":    {bucket},
+		"precision": {"ns"},
+	}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(lines))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if t.config.Token != "" {
+		req.Header.Set("Authorization", "Token "+t.config.Token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode/100 == 2:
+		return 0, nil
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusRequestEntityTooLarge ||
+		resp.StatusCode == http.StatusUnprocessableEntity:
+		return 0, rejectedError{status: resp.Status}
+	}
+	var retryAfter time.Duration
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		retryAfter = time.Duration(secs) * time.Second
+	}
+	return retryAfter, fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+// sleep waits for d, returning false when ctx is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
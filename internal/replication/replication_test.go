@@ -0,0 +1,200 @@
+package replication
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openQueue(dir, 1<<20, 64)
+	assert.NoError(t, err)
+
+	_, ok, err := q.peek()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Records larger than what is left of a segment start a new one
+	for _, r := range []string{"first record", "second record", "third record", "fourth record"} {
+		assert.NoError(t, q.append([]byte(r)))
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	assert.Len(t, segments, 2)
+
+	record, ok, err := q.peek()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "first record", string(record))
+	// peek does not consume
+	record, _, _ = q.peek()
+	assert.Equal(t, "first record", string(record))
+	assert.NoError(t, q.advance())
+	record, _, _ = q.peek()
+	assert.Equal(t, "second record", string(record))
+	assert.NoError(t, q.advance())
+	assert.NoError(t, q.close())
+
+	// Reopening resumes after the consumed records, and a record cut short
+	// by a crash is discarded
+	f, err := os.OpenFile(segments[1], os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	f.Write([]byte{0, 0, 0, 10, 1, 2})
+	f.Close()
+
+	q, err = openQueue(dir, 1<<20, 64)
+	assert.NoError(t, err)
+	defer q.close()
+	var got []string
+	for {
+		record, ok, err := q.peek()
+		assert.NoError(t, err)
+		if !ok {
+			break
+		}
+		got = append(got, string(record))
+		assert.NoError(t, q.advance())
+	}
+	assert.Equal(t, []string{"third record", "fourth record"}, got)
+	assert.Equal(t, int64(0), q.bytes())
+
+	// Read segments are deleted
+	segments, _ = filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	assert.Len(t, segments, 1)
+
+	assert.NoError(t, q.append([]byte("after the restart")))
+	record, _, _ = q.peek()
+	assert.Equal(t, "after the restart", string(record))
+}
+
+func TestQueueFull(t *testing.T) {
+	q, err := openQueue(t.TempDir(), 40, 1<<20)
+	assert.NoError(t, err)
+	defer q.close()
+
+	assert.NoError(t, q.append(make([]byte, 20)))
+	assert.ErrorIs(t, q.append(make([]byte, 20)), errQueueFull)
+	q.peek()
+	q.advance()
+	assert.NoError(t, q.append(make([]byte, 20)))
+}
+
+func TestValidate(t *testing.T) {
+	target := Target{Name: "cloud", URL: "https://influx.example.com", Org: "acme", QueueDir: "queue"}
+	assert.NoError(t, Validate([]Target{target}))
+	assert.Error(t, Validate([]Target{target, target}))
+
+	for _, tc := range []struct {
+		name   string
+		modify func(*Target)
+	}{
+		{"name", func(t *Target) { t.Name = "" }},
+		{"url", func(t *Target) { t.URL = "udp://influx:8089" }},
+		{"org", func(t *Target) { t.Org = "" }},
+		{"queue", func(t *Target) { t.QueueDir = "" }},
+	} {
+		tg := target
+		tc.modify(&tg)
+		assert.Error(t, Validate([]Target{tg}), tc.name)
+	}
+}
+
+// remote records the writes it accepts and answers with the queued
+// statuses first
+type remote struct {
+	mu       sync.Mutex
+	statuses []int
+	writes   []string
+	queries  []string
+	tokens   []string
+}
+
+func (r *remote) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		w.WriteHeader(status)
+		return
+	}
+	r.writes = append(r.writes, string(body))
+	r.queries = append(r.queries, req.URL.RawQuery)
+	r.tokens = append(r.tokens, req.Header.Get("Authorization"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *remote) received() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.writes...)
+}
+
+func TestReplicate(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	rem := &remote{statuses: []int{http.StatusServiceUnavailable, http.StatusBadRequest}}
+	ts := httptest.NewServer(rem)
+	defer ts.Close()
+
+	svc, err := New(db, []Target{{Name: "cloud", URL: ts.URL, Org: "acme", Token: "secret", Databases: []string{"metrics"}, QueueDir: t.TempDir()}},
+		Options{InitialBackoff: time.Millisecond})
+	assert.NoError(t, err)
+	svc.Start()
+	defer svc.Stop()
+
+	ts0 := time.Unix(0, 1000)
+	assert.NoError(t, db.SaveBatch([]persistence.Point{{Database: "metrics", Measurement: "cpu", Fields: map[string]float64{"value": 1}, Timestamp: ts0.UnixNano()}}))
+	assert.NoError(t, db.SaveBatch([]persistence.Point{{Database: "other", Measurement: "cpu", Fields: map[string]float64{"value": 2}, Timestamp: ts0.UnixNano()}}))
+	assert.NoError(t, db.SaveBatch([]persistence.Point{{Database: "metrics", Measurement: "mem", Fields: map[string]float64{"value": 3}, Timestamp: ts0.UnixNano()}}))
+
+	// The first batch is retried after the 503, the second one is dropped
+	// when rejected, and the database that is not replicated is skipped
+	assert.Eventually(t, func() bool { return len(rem.received()) == 1 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, []string{"mem value=3 1000\n"}, rem.received())
+	rem.mu.Lock()
+	assert.Equal(t, "bucket=metrics&org=acme&precision=ns", rem.queries[0])
+	assert.Equal(t, "Token secret", rem.tokens[0])
+	rem.mu.Unlock()
+}
+
+func TestReplicateAfterRestart(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	dir := t.TempDir()
+	targets := []Target{{Name: "cloud", URL: "http://127.0.0.1:1", Org: "acme", Bucket: "mirror", QueueDir: dir}}
+	svc, err := New(db, targets, Options{InitialBackoff: time.Hour})
+	assert.NoError(t, err)
+	svc.Start()
+	assert.NoError(t, db.SaveBatch([]persistence.Point{{Database: "metrics", Measurement: "cpu", Fields: map[string]float64{"value": 1}, Timestamp: 1000}}))
+	svc.Stop()
+
+	// Points queued while the remote was unreachable are sent once it is back
+	rem := &remote{}
+	ts := httptest.NewServer(rem)
+	defer ts.Close()
+	targets[0].URL = ts.URL
+	svc, err = New(db, targets, Options{})
+	assert.NoError(t, err)
+	svc.Start()
+	defer svc.Stop()
+
+	assert.Eventually(t, func() bool { return len(rem.received()) == 1 }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, "cpu value=1 1000\n", rem.received()[0])
+	rem.mu.Lock()
+	assert.Equal(t, "bucket=mirror&org=acme&precision=ns", rem.queries[0])
+	rem.mu.Unlock()
+}
@@ -0,0 +1,350 @@
+package result
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Media types understood by EncoderFor
+const (
+	MediaJSON = "application/json"
+	MediaCSV  = "application/csv"
+)
+
+// Encoder serializes a response into a specific wire format
+type Encoder interface {
+	// ContentType returns the media type written by the encoder
+	ContentType() string
+	// Encode writes the response to w
+	Encode(w io.Writer, resp *Response) error
+}
+
+// Options control how encoders render values
+type Options struct {
+	// Epoch is the unit used for JSON and MessagePack timestamps. Zero
+	// means nanoseconds.
+	Epoch time.Duration
+	// RFC3339 writes the JSON and MessagePack timestamps as RFC3339
+	// strings, ignoring Epoch
+	RFC3339 bool
+	// Pretty indents the JSON
+	Pretty bool
+}
+
+// EncoderFor returns the encoder matching an HTTP Accept header.
+// Media types are tried in the order they appear; JSON is the default.
+func EncoderFor(accept string, opts Options) Encoder {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		switch strings.ToLower(mediaType) {
+		case MediaCSV, "text/csv":
+			return CSVEncoder{}
+		case MediaMsgpack:
+			return MsgpackEncoder{Epoch: opts.Epoch, RFC3339: opts.RFC3339}
+		case MediaJSON, "*/*":
+			return JSONEncoder{Epoch: opts.Epoch, RFC3339: opts.RFC3339, Pretty: opts.Pretty}
+		}
+	}
+	return JSONEncoder{Epoch: opts.Epoch, RFC3339: opts.RFC3339, Pretty: opts.Pretty}
+}
+
+// JSONEncoder writes responses in the InfluxQL JSON format
+type JSONEncoder struct {
+	// Epoch is the unit used for time columns. Zero means nanoseconds.
+	Epoch time.Duration
+	// RFC3339 writes the time columns as RFC3339 strings, ignoring Epoch
+	RFC3339 bool
+	// Pretty indents the JSON with four spaces, as InfluxDB does
+	Pretty bool
+}
+
+// ContentType implements Encoder
+func (JSONEncoder) ContentType() string {
+	return MediaJSON
+}
+
+// Encode implements Encoder
+func (e JSONEncoder) Encode(w io.Writer, resp *Response) error {
+	enc := json.NewEncoder(w)
+	if e.Pretty {
+		enc.SetIndent("", "    ")
+	}
+	return enc.Encode(formatTimes(resp, e.Epoch, e.RFC3339))
+}
+
+// formatTimes returns resp with its time columns as RFC3339 strings, or in
+// the unit of epoch. resp is returned as is for nanoseconds.
+func formatTimes(resp *Response, epoch time.Duration, rfc3339 bool) *Response {
+	switch {
+	case rfc3339:
+		return convertTimes(resp, func(ts int64) interface{} {
+			return time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
+		})
+	case epoch > time.Nanosecond:
+		return convertTimes(resp, func(ts int64) interface{} {
+			return ts / int64(epoch)
+		})
+	}
+	return resp
+}
+
+// convertTimes returns a copy of resp with the values of time columns
+// converted by convert
+func convertTimes(resp *Response, convert func(int64) interface{}) *Response {
+	out := &Response{Err: resp.Err, Results: make([]*Result, len(resp.Results))}
+	for i, res := range resp.Results {
+		converted := &Result{StatementID: res.StatementID, Err: res.Err}
+		for _, s := range res.Series {
+			cs := &Series{Name: s.Name, Tags: s.Tags, Columns: s.Columns, Rows: make([]Row, len(s.Rows))}
+			for j, row := range s.Rows {
+				cr := make(Row, len(row))
+				copy(cr, row)
+				for k, c := range s.Columns {
+					if ts, ok := cr[k].(int64); ok && c.Type == Time {
+						cr[k] = convert(ts)
+					}
+				}
+				cs.Rows[j] = cr
+			}
+			converted.Series = append(converted.Series, cs)
+		}
+		out.Results[i] = converted
+	}
+	return out
+}
+
+// CSVEncoder writes responses as InfluxDB annotated CSV. Every series is
+// emitted as its own table with #datatype, #group and #default annotations
+// derived from the series column schema.
+type CSVEncoder struct {
+	// Dialect selects the header, delimiter and annotations written. Nil
+	// writes the header and every annotation, separated by commas.
+	Dialect *Dialect
+}
+
+// Annotations of the annotated CSV tables
+const (
+	AnnotationDatatype = "datatype"
+	AnnotationGroup    = "group"
+	AnnotationDefault  = "default"
+)
+
+// Dialect is the CSV dialect of a Flux query request
+type Dialect struct {
+	// Header writes the row of column names of every table
+	Header bool
+	// Delimiter separates the values, a comma when empty
+	Delimiter string
+	// Annotations lists the annotation rows written, none when empty
+	Annotations []string
+	// CommentPrefix starts the annotation rows, "#" when empty
+	CommentPrefix string
+}
+
+// DefaultDialect returns the defaults of the settings a Flux request
+// dialect leaves out: a comma separated header without annotations
+func DefaultDialect() Dialect {
+	return Dialect{Header: true, Delimiter: ",", CommentPrefix: "#"}
+}
+
+// Validate checks that the delimiter and comment prefix are a single
+// character and the annotations are known
+func (d Dialect) Validate() error {
+	if utf8.RuneCountInString(d.Delimiter) > 1 || strings.ContainsAny(d.Delimiter, "\"\r\n") {
+		return fmt.Errorf("invalid delimiter %q: expected a single character", d.Delimiter)
+	}
+	if utf8.RuneCountInString(d.CommentPrefix) > 1 {
+		return fmt.Errorf("invalid comment prefix %q: expected a single character", d.CommentPrefix)
+	}
+	for _, a := range d.Annotations {
+		switch a {
+		case AnnotationDatatype, AnnotationGroup, AnnotationDefault:
+		default:
+			return fmt.Errorf("invalid annotation %q: expected datatype, group or default", a)
+		}
+	}
+	return nil
+}
+
+// csvAnnotations is the number of annotation rows preceding the header
+// of every table
+const csvAnnotations = 3
+
+// apply drops the rows of a table the dialect leaves out and prefixes the
+// annotations it keeps
+func (d *Dialect) apply(records [][]string) [][]string {
+	if d == nil {
+		return records
+	}
+	prefix := d.CommentPrefix
+	if prefix == "" {
+		prefix = "#"
+	}
+	var kept [][]string
+	for _, record := range records[:csvAnnotations] {
+		name := strings.TrimPrefix(record[0], "#")
+		if slices.Contains(d.Annotations, name) {
+			record[0] = prefix + name
+			kept = append(kept, record)
+		}
+	}
+	if d.Header {
+		kept = append(kept, records[csvAnnotations])
+	}
+	return append(kept, records[csvAnnotations+1:]...)
+}
+
+// ContentType implements Encoder
+func (CSVEncoder) ContentType() string {
+	return MediaCSV
+}
+
+// Encode implements Encoder
+func (e CSVEncoder) Encode(w io.Writer, resp *Response) error {
+	cw := csv.NewWriter(w)
+	if e.Dialect != nil && e.Dialect.Delimiter != "" {
+		cw.Comma, _ = utf8.DecodeRuneInString(e.Dialect.Delimiter)
+	}
+	table := 0
+	first := true
+
+	writeBlock := func(records ...[]string) error {
+		if !first {
+			cw.Flush()
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+		first = false
+		return cw.WriteAll(e.Dialect.apply(records))
+	}
+
+	if resp.Err != "" {
+		return writeBlock(csvError(resp.Err)...)
+	}
+
+	for _, res := range resp.Results {
+		if res.Err != "" {
+			if err := writeBlock(csvError(res.Err)...); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, series := range res.Series {
+			if err := writeBlock(csvTable(series, table)...); err != nil {
+				return err
+			}
+			table++
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvError builds the annotated CSV records used by InfluxDB to report errors
+func csvError(msg string) [][]string {
+	return [][]string{
+		{"#datatype", "string", "string"},
+		{"#group", "true", "true"},
+		{"#default", "", ""},
+		{"", "error", "reference"},
+		{"", msg, ""},
+	}
+}
+
+// csvTable builds the annotations, header and rows for a single series
+func csvTable(s *Series, table int) [][]string {
+	tagKeys := make([]string, 0, len(s.Tags))
+	for k := range s.Tags {
+		tagKeys = append(tagKeys, k)
+	}
+	sort.Strings(tagKeys)
+
+	datatype := []string{"#datatype", "string", "long", "string"}
+	group := []string{"#group", "false", "false", "true"}
+	defaults := []string{"#default", "_result", "", ""}
+	header := []string{"", "result", "table", "_measurement"}
+
+	for _, k := range tagKeys {
+		datatype = append(datatype, "string")
+		group = append(group, "true")
+		defaults = append(defaults, "")
+		header = append(header, k)
+	}
+	for _, c := range s.Columns {
+		datatype = append(datatype, csvDatatype(c.Type))
+		group = append(group, "false")
+		defaults = append(defaults, "")
+		name := c.Name
+		if c.Type == Time && name == "time" {
+			name = "_time"
+		}
+		header = append(header, name)
+	}
+
+	records := [][]string{datatype, group, defaults, header}
+	for _, row := range s.Rows {
+		record := []string{"", "", strconv.Itoa(table), s.Name}
+		for _, k := range tagKeys {
+			record = append(record, s.Tags[k])
+		}
+		for i, c := range s.Columns {
+			var v interface{}
+			if i < len(row) {
+				v = row[i]
+			}
+			record = append(record, csvValue(c.Type, v))
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// csvDatatype maps a column type to its annotated CSV datatype
+func csvDatatype(t ColumnType) string {
+	switch t {
+	case Time:
+		return "dateTime:RFC3339"
+	case Float:
+		return "double"
+	case Integer:
+		return "long"
+	case Boolean:
+		return "boolean"
+	default:
+		return "string"
+	}
+}
+
+// csvValue formats a single cell value
+func csvValue(t ColumnType, v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	switch val := v.(type) {
+	case int64:
+		if t == Time {
+			return time.Unix(0, val).UTC().Format(time.RFC3339Nano)
+		}
+		return strconv.FormatInt(val, 10)
+	case int:
+		return strconv.Itoa(val)
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(val)
+	case string:
+		return val
+	default:
+		return fmt.Sprint(val)
+	}
+}
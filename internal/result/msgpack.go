@@ -0,0 +1,208 @@
+package result
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+// MediaMsgpack is the media type of MessagePack responses
+const MediaMsgpack = "application/x-msgpack"
+
+// MsgpackEncoder writes responses in the InfluxQL JSON shape encoded as
+// MessagePack, as InfluxDB 1.8 does for the client libraries asking for it
+type MsgpackEncoder struct {
+	// Epoch is the unit used for time columns. Zero means nanoseconds.
+	Epoch time.Duration
+	// RFC3339 writes the time columns as RFC3339 strings, ignoring Epoch
+	RFC3339 bool
+}
+
+// ContentType implements Encoder
+func (MsgpackEncoder) ContentType() string {
+	return MediaMsgpack
+}
+
+// Encode implements Encoder
+func (e MsgpackEncoder) Encode(w io.Writer, resp *Response) error {
+	resp = formatTimes(resp, e.Epoch, e.RFC3339)
+
+	var m msgpackWriter
+	fields := 1
+	if resp.Err != "" {
+		fields++
+	}
+	m.mapHeader(fields)
+	m.str("results")
+	m.arrayHeader(len(resp.Results))
+	for _, res := range resp.Results {
+		if err := m.result(res); err != nil {
+			return err
+		}
+	}
+	if resp.Err != "" {
+		m.str("error")
+		m.str(resp.Err)
+	}
+	_, err := w.Write(m.buf)
+	return err
+}
+
+// msgpackWriter appends MessagePack values to buf
+type msgpackWriter struct {
+	buf []byte
+}
+
+func (m *msgpackWriter) result(res *Result) error {
+	fields := 1
+	if len(res.Series) > 0 {
+		fields++
+	}
+	if res.Err != "" {
+		fields++
+	}
+	m.mapHeader(fields)
+	m.str("statement_id")
+	m.int(int64(res.StatementID))
+	if len(res.Series) > 0 {
+		m.str("series")
+		m.arrayHeader(len(res.Series))
+		for _, s := range res.Series {
+			if err := m.series(s); err != nil {
+				return err
+			}
+		}
+	}
+	if res.Err != "" {
+		m.str("error")
+		m.str(res.Err)
+	}
+	return nil
+}
+
+func (m *msgpackWriter) series(s *Series) error {
+	fields := 3
+	if len(s.Tags) > 0 {
+		fields++
+	}
+	m.mapHeader(fields)
+	m.str("name")
+	m.str(s.Name)
+	if len(s.Tags) > 0 {
+		keys := make([]string, 0, len(s.Tags))
+		for k := range s.Tags {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		m.str("tags")
+		m.mapHeader(len(keys))
+		for _, k := range keys {
+			m.str(k)
+			m.str(s.Tags[k])
+		}
+	}
+	m.str("columns")
+	m.arrayHeader(len(s.Columns))
+	for _, c := range s.Columns {
+		m.str(c.Name)
+	}
+	m.str("values")
+	m.arrayHeader(len(s.Rows))
+	for _, row := range s.Rows {
+		m.arrayHeader(len(row))
+		for _, v := range row {
+			if err := m.value(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// value appends a cell of a row
+func (m *msgpackWriter) value(v interface{}) error {
+	switch val := v.(type) {
+	case nil:
+		m.buf = append(m.buf, 0xc0)
+	case bool:
+		if val {
+			m.buf = append(m.buf, 0xc3)
+		} else {
+			m.buf = append(m.buf, 0xc2)
+		}
+	case int64:
+		m.int(val)
+	case int:
+		m.int(int64(val))
+	case float64:
+		m.buf = append(m.buf, 0xcb)
+		m.buf = binary.BigEndian.AppendUint64(m.buf, math.Float64bits(val))
+	case string:
+		m.str(val)
+	default:
+		return fmt.Errorf("unsupported value %T", v)
+	}
+	return nil
+}
+
+// int appends v in the smallest signed integer format holding it
+func (m *msgpackWriter) int(v int64) {
+	switch {
+	case v >= 0 && v <= math.MaxInt8:
+		m.buf = append(m.buf, byte(v))
+	case v < 0 && v >= -32:
+		m.buf = append(m.buf, byte(v))
+	case v >= math.MinInt8 && v <= math.MaxInt8:
+		m.buf = append(m.buf, 0xd0, byte(v))
+	case v >= math.MinInt16 && v <= math.MaxInt16:
+		m.buf = append(m.buf, 0xd1)
+		m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(v))
+	case v >= math.MinInt32 && v <= math.MaxInt32:
+		m.buf = append(m.buf, 0xd2)
+		m.buf = binary.BigEndian.AppendUint32(m.buf, uint32(v))
+	default:
+		m.buf = append(m.buf, 0xd3)
+		m.buf = binary.BigEndian.AppendUint64(m.buf, uint64(v))
+	}
+}
+
+func (m *msgpackWriter) str(s string) {
+	switch n := len(s); {
+	case n < 32:
+		m.buf = append(m.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		m.buf = append(m.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		m.buf = append(m.buf, 0xda)
+		m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(n))
+	default:
+		m.buf = append(m.buf, 0xdb)
+		m.buf = binary.BigEndian.AppendUint32(m.buf, uint32(n))
+	}
+	m.buf = append(m.buf, s...)
+}
+
+func (m *msgpackWriter) arrayHeader(n int) {
+	m.header(n, 0x90, 0xdc, 0xdd)
+}
+
+func (m *msgpackWriter) mapHeader(n int) {
+	m.header(n, 0x80, 0xde, 0xdf)
+}
+
+// header appends the size of an array or map, in its fix format below 16
+func (m *msgpackWriter) header(n int, fix, b16, b32 byte) {
+	switch {
+	case n < 16:
+		m.buf = append(m.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		m.buf = append(m.buf, b16)
+		m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(n))
+	default:
+		m.buf = append(m.buf, b32)
+		m.buf = binary.BigEndian.AppendUint32(m.buf, uint32(n))
+	}
+}
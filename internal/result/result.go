@@ -0,0 +1,144 @@
+// Package result implements the query result model shared by the HTTP
+// query endpoints and the encoders that serialize it.
+//
+// A Response holds one Result per executed statement. Each Result carries
+// zero or more Series, and every Series declares its column schema up front
+// so encoders can emit typed output (InfluxQL JSON, annotated CSV) without
+// guessing value types from the rows themselves.
+package result
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ColumnType is the declared data type of a series column
+type ColumnType int
+
+const (
+	// Time columns hold int64 Unix nanosecond timestamps
+	Time ColumnType = iota
+	// Float columns hold float64 values
+	Float
+	// Integer columns hold int64 values
+	Integer
+	// String columns hold string values
+	String
+	// Boolean columns hold bool values
+	Boolean
+)
+
+// String returns the column type name
+func (t ColumnType) String() string {
+	switch t {
+	case Time:
+		return "time"
+	case Float:
+		return "float"
+	case Integer:
+		return "integer"
+	case String:
+		return "string"
+	case Boolean:
+		return "boolean"
+	default:
+		return fmt.Sprintf("ColumnType(%d)", int(t))
+	}
+}
+
+// Column describes a single column of a series
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+// Row is a single row of values ordered like the series columns.
+// A nil entry represents a missing value.
+type Row []interface{}
+
+// Series is a named set of rows sharing a column schema
+type Series struct {
+	Name    string
+	Tags    map[string]string
+	Columns []Column
+	Rows    []Row
+}
+
+// NewSeries creates an empty series with the given column schema
+func NewSeries(name string, columns ...Column) *Series {
+	return &Series{
+		Name:    name,
+		Columns: columns,
+		Rows:    make([]Row, 0),
+	}
+}
+
+// Append adds a row to the series. The row must have one value per column.
+func (s *Series) Append(values ...interface{}) {
+	s.Rows = append(s.Rows, Row(values))
+}
+
+// ColumnNames returns the names of the series columns in order
+func (s *Series) ColumnNames() []string {
+	names := make([]string, len(s.Columns))
+	for i, c := range s.Columns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// MarshalJSON encodes the series in the InfluxQL JSON shape
+func (s *Series) MarshalJSON() ([]byte, error) {
+	values := s.Rows
+	if values == nil {
+		values = make([]Row, 0)
+	}
+	return json.Marshal(struct {
+		Name    string            `json:"name"`
+		Tags    map[string]string `json:"tags,omitempty"`
+		Columns []string          `json:"columns"`
+		Values  []Row             `json:"values"`
+	}{
+		Name:    s.Name,
+		Tags:    s.Tags,
+		Columns: s.ColumnNames(),
+		Values:  values,
+	})
+}
+
+// Result holds the output of a single statement
+type Result struct {
+	StatementID int       `json:"statement_id"`
+	Series      []*Series `json:"series,omitempty"`
+	Err         string    `json:"error,omitempty"`
+}
+
+// Response is the top level query response
+type Response struct {
+	Results []*Result `json:"results"`
+	Err     string    `json:"error,omitempty"`
+}
+
+// New creates a response holding a single result for statement 0
+func New(series ...*Series) *Response {
+	return &Response{
+		Results: []*Result{
+			{
+				StatementID: 0,
+				Series:      series,
+			},
+		},
+	}
+}
+
+// Error creates a response reporting that statement 0 failed
+func Error(msg string) *Response {
+	return &Response{
+		Results: []*Result{
+			{
+				StatementID: 0,
+				Err:         msg,
+			},
+		},
+	}
+}
@@ -0,0 +1,201 @@
+package result
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSeries() *Series {
+	s := NewSeries("cpu",
+		Column{Name: "time", Type: Time},
+		Column{Name: "host", Type: String},
+		Column{Name: "value", Type: Float},
+		Column{Name: "count", Type: Integer},
+		Column{Name: "up", Type: Boolean},
+	)
+	s.Append(int64(1556813561098000000), "server1", 42.5, int64(3), true)
+	s.Append(int64(1556813562098000000), "server2", nil, int64(4), false)
+	return s
+}
+
+func TestEncoderFor(t *testing.T) {
+	assert.IsType(t, JSONEncoder{}, EncoderFor("", Options{}))
+	assert.IsType(t, JSONEncoder{}, EncoderFor("application/json", Options{}))
+	assert.IsType(t, CSVEncoder{}, EncoderFor("application/csv", Options{}))
+	assert.IsType(t, CSVEncoder{}, EncoderFor("text/csv; charset=utf-8", Options{}))
+	assert.IsType(t, CSVEncoder{}, EncoderFor("application/xml, application/csv", Options{}))
+	assert.IsType(t, JSONEncoder{}, EncoderFor("application/json, application/csv", Options{}))
+}
+
+func TestJSONEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	err := JSONEncoder{}.Encode(&buf, New(testSeries()))
+	assert.NoError(t, err)
+
+	var decoded map[string]interface{}
+	dec := json.NewDecoder(&buf)
+	dec.UseNumber()
+	assert.NoError(t, dec.Decode(&decoded))
+
+	results := decoded["results"].([]interface{})
+	assert.Len(t, results, 1)
+	series := results[0].(map[string]interface{})["series"].([]interface{})
+	assert.Len(t, series, 1)
+
+	s := series[0].(map[string]interface{})
+	assert.Equal(t, "cpu", s["name"])
+	assert.Equal(t, []interface{}{"time", "host", "value", "count", "up"}, s["columns"])
+
+	values := s["values"].([]interface{})
+	assert.Len(t, values, 2)
+	first := values[0].([]interface{})
+	assert.Equal(t, json.Number("1556813561098000000"), first[0])
+	assert.Equal(t, "server1", first[1])
+	assert.Equal(t, json.Number("42.5"), first[2])
+	assert.Equal(t, true, first[4])
+	assert.Nil(t, values[1].([]interface{})[2])
+}
+
+func TestJSONEncoderEpoch(t *testing.T) {
+	s := testSeries()
+	var buf bytes.Buffer
+	err := JSONEncoder{Epoch: time.Millisecond}.Encode(&buf, New(s))
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "[1556813561098,")
+
+	// The source response must not be modified
+	assert.Equal(t, int64(1556813561098000000), s.Rows[0][0])
+
+	buf.Reset()
+	assert.NoError(t, JSONEncoder{Epoch: time.Millisecond, RFC3339: true}.Encode(&buf, New(s)))
+	assert.Contains(t, buf.String(), `["2019-05-02T16:12:41.098Z",`)
+}
+
+func TestJSONEncoderPretty(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, JSONEncoder{Pretty: true}.Encode(&buf, New()))
+	assert.Equal(t, "{\n    \"results\": [\n        {\n            \"statement_id\": 0\n        }\n    ]\n}\n", buf.String())
+}
+
+func TestMsgpackEncoder(t *testing.T) {
+	s := NewSeries("cpu", Column{Name: "time", Type: Time}, Column{Name: "value", Type: Float})
+	s.Append(int64(1000), 1.5)
+	s.Append(int64(-5), nil)
+
+	var buf bytes.Buffer
+	assert.NoError(t, MsgpackEncoder{}.Encode(&buf, New(s)))
+	str := func(s string) []byte { return append([]byte{0xa0 | byte(len(s))}, s...) }
+	var want []byte
+	want = append(want, 0x81)
+	want = append(want, str("results")...)
+	want = append(want, 0x91, 0x82)
+	want = append(want, str("statement_id")...)
+	want = append(want, 0x00)
+	want = append(want, str("series")...)
+	want = append(want, 0x91, 0x83)
+	want = append(want, str("name")...)
+	want = append(want, str("cpu")...)
+	want = append(want, str("columns")...)
+	want = append(want, 0x92)
+	want = append(want, str("time")...)
+	want = append(want, str("value")...)
+	want = append(want, str("values")...)
+	want = append(want, 0x92, 0x92, 0xd1, 0x03, 0xe8, 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0)
+	want = append(want, 0x92, 0xfb, 0xc0)
+	assert.Equal(t, want, buf.Bytes())
+
+	assert.IsType(t, MsgpackEncoder{}, EncoderFor("application/x-msgpack", Options{}))
+}
+
+func TestJSONEncoderEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, JSONEncoder{}.Encode(&buf, New()))
+	assert.Equal(t, `{"results":[{"statement_id":0}]}`, strings.TrimSpace(buf.String()))
+
+	buf.Reset()
+	assert.NoError(t, JSONEncoder{}.Encode(&buf, New(NewSeries("cpu", Column{Name: "time", Type: Time}))))
+	assert.Contains(t, buf.String(), `"values":[]`)
+}
+
+func TestCSVEncoder(t *testing.T) {
+	s := testSeries()
+	s.Tags = map[string]string{"region": "us-west"}
+
+	var buf bytes.Buffer
+	err := CSVEncoder{}.Encode(&buf, New(s))
+	assert.NoError(t, err)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, []string{
+		"#datatype,string,long,string,string,dateTime:RFC3339,string,double,long,boolean",
+		"#group,false,false,true,true,false,false,false,false,false",
+		"#default,_result,,,,,,,,",
+		",result,table,_measurement,region,_time,host,value,count,up",
+		",,0,cpu,us-west,2019-05-02T16:12:41.098Z,server1,42.5,3,true",
+		",,0,cpu,us-west,2019-05-02T16:12:42.098Z,server2,,4,false",
+	}, lines)
+}
+
+func TestCSVEncoderMultipleTables(t *testing.T) {
+	a := NewSeries("cpu", Column{Name: "time", Type: Time}, Column{Name: "value", Type: Float})
+	a.Append(int64(0), 1.0)
+	b := NewSeries("mem", Column{Name: "time", Type: Time}, Column{Name: "used", Type: Integer})
+	b.Append(int64(0), int64(2))
+
+	var buf bytes.Buffer
+	assert.NoError(t, CSVEncoder{}.Encode(&buf, New(a, b)))
+
+	tables := strings.Split(strings.TrimSpace(buf.String()), "\n\n")
+	assert.Len(t, tables, 2)
+	assert.Contains(t, tables[0], ",,0,cpu,1970-01-01T00:00:00Z,1")
+	assert.Contains(t, tables[1], ",,1,mem,1970-01-01T00:00:00Z,2")
+}
+
+func TestCSVEncoderDialect(t *testing.T) {
+	s := testSeries()
+	dialect := DefaultDialect()
+	dialect.Delimiter = ";"
+	dialect.Annotations = []string{AnnotationDatatype, AnnotationDefault}
+	dialect.CommentPrefix = "@"
+
+	var buf bytes.Buffer
+	assert.NoError(t, CSVEncoder{Dialect: &dialect}.Encode(&buf, New(s)))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, []string{
+		"@datatype;string;long;string;dateTime:RFC3339;string;double;long;boolean",
+		"@default;_result;;;;;;;",
+		";result;table;_measurement;_time;host;value;count;up",
+		";;0;cpu;2019-05-02T16:12:41.098Z;server1;42.5;3;true",
+		";;0;cpu;2019-05-02T16:12:42.098Z;server2;;4;false",
+	}, lines)
+
+	// Without header nor annotations only the rows are left
+	dialect = Dialect{}
+	buf.Reset()
+	assert.NoError(t, CSVEncoder{Dialect: &dialect}.Encode(&buf, New(s)))
+	assert.Equal(t, ",,0,cpu,2019-05-02T16:12:41.098Z,server1,42.5,3,true\n,,0,cpu,2019-05-02T16:12:42.098Z,server2,,4,false\n", buf.String())
+
+	assert.NoError(t, DefaultDialect().Validate())
+	assert.Error(t, Dialect{Delimiter: ";;"}.Validate())
+	assert.Error(t, Dialect{CommentPrefix: "//"}.Validate())
+	assert.Error(t, Dialect{Annotations: []string{"types"}}.Validate())
+}
+
+func TestCSVEncoderError(t *testing.T) {
+	var buf bytes.Buffer
+	resp := &Response{Results: []*Result{{StatementID: 0, Err: "measurement not found"}}}
+	assert.NoError(t, CSVEncoder{}.Encode(&buf, resp))
+	assert.Contains(t, buf.String(), ",error,reference")
+	assert.Contains(t, buf.String(), ",measurement not found,")
+}
+
+func TestJSONEncoderStatementError(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, JSONEncoder{}.Encode(&buf, Error("database not found: foo")))
+	assert.Equal(t, `{"results":[{"statement_id":0,"error":"database not found: foo"}]}`, strings.TrimSpace(buf.String()))
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/result"
+)
+
+// aggregateCall is one of the aggregations of a SELECT clause listing
+// several of them, such as SELECT mean(usage_user), max(usage_system)
+type aggregateCall struct {
+	name  string
+	field string
+	// column is the alias of the call, or its name made unique
+	column string
+}
+
+// parseAggregates returns the aggregations selected by query when its
+// SELECT clause lists several items and one of them is an aggregation,
+// or nil. A selector followed by tags and fields, such as
+// max("value"), "host", is left to parseSelector; other mixes of
+// aggregations and fields are rejected, as in InfluxDB.
+func parseAggregates(query string) ([]aggregateCall, error) {
+	clause, err := selectClause(query)
+	if err != nil {
+		return nil, err
+	}
+	items := splitList(clause)
+	if len(items) < 2 {
+		return nil, nil
+	}
+
+	var calls []aggregateCall
+	taken := make(map[string]int)
+	for _, item := range items {
+		text, alias := splitAlias(item)
+		name, field, ok, err := aggregateArg(text)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		if alias == "" {
+			alias = name
+		}
+		calls = append(calls, aggregateCall{name: name, field: field, column: uniqueName(taken, alias)})
+	}
+
+	switch {
+	case len(calls) == 0:
+		return nil, nil
+	case len(calls) == len(items):
+		return calls, nil
+	case len(calls) == 1 && isSelector(calls[0].name) && aggregateFirst(items):
+		return nil, nil
+	}
+	return nil, fmt.Errorf("mixing aggregate and non-aggregate queries is not supported")
+}
+
+// aggregateFirst reports whether the first of items is an aggregation
+func aggregateFirst(items []string) bool {
+	text, _ := splitAlias(items[0])
+	_, _, ok, _ := aggregateArg(text)
+	return ok
+}
+
+// aggregateArg reads an aggregation of a field such as mean("value"),
+// and returns false when text is not a call to an aggregation
+func aggregateArg(text string) (name, field string, ok bool, err error) {
+	text = strings.TrimSpace(text)
+	open := strings.IndexByte(text, '(')
+	if open == -1 || !strings.HasSuffix(text, ")") {
+		return "", "", false, nil
+	}
+	name = strings.ToLower(strings.TrimSpace(text[:open]))
+	if !isAggregation(name) {
+		return "", "", false, nil
+	}
+	if field, err = identifier(text[open+1 : len(text)-1]); err != nil {
+		return "", "", false, fmt.Errorf("invalid argument of %s: %w", name, err)
+	}
+	return name, field, true, nil
+}
+
+// aggregatesSeries computes every aggregation over the GROUP BY buckets
+// of w, with a column each. Buckets where only some of the fields have
+// values return null for the others.
+func aggregatesSeries(measurement string, calls []aggregateCall, points []persistence.Point, w timeBuckets) *result.Series {
+	columns := []result.Column{{Name: "time", Type: result.Time}}
+	rows := make(map[int64][]interface{})
+	for i, call := range calls {
+		columns = append(columns, result.Column{Name: call.column, Type: result.Float})
+		for _, s := range aggregateBuckets(points, call.field, call.name, w) {
+			row, ok := rows[s.ts]
+			if !ok {
+				row = make([]interface{}, len(calls)+1)
+				row[0] = s.ts
+				rows[s.ts] = row
+			}
+			row[i+1] = s.v
+		}
+	}
+
+	timestamps := make([]int64, 0, len(rows))
+	for ts := range rows {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	series := result.NewSeries(measurement, columns...)
+	for _, ts := range timestamps {
+		series.Append(rows[ts]...)
+	}
+	return series
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// audit records a successful administrative operation in the audit log,
+// with the token or user of the request as actor. Failing to record it is
+// logged but does not fail the operation, which already happened.
+func (s *Server) audit(c *gin.Context, action, target, detail string) {
+	actor := "anonymous"
+	if v, ok := c.Get(tokenKey); ok {
+		actor = v.(persistence.Token).ID
+	}
+	source := c.Request.RemoteAddr
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	err := s.db.RecordAudit(persistence.AuditEntry{
+		Actor:  actor,
+		Source: source,
+		Action: action,
+		Target: target,
+		Detail: detail,
+	})
+	if err != nil {
+		s.logger(c).Errorf("Failed to record %s of %s in the audit log: %v", action, target, err)
+	}
+}
+
+// auditEntry is the API representation of an audit log entry
+type auditEntry struct {
+	ID     int64     `json:"id"`
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Source string    `json:"source"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// handleAuditLog answers GET /api/v2/audit with the entries recorded since
+// the RFC 3339 since parameter, up to limit entries
+func (s *Server) handleAuditLog(c *gin.Context) {
+	var since time.Time
+	if v := c.Query("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid since: %v", err))
+			return
+		}
+	}
+	limit := 0
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid limit: %s", v))
+			return
+		}
+		limit = n
+	}
+
+	log, err := s.db.AuditLog(since, limit)
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	entries := make([]auditEntry, 0, len(log))
+	for _, e := range log {
+		entries = append(entries, auditEntry(e))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"links":   gin.H{"self": "/api/v2/audit"},
+		"entries": entries,
+	})
+}
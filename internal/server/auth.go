@@ -0,0 +1,314 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// tokenKey is the context key of the token authenticating a request
+const tokenKey = "refluxdb.token"
+
+// filterClients rejects the requests whose source address is not
+// accepted by the client allow and deny lists. The address of the
+// connection is used, never a forwarded one, which clients could forge.
+func (s *Server) filterClients() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.clients.AllowsHost(c.Request.RemoteAddr) {
+			clientsRejected.Inc()
+			writeError(c, http.StatusForbidden, "forbidden: client address not allowed")
+			return
+		}
+		c.Next()
+	}
+}
+
+// requestToken returns the token sent as "Authorization: Token <token>"
+// or "Authorization: Bearer <token>"
+func requestToken(c *gin.Context) string {
+	auth := c.GetHeader("Authorization")
+	for _, scheme := range []string{"Token ", "Bearer "} {
+		if strings.HasPrefix(auth, scheme) {
+			return strings.TrimSpace(auth[len(scheme):])
+		}
+	}
+	return ""
+}
+
+// requestCredentials returns the user and password sent with HTTP basic
+// authentication or, by InfluxDB 1.x clients, as the u and p parameters
+func requestCredentials(c *gin.Context) (string, string) {
+	if user, password, ok := c.Request.BasicAuth(); ok {
+		return user, password
+	}
+	return formValue(c, "u"), formValue(c, "p")
+}
+
+// authenticate rejects requests without valid credentials with a 401
+// when authentication is enabled, and otherwise keeps the scopes of the
+// token or user for the checks of the handlers. Like InfluxDB 2, a token
+// is accepted in place of the password of an unknown user.
+func (s *Server) authenticate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.authEnabled {
+			c.Next()
+			return
+		}
+
+		secret := requestToken(c)
+		if secret == "" {
+			user, password := requestCredentials(c)
+			if user != "" {
+				u, err := s.db.AuthenticateUser(user, password)
+				switch {
+				case err == nil:
+					c.Set(tokenKey, persistence.Token{ID: "user:" + u.Name, Scopes: u.Scopes()})
+					c.Next()
+					return
+				case errors.Is(err, persistence.ErrInvalidPassword):
+					writeError(c, http.StatusUnauthorized, "authorization failed")
+					return
+				case !errors.Is(err, persistence.ErrUserNotFound):
+					s.logger(c).Errorf("Failed to authenticate user: %v", err)
+					writeError(c, storageStatus(err), err.Error())
+					return
+				}
+			}
+			secret = password
+		}
+		if secret == "" {
+			if s.bootstrapping(c) {
+				c.Next()
+				return
+			}
+			writeError(c, http.StatusUnauthorized, "unauthorized access: credentials are required")
+			return
+		}
+
+		token, err := s.db.Authorize(secret)
+		if errors.Is(err, persistence.ErrTokenNotFound) {
+			writeError(c, http.StatusUnauthorized, "authorization failed")
+			return
+		}
+		if err != nil {
+			s.logger(c).Errorf("Failed to authorize token: %v", err)
+			writeError(c, storageStatus(err), err.Error())
+			return
+		}
+		c.Set(tokenKey, token)
+		c.Next()
+	}
+}
+
+// bootstrapping reports whether the request creates the first admin user,
+// which InfluxDB allows without credentials:
+// CREATE USER admin WITH PASSWORD '...' WITH ALL PRIVILEGES
+func (s *Server) bootstrapping(c *gin.Context) bool {
+	if c.FullPath() != "/query" {
+		return false
+	}
+	query := strings.ToLower(strings.Join(strings.Fields(formValue(c, "q")), " "))
+	if !strings.HasPrefix(query, "create user ") || !strings.HasSuffix(strings.TrimSuffix(query, ";"), " with all privileges") {
+		return false
+	}
+	exists, err := s.db.HasAdminUser()
+	return err == nil && !exists
+}
+
+// allowed reports whether the request may perform action on database.
+// Everything is allowed when authentication is disabled.
+func (s *Server) allowed(c *gin.Context, action, database string) bool {
+	if !s.authEnabled {
+		return true
+	}
+	v, ok := c.Get(tokenKey)
+	if !ok {
+		return false
+	}
+	return v.(persistence.Token).Allows(action, database)
+}
+
+// authorize reports whether the request may perform action on database.
+// Otherwise it answers the request with a 403.
+func (s *Server) authorize(c *gin.Context, action, database string) bool {
+	if s.allowed(c, action, database) {
+		return true
+	}
+	scope := action
+	if action != persistence.ScopeAdmin {
+		if database == "" {
+			database = "*"
+		}
+		scope = action + ":" + database
+	}
+	s.logger(c).Warnf("Token lacks the %s scope", scope)
+	writeError(c, http.StatusForbidden, fmt.Sprintf("forbidden: token lacks the %s scope", scope))
+	return false
+}
+
+// requireAdmin aborts requests whose token lacks the admin scope
+func (s *Server) requireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !s.authorize(c, persistence.ScopeAdmin, "") {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// authorization is the v2 API representation of a token. The token
+// itself is only returned when it is created.
+type authorization struct {
+	ID          string    `json:"id"`
+	Token       string    `json:"token,omitempty"`
+	Description string    `json:"description"`
+	Scopes      []string  `json:"scopes"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Quota       *quota    `json:"quota,omitempty"`
+}
+
+// quota is the API representation of the write quota of a token, zero
+// limits being unlimited
+type quota struct {
+	PointsPerSecond float64 `json:"pointsPerSecond"`
+	Burst           int64   `json:"burst"`
+	BytesPerDay     int64   `json:"bytesPerDay"`
+}
+
+func newAuthorization(t persistence.Token) authorization {
+	auth := authorization{ID: t.ID, Description: t.Description, Scopes: t.Scopes, Status: "active", CreatedAt: t.CreatedAt}
+	if t.Quota != (persistence.Quota{}) {
+		q := quota(t.Quota)
+		auth.Quota = &q
+	}
+	return auth
+}
+
+// postAuthorizationRequest is the body of POST /api/v2/authorizations
+type postAuthorizationRequest struct {
+	Description string   `json:"description"`
+	Scopes      []string `json:"scopes"`
+	Quota       *quota   `json:"quota"`
+}
+
+func (s *Server) handleListAuthorizations(c *gin.Context) {
+	tokens, err := s.db.Tokens()
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	auths := make([]authorization, 0, len(tokens))
+	for _, t := range tokens {
+		auths = append(auths, newAuthorization(t))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"links":          gin.H{"self": "/api/v2/authorizations"},
+		"authorizations": auths,
+	})
+}
+
+func (s *Server) handleCreateAuthorization(c *gin.Context) {
+	var req postAuthorizationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid authorization: %v", err))
+		return
+	}
+	if len(req.Scopes) == 0 {
+		writeError(c, http.StatusBadRequest, "at least one scope is required")
+		return
+	}
+	for _, scope := range req.Scopes {
+		if err := persistence.ValidateScope(scope); err != nil {
+			writeError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if req.Quota != nil {
+		if err := persistence.Quota(*req.Quota).Validate(); err != nil {
+			writeError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	token, secret, err := s.db.AddToken(req.Description, req.Scopes)
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	if req.Quota != nil {
+		if err := s.db.SetTokenQuota(token.ID, persistence.Quota(*req.Quota)); err != nil {
+			writeError(c, storageStatus(err), err.Error())
+			return
+		}
+		token.Quota = persistence.Quota(*req.Quota)
+	}
+	s.audit(c, "token.create", token.ID, "scopes "+strings.Join(token.Scopes, ","))
+	auth := newAuthorization(token)
+	auth.Token = secret
+	c.JSON(http.StatusCreated, auth)
+}
+
+func (s *Server) handleDeleteAuthorization(c *gin.Context) {
+	err := s.db.DeleteToken(c.Param("authID"))
+	if errors.Is(err, persistence.ErrTokenNotFound) {
+		writeError(c, http.StatusNotFound, "authorization not found")
+		return
+	}
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	s.audit(c, "token.delete", c.Param("authID"), "")
+	c.Status(http.StatusNoContent)
+}
+
+// handleGetQuota answers GET /api/v2/authorizations/:authID/quota with
+// the quota of a token and the bytes it wrote today
+func (s *Server) handleGetQuota(c *gin.Context) {
+	token, err := s.db.Token(c.Param("authID"))
+	if errors.Is(err, persistence.ErrTokenNotFound) {
+		writeError(c, http.StatusNotFound, "authorization not found")
+		return
+	}
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	used, err := s.db.TokenUsage(token.ID, time.Now())
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"quota": quota(token.Quota), "bytesToday": used})
+}
+
+// handleSetQuota answers PUT /api/v2/authorizations/:authID/quota by
+// replacing the quota of a token
+func (s *Server) handleSetQuota(c *gin.Context) {
+	var req quota
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid quota: %v", err))
+		return
+	}
+	if err := persistence.Quota(req).Validate(); err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	err := s.db.SetTokenQuota(c.Param("authID"), persistence.Quota(req))
+	if errors.Is(err, persistence.ErrTokenNotFound) {
+		writeError(c, http.StatusNotFound, "authorization not found")
+		return
+	}
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	s.audit(c, "token.quota", c.Param("authID"), fmt.Sprintf("%g points per second, burst %d, %d bytes per day", req.PointsPerSecond, req.Burst, req.BytesPerDay))
+	c.JSON(http.StatusOK, req)
+}
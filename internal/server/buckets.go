@@ -0,0 +1,305 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// retentionRule is the v2 API representation of a retention period
+type retentionRule struct {
+	Type                      string `json:"type"`
+	EverySeconds              int64  `json:"everySeconds"`
+	ShardGroupDurationSeconds int64  `json:"shardGroupDurationSeconds,omitempty"`
+}
+
+// bucket is the v2 API representation of a database
+type bucket struct {
+	ID             string            `json:"id"`
+	Type           string            `json:"type"`
+	Name           string            `json:"name"`
+	Description    string            `json:"description,omitempty"`
+	OrgID          string            `json:"orgID"`
+	RetentionRules []retentionRule   `json:"retentionRules"`
+	CreatedAt      time.Time         `json:"createdAt"`
+	UpdatedAt      time.Time         `json:"updatedAt"`
+	Labels         []string          `json:"labels"`
+	Links          map[string]string `json:"links"`
+}
+
+// postBucketRequest is the body of POST /api/v2/buckets
+type postBucketRequest struct {
+	Name           string          `json:"name"`
+	OrgID          string          `json:"orgID"`
+	Description    string          `json:"description"`
+	RetentionRules []retentionRule `json:"retentionRules"`
+}
+
+// patchBucketRequest is the body of PATCH /api/v2/buckets/:bucketID.
+// Absent fields are left unchanged; an empty retentionRules list removes
+// the retention period.
+type patchBucketRequest struct {
+	Name           *string         `json:"name"`
+	Description    *string         `json:"description"`
+	RetentionRules []retentionRule `json:"retentionRules"`
+}
+
+func newBucket(d persistence.Database) bucket {
+	rules := make([]retentionRule, 0, 1)
+	if d.RetentionPeriod > 0 {
+		rules = append(rules, retentionRule{Type: "expire", EverySeconds: int64(d.RetentionPeriod / time.Second)})
+	}
+	return bucket{
+		ID:             d.ID,
+		Type:           "user",
+		Name:           d.Name,
+		Description:    d.Description,
+		OrgID:          d.OrgID,
+		RetentionRules: rules,
+		CreatedAt:      d.CreatedAt,
+		UpdatedAt:      d.UpdatedAt,
+		Labels:         []string{},
+		Links: map[string]string{
+			"self":  "/api/v2/buckets/" + d.ID,
+			"org":   "/api/v2/orgs/" + d.OrgID,
+			"write": "/api/v2/write?org=" + d.OrgID + "&bucket=" + d.ID,
+		},
+	}
+}
+
+// retentionPeriod converts retention rules to a period. No rule, or a rule
+// of zero seconds, keeps data forever.
+func retentionPeriod(rules []retentionRule) (time.Duration, error) {
+	var period time.Duration
+	for _, r := range rules {
+		if r.Type != "" && r.Type != "expire" {
+			return 0, fmt.Errorf("unsupported retention rule type %q", r.Type)
+		}
+		if r.EverySeconds < 0 {
+			return 0, fmt.Errorf("retention period must not be negative")
+		}
+		period = time.Duration(r.EverySeconds) * time.Second
+	}
+	return period, nil
+}
+
+// bucketParam returns the database a v2 write or query is for. The
+// official clients name the bucket and organization either by name, with
+// the bucket and org parameters, or by ID, with bucketID and orgID or with
+// an ID in place of a name. A bucket parameter is a name unless no
+// database has that name and one has that ID; unknown names are returned
+// as they are, for writes to create them. It answers the request and
+// returns false when the parameters are missing or an ID is unknown.
+func (s *Server) bucketParam(c *gin.Context) (string, bool) {
+	org, orgID := c.Query("org"), c.Query("orgID")
+	name, id := c.Query("bucket"), c.Query("bucketID")
+	if (org == "" && orgID == "") || (name == "" && id == "") {
+		writeError(c, http.StatusBadRequest, "org and bucket are required")
+		return "", false
+	}
+	if orgID != "" {
+		if _, err := s.db.GetOrganizationByID(orgID); err != nil {
+			s.orgError(c, err)
+			return "", false
+		}
+	}
+
+	if id == "" {
+		exists, err := s.db.HasDatabase(name)
+		if err != nil {
+			writeError(c, storageStatus(err), err.Error())
+			return "", false
+		}
+		if exists {
+			return name, true
+		}
+		id = name
+	}
+	d, err := s.db.GetDatabaseByID(id)
+	switch {
+	case errors.Is(err, persistence.ErrDatabaseNotFound) && name != "":
+		return name, true
+	case errors.Is(err, persistence.ErrDatabaseNotFound):
+		writeError(c, http.StatusNotFound, fmt.Sprintf("bucket %q not found", id))
+		return "", false
+	case err != nil:
+		writeError(c, storageStatus(err), err.Error())
+		return "", false
+	}
+	return d.Name, true
+}
+
+func (s *Server) handleListBuckets(c *gin.Context) {
+	offset, limit, err := parsePage(c)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	name, id, orgID := c.Query("name"), c.Query("id"), c.Query("orgID")
+	if orgName := c.Query("org"); orgName != "" {
+		org, err := s.db.GetOrganization(orgName)
+		if err != nil {
+			s.orgError(c, err)
+			return
+		}
+		orgID = org.ID
+	}
+
+	databases, err := s.db.Databases()
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+
+	buckets := make([]bucket, 0)
+	for _, d := range databases {
+		if (name != "" && d.Name != name) || (id != "" && d.ID != id) || (orgID != "" && d.OrgID != orgID) || !s.allowed(c, persistence.ScopeRead, d.Name) {
+			continue
+		}
+		buckets = append(buckets, newBucket(d))
+	}
+	buckets = page(buckets, offset, limit)
+
+	c.JSON(http.StatusOK, gin.H{
+		"links":   gin.H{"self": fmt.Sprintf("/api/v2/buckets?limit=%d&offset=%d", limit, offset)},
+		"buckets": buckets,
+	})
+}
+
+func (s *Server) handleCreateBucket(c *gin.Context) {
+	var req postBucketRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid bucket: %v", err))
+		return
+	}
+	if req.Name == "" {
+		writeError(c, http.StatusBadRequest, "bucket name is required")
+		return
+	}
+	period, err := retentionPeriod(req.RetentionRules)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.OrgID != "" {
+		if _, err := s.db.GetOrganizationByID(req.OrgID); err != nil {
+			s.orgError(c, err)
+			return
+		}
+	}
+
+	d, err := s.db.AddDatabase(persistence.Database{
+		Name:            req.Name,
+		OrgID:           req.OrgID,
+		Description:     req.Description,
+		RetentionPeriod: period,
+	})
+	if errors.Is(err, persistence.ErrDatabaseExists) {
+		writeError(c, http.StatusUnprocessableEntity, fmt.Sprintf("bucket with name %s already exists", req.Name))
+		return
+	}
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	s.audit(c, "bucket.create", d.Name, "id "+d.ID)
+	c.JSON(http.StatusCreated, newBucket(d))
+}
+
+func (s *Server) handleGetBucket(c *gin.Context) {
+	d, err := s.db.GetDatabaseByID(c.Param("bucketID"))
+	if err != nil {
+		s.bucketError(c, err)
+		return
+	}
+	if !s.authorize(c, persistence.ScopeRead, d.Name) {
+		return
+	}
+	c.JSON(http.StatusOK, newBucket(d))
+}
+
+func (s *Server) handleUpdateBucket(c *gin.Context) {
+	var req patchBucketRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid bucket: %v", err))
+		return
+	}
+
+	update := persistence.DatabaseUpdate{Name: req.Name, Description: req.Description}
+	if req.RetentionRules != nil {
+		period, err := retentionPeriod(req.RetentionRules)
+		if err != nil {
+			writeError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		update.RetentionPeriod = &period
+	}
+	if req.Name != nil && !s.renameAllowed(c, c.Param("bucketID"), *req.Name) {
+		return
+	}
+
+	d, err := s.db.UpdateDatabase(c.Param("bucketID"), update)
+	if err != nil {
+		s.bucketError(c, err)
+		return
+	}
+	s.audit(c, "bucket.update", d.Name, "id "+d.ID)
+	c.JSON(http.StatusOK, newBucket(d))
+}
+
+// renameAllowed reports whether the database with the given ID may be
+// renamed to name. The databases of the tenants are set in the
+// configuration, so renaming one, or another database to one of their
+// names, would leave its points in the wrong file. Otherwise it answers
+// the request with a 422.
+func (s *Server) renameAllowed(c *gin.Context, id, name string) bool {
+	if s.tenants == nil {
+		return true
+	}
+	d, err := s.db.GetDatabaseByID(id)
+	if err != nil {
+		s.bucketError(c, err)
+		return false
+	}
+	if d.Name == name {
+		return true
+	}
+	for _, database := range []string{d.Name, name} {
+		if tenant, ok := s.tenants.TenantOf(database); ok {
+			writeError(c, http.StatusUnprocessableEntity, fmt.Sprintf("bucket %s belongs to tenant %s and cannot be renamed", database, tenant))
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) handleDeleteBucket(c *gin.Context) {
+	d, err := s.db.GetDatabaseByID(c.Param("bucketID"))
+	if err != nil {
+		s.bucketError(c, err)
+		return
+	}
+	if err := s.dropDatabase(c.Request.Context(), d.Name); err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	s.audit(c, "bucket.delete", d.Name, "id "+d.ID)
+	c.Status(http.StatusNoContent)
+}
+
+// bucketError maps catalog errors to HTTP responses
+func (s *Server) bucketError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, persistence.ErrDatabaseNotFound):
+		writeError(c, http.StatusNotFound, "bucket not found")
+	case errors.Is(err, persistence.ErrDatabaseExists):
+		writeError(c, http.StatusUnprocessableEntity, "bucket name already exists")
+	default:
+		writeError(c, storageStatus(err), err.Error())
+	}
+}
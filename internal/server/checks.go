@@ -0,0 +1,127 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/alerts"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// check is the v2 API representation of a threshold check and its latest
+// evaluation. The check name doubles as its ID.
+type check struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Status      string            `json:"status"`
+	Every       string            `json:"every"`
+	Database    string            `json:"database"`
+	Measurement string            `json:"measurement"`
+	Field       string            `json:"field"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Aggregation string            `json:"aggregation"`
+	Operator    string            `json:"operator"`
+	Threshold   float64           `json:"threshold"`
+	Window      string            `json:"window"`
+	Endpoints   []string          `json:"endpoints"`
+	// Level and the fields below describe the latest evaluation. Level is
+	// empty until the check ran once.
+	Level           string     `json:"level"`
+	Value           *float64   `json:"value"`
+	Message         string     `json:"message,omitempty"`
+	LatestCompleted *time.Time `json:"latestCompleted,omitempty"`
+	LastChanged     *time.Time `json:"lastChanged,omitempty"`
+	LastRunStatus   string     `json:"lastRunStatus,omitempty"`
+	LastRunError    string     `json:"lastRunError,omitempty"`
+	Links           struct {
+		Self string `json:"self"`
+	} `json:"links"`
+}
+
+func newCheck(st alerts.Status) check {
+	c := st.Check
+	out := check{
+		ID:          c.Name,
+		Name:        c.Name,
+		Type:        "threshold",
+		Status:      "active",
+		Every:       c.Every.String(),
+		Database:    c.Database,
+		Measurement: c.Measurement,
+		Field:       c.Field,
+		Tags:        c.Tags,
+		Aggregation: c.Aggregation,
+		Operator:    c.Operator,
+		Threshold:   c.Threshold,
+		Window:      c.Window.String(),
+		Endpoints:   c.Notify,
+		Level:       st.Level,
+		Message:     st.Message,
+	}
+	if out.Endpoints == nil {
+		out.Endpoints = []string{}
+	}
+	if st.HasValue {
+		out.Value = &st.Value
+	}
+	if !st.LastRun.IsZero() {
+		lastRun, lastChange := st.LastRun.UTC(), st.LastChange.UTC()
+		out.LatestCompleted, out.LastChanged = &lastRun, &lastChange
+		out.LastRunStatus = "success"
+		if st.Err != "" {
+			out.LastRunStatus, out.LastRunError = "failed", st.Err
+		}
+	}
+	out.Links.Self = "/api/v2/checks/" + c.Name
+	return out
+}
+
+// visibleCheck returns the representation of a check for the token of
+// the request. The notification endpoints, whose URLs hold credentials,
+// are only shown to admins.
+func (s *Server) visibleCheck(c *gin.Context, st alerts.Status) check {
+	out := newCheck(st)
+	if !s.allowed(c, persistence.ScopeAdmin, "") {
+		out.Endpoints = []string{}
+	}
+	return out
+}
+
+// handleListChecks answers GET /api/v2/checks with the configured checks
+// of the readable databases and their latest status, paged with offset
+// and limit
+func (s *Server) handleListChecks(c *gin.Context) {
+	offset, limit, err := parsePage(c)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	checks := make([]check, 0)
+	if s.alerts != nil {
+		for _, st := range s.alerts.Statuses() {
+			if s.allowed(c, persistence.ScopeRead, st.Check.Database) {
+				checks = append(checks, s.visibleCheck(c, st))
+			}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"checks": page(checks, offset, limit),
+		"links":  gin.H{"self": "/api/v2/checks"},
+	})
+}
+
+// handleGetCheck answers GET /api/v2/checks/:checkID
+func (s *Server) handleGetCheck(c *gin.Context) {
+	if s.alerts != nil {
+		if st, ok := s.alerts.Status(c.Param("checkID")); ok {
+			if s.authorize(c, persistence.ScopeRead, st.Check.Database) {
+				c.JSON(http.StatusOK, s.visibleCheck(c, st))
+			}
+			return
+		}
+	}
+	writeError(c, http.StatusNotFound, "check not found")
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// compaction is the API representation of a storage compaction, sizes
+// being in bytes
+type compaction struct {
+	Full       bool    `json:"full"`
+	SizeBefore int64   `json:"sizeBefore"`
+	SizeAfter  int64   `json:"sizeAfter"`
+	FreeBefore int64   `json:"freeBefore"`
+	FreeAfter  int64   `json:"freeAfter"`
+	Reclaimed  int64   `json:"reclaimed"`
+	Seconds    float64 `json:"seconds"`
+}
+
+// handleCompact answers POST /api/v2/compact by compacting the storage
+// now, releasing the free pages left by deletes to the file system. With
+// full=true the whole file is rebuilt; maxPages bounds the pages released
+// by an incremental compaction. Writes wait until it is done.
+func (s *Server) handleCompact(c *gin.Context) {
+	var opts persistence.CompactOptions
+	opts.Full = c.Query("full") == "true"
+	if v := c.Query("maxPages"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid maxPages: %s", v))
+			return
+		}
+		opts.MaxPages = n
+	}
+
+	result, err := s.db.Compact(c.Request.Context(), opts)
+	if err != nil {
+		s.logger(c).Errorf("Failed to compact storage: %v", err)
+		writeError(c, storageStatus(err), fmt.Sprintf("failed to compact storage: %v", err))
+		return
+	}
+	kind := "incremental"
+	if result.Full {
+		kind = "full"
+	}
+	s.audit(c, "storage.compact", "storage", fmt.Sprintf("%s compaction reclaimed %d bytes", kind, result.Reclaimed()))
+	c.JSON(http.StatusOK, compaction{
+		Full:       result.Full,
+		SizeBefore: result.SizeBefore,
+		SizeAfter:  result.SizeAfter,
+		FreeBefore: result.FreeBefore,
+		FreeAfter:  result.FreeAfter,
+		Reclaimed:  result.Reclaimed(),
+		Seconds:    result.Duration.Seconds(),
+	})
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// deadLetter is the API representation of a dropped line
+type deadLetter struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Database string    `json:"db"`
+	Source   string    `json:"source,omitempty"`
+	// Precision is the unit of the timestamp of the line, as the
+	// precision parameter of /api/v2/write
+	Precision string `json:"precision"`
+	Line      string `json:"line"`
+	Error     string `json:"error"`
+}
+
+// replayRequest is the body of POST /api/v2/deadletters/replay
+type replayRequest struct {
+	Entries []struct {
+		ID int64 `json:"id"`
+		// Line replaces the recorded line when set
+		Line string `json:"line"`
+	} `json:"entries"`
+}
+
+// replayFailure is a dead letter that could not be replayed
+type replayFailure struct {
+	ID    int64  `json:"id"`
+	Error string `json:"error"`
+}
+
+// deadLetterFilter reads the db and since parameters shared by the dead
+// letter endpoints. It writes a 400 response and returns false when they
+// are invalid.
+func deadLetterFilter(c *gin.Context) (persistence.DeadLetterFilter, bool) {
+	f := persistence.DeadLetterFilter{Database: c.Query("db")}
+	if v := c.Query("since"); v != "" {
+		var err error
+		if f.Since, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid since: %v", err))
+			return f, false
+		}
+	}
+	return f, true
+}
+
+// handleDeadLetters answers GET /api/v2/deadletters with the lines dropped
+// since the RFC 3339 since parameter, from the db database when set, up to
+// limit lines, oldest first
+func (s *Server) handleDeadLetters(c *gin.Context) {
+	f, ok := deadLetterFilter(c)
+	if !ok {
+		return
+	}
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid limit: %s", v))
+			return
+		}
+		f.Limit = n
+	}
+
+	letters, err := s.db.DeadLetters(f)
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	entries := make([]deadLetter, 0, len(letters))
+	for _, l := range letters {
+		entries = append(entries, deadLetter{
+			ID:        l.ID,
+			Time:      l.Time,
+			Database:  l.Database,
+			Source:    l.Source,
+			Precision: precisionName(l.Precision),
+			Line:      l.Line,
+			Error:     l.Error,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"links":   gin.H{"self": "/api/v2/deadletters"},
+		"entries": entries,
+	})
+}
+
+// handleReplayDeadLetters answers POST /api/v2/deadletters/replay by
+// writing the recorded lines of the entries, or the corrected lines sent
+// in their place, to the database they were written to. Replayed lines
+// are removed from the dead letters, the others are reported as failed
+// and kept.
+func (s *Server) handleReplayDeadLetters(c *gin.Context) {
+	var req replayRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid replay: %v", err))
+		return
+	}
+	if len(req.Entries) == 0 {
+		writeError(c, http.StatusBadRequest, "invalid replay: expected entries")
+		return
+	}
+
+	var points []persistence.Point
+	var replayed []int64
+	failed := []replayFailure{}
+	for _, e := range req.Entries {
+		letter, ok, err := s.db.DeadLetter(e.ID)
+		if err != nil {
+			writeError(c, storageStatus(err), err.Error())
+			return
+		}
+		if !ok {
+			failed = append(failed, replayFailure{ID: e.ID, Error: "dead letter not found"})
+			continue
+		}
+		line := letter.Line
+		if e.Line != "" {
+			line = e.Line
+		}
+		parsed, err := s.parseDeadLetter(line, letter.Precision)
+		if err == nil && len(parsed) == 0 {
+			err = errors.New("no point in line")
+		}
+		if err != nil {
+			failed = append(failed, replayFailure{ID: e.ID, Error: err.Error()})
+			continue
+		}
+		for i := range parsed {
+			parsed[i].Database = letter.Database
+		}
+		points = append(points, parsed...)
+		replayed = append(replayed, e.ID)
+	}
+
+	if len(points) > 0 {
+		if err := s.saveBatch(c.Request.Context(), points); err != nil {
+			writeError(c, storageStatus(err), fmt.Sprintf("Failed to save measurement: %v", err))
+			return
+		}
+		pointsWritten.Add(uint64(len(points)))
+		if _, err := s.db.DeleteDeadLetters(persistence.DeadLetterFilter{}, replayed); err != nil {
+			writeError(c, storageStatus(err), err.Error())
+			return
+		}
+		s.audit(c, "deadletters.replay", "deadletters", fmt.Sprintf("%d lines replayed, %d failed", len(replayed), len(failed)))
+	}
+	c.JSON(http.StatusOK, gin.H{"replayed": len(replayed), "failed": failed})
+}
+
+// parseDeadLetter parses a dropped line with the write validation rules.
+// JSON writes record their points as JSON objects.
+func (s *Server) parseDeadLetter(line string, precision time.Duration) ([]persistence.Point, error) {
+	if strings.HasPrefix(strings.TrimSpace(line), "{") {
+		return s.parser.ParseJSON([]byte("[" + line + "]"))
+	}
+	return s.parser.ParseReaderPrecision(strings.NewReader(line), precision)
+}
+
+// handleDeleteDeadLetter answers DELETE /api/v2/deadletters/:id
+func (s *Server) handleDeleteDeadLetter(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid dead letter id: %s", c.Param("id")))
+		return
+	}
+	n, err := s.db.DeleteDeadLetters(persistence.DeadLetterFilter{}, []int64{id})
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	if n == 0 {
+		writeError(c, http.StatusNotFound, fmt.Sprintf("dead letter %d not found", id))
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handleClearDeadLetters answers DELETE /api/v2/deadletters by removing
+// the lines dropped since the since parameter from the db database, every
+// dropped line when neither is set
+func (s *Server) handleClearDeadLetters(c *gin.Context) {
+	f, ok := deadLetterFilter(c)
+	if !ok {
+		return
+	}
+	n, err := s.db.DeleteDeadLetters(f, nil)
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	s.audit(c, "deadletters.delete", "deadletters", fmt.Sprintf("%d lines removed", n))
+	c.JSON(http.StatusOK, gin.H{"deleted": n})
+}
+
+// precisionName is the precision parameter for timestamps in unit, the
+// inverse of writePrecision
+func precisionName(unit time.Duration) string {
+	switch unit {
+	case time.Microsecond:
+		return "us"
+	case time.Millisecond:
+		return "ms"
+	case time.Second:
+		return "s"
+	case time.Minute:
+		return "m"
+	case time.Hour:
+		return "h"
+	}
+	return "ns"
+}
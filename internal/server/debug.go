@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// guardDebug restricts the /debug endpoints, which expose profiles and
+// internals, to requests carrying the debug token, or to clients on the
+// same host when no token is configured. The peer address is used rather
+// than forwarding headers, which clients can forge.
+func (s *Server) guardDebug() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.debugToken != "" {
+			auth := c.GetHeader("Authorization")
+			token := strings.TrimPrefix(strings.TrimPrefix(auth, "Token "), "Bearer ")
+			if auth == "" || token == auth || subtle.ConstantTimeCompare([]byte(token), []byte(s.debugToken)) != 1 {
+				writeError(c, http.StatusUnauthorized, "a valid debug token is required")
+				return
+			}
+			c.Next()
+			return
+		}
+
+		host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			writeError(c, http.StatusForbidden, "debug endpoints are only served to localhost without a debug token")
+			return
+		}
+		c.Next()
+	}
+}
+
+// handlePprof serves the net/http/pprof profiles under /debug/pprof/
+func (s *Server) handlePprof(c *gin.Context) {
+	switch c.Param("profile") {
+	case "/cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "/profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "/symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "/trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		// Index serves the named profiles, such as heap and goroutine, as
+		// well as the index page
+		pprof.Index(c.Writer, c.Request)
+	}
+}
+
+// handleVars serves the expvar variables: the Go runtime memory
+// statistics, the command line and the refluxdb metrics
+func (s *Server) handleVars(c *gin.Context) {
+	expvar.Handler().ServeHTTP(c.Writer, c.Request)
+}
+
+// handleGetIntegrity answers GET /debug/integrity with the report of the
+// latest storage integrity check, running one if none ran yet
+func (s *Server) handleGetIntegrity(c *gin.Context) {
+	if report, ok := s.db.LatestIntegrityReport(); ok {
+		c.JSON(http.StatusOK, report)
+		return
+	}
+	s.checkIntegrity(c, false)
+}
+
+// handleCheckIntegrity answers POST /debug/integrity by running a storage
+// integrity check now. With repair=true, the issues that can be fixed
+// without losing points are repaired.
+func (s *Server) handleCheckIntegrity(c *gin.Context) {
+	s.checkIntegrity(c, c.Query("repair") == "true")
+}
+
+func (s *Server) checkIntegrity(c *gin.Context, repair bool) {
+	report, err := s.db.CheckIntegrity(c.Request.Context(), repair)
+	if err != nil {
+		s.logger(c).Errorf("Failed to check storage integrity: %v", err)
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
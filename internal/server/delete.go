@@ -0,0 +1,230 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// deleteRequest is the body of a v2 delete
+type deleteRequest struct {
+	Start     string `json:"start"`
+	Stop      string `json:"stop"`
+	Predicate string `json:"predicate"`
+}
+
+// handleDelete answers POST /api/v2/delete, deleting the points of a bucket
+// between start and stop, both RFC3339 times and included, that match the
+// predicate, as InfluxDB 2.x does. The deletion is recorded in the audit
+// log.
+func (s *Server) handleDelete(c *gin.Context) {
+	bucket, ok := s.bucketParam(c)
+	if !ok {
+		return
+	}
+	if !s.authorize(c, persistence.ScopeWrite, bucket) {
+		return
+	}
+	exists, err := s.db.HasDatabase(bucket)
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	if !exists {
+		writeError(c, http.StatusNotFound, fmt.Sprintf("bucket %q not found", bucket))
+		return
+	}
+
+	var req deleteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid delete request: %v", err))
+		return
+	}
+	start, err := deleteTime("start", req.Start)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	stop, err := deleteTime("stop", req.Stop)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if start > stop {
+		writeError(c, http.StatusBadRequest, "invalid delete request: start is after stop")
+		return
+	}
+	measurement, tags, err := parseDeletePredicate(req.Predicate)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid predicate: %v", err))
+		return
+	}
+
+	store, release, ok := s.storageFor(c, bucket)
+	if !ok {
+		return
+	}
+	deleted, err := store.DeleteRangeContext(c.Request.Context(), bucket, start, stop, measurement, tags)
+	release()
+	if err != nil {
+		s.logger(c).Errorf("Failed to delete points of %s: %v", bucket, err)
+		writeError(c, storageStatus(err), fmt.Sprintf("failed to delete points: %v", err))
+		return
+	}
+	pointsDeleted.Add(uint64(deleted))
+	detail := fmt.Sprintf("%d points from %s to %s", deleted, req.Start, req.Stop)
+	if req.Predicate != "" {
+		detail += " where " + req.Predicate
+	}
+	s.audit(c, "data.delete", bucket, detail)
+	s.logger(c).Infof("Deleted %d points of %s", deleted, bucket)
+	c.Status(http.StatusNoContent)
+}
+
+// deleteTime parses the start or stop time of a delete
+func deleteTime(name, value string) (int64, error) {
+	if value == "" {
+		return 0, fmt.Errorf("invalid delete request: %s is required", name)
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid delete request: %s must be an RFC3339 time: %v", name, err)
+	}
+	return persistence.Nanoseconds(t)
+}
+
+// parseDeletePredicate parses the predicate of a v2 delete: equality
+// comparisons joined by AND, such as _measurement="cpu" AND host="a".
+// Values are quoted, with double or single quotes, and keys may be double
+// quoted. _measurement selects the measurement and other keys are tags. An
+// empty predicate matches every point.
+func parseDeletePredicate(s string) (measurement string, tags map[string]string, err error) {
+	p := &predicateScanner{s: s}
+	p.skipSpaces()
+	for !p.done() {
+		key, err := p.key()
+		if err != nil {
+			return "", nil, err
+		}
+		p.skipSpaces()
+		switch {
+		case strings.HasPrefix(p.s[p.i:], "!="):
+			return "", nil, fmt.Errorf("unsupported operator != on %s: only = is supported", key)
+		case p.done() || p.s[p.i] != '=':
+			return "", nil, fmt.Errorf("expected = after %s", key)
+		}
+		p.i++
+		p.skipSpaces()
+		value, err := p.value()
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid value of %s: %w", key, err)
+		}
+
+		switch key {
+		case "_measurement":
+			if measurement != "" && measurement != value {
+				return "", nil, fmt.Errorf("conflicting values of _measurement")
+			}
+			measurement = value
+		case "_field":
+			return "", nil, fmt.Errorf("deleting by _field is not supported")
+		default:
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			if v, ok := tags[key]; ok && v != value {
+				return "", nil, fmt.Errorf("conflicting values of %s", key)
+			}
+			tags[key] = value
+		}
+
+		p.skipSpaces()
+		if p.done() {
+			break
+		}
+		word := p.word()
+		switch strings.ToUpper(word) {
+		case "AND":
+			p.skipSpaces()
+			if p.done() {
+				return "", nil, fmt.Errorf("expected a comparison after AND")
+			}
+		case "OR":
+			return "", nil, fmt.Errorf("unsupported operator OR: only AND is supported")
+		default:
+			return "", nil, fmt.Errorf("unexpected %q, expected AND", word)
+		}
+	}
+	return measurement, tags, nil
+}
+
+// predicateScanner reads the tokens of a delete predicate
+type predicateScanner struct {
+	s string
+	i int
+}
+
+func (p *predicateScanner) done() bool {
+	return p.i >= len(p.s)
+}
+
+func (p *predicateScanner) skipSpaces() {
+	for !p.done() && (p.s[p.i] == ' ' || p.s[p.i] == '\t' || p.s[p.i] == '\n' || p.s[p.i] == '\r') {
+		p.i++
+	}
+}
+
+// word reads the characters up to the next space, quote or operator
+func (p *predicateScanner) word() string {
+	start := p.i
+	for !p.done() && !strings.ContainsRune(" \t\r\n=!\"'", rune(p.s[p.i])) {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+// key reads a bare or double quoted key
+func (p *predicateScanner) key() (string, error) {
+	if p.s[p.i] == '"' {
+		return p.quoted()
+	}
+	key := p.word()
+	if key == "" {
+		return "", fmt.Errorf("expected a key at %q", p.s[p.i:])
+	}
+	return key, nil
+}
+
+// value reads a double or single quoted value
+func (p *predicateScanner) value() (string, error) {
+	if p.done() || (p.s[p.i] != '"' && p.s[p.i] != '\'') {
+		return "", fmt.Errorf("expected a quoted string")
+	}
+	return p.quoted()
+}
+
+// quoted reads a string quoted by the current character, in which
+// backslashes escape the next character
+func (p *predicateScanner) quoted() (string, error) {
+	quote := p.s[p.i]
+	p.i++
+	var sb strings.Builder
+	for !p.done() {
+		c := p.s[p.i]
+		p.i++
+		switch {
+		case c == '\\' && !p.done():
+			sb.WriteByte(p.s[p.i])
+			p.i++
+		case c == quote:
+			return sb.String(), nil
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/result"
+)
+
+// singleRow is a series of a single row built column by column, the
+// shape of the SHOW STATS and SHOW DIAGNOSTICS series
+type singleRow struct {
+	series *result.Series
+	row    []interface{}
+}
+
+// newSingleRow starts a series named after a module
+func newSingleRow(name string, tags map[string]string) *singleRow {
+	series := result.NewSeries(name)
+	series.Tags = tags
+	return &singleRow{series: series}
+}
+
+// add appends a column holding v
+func (s *singleRow) add(name string, v interface{}) *singleRow {
+	typ := result.String
+	switch v.(type) {
+	case int64:
+		typ = result.Integer
+	case float64:
+		typ = result.Float
+	}
+	s.series.Columns = append(s.series.Columns, result.Column{Name: name, Type: typ})
+	s.row = append(s.row, v)
+	return s
+}
+
+// done appends the row and returns the series
+func (s *singleRow) done() *result.Series {
+	s.series.Append(s.row...)
+	return s.series
+}
+
+// handleShowDiagnostics answers SHOW DIAGNOSTICS with the build, runtime,
+// network and system information InfluxDB reports, which Chronograf reads
+// when connecting to a source
+func (s *Server) handleShowDiagnostics(c *gin.Context) {
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	resp := result.New(
+		newSingleRow("build", nil).
+			add("Branch", "").
+			add("Build Time", "").
+			add("Commit", Commit).
+			add("Version", Version).done(),
+		newSingleRow("network", nil).
+			add("hostname", hostname).done(),
+		newSingleRow("runtime", nil).
+			add("GOARCH", runtime.GOARCH).
+			add("GOMAXPROCS", int64(runtime.GOMAXPROCS(0))).
+			add("GOOS", runtime.GOOS).
+			add("version", runtime.Version()).done(),
+		newSingleRow("system", nil).
+			add("PID", int64(os.Getpid())).
+			add("currentTime", now.UTC().Format(time.RFC3339Nano)).
+			add("started", s.start.UTC().Format(time.RFC3339Nano)).
+			add("uptime", now.Sub(s.start).Truncate(time.Second).String()).done(),
+	)
+	s.writeResult(c, http.StatusOK, resp, result.Options{})
+}
+
+// handleShowStats answers SHOW STATS [FOR 'module'] with one series per
+// module, as InfluxDB does: the Go runtime, the HTTP service counters and
+// the measurements and series of each database
+func (s *Server) handleShowStats(c *gin.Context, query string) {
+	module, err := showStatsModule(query)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid query format: %v", err))
+		return
+	}
+
+	var series []*result.Series
+	if module == "" || module == "runtime" {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		series = append(series, newSingleRow("runtime", nil).
+			add("Alloc", int64(mem.Alloc)).
+			add("Frees", int64(mem.Frees)).
+			add("HeapAlloc", int64(mem.HeapAlloc)).
+			add("HeapIdle", int64(mem.HeapIdle)).
+			add("HeapInUse", int64(mem.HeapInuse)).
+			add("HeapObjects", int64(mem.HeapObjects)).
+			add("HeapReleased", int64(mem.HeapReleased)).
+			add("HeapSys", int64(mem.HeapSys)).
+			add("Lookups", int64(mem.Lookups)).
+			add("Mallocs", int64(mem.Mallocs)).
+			add("NumGC", int64(mem.NumGC)).
+			add("NumGoroutine", int64(runtime.NumGoroutine())).
+			add("PauseTotalNs", int64(mem.PauseTotalNs)).
+			add("Sys", int64(mem.Sys)).
+			add("TotalAlloc", int64(mem.TotalAlloc)).done())
+	}
+	if module == "" || module == "httpd" {
+		series = append(series, newSingleRow("httpd", map[string]string{"bind": s.addr}).
+			add("clientRejected", int64(clientsRejected.Value())).
+			add("pointsWrittenOK", int64(pointsWritten.Value())).
+			add("queryReq", int64(queryDuration.With("v1").Count()+queryDuration.With("v2").Count())).
+			add("queryTimeout", int64(queryTimeouts.Value())).
+			add("writeReq", int64(writeRequests.Value())).done())
+	}
+	if module == "" || module == "database" {
+		databases, err := s.db.ListDatabasesContext(c.Request.Context())
+		if err != nil {
+			s.logger(c).Errorf("Failed to list databases: %v", err)
+			writeError(c, storageStatus(err), fmt.Sprintf("failed to list databases: %v", err))
+			return
+		}
+		sort.Strings(databases)
+		ctx, cancel := s.queryContext(c)
+		defer cancel()
+		for _, db := range databases {
+			if !s.allowed(c, persistence.ScopeRead, db) {
+				continue
+			}
+			store, release, ok := s.storageFor(c, db)
+			if !ok {
+				return
+			}
+			measurements, err := store.ListTimeseriesContext(ctx, db)
+			var keys []string
+			if err == nil {
+				keys, err = store.ListSeries(ctx, db, "")
+			}
+			release()
+			if s.queryAborted(c, ctx, err) {
+				return
+			}
+			if err != nil {
+				s.logger(c).Errorf("Failed to list series: %v", err)
+				writeError(c, storageStatus(err), fmt.Sprintf("failed to list series: %v", err))
+				return
+			}
+			series = append(series, newSingleRow("database", map[string]string{"database": db}).
+				add("numMeasurements", int64(len(measurements))).
+				add("numSeries", int64(len(keys))).done())
+		}
+	}
+	s.writeResult(c, http.StatusOK, result.New(series...), result.Options{})
+}
+
+// showStatsModule returns the module of a SHOW STATS FOR 'module'
+// statement, or an empty string for every module
+func showStatsModule(query string) (string, error) {
+	tail, ok := afterKeyword(query, "for")
+	if !ok {
+		return "", nil
+	}
+	module := strings.TrimSuffix(strings.TrimSpace(tail), ";")
+	if len(module) < 2 || module[0] != '\'' || module[len(module)-1] != '\'' {
+		return "", fmt.Errorf("SHOW STATS FOR expects a quoted module such as 'httpd'")
+	}
+	return strings.ToLower(module[1 : len(module)-1]), nil
+}
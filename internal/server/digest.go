@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/result"
+)
+
+// digestCall is a call to percentile(), median() or histogram(), which are
+// estimated from t-digests computed while the points are scanned
+type digestCall struct {
+	name  string
+	field string
+	alias string
+	// percentile is the percentile of percentile() and median(), from 0
+	// to 100
+	percentile float64
+	// bounds are the upper bounds of the bins of histogram(), ascending
+	bounds []float64
+}
+
+// parseDigestCall returns the percentile(), median() or histogram() call
+// of the SELECT clause of query, or nil when it does not call one
+func parseDigestCall(query string) (*digestCall, error) {
+	clause, err := selectClause(query)
+	if err != nil {
+		return nil, err
+	}
+	text, alias := splitAlias(clause)
+	text = strings.TrimSpace(text)
+	open := strings.IndexByte(text, '(')
+	if open == -1 {
+		return nil, nil
+	}
+	name := strings.ToLower(strings.TrimSpace(text[:open]))
+	switch name {
+	case "percentile", "median", "histogram":
+	default:
+		return nil, nil
+	}
+	if len(splitList(clause)) > 1 {
+		return nil, fmt.Errorf("%s cannot be selected with other fields", name)
+	}
+	if !strings.HasSuffix(text, ")") {
+		return nil, fmt.Errorf("missing ) after the arguments of %s", name)
+	}
+
+	call := &digestCall{name: name, alias: alias}
+	args := splitList(text[open+1 : len(text)-1])
+	if call.field, err = identifier(args[0]); err != nil {
+		return nil, fmt.Errorf("invalid argument of %s: %w", name, err)
+	}
+	numbers := make([]float64, len(args)-1)
+	for i, arg := range args[1:] {
+		if numbers[i], err = strconv.ParseFloat(strings.TrimSpace(arg), 64); err != nil || math.IsNaN(numbers[i]) || math.IsInf(numbers[i], 0) {
+			return nil, fmt.Errorf("expected a number as argument of %s, got %s", name, strings.TrimSpace(arg))
+		}
+	}
+
+	switch name {
+	case "median":
+		if len(numbers) != 0 {
+			return nil, fmt.Errorf("invalid number of arguments for median, expected 1, got %d", len(args))
+		}
+		call.percentile = 50
+	case "percentile":
+		if len(numbers) != 1 {
+			return nil, fmt.Errorf("invalid number of arguments for percentile, expected 2, got %d", len(args))
+		}
+		if numbers[0] < 0 || numbers[0] > 100 {
+			return nil, fmt.Errorf("percentile must be between 0 and 100, got %v", numbers[0])
+		}
+		call.percentile = numbers[0]
+	case "histogram":
+		if len(numbers) == 0 {
+			return nil, fmt.Errorf("histogram requires the upper bound of at least one bin")
+		}
+		for i := 1; i < len(numbers); i++ {
+			if numbers[i] <= numbers[i-1] {
+				return nil, fmt.Errorf("histogram bounds must be in ascending order")
+			}
+		}
+		call.bounds = numbers
+	}
+	return call, nil
+}
+
+// digestSeries returns the percentile of every digest, or for
+// histogram() one row per bin holding its upper bound as le and the
+// estimated number of values less than or equal to it
+func digestSeries(measurement string, call *digestCall, digests []persistence.FieldDigest) *result.Series {
+	column := call.alias
+	if column == "" {
+		column = call.name
+	}
+
+	if call.bounds == nil {
+		series := result.NewSeries(measurement,
+			result.Column{Name: "time", Type: result.Time},
+			result.Column{Name: column, Type: result.Float},
+		)
+		for _, d := range digests {
+			series.Append(d.Start, d.Digest.Quantile(call.percentile/100))
+		}
+		return series
+	}
+
+	series := result.NewSeries(measurement,
+		result.Column{Name: "time", Type: result.Time},
+		result.Column{Name: "le", Type: result.Float},
+		result.Column{Name: column, Type: result.Integer},
+	)
+	for _, d := range digests {
+		for _, bound := range call.bounds {
+			series.Append(d.Start, bound, int64(math.Round(d.Digest.CDF(bound)*d.Digest.Count())))
+		}
+	}
+	return series
+}
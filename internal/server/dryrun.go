@@ -0,0 +1,104 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/ingest"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/xform"
+)
+
+// transformTestRequest is the body of POST /api/v2/transforms/test
+type transformTestRequest struct {
+	// Lines is line protocol, as written to /api/v2/write
+	Lines string `json:"lines"`
+	// Rules are tested instead of the configured transforms when set
+	Rules []xform.Rule `json:"rules"`
+}
+
+// transformPoint is the API representation of a point, time being a
+// nanosecond epoch
+type transformPoint struct {
+	Measurement string             `json:"measurement"`
+	Tags        map[string]string  `json:"tags,omitempty"`
+	Fields      map[string]float64 `json:"fields"`
+	Time        int64              `json:"time"`
+}
+
+// transformTest is what the transforms do to one point, reported in the
+// order of the lines
+type transformTest struct {
+	Input transformPoint `json:"input"`
+	// Output is nil when the point is dropped
+	Output  *transformPoint `json:"output"`
+	Rules   []string        `json:"rules"`
+	Dropped bool            `json:"dropped"`
+	// Misses lists the field expressions without a value, as rule.field
+	Misses []string `json:"misses,omitempty"`
+}
+
+// handleTestTransforms answers POST /api/v2/transforms/test with what the
+// configured transforms, or the rules of the request, do to the points of
+// some line protocol, without writing them. Lines that cannot be parsed
+// are reported in errors.
+func (s *Server) handleTestTransforms(c *gin.Context) {
+	var req transformTestRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid transform test: %v", err))
+		return
+	}
+	set := s.transforms
+	if req.Rules != nil {
+		var err error
+		if set, err = xform.New(req.Rules); err != nil {
+			writeError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	// Templates apply before the transforms, the time window is left out
+	// so that old samples can be tested
+	parser := ingest.NewParser(ingest.Options{
+		Templates: s.write.Templates,
+		Mode:      s.write.Mode,
+		MaxLines:  s.write.MaxLines,
+		MaxBytes:  s.write.MaxBytes,
+	})
+	points, err := parser.ParseReader(strings.NewReader(req.Lines))
+	var partial *ingest.PartialWriteError
+	if err != nil && !errors.As(err, &partial) {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tests := make([]transformTest, 0, len(points))
+	for _, p := range points {
+		res := set.Test(p)
+		test := transformTest{Input: newTransformPoint(p), Rules: res.Rules, Dropped: res.Dropped, Misses: res.Misses}
+		if test.Rules == nil {
+			test.Rules = []string{}
+		}
+		if !res.Dropped {
+			out := newTransformPoint(res.Point)
+			test.Output = &out
+		}
+		tests = append(tests, test)
+	}
+	resp := gin.H{"points": tests}
+	if partial != nil {
+		errs := make([]string, 0, len(partial.Dropped))
+		for _, r := range partial.Dropped {
+			errs = append(errs, fmt.Sprintf("line %d: %s", r.Line, r.Reason))
+		}
+		resp["errors"] = errs
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+func newTransformPoint(p persistence.Point) transformPoint {
+	return transformPoint{Measurement: p.Measurement, Tags: p.Tags, Fields: p.Fields, Time: p.Timestamp}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// errorCodes are the codes of the v2 API errors, by status. Clients such
+// as influxdb-client-go decide whether to retry from the status and code.
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "invalid",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not found",
+	http.StatusMethodNotAllowed:      "method not allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "request too large",
+	http.StatusUnsupportedMediaType:  "unsupported media type",
+	http.StatusUnprocessableEntity:   "unprocessable entity",
+	http.StatusTooManyRequests:       "too many requests",
+	http.StatusNotImplemented:        "not implemented",
+	http.StatusServiceUnavailable:    "unavailable",
+	// InfluxDB has no code for timeouts, which are not worth retrying
+	// as they are
+	http.StatusRequestTimeout: "invalid",
+}
+
+// errorHeaderReplacer keeps multi-line messages on the single line of the
+// X-Influxdb-Error header
+var errorHeaderReplacer = strings.NewReplacer("\r\n", " ", "\n", " ", "\r", " ")
+
+// errorCode returns the v2 API code of an error response of status
+func errorCode(status int) string {
+	if code, ok := errorCodes[status]; ok {
+		return code
+	}
+	if status >= http.StatusInternalServerError {
+		return "internal error"
+	}
+	return "invalid"
+}
+
+// storageStatus returns the status of an error returned by the storage:
+// 404 when something does not exist, 409 when it already does, 503 when
+// the storage gave up waiting for a lock, which clients retry, and 500
+// otherwise
+func storageStatus(err error) int {
+	switch {
+	case errors.Is(err, persistence.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, persistence.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, persistence.ErrTimeout):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError answers the request with an error and stops the handler
+// chain. The v2 API routes answer {"code": ..., "message": ...} as
+// InfluxDB 2.x does, the others {"error": ...} as InfluxDB 1.x does. 429
+// and 503 responses tell clients when to retry, after a second unless the
+// handler already set Retry-After.
+//
+// The message is also sent in the X-Influxdb-Error header, which telegraf
+// and the client libraries log and inspect before the body, along with
+// the X-Influxdb-Version and X-Request-Id headers set by the middlewares.
+func writeError(c *gin.Context, status int, message string) {
+	h := c.Writer.Header()
+	h.Set("X-Influxdb-Error", errorHeaderReplacer.Replace(message))
+	if h.Get("X-Influxdb-Version") == "" {
+		h.Set("X-Influxdb-Version", Version)
+	}
+	if h.Get(requestIDHeader) == "" {
+		if id := c.GetHeader(requestIDHeader); id != "" {
+			h.Set(requestIDHeader, id)
+		} else {
+			h.Set(requestIDHeader, newRequestID())
+		}
+	}
+	if (status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable) && c.Writer.Header().Get("Retry-After") == "" {
+		c.Header("Retry-After", "1")
+	}
+	if strings.HasPrefix(c.Request.URL.Path, "/api/v2/") {
+		c.AbortWithStatusJSON(status, gin.H{"code": errorCode(status), "message": message})
+		return
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": message})
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gleicon/go-refluxdb/internal/result"
+)
+
+// capturedResultKey marks the requests made by Execute in their context
+type capturedResultKey struct{}
+
+// capturedResult receives the response of a request made by Execute
+// instead of it being encoded
+type capturedResult struct {
+	resp *result.Response
+}
+
+// discardResponse is the response writer of the requests made by Execute,
+// keeping the body of error responses
+type discardResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *discardResponse) Header() http.Header         { return w.header }
+func (w *discardResponse) Write(b []byte) (int, error) { return w.body.Write(b) }
+func (w *discardResponse) WriteHeader(status int)      { w.status = status }
+
+// Execute runs an InfluxQL statement against database through the v1
+// query endpoint, with its limits and timeout, and returns the result
+// before it is encoded. Statement errors are reported in the result, and
+// requests the endpoint rejects are returned as errors.
+func (s *Server) Execute(ctx context.Context, database, query string) (*result.Response, error) {
+	captured := &capturedResult{}
+	ctx = context.WithValue(ctx, capturedResultKey{}, captured)
+	target := "/query?" + url.Values{"db": {database}, "q": {query}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &discardResponse{header: make(http.Header), status: http.StatusOK}
+	s.router.ServeHTTP(w, req)
+	if captured.resp != nil {
+		return captured.resp, nil
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(w.body.Bytes(), &body) == nil && body.Error != "" {
+		return nil, fmt.Errorf("%s", body.Error)
+	}
+	return nil, fmt.Errorf("query failed with status %d", w.status)
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/result"
+)
+
+// handleExplain answers EXPLAIN SELECT with how the statement would read
+// db, without running it: for every measurement, the tags required by
+// the WHERE clause the series index was asked about, the hours holding
+// points in the time range according to the hour index, the range
+// actually scanned and, with GROUP BY time(), the buckets expected. The
+// plan is returned as a QUERY PLAN column with a line per row, as
+// InfluxDB does.
+func (s *Server) handleExplain(c *gin.Context, db, query string) {
+	queryLower := strings.ToLower(query)
+	if strings.HasPrefix(queryLower, "analyze") {
+		writeError(c, http.StatusBadRequest, "EXPLAIN ANALYZE is not supported")
+		return
+	}
+	if !strings.HasPrefix(queryLower, "select") {
+		writeError(c, http.StatusBadRequest, "EXPLAIN only supports SELECT statements")
+		return
+	}
+
+	where, start, end, err := parseWhere(whereClause(query), time.Now(), 0, time.Now().UnixNano())
+	var sources []source
+	if err == nil {
+		sources, err = parseFrom(query)
+	}
+	var buckets timeBuckets
+	groupByTime := indexUnquoted(query, "group by time", false) != -1
+	if err == nil && groupByTime {
+		var interval time.Duration
+		if interval, err = groupByTimeInterval(queryLower); err == nil {
+			buckets.interval = int64(interval)
+			buckets.loc, err = parseTimezone(query)
+		}
+	}
+	if err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid query format: %v", err))
+		return
+	}
+
+	store, release, ok := s.storageFor(c, db)
+	if !ok {
+		return
+	}
+	defer release()
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+	measurements, err := resolveSources(ctx, store, db, sources)
+	if s.queryAborted(c, ctx, err) {
+		return
+	}
+	if err != nil {
+		writeError(c, storageStatus(err), fmt.Sprintf("failed to list measurements: %v", err))
+		return
+	}
+
+	format := func(ts int64) string {
+		return time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
+	}
+	plan := []string{
+		"DATABASE: " + db,
+		"TIME RANGE: " + format(start) + " - " + format(end),
+	}
+	if groupByTime {
+		plan = append(plan, "GROUP BY TIME: "+time.Duration(buckets.interval).String())
+	}
+	tags := requiredTagsString(where)
+	for _, m := range measurements {
+		plan = append(plan, "MEASUREMENT: "+m)
+		if tags != "" {
+			kept, err := withTags(ctx, store, db, []string{m}, where)
+			if s.queryAborted(c, ctx, err) {
+				return
+			}
+			if err != nil {
+				writeError(c, storageStatus(err), fmt.Sprintf("failed to look up series: %v", err))
+				return
+			}
+			if len(kept) == 0 {
+				plan = append(plan, "  SERIES INDEX: no series with "+tags+", skipped")
+				continue
+			}
+			plan = append(plan, "  SERIES INDEX: series may have "+tags)
+		}
+
+		_, hours, err := dataHours(ctx, store, db, []string{m}, start, end)
+		if s.queryAborted(c, ctx, err) {
+			return
+		}
+		if err != nil {
+			writeError(c, storageStatus(err), fmt.Sprintf("failed to count points: %v", err))
+			return
+		}
+		if len(hours) == 0 {
+			plan = append(plan, "  HOURS WITH POINTS: 0, skipped")
+			continue
+		}
+		points := int64(0)
+		for _, h := range hours {
+			points += h.Points
+		}
+		plan = append(plan, fmt.Sprintf("  HOURS WITH POINTS: %d", len(hours)), fmt.Sprintf("  POINTS: at most %d", points))
+		if groupByTime {
+			from, to := hoursRange(hours, start, end)
+			plan = append(plan, "  SCAN RANGE: "+format(from)+" - "+format(to), fmt.Sprintf("  EXPECTED BUCKETS: %d", expectedBuckets(hours, buckets)))
+		}
+	}
+
+	series := result.NewSeries("", result.Column{Name: "QUERY PLAN", Type: result.String})
+	series.Append("----------")
+	for _, line := range plan {
+		series.Append(line)
+	}
+	s.writeResult(c, http.StatusOK, result.New(series), result.Options{})
+}
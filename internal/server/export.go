@@ -0,0 +1,81 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/export"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// parseExportTime accepts a nanosecond epoch or an RFC3339 timestamp
+func parseExportTime(value string, fallback int64) (int64, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if ns, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ns, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: expected nanoseconds or RFC3339", value)
+	}
+	return persistence.Nanoseconds(t)
+}
+
+// handleExport streams stored points as line protocol. The response is
+// gzip compressed when the client accepts it.
+func (s *Server) handleExport(c *gin.Context) {
+	database := c.Query("db")
+	if database == "" {
+		database = c.Query("bucket")
+	}
+	// Exporting every database requires reading them all
+	if !s.authorize(c, persistence.ScopeRead, database) {
+		return
+	}
+
+	start, err := parseExportTime(c.Query("start"), 0)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	end, err := parseExportTime(c.Query("end"), math.MaxInt64)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Without a database, the points of the main file are exported
+	store, release, ok := s.storageFor(c, database)
+	if !ok {
+		return
+	}
+	defer release()
+
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	var w io.Writer = c.Writer
+	if strings.Contains(c.GetHeader("Accept-Encoding"), "gzip") {
+		c.Header("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(c.Writer)
+		defer gz.Close()
+		w = gz
+	}
+	c.Status(http.StatusOK)
+
+	filter := export.Filter{Database: database, Measurement: c.Query("measurement"), Start: start, End: end}
+	n, err := export.Export(w, store, filter)
+	if err != nil {
+		// Headers are already sent, so the error can only be logged
+		s.logger(c).Errorf("Export failed after %d points: %v", n, err)
+		return
+	}
+	s.logger(c).Debugf("Exported %d points", n)
+}
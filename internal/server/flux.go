@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/result"
+)
+
+// fluxRequest is the JSON body of a Flux query sent to /api/v2/query
+type fluxRequest struct {
+	Query   string       `json:"query"`
+	Dialect *fluxDialect `json:"dialect"`
+}
+
+// fluxDialect is the CSV dialect of a Flux query, which the Grafana Flux
+// data source sets explicitly. The settings left out take the InfluxDB
+// defaults.
+type fluxDialect struct {
+	Header        *bool    `json:"header"`
+	Delimiter     string   `json:"delimiter"`
+	Annotations   []string `json:"annotations"`
+	CommentPrefix string   `json:"commentPrefix"`
+}
+
+// fluxQuery returns the Flux script of a v2 query request, sent either as
+// a JSON document or as an application/vnd.flux body, and the CSV dialect
+// of the response, nil when the request sets none. It returns an empty
+// script for requests that do not carry one.
+func fluxQuery(c *gin.Context) (string, *result.Dialect, error) {
+	if c.Request.Method != http.MethodPost {
+		return "", nil, nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+	if mediaType != "application/json" && mediaType != "application/vnd.flux" {
+		return "", nil, nil
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	if mediaType == "application/vnd.flux" {
+		return strings.TrimSpace(string(body)), nil, nil
+	}
+
+	var req fluxRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return "", nil, fmt.Errorf("invalid query body: %w", err)
+	}
+	if req.Dialect == nil {
+		return strings.TrimSpace(req.Query), nil, nil
+	}
+	dialect := result.DefaultDialect()
+	if req.Dialect.Header != nil {
+		dialect.Header = *req.Dialect.Header
+	}
+	if req.Dialect.Delimiter != "" {
+		dialect.Delimiter = req.Dialect.Delimiter
+	}
+	if req.Dialect.CommentPrefix != "" {
+		dialect.CommentPrefix = req.Dialect.CommentPrefix
+	}
+	dialect.Annotations = req.Dialect.Annotations
+	if err := dialect.Validate(); err != nil {
+		return "", nil, fmt.Errorf("invalid dialect: %w", err)
+	}
+	return strings.TrimSpace(req.Query), &dialect, nil
+}
+
+// handleFluxQuery answers the Flux queries refluxdb understands and
+// reports whether the request carried one. Only buckets(), which the
+// Grafana Flux data source runs to test the connection, is supported;
+// other scripts get a 400 response. Like writes and queries, it ignores
+// the org parameter and lists every bucket. The CSV follows the dialect of
+// the request, annotated with every annotation when it sets none.
+func (s *Server) handleFluxQuery(c *gin.Context) bool {
+	script, dialect, err := fluxQuery(c)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return true
+	}
+	if script == "" {
+		return false
+	}
+	traceOf(c).setQuery("", script)
+	if script != "buckets()" {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("unsupported Flux query %q: only buckets() is supported", script))
+		return true
+	}
+
+	databases, err := s.db.Databases()
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return true
+	}
+
+	series := result.NewSeries("buckets",
+		result.Column{Name: "name", Type: result.String},
+		result.Column{Name: "id", Type: result.String},
+		result.Column{Name: "organizationID", Type: result.String},
+		result.Column{Name: "retentionPeriod", Type: result.Integer},
+	)
+	for _, d := range databases {
+		if s.allowed(c, persistence.ScopeRead, d.Name) {
+			series.Append(d.Name, d.ID, d.OrgID, int64(d.RetentionPeriod))
+		}
+	}
+
+	// Flux results are always annotated CSV
+	resp := result.New(series)
+	trace := traceOf(c)
+	trace.encode(resp)
+	defer trace.encodeDone()
+	var buf bytes.Buffer
+	enc := result.CSVEncoder{Dialect: dialect}
+	if err := enc.Encode(&buf, resp); err != nil {
+		writeError(c, http.StatusInternalServerError, err.Error())
+		return true
+	}
+	c.Data(http.StatusOK, enc.ContentType(), buf.Bytes())
+	return true
+}
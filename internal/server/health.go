@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Version and Build are reported by the health endpoints and the
+// X-Influxdb-Version and X-Influxdb-Build headers. They can be set at
+// link time with -ldflags "-X .../internal/server.Version=...".
+var (
+	Version = "1.0.0"
+	Build   = "OSS"
+	Commit  = "unknown"
+)
+
+// versionHeaders adds the headers InfluxDB clients, and the Grafana
+// datasource, use to identify the server to every response
+func versionHeaders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Header("X-Influxdb-Version", Version)
+		c.Header("X-Influxdb-Build", Build)
+		c.Next()
+	}
+}
+
+// handlePing answers GET and HEAD /ping like InfluxDB: 204 with version
+// headers, or 200 with a JSON body when verbose=true is requested
+func (s *Server) handlePing(c *gin.Context) {
+	if c.Request.Method == http.MethodGet && c.Query("verbose") == "true" {
+		c.JSON(http.StatusOK, gin.H{"version": Version})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handleHealth answers GET /health and /api/health with the InfluxDB v2 health check schema
+func (s *Server) handleHealth(c *gin.Context) {
+	if err := s.db.GetDB().PingContext(c.Request.Context()); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"name":    "influxdb",
+			"message": "storage unavailable: " + err.Error(),
+			"status":  "fail",
+			"checks":  []interface{}{},
+			"version": Version,
+			"commit":  Commit,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"name":    "influxdb",
+		"message": "ready for queries and writes",
+		"status":  "pass",
+		"checks":  []interface{}{},
+		"version": Version,
+		"commit":  Commit,
+	})
+}
+
+// handleReady answers GET /ready with the InfluxDB v2 readiness schema
+func (s *Server) handleReady(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "ready",
+		"started": s.start.UTC().Format(time.RFC3339Nano),
+		"up":      time.Since(s.start).String(),
+	})
+}
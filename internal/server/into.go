@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/gleicon/go-refluxdb/internal/ingest"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/result"
+	"github.com/gleicon/go-refluxdb/internal/tasks"
+)
+
+// intoTarget is the measurement written by SELECT ... INTO
+type intoTarget struct {
+	// database is empty for the database of the query
+	database string
+	// measurement is empty for :MEASUREMENT, which keeps the name of the
+	// measurement each series comes from
+	measurement string
+}
+
+// parseInto returns the target of the INTO clause of query and the query
+// without it, or nil and the query itself when it has none. The target
+// is a measurement, possibly qualified with a database and a retention
+// policy as in "db"."rp"."cpu_1h" or db..cpu_1h, where the retention
+// policy is ignored.
+func parseInto(query string) (*intoTarget, string, error) {
+	if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(query)), "select") {
+		return nil, query, nil
+	}
+	tail, ok := afterKeyword(query, "into")
+	if !ok {
+		return nil, query, nil
+	}
+	head := query[:len(query)-len(tail)-len("into")]
+	parts, rest, err := scanQualified(strings.TrimLeft(tail, " \t\r\n"))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w in INTO clause", err)
+	}
+	from := strings.TrimLeft(rest, " \t\r\n")
+	if tail, ok := afterKeyword(from, "from"); !ok || len(tail) != len(from)-len("from") {
+		return nil, "", fmt.Errorf("expected FROM after the INTO measurement")
+	}
+
+	target := &intoTarget{measurement: parts[len(parts)-1]}
+	switch len(parts) {
+	case 1, 2:
+	case 3:
+		target.database = parts[0]
+	default:
+		return nil, "", fmt.Errorf("too many dots in INTO measurement")
+	}
+	if strings.EqualFold(target.measurement, ":measurement") {
+		target.measurement = ""
+	} else if target.measurement == "" {
+		return nil, "", fmt.Errorf("missing measurement in INTO clause")
+	}
+	return target, head + rest, nil
+}
+
+// handleSelectInto runs the SELECT statement query against db and writes
+// its rows into the target measurement, as a downsampling task would:
+// the time column is the timestamp, string columns are tags and the
+// other columns fields. Like InfluxDB, it answers with the number of
+// points written.
+func (s *Server) handleSelectInto(c *gin.Context, db string, into *intoTarget, query string) {
+	database := into.database
+	if database == "" {
+		database = db
+	}
+	if !s.authorize(c, persistence.ScopeWrite, database) {
+		return
+	}
+
+	// The statement runs as any other, with its result captured rather
+	// than encoded; errors are answered by handleSelect itself
+	captured := &capturedResult{}
+	req := c.Request
+	c.Request = req.WithContext(context.WithValue(req.Context(), capturedResultKey{}, captured))
+	s.handleSelect(c, db, query)
+	c.Request = req
+	if captured.resp == nil {
+		return
+	}
+
+	var points []persistence.Point
+	for _, r := range captured.resp.Results {
+		if r.Err != "" {
+			s.writeResult(c, http.StatusOK, captured.resp, result.Options{})
+			return
+		}
+		for _, series := range r.Series {
+			points = tasks.AppendPoints(points, database, series)
+		}
+	}
+	if into.measurement != "" {
+		for i := range points {
+			points[i].Measurement = into.measurement
+		}
+	}
+
+	if len(points) > 0 {
+		var size int64
+		if s.budget != nil {
+			size = ingest.PointsSize(points)
+		}
+		if !s.budget.Reserve(size) {
+			writeErrors.With("memory").Inc()
+			writeError(c, http.StatusServiceUnavailable, "memory budget exhausted: retry later")
+			return
+		}
+		err := s.saveBatch(c.Request.Context(), points)
+		s.budget.Release(size)
+		if err != nil {
+			writeErrors.With("storage").Inc()
+			s.logger(c).Errorf("Failed to write INTO %s: %v", database, err)
+			writeError(c, storageStatus(err), fmt.Sprintf("failed to write results: %v", err))
+			return
+		}
+		pointsWritten.Add(uint64(len(points)))
+	}
+	s.logger(c).Debugf("Wrote %d points into %s", len(points), database)
+
+	series := result.NewSeries("result",
+		result.Column{Name: "time", Type: result.Time},
+		result.Column{Name: "written", Type: result.Integer})
+	series.Append(int64(0), int64(len(points)))
+	s.writeResult(c, http.StatusOK, result.New(series), result.Options{})
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+)
+
+var (
+	queriesActive   = metrics.NewGauge("refluxdb_queries_active", "Queries being executed")
+	queriesQueued   = metrics.NewGauge("refluxdb_queries_queued", "Queries waiting for an execution slot")
+	queriesRejected = metrics.NewCounterVec("refluxdb_queries_rejected_total", "Queries rejected by the concurrency limit", "reason")
+)
+
+var (
+	errQueueFull    = errors.New("too many queries: queue is full")
+	errQueueTimeout = errors.New("too many queries: timed out waiting for an execution slot")
+)
+
+// queryLimiter bounds the number of queries executed at once. Queries past
+// the limit wait in a bounded queue for a slot to free up.
+type queryLimiter struct {
+	slots   chan struct{}
+	queue   chan struct{}
+	timeout time.Duration
+}
+
+// newQueryLimiter returns a limiter running at most max queries at once
+// with up to queued waiting, or nil when max is zero
+func newQueryLimiter(max, queued int, timeout time.Duration) *queryLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &queryLimiter{
+		slots:   make(chan struct{}, max),
+		queue:   make(chan struct{}, queued),
+		timeout: timeout,
+	}
+}
+
+// acquire takes an execution slot, waiting in the queue for at most the
+// queue timeout. The returned function releases the slot.
+func (l *queryLimiter) acquire(ctx context.Context) (func(), error) {
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+
+	select {
+	case l.queue <- struct{}{}:
+	default:
+		return nil, errQueueFull
+	}
+	queriesQueued.Add(1)
+	defer func() {
+		<-l.queue
+		queriesQueued.Add(-1)
+	}()
+
+	var expired <-chan time.Time
+	if l.timeout > 0 {
+		timer := time.NewTimer(l.timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-expired:
+		return nil, errQueueTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *queryLimiter) release() {
+	<-l.slots
+}
+
+// limitQueries runs the query handlers under the concurrency limit, so a
+// burst of dashboard queries cannot starve the write path of connections.
+// Queries that find the queue full or wait past the queue timeout are
+// answered with 503.
+func (s *Server) limitQueries() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.limiter == nil {
+			traceOf(c).admit()
+			c.Next()
+			return
+		}
+
+		release, err := s.limiter.acquire(c.Request.Context())
+		if err != nil {
+			var reason string
+			switch {
+			case errors.Is(err, errQueueFull):
+				reason = "queue_full"
+			case errors.Is(err, errQueueTimeout):
+				reason = "queue_timeout"
+			default:
+				// The client went away while queued
+				c.AbortWithStatus(statusClientClosedRequest)
+				return
+			}
+			queriesRejected.With(reason).Inc()
+			s.logger(c).Warn(err.Error())
+			writeError(c, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+
+		traceOf(c).admit()
+		queriesActive.Add(1)
+		defer func() {
+			queriesActive.Add(-1)
+			release()
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// requestIDHeader carries the request correlation ID
+	requestIDHeader = "X-Request-Id"
+	// logEntryKey stores the request scoped logger in the gin context
+	logEntryKey = "refluxdb.log"
+)
+
+// newRequestID returns a random 16 byte hex encoded ID
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// requestLogger assigns every request a correlation ID, echoed in the
+// X-Request-Id response header, and logs one structured entry per request
+// once it has been served. IDs sent by the client are kept so they can be
+// followed across services, and so are the W3C or B3 trace headers of
+// services writing metrics while they serve their own requests: they are
+// echoed in the response and their trace and span IDs tag the request
+// logs.
+func (s *Server) requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.GetHeader(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		c.Header(requestIDHeader, id)
+		entry := s.log.WithField("request_id", id)
+		if trace, ok := parseTraceContext(c.Request.Header); ok {
+			for name, values := range trace.headers {
+				c.Writer.Header()[name] = values
+			}
+			c.Set(traceKey, trace)
+			entry = entry.WithFields(logrus.Fields{"trace_id": trace.TraceID, "span_id": trace.SpanID})
+		}
+		c.Set(logEntryKey, entry)
+
+		c.Next()
+
+		entry = s.logger(c).WithFields(logrus.Fields{
+			"method":     c.Request.Method,
+			"path":       c.Request.URL.Path,
+			"status":     c.Writer.Status(),
+			"bytes":      c.Writer.Size(),
+			"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"client_ip":  c.ClientIP(),
+			"user_agent": c.Request.UserAgent(),
+		})
+		if len(c.Errors) > 0 {
+			entry = entry.WithField("errors", c.Errors.String())
+		}
+
+		switch status := c.Writer.Status(); {
+		case status >= http.StatusInternalServerError:
+			entry.Error("request failed")
+		case status >= http.StatusBadRequest:
+			entry.Warn("request rejected")
+		default:
+			entry.Info("request served")
+		}
+	}
+}
+
+// logger returns the logger scoped to the request, tagged with its ID
+func (s *Server) logger(c *gin.Context) *logrus.Entry {
+	if v, ok := c.Get(logEntryKey); ok {
+		if entry, ok := v.(*logrus.Entry); ok {
+			return entry
+		}
+	}
+	return logrus.NewEntry(s.log)
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+)
+
+var (
+	writeRequests   = metrics.NewCounter("refluxdb_http_write_requests_total", "HTTP write requests received")
+	writeErrors     = metrics.NewCounterVec("refluxdb_http_write_errors_total", "HTTP write requests that failed", "reason")
+	pointsWritten   = metrics.NewCounter("refluxdb_http_points_written_total", "Points written over HTTP")
+	writesOverQuota = metrics.NewCounterVec("refluxdb_http_writes_over_quota_total", "HTTP writes rejected by the quota of their token", "quota")
+	pointsDeleted   = metrics.NewCounter("refluxdb_http_points_deleted_total", "Points deleted through the v2 delete API")
+	queryDuration   = metrics.NewHistogramVec("refluxdb_query_duration_seconds", "Time spent serving queries", metrics.DefaultBuckets, "api")
+	queryTimeouts   = metrics.NewCounter("refluxdb_query_timeouts_total", "Queries aborted for exceeding the query timeout")
+	dbSize          = metrics.NewGauge("refluxdb_storage_size_bytes", "Size of the SQLite database in bytes")
+	// clientsRejected counts the requests refused by the client address
+	// allow and deny lists
+	clientsRejected = metrics.NewCounter("refluxdb_http_clients_rejected_total", "HTTP requests rejected by the client address allow and deny lists")
+)
+
+// observeQuery records the latency of a query started at start. It is meant
+// to be deferred at the top of a query handler.
+func observeQuery(api string, start time.Time) {
+	queryDuration.With(api).Observe(time.Since(start).Seconds())
+}
+
+// handleMetrics serves the internal metrics in the Prometheus text format
+func (s *Server) handleMetrics(c *gin.Context) {
+	if size, err := s.db.Size(); err != nil {
+		s.logger(c).Errorf("Failed to read database size: %v", err)
+	} else {
+		dbSize.Set(float64(size))
+	}
+	metrics.Handler().ServeHTTP(c.Writer, c.Request)
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// The statuses of a migration
+const (
+	migrationRunning  = "running"
+	migrationSuccess  = "success"
+	migrationFailed   = "failed"
+	migrationCanceled = "canceled"
+)
+
+// maxMigrations is the number of migrations remembered. The oldest
+// finished ones are forgotten first.
+const maxMigrations = 100
+
+// migration is the v2 API representation of a series rewrite running in
+// the background
+type migration struct {
+	ID          string            `json:"id"`
+	Kind        string            `json:"kind"`
+	Bucket      string            `json:"bucket"`
+	Measurement string            `json:"measurement,omitempty"`
+	Tag         string            `json:"tag,omitempty"`
+	Value       string            `json:"value,omitempty"`
+	To          string            `json:"to,omitempty"`
+	Status      string            `json:"status"`
+	Progress    migrationProgress `json:"progress"`
+	Error       string            `json:"error,omitempty"`
+	StartedAt   time.Time         `json:"startedAt"`
+	FinishedAt  *time.Time        `json:"finishedAt,omitempty"`
+	Links       map[string]string `json:"links"`
+}
+
+// migrationProgress counts the series examined out of those of the
+// migration, and what happened to them
+type migrationProgress struct {
+	Series      int64 `json:"series"`
+	Done        int64 `json:"done"`
+	Rewritten   int64 `json:"rewritten"`
+	Merged      int64 `json:"merged"`
+	PointsMoved int64 `json:"pointsMoved"`
+}
+
+// migrationRequest is the body of POST /api/v2/migrations
+type migrationRequest struct {
+	Kind        string `json:"kind"`
+	Measurement string `json:"measurement"`
+	Tag         string `json:"tag"`
+	Value       string `json:"value"`
+	To          string `json:"to"`
+}
+
+// migrations runs the series rewrites requested through the API and
+// remembers their progress. Rewrites are cancelled when the server stops.
+type migrations struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu   sync.Mutex
+	jobs map[string]*migration
+}
+
+func newMigrations() *migrations {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &migrations{ctx: ctx, cancel: cancel, jobs: make(map[string]*migration)}
+}
+
+// start records a migration of bucket and runs rewrite in the background.
+// It fails when a migration of the bucket is already running.
+func (m *migrations) start(job *migration, rewrite func(context.Context, func(persistence.RewriteProgress)) (persistence.RewriteProgress, error), done func(*migration)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, other := range m.jobs {
+		if other.Bucket == job.Bucket && other.Status == migrationRunning {
+			return fmt.Errorf("migration %s of bucket %q is still running", other.ID, job.Bucket)
+		}
+	}
+	m.forget()
+	m.jobs[job.ID] = job
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		p, err := rewrite(m.ctx, func(p persistence.RewriteProgress) {
+			m.mu.Lock()
+			job.Progress = migrationProgress(p)
+			m.mu.Unlock()
+		})
+
+		m.mu.Lock()
+		now := time.Now().UTC()
+		job.Progress = migrationProgress(p)
+		job.FinishedAt = &now
+		switch {
+		case err == nil:
+			job.Status = migrationSuccess
+		case errors.Is(err, context.Canceled):
+			job.Status = migrationCanceled
+		default:
+			job.Status, job.Error = migrationFailed, err.Error()
+		}
+		finished := *job
+		m.mu.Unlock()
+		done(&finished)
+	}()
+	return nil
+}
+
+// forget drops the oldest finished migrations once maxMigrations are
+// remembered. The caller must hold m.mu.
+func (m *migrations) forget() {
+	var finished []*migration
+	for _, job := range m.jobs {
+		if job.Status != migrationRunning {
+			finished = append(finished, job)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].StartedAt.Before(finished[j].StartedAt) })
+	for i := 0; len(m.jobs) >= maxMigrations && i < len(finished); i++ {
+		delete(m.jobs, finished[i].ID)
+	}
+}
+
+// get returns a copy of a migration
+func (m *migrations) get(id string) (migration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return migration{}, false
+	}
+	return *job, true
+}
+
+// list returns copies of the migrations, newest first
+func (m *migrations) list() []migration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make([]migration, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, *job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].StartedAt.After(jobs[j].StartedAt) })
+	return jobs
+}
+
+// stop cancels the running migrations and waits for them to end
+func (m *migrations) stop() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+// handleCreateMigration answers POST /api/v2/migrations, starting the
+// rewrite of the series of a bucket described by the body: renaming a
+// measurement, or adding, renaming or dropping a tag. It answers 202 with
+// the migration, whose progress is polled with GET
+// /api/v2/migrations/:migrationID.
+func (s *Server) handleCreateMigration(c *gin.Context) {
+	bucket, ok := s.bucketParam(c)
+	if !ok {
+		return
+	}
+	exists, err := s.db.HasDatabase(bucket)
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	if !exists {
+		writeError(c, http.StatusNotFound, fmt.Sprintf("bucket %q not found", bucket))
+		return
+	}
+
+	var req migrationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid migration: %v", err))
+		return
+	}
+	rewrite := persistence.Rewrite{
+		Kind:        req.Kind,
+		Database:    bucket,
+		Measurement: req.Measurement,
+		Tag:         req.Tag,
+		Value:       req.Value,
+		To:          req.To,
+	}
+	if err := rewrite.Validate(); err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid migration: %v", err))
+		return
+	}
+
+	id := newRequestID()
+	job := &migration{
+		ID:          id,
+		Kind:        req.Kind,
+		Bucket:      bucket,
+		Measurement: req.Measurement,
+		Tag:         req.Tag,
+		Value:       req.Value,
+		To:          req.To,
+		Status:      migrationRunning,
+		StartedAt:   time.Now().UTC(),
+		Links:       map[string]string{"self": "/api/v2/migrations/" + id},
+	}
+	log := s.logger(c)
+	run := func(ctx context.Context, progress func(persistence.RewriteProgress)) (persistence.RewriteProgress, error) {
+		store, release, err := s.storage(bucket)
+		if err != nil {
+			return persistence.RewriteProgress{}, err
+		}
+		defer release()
+		return store.RewriteSeries(ctx, rewrite, progress)
+	}
+	err = s.migrations.start(job, run, func(done *migration) {
+		if done.Status == migrationFailed {
+			log.Errorf("Migration %s of %s failed after %d of %d series: %s", done.ID, bucket, done.Progress.Done, done.Progress.Series, done.Error)
+			return
+		}
+		log.Infof("Migration %s of %s %s: %d series rewritten, %d merged", done.ID, bucket, done.Status, done.Progress.Rewritten, done.Progress.Merged)
+	})
+	if err != nil {
+		writeError(c, http.StatusConflict, err.Error())
+		return
+	}
+	s.audit(c, "schema.migrate", bucket, describeMigration(req))
+	started, _ := s.migrations.get(id)
+	c.JSON(http.StatusAccepted, started)
+}
+
+// describeMigration summarizes a migration for the audit log
+func describeMigration(req migrationRequest) string {
+	var detail string
+	switch req.Kind {
+	case persistence.RewriteRenameMeasurement:
+		detail = fmt.Sprintf("rename measurement %s to %s", req.Measurement, req.To)
+	case persistence.RewriteAddTag:
+		detail = fmt.Sprintf("add tag %s=%s", req.Tag, req.Value)
+	case persistence.RewriteRenameTag:
+		detail = fmt.Sprintf("rename tag %s to %s", req.Tag, req.To)
+	case persistence.RewriteDropTag:
+		detail = fmt.Sprintf("drop tag %s", req.Tag)
+	}
+	if req.Measurement != "" && req.Kind != persistence.RewriteRenameMeasurement {
+		detail += " of " + req.Measurement
+	}
+	return detail
+}
+
+// handleListMigrations answers GET /api/v2/migrations with the migrations
+// remembered, newest first
+func (s *Server) handleListMigrations(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"links":      gin.H{"self": "/api/v2/migrations"},
+		"migrations": s.migrations.list(),
+	})
+}
+
+// handleGetMigration answers GET /api/v2/migrations/:migrationID
+func (s *Server) handleGetMigration(c *gin.Context) {
+	job, ok := s.migrations.get(c.Param("migrationID"))
+	if !ok {
+		writeError(c, http.StatusNotFound, fmt.Sprintf("migration %q not found", c.Param("migrationID")))
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
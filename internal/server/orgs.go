@@ -0,0 +1,175 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// defaultPageLimit is the page size of the v2 list endpoints
+const defaultPageLimit = 20
+
+// organization is the v2 API representation of an organization
+type organization struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Status      string            `json:"status"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	UpdatedAt   time.Time         `json:"updatedAt"`
+	Links       map[string]string `json:"links"`
+}
+
+// orgRequest is the body of POST /api/v2/orgs and PATCH /api/v2/orgs/:orgID
+type orgRequest struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+}
+
+func newOrganization(o persistence.Organization) organization {
+	self := "/api/v2/orgs/" + o.ID
+	return organization{
+		ID:          o.ID,
+		Name:        o.Name,
+		Description: o.Description,
+		Status:      "active",
+		CreatedAt:   o.CreatedAt,
+		UpdatedAt:   o.UpdatedAt,
+		Links: map[string]string{
+			"self":    self,
+			"buckets": "/api/v2/buckets?orgID=" + o.ID,
+		},
+	}
+}
+
+// parsePage reads the offset and limit query parameters of a list endpoint
+func parsePage(c *gin.Context) (offset, limit int, err error) {
+	offset, err = strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		return 0, 0, fmt.Errorf("invalid offset")
+	}
+	limit, err = strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultPageLimit)))
+	if err != nil || limit < 1 {
+		return 0, 0, fmt.Errorf("invalid limit")
+	}
+	return offset, limit, nil
+}
+
+// page returns the items of a list endpoint page
+func page[T any](items []T, offset, limit int) []T {
+	if offset > len(items) {
+		offset = len(items)
+	}
+	items = items[offset:]
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return items
+}
+
+func (s *Server) handleListOrgs(c *gin.Context) {
+	offset, limit, err := parsePage(c)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	orgs, err := s.db.Organizations()
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+
+	name, id := c.Query("org"), c.Query("orgID")
+	result := make([]organization, 0, len(orgs))
+	for _, o := range orgs {
+		if (name != "" && o.Name != name) || (id != "" && o.ID != id) {
+			continue
+		}
+		result = append(result, newOrganization(o))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"links": gin.H{"self": fmt.Sprintf("/api/v2/orgs?limit=%d&offset=%d", limit, offset)},
+		"orgs":  page(result, offset, limit),
+	})
+}
+
+func (s *Server) handleCreateOrg(c *gin.Context) {
+	var req orgRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid organization: %v", err))
+		return
+	}
+	if req.Name == nil || *req.Name == "" {
+		writeError(c, http.StatusBadRequest, "organization name is required")
+		return
+	}
+
+	o := persistence.Organization{Name: *req.Name}
+	if req.Description != nil {
+		o.Description = *req.Description
+	}
+	o, err := s.db.AddOrganization(o)
+	if err != nil {
+		s.orgError(c, err)
+		return
+	}
+	s.audit(c, "org.create", o.Name, "id "+o.ID)
+	c.JSON(http.StatusCreated, newOrganization(o))
+}
+
+func (s *Server) handleGetOrg(c *gin.Context) {
+	o, err := s.db.GetOrganizationByID(c.Param("orgID"))
+	if err != nil {
+		s.orgError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, newOrganization(o))
+}
+
+func (s *Server) handleUpdateOrg(c *gin.Context) {
+	var req orgRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid organization: %v", err))
+		return
+	}
+	if req.Name != nil && *req.Name == "" {
+		writeError(c, http.StatusBadRequest, "organization name is required")
+		return
+	}
+
+	o, err := s.db.UpdateOrganization(c.Param("orgID"), persistence.OrganizationUpdate{Name: req.Name, Description: req.Description})
+	if err != nil {
+		s.orgError(c, err)
+		return
+	}
+	s.audit(c, "org.update", o.Name, "id "+o.ID)
+	c.JSON(http.StatusOK, newOrganization(o))
+}
+
+func (s *Server) handleDeleteOrg(c *gin.Context) {
+	if err := s.db.DeleteOrganization(c.Param("orgID")); err != nil {
+		s.orgError(c, err)
+		return
+	}
+	s.audit(c, "org.delete", c.Param("orgID"), "")
+	c.Status(http.StatusNoContent)
+}
+
+// orgError maps organization errors to HTTP responses
+func (s *Server) orgError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, persistence.ErrOrganizationNotFound):
+		writeError(c, http.StatusNotFound, "organization not found")
+	case errors.Is(err, persistence.ErrOrganizationExists):
+		writeError(c, http.StatusUnprocessableEntity, "organization name already exists")
+	default:
+		writeError(c, storageStatus(err), err.Error())
+	}
+}
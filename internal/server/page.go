@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+const (
+	// nextCursorHeader carries the cursor of the next page of a v2 query,
+	// and is left out on the last page
+	nextCursorHeader = "X-Refluxdb-Next-Cursor"
+	// maxPageLimit bounds the number of points of one page
+	maxPageLimit = 100000
+)
+
+// pageCursor is the JSON form of a persistence.PageCursor. Clients treat
+// the encoded cursor as an opaque token.
+type pageCursor struct {
+	Timestamp int64  `json:"t"`
+	SeriesKey string `json:"s"`
+}
+
+// encodeCursor returns the opaque token of cursor
+func encodeCursor(cursor *persistence.PageCursor) string {
+	data, _ := json.Marshal(pageCursor{Timestamp: cursor.Timestamp, SeriesKey: cursor.SeriesKey})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor reads a token returned by encodeCursor
+func decodeCursor(token string) (*persistence.PageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var c pageCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.SeriesKey == "" {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &persistence.PageCursor{Timestamp: c.Timestamp, SeriesKey: c.SeriesKey}, nil
+}
+
+// pageParams reads the limit and cursor parameters of a v2 query. paged
+// is false when neither is set and the whole range is returned.
+func pageParams(c *gin.Context) (limit int, cursor *persistence.PageCursor, paged bool, err error) {
+	l, token := c.Query("limit"), c.Query("cursor")
+	if l == "" && token == "" {
+		return 0, nil, false, nil
+	}
+
+	limit = maxPageLimit
+	if l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > maxPageLimit {
+			return 0, nil, false, fmt.Errorf("invalid limit %q: must be between 1 and %d", l, maxPageLimit)
+		}
+	}
+	if token != "" {
+		if cursor, err = decodeCursor(token); err != nil {
+			return 0, nil, false, err
+		}
+	}
+	return limit, cursor, true, nil
+}
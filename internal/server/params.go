@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/result"
+)
+
+// resultOptionsKey holds the result options of a v1 query, read from its
+// epoch and pretty parameters
+const resultOptionsKey = "refluxdb.result"
+
+// epochUnits are the units accepted by the epoch parameter of /query
+var epochUnits = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"n":  time.Nanosecond,
+	"u":  time.Microsecond,
+	"µ":  time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+}
+
+// parseEpoch returns the options writing the timestamps of a v1 query in
+// the unit of its epoch parameter, or as RFC3339 strings without one as
+// InfluxDB does
+func parseEpoch(epoch string) (result.Options, error) {
+	if epoch == "" {
+		return result.Options{RFC3339: true}, nil
+	}
+	unit, ok := epochUnits[epoch]
+	if !ok {
+		return result.Options{}, fmt.Errorf("invalid epoch %q: expected ns, u, ms, s, m or h", epoch)
+	}
+	return result.Options{Epoch: unit}, nil
+}
+
+// formValue returns a parameter of the URL or, for form encoded POST
+// requests as sent by the InfluxDB client libraries, of the body
+func formValue(c *gin.Context, key string) string {
+	if v := c.Query(key); v != "" {
+		return v
+	}
+	return c.PostForm(key)
+}
+
+// parseParams decodes the params JSON object binding the $placeholders of
+// a query, as in params={"host":"server1","limit":10}
+func parseParams(s string) (map[string]interface{}, error) {
+	if s == "" {
+		return nil, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	var params map[string]interface{}
+	if err := dec.Decode(&params); err != nil {
+		return nil, fmt.Errorf("failed to decode params: %w", err)
+	}
+	for name, v := range params {
+		switch v.(type) {
+		case string, json.Number, bool:
+		default:
+			return nil, fmt.Errorf("unsupported value for parameter %s: %v", name, v)
+		}
+	}
+	return params, nil
+}
+
+// bindParams replaces the $placeholders of query outside of quotes with
+// their values in params. Numbers and booleans are written as they are.
+// Strings compared against, as in host = $host, become string literals,
+// and anywhere else, as in FROM $measurement, quoted identifiers. The
+// clauses of the query are only looked for outside of quotes, so a value
+// cannot change the structure of the query whatever it holds, even
+// keywords such as fill( or GROUP BY.
+func bindParams(query string, params map[string]interface{}) (string, error) {
+	var b strings.Builder
+	quote := byte(0)
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+		switch {
+		case quote != 0:
+			if ch == '\\' && i+1 < len(query) {
+				b.WriteByte(ch)
+				i++
+				ch = query[i]
+			} else if ch == quote {
+				quote = 0
+			}
+		case ch == '"' || ch == '\'':
+			quote = ch
+		case ch == '$' && i+1 < len(query) && isIdentStart(query[i+1]) && (i == 0 || !isIdentChar(query[i-1])):
+			end := i + 1
+			for end < len(query) && isIdentChar(query[end]) {
+				end++
+			}
+			name := query[i+1 : end]
+			v, ok := params[name]
+			if !ok {
+				return "", fmt.Errorf("missing parameter: $%s", name)
+			}
+			switch v := v.(type) {
+			case string:
+				if afterComparison(query[:i]) {
+					b.WriteString(quoteString(v, '\''))
+				} else {
+					b.WriteString(quoteString(v, '"'))
+				}
+			default:
+				fmt.Fprint(&b, v)
+			}
+			i = end - 1
+			continue
+		}
+		b.WriteByte(ch)
+	}
+	return b.String(), nil
+}
+
+// afterComparison reports whether s ends with a comparison operator,
+// ignoring trailing spaces
+func afterComparison(s string) bool {
+	s = strings.TrimRight(s, " \t\r\n")
+	return s != "" && strings.ContainsRune("=<>~", rune(s[len(s)-1]))
+}
+
+// quoteString quotes s with q, escaping backslashes and q
+func quoteString(s string, q byte) string {
+	var b strings.Builder
+	b.WriteByte(q)
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' || s[i] == q {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	b.WriteByte(q)
+	return b.String()
+}
+
+func isIdentStart(b byte) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+func isIdentChar(b byte) bool {
+	return isIdentStart(b) || (b >= '0' && b <= '9')
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// statusClientClosedRequest is logged for queries abandoned by the client,
+// which is no longer there to read a response
+const statusClientClosedRequest = 499
+
+// queryContext returns the context of a query: the request context, which
+// is canceled when the client disconnects, bounded by the query timeout
+func (s *Server) queryContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	if s.queryTimeout > 0 {
+		return context.WithTimeout(c.Request.Context(), s.queryTimeout)
+	}
+	return context.WithCancel(c.Request.Context())
+}
+
+// queryAborted reports whether a query failed because ctx is done and
+// answers the request accordingly: 408 when the query timed out, or
+// nothing when the client went away
+func (s *Server) queryAborted(c *gin.Context, ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() == nil {
+		return false
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		queryTimeouts.Inc()
+		s.logger(c).Warnf("Query timed out after %s", s.queryTimeout)
+		writeError(c, http.StatusRequestTimeout, fmt.Sprintf("query timeout: exceeded %s", s.queryTimeout))
+		return true
+	}
+	s.logger(c).Debug("Query canceled by the client")
+	c.AbortWithStatus(statusClientClosedRequest)
+	return true
+}
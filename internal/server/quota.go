@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// rateLimiter enforces the points per second of the token quotas with the
+// generic cell rate algorithm: every token has a theoretical arrival time,
+// pushed back by each point written, which may run ahead of the current
+// time by the burst of the token
+type rateLimiter struct {
+	mu  sync.Mutex
+	tat map[string]time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{tat: make(map[string]time.Time)}
+}
+
+// rateOf returns the time between two points of q and the burst of q
+func rateOf(q persistence.Quota) (time.Duration, int64) {
+	burst := q.Burst
+	if burst == 0 {
+		burst = int64(math.Ceil(q.PointsPerSecond))
+	}
+	return time.Duration(float64(time.Second) / q.PointsPerSecond), burst
+}
+
+// take accounts for n points written with token at now. It returns how
+// long to wait before they are allowed when they are over the rate, and
+// counts nothing then.
+func (l *rateLimiter) take(token string, q persistence.Quota, n int64, now time.Time) time.Duration {
+	interval, burst := rateOf(q)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	tat := l.tat[token]
+	if tat.Before(now) {
+		tat = now
+	}
+	next := tat.Add(interval * time.Duration(n))
+	if wait := next.Sub(now) - interval*time.Duration(burst); wait > 0 {
+		return wait
+	}
+	l.tat[token] = next
+	return 0
+}
+
+// refund gives back n points taken by take. Nothing was taken when q has
+// no rate.
+func (l *rateLimiter) refund(token string, q persistence.Quota, n int64) {
+	if q.PointsPerSecond <= 0 {
+		return
+	}
+	interval, _ := rateOf(q)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tat[token] = l.tat[token].Add(-interval * time.Duration(n))
+}
+
+// byteCounter counts the bytes read from a request body
+type byteCounter struct {
+	r io.Reader
+	n int64
+}
+
+func (b *byteCounter) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// checkQuota reports whether the token of the request may write points
+// parsed from a body of size bytes, and charges them to the token. refund
+// gives them back when the write fails after all. Otherwise it answers with
+// a 413 when the write can never fit in the quota and a 429 telling when to
+// retry when the quota is used up.
+func (s *Server) checkQuota(c *gin.Context, points int, size int64) (refund func(), ok bool) {
+	v, ok := c.Get(tokenKey)
+	if !ok {
+		return func() {}, true
+	}
+	token := v.(persistence.Token)
+	q := token.Quota
+	n := int64(points)
+	now := time.Now()
+
+	if q.PointsPerSecond > 0 {
+		if _, burst := rateOf(q); n > burst {
+			s.rejectOverQuota(c, "rate", http.StatusRequestEntityTooLarge, 0,
+				fmt.Sprintf("request too large: %d points are over the burst of %d points of the token quota", n, burst))
+			return nil, false
+		}
+		if wait := s.rates.take(token.ID, q, n, now); wait > 0 {
+			s.rejectOverQuota(c, "rate", http.StatusTooManyRequests, wait,
+				fmt.Sprintf("over quota: token is limited to %g points per second", q.PointsPerSecond))
+			return nil, false
+		}
+	}
+	if q.BytesPerDay > 0 {
+		if size > q.BytesPerDay {
+			s.rates.refund(token.ID, q, n)
+			s.rejectOverQuota(c, "bytes", http.StatusRequestEntityTooLarge, 0,
+				fmt.Sprintf("request too large: body of %d bytes is over the %d bytes per day of the token quota", size, q.BytesPerDay))
+			return nil, false
+		}
+		used, ok, err := s.db.AddTokenUsage(token.ID, now, size, q.BytesPerDay)
+		if err != nil {
+			s.rates.refund(token.ID, q, n)
+			writeErrors.With("storage").Inc()
+			writeError(c, storageStatus(err), err.Error())
+			return nil, false
+		}
+		if !ok {
+			s.rates.refund(token.ID, q, n)
+			midnight := now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour)
+			s.rejectOverQuota(c, "bytes", http.StatusTooManyRequests, midnight.Sub(now),
+				fmt.Sprintf("over quota: token wrote %d of its %d bytes per day", used, q.BytesPerDay))
+			return nil, false
+		}
+	}
+
+	refund = func() {
+		s.rates.refund(token.ID, q, n)
+		if q.BytesPerDay > 0 {
+			if _, _, err := s.db.AddTokenUsage(token.ID, now, -size, 0); err != nil {
+				s.logger(c).Warnf("Failed to refund the quota of token %s: %v", token.ID, err)
+			}
+		}
+	}
+	return refund, true
+}
+
+// rejectOverQuota answers a write over the quota of its token, telling the
+// client to retry after wait when it is positive
+func (s *Server) rejectOverQuota(c *gin.Context, reason string, status int, wait time.Duration, message string) {
+	writeErrors.With("quota").Inc()
+	writesOverQuota.With(reason).Inc()
+	if wait > 0 {
+		c.Header("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+	}
+	writeError(c, status, message)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gleicon/go-refluxdb/internal/expr"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/result"
+)
+
+// selectColumn is one expression of a SELECT clause and the name of its
+// column
+type selectColumn struct {
+	expr expr.Expr
+	name string
+}
+
+// parseSelect returns the expressions of the SELECT clause of query, as
+// in SELECT value * 100, (used - free) / total AS ratio FROM ... Columns
+// are named after their alias, or the way InfluxDB names them, with a
+// numeric suffix for the names already taken.
+func parseSelect(query string) ([]selectColumn, error) {
+	clause, err := selectClause(query)
+	if err != nil {
+		return nil, err
+	}
+
+	var columns []selectColumn
+	taken := make(map[string]int)
+	for _, item := range splitList(clause) {
+		text, alias := splitAlias(item)
+		// Clients escaping the quotes of a field send \"value\"
+		if strings.HasPrefix(strings.TrimSpace(text), `\"`) {
+			text = strings.ReplaceAll(text, `\"`, `"`)
+		}
+		e, err := expr.Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression %q: %w", strings.TrimSpace(text), err)
+		}
+
+		name := alias
+		if name == "" {
+			name = expr.Name(e)
+		}
+		columns = append(columns, selectColumn{expr: e, name: uniqueName(taken, name)})
+	}
+	return columns, nil
+}
+
+// uniqueName returns name, followed by a numeric suffix when a previous
+// column of a SELECT clause already took it. taken counts the columns by
+// name.
+func uniqueName(taken map[string]int, name string) string {
+	n := taken[name]
+	taken[name]++
+	if n > 0 {
+		return name + "_" + strconv.Itoa(n)
+	}
+	return name
+}
+
+// selectClause returns what lies between SELECT and FROM in query
+func selectClause(query string) (string, error) {
+	rest, ok := afterKeyword(query, "select")
+	if !ok {
+		return "", fmt.Errorf("missing SELECT clause")
+	}
+	if tail, ok := afterKeyword(rest, "from"); ok {
+		rest = rest[:len(rest)-len(tail)-len("from")]
+	}
+	return rest, nil
+}
+
+// splitAlias splits an item of a SELECT clause into its expression and
+// the alias following AS, if any
+func splitAlias(item string) (string, string) {
+	if tail, ok := afterKeyword(item, "as"); ok {
+		return item[:len(item)-len(tail)-len("as")], unquoteIdent(strings.TrimSpace(tail))
+	}
+	return item, ""
+}
+
+// splitList splits s at the commas outside of quotes and parentheses
+func splitList(s string) []string {
+	var items []string
+	depth, start := 0, 0
+	quote := byte(0)
+	for i := 0; i < len(s); i++ {
+		switch b := s[i]; {
+		case quote != 0:
+			if b == '\\' {
+				i++
+			} else if b == quote {
+				quote = 0
+			}
+		case b == '"' || b == '\'':
+			quote = b
+		case b == '(':
+			depth++
+		case b == ')':
+			depth--
+		case b == ',' && depth == 0:
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// expressionSeries evaluates columns over points, in time order. Points
+// where no column has a value are left out, and the columns without a
+// value are returned as null.
+func expressionSeries(measurement string, points []persistence.Point, columns []selectColumn) *result.Series {
+	resultColumns := []result.Column{{Name: "time", Type: result.Time}}
+	for _, col := range columns {
+		resultColumns = append(resultColumns, result.Column{Name: col.name, Type: result.Float})
+	}
+	series := result.NewSeries(measurement, resultColumns...)
+
+	for _, point := range points {
+		row := make([]interface{}, 1, len(resultColumns))
+		row[0] = point.Timestamp
+		found := false
+		for _, col := range columns {
+			if v, ok := col.expr.Eval(point.Fields); ok {
+				row = append(row, v)
+				found = true
+			} else {
+				row = append(row, nil)
+			}
+		}
+		if found {
+			series.Append(row...)
+		}
+	}
+	return series
+}
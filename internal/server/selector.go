@@ -0,0 +1,252 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gleicon/go-refluxdb/internal/expr"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/result"
+)
+
+// selectorCall is a call to a selector function in a SELECT clause, such
+// as max("value") or top("value", "host", 3), possibly followed by tags or
+// fields of the selected points: SELECT max("value"), "host" FROM cpu
+type selectorCall struct {
+	name  string
+	field string
+	alias string
+	// n is the number of points selected by top and bottom
+	n int
+	// tags are the tag keys top and bottom select at most one point per
+	// value of
+	tags []string
+	// aux are the tags and fields of the selected points returned with
+	// the selected values
+	aux []string
+}
+
+// isSelector reports whether name is a selector function, which returns
+// the value of a point rather than a value computed from several points
+func isSelector(name string) bool {
+	switch name {
+	case "min", "max", "first", "last", "top", "bottom":
+		return true
+	}
+	return false
+}
+
+// parseSelector returns the selector called by the SELECT clause of
+// query, or nil when it does not call one
+func parseSelector(query string) (*selectorCall, error) {
+	clause, err := selectClause(query)
+	if err != nil {
+		return nil, err
+	}
+	items := splitList(clause)
+	text, alias := splitAlias(items[0])
+	text = strings.TrimSpace(text)
+	open := strings.IndexByte(text, '(')
+	if open == -1 {
+		return nil, nil
+	}
+	name := strings.ToLower(strings.TrimSpace(text[:open]))
+	if !isSelector(name) {
+		return nil, nil
+	}
+	if !strings.HasSuffix(text, ")") {
+		return nil, fmt.Errorf("missing ) after the arguments of %s", name)
+	}
+
+	call := &selectorCall{name: name, alias: alias}
+	args := splitList(text[open+1 : len(text)-1])
+	switch name {
+	case "top", "bottom":
+		if len(args) < 2 {
+			return nil, fmt.Errorf("invalid number of arguments for %s, expected at least 2, got %d", name, len(args))
+		}
+		last := strings.TrimSpace(args[len(args)-1])
+		if call.n, err = strconv.Atoi(last); err != nil || call.n < 1 {
+			return nil, fmt.Errorf("expected a positive integer as last argument of %s, got %s", name, last)
+		}
+		for _, arg := range args[1 : len(args)-1] {
+			tag, err := identifier(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid argument of %s: %w", name, err)
+			}
+			call.tags = append(call.tags, tag)
+		}
+	default:
+		if len(args) != 1 {
+			return nil, fmt.Errorf("invalid number of arguments for %s, expected 1, got %d", name, len(args))
+		}
+	}
+	if call.field, err = identifier(args[0]); err != nil {
+		return nil, fmt.Errorf("invalid argument of %s: %w", name, err)
+	}
+
+	for _, item := range items[1:] {
+		aux, err := identifier(item)
+		if err != nil {
+			return nil, fmt.Errorf("only tags and fields can be selected with %s: %w", name, err)
+		}
+		call.aux = append(call.aux, aux)
+	}
+	return call, nil
+}
+
+// identifier reads a bare or double quoted tag or field name
+func identifier(s string) (string, error) {
+	e, err := expr.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	f, ok := e.(expr.Field)
+	if !ok {
+		return "", fmt.Errorf("expected a tag or field, got %s", e)
+	}
+	return string(f), nil
+}
+
+// selected is a point chosen by a selector, at the time it is returned at
+type selected struct {
+	ts    int64
+	point persistence.Point
+}
+
+// selectPoints applies call to points, which are in time order, over the
+// buckets of w, or over all of them when w has no interval. min, max,
+// first and last select one point per bucket, returned at the start of
+// its bucket when grouping by time and at its own timestamp otherwise.
+// top and bottom select the n points with the largest or smallest values,
+// returned at their own timestamp. Ties go to the earliest point.
+func selectPoints(call *selectorCall, points []persistence.Point, w timeBuckets) []selected {
+	var out []selected
+	for len(points) > 0 {
+		// Cut the points of the first bucket
+		end := len(points)
+		bucket := int64(0)
+		if w.interval > 0 {
+			bucket = w.start(points[0].Timestamp)
+			end = sort.Search(len(points), func(i int) bool { return w.start(points[i].Timestamp) > bucket })
+		}
+		var candidates []persistence.Point
+		for _, p := range points[:end] {
+			if _, ok := p.Fields[call.field]; ok {
+				candidates = append(candidates, p)
+			}
+		}
+		points = points[end:]
+		if len(candidates) == 0 {
+			continue
+		}
+
+		if call.name == "top" || call.name == "bottom" {
+			for _, p := range call.topBottom(candidates) {
+				out = append(out, selected{ts: p.Timestamp, point: p})
+			}
+			continue
+		}
+
+		best := candidates[0]
+		for _, p := range candidates[1:] {
+			v, b := p.Fields[call.field], best.Fields[call.field]
+			if (call.name == "max" && v > b) || (call.name == "min" && v < b) || call.name == "last" {
+				best = p
+			}
+		}
+		ts := best.Timestamp
+		if w.interval > 0 {
+			ts = bucket
+		}
+		out = append(out, selected{ts: ts, point: best})
+	}
+	return out
+}
+
+// topBottom returns the n candidates with the largest values for top or
+// the smallest for bottom, keeping only the best point of each
+// combination of the values of call.tags, in time order
+func (call *selectorCall) topBottom(candidates []persistence.Point) []persistence.Point {
+	better := func(a, b persistence.Point) bool {
+		if call.name == "top" {
+			return a.Fields[call.field] > b.Fields[call.field]
+		}
+		return a.Fields[call.field] < b.Fields[call.field]
+	}
+
+	if len(call.tags) > 0 {
+		best := make(map[string]int)
+		var distinct []persistence.Point
+		for _, p := range candidates {
+			values := make([]string, len(call.tags))
+			for i, tag := range call.tags {
+				values[i] = p.Tags[tag]
+			}
+			key := strings.Join(values, "\x00")
+			if i, ok := best[key]; !ok {
+				best[key] = len(distinct)
+				distinct = append(distinct, p)
+			} else if better(p, distinct[i]) {
+				distinct[i] = p
+			}
+		}
+		candidates = distinct
+	}
+
+	ranked := append([]persistence.Point(nil), candidates...)
+	sort.SliceStable(ranked, func(i, j int) bool { return better(ranked[i], ranked[j]) })
+	if len(ranked) > call.n {
+		ranked = ranked[:call.n]
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].Timestamp < ranked[j].Timestamp })
+	return ranked
+}
+
+// selectorSeries returns the selected values with the tags of top and
+// bottom and the auxiliary tags and fields of their points. Auxiliary
+// names found in the tags of a point are returned as strings.
+func selectorSeries(measurement string, call *selectorCall, points []selected) *result.Series {
+	column := call.alias
+	if column == "" {
+		column = call.name
+	}
+	columns := []result.Column{{Name: "time", Type: result.Time}, {Name: column, Type: result.Float}}
+	for _, tag := range call.tags {
+		columns = append(columns, result.Column{Name: tag, Type: result.String})
+	}
+	for _, name := range call.aux {
+		typ := result.Float
+		for _, s := range points {
+			if _, ok := s.point.Tags[name]; ok {
+				typ = result.String
+				break
+			}
+		}
+		columns = append(columns, result.Column{Name: name, Type: typ})
+	}
+	series := result.NewSeries(measurement, columns...)
+
+	for _, s := range points {
+		row := make(result.Row, 0, len(columns))
+		row = append(row, s.ts, s.point.Fields[call.field])
+		for _, tag := range call.tags {
+			row = append(row, s.point.Tags[tag])
+		}
+		for i, name := range call.aux {
+			var v interface{}
+			if columns[2+len(call.tags)+i].Type == result.String {
+				if tag, ok := s.point.Tags[name]; ok {
+					v = tag
+				}
+			} else if f, ok := s.point.Fields[name]; ok {
+				v = f
+			}
+			row = append(row, v)
+		}
+		series.Rows = append(series.Rows, row)
+	}
+	return series
+}
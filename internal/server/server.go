@@ -1,20 +1,37 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
+	"slices"
 	"sort"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/acl"
+	"github.com/gleicon/go-refluxdb/internal/alerts"
+	"github.com/gleicon/go-refluxdb/internal/enrich"
+	"github.com/gleicon/go-refluxdb/internal/ingest"
 	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/predicate"
 	"github.com/gleicon/go-refluxdb/internal/protocol"
+	"github.com/gleicon/go-refluxdb/internal/result"
+	"github.com/gleicon/go-refluxdb/internal/subscriber"
+	"github.com/gleicon/go-refluxdb/internal/tasks"
+	"github.com/gleicon/go-refluxdb/internal/tracing"
+	"github.com/gleicon/go-refluxdb/internal/xform"
 	"github.com/sirupsen/logrus"
 )
 
@@ -23,20 +40,227 @@ type Server struct {
 	db     *persistence.Manager
 	router *gin.Engine
 	log    *logrus.Logger
+	parser *ingest.Parser
+	start  time.Time
+	// write holds the write options of the parser, for the transform
+	// dry runs
+	write ingest.Options
+	// transforms are the transforms of the write options, nil when there
+	// are none
+	transforms *xform.Set
+	// maxWriteBytes is the size limit of a write body. Zero disables it.
+	maxWriteBytes int64
+	// budget bounds the memory of the written points waiting for storage.
+	// Nil is unlimited.
+	budget *ingest.Budget
+	// queryTimeout bounds the duration of a query. Zero disables it.
+	queryTimeout time.Duration
+	// limiter bounds the concurrent queries. Nil means unlimited.
+	limiter *queryLimiter
+	// sessions remember the database selected with USE
+	sessions *sessionStore
+	// subscriber is reloaded when subscriptions change. Nil when points
+	// are not forwarded.
+	subscriber *subscriber.Service
+	// alerts serves the check statuses. Nil when no checks run.
+	alerts *alerts.Service
+	// tasks runs tasks on demand. Nil when the scheduler is disabled.
+	tasks *tasks.Service
+	// slowQueries keeps the queries slower than the threshold. Nil when
+	// slow queries are not recorded.
+	slowQueries *slowQueryLog
+	// tracer exports the spans of the write and query requests. Nil when
+	// tracing is disabled.
+	tracer *tracing.Tracer
+	// migrations runs the series rewrites of /api/v2/migrations
+	migrations *migrations
+	// debugToken grants access to the /debug endpoints. Empty restricts
+	// them to localhost.
+	debugToken string
+	// authEnabled requires a token on every endpoint but the health
+	// checks, metrics and /debug, and enforces its scopes
+	authEnabled bool
+	// clients filters the requests by source address. Nil accepts every
+	// client.
+	clients *acl.List
+	// enrich sets and rewrites the tags of the written points. Nil
+	// leaves them as written.
+	enrich *enrich.Set
+	// deadLetters records the lines dropped from written payloads. Nil
+	// discards them.
+	deadLetters *ingest.DeadLetters
+	// dedup drops the points already written within its window. Nil
+	// keeps them.
+	dedup *ingest.Dedup
+	// rates enforces the points per second of the token quotas
+	rates *rateLimiter
+	// tenants stores the points of the tenant databases in their own
+	// files. Nil stores every point in db.
+	tenants *persistence.Pool
+
+	// httpMu guards httpServer, the server started by Start or
+	// StartWithListener, nil before
+	httpMu     sync.Mutex
+	httpServer *runningServer
 }
 
+// runningServer is a started http.Server, shut down once, by whichever
+// of the context of Start and Shutdown comes first
+type runningServer struct {
+	srv *http.Server
+
+	mu       sync.Mutex
+	stopping bool
+	// done is closed once srv.Shutdown returned err
+	done chan struct{}
+	err  error
+}
+
+// shutdown shuts the server down and returns the error of srv.Shutdown,
+// or waits for the shutdown already in progress to end, until ctx is done
+func (r *runningServer) shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	first := !r.stopping
+	r.stopping = true
+	r.mu.Unlock()
+	if first {
+		r.err = r.srv.Shutdown(ctx)
+		close(r.done)
+		return r.err
+	}
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Options configures optional server behavior
+type Options struct {
+	// Write controls validation of written points
+	Write ingest.Options
+	// QueryTimeout aborts queries running longer than this with a 408
+	// response. Zero disables it.
+	QueryTimeout time.Duration
+	// MaxConcurrentQueries limits the queries executed at once. Zero
+	// means unlimited.
+	MaxConcurrentQueries int
+	// MaxQueuedQueries is the number of queries waiting for a slot once
+	// MaxConcurrentQueries are running. Further queries get a 503.
+	MaxQueuedQueries int
+	// QueueTimeout is how long a queued query waits for a slot before
+	// getting a 503. Zero waits until the client gives up.
+	QueueTimeout time.Duration
+	// Subscriber forwards written points to the subscription destinations
+	// and is reloaded by CREATE and DROP SUBSCRIPTION. Nil stores the
+	// subscriptions without forwarding points.
+	Subscriber *subscriber.Service
+	// Alerts is the service whose checks are listed by /api/v2/checks.
+	// Nil lists no checks.
+	Alerts *alerts.Service
+	// Tasks runs the tasks of /api/v2/tasks on demand. Nil stores the
+	// tasks but rejects manual runs and retries.
+	Tasks *tasks.Service
+	// SlowQueryThreshold is the duration past which a query is logged as
+	// slow and kept for /debug/queries. Zero disables the slow query log.
+	SlowQueryThreshold time.Duration
+	// SlowQueryBuffer is the number of slow queries kept for
+	// /debug/queries, 100 when zero
+	SlowQueryBuffer int
+	// SlowQueryLog receives the slow queries. Logger is used when nil.
+	SlowQueryLog *logrus.Logger
+	// Tracer records the parsing, storage and query stages of the write
+	// and query requests as spans. Nil disables tracing.
+	Tracer *tracing.Tracer
+	// DebugToken must be sent as "Authorization: Token <token>" to reach
+	// the /debug endpoints. Empty only serves them to localhost.
+	DebugToken string
+	// AuthEnabled requires a token with the right scope on every endpoint
+	// but /ping, /health, /ready, /metrics and /debug. Tokens are managed
+	// through /api/v2/authorizations or "refluxdb token".
+	AuthEnabled bool
+	// Clients rejects with a 403 the requests from source addresses it
+	// does not allow, before any other processing. Nil accepts every
+	// client.
+	Clients *acl.List
+	// Enrichment sets and rewrites the tags of the points written over
+	// HTTP, with the rules for enrich.HTTPListener. Nil leaves them as
+	// written.
+	Enrichment *enrich.Set
+	// DeadLetters records the lines dropped from the written payloads,
+	// which /api/v2/deadletters lists and replays. Nil only logs them.
+	DeadLetters *ingest.DeadLetters
+	// Dedup drops the points written again within its window, shared
+	// with the UDP listeners. Nil stores every point.
+	Dedup *ingest.Dedup
+	// Tenants stores the points of the tenant databases in the files of
+	// their tenants. Its catalog must be the db given to New. Nil stores
+	// every point in db.
+	Tenants *persistence.Pool
+	// Budget bounds the memory of the written points waiting for storage,
+	// shared with the UDP listeners. Writes that do not fit get a 503.
+	// Nil is unlimited.
+	Budget *ingest.Budget
+	// Logger receives request and server logs. A default logrus logger is
+	// used when nil.
+	Logger *logrus.Logger
+}
+
+// New creates a server with default options
 func New(addr string, db *persistence.Manager) *Server {
+	return NewWithOptions(addr, db, Options{})
+}
+
+// NewWithOptions creates a server with the given options
+func NewWithOptions(addr string, db *persistence.Manager, opts Options) *Server {
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
-	router.Use(gin.Recovery())
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = logrus.New()
+	}
+
+	slowLog := opts.SlowQueryLog
+	if slowLog == nil {
+		slowLog = logger
+	}
 
 	s := &Server{
 		addr:   addr,
 		db:     db,
 		router: router,
-		log:    logrus.New(),
+		log:    logger,
+		parser: ingest.NewParser(opts.Write),
+		start:  time.Now(),
+		write:  opts.Write,
+
+		transforms: opts.Write.Transforms,
+
+		maxWriteBytes: opts.Write.MaxBytes,
+		budget:        opts.Budget,
+
+		queryTimeout: opts.QueryTimeout,
+		limiter:      newQueryLimiter(opts.MaxConcurrentQueries, opts.MaxQueuedQueries, opts.QueueTimeout),
+		sessions:     newSessionStore(),
+		subscriber:   opts.Subscriber,
+		alerts:       opts.Alerts,
+		tasks:        opts.Tasks,
+		slowQueries:  newSlowQueryLog(opts.SlowQueryThreshold, opts.SlowQueryBuffer, slowLog),
+		tracer:       opts.Tracer,
+		migrations:   newMigrations(),
+		debugToken:   opts.DebugToken,
+		authEnabled:  opts.AuthEnabled,
+		clients:      opts.Clients,
+		enrich:       opts.Enrichment,
+		deadLetters:  opts.DeadLetters,
+		dedup:        opts.Dedup,
+		rates:        newRateLimiter(),
+		tenants:      opts.Tenants,
 	}
 
+	router.Use(versionHeaders(), s.requestLogger(), gin.Recovery(), s.filterClients())
 	s.setupRoutes()
 	return s
 }
@@ -48,490 +272,730 @@ func (s *Server) Addr() string {
 
 func (s *Server) setupRoutes() {
 	// InfluxDB v2 API endpoints
-	v2 := s.router.Group("/api/v2")
+	admin := s.requireAdmin()
+	v2 := s.router.Group("/api/v2", s.authenticate())
 	{
-		v2.POST("/write", s.handleWrite)
-		v2.POST("/query", s.handleQuery)
-		v2.GET("/query", s.handleQuery)
+		v2.POST("/write", s.traceRequests(), s.handleWrite)
+		v2.POST("/query", s.traceRequests(), s.traceQueries("v2"), s.limitQueries(), s.handleQuery)
+		v2.GET("/query", s.traceRequests(), s.traceQueries("v2"), s.limitQueries(), s.handleQuery)
+		v2.POST("/delete", s.handleDelete)
+		v2.GET("/buckets", s.handleListBuckets)
+		v2.POST("/buckets", admin, s.handleCreateBucket)
+		v2.GET("/buckets/:bucketID", s.handleGetBucket)
+		v2.PATCH("/buckets/:bucketID", admin, s.handleUpdateBucket)
+		v2.DELETE("/buckets/:bucketID", admin, s.handleDeleteBucket)
+		v2.GET("/orgs", s.handleListOrgs)
+		v2.POST("/orgs", admin, s.handleCreateOrg)
+		v2.GET("/orgs/:orgID", s.handleGetOrg)
+		v2.PATCH("/orgs/:orgID", admin, s.handleUpdateOrg)
+		v2.DELETE("/orgs/:orgID", admin, s.handleDeleteOrg)
+		v2.GET("/checks", s.handleListChecks)
+		v2.GET("/checks/:checkID", s.handleGetCheck)
+		v2.GET("/authorizations", admin, s.handleListAuthorizations)
+		v2.POST("/authorizations", admin, s.handleCreateAuthorization)
+		v2.DELETE("/authorizations/:authID", admin, s.handleDeleteAuthorization)
+		v2.GET("/authorizations/:authID/quota", admin, s.handleGetQuota)
+		v2.PUT("/authorizations/:authID/quota", admin, s.handleSetQuota)
+		v2.GET("/audit", admin, s.handleAuditLog)
+		v2.POST("/compact", admin, s.handleCompact)
+		v2.GET("/snapshot", admin, s.handleSnapshot)
+		v2.POST("/transforms/test", admin, s.handleTestTransforms)
+		v2.GET("/deadletters", admin, s.handleDeadLetters)
+		v2.POST("/deadletters/replay", admin, s.handleReplayDeadLetters)
+		v2.DELETE("/deadletters", admin, s.handleClearDeadLetters)
+		v2.DELETE("/deadletters/:id", admin, s.handleDeleteDeadLetter)
+		v2.GET("/stats", s.handleWriteStats)
 	}
 
-	// InfluxDB v1 API endpoints
-	v1 := s.router.Group("/")
+	// Tasks read and write any database, so they are reserved to admins
+	tasks := s.router.Group("/api/v2/tasks", s.authenticate(), admin)
 	{
-		v1.POST("/write", s.handleV1Write)
-		v1.GET("/query", s.handleV1Query)
-		v1.POST("/query", s.handleV1Query)
+		tasks.GET("", s.handleListTasks)
+		tasks.POST("", s.handleCreateTask)
+		tasks.GET("/:taskID", s.handleGetTask)
+		tasks.PATCH("/:taskID", s.handleUpdateTask)
+		tasks.DELETE("/:taskID", s.handleDeleteTask)
+		tasks.GET("/:taskID/runs", s.handleListRuns)
+		tasks.POST("/:taskID/runs", s.handleRunTask)
+		tasks.GET("/:taskID/runs/:runID", s.handleGetRun)
+		tasks.POST("/:taskID/runs/:runID/retry", s.handleRetryRun)
 	}
 
-	// Health check endpoint
-	s.router.GET("/health", s.handlePing)
-}
-
-func (s *Server) Start(ctx context.Context) error {
-	srv := &http.Server{
-		Addr:    s.addr,
-		Handler: s.router,
+	// Migrations rewrite the history of a bucket, so they are reserved to
+	// admins
+	migrations := s.router.Group("/api/v2/migrations", s.authenticate(), admin)
+	{
+		migrations.GET("", s.handleListMigrations)
+		migrations.POST("", s.handleCreateMigration)
+		migrations.GET("/:migrationID", s.handleGetMigration)
 	}
 
-	go func() {
-		<-ctx.Done()
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := srv.Shutdown(shutdownCtx); err != nil {
-			s.log.Errorf("Server shutdown error: %v", err)
-		}
-	}()
+	// InfluxDB v1 API endpoints
+	v1 := s.router.Group("/", s.authenticate())
+	{
+		v1.POST("/write", s.traceRequests(), s.handleV1Write)
+		v1.GET("/query", s.traceRequests(), s.traceQueries("v1"), s.limitQueries(), s.handleV1Query)
+		v1.POST("/query", s.traceRequests(), s.traceQueries("v1"), s.limitQueries(), s.handleV1Query)
+		v1.GET("/export", s.handleExport)
+	}
 
-	s.log.Infof("Starting HTTP server on %s", s.addr)
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		return fmt.Errorf("server error: %w", err)
+	// Health check endpoints
+	s.router.GET("/ping", s.handlePing)
+	s.router.HEAD("/ping", s.handlePing)
+	s.router.GET("/health", s.handleHealth)
+	s.router.HEAD("/health", s.handleHealth)
+	s.router.GET("/api/health", s.handleHealth)
+	s.router.HEAD("/api/health", s.handleHealth)
+	s.router.GET("/ready", s.handleReady)
+	s.router.GET("/metrics", s.handleMetrics)
+
+	debug := s.router.Group("/debug", s.guardDebug())
+	{
+		debug.GET("/integrity", s.handleGetIntegrity)
+		debug.POST("/integrity", s.handleCheckIntegrity)
+		debug.GET("/queries", s.handleSlowQueries)
+		debug.GET("/vars", s.handleVars)
+		debug.GET("/pprof/*profile", s.handlePprof)
+		debug.POST("/pprof/*profile", s.handlePprof)
 	}
 
-	return nil
+	// Unknown paths get an error in the schema of their API
+	s.router.NoRoute(func(c *gin.Context) {
+		writeError(c, http.StatusNotFound, "path not found")
+	})
+}
+
+func (s *Server) Start(ctx context.Context) error {
+	s.log.Infof("Starting HTTP server on %s", s.addr)
+	return s.serve(ctx, &http.Server{Addr: s.addr, Handler: s.router}, nil)
 }
 
 // StartWithListener starts the server with a pre-configured listener
 func (s *Server) StartWithListener(ctx context.Context, listener net.Listener) error {
-	srv := &http.Server{
-		Handler: s.router,
-	}
+	s.log.Infof("Starting HTTP server on %s", listener.Addr().String())
+	return s.serve(ctx, &http.Server{Handler: s.router}, listener)
+}
 
+// serve runs srv on listener, or on its address when listener is nil,
+// until ctx is done or Shutdown is called. It returns once the shutdown
+// ends, after the requests in flight are answered, so that the writes
+// they acknowledged are stored before the storage is closed.
+func (s *Server) serve(ctx context.Context, srv *http.Server, listener net.Listener) error {
+	run := &runningServer{srv: srv, done: make(chan struct{})}
+	s.httpMu.Lock()
+	s.httpServer = run
+	s.httpMu.Unlock()
+
+	stopped := make(chan struct{})
+	defer close(stopped)
 	go func() {
-		<-ctx.Done()
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		if err := srv.Shutdown(shutdownCtx); err != nil {
-			s.log.Errorf("Server shutdown error: %v", err)
+		select {
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := run.shutdown(shutdownCtx); err != nil {
+				s.log.Errorf("Server shutdown error: %v", err)
+			}
+		case <-stopped:
 		}
 	}()
 
-	s.log.Infof("Starting HTTP server on %s", listener.Addr().String())
-	if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+	// Running migrations stop at their next batch and can be started again
+	defer s.migrations.stop()
+	var err error
+	if listener != nil {
+		err = srv.Serve(listener)
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
 		return fmt.Errorf("server error: %w", err)
 	}
-
+	// Serve returns as soon as the shutdown starts, before the requests
+	// in flight end
+	<-run.done
 	return nil
 }
 
+// Shutdown stops accepting connections and waits for the requests in
+// flight to be answered, writes included, or for ctx to be done. Start and
+// StartWithListener then return once Shutdown does, without their context
+// being canceled. Unlike canceling that context, which waits 5 seconds at
+// most, Shutdown waits as long as ctx allows.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.httpMu.Lock()
+	run := s.httpServer
+	s.httpMu.Unlock()
+	if run == nil {
+		return nil
+	}
+	return run.shutdown(ctx)
+}
+
 func (s *Server) handleWrite(c *gin.Context) {
-	body, err := ioutil.ReadAll(c.Request.Body)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	bucket, ok := s.bucketParam(c)
+	if !ok {
 		return
 	}
-
-	// Get org and bucket from query parameters
-	org := c.Query("org")
-	bucket := c.Query("bucket")
-	if org == "" || bucket == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "org and bucket are required"})
+	if !s.authorize(c, persistence.ScopeWrite, bucket) {
 		return
 	}
 
-	// Split into lines and process each line
-	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
+	// Buckets are stored as databases of the same name, so data written
+	// through either API version is visible to both
+	s.writeLines(c, bucket)
+}
 
-		// Parse line protocol
-		proto, err := protocol.Parse(line)
+// writeLines parses a line protocol body, or a JSON array of points sent
+// as application/json, and stores every point in database, creating the
+// database if needed. Some clients label line protocol as JSON, so only
+// bodies holding an array are parsed as JSON. Line protocol is parsed as
+// it is read, chunk by chunk for chunked bodies; bodies over the write
+// limits get a 413 and nothing is stored.
+//
+// Clients sending "Expect: 100-continue" only get the 100 Continue
+// response once the body is first read, so requests rejected before, such
+// as those declaring a Content-Length over the limit, never upload it.
+func (s *Server) writeLines(c *gin.Context, database string) {
+	writeRequests.Inc()
+	if s.maxWriteBytes > 0 && c.Request.ContentLength > s.maxWriteBytes {
+		writeErrors.With("too_large").Inc()
+		writeError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("%v: body of %d bytes is over the %d bytes limit",
+			protocol.ErrBatchTooLarge, c.Request.ContentLength, s.maxWriteBytes))
+		return
+	}
+	if !writableContentType(c.ContentType()) {
+		writeErrors.With("parse").Inc()
+		writeError(c, http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported Content-Type %q: expected line protocol as text/plain or points as application/json", c.ContentType()))
+		return
+	}
+	precision, err := writePrecision(c.Query("precision"))
+	if err != nil {
+		writeErrors.With("parse").Inc()
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	// The body limit and the quotas apply to compressed bodies as sent,
+	// the MaxBytes limit of the parser to what they inflate to
+	counter := &byteCounter{r: c.Request.Body}
+	reader := io.Reader(counter)
+	switch encoding := strings.ToLower(strings.TrimSpace(c.GetHeader("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(counter)
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to parse line: %v", err)})
+			writeErrors.With("parse").Inc()
+			writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid gzip body: %v", err))
 			return
 		}
+		defer gz.Close()
+		reader = gz
+	default:
+		writeErrors.With("parse").Inc()
+		writeError(c, http.StatusUnsupportedMediaType, fmt.Sprintf("unsupported Content-Encoding %q", encoding))
+		return
+	}
+	body := bufio.NewReader(reader)
+	parse := func(r io.Reader) ([]persistence.Point, error) {
+		return s.parser.ParseReaderPrecision(r, precision)
+	}
+	if c.ContentType() == "application/json" && startsWithArray(body) {
+		parse = s.parser.ParseJSONReader
+	}
+	tracing.FromContext(c.Request.Context()).SetAttribute("db.namespace", database)
+	_, span := tracing.Start(c.Request.Context(), "write.parse")
+	points, err := parse(body)
+	span.SetAttribute("points", len(points))
+	span.SetError(err)
+	span.End()
+	if errors.Is(err, protocol.ErrTooManyLines) || errors.Is(err, protocol.ErrBatchTooLarge) {
+		writeErrors.With("too_large").Inc()
+		writeError(c, http.StatusRequestEntityTooLarge, err.Error())
+		return
+	}
+	var partial *ingest.PartialWriteError
+	if err != nil && !errors.As(err, &partial) {
+		writeErrors.With("parse").Inc()
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	refundQuota, ok := s.checkQuota(c, len(points), counter.n)
+	if !ok {
+		return
+	}
+	// Unparsable client addresses only match the rules without sources
+	from, _ := netip.ParseAddrPort(c.Request.RemoteAddr)
+	if partial != nil {
+		s.deadLetters.Record(database, from.Addr(), precision, partial)
+	}
+	rules := s.enrich.For(enrich.HTTPListener, from.Addr())
+	for i := range points {
+		points[i].Database = database
+		points[i].Tags = rules.Apply(points[i].Tags)
+	}
+	points = s.dedup.Filter(points)
 
-		// Convert field values to float64
-		for field, value := range proto.Fields {
-			var floatValue float64
-
-			// Handle different field value types
-			if strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
-				// String value - store as 1.0 (presence)
-				value = strings.Trim(value, "\"")
-				floatValue = 1.0
-			} else if strings.HasSuffix(value, "i") {
-				// Integer value
-				numStr := value[:len(value)-1]
-				if intVal, err := strconv.ParseInt(numStr, 10, 64); err == nil {
-					floatValue = float64(intVal)
-				} else {
-					c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid integer value: %s", value)})
-					return
-				}
-			} else if strings.ToLower(value) == "true" {
-				floatValue = 1.0
-			} else if strings.ToLower(value) == "false" {
-				floatValue = 0.0
-			} else {
-				// Try to parse as float
-				if val, err := strconv.ParseFloat(value, 64); err == nil {
-					floatValue = val
-				} else {
-					c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid numeric value: %s", value)})
-					return
-				}
-			}
+	// Clients retry writes, unlike UDP senders, so they are pushed back
+	// rather than evicting the points buffered for others
+	var size int64
+	if s.budget != nil {
+		size = ingest.PointsSize(points)
+	}
+	if !s.budget.Reserve(size) {
+		s.dedup.Forget(points)
+		refundQuota()
+		writeErrors.With("memory").Inc()
+		writeError(c, http.StatusServiceUnavailable, "memory budget exhausted: retry later")
+		return
+	}
+	err = s.saveBatch(c.Request.Context(), points)
+	s.budget.Release(size)
+	if err != nil {
+		// The client is expected to retry the write
+		s.dedup.Forget(points)
+		refundQuota()
+		writeErrors.With("storage").Inc()
+		writeError(c, storageStatus(err), fmt.Sprintf("Failed to save measurement: %v", err))
+		return
+	}
+	pointsWritten.Add(uint64(len(points)))
 
-			// Save each field as a separate measurement
-			err = s.db.SaveMeasurement(proto.Measurement, field, floatValue, proto.Tags, proto.Timestamp)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to save measurement: %v", err)})
-				return
-			}
-		}
+	// Accepted points are stored even when some lines were dropped
+	if partial != nil {
+		writeErrors.With("partial").Inc()
+		s.logger(c).Warnf("Dropped %d points from write request", len(partial.Dropped))
+		writeError(c, http.StatusBadRequest, partial.Error())
+		return
 	}
 
 	c.Status(http.StatusNoContent)
 }
 
 func (s *Server) handleQuery(c *gin.Context) {
-	// Get org and bucket from query parameters
-	org := c.Query("org")
-	bucket := c.Query("bucket")
-	if org == "" || bucket == "" {
-		s.log.Error("Missing org or bucket parameters")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "org and bucket are required"})
+	defer observeQuery("v2", time.Now())
+
+	if c.Query("measurement") == "" && s.handleFluxQuery(c) {
+		return
+	}
+
+	bucket, ok := s.bucketParam(c)
+	if !ok {
 		return
 	}
 
 	// Get measurement from query parameters
 	measurement := c.Query("measurement")
 	if measurement == "" {
-		s.log.Error("Missing measurement parameter")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "measurement is required"})
+		s.logger(c).Error("Missing measurement parameter")
+		writeError(c, http.StatusBadRequest, "measurement is required")
 		return
 	}
 
-	// Get time range (optional)
-	start := c.Query("start")
+	// Get time range (optional). Like Flux range(), both ends may be
+	// relative to the same now, and end may be spelled stop.
+	now := time.Now()
+	startTime, err := parseRangeTime(c.Query("start"), now, 0)
+	if err != nil {
+		s.logger(c).Errorf("Invalid start time: %v", err)
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid start time: %v", err))
+		return
+	}
 	end := c.Query("end")
-
-	var startTime, endTime int64
-	var err error
-
-	if start != "" {
-		startTime, err = strconv.ParseInt(start, 10, 64)
-		if err != nil {
-			s.log.Errorf("Invalid start time: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid start time: %v", err)})
-			return
-		}
-	} else {
-		startTime = 0
+	if end == "" {
+		end = c.Query("stop")
+	}
+	endTime, err := parseRangeTime(end, now, now.UnixNano())
+	if err != nil {
+		s.logger(c).Errorf("Invalid end time: %v", err)
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid end time: %v", err))
+		return
+	}
+	if startTime > endTime {
+		writeError(c, http.StatusBadRequest, "invalid time range: start is after end")
+		return
+	}
+	// An InfluxQL WHERE clause further narrows the range and filters the
+	// points on their tags and fields
+	where, from, to, err := parseWhere(c.Query("where"), now, math.MinInt64, math.MaxInt64)
+	if err != nil {
+		s.logger(c).Errorf("Invalid where condition: %v", err)
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid where condition: %v", err))
+		return
+	}
+	startTime, endTime = max(startTime, from), min(endTime, to)
+	limit, cursor, paged, err := pageParams(c)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	if end != "" {
-		endTime, err = strconv.ParseInt(end, 10, 64)
-		if err != nil {
-			s.log.Errorf("Invalid end time: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid end time: %v", err)})
-			return
-		}
-	} else {
-		endTime = time.Now().UnixNano()
+	if !s.authorize(c, persistence.ScopeRead, bucket) {
+		return
+	}
+	exists, err := s.db.HasDatabase(bucket)
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	if !exists {
+		writeError(c, http.StatusNotFound, fmt.Sprintf("bucket %q not found", bucket))
+		return
 	}
 
-	s.log.Infof("Querying measurement %s from %d to %d", measurement, startTime, endTime)
+	s.logger(c).Debugf("Querying measurement %s from %d to %d", measurement, startTime, endTime)
+	traceOf(c).execute(bucket, queryStatement{Measurement: measurement, Start: startTime, End: endTime})
 
 	// Query the database
-	points, err := s.db.GetMeasurementRange(measurement, startTime, endTime)
+	store, release, ok := s.storageFor(c, bucket)
+	if !ok {
+		return
+	}
+	defer release()
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+	var points []persistence.Point
+	var next *persistence.PageCursor
+	if paged {
+		points, next, err = store.GetMeasurementPage(ctx, bucket, measurement, startTime, endTime, cursor, limit)
+	} else {
+		points, err = store.GetMeasurementRangeContext(ctx, bucket, measurement, startTime, endTime)
+	}
+	if s.queryAborted(c, ctx, err) {
+		return
+	}
 	if err != nil {
-		s.log.Errorf("Failed to query measurements: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query measurements: %v", err)})
+		s.logger(c).Errorf("Failed to query measurements: %v", err)
+		writeError(c, storageStatus(err), fmt.Sprintf("failed to query measurements: %v", err))
 		return
 	}
 
-	s.log.Infof("Found %d points", len(points))
-
-	// Convert points to InfluxDB v2 response format
-	response := map[string]interface{}{
-		"results": []map[string]interface{}{
-			{
-				"statement_id": 0,
-				"series": []map[string]interface{}{
-					{
-						"name":    measurement,
-						"columns": []string{"time", "field", "value"},
-						"values":  make([][]interface{}, 0, len(points)),
-					},
-				},
-			},
-		},
+	s.logger(c).Debugf("Found %d points", len(points))
+	if next != nil {
+		c.Header(nextCursorHeader, encodeCursor(next))
 	}
-
-	for _, point := range points {
-		// For each field in the point, add a value
-		for field, value := range point.Fields {
-			response["results"].([]map[string]interface{})[0]["series"].([]map[string]interface{})[0]["values"] = append(
-				response["results"].([]map[string]interface{})[0]["series"].([]map[string]interface{})[0]["values"].([][]interface{}),
-				[]interface{}{point.Timestamp.UnixNano(), field, value},
-			)
-		}
+	// Pages are cut before filtering, so a page may hold fewer points
+	// than the limit and still be followed by another
+	if keep := matchWhere(where); keep != nil {
+		points = filterPoints(points, keep)
 	}
 
-	c.JSON(http.StatusOK, response)
+	series := pointsSeries(measurement, points, false)
+	s.writeResult(c, http.StatusOK, result.New(series), result.Options{})
 }
 
 func (s *Server) handleV1Write(c *gin.Context) {
-	body, err := ioutil.ReadAll(c.Request.Body)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
 	// Get database from query parameters
 	db := c.Query("db")
 	if db == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "database is required"})
+		writeError(c, http.StatusBadRequest, "database is required")
+		return
+	}
+	if !s.authorize(c, persistence.ScopeWrite, db) {
 		return
 	}
 
-	// Split into lines and process each line
-	lines := strings.Split(strings.TrimSpace(string(body)), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
+	s.writeLines(c, db)
+}
 
-		// Parse line protocol
-		proto, err := protocol.Parse(line)
+// startsWithArray reports whether the first character of r past leading
+// white space opens a JSON array, consuming only the white space
+func startsWithArray(r *bufio.Reader) bool {
+	for {
+		b, err := r.ReadByte()
 		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Failed to parse line: %v", err)})
-			return
+			return false
 		}
-
-		// Convert field values to float64
-		for field, value := range proto.Fields {
-			var floatValue float64
-
-			// Handle different field value types
-			if strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
-				// String value - store as 1.0 (presence)
-				value = strings.Trim(value, "\"")
-				floatValue = 1.0
-			} else if strings.HasSuffix(value, "i") {
-				// Integer value
-				numStr := value[:len(value)-1]
-				if intVal, err := strconv.ParseInt(numStr, 10, 64); err == nil {
-					floatValue = float64(intVal)
-				} else {
-					c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid integer value: %s", value)})
-					return
-				}
-			} else if strings.ToLower(value) == "true" {
-				floatValue = 1.0
-			} else if strings.ToLower(value) == "false" {
-				floatValue = 0.0
-			} else {
-				// Try to parse as float
-				if val, err := strconv.ParseFloat(value, 64); err == nil {
-					floatValue = val
-				} else {
-					c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid numeric value: %s", value)})
-					return
-				}
-			}
-
-			// Save each field as a separate measurement
-			err = s.db.SaveMeasurement(proto.Measurement, field, floatValue, proto.Tags, proto.Timestamp)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to save measurement: %v", err)})
-				return
-			}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
 		}
+		r.UnreadByte()
+		return b == '['
 	}
+}
 
-	c.Status(http.StatusNoContent)
+// writableContentType reports whether a write body of the given media type
+// may hold line protocol or JSON points. Clients label line protocol as
+// text, as a form like curl --data-binary, as bytes or not at all; other
+// types are rejected rather than parsed as lines.
+func writableContentType(mediaType string) bool {
+	switch mediaType {
+	case "", "application/json", "application/x-www-form-urlencoded", "application/octet-stream":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+// writePrecision returns the unit of the timestamps of a write request
+// given its precision parameter, in the spelling of either the 1.x or the
+// 2.x API. Timestamps default to nanoseconds.
+func writePrecision(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us", "µ", "µs":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("invalid precision %q: expected one of ns, us, ms, s, m or h", precision)
 }
 
 func (s *Server) handleV1Query(c *gin.Context) {
+	defer observeQuery("v1", time.Now())
+
 	// Log the incoming request details
-	s.log.Infof("Received %s request to %s", c.Request.Method, c.Request.URL.Path)
-	s.log.Debugf("Query parameters: %v", c.Request.URL.Query())
+	s.logger(c).Debugf("Query parameters: %v", c.Request.URL.Query())
 
 	// Get query from query parameters or body
 	var query string
 	if c.Request.Method == "GET" {
 		query = c.Query("q")
-		s.log.Debugf("GET query from parameters: %q", query)
+		s.logger(c).Debugf("GET query from parameters: %q", query)
 		if query == "" {
 			// Try to get query from body even for GET requests
 			body, err := ioutil.ReadAll(c.Request.Body)
 			if err != nil {
-				s.log.Errorf("Error reading body: %v", err)
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				s.logger(c).Errorf("Error reading body: %v", err)
+				writeError(c, http.StatusBadRequest, err.Error())
 				return
 			}
 			query = string(body)
-			s.log.Debugf("GET query from body: %q", query)
+			s.logger(c).Debugf("GET query from body: %q", query)
 		}
 	} else {
-		// For POST requests, try query parameter first
-		query = c.Query("q")
-		s.log.Debugf("POST query from parameters: %q", query)
+		// For POST requests, try query parameter or form first
+		query = formValue(c, "q")
+		s.logger(c).Debugf("POST query from parameters: %q", query)
 		if query == "" {
 			// If not in query parameters, try body
 			body, err := ioutil.ReadAll(c.Request.Body)
 			if err != nil {
-				s.log.Errorf("Error reading body: %v", err)
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				s.logger(c).Errorf("Error reading body: %v", err)
+				writeError(c, http.StatusBadRequest, err.Error())
 				return
 			}
 			query = string(body)
-			s.log.Debugf("POST query from body: %q", query)
+			s.logger(c).Debugf("POST query from body: %q", query)
 		}
 	}
 
 	if query == "" {
-		s.log.Error("Missing query parameter")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "query is required"})
+		s.logger(c).Error("Missing query parameter")
+		writeError(c, http.StatusBadRequest, "query is required")
+		return
+	}
+
+	// Bind the $placeholders of the query to the params JSON object
+	params, err := parseParams(formValue(c, "params"))
+	if err == nil {
+		query, err = bindParams(query, params)
+	}
+	if err != nil {
+		s.logger(c).Errorf("Invalid query parameters: %v", err)
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid query parameters: %v", err))
 		return
 	}
+	traceOf(c).setQuery(formValue(c, "db"), query)
+
+	// Every statement returns its timestamps in the unit of epoch, and
+	// pretty=true indents the JSON
+	opts, err := parseEpoch(formValue(c, "epoch"))
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts.Pretty = formValue(c, "pretty") == "true"
+	c.Set(resultOptionsKey, opts)
 
 	// Convert query to lowercase for case-insensitive matching
 	queryLower := strings.ToLower(query)
-	s.log.Debugf("Processing query: %q", queryLower)
+	s.logger(c).Debugf("Processing query: %q", queryLower)
 
 	// Handle SHOW DATABASES command
 	if queryLower == "show databases" {
-		s.log.Info("Handling SHOW DATABASES command")
-		// TODO: Get actual databases from persistence layer
-		response := map[string]interface{}{
-			"results": []map[string]interface{}{
-				{
-					"statement_id": 0,
-					"series": []map[string]interface{}{
-						{
-							"name":    "databases",
-							"columns": []string{"name"},
-							"values":  [][]interface{}{{"mydb"}},
-						},
-					},
-				},
-			},
-		}
-		c.JSON(http.StatusOK, response)
-		return
-	}
-
-	// Handle SHOW MEASUREMENTS command
-	if queryLower == "show measurements" {
-		s.log.Info("Handling SHOW MEASUREMENTS command")
-		measurements, err := s.db.ListTimeseries()
+		s.logger(c).Debug("Handling SHOW DATABASES command")
+		databases, err := s.db.ListDatabasesContext(c.Request.Context())
 		if err != nil {
-			s.log.Errorf("Failed to list measurements: %v", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to list measurements: %v", err)})
+			s.logger(c).Errorf("Failed to list databases: %v", err)
+			writeError(c, storageStatus(err), fmt.Sprintf("failed to list databases: %v", err))
 			return
 		}
 
-		// Convert measurements to response format
-		values := make([][]interface{}, len(measurements))
-		for i, m := range measurements {
-			values[i] = []interface{}{m}
+		series := result.NewSeries("databases", result.Column{Name: "name", Type: result.String})
+		for _, name := range databases {
+			if s.allowed(c, persistence.ScopeRead, name) {
+				series.Append(name)
+			}
 		}
+		s.writeResult(c, http.StatusOK, result.New(series), result.Options{})
+		return
+	}
 
-		response := map[string]interface{}{
-			"results": []map[string]interface{}{
-				{
-					"statement_id": 0,
-					"series": []map[string]interface{}{
-						{
-							"name":    "measurements",
-							"columns": []string{"name"},
-							"values":  values,
-						},
-					},
-				},
-			},
+	if strings.HasPrefix(queryLower, "show measurements") {
+		s.handleShowMeasurements(c, query)
+		return
+	}
+	if strings.HasPrefix(queryLower, "show series") {
+		s.handleShowSeries(c, query)
+		return
+	}
+	if strings.HasPrefix(queryLower, "show retention policies") {
+		s.handleShowRetentionPolicies(c, query)
+		return
+	}
+	if isUserStatement(queryLower) {
+		s.handleUserStatement(c, query)
+		return
+	}
+
+	// Statements changing the catalog require the admin scope
+	for _, prefix := range []string{"show subscriptions", "create subscription", "drop subscription", "create database", "drop database", "show stats", "show diagnostics"} {
+		if strings.HasPrefix(queryLower, prefix) && !s.authorize(c, persistence.ScopeAdmin, "") {
+			return
 		}
-		c.JSON(http.StatusOK, response)
+	}
+
+	if strings.HasPrefix(queryLower, "show subscriptions") {
+		s.handleShowSubscriptions(c)
+		return
+	}
+	if strings.HasPrefix(queryLower, "show stats") {
+		s.handleShowStats(c, query)
+		return
+	}
+	if strings.HasPrefix(queryLower, "show diagnostics") {
+		s.handleShowDiagnostics(c)
+		return
+	}
+	if strings.HasPrefix(queryLower, "create subscription") {
+		s.handleCreateSubscription(c, query)
+		return
+	}
+	if strings.HasPrefix(queryLower, "drop subscription") {
+		s.handleDropSubscription(c, query)
 		return
 	}
 
-	// Handle CREATE DATABASE command
-	if strings.HasPrefix(queryLower, "create database") {
-		s.log.Info("Handling CREATE DATABASE command")
-		// Extract database name
+	// Handle CREATE DATABASE and DROP DATABASE commands
+	if strings.HasPrefix(queryLower, "create database") || strings.HasPrefix(queryLower, "drop database") {
 		parts := strings.Fields(query)
 		if len(parts) < 3 {
-			s.log.Error("Invalid CREATE DATABASE syntax")
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid CREATE DATABASE syntax"})
+			s.logger(c).Errorf("Invalid %s DATABASE syntax", strings.ToUpper(parts[0]))
+			writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid %s DATABASE syntax", strings.ToUpper(parts[0])))
 			return
 		}
 
-		dbName := parts[2]
-		s.log.Infof("Creating database: %s", dbName)
-		// TODO: Actually create the database in persistence layer
+		dbName := strings.Trim(parts[2], `"`)
+		var err error
+		if strings.HasPrefix(queryLower, "create") {
+			s.logger(c).Debugf("Creating database: %s", dbName)
+			err = s.db.CreateDatabaseContext(c.Request.Context(), dbName)
+		} else {
+			s.logger(c).Debugf("Dropping database: %s", dbName)
+			err = s.dropDatabase(c.Request.Context(), dbName)
+		}
+		if err != nil {
+			s.logger(c).Errorf("Failed to update database %s: %v", dbName, err)
+			s.writeResult(c, http.StatusOK, result.Error(err.Error()), result.Options{})
+			return
+		}
 
-		// Return success response
-		response := map[string]interface{}{
-			"results": []map[string]interface{}{
-				{
-					"statement_id": 0,
-				},
-			},
+		if strings.HasPrefix(queryLower, "create") {
+			s.audit(c, "database.create", dbName, "")
+		} else {
+			s.audit(c, "database.drop", dbName, "")
 		}
-		c.JSON(http.StatusOK, response)
+		s.writeResult(c, http.StatusOK, result.New(), result.Options{})
 		return
 	}
 
 	// Handle USE command
 	if strings.HasPrefix(queryLower, "use") {
-		s.log.Info("Handling USE command")
+		s.logger(c).Debug("Handling USE command")
 		// Extract database name
 		parts := strings.Fields(query)
 		if len(parts) < 2 {
-			s.log.Error("Invalid USE syntax")
-			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid USE syntax"})
+			s.logger(c).Error("Invalid USE syntax")
+			writeError(c, http.StatusBadRequest, "invalid USE syntax")
 			return
 		}
 
-		dbName := parts[1]
-		s.log.Infof("Using database: %s", dbName)
-		// TODO: Check if database exists in persistence layer
-		// For now, we'll accept any database name
-
-		// Return success response
-		response := map[string]interface{}{
-			"results": []map[string]interface{}{
-				{
-					"statement_id": 0,
-				},
-			},
+		dbName := unquoteIdent(parts[1])
+		s.logger(c).Debugf("Using database: %s", dbName)
+		if !s.authorize(c, persistence.ScopeRead, dbName) || !s.requireDatabase(c, dbName) {
+			return
 		}
-		c.JSON(http.StatusOK, response)
+
+		// Later statements of the session without a db parameter run
+		// against this database
+		s.useDatabase(c, dbName)
+		s.writeResult(c, http.StatusOK, result.New(), result.Options{})
 		return
 	}
 
 	// For other queries, we need a database
-	db := c.Query("db")
+	db := s.queryDatabase(c)
 	if db == "" {
-		s.log.Error("Missing database parameter")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "database is required"})
+		s.logger(c).Error("Missing database parameter")
+		writeError(c, http.StatusBadRequest, "database is required")
+		return
+	}
+	if !s.authorize(c, persistence.ScopeRead, db) || !s.requireDatabase(c, db) {
+		return
+	}
+
+	// EXPLAIN describes how a SELECT would read the database
+	if strings.HasPrefix(queryLower, "explain ") {
+		s.handleExplain(c, db, strings.TrimSpace(query[len("explain "):]))
 		return
 	}
 
-	// Parse the query to get measurement name and aggregation
-	measurement := ""
+	// SELECT ... INTO writes the results instead of returning them
+	into, selectQuery, err := parseInto(query)
+	if err != nil {
+		s.logger(c).Errorf("Invalid INTO clause: %v", err)
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid query format: %v", err))
+		return
+	}
+	if into != nil {
+		s.handleSelectInto(c, db, into, selectQuery)
+		return
+	}
+	s.handleSelect(c, db, query)
+}
+
+// handleSelect answers a SELECT statement against db
+func (s *Server) handleSelect(c *gin.Context, db, query string) {
+	queryLower := strings.ToLower(query)
+
+	// Parse the query to get the measurements and aggregation
+	var sources []source
 	aggregation := ""
 	field := "*"
 	startTime := int64(0)
 	endTime := time.Now().UnixNano()
+	var where predicate.Expr
+	var err error
 
 	// Handle SELECT queries
 	if strings.HasPrefix(queryLower, "select") {
 		// Extract aggregation function if present
-		selectPart := strings.Split(queryLower, "from")[0]
+		selectPart := queryLower
+		if tail, ok := afterKeyword(queryLower, "from"); ok {
+			selectPart = queryLower[:len(queryLower)-len(tail)-len("from")]
+		}
 		selectPart = strings.TrimPrefix(selectPart, "select")
 		selectPart = strings.TrimSpace(selectPart)
 
 		// Check for aggregation functions
-		aggFuncs := []string{"mean", "sum", "count", "min", "max"}
-		for _, agg := range aggFuncs {
+		for _, agg := range aggregations {
 			if strings.HasPrefix(selectPart, agg+"(") {
 				aggregation = agg
 				// Extract field name from inside parentheses
@@ -545,275 +1009,524 @@ func (s *Server) handleV1Query(c *gin.Context) {
 			field = selectPart
 		}
 
-		// Extract measurement name and WHERE clause from FROM clause
-		parts := strings.Split(queryLower, "from")
-		if len(parts) > 1 {
-			fromPart := strings.TrimSpace(parts[1])
-
-			// Extract WHERE clause if present
-			if whereIdx := strings.Index(fromPart, "where"); whereIdx != -1 {
-				whereClause := strings.TrimSpace(fromPart[whereIdx+5:])
-
-				// Parse time range from WHERE clause
-				if timeIdx := strings.Index(whereClause, "time"); timeIdx != -1 {
-					timePart := strings.TrimSpace(whereClause[timeIdx+4:])
-					s.log.Debugf("Parsing time part: %q", timePart)
-
-					// Parse >= condition
-					if startIdx := strings.Index(timePart, ">="); startIdx != -1 {
-						startStr := strings.TrimSpace(timePart[startIdx+2:])
-						if endIdx := strings.Index(startStr, "and"); endIdx != -1 {
-							startStr = strings.TrimSpace(startStr[:endIdx])
-							s.log.Debugf("Found start time string: %q", startStr)
-							var parseErr error
-							// Convert to nanoseconds if in milliseconds
-							if strings.HasSuffix(startStr, "ms") {
-								startStr = strings.TrimSuffix(startStr, "ms")
-								startTime, parseErr = strconv.ParseInt(startStr, 10, 64)
-								if parseErr != nil {
-									s.log.Errorf("Invalid start time format: %v", parseErr)
-									c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid start time format: %v", parseErr)})
-									return
-								}
-								startTime *= 1000000 // Convert ms to ns
-								s.log.Debugf("Converted start time from ms to ns: %d", startTime)
-							} else {
-								// If no ms suffix, assume nanoseconds
-								startTime, parseErr = strconv.ParseInt(startStr, 10, 64)
-								if parseErr != nil {
-									s.log.Errorf("Invalid start time format: %v", parseErr)
-									c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid start time format: %v", parseErr)})
-									return
-								}
-								s.log.Debugf("Parsed start time as ns: %d", startTime)
-							}
-						}
-					}
-
-					// Parse <= condition
-					if endIdx := strings.Index(timePart, "<="); endIdx != -1 {
-						endStr := strings.TrimSpace(timePart[endIdx+2:])
-						s.log.Debugf("Found end time string: %q", endStr)
-						// Find the end of the timestamp by looking for the next space or end of string
-						spaceIdx := strings.Index(endStr, " ")
-						if spaceIdx != -1 {
-							endStr = endStr[:spaceIdx]
-						}
-						s.log.Debugf("Trimmed end time string: %q", endStr)
-						var parseErr error
-						// Convert to nanoseconds if in milliseconds
-						if strings.HasSuffix(endStr, "ms") {
-							endStr = strings.TrimSuffix(endStr, "ms")
-							endTime, parseErr = strconv.ParseInt(endStr, 10, 64)
-							if parseErr != nil {
-								s.log.Errorf("Invalid end time format: %v", parseErr)
-								c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid end time format: %v", parseErr)})
-								return
-							}
-							endTime *= 1000000 // Convert ms to ns
-							s.log.Debugf("Converted end time from ms to ns: %d", endTime)
-						} else {
-							// If no ms suffix, assume nanoseconds
-							endTime, parseErr = strconv.ParseInt(endStr, 10, 64)
-							if parseErr != nil {
-								s.log.Errorf("Invalid end time format: %v", parseErr)
-								c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid end time format: %v", parseErr)})
-								return
-							}
-							s.log.Debugf("Parsed end time as ns: %d", endTime)
-						}
-					}
-				}
-				fromPart = strings.TrimSpace(fromPart[:whereIdx])
-			}
+		// The conditions of the WHERE clause narrow the time range the
+		// points are read from
+		where, startTime, endTime, err = parseWhere(whereClause(query), time.Now(), startTime, endTime)
+		if err != nil {
+			s.logger(c).Errorf("Invalid WHERE clause: %v", err)
+			writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid query format: %v", err))
+			return
+		}
 
-			// Split by GROUP BY if present
-			groupParts := strings.Split(fromPart, "group by")
-			measurement = strings.TrimSpace(groupParts[0])
-			// Strip quotes from measurement name, handling both regular and escaped quotes
-			measurement = strings.Trim(strings.Trim(measurement, "\""), "\\\"")
+		// The measurements are read from the query itself, as queryLower
+		// lost their case
+		if sources, err = parseFrom(query); err != nil {
+			s.logger(c).Errorf("Invalid FROM clause: %v", err)
+			writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid query format: %v", err))
+			return
 		}
 	}
 
 	// Strip quotes from field name, handling both regular and escaped quotes
 	field = strings.Trim(strings.Trim(field, "\""), "\\\"")
 
-	if measurement == "" {
-		s.log.Error("Could not determine measurement from query")
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid query format"})
+	if len(sources) == 0 {
+		s.logger(c).Error("Could not determine measurement from query")
+		writeError(c, http.StatusBadRequest, "invalid query format")
 		return
 	}
 
-	s.log.Infof("Parsed query - measurement: %s, field: %s, start: %d, end: %d", measurement, field, startTime, endTime)
+	// Extract group by interval from the query
+	groupByTime := indexUnquoted(query, "group by time", false) != -1
+	groupByInterval := int64(5 * 60 * 1e9) // default 5 minutes in nanoseconds
+	if groupByTime {
+		interval, err := groupByTimeInterval(queryLower)
+		if err != nil {
+			s.logger(c).Errorf("Invalid GROUP BY time interval: %v", err)
+			writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid query format: %v", err))
+			return
+		}
+		groupByInterval = int64(interval)
+		s.logger(c).Debugf("Using group by interval: %s", interval)
+	}
+	// tz() aligns the buckets to midnight in a time zone instead of UTC
+	loc, err := parseTimezone(query)
+	if err != nil {
+		s.logger(c).Errorf("Invalid tz clause: %v", err)
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid query format: %v", err))
+		return
+	}
+	buckets := timeBuckets{interval: groupByInterval, loc: loc}
+
+	// A transform such as derivative(mean("value"), 1s) applies to the
+	// values of a field, or to their aggregation over GROUP BY buckets
+	transform, err := parseTransform(query)
+	if err == nil && transform != nil {
+		field, aggregation = transform.field, transform.aggregation
+		switch {
+		case aggregation != "" && !groupByTime:
+			err = fmt.Errorf("%s aggregate requires a GROUP BY interval", transform.name)
+		case aggregation == "" && groupByTime:
+			err = fmt.Errorf("aggregate function required inside the call to %s", transform.name)
+		}
+	}
+	if err != nil {
+		s.logger(c).Errorf("Invalid transform: %v", err)
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid query format: %v", err))
+		return
+	}
+
+	// Several aggregations, such as mean(usage_user), max(usage_system),
+	// return a column each over the same buckets
+	var aggregates []aggregateCall
+	if transform == nil {
+		if aggregates, err = parseAggregates(query); err != nil {
+			s.logger(c).Errorf("Invalid SELECT clause: %v", err)
+			writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid query format: %v", err))
+			return
+		}
+	}
+	if aggregates != nil {
+		fields := make([]string, len(aggregates))
+		names := make([]string, len(aggregates))
+		for i, call := range aggregates {
+			fields[i], names[i] = call.field, call.name
+		}
+		field, aggregation = strings.Join(fields, ","), strings.Join(names, ",")
+	}
+
+	// Selectors return the points they select at their own timestamp,
+	// along with the tags or fields selected with them. Without those,
+	// selectors over GROUP BY buckets are plain aggregations, and first()
+	// and last() over the range are answered from the series state cache.
+	var selector *selectorCall
+	var digest *digestCall
+	if transform == nil && aggregates == nil {
+		if digest, err = parseDigestCall(query); err != nil {
+			s.logger(c).Errorf("Invalid percentile: %v", err)
+			writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid query format: %v", err))
+			return
+		}
+	}
+	if digest != nil {
+		field, aggregation = digest.field, digest.name
+	} else if transform == nil && aggregates == nil {
+		if selector, err = parseSelector(query); err != nil {
+			s.logger(c).Errorf("Invalid selector: %v", err)
+			writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid query format: %v", err))
+			return
+		}
+	}
+	if selector != nil {
+		field, aggregation = selector.field, selector.name
+		single := selector.name != "top" && selector.name != "bottom" && len(selector.aux) == 0
+		if single && (groupByTime || selector.name == "first" || selector.name == "last") {
+			selector = nil
+		}
+	}
+
+	// Conditions on tags and fields filter the points before anything is
+	// computed from them
+	keep := matchWhere(where)
+
+	// Fields and arithmetic over them are evaluated for every point
+	var columns []selectColumn
+	if aggregation == "" && field != "*" && transform == nil {
+		if columns, err = parseSelect(query); err != nil {
+			s.logger(c).Errorf("Invalid SELECT clause: %v", err)
+			writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid query format: %v", err))
+			return
+		}
+	}
+
+	store, release, ok := s.storageFor(c, db)
+	if !ok {
+		return
+	}
+	defer release()
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+	measurements, err := resolveSources(ctx, store, db, sources)
+	if s.queryAborted(c, ctx, err) {
+		return
+	}
+	if err != nil {
+		s.logger(c).Errorf("Failed to list measurements: %v", err)
+		writeError(c, storageStatus(err), fmt.Sprintf("failed to list measurements: %v", err))
+		return
+	}
+	// A single named measurement is answered even without points, while
+	// FROM lists and regular expressions only return the measurements
+	// with points, as InfluxDB does
+	keepEmpty := len(sources) == 1 && sources[0].regex == nil
+	measurement := strings.Join(measurements, ",")
+
+	// Measurements without a series carrying the tags required by the
+	// WHERE clause are answered without reading their points
+	scanned, err := withTags(ctx, store, db, measurements, where)
+	if s.queryAborted(c, ctx, err) {
+		return
+	}
+	if err != nil {
+		s.logger(c).Errorf("Failed to look up series: %v", err)
+		writeError(c, storageStatus(err), fmt.Sprintf("failed to look up series: %v", err))
+		return
+	}
+
+	s.logger(c).Debugf("Parsed query - measurement: %s, field: %s, start: %d, end: %d", measurement, field, startTime, endTime)
 
 	// Log the query in a format ready for InfluxDB CLI
 	influxQuery := fmt.Sprintf("SELECT mean(\"%s\") FROM \"%s\" WHERE time >= %dms and time <= %dms GROUP BY time(1m) fill(null) ORDER BY time ASC",
 		field, measurement, startTime/1000000, endTime/1000000)
-	s.log.Debugf("InfluxDB CLI ready query: %s", influxQuery)
+	s.logger(c).Debugf("InfluxDB CLI ready query: %s", influxQuery)
 
 	// Query the database with the parsed time range
-	s.log.Infof("Querying measurement %s with time range: start=%d (UTC: %s), end=%d (UTC: %s)",
+	s.logger(c).Debugf("Querying measurement %s with time range: start=%d (UTC: %s), end=%d (UTC: %s)",
 		measurement,
 		startTime,
 		time.Unix(0, startTime).UTC().Format(time.RFC3339Nano),
 		endTime,
 		time.Unix(0, endTime).UTC().Format(time.RFC3339Nano))
 
-	points, err := s.db.GetMeasurementRange(measurement, startTime, endTime)
-	if err != nil {
-		s.log.Errorf("Failed to query measurements: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("failed to query measurements: %v", err)})
+	traceOf(c).execute(db, queryStatement{Measurement: measurement, Field: field, Aggregation: aggregation, Start: startTime, End: endTime})
+
+	var series []*result.Series
+
+	// first() and last() over the whole range are answered from the series
+	// state cache, which Grafana stat panels hit constantly
+	if (aggregation == "first" || aggregation == "last") && !groupByTime && selector == nil && aggregates == nil && keep == nil {
+		s.handleFirstLast(c, ctx, store, db, measurements, keepEmpty, field, aggregation, startTime, endTime)
 		return
 	}
 
-	s.log.Infof("Found %d points in time range", len(points))
-	if len(points) > 0 {
-		s.log.Debugf("First point timestamp: %d (UTC: %s)",
-			points[0].Timestamp.UnixNano(),
-			points[0].Timestamp.UTC().Format(time.RFC3339Nano))
-		s.log.Debugf("Last point timestamp: %d (UTC: %s)",
-			points[len(points)-1].Timestamp.UnixNano(),
-			points[len(points)-1].Timestamp.UTC().Format(time.RFC3339Nano))
+	// Percentiles and histograms are estimated from digests built as the
+	// points are scanned, without loading them
+	if digest != nil {
+		var bucket func(int64) int64
+		if groupByTime {
+			bucket = buckets.start
+		}
+		for _, m := range measurements {
+			if !slices.Contains(scanned, m) {
+				series = append(series, digestSeries(m, digest, nil))
+				continue
+			}
+			digests, err := store.DigestRangeFilter(ctx, db, m, field, startTime, endTime, bucket, keep)
+			if s.queryAborted(c, ctx, err) {
+				return
+			}
+			if err != nil {
+				s.logger(c).Errorf("Failed to query measurements: %v", err)
+				writeError(c, storageStatus(err), fmt.Sprintf("failed to query measurements: %v", err))
+				return
+			}
+			series = append(series, digestSeries(m, digest, digests))
+		}
+		s.writeResult(c, http.StatusOK, result.New(nonEmpty(series, keepEmpty)...), result.Options{})
+		return
+	}
+
+	// Transforms over buckets also read the buckets preceding the range
+	// that their first value depends on
+	readStart := startTime
+	if transform != nil && aggregation != "" {
+		readStart = buckets.start(buckets.start(startTime) - int64(transforms[transform.name].extra(transform))*groupByInterval)
+	}
+
+	// GROUP BY time() only reads the measurements and hours holding points,
+	// as counted by the hour index, which also sizes the buckets
+	readEnd := endTime
+	if groupByTime && len(scanned) > 0 {
+		var hours []persistence.HourCount
+		scanned, hours, err = dataHours(ctx, store, db, scanned, readStart, endTime)
+		if s.queryAborted(c, ctx, err) {
+			return
+		}
+		if err != nil {
+			s.logger(c).Errorf("Failed to count points: %v", err)
+			writeError(c, storageStatus(err), fmt.Sprintf("failed to count points: %v", err))
+			return
+		}
+		if len(hours) > 0 {
+			readStart, readEnd = hoursRange(hours, readStart, endTime)
+			buckets.expected = expectedBuckets(hours, buckets)
+		}
+	}
+
+	// All the measurements are read with one scan of the shards
+	pointsByMeasurement, err := store.GetMeasurementsRangeContext(ctx, db, scanned, readStart, readEnd)
+	if s.queryAborted(c, ctx, err) {
+		return
+	}
+	if err != nil {
+		s.logger(c).Errorf("Failed to query measurements: %v", err)
+		writeError(c, storageStatus(err), fmt.Sprintf("failed to query measurements: %v", err))
+		return
+	}
+	for _, m := range measurements {
+		s.logger(c).Debugf("Found %d points of %s in time range", len(pointsByMeasurement[m]), m)
+		if keep != nil {
+			pointsByMeasurement[m] = filterPoints(pointsByMeasurement[m], keep)
+		}
 	}
 
 	// Process points based on aggregation
-	if aggregation == "mean" {
-		// Extract group by interval from the query
-		groupByInterval := int64(5 * 60 * 1e9) // default 5 minutes in nanoseconds
-		if strings.Contains(queryLower, "group by time") {
-			groupByPart := strings.Split(queryLower, "group by time(")[1]
-			if strings.Contains(groupByPart, "m)") {
-				minutes := strings.Split(groupByPart, "m)")[0]
-				if mins, err := strconv.ParseInt(minutes, 10, 64); err == nil {
-					groupByInterval = mins * 60 * 1e9 // convert minutes to nanoseconds
-					s.log.Debugf("Using group by interval: %d minutes", mins)
+	if selector != nil {
+		var w timeBuckets
+		if groupByTime {
+			w = buckets
+		}
+		for _, m := range measurements {
+			series = append(series, selectorSeries(m, selector, selectPoints(selector, pointsByMeasurement[m], w)))
+		}
+		s.writeResult(c, http.StatusOK, result.New(nonEmpty(series, keepEmpty)...), result.Options{})
+		return
+	}
+	if aggregates != nil {
+		for _, m := range measurements {
+			series = append(series, aggregatesSeries(m, aggregates, pointsByMeasurement[m], buckets))
+		}
+		s.writeResult(c, http.StatusOK, result.New(nonEmpty(series, keepEmpty)...), result.Options{})
+		return
+	}
+	if aggregation != "" {
+		firstBucket := buckets.start(startTime)
+		for _, m := range measurements {
+			samples := aggregateBuckets(pointsByMeasurement[m], field, aggregation, buckets)
+			column := aggregation
+			if transform != nil {
+				samples = transforms[transform.name].apply(transform, samples, groupByInterval)
+				// The buckets read before the range only served to
+				// compute the first one
+				for len(samples) > 0 && samples[0].ts < firstBucket {
+					samples = samples[1:]
 				}
+				column = transform.column()
 			}
+			series = append(series, samplesSeries(m, column, samples))
 		}
 
-		// Group points by time bucket
-		groupedPoints := make(map[int64][]float64)
+		s.writeResult(c, http.StatusOK, result.New(nonEmpty(series, keepEmpty)...), result.Options{})
+		return
+	}
 
-		for _, point := range points {
-			if val, ok := point.Fields[field]; ok {
-				// Calculate bucket timestamp
-				ts := point.Timestamp.UnixNano()
-				bucketTime := ts - (ts % groupByInterval)
-				s.log.Debugf("Point timestamp: %d, Bucket timestamp: %d", ts, bucketTime)
-				groupedPoints[bucketTime] = append(groupedPoints[bucketTime], val)
-			}
+	// For non-aggregated queries, return all points with their timestamps
+	for _, m := range measurements {
+		points := pointsByMeasurement[m]
+		if transform != nil {
+			samples := transforms[transform.name].apply(transform, fieldSamples(points, field), 0)
+			series = append(series, samplesSeries(m, transform.column(), samples))
+			continue
 		}
+		if field == "*" {
+			// Include all fields and tags
+			series = append(series, pointsSeries(m, points, true))
+			continue
+		}
+		series = append(series, expressionSeries(m, points, columns))
+	}
+
+	s.logger(c).Debugf("Returning %d series for measurements %s", len(series), measurement)
+	s.writeResult(c, http.StatusOK, result.New(nonEmpty(series, keepEmpty)...), result.Options{})
+}
 
-		// Calculate mean for each bucket
-		response := map[string]interface{}{
-			"results": []map[string]interface{}{
-				{
-					"statement_id": 0,
-					"series": []map[string]interface{}{
-						{
-							"name":    measurement,
-							"columns": []string{"time", "mean"},
-							"values":  make([][]interface{}, 0),
-						},
-					},
-				},
-			},
-		}
-
-		// Sort timestamps for consistent ordering
-		timestamps := make([]int64, 0, len(groupedPoints))
-		for ts := range groupedPoints {
-			timestamps = append(timestamps, ts)
-		}
-		sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
-
-		// Calculate mean for each bucket and add to response
-		for _, ts := range timestamps {
-			values := groupedPoints[ts]
+// aggregateBuckets groups the values of field in points, which are in
+// time order, by the buckets of w and returns the aggregation of each
+// bucket with values, in time order
+func aggregateBuckets(points []persistence.Point, field, aggregation string, w timeBuckets) []sample {
+	groupedPoints := make(map[int64][]float64, w.expected)
+	for _, point := range points {
+		if val, ok := point.Fields[field]; ok {
+			bucketTime := w.start(point.Timestamp)
+			groupedPoints[bucketTime] = append(groupedPoints[bucketTime], val)
+		}
+	}
+
+	// Sort timestamps for consistent ordering
+	timestamps := make([]int64, 0, len(groupedPoints))
+	for ts := range groupedPoints {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	// Aggregate each bucket, whose values are in time order
+	samples := make([]sample, 0, len(timestamps))
+	for _, ts := range timestamps {
+		values := groupedPoints[ts]
+		value := values[0]
+		switch aggregation {
+		case "first":
+		case "last":
+			value = values[len(values)-1]
+		case "count":
+			value = float64(len(values))
+		case "min":
+			for _, v := range values {
+				value = math.Min(value, v)
+			}
+		case "max":
+			for _, v := range values {
+				value = math.Max(value, v)
+			}
+		default:
 			sum := 0.0
 			for _, v := range values {
 				sum += v
 			}
-			mean := sum / float64(len(values))
+			value = sum
+			if aggregation == "mean" {
+				value /= float64(len(values))
+			}
+		}
+		samples = append(samples, sample{ts: ts, v: value})
+	}
+	return samples
+}
 
-			s.log.Debugf("Adding bucket - Time: %d (UTC: %s), Mean: %f",
-				ts,
-				time.Unix(0, ts).UTC().Format(time.RFC3339Nano),
-				mean)
+// nonEmpty returns the series holding rows, or all of them when keepEmpty
+// is set
+func nonEmpty(series []*result.Series, keepEmpty bool) []*result.Series {
+	if keepEmpty {
+		return series
+	}
+	kept := series[:0]
+	for _, s := range series {
+		if len(s.Rows) > 0 {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
 
-			// Convert timestamp from nanoseconds to milliseconds for Grafana
-			tsMillis := ts / 1000000
+// handleFirstLast answers a first() or last() query over a time range
+// with a single row per measurement holding the oldest or newest value of
+// field
+func (s *Server) handleFirstLast(c *gin.Context, ctx context.Context, store *persistence.Manager, db string, measurements []string, keepEmpty bool, field, aggregation string, start, end int64) {
+	lookup := store.LastValue
+	if aggregation == "first" {
+		lookup = store.FirstValue
+	}
 
-			response["results"].([]map[string]interface{})[0]["series"].([]map[string]interface{})[0]["values"] = append(
-				response["results"].([]map[string]interface{})[0]["series"].([]map[string]interface{})[0]["values"].([][]interface{}),
-				[]interface{}{tsMillis, mean},
-			)
+	var series []*result.Series
+	for _, measurement := range measurements {
+		ts, value, ok, err := lookup(ctx, db, measurement, field, start, end)
+		if s.queryAborted(c, ctx, err) {
+			return
 		}
-
-		// Log the response payload in a more readable format
-		jsonResponse, err := json.MarshalIndent(response, "", "  ")
 		if err != nil {
-			s.log.Errorf("Error marshaling response: %v", err)
-		} else {
-			s.log.Debugf("Response payload:\n%s", string(jsonResponse))
+			s.logger(c).Errorf("Failed to query %s value: %v", aggregation, err)
+			writeError(c, storageStatus(err), fmt.Sprintf("failed to query measurements: %v", err))
+			return
 		}
 
-		c.JSON(http.StatusOK, response)
-		return
+		ms := result.NewSeries(measurement,
+			result.Column{Name: "time", Type: result.Time},
+			result.Column{Name: aggregation, Type: result.Float},
+		)
+		if ok {
+			ms.Append(ts, value)
+		}
+		series = append(series, ms)
 	}
+	s.writeResult(c, http.StatusOK, result.New(nonEmpty(series, keepEmpty)...), result.Options{})
+}
 
-	// For non-aggregated queries, return all points with their timestamps
-	response := map[string]interface{}{
-		"results": []map[string]interface{}{
-			{
-				"statement_id": 0,
-				"series": []map[string]interface{}{
-					{
-						"name":    measurement,
-						"columns": []string{"time", field},
-						"values":  make([][]interface{}, 0),
-					},
-				},
-			},
-		},
-	}
-
-	// For regular queries, return all points
+// requireDatabase reports whether database exists. Otherwise it answers the
+// request with the InfluxDB "database not found" statement error and
+// returns false.
+func (s *Server) requireDatabase(c *gin.Context, database string) bool {
+	exists, err := s.db.HasDatabase(database)
+	if err != nil {
+		s.logger(c).Errorf("Failed to look up database: %v", err)
+		writeError(c, storageStatus(err), err.Error())
+		return false
+	}
+	if !exists {
+		s.writeResult(c, http.StatusOK, result.Error(fmt.Sprintf("database not found: %s", database)), result.Options{})
+		return false
+	}
+	return true
+}
+
+// pointsSeries builds a series with one row per point and one column per
+// field, optionally followed by tag columns, in alphabetical order.
+// Fields missing from a point are returned as null.
+func pointsSeries(measurement string, points []persistence.Point, withTags bool) *result.Series {
+	fieldSet := make(map[string]bool)
+	tagSet := make(map[string]bool)
 	for _, point := range points {
-		if field == "*" {
-			// Include all fields
-			for _, fieldValue := range point.Fields {
-				// Convert timestamp from nanoseconds to milliseconds for Grafana
-				tsMillis := point.Timestamp.UnixNano() / 1000000
-				response["results"].([]map[string]interface{})[0]["series"].([]map[string]interface{})[0]["values"] = append(
-					response["results"].([]map[string]interface{})[0]["series"].([]map[string]interface{})[0]["values"].([][]interface{}),
-					[]interface{}{tsMillis, fieldValue},
-				)
+		for k := range point.Fields {
+			fieldSet[k] = true
+		}
+		if withTags {
+			for k := range point.Tags {
+				tagSet[k] = true
 			}
-		} else if val, ok := point.Fields[field]; ok {
-			// Convert timestamp from nanoseconds to milliseconds for Grafana
-			tsMillis := point.Timestamp.UnixNano() / 1000000
-			response["results"].([]map[string]interface{})[0]["series"].([]map[string]interface{})[0]["values"] = append(
-				response["results"].([]map[string]interface{})[0]["series"].([]map[string]interface{})[0]["values"].([][]interface{}),
-				[]interface{}{tsMillis, val},
-			)
 		}
 	}
 
-	// Log the response payload in a more readable format
-	jsonResponse, err := json.MarshalIndent(response, "", "  ")
-	if err != nil {
-		s.log.Errorf("Error marshaling response: %v", err)
-	} else {
-		s.log.Debugf("Response payload:\n%s", string(jsonResponse))
+	type column struct {
+		name  string
+		isTag bool
+	}
+	keys := make([]column, 0, len(fieldSet)+len(tagSet))
+	for k := range fieldSet {
+		keys = append(keys, column{name: k})
+	}
+	for k := range tagSet {
+		if !fieldSet[k] {
+			keys = append(keys, column{name: k, isTag: true})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].name < keys[j].name })
+
+	columns := []result.Column{{Name: "time", Type: result.Time}}
+	for _, k := range keys {
+		if k.isTag {
+			columns = append(columns, result.Column{Name: k.name, Type: result.String})
+		} else {
+			columns = append(columns, result.Column{Name: k.name, Type: result.Float})
+		}
 	}
+	series := result.NewSeries(measurement, columns...)
 
-	c.JSON(http.StatusOK, response)
+	for _, point := range points {
+		row := make(result.Row, len(columns))
+		row[0] = point.Timestamp
+		for i, k := range keys {
+			if k.isTag {
+				if v, ok := point.Tags[k.name]; ok {
+					row[i+1] = v
+				}
+			} else if v, ok := point.Fields[k.name]; ok {
+				row[i+1] = v
+			}
+		}
+		series.Rows = append(series.Rows, row)
+	}
+	return series
 }
 
-func (s *Server) handlePing(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"version": "1.0.0",
-		"status":  "ok",
-	})
+// writeResult encodes resp with the encoder negotiated from the Accept
+// header, and the options of the epoch of v1 queries rather than opts
+func (s *Server) writeResult(c *gin.Context, status int, resp *result.Response, opts result.Options) {
+	if captured, ok := c.Request.Context().Value(capturedResultKey{}).(*capturedResult); ok {
+		captured.resp = resp
+		c.Status(status)
+		return
+	}
+	if v, ok := c.Get(resultOptionsKey); ok {
+		opts = v.(result.Options)
+	}
+	trace := traceOf(c)
+	trace.encode(resp)
+	defer trace.encodeDone()
+	enc := result.EncoderFor(c.GetHeader("Accept"), opts)
+	var buf bytes.Buffer
+	if err := enc.Encode(&buf, resp); err != nil {
+		s.logger(c).Errorf("Error encoding response: %v", err)
+		writeError(c, http.StatusInternalServerError, fmt.Sprintf("failed to encode response: %v", err))
+		return
+	}
+	c.Data(status, enc.ContentType(), buf.Bytes())
 }
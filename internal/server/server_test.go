@@ -1,16 +1,38 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/gleicon/go-refluxdb/internal/acl"
+	"github.com/gleicon/go-refluxdb/internal/alerts"
+	"github.com/gleicon/go-refluxdb/internal/enrich"
+	"github.com/gleicon/go-refluxdb/internal/ingest"
 	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/subscriber"
+	"github.com/gleicon/go-refluxdb/internal/tasks"
+	"github.com/gleicon/go-refluxdb/internal/tracing"
+	"github.com/gleicon/go-refluxdb/internal/xform"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -22,73 +44,99 @@ func setupTestServer(t *testing.T) (*Server, *persistence.Manager) {
 	return srv, db
 }
 
+// doRequest serves a request to srv and returns the recorded response.
+// opts, such as withHeader, are applied to the request before it is served.
+func doRequest(t testing.TB, srv *Server, method, path, body string, opts ...func(*http.Request)) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, path, strings.NewReader(body))
+	assert.NoError(t, err)
+	for _, opt := range opts {
+		opt(req)
+	}
+	w := httptest.NewRecorder()
+	srv.router.ServeHTTP(w, req)
+	return w
+}
+
+// withHeader sets a header of the request sent by doRequest
+func withHeader(key, value string) func(*http.Request) {
+	return func(req *http.Request) { req.Header.Set(key, value) }
+}
+
+// withRemoteAddr sets the address the request sent by doRequest comes from
+func withRemoteAddr(addr string) func(*http.Request) {
+	return func(req *http.Request) { req.RemoteAddr = addr }
+}
+
+// decodeValues decodes an InfluxQL JSON response holding a single series
+// and returns its values
+func decodeValues(t *testing.T, body io.Reader) [][]interface{} {
+	var response struct {
+		Results []struct {
+			Series []struct {
+				Values [][]interface{} `json:"values"`
+			} `json:"series"`
+		} `json:"results"`
+	}
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	assert.NoError(t, dec.Decode(&response))
+	if !assert.Len(t, response.Results, 1) || !assert.Len(t, response.Results[0].Series, 1) {
+		t.FailNow()
+	}
+	return response.Results[0].Series[0].Values
+}
+
 func TestHTTPServer(t *testing.T) {
 	srv, db := setupTestServer(t)
 	defer db.Close()
 
 	// Test write endpoint
 	t.Run("write endpoint", func(t *testing.T) {
-		w := httptest.NewRecorder()
 		data := `cpu,host=server1 value="42.5" 1556813561098000000`
-		req, _ := http.NewRequest("POST", "/api/v2/write?org=test-org&bucket=test-bucket", strings.NewReader(data))
-		srv.router.ServeHTTP(w, req)
+		w := doRequest(t, srv, "POST", "/api/v2/write?org=test-org&bucket=test-bucket", data)
 		assert.Equal(t, http.StatusNoContent, w.Code)
 	})
 
 	// Test query endpoint
 	t.Run("query endpoint", func(t *testing.T) {
 		// First write some test data
-		w := httptest.NewRecorder()
 		data := `cpu,host=server1 value="42.5" 1556813561098000000`
-		req, _ := http.NewRequest("POST", "/api/v2/write?org=test-org&bucket=test-bucket", strings.NewReader(data))
-		srv.router.ServeHTTP(w, req)
+		w := doRequest(t, srv, "POST", "/api/v2/write?org=test-org&bucket=test-bucket", data)
 		assert.Equal(t, http.StatusNoContent, w.Code)
 
 		// Now query it back
-		w = httptest.NewRecorder()
-		req, _ = http.NewRequest("GET", "/api/v2/query?org=test-org&bucket=test-bucket&measurement=cpu", nil)
-		srv.router.ServeHTTP(w, req)
+		w = doRequest(t, srv, "GET", "/api/v2/query?org=test-org&bucket=test-bucket&measurement=cpu", "")
 		assert.Equal(t, http.StatusOK, w.Code)
 	})
 
+	// Test annotated CSV output
+	t.Run("query endpoint csv", func(t *testing.T) {
+		w := doRequest(t, srv, "GET", "/api/v2/query?org=test-org&bucket=test-bucket&measurement=cpu", "", withHeader("Accept", "application/csv"))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/csv", w.Header().Get("Content-Type"))
+		assert.Contains(t, w.Body.String(), "#datatype,string,long,string,dateTime:RFC3339,double")
+		assert.Contains(t, w.Body.String(), ",,0,cpu,2019-05-02T16:12:41.098Z,1")
+	})
+
 	// Test ping endpoint
 	t.Run("ping endpoint", func(t *testing.T) {
-		w := httptest.NewRecorder()
-		req, _ := http.NewRequest("GET", "/health", nil)
-		srv.router.ServeHTTP(w, req)
+		w := doRequest(t, srv, "GET", "/health", "")
 		assert.Equal(t, http.StatusOK, w.Code)
 	})
 
 	// Test SHOW MEASUREMENTS command
 	t.Run("show measurements", func(t *testing.T) {
 		// First write some test data
-		w := httptest.NewRecorder()
 		data := `cpu,host=server1 value="42.5" 1556813561098000000`
-		req, _ := http.NewRequest("POST", "/write?db=mydb", strings.NewReader(data))
-		srv.router.ServeHTTP(w, req)
+		w := doRequest(t, srv, "POST", "/write?db=mydb", data)
 		assert.Equal(t, http.StatusNoContent, w.Code)
 
 		// Now test SHOW MEASUREMENTS
-		w = httptest.NewRecorder()
-		req, _ = http.NewRequest("GET", "/query?db=mydb&q=SHOW MEASUREMENTS", nil)
-		srv.router.ServeHTTP(w, req)
+		w = doRequest(t, srv, "GET", "/query?db=mydb&q=SHOW MEASUREMENTS", "")
 		assert.Equal(t, http.StatusOK, w.Code)
 
 		// Verify response format
-		var response map[string]interface{}
-		err := json.NewDecoder(w.Body).Decode(&response)
-		assert.NoError(t, err)
-
-		results, ok := response["results"].([]interface{})
-		assert.True(t, ok)
-		assert.Len(t, results, 1)
-
-		series, ok := results[0].(map[string]interface{})["series"].([]interface{})
-		assert.True(t, ok)
-		assert.Len(t, series, 1)
-
-		values, ok := series[0].(map[string]interface{})["values"].([][]interface{})
-		assert.True(t, ok)
+		values := decodeValues(t, w.Body)
 		assert.Greater(t, len(values), 0)
 
 		// Verify that "cpu" is in the measurements list
@@ -105,235 +153,180 @@ func TestHTTPServer(t *testing.T) {
 	// Test query with quoted identifiers
 	t.Run("query with quoted identifiers", func(t *testing.T) {
 		// First write some test data
-		w := httptest.NewRecorder()
 		data := `cpu,host=server1 value="42.5" 1556813561098000000`
-		req, _ := http.NewRequest("POST", "/write?db=mydb", strings.NewReader(data))
-		srv.router.ServeHTTP(w, req)
+		w := doRequest(t, srv, "POST", "/write?db=mydb", data)
 		assert.Equal(t, http.StatusNoContent, w.Code)
 
 		// Test query with quoted identifiers
-		w = httptest.NewRecorder()
-		req, _ = http.NewRequest("GET", "/query?db=mydb&q=SELECT mean(\"value\") FROM \"cpu\" WHERE time >= 1556813561098000000ms and time <= 1556813561098000000ms GROUP BY time(20s) fill(null) ORDER BY time ASC", nil)
-		srv.router.ServeHTTP(w, req)
+		w = doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q=SELECT mean(\"value\") FROM \"cpu\" WHERE time >= 1556813561098ms and time <= 1556813561098ms GROUP BY time(20s) fill(null) ORDER BY time ASC", "")
 		assert.Equal(t, http.StatusOK, w.Code)
 
 		// Verify response format
-		var response map[string]interface{}
-		err := json.NewDecoder(w.Body).Decode(&response)
-		assert.NoError(t, err)
-
-		results, ok := response["results"].([]interface{})
-		assert.True(t, ok)
-		assert.Len(t, results, 1)
-
-		series, ok := results[0].(map[string]interface{})["series"].([]interface{})
-		assert.True(t, ok)
-		assert.Len(t, series, 1)
-
-		values, ok := series[0].(map[string]interface{})["values"].([][]interface{})
-		assert.True(t, ok)
+		values := decodeValues(t, w.Body)
 		assert.Greater(t, len(values), 0)
 	})
 
 	// Test query with time range
 	t.Run("query with time range", func(t *testing.T) {
+		srv, db := setupTestServer(t)
+		defer db.Close()
+
 		// First write some test data
-		w := httptest.NewRecorder()
 		data := `cpu,host=server1 value=42.5 1556813561098000000`
-		req, _ := http.NewRequest("POST", "/write?db=mydb", strings.NewReader(data))
-		srv.router.ServeHTTP(w, req)
+		w := doRequest(t, srv, "POST", "/write?db=mydb", data)
 		assert.Equal(t, http.StatusNoContent, w.Code)
 
 		// Test query with time range in milliseconds
-		w = httptest.NewRecorder()
-		req, _ = http.NewRequest("GET", "/query?db=mydb&q=SELECT value FROM cpu WHERE time >= 1556813561098ms and time <= 1556813561098ms", nil)
-		srv.router.ServeHTTP(w, req)
+		w = doRequest(t, srv, "GET", "/query?db=mydb&q=SELECT value FROM cpu WHERE time >= 1556813561098ms and time <= 1556813561098ms", "")
 		assert.Equal(t, http.StatusOK, w.Code)
 
 		// Verify response format
-		var response map[string]interface{}
-		err := json.NewDecoder(w.Body).Decode(&response)
-		assert.NoError(t, err)
-
-		results, ok := response["results"].([]interface{})
-		assert.True(t, ok)
-		assert.Len(t, results, 1)
-
-		series, ok := results[0].(map[string]interface{})["series"].([]interface{})
-		assert.True(t, ok)
-		assert.Len(t, series, 1)
-
-		values, ok := series[0].(map[string]interface{})["values"].([][]interface{})
-		assert.True(t, ok)
+		values := decodeValues(t, w.Body)
 		assert.Len(t, values, 1)
 
-		// Verify the timestamp was properly converted
+		// Without epoch, timestamps are RFC3339 strings
 		firstValue := values[0]
 		assert.Len(t, firstValue, 2) // time, value
-		timestamp := firstValue[0].(int64)
-		assert.Equal(t, int64(1556813561098000000), timestamp) // Should be in nanoseconds
+		assert.Equal(t, "2019-05-02T16:12:41.098Z", firstValue[0])
+
+		// epoch returns them in its unit
+		for epoch, want := range map[string]string{"ns": "1556813561098000000", "u": "1556813561098000", "ms": "1556813561098", "s": "1556813561"} {
+			w = doRequest(t, srv, "GET", "/query?db=mydb&epoch="+epoch+"&q=SELECT value FROM cpu WHERE time >= 1556813561098ms and time <= 1556813561098ms", "")
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, json.Number(want), decodeValues(t, w.Body)[0][0], epoch)
+		}
+
+		// pretty indents the JSON, and msgpack is served when asked for
+		w = doRequest(t, srv, "GET", "/query?db=mydb&pretty=true&q=SELECT value FROM cpu WHERE time >= 1556813561098ms", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), "{\n    \"results\": [\n")
+
+		w = doRequest(t, srv, "GET", "/query?db=mydb&epoch=s&q=SELECT value FROM cpu WHERE time >= 1556813561098ms", "", withHeader("Accept", "application/x-msgpack"))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/x-msgpack", w.Header().Get("Content-Type"))
+		// The row holds the time as an int32 and the value as a float64
+		assert.Contains(t, w.Body.String(), "\x92\xd2\x5c\xcb\x16\xf9\xcb\x40\x45\x40")
+
+		w = doRequest(t, srv, "GET", "/query?db=mydb&epoch=days&q=SELECT value FROM cpu", "")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	// Test that all fields of a line are stored and returned as one row
+	t.Run("multi-field select all", func(t *testing.T) {
+		srv, db := setupTestServer(t)
+		defer db.Close()
+
+		data := "memory,host=server1 used=75.5,free=24.5 1556813561098000000\nmemory,host=server1 used=80i 1556813562098000000"
+		w := doRequest(t, srv, "POST", "/write?db=mydb", data)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+
+		w = doRequest(t, srv, "GET", "/query?db=mydb&epoch=ns&q=SELECT * FROM memory", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Contains(t, w.Body.String(), `"columns":["time","free","host","used"]`)
+
+		values := decodeValues(t, w.Body)
+		assert.Len(t, values, 2)
+		assert.Equal(t, []interface{}{json.Number("1556813561098000000"), json.Number("24.5"), "server1", json.Number("75.5")}, values[0])
+		assert.Equal(t, []interface{}{json.Number("1556813562098000000"), nil, "server1", json.Number("80")}, values[1])
 	})
 
 	// Test query with time range in nanoseconds
 	t.Run("query with time range in nanoseconds", func(t *testing.T) {
+		srv, db := setupTestServer(t)
+		defer db.Close()
+
 		// First write some test data
-		w := httptest.NewRecorder()
 		data := `cpu,host=server1 value=42.5 1556813561098000000`
-		req, _ := http.NewRequest("POST", "/write?db=mydb", strings.NewReader(data))
-		srv.router.ServeHTTP(w, req)
+		w := doRequest(t, srv, "POST", "/write?db=mydb", data)
 		assert.Equal(t, http.StatusNoContent, w.Code)
 
 		// Test query with time range in nanoseconds
-		w = httptest.NewRecorder()
-		req, _ = http.NewRequest("GET", "/query?db=mydb&q=SELECT value FROM cpu WHERE time >= 1556813561098000000 and time <= 1556813561098000000", nil)
-		srv.router.ServeHTTP(w, req)
+		w = doRequest(t, srv, "GET", "/query?db=mydb&epoch=ns&q=SELECT value FROM cpu WHERE time >= 1556813561098000000 and time <= 1556813561098000000", "")
 		assert.Equal(t, http.StatusOK, w.Code)
 
 		// Verify response format
-		var response map[string]interface{}
-		err := json.NewDecoder(w.Body).Decode(&response)
-		assert.NoError(t, err)
-
-		results, ok := response["results"].([]interface{})
-		assert.True(t, ok)
-		assert.Len(t, results, 1)
-
-		series, ok := results[0].(map[string]interface{})["series"].([]interface{})
-		assert.True(t, ok)
-		assert.Len(t, series, 1)
-
-		values, ok := series[0].(map[string]interface{})["values"].([][]interface{})
-		assert.True(t, ok)
+		values := decodeValues(t, w.Body)
 		assert.Len(t, values, 1)
 
 		// Verify the timestamp was properly handled
 		firstValue := values[0]
 		assert.Len(t, firstValue, 2) // time, value
-		timestamp := firstValue[0].(int64)
+		timestamp, err := firstValue[0].(json.Number).Int64()
+		assert.NoError(t, err)
 		assert.Equal(t, int64(1556813561098000000), timestamp) // Should be in nanoseconds
 	})
 
 	// Test query with time range and escaped quotes
 	t.Run("query with time range and escaped quotes", func(t *testing.T) {
 		// First write some test data
-		w := httptest.NewRecorder()
 		data := `cpu,host=server1 value="42.5" 1556813561098000000`
-		req, _ := http.NewRequest("POST", "/write?db=mydb", strings.NewReader(data))
-		srv.router.ServeHTTP(w, req)
+		w := doRequest(t, srv, "POST", "/write?db=mydb", data)
 		assert.Equal(t, http.StatusNoContent, w.Code)
 
 		// Test query with escaped quotes and time range
-		w = httptest.NewRecorder()
-		req, _ = http.NewRequest("GET", "/query?db=mydb&q=SELECT mean(\"value\") FROM \"cpu\" WHERE time >= 1556813561098ms and time <= 1556813561098ms GROUP BY time(20s) fill(null) ORDER BY time ASC", nil)
-		srv.router.ServeHTTP(w, req)
+		w = doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q=SELECT mean(\"value\") FROM \"cpu\" WHERE time >= 1556813561098ms and time <= 1556813561098ms GROUP BY time(20s) fill(null) ORDER BY time ASC", "")
 		assert.Equal(t, http.StatusOK, w.Code)
 
 		// Verify response format
-		var response map[string]interface{}
-		err := json.NewDecoder(w.Body).Decode(&response)
-		assert.NoError(t, err)
-
-		results, ok := response["results"].([]interface{})
-		assert.True(t, ok)
-		assert.Len(t, results, 1)
-
-		series, ok := results[0].(map[string]interface{})["series"].([]interface{})
-		assert.True(t, ok)
-		assert.Len(t, series, 1)
-
-		values, ok := series[0].(map[string]interface{})["values"].([][]interface{})
-		assert.True(t, ok)
+		values := decodeValues(t, w.Body)
 		assert.Greater(t, len(values), 0)
 
 		// Verify the timestamp was properly converted
 		firstValue := values[0]
-		assert.Len(t, firstValue, 3) // time, host, value
-		timestamp := firstValue[0].(int64)
-		assert.Equal(t, int64(1556813561098000000), timestamp) // Should be in nanoseconds
+		assert.Len(t, firstValue, 2) // time, mean
+		timestamp, err := firstValue[0].(json.Number).Int64()
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, timestamp, int64(1556813561098)) // Bucket start in milliseconds
 	})
 
 	// Test timestamp handling with different formats
 	t.Run("timestamp handling with different formats", func(t *testing.T) {
 		// First write some test data
-		w := httptest.NewRecorder()
 		data := `cpu,host=server1 value="42.5" 1556813561098000000`
-		req, _ := http.NewRequest("POST", "/write?db=mydb", strings.NewReader(data))
-		srv.router.ServeHTTP(w, req)
+		w := doRequest(t, srv, "POST", "/write?db=mydb", data)
 		assert.Equal(t, http.StatusNoContent, w.Code)
 
 		// Test query with millisecond timestamps
-		w = httptest.NewRecorder()
-		req, _ = http.NewRequest("GET", "/query?db=mydb&q=SELECT mean(\"value\") FROM \"cpu\" WHERE time >= 1556813561098ms and time <= 1556813561098ms", nil)
-		srv.router.ServeHTTP(w, req)
+		w = doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q=SELECT mean(\"value\") FROM \"cpu\" WHERE time >= 1556813561098ms and time <= 1556813561098ms", "")
 		assert.Equal(t, http.StatusOK, w.Code)
 
 		// Test query with nanosecond timestamps
-		w = httptest.NewRecorder()
-		req, _ = http.NewRequest("GET", "/query?db=mydb&q=SELECT mean(\"value\") FROM \"cpu\" WHERE time >= 1556813561098000000 and time <= 1556813561098000000", nil)
-		srv.router.ServeHTTP(w, req)
+		w = doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q=SELECT mean(\"value\") FROM \"cpu\" WHERE time >= 1556813561098000000 and time <= 1556813561098000000", "")
 		assert.Equal(t, http.StatusOK, w.Code)
 
 		// Verify response format for both queries
-		var response map[string]interface{}
-		err := json.NewDecoder(w.Body).Decode(&response)
-		assert.NoError(t, err)
-
-		results, ok := response["results"].([]interface{})
-		assert.True(t, ok)
-		assert.Len(t, results, 1)
-
-		series, ok := results[0].(map[string]interface{})["series"].([]interface{})
-		assert.True(t, ok)
-		assert.Len(t, series, 1)
-
-		values, ok := series[0].(map[string]interface{})["values"].([][]interface{})
-		assert.True(t, ok)
+		values := decodeValues(t, w.Body)
 		assert.Greater(t, len(values), 0)
 
 		// Verify the timestamp was properly handled
 		firstValue := values[0]
-		assert.Len(t, firstValue, 3) // time, host, value
-		timestamp := firstValue[0].(int64)
-		assert.Equal(t, int64(1556813561098000000), timestamp) // Should be in nanoseconds
+		assert.Len(t, firstValue, 2) // time, mean
+		timestamp, err := firstValue[0].(json.Number).Int64()
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, timestamp, int64(1556813561098)) // Bucket start in milliseconds
 	})
 
 	// Test timestamp parsing in WHERE clause
 	t.Run("timestamp parsing in WHERE clause", func(t *testing.T) {
 		// First write some test data
-		w := httptest.NewRecorder()
 		data := `cpu,host=server1 value="42.5" 1556813561098000000`
-		req, _ := http.NewRequest("POST", "/write?db=mydb", strings.NewReader(data))
-		srv.router.ServeHTTP(w, req)
+		w := doRequest(t, srv, "POST", "/write?db=mydb", data)
 		assert.Equal(t, http.StatusNoContent, w.Code)
 
 		// Test query with both start and end times
-		w = httptest.NewRecorder()
-		req, _ = http.NewRequest("GET", "/query?db=mydb&q=SELECT mean(\"value\") FROM \"cpu\" WHERE time >= 1556813561098ms and time <= 1556813561098ms", nil)
-		srv.router.ServeHTTP(w, req)
+		w = doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q=SELECT mean(\"value\") FROM \"cpu\" WHERE time >= 1556813561098ms and time <= 1556813561098ms", "")
 		assert.Equal(t, http.StatusOK, w.Code)
 
 		// Verify response format
-		var response map[string]interface{}
-		err := json.NewDecoder(w.Body).Decode(&response)
-		assert.NoError(t, err)
-
-		results, ok := response["results"].([]interface{})
-		assert.True(t, ok)
-		assert.Len(t, results, 1)
-
-		series, ok := results[0].(map[string]interface{})["series"].([]interface{})
-		assert.True(t, ok)
-		assert.Len(t, series, 1)
-
-		values, ok := series[0].(map[string]interface{})["values"].([][]interface{})
-		assert.True(t, ok)
+		values := decodeValues(t, w.Body)
 		assert.Greater(t, len(values), 0)
 
 		// Verify the timestamp was properly handled
 		firstValue := values[0]
-		assert.Len(t, firstValue, 3) // time, host, value
-		timestamp := firstValue[0].(int64)
-		assert.Equal(t, int64(1556813561098000000), timestamp) // Should be in nanoseconds
+		assert.Len(t, firstValue, 2) // time, mean
+		timestamp, err := firstValue[0].(json.Number).Int64()
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, timestamp, int64(1556813561098)) // Bucket start in milliseconds
 	})
 }
 
@@ -363,6 +356,63 @@ func TestServerStartStop(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestServerShutdown(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	// Shutdown alone stops the server, without canceling its context
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- srv.StartWithListener(context.Background(), listener)
+	}()
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/ping")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, srv.Shutdown(context.Background()))
+	select {
+	case err := <-errChan:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("StartWithListener did not return after Shutdown")
+	}
+	_, err = http.Get("http://" + listener.Addr().String() + "/ping")
+	assert.Error(t, err)
+	// The server is shut down once, later calls report that shutdown
+	assert.NoError(t, srv.Shutdown(context.Background()))
+
+	// Canceling the context while Shutdown runs shares its shutdown
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		errChan <- srv.StartWithListener(ctx, listener)
+	}()
+	assert.Eventually(t, func() bool {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/ping")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return true
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	assert.NoError(t, srv.Shutdown(context.Background()))
+	select {
+	case err := <-errChan:
+		assert.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("StartWithListener did not return after its context was canceled")
+	}
+}
+
 // TestInsertTestData inserts test data points with March 2025 timestamps
 func TestInsertTestData(t *testing.T) {
 	db, err := persistence.New(":memory:")
@@ -375,36 +425,31 @@ func TestInsertTestData(t *testing.T) {
 	// Test data points
 	testData := []struct {
 		measurement string
-		field       string
-		value       float64
+		fields      map[string]float64
 		tags        map[string]string
 		timestamp   int64
 	}{
 		{
 			measurement: "cpu",
-			field:       "value",
-			value:       42.5,
+			fields:      map[string]float64{"value": 42.5},
 			tags:        map[string]string{"host": "server1"},
 			timestamp:   baseTime,
 		},
 		{
 			measurement: "cpu",
-			field:       "value",
-			value:       85.0,
+			fields:      map[string]float64{"value": 85.0},
 			tags:        map[string]string{"host": "server2"},
 			timestamp:   baseTime,
 		},
 		{
 			measurement: "memory",
-			field:       "used",
-			value:       1024.0,
+			fields:      map[string]float64{"used": 1024.0},
 			tags:        map[string]string{"host": "server1"},
 			timestamp:   baseTime,
 		},
 		{
 			measurement: "memory",
-			field:       "free",
-			value:       2048.0,
+			fields:      map[string]float64{"free": 2048.0},
 			tags:        map[string]string{"host": "server1"},
 			timestamp:   baseTime,
 		},
@@ -412,23 +457,2958 @@ func TestInsertTestData(t *testing.T) {
 
 	// Insert test data
 	for _, data := range testData {
-		err := db.SaveMeasurement(data.measurement, data.field, data.value, data.tags, data.timestamp)
+		err := db.SaveMeasurement("mydb", data.measurement, data.fields, data.tags, data.timestamp)
 		assert.NoError(t, err)
-		fmt.Printf("Inserted point: measurement=%s, field=%s, value=%f, tags=%v, timestamp=%d (UTC: %s)\n",
+		fmt.Printf("Inserted point: measurement=%s, fields=%v, tags=%v, timestamp=%d (UTC: %s)\n",
 			data.measurement,
-			data.field,
-			data.value,
+			data.fields,
 			data.tags,
 			data.timestamp,
 			time.Unix(0, data.timestamp).UTC().Format(time.RFC3339Nano))
 	}
 
 	// Verify the data was inserted
-	points, err := db.GetMeasurementRange("cpu", baseTime-3600000000000, baseTime+3600000000000)
+	points, err := db.GetMeasurementRange("mydb", "cpu", baseTime-3600000000000, baseTime+3600000000000)
 	assert.NoError(t, err)
 	assert.Equal(t, 2, len(points), "Expected 2 CPU points")
 
-	points, err = db.GetMeasurementRange("memory", baseTime-3600000000000, baseTime+3600000000000)
+	points, err = db.GetMeasurementRange("mydb", "memory", baseTime-3600000000000, baseTime+3600000000000)
+	assert.NoError(t, err)
+	// Both memory writes share a series and timestamp, so they are merged
+	assert.Equal(t, 1, len(points), "Expected 1 merged memory point")
+	assert.Equal(t, map[string]float64{"used": 1024.0, "free": 2048.0}, points[0].Fields)
+}
+
+func TestWriteTimeWindow(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	srv := NewWithOptions(":8087", db, Options{Write: ingest.Options{MaxPast: time.Hour, MaxFuture: time.Minute}})
+
+	now := time.Now()
+	data := fmt.Sprintf("cpu value=1 %d\ncpu value=2 %d\ncpu value=3 %d",
+		now.UnixNano(), now.Add(-2*time.Hour).UnixNano(), now.Add(time.Hour).UnixNano())
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", data)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "partial write: 2 points dropped")
+	assert.Contains(t, w.Body.String(), "line 2")
+	assert.Contains(t, w.Body.String(), "line 3")
+	// telegraf reads the error from the headers
+	assert.True(t, strings.HasPrefix(w.Header().Get("X-Influxdb-Error"), "partial write: 2 points dropped; line 2"))
+	assert.Equal(t, Version, w.Header().Get("X-Influxdb-Version"))
+	assert.Len(t, w.Header().Get("X-Request-Id"), 32)
+
+	// The accepted point is still stored
+	points, err := db.GetMeasurementRange("mydb", "cpu", 0, now.Add(2*time.Hour).UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+}
+
+func TestWriteEnrichment(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	rules, err := enrich.New([]enrich.Rule{
+		{Listeners: []string{enrich.HTTPListener}, Sources: []string{"192.0.2.0/24"}, Tags: map[string]string{"site": "lab"}},
+		{Listeners: []string{":8089"}, Tags: map[string]string{"agent": "udp"}},
+		{Tag: "host", Pattern: `\.example\.com$`},
+	})
+	assert.NoError(t, err)
+	srv := NewWithOptions(":8087", db, Options{Enrichment: rules})
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu,host=web1.example.com value=1 1000000000", withRemoteAddr("192.0.2.7:51234"))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	points, err := db.GetMeasurementRange("mydb", "cpu", 0, 2000000000)
+	assert.NoError(t, err)
+	if assert.Len(t, points, 1) {
+		assert.Equal(t, map[string]string{"host": "web1", "site": "lab"}, points[0].Tags)
+	}
+}
+
+func TestWriteQuota(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	budget := ingest.NewBudget(1 << 20)
+	srv := NewWithOptions(":8087", db, Options{AuthEnabled: true, Budget: budget})
+	_, admin, err := db.AddToken("admin", []string{"admin"})
+	assert.NoError(t, err)
+
+	request := func(method, target, token, body string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, method, target, body, withHeader("Authorization", "Token "+token))
+	}
+
+	w := request("POST", "/api/v2/authorizations", admin, `{"scopes": ["write:mydb"], "quota": {"pointsPerSecond": 2, "burst": 3, "bytesPerDay": 60}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var auth authorization
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &auth))
+	assert.Equal(t, &quota{PointsPerSecond: 2, Burst: 3, BytesPerDay: 60}, auth.Quota)
+
+	// The burst is written at once, then points come at the sustained rate
+	w = request("POST", "/api/v2/write?org=my-org&bucket=mydb", auth.Token, "cpu value=1 1\ncpu value=2 2\ncpu value=3 3")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = request("POST", "/api/v2/write?org=my-org&bucket=mydb", auth.Token, "cpu value=4 4")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "over quota")
+	w = request("POST", "/api/v2/write?org=my-org&bucket=mydb", auth.Token, "cpu value=4 4\ncpu value=5 5\ncpu value=6 6\ncpu value=7 7")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), `"code":"request too large"`)
+
+	// Rejected writes do not count in the bytes of the day
+	w = request("PUT", "/api/v2/authorizations/"+auth.ID+"/quota", admin, `{"bytesPerDay": 50}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	w = request("GET", "/api/v2/authorizations/"+auth.ID+"/quota", admin, "")
+	assert.JSONEq(t, `{"quota": {"pointsPerSecond": 0, "burst": 0, "bytesPerDay": 50}, "bytesToday": 41}`, w.Body.String())
+	w = request("POST", "/api/v2/write?org=my-org&bucket=mydb", auth.Token, "cpu value=4 4")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	w = request("POST", "/api/v2/write?org=my-org&bucket=mydb", auth.Token, "cpu value=4 4\n"+strings.Repeat("#", 60))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// Writes failing after the quota check give back what they were
+	// charged, so the retry fits in a quota with room for a single write
+	w = request("POST", "/api/v2/authorizations", admin, `{"scopes": ["write:mydb"], "quota": {"pointsPerSecond": 1, "burst": 1, "bytesPerDay": 20}}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var single authorization
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &single))
+	assert.True(t, budget.Reserve(budget.Limit()))
+	w = request("POST", "/api/v2/write?org=my-org&bucket=mydb", single.Token, "cpu value=8 8")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	budget.Release(budget.Limit())
+	w = request("GET", "/api/v2/authorizations/"+single.ID+"/quota", admin, "")
+	assert.Contains(t, w.Body.String(), `"bytesToday":0`)
+	w = request("POST", "/api/v2/write?org=my-org&bucket=mydb", single.Token, "cpu value=8 8")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = request("GET", "/api/v2/authorizations/"+single.ID+"/quota", admin, "")
+	assert.Contains(t, w.Body.String(), `"bytesToday":13`)
+
+	assert.Equal(t, http.StatusBadRequest, request("PUT", "/api/v2/authorizations/"+auth.ID+"/quota", admin, `{"burst": -1}`).Code)
+	assert.Equal(t, http.StatusNotFound, request("GET", "/api/v2/authorizations/unknown/quota", admin, "").Code)
+}
+
+func TestWriteDedup(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := NewWithOptions(":8087", db, Options{Dedup: ingest.NewDedup(time.Minute, 0)})
+
+	// The retried write only stores its new point
+	before := pointsWritten.Value()
+	for _, body := range []string{"cpu value=1 1\ncpu value=2 2", "cpu value=1 1\ncpu value=2 2\ncpu value=3 3"} {
+		w := doRequest(t, srv, "POST", "/write?db=mydb", body)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+	}
+	assert.Equal(t, uint64(3), pointsWritten.Value()-before)
+	points, err := db.GetMeasurementRange("mydb", "cpu", 0, 10)
+	assert.NoError(t, err)
+	assert.Len(t, points, 3)
+}
+
+func TestTenants(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	pool, err := persistence.NewPool(db, persistence.PoolOptions{
+		Tenants: []persistence.Tenant{{Name: "acme", Path: filepath.Join(t.TempDir(), "acme.db"), Databases: []string{"acme"}}},
+		Options: persistence.DefaultOptions(),
+	})
+	assert.NoError(t, err)
+	defer pool.Close()
+	srv := NewWithOptions(":8087", db, Options{Tenants: pool})
+
+	w := doRequest(t, srv, "POST", "/write?db=acme", "cpu value=1 1000000000\ncpu value=2 2000000000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = doRequest(t, srv, "POST", "/write?db=other", "cpu value=3 1000000000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	// The points of the tenant are only in its file, its database in both
+	points, err := db.GetMeasurementRange("acme", "cpu", 0, 3000000000)
+	assert.NoError(t, err)
+	assert.Empty(t, points)
+	exists, err := db.HasDatabase("acme")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	w = doRequest(t, srv, "GET", "/query?db=acme&q="+url.QueryEscape("SELECT value FROM cpu"), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, decodeValues(t, w.Body), 2)
+	w = doRequest(t, srv, "GET", "/query?db=other&q="+url.QueryEscape("SELECT value FROM cpu"), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, decodeValues(t, w.Body), 1)
+
+	// Tenant databases keep their names, so their points stay in the
+	// tenant file
+	acme, err := db.GetDatabase("acme")
+	assert.NoError(t, err)
+	other, err := db.GetDatabase("other")
+	assert.NoError(t, err)
+	w = doRequest(t, srv, "PATCH", "/api/v2/buckets/"+acme.ID, `{"name":"renamed"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "tenant acme")
+	assert.Equal(t, http.StatusUnprocessableEntity, doRequest(t, srv, "PATCH", "/api/v2/buckets/"+other.ID, `{"name":"acme"}`).Code)
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "PATCH", "/api/v2/buckets/"+acme.ID, `{"name":"acme","description":"tenant"}`).Code)
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "PATCH", "/api/v2/buckets/"+other.ID, `{"name":"shared"}`).Code)
+	w = doRequest(t, srv, "GET", "/query?db=acme&q="+url.QueryEscape("SELECT value FROM cpu"), "")
+	assert.Len(t, decodeValues(t, w.Body), 2)
+
+	w = doRequest(t, srv, "POST", "/query?q="+url.QueryEscape("DROP DATABASE acme"), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	tenant, release, err := pool.For("acme")
+	assert.NoError(t, err)
+	defer release()
+	points, err = tenant.GetMeasurementRange("acme", "cpu", 0, 3000000000)
+	assert.NoError(t, err)
+	assert.Empty(t, points)
+}
+
+func TestDeadLetters(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := NewWithOptions(":8087", db, Options{DeadLetters: ingest.NewDeadLetters(db, 10)})
+
+	request := func(method, target, body string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, method, target, body, withRemoteAddr("10.1.2.3:40000"))
+	}
+
+	w := request("POST", "/write?db=mydb&precision=s", "cpu value=1 1\ncpu value= 2\ncpu,host value=3 3")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = request("POST", "/write?db=other", "mem free=x")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = request("GET", "/api/v2/deadletters?db=mydb", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var body struct {
+		Entries []deadLetter `json:"entries"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	if !assert.Len(t, body.Entries, 2) {
+		return
+	}
+	first, second := body.Entries[0], body.Entries[1]
+	assert.Equal(t, "cpu value= 2", first.Line)
+	assert.Equal(t, "10.1.2.3", first.Source)
+	assert.Equal(t, "s", first.Precision)
+	assert.NotEmpty(t, first.Error)
+
+	// The first line is corrected, the second is replayed as recorded and
+	// fails again
+	w = request("POST", "/api/v2/deadletters/replay", fmt.Sprintf(`{"entries": [{"id": %d, "line": "cpu value=2 2"}, {"id": %d}, {"id": 1000}]}`, first.ID, second.ID))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var replay struct {
+		Replayed int             `json:"replayed"`
+		Failed   []replayFailure `json:"failed"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &replay))
+	assert.Equal(t, 1, replay.Replayed)
+	if assert.Len(t, replay.Failed, 2) {
+		assert.Equal(t, second.ID, replay.Failed[0].ID)
+		assert.Equal(t, "dead letter not found", replay.Failed[1].Error)
+	}
+	points, err := db.GetMeasurementRange("mydb", "cpu", 0, 3000000000)
+	assert.NoError(t, err)
+	if assert.Len(t, points, 2) {
+		assert.Equal(t, int64(2000000000), points[1].Timestamp)
+	}
+
+	w = request("GET", "/api/v2/deadletters", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Len(t, body.Entries, 2)
+
+	assert.Equal(t, http.StatusNoContent, request("DELETE", fmt.Sprintf("/api/v2/deadletters/%d", second.ID), "").Code)
+	assert.Equal(t, http.StatusNotFound, request("DELETE", fmt.Sprintf("/api/v2/deadletters/%d", second.ID), "").Code)
+	w = request("DELETE", "/api/v2/deadletters?db=other", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"deleted": 1}`, w.Body.String())
+	w = request("GET", "/api/v2/deadletters", "")
+	assert.JSONEq(t, `{"links": {"self": "/api/v2/deadletters"}, "entries": []}`, w.Body.String())
+}
+
+func TestWriteTransforms(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	set, err := xform.New([]xform.Rule{
+		{Name: "fahrenheit", Measurements: []string{"sensors"}, Fields: map[string]string{"temp": "temp * 1.8 + 32"}},
+		{Name: "no-test-hosts", Where: "host =~ /^test-/", Drop: true},
+	})
+	assert.NoError(t, err)
+	srv := NewWithOptions(":8087", db, Options{Write: ingest.Options{Transforms: set}})
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "sensors,host=a temp=100 1000000000\nsensors,host=test-1 temp=0 1000000000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	points, err := db.GetMeasurementRange("mydb", "sensors", 0, 2000000000)
+	assert.NoError(t, err)
+	if assert.Len(t, points, 1) {
+		assert.Equal(t, 212.0, points[0].Fields["temp"])
+	}
+
+	// Dry runs report what the rules do without writing
+	w = doRequest(t, srv, "POST", "/api/v2/transforms/test", `{"lines": "sensors,host=test-2 temp=10 1\nbad line"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{
+		"points": [{
+			"input": {"measurement": "sensors", "tags": {"host": "test-2"}, "fields": {"temp": 10}, "time": 1},
+			"output": null,
+			"rules": ["fahrenheit", "no-test-hosts"],
+			"dropped": true
+		}],
+		"errors": ["line 2: unable to parse: invalid field format: line"]
+	}`, w.Body.String())
+
+	w = doRequest(t, srv, "POST", "/api/v2/transforms/test", `{"lines": "cpu used=2048 1", "rules": [{"name": "kib", "fields": {"used": "used / 1024", "free": "free / 1024"}}]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{
+		"points": [{
+			"input": {"measurement": "cpu", "fields": {"used": 2048}, "time": 1},
+			"output": {"measurement": "cpu", "fields": {"used": 2}, "time": 1},
+			"rules": ["kib"],
+			"dropped": false,
+			"misses": ["kib.free"]
+		}]
+	}`, w.Body.String())
+
+	w = doRequest(t, srv, "POST", "/api/v2/transforms/test", `{"lines": "cpu used=1", "rules": [{"name": "broken"}]}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	points, err = db.GetMeasurementRange("mydb", "cpu", 0, 2000000000)
+	assert.NoError(t, err)
+	assert.Empty(t, points)
+}
+
+func TestWriteLimits(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	srv := NewWithOptions(":8087", db, Options{Write: ingest.Options{MaxLines: 2, MaxBytes: 64}})
+	write := func(body, contentType string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, "POST", "/write?db=mydb", body, withHeader("Content-Type", contentType))
+	}
+
+	w := write("cpu value=1\ncpu value=2\ncpu value=3", "text/plain")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), "too many lines")
+	w = write("cpu value=1 1\n"+strings.Repeat("#", 64), "text/plain")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	w = write(`  [{"measurement": "cpu", "fields": {"value": 1}}, {"measurement": "cpu", "fields": {"value": 2}}]`, "application/json")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// Nothing from a rejected body is stored
+	points, err := db.GetMeasurementRange("mydb", "cpu", 0, time.Now().UnixNano())
+	assert.NoError(t, err)
+	assert.Empty(t, points)
+
+	// Line protocol labeled as JSON is still parsed as line protocol
+	assert.Equal(t, http.StatusNoContent, write("\ncpu value=1 1\ncpu value=2 2", "application/json").Code)
+	assert.Equal(t, http.StatusNoContent, write(` [{"measurement": "cpu", "fields": {"value": 3}, "time": 3}]`, "application/json").Code)
+	points, err = db.GetMeasurementRange("mydb", "cpu", 0, time.Now().UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, points, 3)
+}
+
+func TestWriteChunkedExpectContinue(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := NewWithOptions(":8087", db, Options{Write: ingest.Options{MaxBytes: 1024}})
+	ts := httptest.NewServer(srv.router)
+	defer ts.Close()
+
+	// send writes the request head and returns the first response, then
+	// the body chunks and the final response when the first one is a
+	// 100 Continue
+	send := func(head string, chunks ...string) (*http.Response, *http.Response) {
+		conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+		assert.NoError(t, err)
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		_, err = conn.Write([]byte(head + "\r\n"))
+		assert.NoError(t, err)
+		first, err := http.ReadResponse(r, nil)
+		assert.NoError(t, err)
+		if first.StatusCode != http.StatusContinue {
+			return first, nil
+		}
+		for _, chunk := range chunks {
+			_, err = fmt.Fprintf(conn, "%x\r\n%s\r\n", len(chunk), chunk)
+			assert.NoError(t, err)
+		}
+		_, err = conn.Write([]byte("0\r\n\r\n"))
+		assert.NoError(t, err)
+		final, err := http.ReadResponse(r, nil)
+		assert.NoError(t, err)
+		return first, final
+	}
+
+	// Chunks split lines anywhere, the parser reads through them
+	first, final := send("POST /write?db=mydb HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\nExpect: 100-continue\r\n",
+		"cpu,host=a val", "ue=1 1556813561098000000\ncpu,host=b value=2 155681356", "1098000000\n")
+	assert.Equal(t, http.StatusContinue, first.StatusCode)
+	if assert.NotNil(t, final) {
+		assert.Equal(t, http.StatusNoContent, final.StatusCode)
+	}
+	points, err := db.GetMeasurementRange("mydb", "cpu", 0, 1556813561098000000)
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+
+	// Chunked bodies are held to the size limit as they are read
+	_, final = send("POST /api/v2/write?org=o&bucket=mydb HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\nExpect: 100-continue\r\n",
+		strings.Repeat("cpu value=3 1556813561099000000\n", 20), strings.Repeat("cpu value=3 1556813561099000000\n", 20))
+	if assert.NotNil(t, final) {
+		assert.Equal(t, http.StatusRequestEntityTooLarge, final.StatusCode)
+	}
+
+	// Requests rejected before reading the body never get a 100 Continue
+	first, _ = send("POST /write?db=mydb HTTP/1.1\r\nHost: test\r\nContent-Length: 4096\r\nExpect: 100-continue\r\n")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, first.StatusCode)
+	first, _ = send("POST /write HTTP/1.1\r\nHost: test\r\nContent-Length: 12\r\nExpect: 100-continue\r\n")
+	assert.Equal(t, http.StatusBadRequest, first.StatusCode)
+
+	points, err = db.GetMeasurementRange("mydb", "cpu", 0, 1556813561099000000)
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+}
+
+func TestWriteMemoryBudget(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	budget := ingest.NewBudget(1024)
+	srv := NewWithOptions(":8087", db, Options{Budget: budget})
+
+	write := func() *httptest.ResponseRecorder {
+		return doRequest(t, srv, "POST", "/write?db=mydb", "cpu value=1 1556813561098000000")
+	}
+
+	// Points buffered by other pipelines exhaust the budget
+	assert.True(t, budget.Reserve(1000))
+	w := write()
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "memory budget")
+
+	budget.Release(1000)
+	assert.Equal(t, http.StatusNoContent, write().Code)
+	assert.Zero(t, budget.Used())
+}
+
+func TestWriteEncodingAndPrecision(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	write := func(path, encoding string, body []byte) *httptest.ResponseRecorder {
+		if encoding == "" {
+			return doRequest(t, srv, "POST", path, string(body))
+		}
+		return doRequest(t, srv, "POST", path, string(body), withHeader("Content-Encoding", encoding))
+	}
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte("cpu value=1 1556813561\ncpu value=2\n"))
+	gz.Close()
+
+	// Timestamps are scaled to the precision, points without one get the
+	// server time
+	assert.Equal(t, http.StatusNoContent, write("/write?db=mydb&precision=s", "GZIP", gzipped.Bytes()).Code)
+	assert.Equal(t, http.StatusNoContent, write("/api/v2/write?org=o&bucket=mydb&precision=ms", "identity", []byte("cpu value=3 1556813561500")).Code)
+	points, err := db.GetMeasurementRange("mydb", "cpu", 0, time.Now().UnixNano())
 	assert.NoError(t, err)
-	assert.Equal(t, 2, len(points), "Expected 2 memory points")
+	if assert.Len(t, points, 3) {
+		assert.Equal(t, int64(1556813561000000000), points[0].Timestamp)
+		assert.Equal(t, int64(1556813561500000000), points[1].Timestamp)
+	}
+
+	w := write("/write?db=mydb&precision=d", "", []byte("cpu value=1 1"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid precision")
+	w = write("/write?db=mydb", "gzip", []byte("cpu value=1 1"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid gzip body")
+	w = write("/write?db=mydb", "br", []byte("cpu value=1 1"))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+
+	// Bodies that cannot hold points are rejected without being parsed
+	for contentType, want := range map[string]int{
+		"text/plain; charset=utf-8":         http.StatusNoContent,
+		"application/x-www-form-urlencoded": http.StatusNoContent,
+		"application/octet-stream":          http.StatusNoContent,
+		"application/x-protobuf":            http.StatusUnsupportedMediaType,
+		"image/png":                         http.StatusUnsupportedMediaType,
+	} {
+		w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu value=1 1", withHeader("Content-Type", contentType))
+		assert.Equal(t, want, w.Code, contentType)
+	}
+}
+
+func TestErrorSchema(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	budget := ingest.NewBudget(1024)
+	srv := NewWithOptions(":8087", db, Options{Budget: budget})
+
+	// The v2 API answers errors with a code clients retry on, the v1 API
+	// with a message
+	w := doRequest(t, srv, "POST", "/api/v2/write?org=o", "cpu value=1")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"code":"invalid","message":"org and bucket are required"}`, w.Body.String())
+	w = doRequest(t, srv, "POST", "/write", "cpu value=1")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.JSONEq(t, `{"error":"database is required"}`, w.Body.String())
+	w = doRequest(t, srv, "GET", "/api/v2/buckets/missing", "")
+	assert.JSONEq(t, `{"code":"not found","message":"bucket not found"}`, w.Body.String())
+	w = doRequest(t, srv, "GET", "/api/v2/unknown", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.JSONEq(t, `{"code":"not found","message":"path not found"}`, w.Body.String())
+	assert.JSONEq(t, `{"error":"path not found"}`, doRequest(t, srv, "GET", "/unknown", "").Body.String())
+
+	assert.True(t, budget.Reserve(1024))
+	w = doRequest(t, srv, "POST", "/api/v2/write?org=o&bucket=mydb", "cpu value=1")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.JSONEq(t, `{"code":"unavailable","message":"memory budget exhausted: retry later"}`, w.Body.String())
+	budget.Release(1024)
+
+	assert.Equal(t, "internal error", errorCode(http.StatusInternalServerError))
+	assert.Equal(t, "too many requests", errorCode(http.StatusTooManyRequests))
+	assert.Equal(t, "invalid", errorCode(http.StatusTeapot))
+}
+
+func TestStorageStatus(t *testing.T) {
+	assert.Equal(t, http.StatusNotFound, storageStatus(fmt.Errorf("lookup: %w", persistence.ErrDatabaseNotFound)))
+	assert.Equal(t, http.StatusConflict, storageStatus(persistence.ErrDatabaseExists))
+	assert.Equal(t, http.StatusInternalServerError, storageStatus(errors.New("disk full")))
+
+	// A write that cannot get the lock of the database answers 503, which
+	// clients retry
+	path := filepath.Join(t.TempDir(), "locked.db")
+	opts := persistence.DefaultOptions()
+	opts.BusyTimeout = 10 * time.Millisecond
+	db, err := persistence.NewWithOptions(path, opts)
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := New(":8087", db)
+	other, err := sql.Open("sqlite3", path)
+	assert.NoError(t, err)
+	defer other.Close()
+	tx, err := other.Begin()
+	assert.NoError(t, err)
+	_, err = tx.Exec(`CREATE TABLE lock (x INTEGER)`)
+	assert.NoError(t, err)
+
+	w := doRequest(t, srv, "POST", "/api/v2/write?org=o&bucket=mydb", "cpu value=1")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), `"code":"unavailable"`)
+
+	assert.NoError(t, tx.Rollback())
+	w = doRequest(t, srv, "POST", "/api/v2/write?org=o&bucket=mydb", "cpu value=1")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+}
+
+func TestWriteJSON(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	body := `[{"measurement": "cpu", "tags": {"host": "a"}, "fields": {"value": 1.5}, "time": 1556813561098000000}]`
+	w := doRequest(t, srv, "POST", "/api/v2/write?org=o&bucket=mydb", body, withHeader("Content-Type", "application/json"))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	points, err := db.GetMeasurementRange("mydb", "cpu", 0, time.Now().UnixNano())
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+	assert.Equal(t, map[string]float64{"value": 1.5}, points[0].Fields)
+
+	w = doRequest(t, srv, "POST", "/write?db=mydb", `[{"measurement": "cpu"}]`, withHeader("Content-Type", "application/json; charset=utf-8"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "missing fields")
+}
+
+func TestQueryTimeout(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.SaveMeasurement("mydb", "cpu", map[string]float64{"value": 1}, nil, time.Now().UnixNano()))
+
+	// A timeout of 1ns expires before the storage is reached
+	srv := NewWithOptions(":8087", db, Options{QueryTimeout: time.Nanosecond})
+
+	w := doRequest(t, srv, "GET", "/query?db=mydb&q="+url.QueryEscape(`SELECT * FROM "cpu"`), "")
+	assert.Equal(t, http.StatusRequestTimeout, w.Code)
+	assert.Contains(t, w.Body.String(), "query timeout")
+
+	w = doRequest(t, srv, "GET", "/api/v2/query?org=o&bucket=mydb&measurement=cpu", "")
+	assert.Equal(t, http.StatusRequestTimeout, w.Code)
+
+	// Queries of a client that went away are abandoned
+	srv = NewWithOptions(":8087", db, Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = doRequest(t, srv, "GET", "/query?db=mydb&q="+url.QueryEscape(`SELECT * FROM "cpu"`), "", func(req *http.Request) {
+		*req = *req.WithContext(ctx)
+	})
+	assert.Equal(t, statusClientClosedRequest, w.Code)
+}
+
+func TestQueryLimiter(t *testing.T) {
+	l := newQueryLimiter(1, 1, 50*time.Millisecond)
+	release, err := l.acquire(context.Background())
+	assert.NoError(t, err)
+
+	queued := make(chan error)
+	go func() {
+		_, err := l.acquire(context.Background())
+		queued <- err
+	}()
+	assert.Eventually(t, func() bool { return len(l.queue) == 1 }, time.Second, time.Millisecond)
+
+	_, err = l.acquire(context.Background())
+	assert.ErrorIs(t, err, errQueueFull)
+	assert.ErrorIs(t, <-queued, errQueueTimeout)
+
+	// A released slot is handed to the next query
+	go func() {
+		_, err := l.acquire(context.Background())
+		queued <- err
+	}()
+	assert.Eventually(t, func() bool { return len(l.queue) == 1 }, time.Second, time.Millisecond)
+	release()
+	assert.NoError(t, <-queued)
+}
+
+func TestQueryLimit(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.CreateDatabase("mydb"))
+
+	srv := NewWithOptions(":8087", db, Options{MaxConcurrentQueries: 1})
+	release, err := srv.limiter.acquire(context.Background())
+	assert.NoError(t, err)
+
+	// Without a queue, queries are rejected while the slot is taken
+	w := doRequest(t, srv, "GET", "/query?db=mydb&q=SHOW+MEASUREMENTS", "")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "too many queries")
+
+	// Writes are not limited
+	w = doRequest(t, srv, "POST", "/write?db=mydb", "cpu value=1")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	release()
+	w = doRequest(t, srv, "GET", "/query?db=mydb&q=SHOW+MEASUREMENTS", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestFirstLastQueries(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	now := time.Now().Truncate(time.Minute)
+	data := fmt.Sprintf("cpu,host=a value=1 %d\ncpu,host=b value=2 %d\ncpu,host=a value=3 %d",
+		now.Add(-3*time.Minute).UnixNano(), now.Add(-2*time.Minute).UnixNano(), now.Add(-time.Minute).UnixNano())
+	w := doRequest(t, srv, "POST", "/write?db=mydb", data)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	query := func(q string) [][]interface{} {
+		w := doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q="+url.QueryEscape(q), "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		return decodeValues(t, w.Body)
+	}
+
+	values := query(`SELECT last("value") FROM "cpu"`)
+	assert.Equal(t, [][]interface{}{{json.Number(fmt.Sprint(now.Add(-time.Minute).UnixMilli())), json.Number("3")}}, values)
+	values = query(`SELECT first("value") FROM "cpu"`)
+	assert.Equal(t, [][]interface{}{{json.Number(fmt.Sprint(now.Add(-3 * time.Minute).UnixMilli())), json.Number("1")}}, values)
+
+	// Grouped by time, every bucket holds its own last value
+	values = query(`SELECT last("value") FROM "cpu" WHERE time >= 0ms and time <= ` + fmt.Sprint(now.UnixMilli()) + `ms GROUP BY time(1m)`)
+	assert.Len(t, values, 3)
+	assert.Equal(t, json.Number("2"), values[1][1])
+}
+
+func TestParseFrom(t *testing.T) {
+	names := func(q string) []string {
+		sources, err := parseFrom(q)
+		assert.NoError(t, err)
+		var got []string
+		for _, s := range sources {
+			if s.regex != nil {
+				got = append(got, "/"+s.regex.String()+"/")
+			} else {
+				got = append(got, s.name)
+			}
+		}
+		return got
+	}
+
+	assert.Equal(t, []string{"cpu"}, names(`SELECT * FROM cpu`))
+	assert.Equal(t, []string{"CPU Load"}, names(`select * from "CPU Load" where time > 0`))
+	assert.Equal(t, []string{"cpu", "mem"}, names(`SELECT mean("value") FROM "cpu","mem" GROUP BY time(1m)`))
+	assert.Equal(t, []string{"cpu", "/^disk_.*/", "a/b"}, names(`SELECT * FROM mydb.autogen.cpu, /^disk_.*/ ,"a/b";`))
+	assert.Equal(t, []string{"/a/b/"}, names(`SELECT * FROM /a\/b/`))
+	assert.Equal(t, []string{"cpu"}, names(`SELECT * FROM \"cpu\"`))
+
+	for _, q := range []string{`SELECT value`, `SELECT * FROM "cpu`, `SELECT * FROM /cpu`, `SELECT * FROM /[/`, `SELECT * FROM cpu,`} {
+		_, err := parseFrom(q)
+		assert.Error(t, err, q)
+	}
+}
+
+func TestWhereClause(t *testing.T) {
+	assert.Equal(t, " host = 'a' ", whereClause(`SELECT value FROM cpu WHERE host = 'a' GROUP BY time(1m)`))
+	assert.Equal(t, " host = 'a' ", whereClause(`SELECT value FROM cpu WHERE host = 'a' fill(null) tz('UTC')`))
+	assert.Equal(t, "", whereClause(`SELECT value FROM cpu`))
+	// Clauses are only cut outside of quotes
+	assert.Equal(t, ` host = 'fill(x)' AND "tz(" = 'tz(y)' AND region = 'a\' limit 1'`,
+		whereClause(`SELECT value FROM cpu WHERE host = 'fill(x)' AND "tz(" = 'tz(y)' AND region = 'a\' limit 1'`))
+
+	srv, db := setupTestServer(t)
+	defer db.Close()
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu,host=fill(x) value=1 1000000000\ncpu,host=tz(y) value=2 1000000000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	for host, value := range map[string]string{"fill(x)": "1", "tz(y)": "2"} {
+		w = doRequest(t, srv, "GET", "/query?db=mydb&q="+url.QueryEscape(`SELECT value FROM cpu WHERE host = '`+host+`'`), "")
+		assert.Equal(t, http.StatusOK, w.Code, host)
+		values := decodeValues(t, w.Body)
+		if assert.Len(t, values, 1, host) {
+			assert.Equal(t, json.Number(value), values[0][1])
+		}
+	}
+}
+
+func TestV1QueryMultipleMeasurements(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu value=1 1000000000\nmem value=2 1000000000\ndisk_a value=3 1000000000\ndisk_b value=4 2000000000\nDisk value=5 1000000000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	query := func(q string) []string {
+		w := doRequest(t, srv, "GET", "/query?db=mydb&q="+url.QueryEscape(q), "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var response struct {
+			Results []struct {
+				Series []struct {
+					Name   string          `json:"name"`
+					Values [][]interface{} `json:"values"`
+				} `json:"series"`
+			} `json:"results"`
+		}
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&response))
+		var got []string
+		for _, r := range response.Results {
+			for _, s := range r.Series {
+				got = append(got, fmt.Sprintf("%s:%d", s.Name, len(s.Values)))
+			}
+		}
+		return got
+	}
+
+	assert.Equal(t, []string{"cpu:1", "mem:1"}, query(`SELECT value FROM "mem","cpu"`))
+	assert.Equal(t, []string{"disk_a:1", "disk_b:1"}, query(`SELECT * FROM /^disk_/`))
+	assert.Equal(t, []string{"Disk:1", "disk_a:1", "disk_b:1"}, query(`SELECT value FROM /(?i)^disk/, "Disk"`))
+	assert.Equal(t, []string{"cpu:1", "disk_a:1"}, query(`SELECT mean("value") FROM cpu, disk_a, missing WHERE time >= 0ms and time <= 5000ms GROUP BY time(1m)`))
+	assert.Equal(t, []string{"disk_a:1", "disk_b:1"}, query(`SELECT last("value") FROM /^disk_/`))
+	assert.Equal(t, []string{"Disk:1"}, query(`SELECT * FROM "Disk"`))
+	assert.Equal(t, []string{"missing:0"}, query(`SELECT * FROM missing`))
+	assert.Empty(t, query(`SELECT * FROM /^nothing/`))
+}
+
+func TestV1QueryExpressions(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "mem used=6,free=2,total=8 1000000000\nmem used=3,total=4 2000000000\nmem Value=0.5 3000000000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	query := func(q string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q="+url.QueryEscape(q), "")
+	}
+
+	w = query(`SELECT used * 100, (used - free) / total AS ratio, round(total / 3) FROM mem`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"columns":["time","used","ratio","round"]`)
+	assert.Equal(t, [][]interface{}{
+		{json.Number("1000"), json.Number("600"), json.Number("0.5"), json.Number("3")},
+		{json.Number("2000"), json.Number("300"), nil, json.Number("1")},
+	}, decodeValues(t, w.Body))
+
+	// Field names keep their case
+	w = query(`SELECT "Value" * 2, Value FROM mem`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"columns":["time","Value","Value_1"]`)
+	assert.Equal(t, [][]interface{}{{json.Number("3000"), json.Number("1"), json.Number("0.5")}}, decodeValues(t, w.Body))
+
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT used * FROM mem`).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT nope(used) FROM mem`).Code)
+}
+
+func TestV1QueryTransforms(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	// A counter reset at 1030s
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "req count=10 1000000000000\nreq count=20 1010000000000\nreq count=40 1020000000000\nreq count=30 1030000000000\nreq count=60 1060000000000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	query := func(q string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q="+url.QueryEscape(q), "")
+	}
+	values := func(q string) []string {
+		w := query(q)
+		assert.Equal(t, http.StatusOK, w.Code, q)
+		var got []string
+		for _, row := range decodeValues(t, w.Body) {
+			got = append(got, fmt.Sprintf("%v:%v", row[0], row[1]))
+		}
+		return got
+	}
+
+	assert.Equal(t, []string{"1010000:1", "1020000:2", "1030000:-1", "1060000:1"}, values(`SELECT derivative("count", 1s) FROM req`))
+	assert.Equal(t, []string{"1010000:60", "1020000:120", "1060000:60"}, values(`SELECT non_negative_derivative(count, 1m) FROM req`))
+	assert.Equal(t, []string{"1010000:10", "1020000:20", "1030000:-10", "1060000:30"}, values(`SELECT difference(count) FROM req`))
+	assert.Equal(t, []string{"1010000:10", "1020000:10", "1030000:10", "1060000:30"}, values(`SELECT elapsed(count, 1s) FROM req`))
+
+	// Over buckets, the rate is per interval by default and the bucket
+	// before the range gives the first bucket its value. The empty bucket
+	// at 1040s is skipped.
+	assert.Equal(t, []string{"1020000:20", "1060000:10"}, values(`SELECT derivative(max("count")) FROM req WHERE time >= 1020000ms and time <= 1060000ms GROUP BY time(20s)`))
+	assert.Equal(t, []string{"1020000:1", "1060000:0.5"}, values(`SELECT derivative(max("count"), 1s) AS rate FROM req WHERE time >= 1025000ms and time <= 1060000ms GROUP BY time(20s)`))
+	assert.Contains(t, query(`SELECT difference(sum(count)) AS d FROM req GROUP BY time(20s)`).Body.String(), `"columns":["time","d"]`)
+	assert.Equal(t, []string{"1000000:30", "1020000:70", "1060000:60"}, values(`SELECT sum(count) FROM req WHERE time >= 0ms and time <= 1060000ms GROUP BY time(20s)`))
+
+	// Window transforms
+	assert.Equal(t, []string{"1010000:15", "1020000:30", "1030000:35", "1060000:45"}, values(`SELECT moving_average(count, 2) FROM req`))
+	assert.Equal(t, []string{"1020000:27.5", "1030000:28.75", "1060000:44.375"}, values(`SELECT exponential_moving_average(count, 3) FROM req`))
+	assert.Equal(t, []string{"1000000:10", "1010000:30", "1020000:70", "1030000:100", "1060000:160"}, values(`SELECT cumulative_sum(count) FROM req`))
+	assert.Equal(t, []string{"1020000:30", "1060000:50"}, values(`SELECT moving_average(max(count), 2) FROM req WHERE time >= 1020000ms and time <= 1060000ms GROUP BY time(20s)`))
+	assert.Equal(t, []string{"1020000:40", "1060000:100"}, values(`SELECT cumulative_sum(max(count)) FROM req WHERE time >= 1020000ms and time <= 1060000ms GROUP BY time(20s)`))
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT moving_average(count, 1) FROM req`).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT moving_average(count) FROM req`).Code)
+
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT derivative(count) FROM req GROUP BY time(20s)`).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT derivative(mean(count)) FROM req`).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT derivative(count, 1x) FROM req`).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT difference(count, 1s) FROM req`).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT derivative(median(count)) FROM req GROUP BY time(1m)`).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT mean(count) FROM req GROUP BY time(0s)`).Code)
+}
+
+func TestV1QueryMultipleFields(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu usage_user=10,usage_system=1 1000000000000\ncpu usage_user=20,usage_system=3 1010000000000\ncpu usage_user=30 1070000000000\ncpu usage_system=5 1130000000000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	query := func(q string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q="+url.QueryEscape(q), "")
+	}
+	values := func(q string) []string {
+		w := query(q)
+		assert.Equal(t, http.StatusOK, w.Code, q)
+		var got []string
+		for _, row := range decodeValues(t, w.Body) {
+			got = append(got, strings.Trim(fmt.Sprint(row), "[]"))
+		}
+		return got
+	}
+
+	// Field lists return a column per field, null where a point lacks one
+	w = query(`SELECT usage_user, "usage_system" FROM cpu`)
+	assert.Contains(t, w.Body.String(), `"columns":["time","usage_user","usage_system"]`)
+	assert.Equal(t, []string{"1000000 10 1", "1010000 20 3", "1070000 30 <nil>", "1130000 <nil> 5"}, values(`SELECT usage_user, usage_system FROM cpu`))
+
+	// Aggregations share the buckets, each with its own column
+	w = query(`SELECT mean(usage_user), max(usage_system) FROM cpu WHERE time >= 1000000ms and time <= 1140000ms GROUP BY time(1m)`)
+	assert.Contains(t, w.Body.String(), `"columns":["time","mean","max"]`)
+	assert.Equal(t, []string{"960000 15 3", "1020000 30 <nil>", "1080000 <nil> 5"}, values(`SELECT mean(usage_user), max(usage_system) FROM cpu WHERE time >= 1000000ms and time <= 1140000ms GROUP BY time(1m)`))
+	assert.Equal(t, []string{"960000 2 2"}, values(`SELECT count(usage_user), COUNT("usage_system") FROM cpu WHERE time >= 1000000ms and time <= 1020000ms GROUP BY time(1m)`))
+
+	// Columns are named after their alias, or their function with a
+	// suffix when it repeats
+	assert.Contains(t, query(`SELECT mean(usage_user), mean(usage_system) FROM cpu GROUP BY time(1m)`).Body.String(), `"columns":["time","mean","mean_1"]`)
+	assert.Contains(t, query(`SELECT min(usage_user) AS low, max(usage_user) AS high FROM cpu GROUP BY time(1m)`).Body.String(), `"columns":["time","low","high"]`)
+
+	// A selector may still return the fields of the selected point
+	assert.Equal(t, []string{"1010000 20 3"}, values(`SELECT max(usage_user), usage_system FROM cpu WHERE time >= 1000000ms and time <= 1020000ms`))
+
+	w = query(`SELECT mean(usage_user), usage_system FROM cpu`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "mixing aggregate and non-aggregate queries is not supported")
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT usage_system, max(usage_user) FROM cpu`).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT mean(usage_user), max(usage_user * 2) FROM cpu`).Code)
+}
+
+func TestV1Explain(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	// Points at 00:10, 00:20 and 02:30 on the first day of 1970
+	w := doRequest(t, srv, "POST", "/write?db=mydb&precision=s", "cpu,host=a value=1 600\ncpu,host=b value=2 1200\ncpu,host=a value=3 9000\nmem,host=a free=1 600")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	plan := func(q string) []string {
+		w := doRequest(t, srv, "GET", "/query?db=mydb&q="+url.QueryEscape(q), "")
+		assert.Equal(t, http.StatusOK, w.Code, q)
+		var lines []string
+		for _, row := range decodeValues(t, w.Body) {
+			lines = append(lines, row[0].(string))
+		}
+		return lines
+	}
+
+	assert.Equal(t, []string{
+		"----------",
+		"DATABASE: mydb",
+		"TIME RANGE: 1970-01-01T00:00:00Z - 1970-01-01T04:00:00Z",
+		"GROUP BY TIME: 10m0s",
+		"MEASUREMENT: cpu",
+		"  HOURS WITH POINTS: 2",
+		"  POINTS: at most 3",
+		"  SCAN RANGE: 1970-01-01T00:00:00Z - 1970-01-01T02:59:59.999999999Z",
+		"  EXPECTED BUCKETS: 3",
+	}, plan(`EXPLAIN SELECT mean(value) FROM cpu WHERE time >= 0 AND time <= 4h GROUP BY time(10m)`))
+
+	// Measurements are skipped without points in the range, or without
+	// series carrying the tags of the WHERE clause
+	assert.Equal(t, []string{
+		"----------",
+		"DATABASE: mydb",
+		"TIME RANGE: 1970-01-01T01:00:00Z - 1970-01-01T01:59:59.999999999Z",
+		"MEASUREMENT: cpu",
+		"  SERIES INDEX: series may have host = 'a'",
+		"  HOURS WITH POINTS: 0, skipped",
+	}, plan(`EXPLAIN SELECT value FROM cpu WHERE host = 'a' AND time >= 1h AND time < 2h`))
+	assert.Contains(t, plan(`EXPLAIN SELECT free FROM mem WHERE host = 'b'`), "  SERIES INDEX: no series with host = 'b', skipped")
+
+	// GROUP BY time() results do not depend on the hours read
+	w = doRequest(t, srv, "GET", "/query?db=mydb&epoch=s&q="+url.QueryEscape(`SELECT count(value) FROM cpu WHERE time >= 0 AND time <= 4h GROUP BY time(1h)`), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, [][]interface{}{{json.Number("0"), json.Number("2")}, {json.Number("7200"), json.Number("1")}}, decodeValues(t, w.Body))
+
+	for _, q := range []string{`EXPLAIN ANALYZE SELECT value FROM cpu`, `EXPLAIN SHOW DATABASES`} {
+		w = doRequest(t, srv, "GET", "/query?db=mydb&q="+url.QueryEscape(q), "")
+		assert.Equal(t, http.StatusBadRequest, w.Code, q)
+	}
+}
+
+func TestV1QueryFieldConditions(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu,host=a value=95 1000000000000\ncpu,host=b value=40 1010000000000\ncpu,host=a value=97,load=1 1020000000000\ncpu,host=b value=10 1030000000000\ncpu,host=c load=2 1040000000000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	query := func(q string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q="+url.QueryEscape(q), "")
+	}
+	values := func(q string) []string {
+		w := query(q)
+		assert.Equal(t, http.StatusOK, w.Code, q)
+		var got []string
+		for _, row := range decodeValues(t, w.Body) {
+			got = append(got, strings.Trim(fmt.Sprint(row), "[]"))
+		}
+		return got
+	}
+
+	// Points lacking the field never match
+	assert.Equal(t, []string{"1000000 95", "1020000 97"}, values(`SELECT value FROM cpu WHERE value > 90`))
+	assert.Equal(t, []string{"1010000 40", "1030000 10"}, values(`SELECT value FROM cpu WHERE "value" <= 90`))
+	assert.Equal(t, []string{"1020000 97 1"}, values(`SELECT value, load FROM cpu WHERE value >= 90 AND load = 1`))
+	assert.Equal(t, []string{"1000000 95", "1010000 40", "1030000 10"}, values(`SELECT value FROM cpu WHERE value != 97`))
+
+	// Along with time conditions and tag conditions
+	assert.Equal(t, []string{"1010000 40"}, values(`SELECT value FROM cpu WHERE time >= 1005000ms AND value < 50 AND time <= 1020000ms`))
+	assert.Equal(t, []string{"1020000 97"}, values(`SELECT value FROM cpu WHERE host = 'a' and value > 96 and time > 1000000000000`))
+	// Tags no series carries are answered without a scan, by an empty
+	// series still
+	assert.Empty(t, values(`SELECT value FROM cpu WHERE host = 'z'`))
+	assert.Contains(t, query(`SELECT value FROM cpu WHERE host = 'z'`).Body.String(), `"name":"cpu"`)
+	assert.Empty(t, values(`SELECT percentile(value, 10) FROM cpu WHERE host = 'z'`))
+
+	// Aggregations, selectors and percentiles only see the matching points
+	assert.Equal(t, []string{"960000 2 96"}, values(`SELECT count(value), mean(value) FROM cpu WHERE value > 90 AND time >= 960000ms AND time <= 1040000ms GROUP BY time(2m)`))
+	assert.Equal(t, []string{"960000 40"}, values(`SELECT last(value) FROM cpu WHERE value < 90 AND value > 20 GROUP BY time(1m)`))
+	assert.Equal(t, []string{"1010000 40 b"}, values(`SELECT max(value), host FROM cpu WHERE value < 90`))
+	assert.Equal(t, []string{"0 10"}, values(`SELECT percentile(value, 10) FROM cpu WHERE value < 90`))
+
+	// Any combination of AND, OR and parentheses
+	assert.Equal(t, []string{"1000000 95", "1010000 40", "1020000 97", "1030000 10"}, values(`SELECT value FROM cpu WHERE value > 90 OR host = 'b'`))
+	assert.Equal(t, []string{"1020000 1", "1040000 2"}, values(`SELECT load FROM cpu WHERE (host = 'a' OR host = 'c') AND time > 1000000000000`))
+	assert.Equal(t, []string{"1010000 40", "1030000 10"}, values(`SELECT value FROM cpu WHERE host !~ /a/ AND (value < 20 OR value > 30)`))
+	assert.Equal(t, []string{"1000000 95", "1030000 10"}, values(`SELECT value FROM cpu WHERE time = 1000000000000 OR time = '1970-01-01T00:17:10Z'`))
+	assert.Equal(t, []string{"1000000 95", "1010000 40"}, values(`SELECT value FROM cpu WHERE host = 'b' AND value > 20 OR host = 'a' AND time < 1010000000000`))
+
+	for _, q := range []string{
+		`SELECT value FROM cpu WHERE time >= yesterday`,
+		`SELECT value FROM cpu WHERE value > 90 OR (host = 'b'`,
+		`SELECT value FROM cpu WHERE host = 'a' AND`,
+		`SELECT value FROM cpu WHERE host > 'a'`,
+		`SELECT value FROM cpu WHERE value =~ 3`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, query(q).Code, q)
+	}
+}
+
+func TestParseWhere(t *testing.T) {
+	now := time.Unix(3600, 0)
+	for where, want := range map[string][2]int64{
+		``: {0, 99},
+		`time >= 1000000ms and time <= 2000000ms`:            {1e12, 2e12},
+		`time > 10 AND time < 20`:                            {11, 19},
+		`time = 5`:                                           {5, 5},
+		`time >= now() - 1h and time <= now() + 30s`:         {0, 3630e9},
+		`time >= '1970-01-01T00:00:01Z' AND "host" = 'time'`: {1e9, 99},
+		`value <= 5 and time >= 7`:                           {7, 99},
+	} {
+		_, start, end, err := parseWhere(where, now, 0, 99)
+		assert.NoError(t, err, where)
+		assert.Equal(t, want, [2]int64{start, end}, where)
+	}
+
+	for _, where := range []string{`time >= now() * 2`, `time >= '1st of May'`, `time =~ /x/`, `time >= 10x`} {
+		_, _, _, err := parseWhere(where, now, 0, 99)
+		assert.Error(t, err, where)
+	}
+}
+
+func TestTimeBuckets(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	assert.NoError(t, err)
+	day := int64(24 * time.Hour)
+	at := func(s string) int64 {
+		ts, err := time.Parse(time.RFC3339, s)
+		assert.NoError(t, err)
+		return ts.UnixNano()
+	}
+
+	utc := timeBuckets{interval: day}
+	assert.Equal(t, at("2025-03-19T00:00:00Z"), utc.start(at("2025-03-19T23:30:00Z")))
+
+	local := timeBuckets{interval: day, loc: berlin}
+	for ts, want := range map[string]string{
+		"2025-03-19T23:30:00Z": "2025-03-19T23:00:00Z",
+		"2025-03-19T22:30:00Z": "2025-03-18T23:00:00Z",
+		// Around daylight saving changes, days start at local midnight
+		// of the offset in effect then and last 23 or 25 hours
+		"2025-03-30T12:00:00Z": "2025-03-29T23:00:00Z",
+		"2025-03-30T22:30:00Z": "2025-03-30T22:00:00Z",
+		"2025-10-26T12:00:00Z": "2025-10-25T22:00:00Z",
+		"2025-10-26T22:30:00Z": "2025-10-25T22:00:00Z",
+		"2025-10-26T23:30:00Z": "2025-10-26T23:00:00Z",
+		"1969-12-31T12:00:00Z": "1969-12-30T23:00:00Z",
+	} {
+		assert.Equal(t, at(want), local.start(at(ts)), ts)
+	}
+
+	loc, err := parseTimezone(`SELECT mean(value) FROM cpu GROUP BY time(1d) TZ('Europe/Berlin')`)
+	assert.NoError(t, err)
+	assert.Equal(t, berlin.String(), loc.String())
+	loc, err = parseTimezone(`SELECT mean(value) FROM cpu WHERE "xtz(" = 'a'`)
+	assert.NoError(t, err)
+	assert.Nil(t, loc)
+	for _, q := range []string{`SELECT value FROM cpu tz('Mars/Olympus')`, `SELECT value FROM cpu tz(UTC)`, `SELECT value FROM cpu tz('UTC'`} {
+		_, err := parseTimezone(q)
+		assert.Error(t, err, q)
+	}
+}
+
+func TestV1QueryTimezone(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	// 23:00 on the 18th and 01:00 on the 19th in Sao Paulo, UTC-3
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu value=1 1742349600000000000\ncpu value=2 1742356800000000000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	values := func(q string) []string {
+		w := doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q="+url.QueryEscape(q), "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var got []string
+		for _, row := range decodeValues(t, w.Body) {
+			got = append(got, strings.Trim(fmt.Sprint(row), "[]"))
+		}
+		return got
+	}
+
+	const where = ` WHERE time >= '2025-03-17T00:00:00Z' AND time < '2025-03-21T00:00:00Z'`
+	assert.Equal(t, []string{"1742342400000 3"}, values(`SELECT sum(value) FROM cpu`+where+` GROUP BY time(1d)`))
+	assert.Equal(t, []string{"1742266800000 1", "1742353200000 2"}, values(`SELECT sum(value) FROM cpu`+where+` GROUP BY time(1d) tz('America/Sao_Paulo')`))
+	assert.Equal(t, []string{"1742266800000 1 1", "1742353200000 2 1"}, values(`SELECT max(value), count(value) FROM cpu`+where+` GROUP BY time(1d) fill(none) tz('America/Sao_Paulo')`))
+	assert.Equal(t, []string{"1742353200000 2"}, values(`SELECT last(value) FROM cpu WHERE time >= '2025-03-19T03:00:00Z' GROUP BY time(1d) tz('America/Sao_Paulo')`))
+	assert.Equal(t, []string{"1742353200000 2"}, values(`SELECT percentile(value, 50) FROM cpu WHERE time >= '2025-03-19T03:00:00Z' GROUP BY time(1d) tz('America/Sao_Paulo')`))
+	// Clauses inside string literals do not count
+	assert.Equal(t, []string{"1742342400000 3"}, values(`SELECT sum(value) FROM cpu`+where+` AND host != 'tz(\'America/Sao_Paulo\')' GROUP BY time(1d)`))
+	assert.Equal(t, []string{"1742349600000 1", "1742356800000 2"}, values(`SELECT value FROM cpu`+where+` AND host != 'group by time(1d)'`))
+	loc, err := parseTimezone(`SELECT value FROM cpu WHERE host = "tz('UTC')"`)
+	assert.NoError(t, err)
+	assert.Nil(t, loc)
+	interval, err := groupByTimeInterval(`SELECT mean(value) FROM cpu WHERE host = 'group by time(1h)' GROUP BY time(1m)`)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, interval)
+
+	w = doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q="+url.QueryEscape(`SELECT sum(value) FROM cpu GROUP BY time(1d) tz('Nowhere/City')`), "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "unknown time zone")
+}
+
+func TestV1QueryInto(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu,host=a value=1 3600000000000\ncpu,host=b value=3 3700000000000\ncpu,host=a value=8 7200000000000\nmem,host=a used=5 3600000000000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	query := func(database, q string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, "POST", "/query?db="+database+"&epoch=ms&q="+url.QueryEscape(q), "")
+	}
+	values := func(database, q string) []string {
+		w := query(database, q)
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var got []string
+		for _, row := range decodeValues(t, w.Body) {
+			got = append(got, strings.Trim(fmt.Sprint(row), "[]"))
+		}
+		return got
+	}
+
+	// Aggregates are written at the start of their bucket
+	const hours = ` WHERE time >= 3600000000000 AND time < 10800000000000 GROUP BY time(1h)`
+	assert.Equal(t, []string{"0 2"}, values("mydb", `SELECT mean(value) INTO cpu_1h FROM cpu`+hours))
+	assert.Equal(t, []string{"3600000 2", "7200000 8"}, values("mydb", `SELECT mean FROM cpu_1h`))
+
+	// Tags stay tags, here in another database
+	assert.Equal(t, []string{"0 3"}, values("mydb", `SELECT * INTO "other".."cpu_copy" FROM cpu`))
+	assert.Equal(t, []string{"3600000 1", "7200000 8"}, values("other", `SELECT value FROM cpu_copy WHERE host = 'a'`))
+
+	// :MEASUREMENT keeps the name of each source measurement
+	assert.Equal(t, []string{"0 4"}, values("mydb", `SELECT * INTO archive.autogen.:MEASUREMENT FROM cpu, mem`))
+	assert.Equal(t, []string{"3600000 a 5"}, values("archive", `SELECT * FROM mem`))
+
+	// Nothing selected, nothing written
+	assert.Equal(t, []string{"0 0"}, values("mydb", `SELECT value INTO empty FROM cpu WHERE value > 100`))
+
+	for _, q := range []string{
+		`SELECT value INTO FROM cpu`,
+		`SELECT value INTO a.b.c.d FROM cpu`,
+		`SELECT value INTO "unterminated FROM cpu`,
+		`SELECT value INTO target cpu`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, query("mydb", q).Code, q)
+	}
+	assert.Equal(t, http.StatusBadRequest, query("mydb", `SELECT value INTO target FROM cpu WHERE time >= yesterday`).Code)
+}
+
+func TestV1QuerySelectors(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu,host=a value=5 1000000000000\ncpu,host=b value=9,load=2 1010000000000\ncpu,host=a value=7 1020000000000\ncpu,host=b value=9 1030000000000\ncpu,host=c value=1 1040000000000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	query := func(q string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q="+url.QueryEscape(q), "")
+	}
+	values := func(q string) []string {
+		w := query(q)
+		assert.Equal(t, http.StatusOK, w.Code, q)
+		var got []string
+		for _, row := range decodeValues(t, w.Body) {
+			got = append(got, strings.Trim(fmt.Sprint(row), "[]"))
+		}
+		return got
+	}
+
+	// Selectors return the timestamp of the selected point, the earliest
+	// one on ties
+	assert.Equal(t, []string{"1010000 9"}, values(`SELECT max(value) FROM cpu`))
+	assert.Equal(t, []string{"1010000 9 b 2"}, values(`SELECT max("value"), "host", load FROM cpu`))
+	assert.Equal(t, []string{"1040000 1 c"}, values(`SELECT min(value), host FROM cpu`))
+	assert.Equal(t, []string{"1000000 5 a"}, values(`SELECT first(value), host FROM cpu`))
+	assert.Equal(t, []string{"1040000 1 c"}, values(`SELECT last(value), host FROM cpu`))
+	assert.Contains(t, query(`SELECT max(value) AS peak, host FROM cpu`).Body.String(), `"columns":["time","peak","host"]`)
+
+	// Over buckets, the bucket start is returned
+	assert.Equal(t, []string{"1000000 9 b", "1020000 9 b", "1040000 1 c"},
+		values(`SELECT max(value), host FROM cpu WHERE time >= 1000000ms and time <= 1040000ms GROUP BY time(20s)`))
+
+	// top and bottom return their points in time order
+	assert.Equal(t, []string{"1010000 9", "1030000 9"}, values(`SELECT top(value, 2) FROM cpu`))
+	assert.Equal(t, []string{"1010000 9 b", "1020000 7 a"}, values(`SELECT top(value, host, 2) FROM cpu`))
+	assert.Equal(t, []string{"1000000 5 a", "1040000 1 c"}, values(`SELECT bottom(value, 2), host FROM cpu`))
+	assert.Equal(t, []string{"1010000 9", "1030000 9", "1040000 1"},
+		values(`SELECT top(value, 1) FROM cpu WHERE time >= 1000000ms and time <= 1040000ms GROUP BY time(20s)`))
+	assert.Contains(t, query(`SELECT top(value, host, 1) FROM cpu`).Body.String(), `"columns":["time","top","host"]`)
+
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT top(value, 0) FROM cpu`).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT top(value) FROM cpu`).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT max(value, 2) FROM cpu`).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT max(value), value * 2 FROM cpu`).Code)
+}
+
+func TestV1QueryPercentiles(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	var lines []string
+	for i := 1; i <= 100; i++ {
+		lines = append(lines, fmt.Sprintf("latency ms=%d %d", i, int64(1000+i)*int64(time.Second)))
+	}
+	w := doRequest(t, srv, "POST", "/write?db=mydb", strings.Join(lines, "\n"))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	query := func(q string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q="+url.QueryEscape(q), "")
+	}
+	values := func(q string) [][]float64 {
+		w := query(q)
+		assert.Equal(t, http.StatusOK, w.Code, q)
+		var got [][]float64
+		for _, row := range decodeValues(t, w.Body) {
+			var values []float64
+			for _, v := range row {
+				f, err := v.(json.Number).Float64()
+				assert.NoError(t, err)
+				values = append(values, f)
+			}
+			got = append(got, values)
+		}
+		return got
+	}
+	where := ` FROM latency WHERE time >= 1000000ms and time <= 1200000ms`
+
+	// Without GROUP BY, the single digest is returned at the range start
+	rows := values(`SELECT percentile(ms, 90)` + where)
+	if assert.Len(t, rows, 1) {
+		assert.Equal(t, float64(1000000), rows[0][0])
+		assert.InDelta(t, 90, rows[0][1], 1)
+	}
+	rows = values(`SELECT median("ms")` + where)
+	if assert.Len(t, rows, 1) {
+		assert.InDelta(t, 50.5, rows[0][1], 1)
+	}
+	assert.Contains(t, query(`SELECT percentile(ms, 99) AS p99`+where).Body.String(), `"columns":["time","p99"]`)
+
+	rows = values(`SELECT percentile(ms, 50)` + where + ` GROUP BY time(50s)`)
+	if assert.Len(t, rows, 3) {
+		assert.Equal(t, []float64{1000000, 1050000, 1100000}, []float64{rows[0][0], rows[1][0], rows[2][0]})
+		assert.InDelta(t, 25, rows[0][1], 1)
+		assert.InDelta(t, 75, rows[1][1], 1)
+		assert.Equal(t, float64(100), rows[2][1])
+	}
+
+	// histogram() counts the values less than or equal to each bound
+	assert.Contains(t, query(`SELECT histogram(ms, 10, 50)`+where).Body.String(), `"columns":["time","le","histogram"]`)
+	rows = values(`SELECT histogram(ms, 10, 50, 100)` + where)
+	if assert.Len(t, rows, 3) {
+		assert.Equal(t, float64(10), rows[0][1])
+		assert.InDelta(t, 10, rows[0][2], 1)
+		assert.InDelta(t, 50, rows[1][2], 1)
+		assert.Equal(t, []float64{1000000, 100, 100}, rows[2])
+	}
+
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT percentile(ms, 101)`+where).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT percentile(ms)`+where).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT median(ms, 2)`+where).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT histogram(ms)`+where).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT histogram(ms, 50, 10)`+where).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`SELECT median(ms), ms`+where).Code)
+}
+
+func TestBindParams(t *testing.T) {
+	params, err := parseParams(`{"m":"cpu","host":"it's","start":1000,"on":true,"q":"a\\\"b"}`)
+	assert.NoError(t, err)
+
+	for query, want := range map[string]string{
+		`SELECT value FROM $m WHERE time >= $start`:         `SELECT value FROM "cpu" WHERE time >= 1000`,
+		`SELECT value FROM cpu WHERE host = $host`:          `SELECT value FROM cpu WHERE host = 'it\'s'`,
+		`SELECT value FROM cpu WHERE host='$host' OR x=$on`: `SELECT value FROM cpu WHERE host='$host' OR x=true`,
+		`SELECT value FROM $q`:                              `SELECT value FROM "a\\\"b"`,
+		`SELECT value FROM /^cpu$/`:                         `SELECT value FROM /^cpu$/`,
+	} {
+		got, err := bindParams(query, params)
+		assert.NoError(t, err, query)
+		assert.Equal(t, want, got, query)
+	}
+
+	_, err = bindParams(`SELECT value FROM cpu WHERE host = $missing`, params)
+	assert.EqualError(t, err, "missing parameter: $missing")
+	_, err = parseParams(`{"h":["a"]}`)
+	assert.Error(t, err)
+	_, err = parseParams(`not json`)
+	assert.Error(t, err)
+}
+
+func TestV1QueryParams(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu value=1 1000000000000\ncpu value=2 1010000000000\nmem used=3 1010000000000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	// Client libraries POST the query, database and params as a form
+	form := url.Values{
+		"db":     {"mydb"},
+		"q":      {`SELECT max(value) FROM $m WHERE time >= $start and time <= 1100000ms`},
+		"params": {`{"m":"cpu","start":1005000000000}`},
+		"epoch":  {"ms"},
+	}
+	w = doRequest(t, srv, "POST", "/query", form.Encode(), withHeader("Content-Type", "application/x-www-form-urlencoded"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, [][]interface{}{{json.Number("1010000"), json.Number("2")}}, decodeValues(t, w.Body))
+
+	// Values holding clauses are compared as they are
+	for _, h := range []string{"fill(", "tz('Nowhere/Zone')", "x' GROUP BY time(1s) LIMIT 1", "from"} {
+		params, _ := json.Marshal(map[string]string{"m": "cpu", "h": h})
+		w = doRequest(t, srv, "GET", "/query?db=mydb&q="+url.QueryEscape(`SELECT value FROM $m WHERE host = $h`)+"&params="+url.QueryEscape(string(params)), "")
+		assert.Equal(t, http.StatusOK, w.Code, h)
+		assert.Empty(t, decodeValues(t, w.Body), h)
+	}
+	w = doRequest(t, srv, "POST", "/write?db=mydb", `cpu value\ from=5 1020000000000`)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	w = doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q="+url.QueryEscape(`SELECT $f FROM cpu WHERE time >= 1020000ms`)+"&params="+url.QueryEscape(`{"f":"value from"}`), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, [][]interface{}{{json.Number("1020000"), json.Number("5")}}, decodeValues(t, w.Body))
+
+	// A value cannot break out of its identifier
+	w = doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q="+url.QueryEscape(`SELECT * FROM $m`)+"&params="+url.QueryEscape(`{"m":"cpu\", mem"}`), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), `"mem"`)
+
+	w = doRequest(t, srv, "GET", "/query?db=mydb&epoch=ms&q="+url.QueryEscape(`SELECT * FROM $m`), "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "missing parameter: $m")
+}
+
+func TestAuthScopes(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := NewWithOptions(":8087", db, Options{AuthEnabled: true})
+	assert.NoError(t, db.CreateDatabase("mydb"))
+	assert.NoError(t, db.CreateDatabase("other"))
+
+	_, admin, err := db.AddToken("admin", []string{"admin"})
+	assert.NoError(t, err)
+	_, writer, err := db.AddToken("writer", []string{"write:mydb"})
+	assert.NoError(t, err)
+	_, reader, err := db.AddToken("reader", []string{"read:mydb"})
+	assert.NoError(t, err)
+
+	request := func(method, target, token, body string) *httptest.ResponseRecorder {
+		if token == "" {
+			return doRequest(t, srv, method, target, body)
+		}
+		return doRequest(t, srv, method, target, body, withHeader("Authorization", "Token "+token))
+	}
+	query := func(token, q string) *httptest.ResponseRecorder {
+		return request("GET", "/query?db=mydb&q="+url.QueryEscape(q), token, "")
+	}
+
+	// Health checks stay open, everything else needs a valid token
+	assert.Equal(t, http.StatusNoContent, request("GET", "/ping", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/write?db=mydb", "", "cpu value=1").Code)
+	assert.Equal(t, http.StatusUnauthorized, request("POST", "/write?db=mydb", "wrong", "cpu value=1").Code)
+
+	assert.Equal(t, http.StatusNoContent, request("POST", "/write?db=mydb", writer, "cpu value=1").Code)
+	assert.Equal(t, http.StatusForbidden, request("POST", "/write?db=other", writer, "cpu value=1").Code)
+	assert.Equal(t, http.StatusForbidden, request("POST", "/api/v2/write?org=o&bucket=mydb", reader, "cpu value=1").Code)
+	assert.Equal(t, http.StatusForbidden, query(writer, "SELECT value FROM cpu").Code)
+
+	// v1 clients send the token as the password
+	w := request("GET", "/query?db=mydb&u=me&p="+reader+"&q="+url.QueryEscape("SELECT value FROM cpu"), "", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, decodeValues(t, w.Body), 1)
+
+	assert.Equal(t, http.StatusOK, query(reader, "SHOW MEASUREMENTS").Code)
+	assert.Equal(t, http.StatusForbidden, query(reader, "SHOW MEASUREMENTS ON other").Code)
+	assert.Equal(t, http.StatusForbidden, query(reader, "USE other").Code)
+	assert.Equal(t, http.StatusForbidden, query(reader, "DROP DATABASE mydb").Code)
+	assert.Equal(t, http.StatusForbidden, request("DELETE", "/api/v2/buckets/x", reader, "").Code)
+	assert.Equal(t, http.StatusForbidden, request("GET", "/export?db=other", reader, "").Code)
+	assert.Equal(t, http.StatusForbidden, request("GET", "/export", reader, "").Code)
+	assert.Equal(t, http.StatusForbidden, request("GET", "/api/v2/tasks", reader, "").Code)
+
+	// Listings only show the readable databases
+	w = query(reader, "SHOW DATABASES")
+	assert.Equal(t, [][]interface{}{{"mydb"}}, decodeValues(t, w.Body))
+	w = request("GET", "/api/v2/buckets", reader, "")
+	assert.Contains(t, w.Body.String(), `"name":"mydb"`)
+	assert.NotContains(t, w.Body.String(), `"name":"other"`)
+	assert.Equal(t, http.StatusOK, query(admin, "DROP DATABASE other").Code)
+
+	// Admins manage the tokens
+	assert.Equal(t, http.StatusForbidden, request("GET", "/api/v2/authorizations", reader, "").Code)
+	assert.Equal(t, http.StatusBadRequest, request("POST", "/api/v2/authorizations", admin, `{"scopes":["delete:mydb"]}`).Code)
+	w = request("POST", "/api/v2/authorizations", admin, `{"description":"grafana","scopes":["read:mydb"]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, http.StatusOK, query(created.Token, "SELECT value FROM cpu").Code)
+
+	w = request("GET", "/api/v2/authorizations", admin, "")
+	assert.Contains(t, w.Body.String(), `"description":"grafana"`)
+	assert.NotContains(t, w.Body.String(), created.Token)
+
+	assert.Equal(t, http.StatusNoContent, request("DELETE", "/api/v2/authorizations/"+created.ID, admin, "").Code)
+	assert.Equal(t, http.StatusNotFound, request("DELETE", "/api/v2/authorizations/"+created.ID, admin, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, query(created.Token, "SELECT value FROM cpu").Code)
+}
+
+func TestUserAuthentication(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := NewWithOptions(":8087", db, Options{AuthEnabled: true})
+	assert.NoError(t, db.CreateDatabase("mydb"))
+
+	query := func(q string, auth ...func(*http.Request)) *httptest.ResponseRecorder {
+		return doRequest(t, srv, "GET", "/query?db=mydb&q="+url.QueryEscape(q), "", auth...)
+	}
+	basic := func(user, password string) func(*http.Request) {
+		return func(req *http.Request) { req.SetBasicAuth(user, password) }
+	}
+	params := func(user, password string) func(*http.Request) {
+		return func(req *http.Request) {
+			req.URL.RawQuery += "&u=" + url.QueryEscape(user) + "&p=" + url.QueryEscape(password)
+		}
+	}
+
+	// The first admin user can be created without credentials, and only
+	// that user
+	assert.Equal(t, http.StatusUnauthorized, query(`CREATE USER bob WITH PASSWORD 'pw'`).Code)
+	assert.Equal(t, http.StatusOK, query(`CREATE USER "admin" WITH PASSWORD 'secret' WITH ALL PRIVILEGES`).Code)
+	assert.Equal(t, http.StatusUnauthorized, query(`CREATE USER other WITH PASSWORD 'pw' WITH ALL PRIVILEGES`).Code)
+	assert.Equal(t, http.StatusUnauthorized, query("SHOW USERS", basic("admin", "wrong")).Code)
+
+	admin := basic("admin", "secret")
+	assert.Equal(t, http.StatusOK, query(`CREATE USER bob WITH PASSWORD 'pw'`, admin).Code)
+	assert.Equal(t, http.StatusOK, query(`GRANT WRITE ON mydb TO bob`, admin).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`GRANT READ TO bob`, admin).Code)
+	assert.Contains(t, query(`GRANT READ ON mydb TO carol`, admin).Body.String(), "user not found")
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb&u=bob&p=pw", "cpu value=1")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	assert.Equal(t, http.StatusForbidden, query("SELECT value FROM cpu", params("bob", "pw")).Code)
+	assert.Equal(t, http.StatusOK, query(`GRANT ALL PRIVILEGES ON "mydb" TO "bob"`, admin).Code)
+	w = query("SELECT value FROM cpu", params("bob", "pw"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, decodeValues(t, w.Body), 1)
+	assert.Equal(t, http.StatusForbidden, query("SHOW USERS", params("bob", "pw")).Code)
+
+	assert.Equal(t, [][]interface{}{{"admin", true}, {"bob", false}}, decodeValues(t, query("SHOW USERS", admin).Body))
+	assert.Equal(t, [][]interface{}{{"mydb", "ALL PRIVILEGES"}}, decodeValues(t, query("SHOW GRANTS FOR bob", admin).Body))
+	assert.Equal(t, http.StatusOK, query(`REVOKE READ ON mydb FROM bob`, admin).Code)
+	assert.Equal(t, [][]interface{}{{"mydb", "WRITE"}}, decodeValues(t, query("SHOW GRANTS FOR bob", admin).Body))
+
+	// Admin rights and passwords change on the next request
+	assert.Equal(t, http.StatusOK, query(`GRANT ALL TO bob`, admin).Code)
+	assert.Equal(t, http.StatusOK, query("SHOW USERS", basic("bob", "pw")).Code)
+	assert.Equal(t, http.StatusOK, query(`SET PASSWORD FOR bob = 'new'`, admin).Code)
+	assert.Equal(t, http.StatusUnauthorized, query("SHOW USERS", basic("bob", "pw")).Code)
+	assert.Equal(t, http.StatusOK, query("SHOW USERS", basic("bob", "new")).Code)
+	assert.Equal(t, http.StatusOK, query(`DROP USER bob`, admin).Code)
+	assert.Equal(t, http.StatusUnauthorized, query("SHOW USERS", basic("bob", "new")).Code)
+
+	// Tokens are accepted as the password of any other user
+	_, token, err := db.AddToken("", []string{"read:mydb"})
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, query("SELECT value FROM cpu", basic("anyone", token)).Code)
+}
+
+func TestClientFilter(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	clients, err := acl.New([]string{"10.0.0.0/8"}, []string{"10.0.0.66"})
+	assert.NoError(t, err)
+	srv := NewWithOptions(":8087", db, Options{Clients: clients})
+
+	write := func(remote string) int {
+		w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu value=1", withRemoteAddr(remote), withHeader("X-Forwarded-For", "10.0.0.1"))
+		return w.Code
+	}
+	assert.Equal(t, http.StatusNoContent, write("10.1.2.3:40000"))
+	assert.Equal(t, http.StatusForbidden, write("10.0.0.66:40000"))
+	// Forwarded addresses are ignored
+	assert.Equal(t, http.StatusForbidden, write("203.0.113.9:40000"))
+
+	has, err := db.HasDatabase("mydb")
+	assert.NoError(t, err)
+	assert.True(t, has)
+}
+
+func TestAuditLog(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := NewWithOptions(":8087", db, Options{AuthEnabled: true})
+	adminToken, admin, err := db.AddToken("admin", []string{"admin"})
+	assert.NoError(t, err)
+	_, reader, err := db.AddToken("reader", []string{"read:*"})
+	assert.NoError(t, err)
+
+	request := func(method, target, token, body string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, method, target, body, withRemoteAddr("10.1.2.3:40000"), withHeader("Authorization", "Token "+token))
+	}
+
+	assert.Equal(t, http.StatusOK, request("GET", "/query?q="+url.QueryEscape("CREATE DATABASE mydb"), admin, "").Code)
+	w := request("POST", "/api/v2/authorizations", admin, `{"scopes":["write:mydb"]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, http.StatusOK, request("GET", "/query?q="+url.QueryEscape("CREATE USER bob WITH PASSWORD 'secret'"), admin, "").Code)
+	assert.Equal(t, http.StatusOK, request("GET", "/query?q="+url.QueryEscape("GRANT READ ON mydb TO bob"), admin, "").Code)
+	assert.Equal(t, http.StatusOK, request("GET", "/query?q="+url.QueryEscape("DROP DATABASE mydb"), admin, "").Code)
+	// Rejected operations are not recorded
+	assert.Equal(t, http.StatusForbidden, request("GET", "/query?q="+url.QueryEscape("CREATE DATABASE other"), reader, "").Code)
+
+	assert.Equal(t, http.StatusForbidden, request("GET", "/api/v2/audit", reader, "").Code)
+	w = request("GET", "/api/v2/audit", admin, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var body struct {
+		Entries []auditEntry `json:"entries"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	var actions []string
+	for _, e := range body.Entries {
+		actions = append(actions, e.Action+" "+e.Target)
+		assert.Equal(t, adminToken.ID, e.Actor)
+		assert.Equal(t, "10.1.2.3", e.Source)
+		assert.NotContains(t, e.Detail, "secret")
+	}
+	assert.Len(t, actions, 5)
+	assert.Equal(t, "database.create mydb", actions[0])
+	assert.Contains(t, actions[1], "token.create ")
+	assert.Equal(t, []string{"user.create bob", "user.grant bob", "database.drop mydb"}, actions[2:])
+	assert.Equal(t, "READ on mydb", body.Entries[3].Detail)
+
+	w = request("GET", "/api/v2/audit?limit=2&since="+url.QueryEscape(body.Entries[3].Time.Format(time.RFC3339Nano)), admin, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Len(t, body.Entries, 2)
+	assert.Equal(t, "user.grant", body.Entries[0].Action)
+
+	assert.Equal(t, http.StatusBadRequest, request("GET", "/api/v2/audit?since=yesterday", admin, "").Code)
+	assert.Equal(t, http.StatusBadRequest, request("GET", "/api/v2/audit?limit=0", admin, "").Code)
+}
+
+func TestWriteStats(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := NewWithOptions(":8087", db, Options{AuthEnabled: true})
+	_, admin, err := db.AddToken("admin", []string{"admin"})
+	assert.NoError(t, err)
+	_, reader, err := db.AddToken("reader", []string{"read:mydb"})
+	assert.NoError(t, err)
+
+	request := func(method, target, token, body string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, method, target, body, withHeader("Authorization", "Token "+token))
+	}
+	stats := func(target, token string) []measurementStats {
+		w := request("GET", target, token, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		var body struct {
+			Measurements []measurementStats `json:"measurements"`
+		}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return body.Measurements
+	}
+
+	assert.Equal(t, http.StatusNoContent, request("POST", "/write?db=mydb", admin, "cpu value=1 1556813561098000000\ncpu value=2 1556813562098000000\nmem used=3 1556813561098000000").Code)
+	assert.Equal(t, http.StatusNoContent, request("POST", "/write?db=other", admin, "cpu value=1 1556813561098000000").Code)
+
+	all := stats("/api/v2/stats", admin)
+	assert.Len(t, all, 3)
+	assert.Equal(t, "mydb", all[0].Bucket)
+	assert.Equal(t, "cpu", all[0].Measurement)
+	assert.Equal(t, uint64(2), all[0].Points)
+	assert.Equal(t, uint64(len("cpu value=1 1556813561098000000\ncpu value=2 1556813562098000000\n")), all[0].Bytes)
+	assert.Greater(t, all[0].PointsPerSecond, 0.0)
+	assert.False(t, all[0].LastWrite.IsZero())
+
+	// Tokens only see the buckets they may read
+	visible := stats("/api/v2/stats", reader)
+	assert.Len(t, visible, 2)
+	for _, st := range visible {
+		assert.Equal(t, "mydb", st.Bucket)
+	}
+	filtered := stats("/api/v2/stats?bucket=mydb&measurement=mem", admin)
+	assert.Len(t, filtered, 1)
+	assert.Equal(t, uint64(1), filtered[0].Points)
+}
+
+func TestShowMetadata(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu,host=b value=1\ncpu,host=a value=2\nmem,host=a used=3")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	week := 7 * 24 * time.Hour
+	d, err := db.GetDatabase("mydb")
+	assert.NoError(t, err)
+	_, err = db.UpdateDatabase(d.ID, persistence.DatabaseUpdate{RetentionPeriod: &week})
+	assert.NoError(t, err)
+
+	query := func(params string) [][]interface{} {
+		w := doRequest(t, srv, "GET", "/query?"+params, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		return decodeValues(t, w.Body)
+	}
+
+	assert.Equal(t, [][]interface{}{{"mydb"}}, query("q=SHOW+DATABASES"))
+	assert.Equal(t, [][]interface{}{{"cpu,host=a"}, {"cpu,host=b"}, {"mem,host=a"}}, query("db=mydb&q=SHOW+SERIES"))
+	assert.Equal(t, [][]interface{}{{"cpu,host=a"}, {"cpu,host=b"}}, query("q="+url.QueryEscape(`SHOW SERIES ON "mydb" FROM "cpu"`)))
+	assert.Equal(t, [][]interface{}{{"autogen", "168h0m0s", "24h0m0s", json.Number("1"), true}}, query("q="+url.QueryEscape("SHOW RETENTION POLICIES ON mydb")))
+
+	w = doRequest(t, srv, "GET", "/query?q=SHOW+SERIES+ON+missing", "")
+	assert.Contains(t, w.Body.String(), "database not found: missing")
+}
+
+func TestShowStatsAndDiagnostics(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu,host=b value=1\ncpu,host=a value=2\nmem,host=a used=3")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	type series struct {
+		Name    string            `json:"name"`
+		Tags    map[string]string `json:"tags"`
+		Columns []string          `json:"columns"`
+		Values  [][]interface{}   `json:"values"`
+	}
+	show := func(q string) map[string]series {
+		w := doRequest(t, srv, "GET", "/query?q="+url.QueryEscape(q), "")
+		assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var response struct {
+			Results []struct {
+				Series []series `json:"series"`
+			} `json:"results"`
+		}
+		dec := json.NewDecoder(w.Body)
+		dec.UseNumber()
+		assert.NoError(t, dec.Decode(&response))
+		byName := make(map[string]series)
+		for _, s := range response.Results[0].Series {
+			// Each series holds a single row, one column per value
+			assert.Len(t, s.Values, 1, s.Name)
+			assert.Len(t, s.Values[0], len(s.Columns), s.Name)
+			byName[s.Name] = s
+		}
+		return byName
+	}
+
+	diagnostics := show("SHOW DIAGNOSTICS")
+	assert.Len(t, diagnostics, 4)
+	assert.Equal(t, []string{"Branch", "Build Time", "Commit", "Version"}, diagnostics["build"].Columns)
+	assert.Equal(t, Version, diagnostics["build"].Values[0][3])
+	assert.Equal(t, runtime.GOOS, diagnostics["runtime"].Values[0][2])
+	assert.Contains(t, diagnostics["system"].Columns, "uptime")
+
+	stats := show("SHOW STATS")
+	assert.Len(t, stats, 3)
+	assert.Contains(t, stats["runtime"].Columns, "HeapAlloc")
+	assert.Equal(t, map[string]string{"database": "mydb"}, stats["database"].Tags)
+	assert.Equal(t, []interface{}{json.Number("2"), json.Number("3")}, stats["database"].Values[0])
+	httpd := stats["httpd"]
+	assert.Equal(t, []string{"clientRejected", "pointsWrittenOK", "queryReq", "queryTimeout", "writeReq"}, httpd.Columns)
+
+	stats = show("SHOW STATS FOR 'httpd'")
+	assert.Len(t, stats, 1)
+	// The SHOW STATS query above counts as one more query
+	queries, _ := stats["httpd"].Values[0][2].(json.Number).Int64()
+	before, _ := httpd.Values[0][2].(json.Number).Int64()
+	assert.Equal(t, before+1, queries)
+
+	w = doRequest(t, srv, "GET", "/query?q="+url.QueryEscape("SHOW STATS FOR httpd"), "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	for _, method := range []string{"GET", "HEAD"} {
+		w := doRequest(t, srv, method, "/ping", "")
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Equal(t, Version, w.Header().Get("X-Influxdb-Version"))
+		assert.Equal(t, Build, w.Header().Get("X-Influxdb-Build"))
+	}
+
+	w := doRequest(t, srv, "GET", "/ping?verbose=true", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"version":"`+Version+`"}`, w.Body.String())
+
+	w = doRequest(t, srv, "GET", "/health", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var health map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &health))
+	assert.Equal(t, "pass", health["status"])
+	assert.Equal(t, "influxdb", health["name"])
+	assert.Equal(t, Version, health["version"])
+
+	w = doRequest(t, srv, "GET", "/ready", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var ready map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &ready))
+	assert.Equal(t, "ready", ready["status"])
+	assert.NotEmpty(t, ready["up"])
+}
+
+func TestGrafanaDatasource(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu value=1\nmem used=2")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, Version, w.Header().Get("X-Influxdb-Version"))
+	assert.Equal(t, Build, w.Header().Get("X-Influxdb-Build"))
+
+	for _, method := range []string{"GET", "HEAD"} {
+		w = doRequest(t, srv, method, "/api/health", "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, Version, w.Header().Get("X-Influxdb-Version"))
+	}
+
+	// InfluxQL data source test
+	w = doRequest(t, srv, "GET", "/query?q="+url.QueryEscape(`SHOW measurements ON "mydb" LIMIT 1`), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, [][]interface{}{{"cpu"}}, decodeValues(t, w.Body))
+
+	// Flux data source test
+	w = doRequest(t, srv, "POST", "/api/v2/query?org=default", `{"query": "buckets()", "type": "flux"}`, withHeader("Content-Type", "application/json"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/csv", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), ",name,id,organizationID,retentionPeriod")
+	assert.Contains(t, w.Body.String(), ",mydb,")
+
+	// The dialect set by the data source shapes the CSV
+	w = doRequest(t, srv, "POST", "/api/v2/query?org=default", `{"query": "buckets()", "dialect": {"header": true, "delimiter": ";", "annotations": ["group", "datatype"], "commentPrefix": "#"}}`, withHeader("Content-Type", "application/json"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	lines := strings.Split(w.Body.String(), "\n")
+	assert.Equal(t, "#datatype;string;long;string;string;string;string;long", lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "#group;"))
+	assert.Equal(t, ";result;table;_measurement;name;id;organizationID;retentionPeriod", lines[2])
+	assert.NotContains(t, w.Body.String(), "#default")
+
+	w = doRequest(t, srv, "POST", "/api/v2/query?org=default", `{"query": "buckets()", "dialect": {"delimiter": "::"}}`, withHeader("Content-Type", "application/json"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid dialect")
+
+	w = doRequest(t, srv, "POST", "/api/v2/query?org=default", `from(bucket: "mydb")`, withHeader("Content-Type", "application/vnd.flux"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "only buckets() is supported")
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu value=1 1556813561098000000\nbad line")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = doRequest(t, srv, "GET", "/query?db=mydb&q="+url.QueryEscape("SELECT * FROM cpu"), "")
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = doRequest(t, srv, "GET", "/metrics", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+
+	body := w.Body.String()
+	assert.Contains(t, body, "# TYPE refluxdb_http_points_written_total counter")
+	assert.Contains(t, body, `refluxdb_http_write_errors_total{reason="partial"}`)
+	assert.Contains(t, body, "# TYPE refluxdb_ingest_parse_failures_total counter")
+	assert.Contains(t, body, `refluxdb_query_duration_seconds_bucket{api="v1",le="+Inf"}`)
+	assert.Contains(t, body, "refluxdb_storage_points_written_total")
+	assert.Contains(t, body, "refluxdb_storage_size_bytes")
+	assert.Contains(t, body, "refluxdb_goroutines")
+}
+
+func TestIntegrityEndpoint(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu value=1 1556813561098000000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	// The first GET runs a check
+	var report persistence.IntegrityReport
+	w = doRequest(t, srv, "GET", "/debug/integrity", "", withRemoteAddr("127.0.0.1:50000"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, 1, report.Shards)
+	assert.Empty(t, report.Issues)
+
+	_, err := db.GetDB().Exec(`CREATE TABLE shard_999 (series_id INTEGER)`)
+	assert.NoError(t, err)
+
+	// GET returns the latest report, POST checks again
+	w = doRequest(t, srv, "GET", "/debug/integrity", "", withRemoteAddr("127.0.0.1:50000"))
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Empty(t, report.Issues)
+
+	w = doRequest(t, srv, "POST", "/debug/integrity?repair=true", "", withRemoteAddr("127.0.0.1:50000"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	if assert.Len(t, report.Issues, 1) {
+		assert.Equal(t, persistence.IssueUnregisteredTable, report.Issues[0].Kind)
+		assert.Equal(t, "shard_999", report.Issues[0].Table)
+		assert.False(t, report.Issues[0].Repaired)
+	}
+}
+
+func TestSlowQueries(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	logger, hook := logtest.NewNullLogger()
+	srv := NewWithOptions(":8087", db, Options{SlowQueryThreshold: time.Nanosecond, SlowQueryBuffer: 2, SlowQueryLog: logger})
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu value=1 1556813561098000000\ncpu value=2 1556813562098000000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	for _, q := range []string{"SHOW DATABASES", "SELECT value FROM cpu", "SELECT * FROM cpu WHERE time >= 0 and time <= 1556813562098000000"} {
+		w = doRequest(t, srv, "GET", "/query?db=mydb&u=admin&p=secret&q="+url.QueryEscape(q), "")
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+
+	// Only the latest queries are kept, newest first
+	var slow struct {
+		Queries []slowQuery `json:"queries"`
+	}
+	w = doRequest(t, srv, "GET", "/debug/queries", "", withRemoteAddr("127.0.0.1:50000"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &slow))
+	if assert.Len(t, slow.Queries, 2) {
+		q := slow.Queries[0]
+		assert.Equal(t, "v1", q.API)
+		assert.Equal(t, "mydb", q.Database)
+		assert.Equal(t, "SELECT * FROM cpu WHERE time >= 0 and time <= 1556813562098000000", q.Query)
+		assert.Equal(t, &queryStatement{Measurement: "cpu", Field: "*", End: 1556813562098000000}, q.Statement)
+		assert.Equal(t, 2, q.Rows)
+		assert.Equal(t, http.StatusOK, q.Status)
+		assert.Len(t, q.RequestID, 32)
+		assert.Equal(t, map[string]string{"db": "mydb", "q": q.Query}, q.Params)
+		assert.Greater(t, q.Timing.Total, 0.0)
+		assert.Equal(t, "SELECT value FROM cpu", slow.Queries[1].Query)
+	}
+
+	entries := hook.AllEntries()
+	if assert.Len(t, entries, 3) {
+		assert.Equal(t, "slow query", entries[2].Message)
+		assert.Equal(t, 2, entries[2].Data["rows"])
+	}
+
+	// Disabled by default
+	srv, other := setupTestServer(t)
+	defer other.Close()
+	w = doRequest(t, srv, "GET", "/debug/queries", "", withRemoteAddr("127.0.0.1:50000"))
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &slow))
+	assert.Empty(t, slow.Queries)
+}
+
+func TestDebugEndpoints(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	get := func(srv *Server, path, remote, auth string) *httptest.ResponseRecorder {
+		if auth == "" {
+			return doRequest(t, srv, "GET", path, "", withRemoteAddr(remote))
+		}
+		return doRequest(t, srv, "GET", path, "", withRemoteAddr(remote), withHeader("Authorization", auth))
+	}
+
+	// Without a token, only local clients are served
+	w := get(srv, "/debug/vars", "127.0.0.1:50000", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var vars map[string]json.RawMessage
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &vars))
+	assert.Contains(t, vars, "memstats")
+	assert.Contains(t, string(vars["refluxdb"]), "refluxdb_goroutines")
+
+	w = get(srv, "/debug/pprof/", "[::1]:50000", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "goroutine")
+	w = get(srv, "/debug/pprof/heap?debug=1", "127.0.0.1:50000", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "heap profile")
+
+	w = get(srv, "/debug/pprof/", "192.0.2.1:50000", "")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	w = doRequest(t, srv, "GET", "/debug/vars", "", withRemoteAddr("192.0.2.1:50000"), withHeader("X-Forwarded-For", "127.0.0.1"))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// With a token, every client must send it
+	srv = NewWithOptions(":8087", db, Options{DebugToken: "s3cret"})
+	assert.Equal(t, http.StatusUnauthorized, get(srv, "/debug/vars", "127.0.0.1:50000", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, get(srv, "/debug/vars", "192.0.2.1:50000", "Token wrong").Code)
+	assert.Equal(t, http.StatusUnauthorized, get(srv, "/debug/vars", "192.0.2.1:50000", "s3cret").Code)
+	assert.Equal(t, http.StatusOK, get(srv, "/debug/vars", "192.0.2.1:50000", "Token s3cret").Code)
+	assert.Equal(t, http.StatusOK, get(srv, "/debug/queries", "192.0.2.1:50000", "Bearer s3cret").Code)
+}
+
+func TestRequestLogging(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	logger, hook := logtest.NewNullLogger()
+	srv := NewWithOptions(":8087", db, Options{Logger: logger})
+
+	w := doRequest(t, srv, "GET", "/ping", "")
+	id := w.Header().Get("X-Request-Id")
+	assert.Len(t, id, 32)
+
+	entry := hook.LastEntry()
+	assert.Equal(t, logrus.InfoLevel, entry.Level)
+	assert.Equal(t, id, entry.Data["request_id"])
+	assert.Equal(t, "GET", entry.Data["method"])
+	assert.Equal(t, "/ping", entry.Data["path"])
+	assert.Equal(t, http.StatusNoContent, entry.Data["status"])
+	assert.Contains(t, entry.Data, "latency_ms")
+	assert.Contains(t, entry.Data, "bytes")
+
+	// A client supplied ID is propagated, and rejected requests log a warning
+	w = doRequest(t, srv, "POST", "/write", "cpu value=1", withHeader("X-Request-Id", "abc123"))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "abc123", w.Header().Get("X-Request-Id"))
+
+	entry = hook.LastEntry()
+	assert.Equal(t, logrus.WarnLevel, entry.Level)
+	assert.Equal(t, "abc123", entry.Data["request_id"])
+}
+
+func TestTraceHeaders(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	logger, hook := logtest.NewNullLogger()
+	slowLog, slowHook := logtest.NewNullLogger()
+	srv := NewWithOptions(":8087", db, Options{Logger: logger, SlowQueryThreshold: time.Nanosecond, SlowQueryLog: slowLog})
+
+	// The trace context is echoed and tags the request and slow query logs
+	w := doRequest(t, srv, "GET", "/query?q=SHOW+DATABASES", "", withHeader("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"), withHeader("tracestate", "vendor=1"), withHeader("User-Agent", "app/1.0"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", w.Header().Get("traceparent"))
+	assert.Equal(t, "vendor=1", w.Header().Get("tracestate"))
+
+	entry := hook.LastEntry()
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", entry.Data["trace_id"])
+	assert.Equal(t, "00f067aa0ba902b7", entry.Data["span_id"])
+	assert.Equal(t, "app/1.0", entry.Data["user_agent"])
+	entry = slowHook.LastEntry()
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", entry.Data["trace_id"])
+	assert.Equal(t, "app/1.0", entry.Data["user_agent"])
+	if queries := srv.slowQueries.list(); assert.Len(t, queries, 1) {
+		assert.Equal(t, "00f067aa0ba902b7", queries[0].SpanID)
+	}
+
+	// Requests without a trace are logged without one
+	w = doRequest(t, srv, "GET", "/ping", "")
+	assert.Empty(t, w.Header().Get("traceparent"))
+	assert.NotContains(t, hook.LastEntry().Data, "trace_id")
+
+	for _, tt := range []struct {
+		headers     map[string]string
+		trace, span string
+		echoed      []string
+		sampled     bool
+		none        bool
+	}{
+		{headers: map[string]string{"b3": "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1-05e3ac9a4f6e3b90"},
+			trace: "80f198ee56343ba864fe8b2a57d3eff7", span: "e457b5a2e4d86bd1", echoed: []string{"b3"}, sampled: true},
+		{headers: map[string]string{"X-B3-TraceId": "a3ce929d0e0e4736", "X-B3-SpanId": "00F067AA0BA902B7", "X-B3-Sampled": "1"},
+			trace: "a3ce929d0e0e4736", span: "00f067aa0ba902b7", echoed: []string{"X-B3-TraceId", "X-B3-SpanId", "X-B3-Sampled"}, sampled: true},
+		// A valid traceparent wins over B3 headers
+		{headers: map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", "b3": "a3ce929d0e0e4736-00f067aa0ba902b7"},
+			trace: "4bf92f3577b34da6a3ce929d0e0e4736", span: "00f067aa0ba902b7", echoed: []string{"traceparent"}},
+		// An invalid one does not
+		{headers: map[string]string{"traceparent": "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "b3": "a3ce929d0e0e4736-00f067aa0ba902b7"},
+			trace: "a3ce929d0e0e4736", span: "00f067aa0ba902b7", echoed: []string{"b3"}},
+		{headers: map[string]string{"traceparent": "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, none: true},
+		{headers: map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"}, none: true},
+		{headers: map[string]string{"b3": "1"}, none: true},
+		{headers: map[string]string{"X-B3-TraceId": "xyz", "X-B3-SpanId": "00f067aa0ba902b7"}, none: true},
+	} {
+		h := make(http.Header)
+		for k, v := range tt.headers {
+			h.Set(k, v)
+		}
+		trace, ok := parseTraceContext(h)
+		assert.Equal(t, !tt.none, ok, tt.headers)
+		assert.Equal(t, tt.trace, trace.TraceID, tt.headers)
+		assert.Equal(t, tt.span, trace.SpanID, tt.headers)
+		assert.Equal(t, tt.sampled, trace.Sampled, tt.headers)
+		assert.Len(t, trace.headers, len(tt.echoed), tt.headers)
+		for _, name := range tt.echoed {
+			assert.Equal(t, h.Get(name), trace.headers.Get(name), tt.headers)
+		}
+	}
+}
+
+func TestTracingSpans(t *testing.T) {
+	type span struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Name         string `json:"name"`
+	}
+	var mu sync.Mutex
+	var spans []span
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans json.RawMessage `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				var batch []span
+				assert.NoError(t, json.Unmarshal(ss.Spans, &batch))
+				spans = append(spans, batch...)
+			}
+		}
+	}))
+	defer collector.Close()
+
+	tracer, err := tracing.New(tracing.Options{Endpoint: collector.URL, SampleRate: 0})
+	assert.NoError(t, err)
+	tracer.Start(context.Background())
+
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	srv := NewWithOptions(":8087", db, Options{Tracer: tracer})
+
+	// Only the traces sampled upstream are recorded at a rate of 0
+	for _, flags := range []string{"01", "00"} {
+		w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu,host=a value=1 1556813561098000000", withHeader("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-"+flags))
+		assert.Equal(t, http.StatusNoContent, w.Code)
+	}
+	w := doRequest(t, srv, "GET", "/query?db=mydb&q=SELECT+value+FROM+cpu", "", withHeader("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"))
+	assert.Equal(t, http.StatusOK, w.Code)
+	tracer.Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	byName := map[string][]string{}
+	ids := map[string]string{}
+	for _, s := range spans {
+		byName[s.TraceID] = append(byName[s.TraceID], s.Name)
+		ids[s.Name] = s.SpanID
+	}
+	assert.ElementsMatch(t, []string{"POST /write", "write.parse", "storage.enqueue", "storage.commit"}, byName["4bf92f3577b34da6a3ce929d0e0e4736"])
+	assert.ElementsMatch(t, []string{"GET /query", "query.queue", "query.parse", "query.execute", "query.encode"}, byName["0af7651916cd43dd8448eb211c80319c"])
+	for _, s := range spans {
+		switch s.Name {
+		case "POST /write":
+			assert.Equal(t, "00f067aa0ba902b7", s.ParentSpanID)
+		case "GET /query":
+			assert.Equal(t, "b7ad6b7169203331", s.ParentSpanID)
+		case "write.parse", "storage.enqueue", "storage.commit":
+			assert.Equal(t, ids["POST /write"], s.ParentSpanID, s.Name)
+		default:
+			assert.Equal(t, ids["GET /query"], s.ParentSpanID, s.Name)
+		}
+	}
+}
+
+func TestExportEndpoint(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu,host=a user=1 1556813561098000000\ncpu,host=a user=2 1556813562098000000\nmem,host=a used=3 1556813561098000000")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	w = doRequest(t, srv, "GET", "/export?db=mydb&measurement=cpu&start=2019-05-02T16:12:42Z", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "# DML\n# CONTEXT-DATABASE:mydb\n# CONTEXT-RETENTION-POLICY:autogen\ncpu,host=a user=2 1556813562098000000\n", w.Body.String())
+
+	w = doRequest(t, srv, "GET", "/export", "", withHeader("Accept-Encoding", "gzip"))
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(w.Body)
+	assert.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, strings.Count(string(body), " 15568135"))
+
+	w = doRequest(t, srv, "GET", "/export?start=yesterday", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDatabaseIsolation(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	query := func(q, database string) string {
+		w := doRequest(t, srv, "GET", "/query?db="+database+"&q="+url.QueryEscape(q), "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+	write := func(path, data string) {
+		w := doRequest(t, srv, "POST", path, data)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+	}
+
+	assert.JSONEq(t, `{"results":[{"statement_id":0}]}`, query("CREATE DATABASE empty", ""))
+	write("/write?db=first", "cpu,host=a value=1 1556813561098000000")
+	write("/api/v2/write?org=my-org&bucket=second", "cpu,host=a value=2 1556813561098000000")
+
+	assert.JSONEq(t, `{"results":[{"statement_id":0,"series":[{"name":"databases","columns":["name"],"values":[["empty"],["first"],["second"]]}]}]}`,
+		query("SHOW DATABASES", ""))
+
+	// The same series lives independently in each database
+	assert.Contains(t, query("SELECT value FROM cpu WHERE time >= 1556813561098ms and time <= 1556813561098ms", "first"), `,1]`)
+	assert.Contains(t, query("SELECT value FROM cpu WHERE time >= 1556813561098ms and time <= 1556813561098ms", "second"), `,2]`)
+	assert.Contains(t, query("SHOW MEASUREMENTS", "first"), `["cpu"]`)
+	assert.NotContains(t, query("SHOW MEASUREMENTS", "empty"), `cpu`)
+
+	// v2 queries read the bucket of the same name
+	w := doRequest(t, srv, "GET", "/api/v2/query?org=my-org&bucket=first&measurement=cpu&start=0", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `,1]`)
+
+	assert.JSONEq(t, `{"results":[{"statement_id":0}]}`, query("DROP DATABASE first", ""))
+	assert.JSONEq(t, `{"results":[{"statement_id":0,"error":"database not found: first"}]}`, query("SELECT * FROM cpu", "first"))
+	assert.JSONEq(t, `{"results":[{"statement_id":0,"error":"database not found: first"}]}`, query("USE first", ""))
+
+	w = doRequest(t, srv, "GET", "/api/v2/query?org=my-org&bucket=first&measurement=cpu", "")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestUseSession(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	w := doRequest(t, srv, "POST", "/write?db=mydb", "cpu value=1")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	query := func(q string, header http.Header, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		return doRequest(t, srv, "GET", "/query?q="+url.QueryEscape(q), "", func(req *http.Request) {
+			for k, v := range header {
+				req.Header[k] = v
+			}
+			for _, cookie := range cookies {
+				req.AddCookie(cookie)
+			}
+		})
+	}
+
+	// Without a session, unqualified statements still need a database
+	w = query("SHOW MEASUREMENTS", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = query(`USE "mydb"`, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	id := w.Header().Get(sessionHeader)
+	assert.NotEmpty(t, id)
+	cookies := w.Result().Cookies()
+
+	// The session is found by header or cookie
+	w = query("SHOW MEASUREMENTS", http.Header{sessionHeader: {id}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, [][]interface{}{{"cpu"}}, decodeValues(t, w.Body))
+	w = query("SELECT value FROM cpu", nil, cookies...)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"cpu"`)
+
+	// Unknown databases leave the session unchanged
+	w = query("USE missing", http.Header{sessionHeader: {id}})
+	assert.Contains(t, w.Body.String(), "database not found: missing")
+	w = query("SHOW MEASUREMENTS", http.Header{sessionHeader: {id}})
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Idle sessions expire
+	srv.sessions.now = func() time.Time { return time.Now().Add(2 * sessionTTL) }
+	w = query("SHOW MEASUREMENTS", http.Header{sessionHeader: {id}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestBucketsAPI(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+	org, err := db.SetDefaultOrganization("my-org")
+	assert.NoError(t, err)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, method, path, body, withHeader("Content-Type", "application/json"))
+	}
+
+	w := do("POST", "/api/v2/buckets", `{"name":"metrics","orgID":"`+org.ID+`","retentionRules":[{"type":"expire","everySeconds":3600}]}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created struct {
+		ID             string `json:"id"`
+		Name           string `json:"name"`
+		OrgID          string `json:"orgID"`
+		RetentionRules []struct {
+			EverySeconds int64 `json:"everySeconds"`
+		} `json:"retentionRules"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, "metrics", created.Name)
+	assert.Equal(t, org.ID, created.OrgID)
+	assert.Len(t, created.RetentionRules, 1)
+	assert.Equal(t, int64(3600), created.RetentionRules[0].EverySeconds)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, do("POST", "/api/v2/buckets", `{"name":"metrics"}`).Code)
+	assert.Equal(t, http.StatusNotFound, do("POST", "/api/v2/buckets", `{"name":"x","orgID":"missing"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/v2/buckets", `{"orgID":"`+org.ID+`"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/v2/buckets", `{"name":"x","retentionRules":[{"type":"expire","everySeconds":-1}]}`).Code)
+
+	// Buckets are databases, so writes land in them and they can be listed
+	assert.Equal(t, http.StatusNoContent, do("POST", "/api/v2/write?org=org1&bucket=other", "cpu value=1").Code)
+	w = do("GET", "/api/v2/buckets?name=metrics&org=my-org", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"id":"`+created.ID+`"`)
+	assert.NotContains(t, w.Body.String(), `"other"`)
+	w = do("GET", "/api/v2/buckets?limit=1&offset=1", "")
+	assert.Contains(t, w.Body.String(), `"name":"other"`)
+	assert.NotContains(t, w.Body.String(), `"name":"metrics"`)
+
+	w = do("PATCH", "/api/v2/buckets/"+created.ID, `{"name":"renamed","description":"app","retentionRules":[]}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"name":"renamed"`)
+	assert.Contains(t, w.Body.String(), `"retentionRules":[]`)
+
+	w = do("GET", "/api/v2/buckets/"+created.ID, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"description":"app"`)
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/api/v2/buckets/"+created.ID, "").Code)
+	assert.Equal(t, http.StatusNotFound, do("GET", "/api/v2/buckets/"+created.ID, "").Code)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/api/v2/buckets/"+created.ID, "").Code)
+}
+
+func TestRenameBucketSeriesIndex(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	query := func(database, q string) [][]interface{} {
+		w := doRequest(t, srv, "GET", "/query?db="+database+"&q="+url.QueryEscape(q), "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		return decodeValues(t, w.Body)
+	}
+
+	assert.Equal(t, http.StatusNoContent, doRequest(t, srv, "POST", "/write?db=a", "cpu,host=new value=1 1").Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(t, srv, "POST", "/write?db=b", "cpu,host=old value=2 1").Code)
+	// Loads the series index of b
+	assert.Len(t, query("b", `SELECT value FROM cpu WHERE host = 'old'`), 1)
+
+	// a takes the name b had, whose series the index must not keep
+	// answering for
+	a, err := db.GetDatabase("a")
+	assert.NoError(t, err)
+	b, err := db.GetDatabase("b")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "PATCH", "/api/v2/buckets/"+b.ID, `{"name":"c"}`).Code)
+	assert.Equal(t, http.StatusOK, doRequest(t, srv, "PATCH", "/api/v2/buckets/"+a.ID, `{"name":"b"}`).Code)
+	assert.Len(t, query("b", `SELECT value FROM cpu WHERE host = 'new'`), 1)
+	assert.Len(t, query("c", `SELECT value FROM cpu WHERE host = 'old'`), 1)
+}
+
+func TestV2BucketIDs(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+	org, err := db.SetDefaultOrganization("my-org")
+	assert.NoError(t, err)
+	d, err := db.AddDatabase(persistence.Database{Name: "metrics"})
+	assert.NoError(t, err)
+
+	// IDs are accepted in place of names, or in the ID parameters
+	assert.Equal(t, http.StatusNoContent, doRequest(t, srv, "POST", "/api/v2/write?orgID="+org.ID+"&bucketID="+d.ID, "cpu value=1 1").Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(t, srv, "POST", "/api/v2/write?org="+org.ID+"&bucket="+d.ID, "cpu value=2 2").Code)
+	assert.Equal(t, http.StatusNoContent, doRequest(t, srv, "POST", "/api/v2/write?org=my-org&bucket=metrics", "cpu value=3 3").Code)
+	w := doRequest(t, srv, "GET", "/api/v2/query?orgID="+org.ID+"&bucketID="+d.ID+"&measurement=cpu&start=0", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, decodeValues(t, w.Body), 3)
+	w = doRequest(t, srv, "GET", "/api/v2/query?org=my-org&bucket="+d.ID+"&measurement=cpu&start=0", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, decodeValues(t, w.Body), 3)
+
+	// No database was created under the ID
+	exists, err := db.HasDatabase(d.ID)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.Equal(t, http.StatusNotFound, doRequest(t, srv, "POST", "/api/v2/write?orgID=missing&bucket=metrics", "cpu value=1").Code)
+	assert.Equal(t, http.StatusNotFound, doRequest(t, srv, "POST", "/api/v2/write?org=my-org&bucketID=missing", "cpu value=1").Code)
+	assert.Equal(t, http.StatusBadRequest, doRequest(t, srv, "POST", "/api/v2/write?bucketID="+d.ID, "cpu value=1").Code)
+}
+
+func TestDeleteAPI(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+	_, err := db.SetDefaultOrganization("my-org")
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusNoContent, doRequest(t, srv, "POST", "/api/v2/write?org=my-org&bucket=metrics", strings.Join([]string{
+		"cpu,host=a value=1 1000000000",
+		"cpu,host=a value=2 2000000000",
+		"cpu,host=b value=3 2000000000",
+		"mem,host=a used=4 2000000000",
+	}, "\n")).Code)
+
+	w := doRequest(t, srv, "POST", "/api/v2/delete?org=my-org&bucket=metrics",
+		`{"start": "1970-01-01T00:00:02Z", "stop": "1970-01-01T00:00:03Z", "predicate": "_measurement=\"cpu\" AND host=\"a\""}`)
+	assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	w = doRequest(t, srv, "GET", "/query?db=metrics&q=SELECT+value+FROM+cpu", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, decodeValues(t, w.Body), 2)
+
+	// Without a predicate every point in the range is deleted
+	w = doRequest(t, srv, "POST", "/api/v2/delete?org=my-org&bucket=metrics", `{"start": "1970-01-01T00:00:00Z", "stop": "2100-01-01T00:00:00Z"}`)
+	assert.Equal(t, http.StatusNoContent, w.Code, w.Body.String())
+	measurements, err := db.ListTimeseries("metrics")
+	assert.NoError(t, err)
+	assert.Empty(t, measurements)
+
+	entries, err := db.AuditLog(time.Time{}, 0)
+	assert.NoError(t, err)
+	var details []string
+	for _, e := range entries {
+		if e.Action == "data.delete" && e.Target == "metrics" {
+			details = append(details, e.Detail)
+		}
+	}
+	assert.ElementsMatch(t, []string{
+		`1 points from 1970-01-01T00:00:02Z to 1970-01-01T00:00:03Z where _measurement="cpu" AND host="a"`,
+		"3 points from 1970-01-01T00:00:00Z to 2100-01-01T00:00:00Z",
+	}, details)
+
+	for _, tt := range []struct {
+		path, body string
+		status     int
+	}{
+		{"/api/v2/delete?org=my-org&bucket=missing", `{"start": "1970-01-01T00:00:00Z", "stop": "1970-01-01T00:00:01Z"}`, http.StatusNotFound},
+		{"/api/v2/delete?org=my-org", `{"start": "1970-01-01T00:00:00Z", "stop": "1970-01-01T00:00:01Z"}`, http.StatusBadRequest},
+		{"/api/v2/delete?org=my-org&bucket=metrics", `{"stop": "1970-01-01T00:00:01Z"}`, http.StatusBadRequest},
+		{"/api/v2/delete?org=my-org&bucket=metrics", `{"start": "yesterday", "stop": "1970-01-01T00:00:01Z"}`, http.StatusBadRequest},
+		{"/api/v2/delete?org=my-org&bucket=metrics", `{"start": "1970-01-01T00:00:02Z", "stop": "1970-01-01T00:00:01Z"}`, http.StatusBadRequest},
+		{"/api/v2/delete?org=my-org&bucket=metrics", `{"start": "1970-01-01T00:00:00Z", "stop": "1970-01-01T00:00:01Z", "predicate": "host='a' OR host='b'"}`, http.StatusBadRequest},
+		{"/api/v2/delete?org=my-org&bucket=metrics", `not json`, http.StatusBadRequest},
+	} {
+		w := doRequest(t, srv, "POST", tt.path, tt.body)
+		assert.Equal(t, tt.status, w.Code, tt.body)
+		assert.Contains(t, w.Body.String(), `"code"`, tt.body)
+	}
+}
+
+func TestDeletePredicate(t *testing.T) {
+	for _, tt := range []struct {
+		predicate   string
+		measurement string
+		tags        map[string]string
+		err         bool
+	}{
+		{predicate: ""},
+		{predicate: `_measurement="cpu"`, measurement: "cpu"},
+		{predicate: ` _measurement = "cpu"  and  host = 'a b' AND "region tag"="eu \"west\"" `, measurement: "cpu",
+			tags: map[string]string{"host": "a b", "region tag": `eu "west"`}},
+		{predicate: `host="" AND host=""`, tags: map[string]string{"host": ""}},
+		{predicate: `host="a" AND host="b"`, err: true},
+		{predicate: `_measurement="cpu" AND _measurement="mem"`, err: true},
+		{predicate: `_field="usage"`, err: true},
+		{predicate: `host!="a"`, err: true},
+		{predicate: `host="a" OR host="b"`, err: true},
+		{predicate: `host="a" AND`, err: true},
+		{predicate: `host=a`, err: true},
+		{predicate: `host="a`, err: true},
+		{predicate: `host`, err: true},
+		{predicate: `host="a" region="b"`, err: true},
+	} {
+		measurement, tags, err := parseDeletePredicate(tt.predicate)
+		if tt.err {
+			assert.Error(t, err, tt.predicate)
+			continue
+		}
+		assert.NoError(t, err, tt.predicate)
+		assert.Equal(t, tt.measurement, measurement, tt.predicate)
+		assert.Equal(t, tt.tags, tags, tt.predicate)
+	}
+}
+
+func TestMigrationsAPI(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+	_, err := db.SetDefaultOrganization("my-org")
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusNoContent, doRequest(t, srv, "POST", "/api/v2/write?org=my-org&bucket=metrics", strings.Join([]string{
+		"cpu,hostname=a value=1 1000000000",
+		"cpu,host=a value=2 2000000000",
+		"cpu,hostname=b value=3 2000000000",
+	}, "\n")).Code)
+
+	w := doRequest(t, srv, "POST", "/api/v2/migrations?org=my-org&bucket=metrics", `{"kind": "rename-tag", "measurement": "cpu", "tag": "hostname", "to": "host"}`)
+	assert.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var started migration
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &started))
+	assert.Equal(t, "metrics", started.Bucket)
+	assert.Equal(t, "/api/v2/migrations/"+started.ID, started.Links["self"])
+
+	var done migration
+	assert.Eventually(t, func() bool {
+		w := doRequest(t, srv, "GET", "/api/v2/migrations/"+started.ID, "")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &done))
+		return done.Status != migrationRunning
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, migrationSuccess, done.Status, done.Error)
+	assert.Equal(t, migrationProgress{Series: 3, Done: 3, Rewritten: 2, Merged: 1, PointsMoved: 1}, done.Progress)
+	assert.NotNil(t, done.FinishedAt)
+
+	series, err := db.ListSeries(context.Background(), "metrics", "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cpu,host=a", "cpu,host=b"}, series)
+
+	w = doRequest(t, srv, "GET", "/api/v2/migrations", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list struct{ Migrations []migration }
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list.Migrations, 1)
+
+	entries, err := db.AuditLog(time.Time{}, 0)
+	assert.NoError(t, err)
+	var details []string
+	for _, e := range entries {
+		if e.Action == "schema.migrate" {
+			details = append(details, e.Detail)
+		}
+	}
+	assert.Equal(t, []string{"rename tag hostname to host of cpu"}, details)
+
+	for _, tt := range []struct {
+		path, body string
+		status     int
+	}{
+		{"/api/v2/migrations?org=my-org&bucket=missing", `{"kind": "drop-tag", "tag": "host"}`, http.StatusNotFound},
+		{"/api/v2/migrations?org=my-org", `{"kind": "drop-tag", "tag": "host"}`, http.StatusBadRequest},
+		{"/api/v2/migrations?org=my-org&bucket=metrics", `{"kind": "drop-field", "tag": "host"}`, http.StatusBadRequest},
+		{"/api/v2/migrations?org=my-org&bucket=metrics", `{"kind": "rename-measurement", "measurement": "cpu"}`, http.StatusBadRequest},
+		{"/api/v2/migrations?org=my-org&bucket=metrics", `not json`, http.StatusBadRequest},
+	} {
+		w := doRequest(t, srv, "POST", tt.path, tt.body)
+		assert.Equal(t, tt.status, w.Code, tt.body)
+		assert.Contains(t, w.Body.String(), `"code"`, tt.body)
+	}
+	assert.Equal(t, http.StatusNotFound, doRequest(t, srv, "GET", "/api/v2/migrations/unknown", "").Code)
+}
+
+func TestCompactAPI(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	w := doRequest(t, srv, "POST", "/api/v2/compact?full=true", "")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var got compaction
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.True(t, got.Full)
+	assert.Positive(t, got.SizeAfter)
+
+	entries, err := db.AuditLog(time.Time{}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "storage.compact", entries[len(entries)-1].Action)
+
+	w = doRequest(t, srv, "POST", "/api/v2/compact?maxPages=none", "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestSnapshotAPI(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+	assert.NoError(t, db.SaveBatch([]persistence.Point{{Database: "metrics", Measurement: "cpu", Fields: map[string]float64{"value": 1}, Timestamp: 1000}}))
+
+	w := doRequest(t, srv, "GET", "/api/v2/snapshot", "")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "application/vnd.sqlite3", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Header().Get("Content-Disposition"), "attachment")
+
+	path := filepath.Join(t.TempDir(), "snapshot.db")
+	assert.NoError(t, os.WriteFile(path, w.Body.Bytes(), 0o644))
+	copied, err := persistence.New(path)
+	assert.NoError(t, err)
+	defer copied.Close()
+	points, err := copied.GetMeasurementRange("metrics", "cpu", 0, 2000)
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+
+	entries, err := db.AuditLog(time.Time{}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "storage.snapshot", entries[len(entries)-1].Action)
+}
+
+func TestOrgsAPI(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+	_, err := db.SetDefaultOrganization("my-org")
+	assert.NoError(t, err)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, method, path, body, withHeader("Content-Type", "application/json"))
+	}
+
+	// The default org is looked up by name, as the official clients do
+	w := do("GET", "/api/v2/orgs?org=my-org", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"name":"my-org"`)
+	assert.Contains(t, do("GET", "/api/v2/orgs?org=missing", "").Body.String(), `"orgs":[]`)
+
+	w = do("POST", "/api/v2/orgs", `{"name":"acme","description":"tenant"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var created struct {
+		ID string `json:"id"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.Equal(t, http.StatusUnprocessableEntity, do("POST", "/api/v2/orgs", `{"name":"acme"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/api/v2/orgs", `{}`).Code)
+
+	w = do("PATCH", "/api/v2/orgs/"+created.ID, `{"name":"acme-corp"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"name":"acme-corp"`)
+	assert.Contains(t, w.Body.String(), `"description":"tenant"`)
+	assert.Equal(t, http.StatusUnprocessableEntity, do("PATCH", "/api/v2/orgs/"+created.ID, `{"name":"my-org"}`).Code)
+
+	// Deleting an org deletes its buckets
+	assert.Equal(t, http.StatusCreated, do("POST", "/api/v2/buckets", `{"name":"acme-data","orgID":"`+created.ID+`"}`).Code)
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/api/v2/orgs/"+created.ID, "").Code)
+	assert.Equal(t, http.StatusNotFound, do("GET", "/api/v2/orgs/"+created.ID, "").Code)
+	assert.NotContains(t, do("GET", "/api/v2/buckets", "").Body.String(), "acme-data")
+}
+
+func TestSubscriptions(t *testing.T) {
+	received := make(chan string, 10)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r.URL.Query().Get("db") + ":" + string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer downstream.Close()
+
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.CreateDatabase("mydb"))
+	svc := subscriber.New(db, subscriber.Options{})
+	assert.NoError(t, svc.Start())
+	defer svc.Stop()
+	srv := NewWithOptions(":8087", db, Options{Subscriber: svc})
+
+	query := func(q string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, "POST", "/query?q="+url.QueryEscape(q), "")
+	}
+
+	w := query(`CREATE SUBSCRIPTION "mirror" ON "mydb"."autogen" DESTINATIONS ALL '` + downstream.URL + `' MEASUREMENTS "cpu"`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"results":[{"statement_id":0}]}`, w.Body.String())
+	assert.Contains(t, query(`CREATE SUBSCRIPTION "mirror" ON mydb DESTINATIONS ANY 'udp://localhost:8089'`).Body.String(), "subscription already exists")
+	assert.Contains(t, query(`CREATE SUBSCRIPTION "x" ON "missing" DESTINATIONS ALL 'udp://localhost:8089'`).Body.String(), "database not found")
+	assert.Equal(t, http.StatusBadRequest, query(`CREATE SUBSCRIPTION "x" ON "mydb" DESTINATIONS ALL 'tcp://localhost:8089'`).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`CREATE SUBSCRIPTION "x" ON "mydb" DESTINATIONS SOME 'udp://localhost:8089'`).Code)
+	assert.Equal(t, http.StatusBadRequest, query(`CREATE SUBSCRIPTION "x" ON "mydb"."weekly" DESTINATIONS ALL 'udp://localhost:8089'`).Code)
+
+	values := decodeValues(t, query("SHOW SUBSCRIPTIONS").Body)
+	assert.Equal(t, [][]interface{}{{"autogen", "mirror", "ALL", []interface{}{downstream.URL}, []interface{}{"cpu"}}}, values)
+
+	// Written points of the subscribed measurements are forwarded
+	w = doRequest(t, srv, "POST", "/write?db=mydb", "cpu value=1 100\nmem value=2 100")
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	select {
+	case body := <-received:
+		assert.Equal(t, "mydb:cpu value=1 100\n", body)
+	case <-time.After(2 * time.Second):
+		t.Fatal("points were not forwarded")
+	}
+
+	assert.JSONEq(t, `{"results":[{"statement_id":0}]}`, query(`DROP SUBSCRIPTION "mirror" ON "mydb"."autogen"`).Body.String())
+	assert.Contains(t, query(`DROP SUBSCRIPTION "mirror" ON "mydb"."autogen"`).Body.String(), "subscription not found")
+	assert.JSONEq(t, `{"results":[{"statement_id":0}]}`, query("SHOW SUBSCRIPTIONS").Body.String())
+}
+
+func TestChecks(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.NoError(t, db.SaveBatch([]persistence.Point{{Database: "telegraf", Measurement: "cpu", Fields: map[string]float64{"usage": 95}, Timestamp: time.Now().UnixNano()}}))
+
+	svc, err := alerts.New(db, []alerts.Check{
+		{Name: "cpu_high", Database: "telegraf", Measurement: "cpu", Field: "usage", Aggregation: "max", Operator: ">", Threshold: 90, Window: time.Hour, Every: time.Minute},
+		{Name: "idle", Database: "telegraf", Measurement: "cpu", Field: "idle", Aggregation: "mean", Operator: "<", Threshold: 10, Window: time.Hour, Every: time.Minute},
+	}, nil, alerts.Options{})
+	assert.NoError(t, err)
+	svc.Run(context.Background(), "cpu_high")
+	srv := NewWithOptions(":8087", db, Options{Alerts: svc})
+
+	w := doRequest(t, srv, "GET", "/api/v2/checks", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Checks []map[string]interface{} `json:"checks"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	if assert.Len(t, list.Checks, 2) {
+		assert.Equal(t, "cpu_high", list.Checks[0]["id"])
+		assert.Equal(t, "crit", list.Checks[0]["level"])
+		assert.Equal(t, 95.0, list.Checks[0]["value"])
+		assert.Equal(t, "success", list.Checks[0]["lastRunStatus"])
+		// Checks that did not run yet have no level
+		assert.Equal(t, "", list.Checks[1]["level"])
+		assert.Nil(t, list.Checks[1]["value"])
+	}
+
+	w = doRequest(t, srv, "GET", "/api/v2/checks?limit=1&offset=1", "")
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	assert.Len(t, list.Checks, 1)
+
+	w = doRequest(t, srv, "GET", "/api/v2/checks/cpu_high", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var one map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &one))
+	assert.Equal(t, "cpu_high is CRIT: max(usage) of cpu is 95 > 90 over the last 1h0m0s", one["message"])
+	assert.Equal(t, http.StatusNotFound, doRequest(t, srv, "GET", "/api/v2/checks/missing", "").Code)
+
+	// Without an alerts service there are no checks
+	srv, _ = setupTestServer(t)
+	w = doRequest(t, srv, "GET", "/api/v2/checks", "")
+	assert.JSONEq(t, `{"checks":[],"links":{"self":"/api/v2/checks"}}`, w.Body.String())
+}
+
+func TestCheckScopes(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	svc, err := alerts.New(db, []alerts.Check{
+		{Name: "cpu_high", Database: "telegraf", Measurement: "cpu", Field: "usage", Aggregation: "max", Operator: ">", Threshold: 90, Window: time.Hour, Every: time.Minute, Notify: []string{"ops"}},
+		{Name: "disk_full", Database: "infra", Measurement: "disk", Field: "used", Aggregation: "max", Operator: ">", Threshold: 90, Window: time.Hour, Every: time.Minute},
+	}, []alerts.Endpoint{{Name: "ops", Type: alerts.EndpointWebhook, URL: "http://alerts.example.com/hook"}}, alerts.Options{})
+	assert.NoError(t, err)
+	srv := NewWithOptions(":8087", db, Options{Alerts: svc, AuthEnabled: true})
+	_, admin, err := db.AddToken("admin", []string{"admin"})
+	assert.NoError(t, err)
+	_, reader, err := db.AddToken("reader", []string{"read:telegraf"})
+	assert.NoError(t, err)
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, "GET", path, "", withHeader("Authorization", "Token "+token))
+	}
+
+	// Readers only see the checks of their databases, without endpoints
+	w := get("/api/v2/checks", reader)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"id":"cpu_high"`)
+	assert.NotContains(t, w.Body.String(), "disk_full")
+	assert.Contains(t, w.Body.String(), `"endpoints":[]`)
+	assert.Equal(t, http.StatusForbidden, get("/api/v2/checks/disk_full", reader).Code)
+	w = get("/api/v2/checks/cpu_high", reader)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"endpoints":[]`)
+
+	w = get("/api/v2/checks", admin)
+	assert.Contains(t, w.Body.String(), "disk_full")
+	assert.Contains(t, w.Body.String(), `"endpoints":["ops"]`)
+}
+
+func TestTasks(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	hour := time.Now().Truncate(time.Hour).Add(-time.Hour)
+	assert.NoError(t, db.SaveBatch([]persistence.Point{
+		{Database: "raw", Measurement: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"value": 2}, Timestamp: hour.Add(time.Minute).UnixNano()},
+		{Database: "raw", Measurement: "cpu", Tags: map[string]string{"host": "a"}, Fields: map[string]float64{"value": 4}, Timestamp: hour.Add(2 * time.Minute).UnixNano()},
+	}))
+
+	svc := tasks.New(db, tasks.Options{})
+	srv := NewWithOptions(":8087", db, Options{Tasks: svc})
+	svc.Start(context.Background(), srv.Execute)
+	defer svc.Stop()
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, method, path, body, withHeader("Content-Type", "application/json"))
+	}
+	decode := func(w *httptest.ResponseRecorder) map[string]interface{} {
+		var out map[string]interface{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &out))
+		return out
+	}
+
+	w := do("POST", "/api/v2/tasks", `{"name":"downsample","query":"SELECT mean(value) FROM cpu WHERE time >= :start: AND time < :end: GROUP BY time(1h), host","database":"raw","destination":"hourly","cron":"@hourly","maxRetries":1}`)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	created := decode(w)
+	id := created["id"].(string)
+	assert.Equal(t, "active", created["status"])
+	assert.Equal(t, "@hourly", created["cron"])
+	assert.Equal(t, "/api/v2/tasks/"+id+"/runs", created["links"].(map[string]interface{})["runs"])
+
+	for _, body := range []string{
+		`{"name":"bad","query":"DROP DATABASE raw","database":"raw","destination":"hourly","every":"1h"}`,
+		`{"name":"bad","query":"SELECT 1","database":"raw","destination":"hourly"}`,
+		`{"name":"bad","query":"SELECT 1","database":"raw","destination":"hourly","every":"soon"}`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, do("POST", "/api/v2/tasks", body).Code, body)
+	}
+	assert.Equal(t, http.StatusNotFound, do("POST", "/api/v2/tasks", `{"name":"x","orgID":"missing","query":"SELECT 1","database":"raw","destination":"hourly","every":"1h"}`).Code)
+
+	// Switching to every clears the cron schedule
+	w = do("PATCH", "/api/v2/tasks/"+id, `{"every":"1h","status":"inactive"}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	updated := decode(w)
+	assert.Equal(t, "1h0m0s", updated["every"])
+	assert.Nil(t, updated["cron"])
+	assert.Equal(t, http.StatusBadRequest, do("PATCH", "/api/v2/tasks/"+id, `{"status":"paused"}`).Code)
+	assert.Equal(t, http.StatusNotFound, do("PATCH", "/api/v2/tasks/missing", `{}`).Code)
+
+	var list struct {
+		Tasks []map[string]interface{} `json:"tasks"`
+	}
+	assert.NoError(t, json.Unmarshal(do("GET", "/api/v2/tasks?status=inactive", "").Body.Bytes(), &list))
+	assert.Len(t, list.Tasks, 1)
+	assert.NoError(t, json.Unmarshal(do("GET", "/api/v2/tasks?name=other", "").Body.Bytes(), &list))
+	assert.Len(t, list.Tasks, 0)
+
+	// Manual runs cover the time since the latest completed run
+	assert.NoError(t, db.SetTaskCompleted(id, hour))
+	w = do("POST", "/api/v2/tasks/"+id+"/runs", "")
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	run := decode(w)
+	assert.Equal(t, "success", run["status"])
+	assert.Equal(t, 1.0, run["pointsWritten"])
+	runID := run["id"].(string)
+
+	// The downsampled point holds the mean of the hour
+	w = doRequest(t, srv, "GET", "/query?db=hourly&epoch=ns&q="+url.QueryEscape("SELECT mean FROM cpu"), "")
+	values := decodeValues(t, w.Body)
+	if assert.Len(t, values, 1) {
+		assert.Equal(t, json.Number(fmt.Sprint(hour.UnixNano())), values[0][0])
+		assert.Equal(t, json.Number("3"), values[0][1])
+	}
+
+	w = do("POST", "/api/v2/tasks/"+id+"/runs/"+runID+"/retry", "")
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	retry := decode(w)
+	assert.Equal(t, run["rangeStart"], retry["rangeStart"])
+	assert.Equal(t, run["scheduledFor"], retry["scheduledFor"])
+
+	var runs struct {
+		Runs []map[string]interface{} `json:"runs"`
+	}
+	assert.NoError(t, json.Unmarshal(do("GET", "/api/v2/tasks/"+id+"/runs", "").Body.Bytes(), &runs))
+	assert.Len(t, runs.Runs, 2)
+	assert.Equal(t, http.StatusOK, do("GET", "/api/v2/tasks/"+id+"/runs/"+runID, "").Code)
+	assert.Equal(t, http.StatusNotFound, do("GET", "/api/v2/tasks/"+id+"/runs/missing", "").Code)
+	assert.Equal(t, "success", decode(do("GET", "/api/v2/tasks/"+id, ""))["lastRunStatus"])
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/api/v2/tasks/"+id, "").Code)
+	assert.Equal(t, http.StatusNotFound, do("GET", "/api/v2/tasks/"+id, "").Code)
+	assert.Equal(t, http.StatusNotFound, do("GET", "/api/v2/tasks/"+id+"/runs", "").Code)
+}
+
+func TestParseRangeTime(t *testing.T) {
+	now := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value    string
+		expected time.Time
+	}{
+		{"now()", now},
+		{"-1h", now.Add(-time.Hour)},
+		{"-1h30m", now.Add(-90 * time.Minute)},
+		{"-500ms", now.Add(-500 * time.Millisecond)},
+		{"-10ns", now.Add(-10)},
+		{"-2d", now.AddDate(0, 0, -2)},
+		{"-1w", now.AddDate(0, 0, -7)},
+		{"-1mo", now.AddDate(0, -1, 0)},
+		{"-1y2mo", now.AddDate(-1, -2, 0)},
+		{"15m", now.Add(15 * time.Minute)},
+		{"2024-03-30T00:00:00Z", time.Date(2024, 3, 30, 0, 0, 0, 0, time.UTC)},
+		{"2024-03-30T00:00:00.5+02:00", time.Date(2024, 3, 29, 22, 0, 0, 5e8, time.UTC)},
+		{"1556813561098000000", time.Unix(0, 1556813561098000000)},
+	}
+	for _, tt := range tests {
+		ns, err := parseRangeTime(tt.value, now, 0)
+		if assert.NoError(t, err, tt.value) {
+			assert.Equal(t, tt.expected.UnixNano(), ns, tt.value)
+		}
+	}
+
+	ns, err := parseRangeTime("", now, 42)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(42), ns)
+
+	// Durations reaching past the nanosecond timestamps fail instead of wrapping
+	for _, value := range []string{"-", "-h", "-1x", "-1h-", "yesterday", "2024-03-30", "-400y", "400y"} {
+		_, err := parseRangeTime(value, now, 0)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestV2QueryRelativeRange(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	now := time.Now()
+	lines := fmt.Sprintf("cpu value=1 %d\ncpu value=2 %d\n", now.Add(-3*time.Hour).UnixNano(), now.Add(-30*time.Minute).UnixNano())
+	w := doRequest(t, srv, "POST", "/api/v2/write?org=o&bucket=mydb", lines)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	query := func(params string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, "GET", "/api/v2/query?org=o&bucket=mydb&measurement=cpu&"+params, "")
+	}
+
+	w = query("start=-1h&end=now()")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, decodeValues(t, w.Body), 1)
+
+	w = query("start=-4h&stop=-1h")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, decodeValues(t, w.Body), 1)
+
+	w = query("start=" + now.Add(-4*time.Hour).UTC().Format(time.RFC3339))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, decodeValues(t, w.Body), 2)
+
+	assert.Equal(t, http.StatusBadRequest, query("start=-1x").Code)
+	assert.Equal(t, http.StatusBadRequest, query("start=-1h&end=-2h").Code)
+}
+
+func TestV2QueryPages(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	var lines strings.Builder
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(&lines, "cpu,host=a value=%d %d\ncpu,host=b value=%d %d\n", i, i, 10+i, i)
+	}
+	w := doRequest(t, srv, "POST", "/api/v2/write?org=o&bucket=mydb", lines.String())
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	query := func(params string) *httptest.ResponseRecorder {
+		return doRequest(t, srv, "GET", "/api/v2/query?org=o&bucket=mydb&measurement=cpu&start=0&end=10&"+params, "")
+	}
+
+	var pages [][][]interface{}
+	params := "limit=4"
+	for len(pages) < 10 {
+		w := query(params)
+		assert.Equal(t, http.StatusOK, w.Code)
+		pages = append(pages, decodeValues(t, w.Body))
+		next := w.Header().Get("X-Refluxdb-Next-Cursor")
+		if next == "" {
+			break
+		}
+		params = "limit=4&cursor=" + next
+	}
+	if assert.Len(t, pages, 3) {
+		assert.Len(t, pages[0], 4)
+		assert.Len(t, pages[1], 4)
+		assert.Len(t, pages[2], 2)
+		// host a comes before host b at each timestamp
+		assert.Equal(t, json.Number("1"), pages[0][0][1])
+		assert.Equal(t, json.Number("11"), pages[0][1][1])
+		assert.Equal(t, json.Number("15"), pages[2][1][1])
+	}
+
+	assert.Equal(t, http.StatusBadRequest, query("limit=0").Code)
+	assert.Equal(t, http.StatusBadRequest, query("limit=x").Code)
+	assert.Equal(t, http.StatusBadRequest, query("cursor=!!").Code)
+	assert.Equal(t, http.StatusBadRequest, query("cursor=e30").Code)
+}
+
+func TestV2QueryWhere(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	var lines strings.Builder
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(&lines, "cpu,host=a value=%d %d\ncpu,host=b value=%d %d\n", i, i, 10+i, i)
+	}
+	w := doRequest(t, srv, "POST", "/api/v2/write?org=o&bucket=mydb", lines.String())
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	values := func(params string) []string {
+		w := doRequest(t, srv, "GET", "/api/v2/query?org=o&bucket=mydb&measurement=cpu&start=0&end=10&"+params, "")
+		assert.Equal(t, http.StatusOK, w.Code, params)
+		var got []string
+		for _, row := range decodeValues(t, w.Body) {
+			got = append(got, fmt.Sprint(row[1]))
+		}
+		return got
+	}
+	where := func(cond string) string { return "where=" + url.QueryEscape(cond) }
+
+	assert.Equal(t, []string{"13", "14", "15"}, values(where(`host = 'b' AND value > 12`)))
+	assert.Equal(t, []string{"1", "2", "15"}, values(where(`(host = 'a' AND time <= 2) OR value = 15`)))
+	// Conditions on time narrow start and end
+	assert.Equal(t, []string{"4", "14", "5", "15"}, values(where(`time >= 4`)))
+	assert.Empty(t, values(where(`time > 20`)))
+	// Pages are filtered after being cut
+	assert.Equal(t, []string{"1", "2"}, values("limit=4&"+where(`host = 'a'`)))
+
+	w = doRequest(t, srv, "GET", "/api/v2/query?org=o&bucket=mydb&measurement=cpu&"+where(`host = 'a' OR`), "")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid where condition")
+}
+
+// BenchmarkAggregate measures GROUP BY time() queries through the v1 API
+// over a day of 10s samples from 10 hosts
+func BenchmarkAggregate(b *testing.B) {
+	db, err := persistence.New(":memory:")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	srv := NewWithOptions(":8087", db, Options{Logger: logger})
+
+	base := time.Date(2025, 3, 19, 0, 0, 0, 0, time.UTC)
+	for h := 0; h < 10; h++ {
+		points := make([]persistence.Point, 8640)
+		for i := range points {
+			points[i] = persistence.Point{
+				Database:    "mydb",
+				Measurement: "cpu",
+				Tags:        map[string]string{"host": fmt.Sprintf("host%d", h)},
+				Fields:      map[string]float64{"usage": float64(i%100) / 4},
+				Timestamp:   base.Add(time.Duration(i) * 10 * time.Second).UnixNano(),
+			}
+		}
+		if err := db.SaveBatch(points); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, q := range []struct{ name, query string }{
+		{"Mean-1h", `SELECT mean(usage) FROM cpu WHERE time >= '2025-03-19T00:00:00Z' AND time < '2025-03-20T00:00:00Z' GROUP BY time(1h)`},
+		{"Max-1m-Host", `SELECT max(usage) FROM cpu WHERE host = 'host3' AND time >= '2025-03-19T00:00:00Z' AND time < '2025-03-20T00:00:00Z' GROUP BY time(1m)`},
+	} {
+		b.Run(q.name, func(b *testing.B) {
+			target := "/query?db=mydb&epoch=s&q=" + url.QueryEscape(q.query)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				w := doRequest(b, srv, "GET", target, "")
+				if w.Code != http.StatusOK {
+					b.Fatalf("%d: %s", w.Code, w.Body)
+				}
+			}
+		})
+	}
 }
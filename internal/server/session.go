@@ -0,0 +1,130 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// sessionHeader carries the session ID of v1 query clients that do not
+	// keep cookies
+	sessionHeader = "X-Refluxdb-Session"
+	// sessionCookie carries the session ID of v1 query clients keeping
+	// cookies
+	sessionCookie = "refluxdb_session"
+	// sessionTTL is how long an idle session is kept
+	sessionTTL = time.Hour
+	// maxSessions bounds the number of sessions kept in memory
+	maxSessions = 10000
+)
+
+// session is the state kept for a v1 query client between requests
+type session struct {
+	database string
+	lastUsed time.Time
+}
+
+// sessionStore holds the database selected with USE by each client, so
+// later statements without a db parameter run against it
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*session
+	now      func() time.Time
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{
+		sessions: make(map[string]*session),
+		now:      time.Now,
+	}
+}
+
+// database returns the database selected by session id, and false when
+// the session does not exist or expired
+func (st *sessionStore) database(id string) (string, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	sess, ok := st.sessions[id]
+	if !ok {
+		return "", false
+	}
+	now := st.now()
+	if now.Sub(sess.lastUsed) > sessionTTL {
+		delete(st.sessions, id)
+		return "", false
+	}
+	sess.lastUsed = now
+	return sess.database, true
+}
+
+// use selects database for session id, evicting expired sessions, then
+// the least recently used one, when the store is full
+func (st *sessionStore) use(id, database string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := st.now()
+	if _, ok := st.sessions[id]; !ok && len(st.sessions) >= maxSessions {
+		var oldest string
+		for sid, sess := range st.sessions {
+			if now.Sub(sess.lastUsed) > sessionTTL {
+				delete(st.sessions, sid)
+				continue
+			}
+			if oldest == "" || sess.lastUsed.Before(st.sessions[oldest].lastUsed) {
+				oldest = sid
+			}
+		}
+		if len(st.sessions) >= maxSessions {
+			delete(st.sessions, oldest)
+		}
+	}
+	st.sessions[id] = &session{database: database, lastUsed: now}
+}
+
+// sessionID returns the session ID sent by the client, from the session
+// header or cookie
+func sessionID(c *gin.Context) string {
+	if id := c.GetHeader(sessionHeader); id != "" {
+		return id
+	}
+	id, _ := c.Cookie(sessionCookie)
+	return id
+}
+
+// useDatabase remembers database as the session database of the client,
+// starting a session when it has none, and returns the session ID in the
+// session header and cookie
+func (s *Server) useDatabase(c *gin.Context, database string) {
+	id := sessionID(c)
+	if id == "" {
+		id = newRequestID()
+	}
+	s.sessions.use(id, database)
+	c.Header(sessionHeader, id)
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(sessionTTL / time.Second),
+		HttpOnly: true,
+	})
+}
+
+// queryDatabase returns the database of a v1 query: the db parameter, or
+// the database selected with USE in the client session
+func (s *Server) queryDatabase(c *gin.Context) string {
+	if db := formValue(c, "db"); db != "" {
+		return db
+	}
+	if id := sessionID(c); id != "" {
+		if db, ok := s.sessions.database(id); ok {
+			return db
+		}
+	}
+	return ""
+}
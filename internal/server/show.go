@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/result"
+)
+
+// showClauses extracts the database of an ON clause and the measurement of
+// a FROM clause from a SHOW statement, unquoting them
+func showClauses(query string) (on, from string) {
+	parts := strings.Fields(query)
+	for i := 0; i+1 < len(parts); i++ {
+		switch strings.ToLower(parts[i]) {
+		case "on":
+			on = unquoteIdent(parts[i+1])
+		case "from":
+			from = unquoteIdent(parts[i+1])
+		}
+	}
+	return on, from
+}
+
+// showLimit returns the LIMIT of a SHOW statement, or zero when there is
+// none
+func showLimit(query string) (int, error) {
+	parts := strings.Fields(query)
+	for i := 0; i+1 < len(parts); i++ {
+		if strings.EqualFold(parts[i], "limit") {
+			n, err := strconv.Atoi(strings.TrimSuffix(parts[i+1], ";"))
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("invalid LIMIT %q", parts[i+1])
+			}
+			return n, nil
+		}
+	}
+	return 0, nil
+}
+
+// unquoteIdent strips the double quotes and trailing semicolon of an
+// InfluxQL identifier
+func unquoteIdent(ident string) string {
+	return strings.Trim(strings.TrimSuffix(ident, ";"), `"`)
+}
+
+// showDatabase returns the database of a SHOW statement: the ON clause,
+// the db parameter or the session database
+func (s *Server) showDatabase(c *gin.Context, query string) (string, bool) {
+	db, _ := showClauses(query)
+	if db == "" {
+		db = s.queryDatabase(c)
+	}
+	if db == "" {
+		s.logger(c).Error("Missing database parameter")
+		writeError(c, http.StatusBadRequest, "database is required")
+		return "", false
+	}
+	return db, s.authorize(c, persistence.ScopeRead, db) && s.requireDatabase(c, db)
+}
+
+// handleShowMeasurements answers SHOW MEASUREMENTS [ON db] [LIMIT n], the
+// statement Grafana runs to test an InfluxQL data source
+func (s *Server) handleShowMeasurements(c *gin.Context, query string) {
+	db, ok := s.showDatabase(c, query)
+	if !ok {
+		return
+	}
+	limit, err := showLimit(query)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	store, release, ok := s.storageFor(c, db)
+	if !ok {
+		return
+	}
+	defer release()
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+	measurements, err := store.ListTimeseriesContext(ctx, db)
+	if s.queryAborted(c, ctx, err) {
+		return
+	}
+	if err != nil {
+		s.logger(c).Errorf("Failed to list measurements: %v", err)
+		writeError(c, storageStatus(err), fmt.Sprintf("failed to list measurements: %v", err))
+		return
+	}
+	if limit > 0 && len(measurements) > limit {
+		measurements = measurements[:limit]
+	}
+
+	series := result.NewSeries("measurements", result.Column{Name: "name", Type: result.String})
+	for _, m := range measurements {
+		series.Append(m)
+	}
+	s.writeResult(c, http.StatusOK, result.New(series), result.Options{})
+}
+
+// handleShowSeries answers SHOW SERIES [ON db] [FROM measurement] with the
+// keys of the series holding points
+func (s *Server) handleShowSeries(c *gin.Context, query string) {
+	db, ok := s.showDatabase(c, query)
+	if !ok {
+		return
+	}
+	_, measurement := showClauses(query)
+
+	store, release, ok := s.storageFor(c, db)
+	if !ok {
+		return
+	}
+	defer release()
+	ctx, cancel := s.queryContext(c)
+	defer cancel()
+	keys, err := store.ListSeries(ctx, db, measurement)
+	if s.queryAborted(c, ctx, err) {
+		return
+	}
+	if err != nil {
+		s.logger(c).Errorf("Failed to list series: %v", err)
+		writeError(c, storageStatus(err), fmt.Sprintf("failed to list series: %v", err))
+		return
+	}
+
+	series := result.NewSeries("", result.Column{Name: "key", Type: result.String})
+	for _, key := range keys {
+		series.Append(key)
+	}
+	s.writeResult(c, http.StatusOK, result.New(series), result.Options{})
+}
+
+// handleShowRetentionPolicies answers SHOW RETENTION POLICIES [ON db].
+// Every database has a single default policy, autogen, whose duration is
+// the retention period of the database.
+func (s *Server) handleShowRetentionPolicies(c *gin.Context, query string) {
+	db, ok := s.showDatabase(c, query)
+	if !ok {
+		return
+	}
+	d, err := s.db.GetDatabase(db)
+	if err != nil {
+		s.logger(c).Errorf("Failed to look up database: %v", err)
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+
+	series := result.NewSeries("",
+		result.Column{Name: "name", Type: result.String},
+		result.Column{Name: "duration", Type: result.String},
+		result.Column{Name: "shardGroupDuration", Type: result.String},
+		result.Column{Name: "replicaN", Type: result.Integer},
+		result.Column{Name: "default", Type: result.Boolean},
+	)
+	series.Append("autogen", d.RetentionPeriod.String(), s.db.ShardDuration().String(), int64(1), true)
+	s.writeResult(c, http.StatusOK, result.New(series), result.Options{})
+}
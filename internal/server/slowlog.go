@@ -0,0 +1,313 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	"github.com/gleicon/go-refluxdb/internal/result"
+	"github.com/gleicon/go-refluxdb/internal/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+var slowQueries = metrics.NewCounterVec("refluxdb_slow_queries_total", "Queries that ran longer than the slow query threshold", "api")
+
+const (
+	// queryTraceKey stores the trace of a query in the gin context
+	queryTraceKey = "refluxdb.query"
+	// defaultSlowQueryBuffer is the number of slow queries kept for
+	// /debug/queries when the size is not set
+	defaultSlowQueryBuffer = 100
+)
+
+// hiddenParams are the request parameters left out of the slow query log
+// because they carry credentials
+var hiddenParams = map[string]bool{"p": true, "u": true, "token": true}
+
+// queryStatement is the parsed form of a SELECT query
+type queryStatement struct {
+	Measurement string `json:"measurement"`
+	Field       string `json:"field,omitempty"`
+	Aggregation string `json:"aggregation,omitempty"`
+	Start       int64  `json:"start"`
+	End         int64  `json:"end"`
+}
+
+// queryTiming breaks the duration of a query down, in milliseconds: the
+// wait for an execution slot, the parsing, the storage reads and
+// aggregation, and the encoding of the response
+type queryTiming struct {
+	Total   float64 `json:"totalMs"`
+	Queue   float64 `json:"queueMs"`
+	Parse   float64 `json:"parseMs"`
+	Execute float64 `json:"executeMs"`
+	Encode  float64 `json:"encodeMs"`
+}
+
+// slowQuery is a query that ran longer than the slow query threshold
+type slowQuery struct {
+	Time      time.Time         `json:"time"`
+	RequestID string            `json:"requestId,omitempty"`
+	TraceID   string            `json:"traceId,omitempty"`
+	SpanID    string            `json:"spanId,omitempty"`
+	UserAgent string            `json:"userAgent,omitempty"`
+	API       string            `json:"api"`
+	Database  string            `json:"database,omitempty"`
+	Query     string            `json:"query,omitempty"`
+	Statement *queryStatement   `json:"statement,omitempty"`
+	Params    map[string]string `json:"params,omitempty"`
+	Status    int               `json:"status"`
+	Rows      int               `json:"rows"`
+	Timing    queryTiming       `json:"timing"`
+}
+
+// queryTrace follows a query through its phases. The handlers record what
+// they learn about the query; a nil trace ignores it.
+type queryTrace struct {
+	query     slowQuery
+	start     time.Time
+	admitted  time.Time
+	executing time.Time
+	encoding  time.Time
+	encoded   time.Time
+}
+
+// traceOf returns the trace of the query served by c, or nil
+func traceOf(c *gin.Context) *queryTrace {
+	if t, ok := c.Get(queryTraceKey); ok {
+		return t.(*queryTrace)
+	}
+	return nil
+}
+
+// admit marks the end of the wait for an execution slot
+func (t *queryTrace) admit() {
+	if t != nil {
+		t.admitted = time.Now()
+	}
+}
+
+// setQuery records the text of the query
+func (t *queryTrace) setQuery(database, query string) {
+	if t != nil {
+		t.query.Database, t.query.Query = database, query
+	}
+}
+
+// execute records the parsed query and marks the start of its execution
+func (t *queryTrace) execute(database string, stmt queryStatement) {
+	if t != nil {
+		t.query.Database, t.query.Statement = database, &stmt
+		t.executing = time.Now()
+	}
+}
+
+// encode marks the start of the encoding of resp
+func (t *queryTrace) encode(resp *result.Response) {
+	if t == nil {
+		return
+	}
+	t.encoding = time.Now()
+	for _, r := range resp.Results {
+		for _, s := range r.Series {
+			t.query.Rows += len(s.Rows)
+		}
+	}
+}
+
+// encodeDone marks the end of the encoding
+func (t *queryTrace) encodeDone() {
+	if t != nil {
+		t.encoded = time.Now()
+	}
+}
+
+// finish completes the timing of the query, ended now, and returns its
+// duration. Phases a handler did not mark are accounted to the previous
+// one.
+func (t *queryTrace) finish() time.Duration {
+	end := time.Now()
+	t.admitted, t.executing, t.encoding, t.encoded = t.phases(end)
+
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	t.query.Timing = queryTiming{
+		Total:   ms(end.Sub(t.start)),
+		Queue:   ms(t.admitted.Sub(t.start)),
+		Parse:   ms(t.executing.Sub(t.admitted)),
+		Execute: ms(t.encoding.Sub(t.executing)),
+		Encode:  ms(t.encoded.Sub(t.encoding)),
+	}
+	return end.Sub(t.start)
+}
+
+// phases returns the marks of a query that ended at end, filling in the
+// ones a handler did not set
+func (t *queryTrace) phases(end time.Time) (admitted, executing, encoding, encoded time.Time) {
+	admitted = t.admitted
+	if admitted.IsZero() {
+		admitted = t.start
+	}
+	executing = t.executing
+	if executing.IsZero() {
+		executing = admitted
+	}
+	encoding, encoded = t.encoding, t.encoded
+	if encoding.IsZero() {
+		encoding, encoded = end, end
+	} else if encoded.IsZero() {
+		encoded = end
+	}
+	return admitted, executing, encoding, encoded
+}
+
+// record adds the phases of a finished query to the span carried by ctx,
+// along with the query and the rows it returned
+func (t *queryTrace) record(ctx context.Context) {
+	span := tracing.FromContext(ctx)
+	if span == nil {
+		return
+	}
+	if t.query.Database != "" {
+		span.SetAttribute("db.namespace", t.query.Database)
+	}
+	if t.query.Query != "" {
+		span.SetAttribute("db.query.text", t.query.Query)
+	}
+	span.SetAttribute("db.response.returned_rows", t.query.Rows)
+	tracing.Record(ctx, "query.queue", t.start, t.admitted)
+	tracing.Record(ctx, "query.parse", t.admitted, t.executing)
+	tracing.Record(ctx, "query.execute", t.executing, t.encoding)
+	tracing.Record(ctx, "query.encode", t.encoding, t.encoded)
+}
+
+// slowQueryLog keeps the latest slow queries in a ring buffer
+type slowQueryLog struct {
+	threshold time.Duration
+	log       *logrus.Logger
+
+	mu      sync.Mutex
+	entries []slowQuery
+	next    int
+	full    bool
+}
+
+// newSlowQueryLog returns a log of the queries running longer than
+// threshold, or nil when threshold is zero
+func newSlowQueryLog(threshold time.Duration, size int, logger *logrus.Logger) *slowQueryLog {
+	if threshold <= 0 {
+		return nil
+	}
+	if size <= 0 {
+		size = defaultSlowQueryBuffer
+	}
+	return &slowQueryLog{threshold: threshold, log: logger, entries: make([]slowQuery, size)}
+}
+
+func (l *slowQueryLog) add(q slowQuery) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = q
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// list returns the slow queries kept, newest first
+func (l *slowQueryLog) list() []slowQuery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.entries)
+	}
+	queries := make([]slowQuery, 0, n)
+	for i := 1; i <= n; i++ {
+		queries = append(queries, l.entries[(l.next-i+len(l.entries))%len(l.entries)])
+	}
+	return queries
+}
+
+// traceQueries times the queries served by the handlers that follow,
+// records their phases as spans when the request is traced, and records
+// the ones running longer than the slow query threshold, both to the slow
+// query log and to the buffer served by /debug/queries
+func (s *Server) traceQueries(api string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.slowQueries == nil && s.tracer == nil {
+			c.Next()
+			return
+		}
+
+		t := &queryTrace{start: time.Now()}
+		t.query.API = api
+		c.Set(queryTraceKey, t)
+		c.Next()
+
+		d := t.finish()
+		t.record(c.Request.Context())
+		if s.slowQueries == nil || d < s.slowQueries.threshold {
+			return
+		}
+		q := t.query
+		q.Time = t.start.UTC()
+		q.RequestID = c.Writer.Header().Get(requestIDHeader)
+		if trace, ok := traceOfRequest(c); ok {
+			q.TraceID, q.SpanID = trace.TraceID, trace.SpanID
+		}
+		q.UserAgent = c.Request.UserAgent()
+		q.Status = c.Writer.Status()
+		for name, values := range c.Request.URL.Query() {
+			if hiddenParams[name] || len(values) == 0 {
+				continue
+			}
+			if q.Params == nil {
+				q.Params = make(map[string]string)
+			}
+			q.Params[name] = values[0]
+		}
+
+		slowQueries.With(api).Inc()
+		s.slowQueries.add(q)
+		entry := s.slowQueries.log.WithFields(logrus.Fields{
+			"request_id": q.RequestID,
+			"api":        q.API,
+			"database":   q.Database,
+			"query":      q.Query,
+			"params":     q.Params,
+			"status":     q.Status,
+			"rows":       q.Rows,
+			"total_ms":   q.Timing.Total,
+			"queue_ms":   q.Timing.Queue,
+			"parse_ms":   q.Timing.Parse,
+			"execute_ms": q.Timing.Execute,
+			"encode_ms":  q.Timing.Encode,
+		})
+		if q.Statement != nil {
+			entry = entry.WithField("statement", *q.Statement)
+		}
+		if q.TraceID != "" {
+			entry = entry.WithFields(logrus.Fields{"trace_id": q.TraceID, "span_id": q.SpanID})
+		}
+		if q.UserAgent != "" {
+			entry = entry.WithField("user_agent", q.UserAgent)
+		}
+		entry.Warn("slow query")
+	}
+}
+
+// handleSlowQueries answers GET /debug/queries with the latest queries
+// that ran longer than the slow query threshold, newest first
+func (s *Server) handleSlowQueries(c *gin.Context) {
+	if s.slowQueries == nil {
+		c.JSON(http.StatusOK, gin.H{"thresholdMs": 0, "queries": []slowQuery{}})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"thresholdMs": float64(s.slowQueries.threshold.Microseconds()) / 1000,
+		"queries":     s.slowQueries.list(),
+	})
+}
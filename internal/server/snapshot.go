@@ -0,0 +1,36 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleSnapshot answers GET /api/v2/snapshot with a consistent copy of the
+// database file, taken while writes go on. The copy is written to the
+// temporary directory, then streamed and removed.
+func (s *Server) handleSnapshot(c *gin.Context) {
+	dir, err := os.MkdirTemp("", "refluxdb-snapshot-")
+	if err != nil {
+		writeError(c, http.StatusInternalServerError, fmt.Sprintf("failed to create snapshot: %v", err))
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	snapshot, err := s.db.Snapshot(c.Request.Context(), filepath.Join(dir, "snapshot.db"))
+	if err != nil {
+		s.logger(c).Errorf("Failed to snapshot storage: %v", err)
+		writeError(c, storageStatus(err), fmt.Sprintf("failed to create snapshot: %v", err))
+		return
+	}
+	s.audit(c, "storage.snapshot", "storage", fmt.Sprintf("%d bytes", snapshot.Size))
+	s.logger(c).Infof("Snapshot of %d bytes taken in %s", snapshot.Size, snapshot.Duration.Round(time.Millisecond))
+
+	name := fmt.Sprintf("refluxdb-%s.db", time.Now().UTC().Format("20060102T150405Z"))
+	c.Header("Content-Type", "application/vnd.sqlite3")
+	c.FileAttachment(snapshot.Path, name)
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// source is one measurement of a FROM clause: a name, or a regular
+// expression matching the names of the measurements of the database
+type source struct {
+	name  string
+	regex *regexp.Regexp
+}
+
+// parseFrom returns the measurements of the FROM clause of a SELECT
+// statement, as in FROM "cpu", mem, /^disk_.*/. Names keep their case, and
+// a name qualified with a database and retention policy such as
+// "db"."autogen"."cpu" is reduced to the measurement.
+func parseFrom(query string) ([]source, error) {
+	rest, ok := afterKeyword(query, "from")
+	if !ok {
+		return nil, fmt.Errorf("missing FROM clause")
+	}
+
+	var sources []source
+	for {
+		rest = strings.TrimLeft(rest, " \t\r\n")
+		var src source
+		var err error
+		if strings.HasPrefix(rest, "/") {
+			var expr string
+			expr, rest, err = scanRegex(rest)
+			if err == nil {
+				src.regex, err = regexp.Compile(expr)
+			}
+		} else {
+			src.name, rest, err = scanMeasurement(rest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, src)
+
+		rest = strings.TrimLeft(rest, " \t\r\n")
+		if !strings.HasPrefix(rest, ",") {
+			return sources, nil
+		}
+		rest = rest[1:]
+	}
+}
+
+// afterKeyword returns what follows the first occurrence of keyword in
+// query as a word outside of quotes, matched without regard to case
+func afterKeyword(query, keyword string) (string, bool) {
+	i := indexUnquoted(query, keyword, true)
+	if i == -1 {
+		return "", false
+	}
+	return query[i+len(keyword):], true
+}
+
+// indexUnquoted returns the index of the first occurrence of pattern in
+// query outside of quotes, matched without regard to case, or -1. A
+// keyword is matched as a word between spaces; other patterns, such as
+// "tz(", must not follow a letter, digit or underscore.
+func indexUnquoted(query, pattern string, keyword bool) int {
+	quote := byte(0)
+	for i := 0; i < len(query); i++ {
+		switch b := query[i]; {
+		case quote != 0:
+			if b == '\\' {
+				i++
+			} else if b == quote {
+				quote = 0
+			}
+		case b == '"' || b == '\'':
+			quote = b
+		case len(query)-i >= len(pattern) && strings.EqualFold(query[i:i+len(pattern)], pattern):
+			end := i + len(pattern)
+			if keyword && (i == 0 || isSpace(query[i-1])) && (end == len(query) || isSpace(query[end])) {
+				return i
+			}
+			if !keyword && (i == 0 || !isIdentChar(query[i-1])) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// scanMeasurement reads a possibly quoted and qualified measurement name
+// at the start of s and returns its last part and what follows
+func scanMeasurement(s string) (string, string, error) {
+	parts, rest, err := scanQualified(s)
+	if err != nil {
+		return "", "", fmt.Errorf("%w in FROM clause", err)
+	}
+	name := parts[len(parts)-1]
+	if name == "" {
+		return "", "", fmt.Errorf("missing measurement in FROM clause")
+	}
+	return name, rest, nil
+}
+
+// scanQualified reads a name of possibly quoted parts separated by dots,
+// such as "db"."rp"."cpu" or db..cpu, at the start of s and returns its
+// parts and what follows
+func scanQualified(s string) ([]string, string, error) {
+	var parts []string
+	for {
+		var part string
+		if strings.HasPrefix(s, `"`) {
+			end := 1
+			var b strings.Builder
+			for ; end < len(s) && s[end] != '"'; end++ {
+				if s[end] == '\\' && end+1 < len(s) {
+					end++
+				}
+				b.WriteByte(s[end])
+			}
+			if end == len(s) {
+				return nil, "", fmt.Errorf("unterminated quoted measurement")
+			}
+			part, s = b.String(), s[end+1:]
+		} else {
+			end := 0
+			for end < len(s) && !isSpace(s[end]) && !strings.ContainsRune(",;.()", rune(s[end])) {
+				end++
+			}
+			// Clients escaping the quotes of a name send \"cpu\"
+			part, s = strings.Trim(s[:end], `\"`), s[end:]
+		}
+		parts = append(parts, part)
+		if !strings.HasPrefix(s, ".") {
+			return parts, s, nil
+		}
+		s = s[1:]
+	}
+}
+
+// scanRegex reads a regular expression between slashes at the start of
+// s, where \/ stands for a slash, and returns it and what follows
+func scanRegex(s string) (string, string, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == '/':
+			b.WriteByte('/')
+			i++
+		case s[i] == '/':
+			return b.String(), s[i+1:], nil
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", fmt.Errorf("unterminated regular expression in FROM clause")
+}
+
+func isSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+// resolveSources returns the measurements selected by sources, sorted and
+// without duplicates. Regular expressions are matched against the
+// measurements of db in store.
+func resolveSources(ctx context.Context, store *persistence.Manager, db string, sources []source) ([]string, error) {
+	seen := make(map[string]bool)
+	var measurements, all []string
+	for _, src := range sources {
+		if src.regex == nil {
+			if !seen[src.name] {
+				seen[src.name] = true
+				measurements = append(measurements, src.name)
+			}
+			continue
+		}
+		if all == nil {
+			var err error
+			if all, err = store.ListTimeseriesContext(ctx, db); err != nil {
+				return nil, err
+			}
+		}
+		for _, name := range all {
+			if !seen[name] && src.regex.MatchString(name) {
+				seen[name] = true
+				measurements = append(measurements, name)
+			}
+		}
+	}
+	sort.Strings(measurements)
+	return measurements, nil
+}
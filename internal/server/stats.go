@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// measurementStats is the API representation of the write statistics of
+// a measurement
+type measurementStats struct {
+	Bucket          string    `json:"bucket"`
+	Measurement     string    `json:"measurement"`
+	Points          uint64    `json:"points"`
+	Bytes           uint64    `json:"bytes"`
+	LastWrite       time.Time `json:"lastWrite"`
+	PointsPerSecond float64   `json:"pointsPerSecond"`
+	BytesPerSecond  float64   `json:"bytesPerSecond"`
+}
+
+// handleWriteStats answers GET /api/v2/stats with the write statistics of
+// the measurements of the buckets the token may read, optionally only
+// those of the bucket and measurement parameters. The statistics come from
+// counters kept by the write path, so they are cheap to poll.
+func (s *Server) handleWriteStats(c *gin.Context) {
+	bucket, measurement := c.Query("bucket"), c.Query("measurement")
+	stats := make([]measurementStats, 0)
+	for _, st := range s.db.WriteStats() {
+		if (bucket != "" && st.Database != bucket) || (measurement != "" && st.Measurement != measurement) || !s.allowed(c, persistence.ScopeRead, st.Database) {
+			continue
+		}
+		stats = append(stats, measurementStats{
+			Bucket:          st.Database,
+			Measurement:     st.Measurement,
+			Points:          st.Points,
+			Bytes:           st.Bytes,
+			LastWrite:       st.LastWrite,
+			PointsPerSecond: st.PointsPerSecond,
+			BytesPerSecond:  st.BytesPerSecond,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"links":        gin.H{"self": "/api/v2/stats"},
+		"measurements": stats,
+	})
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/result"
+	"github.com/gleicon/go-refluxdb/internal/subscriber"
+)
+
+// subscriptionTokens splits a subscription statement into words, keeping
+// quoted identifiers and strings whole and commas as their own tokens
+func subscriptionTokens(query string) ([]string, error) {
+	var tokens []string
+	query = strings.TrimSuffix(strings.TrimSpace(query), ";")
+	for i := 0; i < len(query); {
+		switch ch := query[i]; {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r':
+			i++
+		case ch == ',' || ch == '.':
+			tokens = append(tokens, string(ch))
+			i++
+		case ch == '"' || ch == '\'':
+			end := strings.IndexByte(query[i+1:], ch)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			tokens = append(tokens, query[i:i+end+2])
+			i += end + 2
+		default:
+			end := strings.IndexAny(query[i:], " \t\n\r,.")
+			if end < 0 {
+				end = len(query) - i
+			}
+			tokens = append(tokens, query[i:i+end])
+			i += end
+		}
+	}
+	return tokens, nil
+}
+
+// subscriptionTarget parses `name ON db[.rp]` at the start of tokens and
+// returns the remaining tokens
+func subscriptionTarget(tokens []string) (name, database string, rest []string, err error) {
+	if len(tokens) < 3 || !strings.EqualFold(tokens[1], "on") {
+		return "", "", nil, fmt.Errorf("expected <name> ON <database>")
+	}
+	name, database, rest = unquoteIdent(tokens[0]), unquoteIdent(tokens[2]), tokens[3:]
+	// The retention policy is accepted for compatibility, every database
+	// has a single one
+	if len(rest) >= 2 && rest[0] == "." {
+		if rp := unquoteIdent(rest[1]); rp != "autogen" {
+			return "", "", nil, fmt.Errorf("retention policy not found: %s", rp)
+		}
+		rest = rest[2:]
+	}
+	return name, database, rest, nil
+}
+
+// stringList parses a comma separated list of quoted items, such as
+// 'a', 'b', returning the remaining tokens
+func stringList(tokens []string, quote byte) (items, rest []string) {
+	for len(tokens) > 0 {
+		t := tokens[0]
+		if len(t) < 2 || t[0] != quote {
+			break
+		}
+		items = append(items, t[1:len(t)-1])
+		tokens = tokens[1:]
+		if len(tokens) == 0 || tokens[0] != "," {
+			break
+		}
+		tokens = tokens[1:]
+	}
+	return items, tokens
+}
+
+// parseCreateSubscription parses
+//
+//	CREATE SUBSCRIPTION "name" ON "db"."autogen" DESTINATIONS ALL|ANY 'url' [, 'url'] [MEASUREMENTS "m" [, "m"]]
+//
+// The MEASUREMENTS clause is a refluxdb extension restricting the
+// forwarded points
+func parseCreateSubscription(query string) (persistence.Subscription, error) {
+	tokens, err := subscriptionTokens(query)
+	if err != nil {
+		return persistence.Subscription{}, err
+	}
+	var sub persistence.Subscription
+	sub.Name, sub.Database, tokens, err = subscriptionTarget(tokens[2:])
+	if err != nil {
+		return persistence.Subscription{}, err
+	}
+	if len(tokens) < 3 || !strings.EqualFold(tokens[0], "destinations") {
+		return persistence.Subscription{}, fmt.Errorf("expected DESTINATIONS ALL|ANY")
+	}
+	sub.Mode = strings.ToUpper(tokens[1])
+	if sub.Mode != persistence.SubscriptionAll && sub.Mode != persistence.SubscriptionAny {
+		return persistence.Subscription{}, fmt.Errorf("invalid subscription mode %q: expected ALL or ANY", tokens[1])
+	}
+	sub.Destinations, tokens = stringList(tokens[2:], '\'')
+	if len(sub.Destinations) == 0 {
+		return persistence.Subscription{}, fmt.Errorf("expected at least one quoted destination")
+	}
+	for _, dest := range sub.Destinations {
+		if err := subscriber.CheckDestination(dest); err != nil {
+			return persistence.Subscription{}, err
+		}
+	}
+	if len(tokens) > 0 && strings.EqualFold(tokens[0], "measurements") {
+		sub.Measurements, tokens = stringList(tokens[1:], '"')
+		if len(sub.Measurements) == 0 {
+			return persistence.Subscription{}, fmt.Errorf("expected at least one quoted measurement")
+		}
+	}
+	if len(tokens) > 0 {
+		return persistence.Subscription{}, fmt.Errorf("unexpected %q", tokens[0])
+	}
+	return sub, nil
+}
+
+// handleCreateSubscription executes CREATE SUBSCRIPTION
+func (s *Server) handleCreateSubscription(c *gin.Context, query string) {
+	sub, err := parseCreateSubscription(query)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid CREATE SUBSCRIPTION syntax: %v", err))
+		return
+	}
+	if err := s.db.AddSubscription(sub); err != nil {
+		if errors.Is(err, persistence.ErrDatabaseNotFound) {
+			err = fmt.Errorf("database not found: %s", sub.Database)
+		} else if errors.Is(err, persistence.ErrSubscriptionExists) {
+			err = fmt.Errorf("subscription already exists")
+		}
+		s.writeResult(c, http.StatusOK, result.Error(err.Error()), result.Options{})
+		return
+	}
+	s.audit(c, "subscription.create", sub.Database+"."+sub.Name, sub.Mode+" "+strings.Join(sub.Destinations, ","))
+	s.reloadSubscriptions(c)
+	s.writeResult(c, http.StatusOK, result.New(), result.Options{})
+}
+
+// parseDropSubscription parses DROP SUBSCRIPTION "name" ON "db"."rp"
+func parseDropSubscription(query string) (name, database string, err error) {
+	tokens, err := subscriptionTokens(query)
+	if err != nil {
+		return "", "", err
+	}
+	name, database, tokens, err = subscriptionTarget(tokens[2:])
+	if err != nil {
+		return "", "", err
+	}
+	if len(tokens) > 0 {
+		return "", "", fmt.Errorf("unexpected %q", tokens[0])
+	}
+	return name, database, nil
+}
+
+// handleDropSubscription executes DROP SUBSCRIPTION
+func (s *Server) handleDropSubscription(c *gin.Context, query string) {
+	name, database, err := parseDropSubscription(query)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid DROP SUBSCRIPTION syntax: %v", err))
+		return
+	}
+	if err := s.db.DropSubscription(database, name); err != nil {
+		if errors.Is(err, persistence.ErrDatabaseNotFound) {
+			err = fmt.Errorf("database not found: %s", database)
+		} else if errors.Is(err, persistence.ErrSubscriptionNotFound) {
+			err = fmt.Errorf("subscription not found")
+		}
+		s.writeResult(c, http.StatusOK, result.Error(err.Error()), result.Options{})
+		return
+	}
+	s.audit(c, "subscription.drop", database+"."+name, "")
+	s.reloadSubscriptions(c)
+	s.writeResult(c, http.StatusOK, result.New(), result.Options{})
+}
+
+// handleShowSubscriptions lists the subscriptions with one series per
+// database, like InfluxDB
+func (s *Server) handleShowSubscriptions(c *gin.Context) {
+	subs, err := s.db.Subscriptions()
+	if err != nil {
+		s.logger(c).Errorf("Failed to list subscriptions: %v", err)
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+
+	var all []*result.Series
+	for _, sub := range subs {
+		if len(all) == 0 || all[len(all)-1].Name != sub.Database {
+			all = append(all, result.NewSeries(sub.Database,
+				result.Column{Name: "retention_policy", Type: result.String},
+				result.Column{Name: "name", Type: result.String},
+				result.Column{Name: "mode", Type: result.String},
+				result.Column{Name: "destinations", Type: result.String},
+				result.Column{Name: "measurements", Type: result.String},
+			))
+		}
+		measurements := sub.Measurements
+		if measurements == nil {
+			measurements = []string{}
+		}
+		all[len(all)-1].Append("autogen", sub.Name, sub.Mode, sub.Destinations, measurements)
+	}
+	s.writeResult(c, http.StatusOK, result.New(all...), result.Options{})
+}
+
+// reloadSubscriptions makes the subscriber apply a subscription change
+func (s *Server) reloadSubscriptions(c *gin.Context) {
+	if s.subscriber == nil {
+		return
+	}
+	if err := s.subscriber.Reload(); err != nil {
+		s.logger(c).Errorf("Failed to reload subscriptions: %v", err)
+	}
+}
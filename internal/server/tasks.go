@@ -0,0 +1,417 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/tasks"
+)
+
+// task is the v2 API representation of a scheduled query. The query is
+// InfluxQL rather than Flux, with database and destination naming the
+// source and destination buckets.
+type task struct {
+	ID              string            `json:"id"`
+	OrgID           string            `json:"orgID"`
+	Name            string            `json:"name"`
+	Description     string            `json:"description,omitempty"`
+	Status          string            `json:"status"`
+	Query           string            `json:"query"`
+	Database        string            `json:"database"`
+	Destination     string            `json:"destination"`
+	Every           string            `json:"every,omitempty"`
+	Cron            string            `json:"cron,omitempty"`
+	Offset          string            `json:"offset,omitempty"`
+	MaxRetries      int               `json:"maxRetries"`
+	LatestCompleted time.Time         `json:"latestCompleted"`
+	LastRunStatus   string            `json:"lastRunStatus,omitempty"`
+	LastRunError    string            `json:"lastRunError,omitempty"`
+	CreatedAt       time.Time         `json:"createdAt"`
+	UpdatedAt       time.Time         `json:"updatedAt"`
+	Links           map[string]string `json:"links"`
+}
+
+// taskRequest is the body of POST /api/v2/tasks and PATCH
+// /api/v2/tasks/:taskID. Absent fields are left unchanged by PATCH; every
+// and offset are durations such as "1h".
+type taskRequest struct {
+	OrgID       *string `json:"orgID"`
+	Org         *string `json:"org"`
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+	Status      *string `json:"status"`
+	Query       *string `json:"query"`
+	Database    *string `json:"database"`
+	Destination *string `json:"destination"`
+	Every       *string `json:"every"`
+	Cron        *string `json:"cron"`
+	Offset      *string `json:"offset"`
+	MaxRetries  *int    `json:"maxRetries"`
+}
+
+// run is the v2 API representation of a task run
+type run struct {
+	ID            string            `json:"id"`
+	TaskID        string            `json:"taskID"`
+	Status        string            `json:"status"`
+	RangeStart    time.Time         `json:"rangeStart"`
+	ScheduledFor  time.Time         `json:"scheduledFor"`
+	StartedAt     time.Time         `json:"startedAt"`
+	FinishedAt    time.Time         `json:"finishedAt"`
+	Attempts      int               `json:"attempts"`
+	PointsWritten int64             `json:"pointsWritten"`
+	Error         string            `json:"error,omitempty"`
+	Links         map[string]string `json:"links"`
+}
+
+func newTask(t persistence.Task, last *persistence.TaskRun) task {
+	self := "/api/v2/tasks/" + t.ID
+	out := task{
+		ID:              t.ID,
+		OrgID:           t.OrgID,
+		Name:            t.Name,
+		Description:     t.Description,
+		Status:          t.Status,
+		Query:           t.Query,
+		Database:        t.Database,
+		Destination:     t.Destination,
+		Cron:            t.Cron,
+		MaxRetries:      t.MaxRetries,
+		LatestCompleted: t.LatestCompleted,
+		CreatedAt:       t.CreatedAt,
+		UpdatedAt:       t.UpdatedAt,
+		Links: map[string]string{
+			"self": self,
+			"runs": self + "/runs",
+		},
+	}
+	if t.Every > 0 {
+		out.Every = t.Every.String()
+	}
+	if t.Offset > 0 {
+		out.Offset = t.Offset.String()
+	}
+	if last != nil {
+		out.LastRunStatus, out.LastRunError = last.Status, last.Error
+	}
+	return out
+}
+
+func newRun(r persistence.TaskRun) run {
+	return run{
+		ID:            r.ID,
+		TaskID:        r.TaskID,
+		Status:        r.Status,
+		RangeStart:    r.RangeStart,
+		ScheduledFor:  r.ScheduledFor,
+		StartedAt:     r.StartedAt,
+		FinishedAt:    r.FinishedAt,
+		Attempts:      r.Attempts,
+		PointsWritten: r.PointsWritten,
+		Error:         r.Error,
+		Links: map[string]string{
+			"self":  "/api/v2/tasks/" + r.TaskID + "/runs/" + r.ID,
+			"task":  "/api/v2/tasks/" + r.TaskID,
+			"retry": "/api/v2/tasks/" + r.TaskID + "/runs/" + r.ID + "/retry",
+		},
+	}
+}
+
+// apply copies the fields set in a request to t
+func (req taskRequest) apply(t *persistence.Task) error {
+	set := func(dst *string, src *string) {
+		if src != nil {
+			*dst = *src
+		}
+	}
+	set(&t.Name, req.Name)
+	set(&t.Description, req.Description)
+	set(&t.Status, req.Status)
+	set(&t.Query, req.Query)
+	set(&t.Database, req.Database)
+	set(&t.Destination, req.Destination)
+	set(&t.Cron, req.Cron)
+	if req.MaxRetries != nil {
+		t.MaxRetries = *req.MaxRetries
+	}
+
+	// Setting one of every and cron clears the other
+	if req.Every != nil {
+		t.Every = 0
+		if *req.Every != "" {
+			d, err := time.ParseDuration(*req.Every)
+			if err != nil {
+				return fmt.Errorf("invalid every: %w", err)
+			}
+			t.Every = d
+		}
+		if req.Cron == nil {
+			t.Cron = ""
+		}
+	} else if req.Cron != nil {
+		t.Every = 0
+	}
+	if req.Offset != nil {
+		t.Offset = 0
+		if *req.Offset != "" {
+			d, err := time.ParseDuration(*req.Offset)
+			if err != nil {
+				return fmt.Errorf("invalid offset: %w", err)
+			}
+			t.Offset = d
+		}
+	}
+	return nil
+}
+
+// lastRun returns the latest run of a task, or nil if it never ran
+func (s *Server) lastRun(taskID string) (*persistence.TaskRun, error) {
+	runs, err := s.db.TaskRuns(taskID, 1)
+	if err != nil || len(runs) == 0 {
+		return nil, err
+	}
+	return &runs[0], nil
+}
+
+// handleListTasks answers GET /api/v2/tasks, filtered by name, orgID, org
+// and status and paged with offset and limit
+func (s *Server) handleListTasks(c *gin.Context) {
+	offset, limit, err := parsePage(c)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	name, orgID, status := c.Query("name"), c.Query("orgID"), c.Query("status")
+	if orgName := c.Query("org"); orgName != "" {
+		org, err := s.db.GetOrganization(orgName)
+		if err != nil {
+			s.orgError(c, err)
+			return
+		}
+		orgID = org.ID
+	}
+
+	all, err := s.db.Tasks()
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+
+	var matched []persistence.Task
+	for _, t := range all {
+		if (name != "" && t.Name != name) || (orgID != "" && t.OrgID != orgID) || (status != "" && t.Status != status) {
+			continue
+		}
+		matched = append(matched, t)
+	}
+	result := make([]task, 0, len(matched))
+	for _, t := range page(matched, offset, limit) {
+		last, err := s.lastRun(t.ID)
+		if err != nil {
+			writeError(c, storageStatus(err), err.Error())
+			return
+		}
+		result = append(result, newTask(t, last))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"links": gin.H{"self": fmt.Sprintf("/api/v2/tasks?limit=%d&offset=%d", limit, offset)},
+		"tasks": result,
+	})
+}
+
+func (s *Server) handleCreateTask(c *gin.Context) {
+	var req taskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid task: %v", err))
+		return
+	}
+
+	t := persistence.Task{Status: persistence.TaskActive}
+	if err := req.apply(&t); err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	switch {
+	case req.OrgID != nil && *req.OrgID != "":
+		org, err := s.db.GetOrganizationByID(*req.OrgID)
+		if err != nil {
+			s.orgError(c, err)
+			return
+		}
+		t.OrgID = org.ID
+	case req.Org != nil && *req.Org != "":
+		org, err := s.db.GetOrganization(*req.Org)
+		if err != nil {
+			s.orgError(c, err)
+			return
+		}
+		t.OrgID = org.ID
+	}
+	if err := tasks.Validate(t); err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The first run covers the interval the task is created in
+	t.LatestCompleted = tasks.Initial(t, time.Now())
+	t, err := s.db.AddTask(t)
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	c.JSON(http.StatusCreated, newTask(t, nil))
+}
+
+func (s *Server) handleGetTask(c *gin.Context) {
+	t, err := s.db.GetTask(c.Param("taskID"))
+	if err != nil {
+		s.taskError(c, err)
+		return
+	}
+	last, err := s.lastRun(t.ID)
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, newTask(t, last))
+}
+
+func (s *Server) handleUpdateTask(c *gin.Context) {
+	var req taskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid task: %v", err))
+		return
+	}
+
+	t, err := s.db.GetTask(c.Param("taskID"))
+	if err != nil {
+		s.taskError(c, err)
+		return
+	}
+	if err := req.apply(&t); err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := tasks.Validate(t); err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if t, err = s.db.UpdateTask(t); err != nil {
+		s.taskError(c, err)
+		return
+	}
+	last, err := s.lastRun(t.ID)
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, newTask(t, last))
+}
+
+func (s *Server) handleDeleteTask(c *gin.Context) {
+	if err := s.db.DeleteTask(c.Param("taskID")); err != nil {
+		s.taskError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handleListRuns answers GET /api/v2/tasks/:taskID/runs with the run
+// history of a task, newest first, limited by limit
+func (s *Server) handleListRuns(c *gin.Context) {
+	_, limit, err := parsePage(c)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	t, err := s.db.GetTask(c.Param("taskID"))
+	if err != nil {
+		s.taskError(c, err)
+		return
+	}
+
+	runs, err := s.db.TaskRuns(t.ID, limit)
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	result := make([]run, 0, len(runs))
+	for _, r := range runs {
+		result = append(result, newRun(r))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"links": gin.H{"self": "/api/v2/tasks/" + t.ID + "/runs", "task": "/api/v2/tasks/" + t.ID},
+		"runs":  result,
+	})
+}
+
+// handleRunTask answers POST /api/v2/tasks/:taskID/runs by running a task
+// now over the time since its latest completed run. Manual runs do not
+// move the schedule forward.
+func (s *Server) handleRunTask(c *gin.Context) {
+	t, err := s.db.GetTask(c.Param("taskID"))
+	if err != nil {
+		s.taskError(c, err)
+		return
+	}
+	s.runTask(c, t, t.LatestCompleted, time.Now())
+}
+
+func (s *Server) handleGetRun(c *gin.Context) {
+	r, err := s.db.GetTaskRun(c.Param("taskID"), c.Param("runID"))
+	if err != nil {
+		s.taskError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, newRun(r))
+}
+
+// handleRetryRun answers POST /api/v2/tasks/:taskID/runs/:runID/retry by
+// running a task again over the time range of a previous run
+func (s *Server) handleRetryRun(c *gin.Context) {
+	t, err := s.db.GetTask(c.Param("taskID"))
+	if err != nil {
+		s.taskError(c, err)
+		return
+	}
+	r, err := s.db.GetTaskRun(t.ID, c.Param("runID"))
+	if err != nil {
+		s.taskError(c, err)
+		return
+	}
+	s.runTask(c, t, r.RangeStart, r.ScheduledFor)
+}
+
+// runTask runs a task over the range from start to end and answers with
+// the recorded run
+func (s *Server) runTask(c *gin.Context, t persistence.Task, start, end time.Time) {
+	if s.tasks == nil {
+		writeError(c, http.StatusServiceUnavailable, "task scheduler is disabled")
+		return
+	}
+	r, err := s.tasks.Run(c.Request.Context(), t, start, end)
+	if err != nil {
+		writeError(c, storageStatus(err), err.Error())
+		return
+	}
+	c.JSON(http.StatusCreated, newRun(r))
+}
+
+// taskError maps task errors to HTTP responses
+func (s *Server) taskError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, persistence.ErrTaskNotFound):
+		writeError(c, http.StatusNotFound, "task not found")
+	case errors.Is(err, persistence.ErrTaskRunNotFound):
+		writeError(c, http.StatusNotFound, "run not found")
+	default:
+		writeError(c, storageStatus(err), err.Error())
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+)
+
+// storage returns the file storing the points of database and the function
+// to call once done with it
+func (s *Server) storage(database string) (*persistence.Manager, func(), error) {
+	if s.tenants == nil {
+		return s.db, func() {}, nil
+	}
+	return s.tenants.For(database)
+}
+
+// storageFor returns the file storing the points of database, answering
+// with a 503 when the file of its tenant cannot be opened
+func (s *Server) storageFor(c *gin.Context, database string) (*persistence.Manager, func(), bool) {
+	m, release, err := s.storage(database)
+	if err != nil {
+		s.logger(c).Errorf("Failed to open storage of database %s: %v", database, err)
+		writeError(c, http.StatusServiceUnavailable, fmt.Sprintf("failed to open storage: %v", err))
+		return nil, nil, false
+	}
+	return m, release, true
+}
+
+// saveBatch stores points in the files of their databases
+func (s *Server) saveBatch(ctx context.Context, points []persistence.Point) error {
+	if s.tenants == nil {
+		return s.db.SaveBatchContext(ctx, points)
+	}
+	return s.tenants.SaveBatchContext(ctx, points)
+}
+
+// dropDatabase removes database and its points
+func (s *Server) dropDatabase(ctx context.Context, name string) error {
+	if s.tenants == nil {
+		return s.db.DropDatabaseContext(ctx, name)
+	}
+	return s.tenants.DropDatabaseContext(ctx, name)
+}
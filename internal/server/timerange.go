@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/predicate"
+)
+
+// fluxUnits are the fixed length units of Flux duration literals. Two
+// letter units come first so that "ms" is not read as minutes.
+var fluxUnits = []struct {
+	name string
+	unit time.Duration
+}{
+	{"ns", time.Nanosecond},
+	{"us", time.Microsecond},
+	{"µs", time.Microsecond},
+	{"ms", time.Millisecond},
+	{"s", time.Second},
+	{"m", time.Minute},
+	{"h", time.Hour},
+	{"d", 24 * time.Hour},
+	{"w", 7 * 24 * time.Hour},
+}
+
+// parseRangeTime reads the start or end of a query range the way Flux
+// range() does: a nanosecond epoch, an RFC3339 timestamp, now() or a
+// duration literal such as -1h30m relative to now. fallback is returned
+// for an empty value.
+func parseRangeTime(value string, now time.Time, fallback int64) (int64, error) {
+	value = strings.TrimSpace(value)
+	switch value {
+	case "":
+		return fallback, nil
+	case "now()":
+		return now.UnixNano(), nil
+	}
+	if ns, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return ns, nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return persistence.Nanoseconds(t)
+	}
+	t, err := addFluxDuration(now, value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: expected nanoseconds, RFC3339, now() or a duration such as -1h", value)
+	}
+	return persistence.Nanoseconds(t)
+}
+
+// addFluxDuration returns now moved by the Flux duration literal d, such
+// as -1h, 2d or -1mo15d. Months and years are calendar units.
+func addFluxDuration(now time.Time, d string) (time.Time, error) {
+	sign := 1
+	switch {
+	case strings.HasPrefix(d, "-"):
+		sign, d = -1, d[1:]
+	case strings.HasPrefix(d, "+"):
+		d = d[1:]
+	}
+	if d == "" {
+		return time.Time{}, fmt.Errorf("empty duration")
+	}
+
+	var (
+		fixed         time.Duration
+		months, years int
+	)
+	for d != "" {
+		i := 0
+		for i < len(d) && d[i] >= '0' && d[i] <= '9' {
+			i++
+		}
+		if i == 0 {
+			return time.Time{}, fmt.Errorf("missing magnitude in %q", d)
+		}
+		n, err := strconv.Atoi(d[:i])
+		if err != nil {
+			return time.Time{}, err
+		}
+		d = d[i:]
+
+		switch {
+		case strings.HasPrefix(d, "mo"):
+			months += n
+			d = d[2:]
+			continue
+		case strings.HasPrefix(d, "y"):
+			years += n
+			d = d[1:]
+			continue
+		}
+		matched := false
+		for _, u := range fluxUnits {
+			if strings.HasPrefix(d, u.name) {
+				fixed += time.Duration(n) * u.unit
+				d = d[len(u.name):]
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return time.Time{}, fmt.Errorf("unknown unit in %q", d)
+		}
+	}
+	return now.AddDate(sign*years, sign*months, 0).Add(time.Duration(sign) * fixed), nil
+}
+
+// groupByTimeInterval returns the interval of the GROUP BY time() clause
+// of query
+func groupByTimeInterval(query string) (time.Duration, error) {
+	i := indexUnquoted(query, "group by time(", false)
+	if i == -1 {
+		return 0, fmt.Errorf("missing GROUP BY time clause")
+	}
+	arg := query[i+len("group by time("):]
+	end := strings.IndexAny(arg, ",)")
+	if end == -1 {
+		return 0, fmt.Errorf("missing ) after GROUP BY time")
+	}
+	d, err := predicate.ParseDuration(arg[:end])
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("GROUP BY time interval must be positive")
+	}
+	return d, nil
+}
+
+// timeBuckets divides time into the GROUP BY time() buckets of interval
+// nanoseconds. Buckets are aligned to the epoch, or to midnight in loc
+// when the query sets tz(), so that daily buckets start at local midnight
+// and last 23 or 25 hours across daylight saving changes.
+type timeBuckets struct {
+	interval int64
+	loc      *time.Location
+	// expected is the number of buckets expected to hold points, counted
+	// from the hour index to size them
+	expected int
+}
+
+// start returns the start of the bucket holding ts
+func (w timeBuckets) start(ts int64) int64 {
+	if w.loc == nil {
+		return ts - ts%w.interval
+	}
+	offset := zoneOffset(ts, w.loc)
+	local := ts + offset
+	start := local - local%w.interval
+	if local%w.interval < 0 {
+		start -= w.interval
+	}
+	start -= offset
+	// A bucket starting before a daylight saving change starts at the
+	// local time of the offset in effect then
+	if before := zoneOffset(start, w.loc); before != offset && start+offset-before <= ts {
+		start += offset - before
+	}
+	return start
+}
+
+// zoneOffset returns the offset from UTC of loc at ts, in nanoseconds
+func zoneOffset(ts int64, loc *time.Location) int64 {
+	_, offset := time.Unix(0, ts).In(loc).Zone()
+	return int64(offset) * int64(time.Second)
+}
+
+// parseTimezone returns the location of the tz() clause of query, such as
+// tz('America/Sao_Paulo'), or nil without one
+func parseTimezone(query string) (*time.Location, error) {
+	i := indexUnquoted(query, "tz(", false)
+	if i == -1 {
+		return nil, nil
+	}
+	arg := query[i+len("tz("):]
+	end := strings.IndexByte(arg, ')')
+	if end == -1 {
+		return nil, fmt.Errorf("missing ) after tz")
+	}
+	name := strings.TrimSpace(arg[:end])
+	if len(name) < 2 || name[0] != '\'' || name[len(name)-1] != '\'' {
+		return nil, fmt.Errorf("tz() expects a quoted time zone such as 'America/Sao_Paulo'")
+	}
+	loc, err := time.LoadLocation(name[1 : len(name)-1])
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %s", name)
+	}
+	return loc, nil
+}
+
+// dataHours returns the measurements of db holding points in [start,
+// end], along with the hours of the range holding points of any of them,
+// in time order, as counted by the hour index
+func dataHours(ctx context.Context, store *persistence.Manager, db string, measurements []string, start, end int64) ([]string, []persistence.HourCount, error) {
+	var kept []string
+	points := make(map[int64]int64)
+	for _, m := range measurements {
+		counts, err := store.HourCounts(ctx, db, m, start, end)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(counts) > 0 {
+			kept = append(kept, m)
+		}
+		for _, h := range counts {
+			points[h.Start] += h.Points
+		}
+	}
+	hours := make([]persistence.HourCount, 0, len(points))
+	for hour, n := range points {
+		hours = append(hours, persistence.HourCount{Start: hour, Points: n})
+	}
+	sort.Slice(hours, func(i, j int) bool { return hours[i].Start < hours[j].Start })
+	return kept, hours, nil
+}
+
+// hoursRange narrows [start, end] to the hours holding points, which must
+// not be empty
+func hoursRange(hours []persistence.HourCount, start, end int64) (int64, int64) {
+	last := hours[len(hours)-1].Start
+	if last <= end-int64(time.Hour) {
+		end = last + int64(time.Hour) - 1
+	}
+	return max(start, hours[0].Start), end
+}
+
+// expectedBuckets estimates the number of buckets of w holding the points
+// of hours: the buckets holding whole hours, or as many buckets per hour
+// as it has points up to the buckets of an hour
+func expectedBuckets(hours []persistence.HourCount, w timeBuckets) int {
+	if w.interval >= int64(time.Hour) {
+		n := 0
+		last := int64(0)
+		for i, h := range hours {
+			if b := w.start(h.Start); i == 0 || b != last {
+				n++
+				last = b
+			}
+		}
+		return n
+	}
+	perHour := (int64(time.Hour) + w.interval - 1) / w.interval
+	n := int64(0)
+	for _, h := range hours {
+		n += min(h.Points, perHour)
+	}
+	return int(n)
+}
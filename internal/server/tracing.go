@@ -0,0 +1,161 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/tracing"
+)
+
+const (
+	// traceparentHeader carries a W3C Trace Context, followed by its
+	// vendor specific tracestate
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+	// b3Header carries a Zipkin B3 context in its single header form
+	b3Header = "b3"
+	// traceKey stores the trace context of a request in the gin context
+	traceKey = "refluxdb.trace"
+)
+
+// b3Headers are the headers of a Zipkin B3 context in its multiple header
+// form
+var b3Headers = []string{"X-B3-TraceId", "X-B3-SpanId", "X-B3-ParentSpanId", "X-B3-Sampled", "X-B3-Flags"}
+
+// traceContext identifies the trace and span of the upstream service a
+// request was sent from
+type traceContext struct {
+	TraceID string
+	SpanID  string
+	// Sampled is set when the upstream service records the trace
+	Sampled bool
+	// headers are the trace headers of the request, echoed in the response
+	headers http.Header
+}
+
+// parseTraceContext reads the trace context of a request from a W3C
+// traceparent header or from Zipkin B3 headers, in this order of
+// preference. Malformed headers are ignored, and ok is false when no
+// header carries a trace.
+func parseTraceContext(h http.Header) (trace traceContext, ok bool) {
+	trace.headers = make(http.Header)
+	if v := h.Get(traceparentHeader); v != "" {
+		// version-traceid-parentid-flags, where future versions may
+		// append fields
+		parts := strings.Split(strings.TrimSpace(v), "-")
+		if len(parts) >= 4 && isHexID(parts[0], 2) && parts[0] != "ff" && (parts[0] != "00" || len(parts) == 4) &&
+			isHexID(parts[1], 32) && isHexID(parts[2], 16) && isHexID(parts[3], 2) {
+			trace.TraceID, trace.SpanID = parts[1], parts[2]
+			flags, _ := strconv.ParseUint(parts[3], 16, 8)
+			trace.Sampled = flags&1 == 1
+			trace.headers.Set(traceparentHeader, v)
+			if state := h.Get(tracestateHeader); state != "" {
+				trace.headers.Set(tracestateHeader, state)
+			}
+			return trace, true
+		}
+	}
+
+	if v := h.Get(b3Header); v != "" {
+		// traceid-spanid[-sampled[-parentspanid]], or only the sampling
+		// decision, which carries no trace
+		parts := strings.Split(strings.TrimSpace(v), "-")
+		if len(parts) >= 2 && isB3TraceID(parts[0]) && isHexID(parts[1], 16) {
+			trace.TraceID, trace.SpanID = strings.ToLower(parts[0]), strings.ToLower(parts[1])
+			// d is the debug flag, which implies sampling
+			trace.Sampled = len(parts) >= 3 && (parts[2] == "1" || parts[2] == "d")
+			trace.headers.Set(b3Header, v)
+			return trace, true
+		}
+	}
+
+	traceID, spanID := h.Get("X-B3-TraceId"), h.Get("X-B3-SpanId")
+	if isB3TraceID(traceID) && isHexID(spanID, 16) {
+		trace.TraceID, trace.SpanID = strings.ToLower(traceID), strings.ToLower(spanID)
+		sampled := h.Get("X-B3-Sampled")
+		trace.Sampled = sampled == "1" || sampled == "true" || h.Get("X-B3-Flags") == "1"
+		for _, name := range b3Headers {
+			if v := h.Get(name); v != "" {
+				trace.headers.Set(name, v)
+			}
+		}
+		return trace, true
+	}
+	return traceContext{}, false
+}
+
+// isB3TraceID reports whether s is a B3 trace ID, of 64 or 128 bits
+func isB3TraceID(s string) bool {
+	return isHexID(s, 16) || isHexID(s, 32)
+}
+
+// isHexID reports whether s is a non-zero identifier of n hexadecimal
+// digits
+func isHexID(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	zero := true
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= '0' && c <= '9', c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+		default:
+			return false
+		}
+		if c != '0' {
+			zero = false
+		}
+	}
+	// Version 00 and the trace flags may be zero, IDs may not
+	return !zero || n == 2
+}
+
+// traceOfRequest returns the trace context of the request served by c,
+// and false when the client sent none
+func traceOfRequest(c *gin.Context) (traceContext, bool) {
+	if v, ok := c.Get(traceKey); ok {
+		return v.(traceContext), true
+	}
+	return traceContext{}, false
+}
+
+// traceRequests records the requests served by the handlers that follow
+// as server spans exported by the tracer, continuing the trace of the
+// upstream service when it sent one. The handlers add their own stages to
+// the span carried by the request context.
+func (s *Server) traceRequests() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.tracer == nil {
+			c.Next()
+			return
+		}
+		var remote *tracing.Remote
+		if trace, ok := traceOfRequest(c); ok {
+			remote = &tracing.Remote{TraceID: trace.TraceID, SpanID: trace.SpanID, Sampled: trace.Sampled}
+		}
+		ctx, span := s.tracer.StartSpan(c.Request.Context(), c.Request.Method+" "+c.FullPath(), tracing.KindServer, remote)
+		if span == nil {
+			c.Next()
+			return
+		}
+		c.Request = c.Request.WithContext(ctx)
+		span.SetAttribute("http.request.method", c.Request.Method)
+		span.SetAttribute("url.path", c.Request.URL.Path)
+		if ua := c.Request.UserAgent(); ua != "" {
+			span.SetAttribute("user_agent.original", ua)
+		}
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttribute("http.response.status_code", status)
+		if status >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+		}
+		span.End()
+	}
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/expr"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/predicate"
+	"github.com/gleicon/go-refluxdb/internal/result"
+)
+
+// aggregations are the functions computed over the values of a GROUP BY
+// time bucket
+var aggregations = []string{"mean", "sum", "count", "min", "max", "first", "last"}
+
+// sample is a value at a timestamp, in nanoseconds
+type sample struct {
+	ts int64
+	v  float64
+}
+
+// transformCall is a call to a transform function in a SELECT clause,
+// such as derivative(mean("value"), 1s). The transform applies to the
+// values of field, or to their aggregation over GROUP BY time buckets.
+type transformCall struct {
+	name        string
+	field       string
+	aggregation string
+	alias       string
+	// unit is the duration argument of the call, zero when not given
+	unit time.Duration
+	// n is the number of values of a window
+	n int
+}
+
+// transform is the definition of a transform function
+type transform struct {
+	// args checks the arguments following the field and stores them in
+	// the call
+	args func(call *transformCall, args []string) error
+	// extra returns the number of buckets before the range needed to
+	// compute the value of the first bucket of the range
+	extra func(call *transformCall) int
+	// apply computes the transform over samples in time order. interval
+	// is the GROUP BY time interval, or zero over raw values.
+	apply func(call *transformCall, samples []sample, interval int64) []sample
+}
+
+// transforms are the transform functions of InfluxQL
+var transforms = map[string]transform{
+	"derivative":                 {args: unitArg, extra: previous, apply: derivative(false)},
+	"non_negative_derivative":    {args: unitArg, extra: previous, apply: derivative(true)},
+	"difference":                 {args: noArgs, extra: previous, apply: difference},
+	"elapsed":                    {args: unitArg, extra: previous, apply: elapsed},
+	"moving_average":             {args: windowArg, extra: window, apply: movingAverage},
+	"exponential_moving_average": {args: windowArg, extra: window, apply: exponentialMovingAverage},
+	"cumulative_sum":             {args: noArgs, extra: none, apply: cumulativeSum},
+}
+
+// previous needs the bucket preceding the range
+func previous(*transformCall) int { return 1 }
+
+// window needs the buckets filling the window of the first bucket
+func window(call *transformCall) int { return call.n - 1 }
+
+// none only needs the buckets of the range
+func none(*transformCall) int { return 0 }
+
+// parseTransform returns the transform called by the SELECT clause of
+// query, or nil when it does not call one
+func parseTransform(query string) (*transformCall, error) {
+	clause, err := selectClause(query)
+	if err != nil {
+		return nil, err
+	}
+	text, alias := splitAlias(clause)
+	text = strings.TrimSpace(text)
+	open := strings.IndexByte(text, '(')
+	if open == -1 {
+		return nil, nil
+	}
+	name := strings.ToLower(strings.TrimSpace(text[:open]))
+	def, ok := transforms[name]
+	if !ok {
+		return nil, nil
+	}
+	if len(splitList(clause)) > 1 {
+		return nil, fmt.Errorf("%s cannot be selected with other fields", name)
+	}
+	if !strings.HasSuffix(text, ")") {
+		return nil, fmt.Errorf("missing ) after the arguments of %s", name)
+	}
+
+	args := splitList(text[open+1 : len(text)-1])
+	call := &transformCall{name: name, alias: alias}
+	if call.field, call.aggregation, err = transformArg(args[0]); err != nil {
+		return nil, fmt.Errorf("invalid argument of %s: %w", name, err)
+	}
+	if err := def.args(call, args[1:]); err != nil {
+		return nil, fmt.Errorf("invalid arguments of %s: %w", name, err)
+	}
+	return call, nil
+}
+
+// transformArg reads the first argument of a transform: a field, or an
+// aggregation of a field such as mean("value")
+func transformArg(arg string) (field, aggregation string, err error) {
+	arg = strings.TrimSpace(arg)
+	if open := strings.IndexByte(arg, '('); open != -1 && strings.HasSuffix(arg, ")") {
+		aggregation = strings.ToLower(strings.TrimSpace(arg[:open]))
+		if !isAggregation(aggregation) {
+			return "", "", fmt.Errorf("unsupported aggregation %s", aggregation)
+		}
+		arg = arg[open+1 : len(arg)-1]
+	}
+	e, err := expr.Parse(arg)
+	if err != nil {
+		return "", "", err
+	}
+	f, ok := e.(expr.Field)
+	if !ok {
+		return "", "", fmt.Errorf("expected a field, got %s", e)
+	}
+	return string(f), aggregation, nil
+}
+
+func isAggregation(name string) bool {
+	for _, agg := range aggregations {
+		if name == agg {
+			return true
+		}
+	}
+	return false
+}
+
+func noArgs(call *transformCall, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("expected 1 argument, got %d", len(args)+1)
+	}
+	return nil
+}
+
+// unitArg reads the optional duration argument of a call
+func unitArg(call *transformCall, args []string) error {
+	switch len(args) {
+	case 0:
+		return nil
+	case 1:
+		d, err := predicate.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("the unit must be positive")
+		}
+		call.unit = d
+		return nil
+	}
+	return fmt.Errorf("expected at most 2 arguments, got %d", len(args)+1)
+}
+
+// windowArg reads the required window size argument of a call
+func windowArg(call *transformCall, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected 2 arguments, got %d", len(args)+1)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(args[0]))
+	if err != nil || n < 2 {
+		return fmt.Errorf("the window size must be an integer greater than 1, got %s", strings.TrimSpace(args[0]))
+	}
+	call.n = n
+	return nil
+}
+
+// derivative returns the rate of change between consecutive samples per
+// unit, which defaults to the GROUP BY interval over buckets and to one
+// second over raw values. Buckets without values are skipped, so a rate
+// spanning them is computed over the time actually elapsed.
+func derivative(nonNegative bool) func(*transformCall, []sample, int64) []sample {
+	return func(call *transformCall, samples []sample, interval int64) []sample {
+		unit := int64(call.unit)
+		if unit == 0 {
+			unit = interval
+		}
+		if unit == 0 {
+			unit = int64(time.Second)
+		}
+
+		var out []sample
+		for i := 1; i < len(samples); i++ {
+			prev, cur := samples[i-1], samples[i]
+			if cur.ts == prev.ts {
+				continue
+			}
+			v := (cur.v - prev.v) / (float64(cur.ts-prev.ts) / float64(unit))
+			if nonNegative && v < 0 {
+				continue
+			}
+			out = append(out, sample{ts: cur.ts, v: v})
+		}
+		return out
+	}
+}
+
+// difference returns the change between consecutive samples
+func difference(call *transformCall, samples []sample, interval int64) []sample {
+	var out []sample
+	for i := 1; i < len(samples); i++ {
+		out = append(out, sample{ts: samples[i].ts, v: samples[i].v - samples[i-1].v})
+	}
+	return out
+}
+
+// elapsed returns the time between consecutive samples, in units of one
+// nanosecond by default
+func elapsed(call *transformCall, samples []sample, interval int64) []sample {
+	unit := int64(call.unit)
+	if unit == 0 {
+		unit = 1
+	}
+	var out []sample
+	for i := 1; i < len(samples); i++ {
+		out = append(out, sample{ts: samples[i].ts, v: float64((samples[i].ts - samples[i-1].ts) / unit)})
+	}
+	return out
+}
+
+// movingAverage returns the mean of each window of n consecutive samples,
+// starting with the first full window
+func movingAverage(call *transformCall, samples []sample, interval int64) []sample {
+	var out []sample
+	sum := 0.0
+	for i, s := range samples {
+		sum += s.v
+		if i >= call.n {
+			sum -= samples[i-call.n].v
+		}
+		if i >= call.n-1 {
+			out = append(out, sample{ts: s.ts, v: sum / float64(call.n)})
+		}
+	}
+	return out
+}
+
+// exponentialMovingAverage returns the moving average of samples weighing
+// each one 2/(n+1) against the average of the ones before it. The average
+// starts at the first sample and is returned once n samples were seen.
+func exponentialMovingAverage(call *transformCall, samples []sample, interval int64) []sample {
+	alpha := 2 / float64(call.n+1)
+	var out []sample
+	ema := 0.0
+	for i, s := range samples {
+		if i == 0 {
+			ema = s.v
+		} else {
+			ema += alpha * (s.v - ema)
+		}
+		if i >= call.n-1 {
+			out = append(out, sample{ts: s.ts, v: ema})
+		}
+	}
+	return out
+}
+
+// cumulativeSum returns the running total of samples
+func cumulativeSum(call *transformCall, samples []sample, interval int64) []sample {
+	out := make([]sample, len(samples))
+	sum := 0.0
+	for i, s := range samples {
+		sum += s.v
+		out[i] = sample{ts: s.ts, v: sum}
+	}
+	return out
+}
+
+// fieldSamples returns the values of field in points, which are in time
+// order
+func fieldSamples(points []persistence.Point, field string) []sample {
+	var samples []sample
+	for _, point := range points {
+		if v, ok := point.Fields[field]; ok {
+			samples = append(samples, sample{ts: point.Timestamp, v: v})
+		}
+	}
+	return samples
+}
+
+// samplesSeries returns a series of samples with a single value column
+func samplesSeries(measurement, column string, samples []sample) *result.Series {
+	series := result.NewSeries(measurement,
+		result.Column{Name: "time", Type: result.Time},
+		result.Column{Name: column, Type: result.Float},
+	)
+	for _, s := range samples {
+		series.Append(s.ts, s.v)
+	}
+	return series
+}
+
+// column returns the name of the column of the call
+func (call *transformCall) column() string {
+	if call.alias != "" {
+		return call.alias
+	}
+	return call.name
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/result"
+)
+
+// userStatement is a parsed user management statement
+type userStatement struct {
+	// kind is the statement keywords, such as "create user" or "grant"
+	kind     string
+	user     string
+	password string
+	// database is empty for GRANT and REVOKE of the admin rights
+	database  string
+	privilege persistence.Privilege
+	admin     bool
+}
+
+// userStatements are the user management statements, by their leading
+// keywords
+var userStatements = []string{"create user", "drop user", "set password", "grant", "revoke", "show users", "show grants"}
+
+// isUserStatement reports whether queryLower is a user management
+// statement
+func isUserStatement(queryLower string) bool {
+	for _, kind := range userStatements {
+		if queryLower == kind || strings.HasPrefix(queryLower, kind+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// keywords consumes the case-insensitive words of expected at the start of
+// tokens and returns the remaining tokens
+func keywords(tokens []string, expected string) ([]string, error) {
+	for _, word := range strings.Fields(expected) {
+		if len(tokens) == 0 || !strings.EqualFold(tokens[0], word) {
+			return nil, fmt.Errorf("expected %s", strings.ToUpper(expected))
+		}
+		tokens = tokens[1:]
+	}
+	return tokens, nil
+}
+
+// stringLiteral reads a single quoted string
+func stringLiteral(token string) (string, error) {
+	if len(token) < 2 || token[0] != '\'' || token[len(token)-1] != '\'' {
+		return "", fmt.Errorf("expected a single quoted string, got %s", token)
+	}
+	return token[1 : len(token)-1], nil
+}
+
+// parsePrivilege reads READ, WRITE or ALL [PRIVILEGES]
+func parsePrivilege(tokens []string) (persistence.Privilege, []string, error) {
+	if len(tokens) == 0 {
+		return 0, nil, fmt.Errorf("expected READ, WRITE or ALL")
+	}
+	var p persistence.Privilege
+	switch strings.ToUpper(tokens[0]) {
+	case "READ":
+		p = persistence.PrivilegeRead
+	case "WRITE":
+		p = persistence.PrivilegeWrite
+	case "ALL":
+		p = persistence.PrivilegeAll
+		if len(tokens) > 1 && strings.EqualFold(tokens[1], "privileges") {
+			tokens = tokens[1:]
+		}
+	default:
+		return 0, nil, fmt.Errorf("expected READ, WRITE or ALL, got %s", tokens[0])
+	}
+	return p, tokens[1:], nil
+}
+
+// parseUserStatement parses CREATE USER, DROP USER, SET PASSWORD, GRANT,
+// REVOKE, SHOW USERS and SHOW GRANTS
+func parseUserStatement(query string) (userStatement, error) {
+	tokens, err := subscriptionTokens(query)
+	if err != nil {
+		return userStatement{}, err
+	}
+	var stmt userStatement
+	for _, kind := range userStatements {
+		if rest, err := keywords(tokens, kind); err == nil {
+			stmt.kind, tokens = kind, rest
+			break
+		}
+	}
+
+	// name reads the user name ending the statement
+	name := func(tokens []string) error {
+		if len(tokens) != 1 {
+			return fmt.Errorf("expected a user name")
+		}
+		stmt.user = unquoteIdent(tokens[0])
+		return nil
+	}
+
+	switch stmt.kind {
+	case "create user":
+		if len(tokens) < 1 {
+			return userStatement{}, fmt.Errorf("expected a user name")
+		}
+		stmt.user = unquoteIdent(tokens[0])
+		if tokens, err = keywords(tokens[1:], "with password"); err != nil {
+			return userStatement{}, err
+		}
+		if len(tokens) == 0 {
+			return userStatement{}, fmt.Errorf("expected a password")
+		}
+		if stmt.password, err = stringLiteral(tokens[0]); err != nil {
+			return userStatement{}, err
+		}
+		if tokens = tokens[1:]; len(tokens) > 0 {
+			if tokens, err = keywords(tokens, "with all privileges"); err != nil || len(tokens) > 0 {
+				return userStatement{}, fmt.Errorf("expected WITH ALL PRIVILEGES")
+			}
+			stmt.admin = true
+		}
+	case "drop user":
+		err = name(tokens)
+	case "set password":
+		if tokens, err = keywords(tokens, "for"); err != nil {
+			return userStatement{}, err
+		}
+		if len(tokens) != 3 || tokens[1] != "=" {
+			return userStatement{}, fmt.Errorf("expected SET PASSWORD FOR <user> = '<password>'")
+		}
+		stmt.user = unquoteIdent(tokens[0])
+		stmt.password, err = stringLiteral(tokens[2])
+	case "grant", "revoke":
+		if stmt.privilege, tokens, err = parsePrivilege(tokens); err != nil {
+			return userStatement{}, err
+		}
+		if len(tokens) > 1 && strings.EqualFold(tokens[0], "on") {
+			stmt.database, tokens = unquoteIdent(tokens[1]), tokens[2:]
+		} else if stmt.privilege != persistence.PrivilegeAll {
+			return userStatement{}, fmt.Errorf("expected ON <database>")
+		}
+		preposition := "to"
+		if stmt.kind == "revoke" {
+			preposition = "from"
+		}
+		if tokens, err = keywords(tokens, preposition); err != nil {
+			return userStatement{}, err
+		}
+		err = name(tokens)
+	case "show users":
+		if len(tokens) > 0 {
+			err = fmt.Errorf("unexpected %q", tokens[0])
+		}
+	case "show grants":
+		if tokens, err = keywords(tokens, "for"); err != nil {
+			return userStatement{}, err
+		}
+		err = name(tokens)
+	default:
+		err = fmt.Errorf("unknown statement")
+	}
+	if err != nil {
+		return userStatement{}, err
+	}
+	return stmt, nil
+}
+
+// handleUserStatement executes a user management statement. Only admins
+// may run them, except for the creation of the first admin user.
+func (s *Server) handleUserStatement(c *gin.Context, query string) {
+	stmt, err := parseUserStatement(query)
+	if err != nil {
+		writeError(c, http.StatusBadRequest, fmt.Sprintf("invalid query format: %v", err))
+		return
+	}
+	bootstrap := stmt.kind == "create user" && stmt.admin && s.bootstrapping(c)
+	if !bootstrap && !s.authorize(c, persistence.ScopeAdmin, "") {
+		return
+	}
+
+	switch stmt.kind {
+	case "create user":
+		err = s.db.AddUser(stmt.user, stmt.password, stmt.admin)
+	case "drop user":
+		err = s.db.DropUser(stmt.user)
+	case "set password":
+		err = s.db.SetPassword(stmt.user, stmt.password)
+	case "grant", "revoke":
+		switch {
+		case stmt.database == "":
+			err = s.db.SetAdmin(stmt.user, stmt.kind == "grant")
+		case stmt.kind == "grant":
+			err = s.db.GrantPrivilege(stmt.user, stmt.database, stmt.privilege)
+		default:
+			err = s.db.RevokePrivilege(stmt.user, stmt.database, stmt.privilege)
+		}
+	case "show users":
+		s.showUsers(c)
+		return
+	case "show grants":
+		s.showGrants(c, stmt.user)
+		return
+	}
+	if err != nil {
+		if errors.Is(err, persistence.ErrUserNotFound) {
+			err = fmt.Errorf("user not found")
+		} else if errors.Is(err, persistence.ErrUserExists) {
+			err = fmt.Errorf("user already exists")
+		}
+		s.writeResult(c, http.StatusOK, result.Error(err.Error()), result.Options{})
+		return
+	}
+	s.auditUserStatement(c, stmt)
+	s.writeResult(c, http.StatusOK, result.New(), result.Options{})
+}
+
+// auditUserStatement records a user management statement in the audit
+// log, never with its password
+func (s *Server) auditUserStatement(c *gin.Context, stmt userStatement) {
+	var action, detail string
+	switch stmt.kind {
+	case "create user":
+		action = "user.create"
+		if stmt.admin {
+			detail = "admin"
+		}
+	case "drop user":
+		action = "user.drop"
+	case "set password":
+		action = "user.password"
+	default:
+		action = "user." + stmt.kind
+		detail = "admin"
+		if stmt.database != "" {
+			detail = stmt.privilege.String() + " on " + stmt.database
+		}
+	}
+	s.audit(c, action, stmt.user, detail)
+}
+
+// showUsers answers SHOW USERS
+func (s *Server) showUsers(c *gin.Context) {
+	users, err := s.db.Users()
+	if err != nil {
+		s.writeResult(c, http.StatusOK, result.Error(err.Error()), result.Options{})
+		return
+	}
+	series := result.NewSeries("",
+		result.Column{Name: "user", Type: result.String},
+		result.Column{Name: "admin", Type: result.Boolean},
+	)
+	for _, u := range users {
+		series.Append(u.Name, u.Admin)
+	}
+	s.writeResult(c, http.StatusOK, result.New(series), result.Options{})
+}
+
+// showGrants answers SHOW GRANTS FOR user, listing its privileges by
+// database
+func (s *Server) showGrants(c *gin.Context, user string) {
+	u, err := s.db.GetUser(user)
+	if errors.Is(err, persistence.ErrUserNotFound) {
+		err = fmt.Errorf("user not found")
+	}
+	if err != nil {
+		s.writeResult(c, http.StatusOK, result.Error(err.Error()), result.Options{})
+		return
+	}
+	databases := make([]string, 0, len(u.Privileges))
+	for d := range u.Privileges {
+		databases = append(databases, d)
+	}
+	sort.Strings(databases)
+
+	series := result.NewSeries("",
+		result.Column{Name: "database", Type: result.String},
+		result.Column{Name: "privilege", Type: result.String},
+	)
+	for _, d := range databases {
+		series.Append(d, u.Privileges[d].String())
+	}
+	s.writeResult(c, http.StatusOK, result.New(series), result.Options{})
+}
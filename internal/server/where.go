@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/predicate"
+)
+
+// clauseKeywords end a WHERE clause
+var clauseKeywords = []string{"group", "order", "limit", "slimit", "offset", "soffset"}
+
+// whereClause returns the conditions following WHERE in query, or an
+// empty string without a WHERE clause
+func whereClause(query string) string {
+	where, ok := afterKeyword(query, "where")
+	if !ok {
+		return ""
+	}
+	end := len(where)
+	for _, keyword := range clauseKeywords {
+		if tail, ok := afterKeyword(where, keyword); ok {
+			end = min(end, len(where)-len(tail)-len(keyword))
+		}
+	}
+	for _, call := range []string{"fill(", "tz("} {
+		if i := indexUnquoted(where[:end], call, false); i != -1 {
+			end = min(end, i)
+		}
+	}
+	return where[:end]
+}
+
+// parseWhere parses the conditions of a WHERE clause, such as time >=
+// now() - 1h AND (host = 'a' OR value > 90), and returns them with the
+// range of times they may hold at. Either end of the default [start, end]
+// is kept when the conditions leave it unbounded.
+func parseWhere(where string, now time.Time, start, end int64) (predicate.Expr, int64, int64, error) {
+	cond, err := predicate.Parse(where, now)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	from, to := predicate.TimeRange(cond)
+	if from != math.MinInt64 {
+		start = from
+	}
+	if to != math.MaxInt64 {
+		end = to
+	}
+	return cond, start, end, nil
+}
+
+// matchWhere returns a function reporting whether a point satisfies cond,
+// or nil when the time range alone selects the points
+func matchWhere(cond predicate.Expr) func(persistence.Point) bool {
+	if predicate.TimeOnly(cond) {
+		return nil
+	}
+	return func(p persistence.Point) bool {
+		return cond.Eval(p.Timestamp, p.Tags, p.Fields)
+	}
+}
+
+// filterPoints returns the points for which keep returns true
+func filterPoints(points []persistence.Point, keep func(persistence.Point) bool) []persistence.Point {
+	var kept []persistence.Point
+	for _, p := range points {
+		if keep(p) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// withTags returns the measurements of db with a series that may carry
+// the tags cond requires, according to the series index, so that the
+// others are not scanned
+func withTags(ctx context.Context, store *persistence.Manager, db string, measurements []string, cond predicate.Expr) ([]string, error) {
+	tags := predicate.RequiredTags(cond)
+	if len(tags) == 0 {
+		return measurements, nil
+	}
+	var kept []string
+	for _, m := range measurements {
+		ok, err := store.MayHaveTags(ctx, db, m, tags)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			kept = append(kept, m)
+		}
+	}
+	return kept, nil
+}
+
+// requiredTagsString formats the tags cond requires as conditions, sorted
+// by key, or returns an empty string when it requires none
+func requiredTagsString(cond predicate.Expr) string {
+	tags := predicate.RequiredTags(cond)
+	conds := make([]string, 0, len(tags))
+	for k, v := range tags {
+		conds = append(conds, (&predicate.Comparison{Kind: predicate.Tag, Key: k, Op: "=", Text: v}).String())
+	}
+	sort.Strings(conds)
+	return strings.Join(conds, " AND ")
+}
@@ -0,0 +1,432 @@
+// Package subscriber forwards the points written to refluxdb to the
+// destinations of the database subscriptions, as line protocol, so
+// instances can be chained or mirrored to InfluxDB.
+package subscriber
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/export"
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/protocol"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	pointsSent    = metrics.NewCounter("refluxdb_subscriber_points_sent_total", "Points sent to subscription destinations")
+	writeErrors   = metrics.NewCounter("refluxdb_subscriber_write_errors_total", "Writes to subscription destinations that failed")
+	pointsDropped = metrics.NewCounter("refluxdb_subscriber_points_dropped_total", "Points not forwarded because the subscription queue was full")
+)
+
+const (
+	// DefaultQueueSize is the number of batches buffered per subscription
+	DefaultQueueSize = 1000
+	// DefaultWriteTimeout bounds every write to a destination
+	DefaultWriteTimeout = 10 * time.Second
+	// maxPacketSize is the largest payload sent in one UDP packet, the
+	// limit of IPv4, which fits the read buffer of UDP listeners
+	maxPacketSize = 65507
+)
+
+// Options configures a Service
+type Options struct {
+	// QueueSize is the number of batches buffered per subscription before
+	// new batches are dropped
+	QueueSize int
+	// WriteTimeout bounds every write to a destination
+	WriteTimeout time.Duration
+	// Logger receives delivery errors. The standard logrus logger is used
+	// when nil.
+	Logger *logrus.Logger
+}
+
+// CheckDestination returns an error when dest is not a destination URL
+// the service can write to
+func CheckDestination(dest string) error {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return fmt.Errorf("invalid destination %q: %w", dest, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "udp":
+	default:
+		return fmt.Errorf("invalid destination %q: scheme must be http, https or udp", dest)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid destination %q: host is required", dest)
+	}
+	return nil
+}
+
+// Service delivers the written points to the subscription destinations.
+// Every subscription has its own queue and goroutine, so a slow
+// destination only delays its own subscription.
+type Service struct {
+	db     *persistence.Manager
+	opts   Options
+	log    *logrus.Logger
+	client *http.Client
+
+	// mu guards subs and running. observe holds it for reading while
+	// queueing, so queues are never closed under it.
+	mu       sync.RWMutex
+	subs     map[string]*subscription
+	running  bool
+	register sync.Once
+	wg       sync.WaitGroup
+}
+
+// New creates a service forwarding the points written to db
+func New(db *persistence.Manager, opts Options) *Service {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = DefaultWriteTimeout
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	return &Service{
+		db:     db,
+		opts:   opts,
+		log:    logger,
+		client: &http.Client{Timeout: opts.WriteTimeout},
+		subs:   make(map[string]*subscription),
+	}
+}
+
+// Start loads the subscriptions and starts forwarding written points
+func (s *Service) Start() error {
+	// Registered outside s.mu: writers call observe holding the storage
+	// lock, which OnWrite takes
+	s.register.Do(func() { s.db.OnWrite(s.observe) })
+	s.mu.Lock()
+	s.running = true
+	s.mu.Unlock()
+	return s.Reload()
+}
+
+// Reload applies the subscriptions stored in the database, starting the
+// new ones and stopping the dropped or changed ones. It is called after
+// every CREATE or DROP SUBSCRIPTION.
+func (s *Service) Reload() error {
+	subs, err := s.db.Subscriptions()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running {
+		return nil
+	}
+
+	wanted := make(map[string]persistence.Subscription, len(subs))
+	for _, sub := range subs {
+		wanted[subscriptionKey(sub.Database, sub.Name)] = sub
+	}
+	for key, running := range s.subs {
+		if sub, ok := wanted[key]; ok && sameSubscription(sub, running.config) {
+			delete(wanted, key)
+			continue
+		}
+		running.stop()
+		delete(s.subs, key)
+	}
+	for key, sub := range wanted {
+		running, err := s.newSubscription(sub)
+		if err != nil {
+			s.log.Errorf("Failed to start subscription %s on %s: %v", sub.Name, sub.Database, err)
+			continue
+		}
+		s.subs[key] = running
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			running.run()
+		}()
+	}
+	return nil
+}
+
+// Stop stops forwarding points and waits for the queued batches to be
+// delivered
+func (s *Service) Stop() {
+	s.mu.Lock()
+	s.running = false
+	for key, sub := range s.subs {
+		sub.stop()
+		delete(s.subs, key)
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// observe queues a stored batch to the subscriptions of its databases. It
+// runs while writers are held off, so it never blocks: batches are dropped
+// when a queue is full.
+func (s *Service) observe(points []persistence.Point) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.subs) == 0 {
+		return
+	}
+
+	byDatabase := make(map[string][]persistence.Point)
+	for _, p := range points {
+		database := p.Database
+		if database == "" {
+			database = persistence.DefaultDatabase
+		}
+		byDatabase[database] = append(byDatabase[database], p)
+	}
+
+	// Subscriptions without a measurement filter share one encoding of
+	// the points of their database
+	encoded := make(map[string]batch)
+	for _, sub := range s.subs {
+		points, ok := byDatabase[sub.config.Database]
+		if !ok {
+			continue
+		}
+		var b batch
+		if len(sub.measurements) == 0 {
+			if b, ok = encoded[sub.config.Database]; !ok {
+				b = encode(points, nil)
+				encoded[sub.config.Database] = b
+			}
+		} else {
+			b = encode(points, sub.measurements)
+		}
+		if b.points == 0 {
+			continue
+		}
+		select {
+		case sub.queue <- b:
+		default:
+			pointsDropped.Add(uint64(b.points))
+		}
+	}
+}
+
+// batch is a set of points encoded as line protocol
+type batch struct {
+	data   []byte
+	points int
+}
+
+// encode renders the points whose measurement is in measurements, or all
+// of them when measurements is nil, as line protocol. Points that cannot be
+// written as line protocol are left out.
+func encode(points []persistence.Point, measurements map[string]bool) batch {
+	var enc protocol.Encoder
+	var b batch
+	for _, p := range points {
+		if measurements != nil && !measurements[p.Measurement] {
+			continue
+		}
+		if export.EncodePoint(&enc, p) == nil {
+			b.points++
+		}
+	}
+	b.data = enc.Bytes()
+	return b
+}
+
+// subscriptionKey identifies a subscription across reloads
+func subscriptionKey(database, name string) string {
+	return database + "\x00" + name
+}
+
+// sameSubscription reports whether a and b deliver the same points to the
+// same destinations
+func sameSubscription(a, b persistence.Subscription) bool {
+	return a.Mode == b.Mode &&
+		strings.Join(a.Destinations, "\x00") == strings.Join(b.Destinations, "\x00") &&
+		strings.Join(a.Measurements, "\x00") == strings.Join(b.Measurements, "\x00")
+}
+
+// subscription is a running subscription with its queue and destinations
+type subscription struct {
+	config       persistence.Subscription
+	measurements map[string]bool
+	destinations []destination
+	queue        chan batch
+	log          *logrus.Logger
+	// next is the destination of the next batch in ANY mode
+	next int
+}
+
+func (s *Service) newSubscription(config persistence.Subscription) (*subscription, error) {
+	sub := &subscription{
+		config: config,
+		queue:  make(chan batch, s.opts.QueueSize),
+		log:    s.log,
+	}
+	if len(config.Measurements) > 0 {
+		sub.measurements = make(map[string]bool, len(config.Measurements))
+		for _, m := range config.Measurements {
+			sub.measurements[m] = true
+		}
+	}
+	for _, dest := range config.Destinations {
+		d, err := s.newDestination(dest, config.Database)
+		if err != nil {
+			for _, started := range sub.destinations {
+				started.close()
+			}
+			return nil, err
+		}
+		sub.destinations = append(sub.destinations, d)
+	}
+	return sub, nil
+}
+
+// stop closes the queue, so run returns once the queued batches are sent.
+// The caller must hold the service lock.
+func (sub *subscription) stop() {
+	close(sub.queue)
+}
+
+// run delivers the queued batches until the queue is closed
+func (sub *subscription) run() {
+	defer func() {
+		for _, d := range sub.destinations {
+			d.close()
+		}
+	}()
+	for b := range sub.queue {
+		sub.send(b)
+	}
+}
+
+// send writes a batch to every destination in ALL mode, or to the next
+// destination in ANY mode, trying the others when it fails
+func (sub *subscription) send(b batch) {
+	if sub.config.Mode == persistence.SubscriptionAll {
+		for _, d := range sub.destinations {
+			sub.write(d, b)
+		}
+		return
+	}
+	for range sub.destinations {
+		d := sub.destinations[sub.next%len(sub.destinations)]
+		sub.next++
+		if sub.write(d, b) {
+			return
+		}
+	}
+}
+
+// write sends a batch to one destination and reports whether it succeeded
+func (sub *subscription) write(d destination, b batch) bool {
+	if err := d.write(b.data); err != nil {
+		writeErrors.Inc()
+		sub.log.Errorf("Subscription %s on %s failed to write to %s: %v", sub.config.Name, sub.config.Database, d, err)
+		return false
+	}
+	pointsSent.Add(uint64(b.points))
+	return true
+}
+
+// destination receives line protocol
+type destination interface {
+	write(data []byte) error
+	close()
+	String() string
+}
+
+func (s *Service) newDestination(dest, database string) (destination, error) {
+	if err := CheckDestination(dest); err != nil {
+		return nil, err
+	}
+	u, _ := url.Parse(dest)
+	if u.Scheme == "udp" {
+		conn, err := net.DialTimeout("udp", u.Host, s.opts.WriteTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %w", dest, err)
+		}
+		return &udpDestination{url: dest, conn: conn, timeout: s.opts.WriteTimeout}, nil
+	}
+
+	// Points are written with the v1 API, understood by refluxdb and
+	// every InfluxDB version
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/write"
+	q := u.Query()
+	q.Set("db", database)
+	u.RawQuery = q.Encode()
+	return &httpDestination{url: dest, writeURL: u.String(), client: s.client}, nil
+}
+
+// httpDestination writes to the /write endpoint of a server
+type httpDestination struct {
+	url      string
+	writeURL string
+	client   *http.Client
+}
+
+func (d *httpDestination) write(data []byte) error {
+	resp, err := d.client.Post(d.writeURL, "text/plain; charset=utf-8", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (d *httpDestination) close() {}
+
+func (d *httpDestination) String() string {
+	return d.url
+}
+
+// udpDestination sends line protocol packets to a UDP listener
+type udpDestination struct {
+	url     string
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// write sends data in packets of at most maxPacketSize bytes, split on
+// line boundaries. A line longer than a packet is sent alone.
+func (d *udpDestination) write(data []byte) error {
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxPacketSize {
+			n = bytes.LastIndexByte(data[:maxPacketSize], '\n') + 1
+			if n == 0 {
+				n = bytes.IndexByte(data, '\n') + 1
+			}
+			if n == 0 {
+				n = len(data)
+			}
+		}
+		d.conn.SetWriteDeadline(time.Now().Add(d.timeout))
+		if _, err := d.conn.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (d *udpDestination) close() {
+	d.conn.Close()
+}
+
+func (d *udpDestination) String() string {
+	return d.url
+}
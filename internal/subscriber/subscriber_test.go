@@ -0,0 +1,141 @@
+package subscriber
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupTestService(t *testing.T) (*Service, *persistence.Manager) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	assert.NoError(t, db.CreateDatabase("mydb"))
+	return New(db, Options{WriteTimeout: time.Second}), db
+}
+
+func point(measurement string, value float64) persistence.Point {
+	return persistence.Point{
+		Database:    "mydb",
+		Measurement: measurement,
+		Tags:        map[string]string{"host": "a"},
+		Fields:      map[string]float64{"value": value},
+		Timestamp:   100,
+	}
+}
+
+func TestCheckDestination(t *testing.T) {
+	assert.NoError(t, CheckDestination("http://localhost:8086"))
+	assert.NoError(t, CheckDestination("https://influx.example.com/prefix"))
+	assert.NoError(t, CheckDestination("udp://localhost:8089"))
+	assert.Error(t, CheckDestination("tcp://localhost:8089"))
+	assert.Error(t, CheckDestination("http://"))
+	assert.Error(t, CheckDestination("localhost:8086"))
+}
+
+func TestForwardHTTP(t *testing.T) {
+	received := make(chan string, 10)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		assert.Equal(t, "/write", r.URL.Path)
+		assert.Equal(t, "mydb", r.URL.Query().Get("db"))
+		received <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer downstream.Close()
+
+	svc, db := setupTestService(t)
+	defer db.Close()
+	assert.NoError(t, db.AddSubscription(persistence.Subscription{
+		Name: "all", Database: "mydb", Mode: persistence.SubscriptionAll,
+		Destinations: []string{downstream.URL},
+	}))
+	assert.NoError(t, db.AddSubscription(persistence.Subscription{
+		Name: "mem", Database: "mydb", Mode: persistence.SubscriptionAny,
+		Destinations: []string{downstream.URL}, Measurements: []string{"mem"},
+	}))
+	assert.NoError(t, svc.Start())
+
+	assert.NoError(t, db.SaveBatch([]persistence.Point{point("cpu", 1), point("mem", 2)}))
+	// Points of other databases are not forwarded
+	assert.NoError(t, db.SaveBatch([]persistence.Point{{Database: "other", Measurement: "cpu", Fields: map[string]float64{"value": 3}, Timestamp: 100}}))
+	svc.Stop()
+
+	var bodies []string
+	for len(received) > 0 {
+		bodies = append(bodies, <-received)
+	}
+	assert.ElementsMatch(t, []string{
+		"cpu,host=a value=1 100\nmem,host=a value=2 100\n",
+		"mem,host=a value=2 100\n",
+	}, bodies)
+
+	// Nothing is forwarded once stopped
+	assert.NoError(t, db.SaveBatch([]persistence.Point{point("cpu", 4)}))
+	assert.Empty(t, received)
+}
+
+func TestForwardUDPFailover(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	svc, db := setupTestService(t)
+	defer db.Close()
+	assert.NoError(t, svc.Start())
+	defer svc.Stop()
+
+	// Subscriptions created after Start are picked up by Reload, and ANY
+	// fails over to the next destination
+	assert.NoError(t, db.AddSubscription(persistence.Subscription{
+		Name: "any", Database: "mydb", Mode: persistence.SubscriptionAny,
+		Destinations: []string{failing.URL, "udp://" + conn.LocalAddr().String()},
+	}))
+	assert.NoError(t, svc.Reload())
+
+	assert.NoError(t, db.SaveBatch([]persistence.Point{point("cpu", 1)}))
+	buf := make([]byte, maxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "cpu,host=a value=1 100\n", string(buf[:n]))
+}
+
+func TestUDPPackets(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer conn.Close()
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	assert.NoError(t, err)
+	d := &udpDestination{conn: client, timeout: time.Second}
+	defer d.close()
+
+	line := strings.Repeat("x", 1000) + "\n"
+	data := strings.Repeat(line, 100)
+	assert.NoError(t, d.write([]byte(data)))
+
+	var got strings.Builder
+	buf := make([]byte, maxPacketSize+1)
+	for got.Len() < len(data) {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.LessOrEqual(t, n, maxPacketSize)
+		assert.True(t, strings.HasSuffix(string(buf[:n]), "\n"))
+		got.Write(buf[:n])
+	}
+	assert.Equal(t, data, got.String())
+}
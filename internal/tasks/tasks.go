@@ -0,0 +1,350 @@
+// Package tasks runs stored InfluxQL queries on an interval or cron
+// schedule and writes their results into a bucket, like InfluxDB v2 tasks
+// do with Flux. The typical task downsamples raw points:
+//
+//	SELECT mean(value) FROM cpu WHERE time >= :start: AND time < :end: GROUP BY time(1h)
+//
+// :start: and :end: are replaced with the bounds of the run, in
+// nanoseconds, so every run covers the time since the previous one.
+package tasks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/result"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	runsCompleted = metrics.NewCounterVec("refluxdb_tasks_runs_total", "Task runs by outcome", "status")
+	runRetries    = metrics.NewCounter("refluxdb_tasks_retries_total", "Failed task executions that were retried")
+)
+
+const (
+	// DefaultCheckInterval is how often the schedules are checked for due
+	// runs
+	DefaultCheckInterval = time.Second
+	// DefaultRetryDelay is the wait before the first retry of a failed run,
+	// doubled for every further retry
+	DefaultRetryDelay = time.Second
+)
+
+// Executor runs an InfluxQL query against a database
+type Executor func(ctx context.Context, database, query string) (*result.Response, error)
+
+// Options configures a Service
+type Options struct {
+	// CheckInterval is how often the schedules are checked for due runs
+	CheckInterval time.Duration
+	// RetryDelay is the wait before the first retry of a failed run
+	RetryDelay time.Duration
+	// Logger receives run errors. The standard logrus logger is used when
+	// nil.
+	Logger *logrus.Logger
+}
+
+// ScheduleOf returns the schedule of a task
+func ScheduleOf(t persistence.Task) (Schedule, error) {
+	switch {
+	case t.Every > 0 && t.Cron != "":
+		return nil, fmt.Errorf("every and cron are mutually exclusive")
+	case t.Every > 0:
+		return every(t.Every), nil
+	case t.Cron != "":
+		return ParseCron(t.Cron)
+	default:
+		return nil, fmt.Errorf("every or cron is required")
+	}
+}
+
+// Validate checks that a task can be scheduled and run
+func Validate(t persistence.Task) error {
+	if t.Name == "" {
+		return fmt.Errorf("task name is required")
+	}
+	if t.Status != persistence.TaskActive && t.Status != persistence.TaskInactive {
+		return fmt.Errorf("invalid status %q: expected active or inactive", t.Status)
+	}
+	if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(t.Query)), "select") {
+		return fmt.Errorf("query must be an InfluxQL SELECT statement")
+	}
+	if t.Database == "" || t.Destination == "" {
+		return fmt.Errorf("database and destination are required")
+	}
+	if t.Every < 0 || t.Offset < 0 || t.MaxRetries < 0 {
+		return fmt.Errorf("every, offset and maxRetries must not be negative")
+	}
+	schedule, err := ScheduleOf(t)
+	if err != nil {
+		return err
+	}
+	if schedule.Next(time.Now()).IsZero() {
+		return fmt.Errorf("cron expression %q never matches", t.Cron)
+	}
+	return nil
+}
+
+// Initial returns the latest completed time of a task created at now, so
+// that its first run covers a whole interval
+func Initial(t persistence.Task, now time.Time) time.Time {
+	if t.Every > 0 {
+		return now.Truncate(t.Every)
+	}
+	return now.Truncate(time.Minute)
+}
+
+// Service runs the active tasks when they are due
+type Service struct {
+	db      *persistence.Manager
+	opts    Options
+	log     *logrus.Logger
+	now     func() time.Time
+	execute Executor
+
+	mu sync.Mutex
+	// running holds the IDs of the tasks being run by the scheduler
+	running map[string]bool
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New creates a service running the tasks stored in db
+func New(db *persistence.Manager, opts Options) *Service {
+	if opts.CheckInterval <= 0 {
+		opts.CheckInterval = DefaultCheckInterval
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = DefaultRetryDelay
+	}
+	logger := opts.Logger
+	if logger == nil {
+		logger = logrus.StandardLogger()
+	}
+	return &Service{
+		db:      db,
+		opts:    opts,
+		log:     logger,
+		now:     time.Now,
+		running: make(map[string]bool),
+	}
+}
+
+// Start schedules the tasks, running their queries with execute, until
+// ctx is done or Stop is called
+func (s *Service) Start(ctx context.Context, execute Executor) {
+	s.execute = execute
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.opts.CheckInterval)
+		defer ticker.Stop()
+		for {
+			s.schedule(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops scheduling runs and waits for the running ones, which are
+// canceled
+func (s *Service) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+}
+
+// schedule starts the next run of every active task that is due. Runs of
+// a task never overlap, and missed runs are caught up one at a time.
+func (s *Service) schedule(ctx context.Context) {
+	tasks, err := s.db.Tasks()
+	if err != nil {
+		s.log.Errorf("Failed to list tasks: %v", err)
+		return
+	}
+
+	now := s.now()
+	for _, t := range tasks {
+		if t.Status != persistence.TaskActive {
+			continue
+		}
+		schedule, err := ScheduleOf(t)
+		if err != nil {
+			continue
+		}
+		next := schedule.Next(t.LatestCompleted)
+		if next.IsZero() || now.Before(next.Add(t.Offset)) {
+			continue
+		}
+
+		s.mu.Lock()
+		if s.running[t.ID] {
+			s.mu.Unlock()
+			continue
+		}
+		s.running[t.ID] = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.running, t.ID)
+				s.mu.Unlock()
+			}()
+			if _, err := s.Run(ctx, t, t.LatestCompleted, next); err != nil {
+				return
+			}
+			if err := s.db.SetTaskCompleted(t.ID, next); err != nil {
+				s.log.Errorf("Failed to complete task %s: %v", t.Name, err)
+			}
+		}()
+	}
+}
+
+// Run executes a task over the range from start to scheduledFor,
+// retrying up to MaxRetries times, and records the run in its history. A
+// run failing every attempt is recorded as failed, and only storage
+// errors and cancellation are returned.
+func (s *Service) Run(ctx context.Context, t persistence.Task, start, scheduledFor time.Time) (persistence.TaskRun, error) {
+	run := persistence.TaskRun{
+		TaskID:       t.ID,
+		RangeStart:   start,
+		ScheduledFor: scheduledFor,
+		StartedAt:    s.now(),
+	}
+
+	delay := s.opts.RetryDelay
+	var err error
+	for {
+		run.Attempts++
+		run.PointsWritten, err = s.runOnce(ctx, t, start, scheduledFor)
+		if err == nil || run.Attempts > t.MaxRetries || ctx.Err() != nil {
+			break
+		}
+		runRetries.Inc()
+		s.log.Warnf("Task %s failed, retrying in %s: %v", t.Name, delay, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+	if ctx.Err() != nil {
+		return persistence.TaskRun{}, ctx.Err()
+	}
+
+	run.FinishedAt = s.now()
+	run.Status = persistence.RunSuccess
+	if err != nil {
+		run.Status = persistence.RunFailed
+		run.Error = err.Error()
+		s.log.Errorf("Task %s failed after %d attempts: %v", t.Name, run.Attempts, err)
+	}
+	runsCompleted.With(run.Status).Inc()
+	return s.db.AddTaskRun(run)
+}
+
+// runOnce executes the query of a task once and writes its results,
+// returning the number of points written
+func (s *Service) runOnce(ctx context.Context, t persistence.Task, start, end time.Time) (int64, error) {
+	if s.execute == nil {
+		return 0, errors.New("task service is not started")
+	}
+	query := strings.NewReplacer(
+		":start:", strconv.FormatInt(start.UnixNano(), 10),
+		":end:", strconv.FormatInt(end.UnixNano(), 10),
+	).Replace(t.Query)
+
+	resp, err := s.execute(ctx, t.Database, query)
+	if err != nil {
+		return 0, err
+	}
+	if resp.Err != "" {
+		return 0, errors.New(resp.Err)
+	}
+	var points []persistence.Point
+	for _, r := range resp.Results {
+		if r.Err != "" {
+			return 0, errors.New(r.Err)
+		}
+		for _, series := range r.Series {
+			points = AppendPoints(points, t.Destination, series)
+		}
+	}
+	if len(points) == 0 {
+		return 0, nil
+	}
+	if err := s.db.SaveBatch(points); err != nil {
+		return 0, fmt.Errorf("failed to write results: %w", err)
+	}
+	return int64(len(points)), nil
+}
+
+// AppendPoints converts the rows of a series to points of database. The
+// time column is the timestamp, numeric and boolean columns are fields
+// and string columns tags. Rows without a time or a field are skipped.
+func AppendPoints(points []persistence.Point, database string, series *result.Series) []persistence.Point {
+	if series.Name == "" {
+		return points
+	}
+	for _, row := range series.Rows {
+		p := persistence.Point{
+			Database:    database,
+			Measurement: series.Name,
+			Tags:        make(map[string]string, len(series.Tags)),
+			Fields:      make(map[string]float64),
+		}
+		for k, v := range series.Tags {
+			p.Tags[k] = v
+		}
+		hasTime := false
+		for i, col := range series.Columns {
+			if i >= len(row) || row[i] == nil {
+				continue
+			}
+			if col.Type == result.Time {
+				if ts, ok := row[i].(int64); ok {
+					p.Timestamp = ts
+					hasTime = true
+				}
+				continue
+			}
+			switch v := row[i].(type) {
+			case float64:
+				p.Fields[col.Name] = v
+			case int64:
+				p.Fields[col.Name] = float64(v)
+			case int:
+				p.Fields[col.Name] = float64(v)
+			case bool:
+				if v {
+					p.Fields[col.Name] = 1
+				} else {
+					p.Fields[col.Name] = 0
+				}
+			case string:
+				p.Tags[col.Name] = v
+			}
+		}
+		if hasTime && len(p.Fields) > 0 {
+			points = append(points, p)
+		}
+	}
+	return points
+}
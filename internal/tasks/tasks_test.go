@@ -0,0 +1,204 @@
+package tasks
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/result"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCron(t *testing.T) {
+	base := time.Date(2024, 3, 15, 10, 7, 30, 0, time.UTC) // a Friday
+	for _, tc := range []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2024, 3, 15, 10, 8, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 3, 15, 10, 15, 0, 0, time.UTC)},
+		{"5 * * * *", time.Date(2024, 3, 15, 11, 5, 0, 0, time.UTC)},
+		{"0 9-17/4 * * *", time.Date(2024, 3, 15, 13, 0, 0, 0, time.UTC)},
+		{"30 2 1,20 * *", time.Date(2024, 3, 20, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 3, 17, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 1", time.Date(2024, 3, 18, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 3, 15, 11, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		schedule, err := ParseCron(tc.expr)
+		if assert.NoError(t, err, tc.expr) {
+			assert.Equal(t, tc.next, schedule.Next(base), tc.expr)
+		}
+	}
+
+	for _, expr := range []string{"* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		_, err := ParseCron(expr)
+		assert.Error(t, err, expr)
+	}
+
+	never, err := ParseCron("0 0 30 2 *")
+	assert.NoError(t, err)
+	assert.True(t, never.Next(base).IsZero())
+}
+
+func TestEvery(t *testing.T) {
+	base := time.Date(2024, 3, 15, 10, 7, 30, 0, time.UTC)
+	assert.Equal(t, time.Date(2024, 3, 15, 11, 0, 0, 0, time.UTC), every(time.Hour).Next(base))
+	assert.Equal(t, time.Date(2024, 3, 15, 10, 10, 0, 0, time.UTC), every(5*time.Minute).Next(base))
+	assert.Equal(t, time.Date(2024, 3, 15, 10, 10, 0, 0, time.UTC), every(5*time.Minute).Next(time.Date(2024, 3, 15, 10, 5, 0, 0, time.UTC)))
+}
+
+func TestValidate(t *testing.T) {
+	task := persistence.Task{Name: "downsample", Status: persistence.TaskActive, Query: "SELECT mean(value) FROM cpu", Database: "raw", Destination: "hourly", Every: time.Hour}
+	assert.NoError(t, Validate(task))
+
+	for _, tc := range []struct {
+		name   string
+		modify func(*persistence.Task)
+	}{
+		{"name", func(t *persistence.Task) { t.Name = "" }},
+		{"status", func(t *persistence.Task) { t.Status = "paused" }},
+		{"query", func(t *persistence.Task) { t.Query = "DROP DATABASE raw" }},
+		{"destination", func(t *persistence.Task) { t.Destination = "" }},
+		{"schedule", func(t *persistence.Task) { t.Every = 0 }},
+		{"both schedules", func(t *persistence.Task) { t.Cron = "@hourly" }},
+		{"cron", func(t *persistence.Task) { t.Every, t.Cron = 0, "0 0 30 2 *" }},
+		{"retries", func(t *persistence.Task) { t.MaxRetries = -1 }},
+	} {
+		tk := task
+		tc.modify(&tk)
+		assert.Error(t, Validate(tk), tc.name)
+	}
+}
+
+func TestAppendPoints(t *testing.T) {
+	series := &result.Series{
+		Name:    "cpu",
+		Tags:    map[string]string{"host": "a"},
+		Columns: []result.Column{{Name: "time", Type: result.Time}, {Name: "mean", Type: result.Float}, {Name: "region", Type: result.String}, {Name: "up", Type: result.Boolean}},
+		Rows: []result.Row{
+			{int64(3600e9), 1.5, "eu", true},
+			{int64(7200e9), nil, "eu", nil},
+		},
+	}
+	points := AppendPoints(nil, "hourly", series)
+	if assert.Len(t, points, 1) {
+		assert.Equal(t, "hourly", points[0].Database)
+		assert.Equal(t, "cpu", points[0].Measurement)
+		assert.Equal(t, map[string]string{"host": "a", "region": "eu"}, points[0].Tags)
+		assert.Equal(t, map[string]float64{"mean": 1.5, "up": 1}, points[0].Fields)
+		assert.Equal(t, time.Unix(3600, 0).UnixNano(), points[0].Timestamp)
+	}
+}
+
+func TestRun(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	task, err := db.AddTask(persistence.Task{Name: "downsample", Status: persistence.TaskActive, Query: "SELECT mean(value) FROM cpu WHERE time >= :start: AND time < :end:", Database: "raw", Destination: "hourly", Every: time.Hour, MaxRetries: 2})
+	assert.NoError(t, err)
+
+	var calls atomic.Int32
+	var queries []string
+	execute := func(ctx context.Context, database, query string) (*result.Response, error) {
+		queries = append(queries, query)
+		if calls.Add(1) < 3 {
+			return nil, errors.New("database is locked")
+		}
+		return &result.Response{Results: []*result.Result{{Series: []*result.Series{{
+			Name:    "cpu",
+			Columns: []result.Column{{Name: "time", Type: result.Time}, {Name: "mean", Type: result.Float}},
+			Rows:    []result.Row{{int64(0), 2.5}},
+		}}}}}, nil
+	}
+
+	svc := New(db, Options{RetryDelay: time.Millisecond})
+	svc.execute = execute
+	start, end := time.Unix(0, 0), time.Unix(3600, 0)
+	run, err := svc.Run(context.Background(), task, start, end)
+	assert.NoError(t, err)
+	assert.Equal(t, persistence.RunSuccess, run.Status)
+	assert.Equal(t, 3, run.Attempts)
+	assert.Equal(t, int64(1), run.PointsWritten)
+	assert.Equal(t, "SELECT mean(value) FROM cpu WHERE time >= 0 AND time < 3600000000000", queries[0])
+
+	points, err := db.GetMeasurementRange("hourly", "cpu", 0, 1)
+	assert.NoError(t, err)
+	if assert.Len(t, points, 1) {
+		assert.Equal(t, map[string]float64{"mean": 2.5}, points[0].Fields)
+	}
+
+	// Runs failing every attempt are recorded as failed
+	calls.Store(-10)
+	run, err = svc.Run(context.Background(), task, start, end)
+	assert.NoError(t, err)
+	assert.Equal(t, persistence.RunFailed, run.Status)
+	assert.Equal(t, 3, run.Attempts)
+	assert.Equal(t, "database is locked", run.Error)
+
+	runs, err := db.TaskRuns(task.ID, 0)
+	assert.NoError(t, err)
+	assert.Len(t, runs, 2)
+}
+
+func TestSchedule(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	created := time.Date(2024, 3, 15, 10, 0, 0, 0, time.UTC)
+	task := persistence.Task{Name: "downsample", Status: persistence.TaskActive, Query: "SELECT mean(value) FROM cpu", Database: "raw", Destination: "hourly", Every: time.Hour, Offset: time.Minute}
+	task.LatestCompleted = Initial(task, created.Add(30*time.Minute))
+	task, err = db.AddTask(task)
+	assert.NoError(t, err)
+	paused, err := db.AddTask(persistence.Task{Name: "paused", Status: persistence.TaskInactive, Query: "SELECT 1", Database: "raw", Destination: "hourly", Every: time.Minute})
+	assert.NoError(t, err)
+
+	var ranges [][2]time.Time
+	ran := make(chan struct{}, 10)
+	svc := New(db, Options{})
+	svc.execute = func(ctx context.Context, database, query string) (*result.Response, error) {
+		ran <- struct{}{}
+		return &result.Response{}, nil
+	}
+	tick := func(now time.Time) {
+		svc.now = func() time.Time { return now }
+		svc.schedule(context.Background())
+		svc.wg.Wait()
+	}
+
+	// Due at 11:00, but delayed by the offset
+	tick(created.Add(time.Hour))
+	assert.Len(t, ran, 0)
+	tick(created.Add(time.Hour + time.Minute))
+	assert.Len(t, ran, 1)
+
+	// Missed runs are caught up one interval at a time
+	tick(created.Add(3*time.Hour + time.Minute))
+	tick(created.Add(3*time.Hour + time.Minute))
+	tick(created.Add(3*time.Hour + time.Minute))
+	assert.Len(t, ran, 3)
+
+	runs, err := db.TaskRuns(task.ID, 0)
+	assert.NoError(t, err)
+	for _, r := range runs {
+		ranges = append(ranges, [2]time.Time{r.RangeStart, r.ScheduledFor})
+	}
+	assert.Equal(t, [][2]time.Time{
+		{created.Add(2 * time.Hour), created.Add(3 * time.Hour)},
+		{created.Add(time.Hour), created.Add(2 * time.Hour)},
+		{created, created.Add(time.Hour)},
+	}, ranges)
+	task, err = db.GetTask(task.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, created.Add(3*time.Hour), task.LatestCompleted)
+
+	runs, err = db.TaskRuns(paused.ID, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, runs)
+}
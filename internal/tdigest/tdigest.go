@@ -0,0 +1,210 @@
+// Package tdigest estimates quantiles and cumulative distributions of a
+// stream of values with a merging t-digest (Dunning & Ertl, "Computing
+// Extremely Accurate Quantiles Using t-Digests").
+//
+// A digest summarizes any number of values in a few hundred centroids, so
+// the percentiles of millions of points can be computed while they are
+// scanned, without keeping them. Estimates are most accurate at the tails:
+// with the default compression, quantiles such as p99 are typically within
+// a fraction of a percent of their exact rank. Digests of parts of a
+// stream can be merged into the digest of the whole.
+package tdigest
+
+import (
+	"math"
+	"sort"
+)
+
+// DefaultCompression bounds the number of centroids of a digest to about
+// 100, trading memory for accuracy
+const DefaultCompression = 100
+
+// Centroid is the mean of Count values
+type Centroid struct {
+	Mean  float64
+	Count float64
+}
+
+// TDigest is a t-digest. The zero value is not usable; create digests
+// with New.
+type TDigest struct {
+	compression float64
+	centroids   []Centroid
+	// buffer holds the values added since the last compression
+	buffer   []Centroid
+	count    float64
+	min, max float64
+}
+
+// New returns an empty digest. Higher compressions keep more centroids
+// and give more accurate estimates; zero or less uses DefaultCompression.
+func New(compression float64) *TDigest {
+	if compression <= 0 {
+		compression = DefaultCompression
+	}
+	return &TDigest{compression: compression, min: math.Inf(1), max: math.Inf(-1)}
+}
+
+// Add adds a value. NaN values are ignored.
+func (d *TDigest) Add(x float64) {
+	d.AddWeighted(x, 1)
+}
+
+// AddWeighted adds a value seen count times
+func (d *TDigest) AddWeighted(x, count float64) {
+	if math.IsNaN(x) || count <= 0 {
+		return
+	}
+	d.buffer = append(d.buffer, Centroid{Mean: x, Count: count})
+	d.count += count
+	d.min = math.Min(d.min, x)
+	d.max = math.Max(d.max, x)
+	if len(d.buffer) >= int(5*d.compression) {
+		d.compress()
+	}
+}
+
+// Merge adds the values summarized by other
+func (d *TDigest) Merge(other *TDigest) {
+	other.compress()
+	for _, c := range other.centroids {
+		d.AddWeighted(c.Mean, c.Count)
+	}
+}
+
+// Count returns the number of values added
+func (d *TDigest) Count() float64 {
+	return d.count
+}
+
+// Min returns the smallest value added, or NaN when the digest is empty
+func (d *TDigest) Min() float64 {
+	if d.count == 0 {
+		return math.NaN()
+	}
+	return d.min
+}
+
+// Max returns the largest value added, or NaN when the digest is empty
+func (d *TDigest) Max() float64 {
+	if d.count == 0 {
+		return math.NaN()
+	}
+	return d.max
+}
+
+// Centroids returns the centroids of the digest, sorted by mean
+func (d *TDigest) Centroids() []Centroid {
+	d.compress()
+	return append([]Centroid(nil), d.centroids...)
+}
+
+// Quantile returns an estimate of the value below which a fraction q of
+// the values fall, or NaN when the digest is empty
+func (d *TDigest) Quantile(q float64) float64 {
+	d.compress()
+	n := len(d.centroids)
+	switch {
+	case n == 0 || math.IsNaN(q):
+		return math.NaN()
+	case q <= 0:
+		return d.min
+	case q >= 1:
+		return d.max
+	case n == 1:
+		return d.centroids[0].Mean
+	}
+
+	// Values are interpolated between the centers of the centroids, each
+	// center standing at the middle of the weight of its centroid, and
+	// between the extreme values and the outer centers
+	target := q * d.count
+	cum := 0.0
+	for i, c := range d.centroids {
+		center := cum + c.Count/2
+		if target < center {
+			if i == 0 {
+				return interpolate(d.min, c.Mean, target/center)
+			}
+			prev := d.centroids[i-1]
+			prevCenter := cum - prev.Count/2
+			return interpolate(prev.Mean, c.Mean, (target-prevCenter)/(center-prevCenter))
+		}
+		cum += c.Count
+	}
+	last := d.centroids[n-1]
+	lastCenter := d.count - last.Count/2
+	return interpolate(last.Mean, d.max, (target-lastCenter)/(d.count-lastCenter))
+}
+
+// CDF returns an estimate of the fraction of the values less than or
+// equal to x, or NaN when the digest is empty
+func (d *TDigest) CDF(x float64) float64 {
+	d.compress()
+	n := len(d.centroids)
+	switch {
+	case n == 0 || math.IsNaN(x):
+		return math.NaN()
+	case x < d.min:
+		return 0
+	case x >= d.max:
+		return 1
+	case n == 1:
+		return (x - d.min) / (d.max - d.min)
+	}
+
+	cum := 0.0
+	for i, c := range d.centroids {
+		center := cum + c.Count/2
+		if x < c.Mean {
+			if i == 0 {
+				return center * (x - d.min) / (c.Mean - d.min) / d.count
+			}
+			prev := d.centroids[i-1]
+			prevCenter := cum - prev.Count/2
+			return (prevCenter + (center-prevCenter)*(x-prev.Mean)/(c.Mean-prev.Mean)) / d.count
+		}
+		cum += c.Count
+	}
+	last := d.centroids[n-1]
+	lastCenter := d.count - last.Count/2
+	return (lastCenter + (d.count-lastCenter)*(x-last.Mean)/(d.max-last.Mean)) / d.count
+}
+
+// compress merges the buffered values into the centroids. Neighboring
+// centroids are merged as long as they span at most one unit of the
+// scale function, which keeps centroids small near the tails.
+func (d *TDigest) compress() {
+	if len(d.buffer) == 0 {
+		return
+	}
+	all := make([]Centroid, 0, len(d.centroids)+len(d.buffer))
+	all = append(append(all, d.centroids...), d.buffer...)
+	sort.Slice(all, func(i, j int) bool { return all[i].Mean < all[j].Mean })
+
+	merged := all[:1]
+	// before is the weight of the centroids preceding the last one
+	before := 0.0
+	for _, c := range all[1:] {
+		last := &merged[len(merged)-1]
+		if d.scale((before+last.Count+c.Count)/d.count)-d.scale(before/d.count) <= 1 {
+			last.Count += c.Count
+			last.Mean += (c.Mean - last.Mean) * c.Count / last.Count
+			continue
+		}
+		before += last.Count
+		merged = append(merged, c)
+	}
+	d.centroids = merged
+	d.buffer = d.buffer[:0]
+}
+
+// scale is the k1 scale function, mapping a quantile to the number of
+// centroids that may precede it
+func (d *TDigest) scale(q float64) float64 {
+	return d.compression / (2 * math.Pi) * math.Asin(2*math.Min(q, 1)-1)
+}
+
+func interpolate(a, b, t float64) float64 {
+	return a + (b-a)*t
+}
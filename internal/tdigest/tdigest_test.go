@@ -0,0 +1,74 @@
+package tdigest
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuantile(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	values := make([]float64, 100000)
+	d := New(0)
+	for i := range values {
+		// A long tailed latency distribution
+		values[i] = math.Exp(rng.NormFloat64())
+		d.Add(values[i])
+	}
+	sort.Float64s(values)
+
+	assert.Equal(t, float64(len(values)), d.Count())
+	assert.Equal(t, values[0], d.Min())
+	assert.Equal(t, values[len(values)-1], d.Max())
+	assert.Less(t, len(d.Centroids()), 200)
+
+	for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99, 0.999} {
+		// The estimate ranks close to q
+		rank := float64(sort.SearchFloat64s(values, d.Quantile(q))) / float64(len(values))
+		assert.InDelta(t, q, rank, 0.005, "q=%v", q)
+		assert.InDelta(t, q, d.CDF(values[int(q*float64(len(values)))]), 0.005, "q=%v", q)
+	}
+	assert.Equal(t, d.Min(), d.Quantile(0))
+	assert.Equal(t, d.Max(), d.Quantile(1))
+	assert.Equal(t, float64(0), d.CDF(d.Min()-1))
+	assert.Equal(t, float64(1), d.CDF(d.Max()))
+}
+
+func TestSmallDigests(t *testing.T) {
+	d := New(0)
+	assert.True(t, math.IsNaN(d.Quantile(0.5)))
+	assert.True(t, math.IsNaN(d.CDF(1)))
+	assert.True(t, math.IsNaN(d.Min()))
+
+	d.Add(3)
+	assert.Equal(t, float64(3), d.Quantile(0.5))
+	assert.Equal(t, float64(1), d.CDF(3))
+
+	for _, v := range []float64{1, 2, 4, 5, math.NaN()} {
+		d.Add(v)
+	}
+	assert.Equal(t, float64(5), d.Count())
+	assert.Equal(t, float64(3), d.Quantile(0.5))
+	assert.InDelta(t, 0.5, d.CDF(3), 1e-9)
+	assert.Equal(t, float64(1), d.Quantile(0.05))
+}
+
+func TestMerge(t *testing.T) {
+	whole, parts := New(0), []*TDigest{New(0), New(0), New(0)}
+	for i := 0; i < 30000; i++ {
+		v := float64(i % 1000)
+		whole.Add(v)
+		parts[i%3].Add(v)
+	}
+	merged := New(0)
+	for _, p := range parts {
+		merged.Merge(p)
+	}
+	assert.Equal(t, whole.Count(), merged.Count())
+	for _, q := range []float64{0.05, 0.5, 0.95} {
+		assert.InDelta(t, whole.Quantile(q), merged.Quantile(q), 5, "q=%v", q)
+	}
+}
@@ -0,0 +1,211 @@
+// Package templates extracts measurements, tags and fields from flat,
+// dot separated metric names such as the ones sent by Graphite and StatsD
+// clients, using the template syntax of InfluxDB's Graphite input.
+//
+// A template is made of an optional filter, a pattern and optional default
+// tags, separated by spaces:
+//
+//	servers.*.cpu.* .host.measurement.field region=us-west
+//
+// The filter selects the names the template applies to: each of its parts
+// must equal the part of the name at the same position, or be "*". The
+// pattern then names every part of the name:
+//
+//   - "measurement" parts are joined with dots into the measurement
+//   - "field" parts are joined with dots into the field name
+//   - "measurement*" and "field*" consume the remaining parts
+//   - empty parts are skipped
+//   - any other word turns the part into the value of a tag of that name
+//
+// With the template above, "servers.web1.cpu.idle" becomes measurement
+// "cpu" with tags host=web1 and region=us-west and field "idle". When
+// several filters match a name, the one with the most parts wins, then the
+// one with the fewest wildcards. A template without a filter applies to
+// the names no filter matches.
+package templates
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Template is a parsed template
+type Template struct {
+	filter []string
+	parts  []string
+	tags   map[string]string
+}
+
+// Set is the list of templates applied to incoming names
+type Set struct {
+	filtered []*Template
+	fallback *Template
+}
+
+// Parse parses templates. It returns nil when there are none.
+func Parse(specs []string) (*Set, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+
+	set := &Set{}
+	for _, spec := range specs {
+		t, err := parseTemplate(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template %q: %w", spec, err)
+		}
+		if t.filter == nil {
+			if set.fallback != nil {
+				return nil, fmt.Errorf("invalid template %q: only one template may omit the filter", spec)
+			}
+			set.fallback = t
+			continue
+		}
+		set.filtered = append(set.filtered, t)
+	}
+	return set, nil
+}
+
+func parseTemplate(spec string) (*Template, error) {
+	words := strings.Fields(spec)
+	t := &Template{tags: make(map[string]string)}
+
+	// Default tags are the last word when it holds key=value pairs
+	if n := len(words); n > 1 && strings.Contains(words[n-1], "=") {
+		for _, pair := range strings.Split(words[n-1], ",") {
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok || k == "" || v == "" {
+				return nil, fmt.Errorf("invalid default tag %q", pair)
+			}
+			t.tags[k] = v
+		}
+		words = words[:n-1]
+	}
+
+	switch len(words) {
+	case 1:
+		t.parts = strings.Split(words[0], ".")
+	case 2:
+		t.filter = strings.Split(words[0], ".")
+		t.parts = strings.Split(words[1], ".")
+	default:
+		return nil, fmt.Errorf("expected [filter] pattern [tags]")
+	}
+
+	for i, part := range t.parts {
+		if (part == "measurement*" || part == "field*") && i != len(t.parts)-1 {
+			return nil, fmt.Errorf("%s must be the last part of the pattern", part)
+		}
+	}
+	for _, part := range t.filter {
+		if part == "" {
+			return nil, fmt.Errorf("empty filter part")
+		}
+	}
+	return t, nil
+}
+
+// matches reports whether the filter of t selects the parts of a name
+func (t *Template) matches(parts []string) bool {
+	if len(parts) < len(t.filter) {
+		return false
+	}
+	for i, f := range t.filter {
+		if f != "*" && f != parts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// moreSpecific reports whether the filter of t takes precedence over the
+// filter of other
+func (t *Template) moreSpecific(other *Template) bool {
+	if len(t.filter) != len(other.filter) {
+		return len(t.filter) > len(other.filter)
+	}
+	return wildcards(t.filter) < wildcards(other.filter)
+}
+
+func wildcards(filter []string) int {
+	n := 0
+	for _, part := range filter {
+		if part == "*" {
+			n++
+		}
+	}
+	return n
+}
+
+// Result is a name split by a template
+type Result struct {
+	Measurement string
+	Tags        map[string]string
+	// Field is empty when the pattern has no field part
+	Field string
+}
+
+// Apply splits name with the template that matches it. It returns false
+// when no template applies, in which case name should be kept as is.
+func (s *Set) Apply(name string) (Result, bool) {
+	if s == nil {
+		return Result{}, false
+	}
+
+	parts := strings.Split(name, ".")
+	var best *Template
+	for _, t := range s.filtered {
+		if t.matches(parts) && (best == nil || t.moreSpecific(best)) {
+			best = t
+		}
+	}
+	if best == nil {
+		best = s.fallback
+	}
+	if best == nil {
+		return Result{}, false
+	}
+	return best.apply(name, parts), true
+}
+
+func (t *Template) apply(name string, parts []string) Result {
+	var measurement, field []string
+	tags := make(map[string]string, len(t.tags))
+	for k, v := range t.tags {
+		tags[k] = v
+	}
+
+	for i, part := range parts {
+		if i >= len(t.parts) {
+			break
+		}
+		switch p := t.parts[i]; p {
+		case "":
+		case "measurement":
+			measurement = append(measurement, part)
+		case "field":
+			field = append(field, part)
+		case "measurement*":
+			measurement = append(measurement, parts[i:]...)
+		case "field*":
+			field = append(field, parts[i:]...)
+		default:
+			if v, ok := tags[p]; ok && t.tags[p] == "" {
+				tags[p] = v + "." + part
+			} else {
+				tags[p] = part
+			}
+		}
+	}
+
+	r := Result{
+		Measurement: strings.Join(measurement, "."),
+		Tags:        tags,
+		Field:       strings.Join(field, "."),
+	}
+	// Patterns without a measurement part keep the whole name
+	if r.Measurement == "" {
+		r.Measurement = name
+	}
+	return r
+}
@@ -0,0 +1,90 @@
+package templates
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApply(t *testing.T) {
+	set, err := Parse([]string{
+		"servers.*.cpu.* .host.measurement.field region=us-west",
+		"servers.* .host.measurement*",
+		"stats.*.* ..measurement.field*",
+		"measurement.host.host",
+	})
+	assert.NoError(t, err)
+
+	r, ok := set.Apply("servers.web1.cpu.idle")
+	assert.True(t, ok)
+	assert.Equal(t, Result{
+		Measurement: "cpu",
+		Tags:        map[string]string{"host": "web1", "region": "us-west"},
+		Field:       "idle",
+	}, r)
+
+	// The longer filter wins, the shorter one handles the other names
+	r, ok = set.Apply("servers.web1.disk.sda.used")
+	assert.True(t, ok)
+	assert.Equal(t, "disk.sda.used", r.Measurement)
+	assert.Equal(t, map[string]string{"host": "web1"}, r.Tags)
+	assert.Equal(t, "", r.Field)
+
+	r, ok = set.Apply("stats.gauges.requests.api.latency")
+	assert.True(t, ok)
+	assert.Equal(t, "requests", r.Measurement)
+	assert.Equal(t, "api.latency", r.Field)
+
+	// Names no filter matches use the template without one, repeated tags
+	// are joined
+	r, ok = set.Apply("load.eu.web1")
+	assert.True(t, ok)
+	assert.Equal(t, "load", r.Measurement)
+	assert.Equal(t, map[string]string{"host": "eu.web1"}, r.Tags)
+}
+
+func TestApplySpecificity(t *testing.T) {
+	set, err := Parse([]string{
+		"a.* measurement.wild",
+		"a.b measurement.exact",
+	})
+	assert.NoError(t, err)
+
+	r, ok := set.Apply("a.b")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"exact": "b"}, r.Tags)
+
+	// Without a template for them, names are kept as is
+	_, ok = set.Apply("x.y")
+	assert.False(t, ok)
+
+	// Patterns without a measurement part keep the whole name
+	set, err = Parse([]string{".host"})
+	assert.NoError(t, err)
+	r, _ = set.Apply("a.b")
+	assert.Equal(t, "a.b", r.Measurement)
+
+	var none *Set
+	_, ok = none.Apply("a.b")
+	assert.False(t, ok)
+}
+
+func TestParseErrors(t *testing.T) {
+	set, err := Parse(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, set)
+
+	for _, spec := range []string{
+		"",
+		"a.* measurement extra tags",
+		"a.* measurement host=",
+		"measurement*.host",
+		"a..b measurement",
+	} {
+		_, err := Parse([]string{spec})
+		assert.Error(t, err, spec)
+	}
+
+	_, err = Parse([]string{"measurement", "measurement.host"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,170 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// statusError is the OTLP status code of a failed span
+const statusError = 2
+
+// The types below are the OTLP/HTTP JSON encoding of an
+// ExportTraceServiceRequest, limited to the fields refluxdb sends
+
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []spanJSON `json:"spans"`
+}
+
+type scope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type spanJSON struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              Kind        `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []keyValue  `json:"attributes,omitempty"`
+	Status            *statusJSON `json:"status,omitempty"`
+}
+
+type statusJSON struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+// anyValue holds one of its fields. Integers are strings, as 64 bit
+// integers are in the protobuf JSON mapping.
+type anyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+// valueOf encodes an attribute value
+func valueOf(v interface{}) anyValue {
+	switch v := v.(type) {
+	case string:
+		return anyValue{StringValue: &v}
+	case bool:
+		return anyValue{BoolValue: &v}
+	case int:
+		s := strconv.Itoa(v)
+		return anyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return anyValue{IntValue: &s}
+	case float64:
+		return anyValue{DoubleValue: &v}
+	default:
+		s := fmt.Sprint(v)
+		return anyValue{StringValue: &s}
+	}
+}
+
+// encode returns the export request of spans
+func (t *Tracer) encode(spans []*Span) exportRequest {
+	attrs := []keyValue{{Key: "service.name", Value: valueOf(t.opts.ServiceName)}}
+	if t.opts.ServiceVersion != "" {
+		attrs = append(attrs, keyValue{Key: "service.version", Value: valueOf(t.opts.ServiceVersion)})
+	}
+
+	encoded := make([]spanJSON, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		span := spanJSON{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attrs {
+			span.Attributes = append(span.Attributes, keyValue{Key: a.key, Value: valueOf(a.value)})
+		}
+		if s.err != "" {
+			span.Status = &statusJSON{Code: statusError, Message: s.err}
+		}
+		s.mu.Unlock()
+		encoded = append(encoded, span)
+	}
+
+	return exportRequest{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: attrs},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: "refluxdb", Version: t.opts.ServiceVersion}, Spans: encoded}},
+	}}}
+}
+
+// export sends spans to the collector. Spans the collector did not accept
+// are counted as dropped, as retrying would delay the next batches.
+func (t *Tracer) export(ctx context.Context, spans []*Span) {
+	if len(spans) == 0 {
+		return
+	}
+	if err := t.send(ctx, spans); err != nil {
+		spansDropped.Add(uint64(len(spans)))
+		t.opts.Logger.WithError(err).WithField("spans", len(spans)).Warn("Failed to export spans")
+		return
+	}
+	spansExported.Add(uint64(len(spans)))
+}
+
+func (t *Tracer) send(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(t.encode(spans))
+	if err != nil {
+		return fmt.Errorf("failed to encode spans: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create export request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range t.opts.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := t.opts.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send spans: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
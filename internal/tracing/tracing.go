@@ -0,0 +1,393 @@
+// Package tracing records spans of the write and query paths and exports
+// them to an OpenTelemetry collector over OTLP/HTTP, in its JSON encoding,
+// so operators can see where the latency of a request goes.
+//
+// Spans are carried in contexts. A Tracer starts the span of a request and
+// the code it calls starts child spans with Start, which does nothing when
+// the context carries no span, as when tracing is disabled or the trace
+// was not sampled:
+//
+//	ctx, span := tracing.Start(ctx, "storage.commit")
+//	defer span.End()
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	spansExported = metrics.NewCounter("refluxdb_tracing_spans_exported_total", "Spans sent to the trace collector")
+	spansDropped  = metrics.NewCounter("refluxdb_tracing_spans_dropped_total", "Spans lost because the export queue was full or the collector failed")
+)
+
+const (
+	// DefaultServiceName names the service in the exported resource
+	DefaultServiceName = "refluxdb"
+	// DefaultBatchSize is the number of spans sent in one export request
+	DefaultBatchSize = 512
+	// DefaultFlushInterval is how often the pending spans are exported
+	DefaultFlushInterval = 5 * time.Second
+	// DefaultQueueSize is the number of ended spans waiting for export.
+	// Further spans are dropped.
+	DefaultQueueSize = 4096
+	// tracesPath is the path of the OTLP/HTTP traces endpoint
+	tracesPath = "/v1/traces"
+)
+
+// Kind is the OpenTelemetry kind of a span
+type Kind int
+
+const (
+	// KindInternal is an operation within refluxdb
+	KindInternal Kind = 1
+	// KindServer is a request served by refluxdb
+	KindServer Kind = 2
+)
+
+// Options configures a Tracer
+type Options struct {
+	// Endpoint is the OTLP/HTTP traces URL of the collector, such as
+	// http://localhost:4318/v1/traces. A URL without a path gets the
+	// /v1/traces path.
+	Endpoint string
+	// SampleRate is the fraction of the traces started by refluxdb that
+	// are recorded, from 0 to 1. Traces that an upstream service sampled
+	// are always recorded.
+	SampleRate float64
+	// ServiceName and ServiceVersion describe refluxdb in the exported
+	// resource. ServiceName defaults to DefaultServiceName.
+	ServiceName    string
+	ServiceVersion string
+	// Headers are added to the export requests, for collectors requiring
+	// credentials
+	Headers map[string]string
+	// BatchSize, FlushInterval and QueueSize default to DefaultBatchSize,
+	// DefaultFlushInterval and DefaultQueueSize when zero
+	BatchSize     int
+	FlushInterval time.Duration
+	QueueSize     int
+	// Client sends the export requests, with a 10 second timeout when nil
+	Client *http.Client
+	// Logger receives export errors. The standard logrus logger is used
+	// when nil.
+	Logger *logrus.Logger
+}
+
+// Validate checks the endpoint and sample rate
+func (o Options) Validate() error {
+	u, err := url.Parse(o.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q: expected an http or https URL", o.Endpoint)
+	}
+	if o.SampleRate < 0 || o.SampleRate > 1 || math.IsNaN(o.SampleRate) {
+		return fmt.Errorf("invalid sample rate %v: must be between 0 and 1", o.SampleRate)
+	}
+	return nil
+}
+
+// Tracer starts the spans of the requests served by refluxdb and exports
+// them once they end. A nil Tracer records nothing.
+type Tracer struct {
+	opts     Options
+	endpoint string
+	// threshold is the largest trace ID, in its last 8 bytes, of the
+	// sampled traces. Comparing IDs rather than drawing lots keeps the
+	// decision consistent with other services sampling at the same rate.
+	threshold uint64
+	queue     chan *Span
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New creates a tracer exporting to the collector of opts
+func New(opts Options) (*Tracer, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	endpoint := opts.Endpoint
+	if u, _ := url.Parse(endpoint); u.Path == "" || u.Path == "/" {
+		u.Path = tracesPath
+		endpoint = u.String()
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = DefaultServiceName
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultFlushInterval
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.Logger == nil {
+		opts.Logger = logrus.StandardLogger()
+	}
+
+	threshold := uint64(math.MaxUint64)
+	if opts.SampleRate < 1 {
+		threshold = uint64(opts.SampleRate * math.MaxUint64)
+	}
+	return &Tracer{
+		opts:      opts,
+		endpoint:  endpoint,
+		threshold: threshold,
+		queue:     make(chan *Span, opts.QueueSize),
+	}, nil
+}
+
+// Remote is the trace context of the upstream service a request came
+// from, with hexadecimal IDs
+type Remote struct {
+	TraceID string
+	SpanID  string
+	// Sampled is set when the upstream service records the trace
+	Sampled bool
+}
+
+// StartSpan starts the span of a request, continuing the trace of remote
+// when it is not nil. It returns ctx and a nil span when the trace is not
+// sampled.
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind Kind, remote *Remote) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	sampled := false
+	if remote != nil && decodeID(s.traceID[:], remote.TraceID) && decodeID(s.parentID[:], remote.SpanID) {
+		sampled = remote.Sampled
+	} else {
+		s.traceID, s.parentID = [16]byte{}, [8]byte{}
+		binary.BigEndian.PutUint64(s.traceID[:8], nonZero())
+		binary.BigEndian.PutUint64(s.traceID[8:], nonZero())
+	}
+	if !sampled && binary.BigEndian.Uint64(s.traceID[8:]) > t.threshold {
+		return ctx, nil
+	}
+	binary.BigEndian.PutUint64(s.spanID[:], nonZero())
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Start starts a span within the span carried by ctx. It returns ctx and
+// a nil span when ctx carries none.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.child(name, time.Now())
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// Record records an operation of the span carried by ctx that ran from
+// start to end, for phases timed before they can be traced
+func Record(ctx context.Context, name string, start, end time.Time) {
+	if parent := FromContext(ctx); parent != nil {
+		parent.child(name, start).EndAt(end)
+	}
+}
+
+type spanKey struct{}
+
+// FromContext returns the span carried by ctx, or nil
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start binds the exporter, which sends the ended spans until ctx is done
+// or Stop is called
+func (t *Tracer) Start(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	ctx, t.cancel = context.WithCancel(ctx)
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		t.run(ctx)
+	}()
+}
+
+// Stop exports the spans that ended and stops the exporter
+func (t *Tracer) Stop() {
+	if t == nil || t.cancel == nil {
+		return
+	}
+	t.cancel()
+	t.wg.Wait()
+}
+
+// run batches the ended spans until ctx is done, then exports the
+// remaining ones
+func (t *Tracer) run(ctx context.Context) {
+	ticker := time.NewTicker(t.opts.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) >= t.opts.BatchSize {
+				t.export(context.Background(), batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.export(ctx, batch)
+			batch = nil
+		case <-ctx.Done():
+		drain:
+			for {
+				select {
+				case s := <-t.queue:
+					batch = append(batch, s)
+				default:
+					break drain
+				}
+			}
+			for len(batch) > 0 {
+				n := min(len(batch), t.opts.BatchSize)
+				t.export(context.Background(), batch[:n])
+				batch = batch[n:]
+			}
+			return
+		}
+	}
+}
+
+// enqueue hands an ended span to the exporter, dropping it when the queue
+// is full
+func (t *Tracer) enqueue(s *Span) {
+	select {
+	case t.queue <- s:
+	default:
+		spansDropped.Inc()
+	}
+}
+
+// Span is a timed operation of a trace. A nil Span ignores every call, so
+// callers need not check whether tracing is enabled.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     Kind
+	start    time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []attribute
+	err   string
+	ended bool
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// child returns a new span of the same trace under s
+func (s *Span) child(name string, start time.Time) *Span {
+	c := &Span{tracer: s.tracer, traceID: s.traceID, parentID: s.spanID, name: name, kind: KindInternal, start: start}
+	binary.BigEndian.PutUint64(c.spanID[:], nonZero())
+	return c
+}
+
+// TraceID returns the hexadecimal ID of the trace of s
+func (s *Span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// SetAttribute records a string, integer, float or boolean value on s.
+// Other values are recorded as their text.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs = append(s.attrs, attribute{key: key, value: value})
+	s.mu.Unlock()
+}
+
+// SetError marks s as failed with err. A nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err.Error()
+	s.mu.Unlock()
+}
+
+// End ends s now and queues it for export. Spans are exported once.
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt ends s at the given time
+func (s *Span) EndAt(end time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended, s.end = true, end
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+// decodeID decodes the hexadecimal ID s into the non-zero bytes of id
+func decodeID(id []byte, s string) bool {
+	if hex.DecodedLen(len(s)) != len(id) {
+		// B3 trace IDs may be 64 bits, the low half of a 128 bit ID
+		if len(id) != 16 || len(s) != 16 {
+			return false
+		}
+		clear(id[:8])
+		id = id[8:]
+	}
+	if _, err := hex.Decode(id, []byte(s)); err != nil {
+		return false
+	}
+	for _, b := range id {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// nonZero returns a random ID half, never zero as zero IDs are invalid
+func nonZero() uint64 {
+	for {
+		if v := rand.Uint64(); v != 0 {
+			return v
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// collector records the export requests it receives
+type collector struct {
+	mu       sync.Mutex
+	requests []exportRequest
+	headers  []http.Header
+	paths    []string
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	c.requests = append(c.requests, req)
+	c.headers = append(c.headers, r.Header)
+	c.paths = append(c.paths, r.URL.Path)
+	c.mu.Unlock()
+}
+
+func (c *collector) spans() []spanJSON {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var spans []spanJSON
+	for _, req := range c.requests {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+func TestExport(t *testing.T) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	defer srv.Close()
+
+	tracer, err := New(Options{Endpoint: srv.URL, SampleRate: 1, ServiceVersion: "1.2.3", Headers: map[string]string{"Authorization": "Bearer secret"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	tracer.Start(context.Background())
+
+	ctx, root := tracer.StartSpan(context.Background(), "POST /write", KindServer, nil)
+	if !assert.NotNil(t, root) {
+		return
+	}
+	root.SetAttribute("http.status_code", 204)
+	_, commit := Start(ctx, "storage.commit")
+	commit.SetAttribute("points", int64(3))
+	commit.SetError(errors.New("disk full"))
+	commit.End()
+	start := time.Unix(100, 0)
+	Record(ctx, "query.parse", start, start.Add(time.Millisecond))
+	root.End()
+	root.End()
+	tracer.Stop()
+
+	spans := c.spans()
+	if !assert.Len(t, spans, 3) {
+		return
+	}
+	byName := map[string]spanJSON{}
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+	server, storage, parse := byName["POST /write"], byName["storage.commit"], byName["query.parse"]
+
+	assert.Equal(t, root.TraceID(), server.TraceID)
+	assert.Len(t, server.TraceID, 32)
+	assert.Len(t, server.SpanID, 16)
+	assert.Empty(t, server.ParentSpanID)
+	assert.Equal(t, KindServer, server.Kind)
+	assert.Equal(t, "204", *server.Attributes[0].Value.IntValue)
+
+	assert.Equal(t, server.TraceID, storage.TraceID)
+	assert.Equal(t, server.SpanID, storage.ParentSpanID)
+	assert.Equal(t, KindInternal, storage.Kind)
+	assert.Equal(t, "points", storage.Attributes[0].Key)
+	assert.Equal(t, "3", *storage.Attributes[0].Value.IntValue)
+	if !assert.NotNil(t, storage.Status) {
+		return
+	}
+	assert.Equal(t, statusError, storage.Status.Code)
+	assert.Equal(t, "disk full", storage.Status.Message)
+
+	assert.Equal(t, server.SpanID, parse.ParentSpanID)
+	assert.Equal(t, "100000000000", parse.StartTimeUnixNano)
+	assert.Equal(t, "100001000000", parse.EndTimeUnixNano)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	assert.Equal(t, "/v1/traces", c.paths[0])
+	assert.Equal(t, "Bearer secret", c.headers[0].Get("Authorization"))
+	assert.Equal(t, "application/json", c.headers[0].Get("Content-Type"))
+	attrs := c.requests[0].ResourceSpans[0].Resource.Attributes
+	assert.Equal(t, "service.name", attrs[0].Key)
+	assert.Equal(t, DefaultServiceName, *attrs[0].Value.StringValue)
+	assert.Equal(t, "1.2.3", *attrs[1].Value.StringValue)
+}
+
+func TestSampling(t *testing.T) {
+	never, err := New(Options{Endpoint: "http://localhost:4318", SampleRate: 0})
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx, span := never.StartSpan(context.Background(), "query", KindServer, nil)
+	assert.Nil(t, span)
+	// Children of unsampled traces record nothing
+	_, child := Start(ctx, "query.execute")
+	assert.Nil(t, child)
+	child.SetAttribute("rows", 1)
+	child.End()
+
+	// Traces sampled upstream are recorded whatever the rate, and continue
+	// the upstream trace
+	remote := &Remote{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Sampled: true}
+	_, span = never.StartSpan(context.Background(), "query", KindServer, remote)
+	if !assert.NotNil(t, span) {
+		return
+	}
+	assert.Equal(t, remote.TraceID, span.TraceID())
+	assert.Equal(t, [8]byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7}, span.parentID)
+
+	// 64 bit B3 trace IDs are the low half of the trace ID
+	_, span = never.StartSpan(context.Background(), "query", KindServer, &Remote{TraceID: "a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7", Sampled: true})
+	if !assert.NotNil(t, span) {
+		return
+	}
+	assert.Equal(t, "0000000000000000a3ce929d0e0e4736", span.TraceID())
+
+	// Malformed remote contexts start a new trace
+	always, err := New(Options{Endpoint: "http://localhost:4318", SampleRate: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, span = always.StartSpan(context.Background(), "query", KindServer, &Remote{TraceID: "zz", SpanID: "00f067aa0ba902b7"})
+	if !assert.NotNil(t, span) {
+		return
+	}
+	assert.Equal(t, [8]byte{}, span.parentID)
+
+	half, err := New(Options{Endpoint: "http://localhost:4318", SampleRate: 0.5})
+	if !assert.NoError(t, err) {
+		return
+	}
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		if _, span := half.StartSpan(context.Background(), "query", KindServer, nil); span != nil {
+			sampled++
+		}
+	}
+	assert.InDelta(t, 500, sampled, 100)
+
+	var tracer *Tracer
+	_, span = tracer.StartSpan(context.Background(), "query", KindServer, nil)
+	assert.Nil(t, span)
+	tracer.Stop()
+}
+
+func TestOptions(t *testing.T) {
+	for _, opts := range []Options{
+		{Endpoint: "localhost:4318"},
+		{Endpoint: "ftp://collector/v1/traces"},
+		{Endpoint: "http://collector:4318", SampleRate: 1.5},
+		{Endpoint: "http://collector:4318", SampleRate: -0.1},
+	} {
+		_, err := New(opts)
+		assert.Error(t, err, opts)
+	}
+
+	tracer, err := New(Options{Endpoint: "https://collector/otlp/v1/traces"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "https://collector/otlp/v1/traces", tracer.endpoint)
+}
+
+func TestExportFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	tracer, err := New(Options{Endpoint: srv.URL, SampleRate: 1, QueueSize: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	dropped := spansDropped.Value()
+	for i := 0; i < 2; i++ {
+		_, span := tracer.StartSpan(context.Background(), "write", KindServer, nil)
+		span.End()
+	}
+	// The second span did not fit in the queue
+	assert.Equal(t, dropped+1, spansDropped.Value())
+
+	tracer.Start(context.Background())
+	tracer.Stop()
+	assert.Equal(t, dropped+2, spansDropped.Value())
+}
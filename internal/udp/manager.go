@@ -0,0 +1,67 @@
+package udp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/sirupsen/logrus"
+)
+
+// Listener describes one UDP listener managed by a Manager
+type Listener struct {
+	Addr    string
+	Options Options
+}
+
+// Manager runs a set of UDP listeners, each bound to its own address and
+// routed to its own database
+type Manager struct {
+	servers []*Server
+}
+
+// NewManager creates a listener for every entry of listeners
+func NewManager(db *persistence.Manager, listeners []Listener) *Manager {
+	m := &Manager{}
+	for _, l := range listeners {
+		m.servers = append(m.servers, NewWithOptions(l.Addr, db, l.Options))
+	}
+	return m
+}
+
+// Servers returns the managed listeners in configuration order
+func (m *Manager) Servers() []*Server {
+	return m.servers
+}
+
+// Start starts every listener and returns their bound addresses. If one
+// fails to start, the listeners already started are stopped.
+func (m *Manager) Start(ctx context.Context) ([]string, error) {
+	addrs := make([]string, 0, len(m.servers))
+	for i, s := range m.servers {
+		addr, err := s.Start(ctx)
+		if err != nil {
+			for _, started := range m.servers[:i] {
+				if stopErr := started.Stop(); stopErr != nil {
+					logrus.Errorf("Error stopping UDP listener: %v", stopErr)
+				}
+			}
+			return nil, fmt.Errorf("failed to start UDP listener %s: %w", s.addr, err)
+		}
+		logrus.Infof("UDP listener on %s writing to database %q", addr, s.Database())
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// Stop stops every listener, flushing their pending points
+func (m *Manager) Stop() error {
+	var errs []error
+	for _, s := range m.servers {
+		if err := s.Stop(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
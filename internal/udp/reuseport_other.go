@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package udp
+
+import (
+	"errors"
+	"net"
+)
+
+// listenReusePort is not supported on this platform, so listeners only
+// read one socket
+func listenReusePort(addr string) (*net.UDPConn, error) {
+	return nil, errors.New("SO_REUSEPORT is not supported on this platform")
+}
@@ -2,35 +2,224 @@ package udp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
-	"strconv"
-	"strings"
+	"net/netip"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/gleicon/go-refluxdb/internal/acl"
+	"github.com/gleicon/go-refluxdb/internal/enrich"
+	"github.com/gleicon/go-refluxdb/internal/ingest"
+	"github.com/gleicon/go-refluxdb/internal/metrics"
 	"github.com/gleicon/go-refluxdb/internal/persistence"
-	"github.com/gleicon/go-refluxdb/internal/protocol"
 	"github.com/sirupsen/logrus"
 )
 
+var (
+	packetsReceived = metrics.NewCounter("refluxdb_udp_packets_received_total", "UDP packets received")
+	bytesReceived   = metrics.NewCounter("refluxdb_udp_bytes_received_total", "Bytes received over UDP")
+	packetsDropped  = metrics.NewCounterVec("refluxdb_udp_packets_dropped_total", "UDP packets that could not be read or stored", "reason")
+	// A packet filling the read buffer was most likely cut short
+	packetsTruncated = metrics.NewCounter("refluxdb_udp_packets_truncated_total", "UDP packets as large as the read buffer, most likely truncated")
+	parseErrors      = metrics.NewCounter("refluxdb_udp_parse_errors_total", "Lines of UDP packets dropped because they could not be parsed or validated")
+	pointsReceived   = metrics.NewCounter("refluxdb_udp_points_received_total", "Points parsed from UDP packets")
+	pointsDropped    = metrics.NewCounter("refluxdb_udp_points_dropped_total", "Points parsed from UDP packets but dropped because the ingest pipeline was full")
+)
+
+const (
+	// MaxBufferSize is the largest UDP payload that can be received
+	MaxBufferSize = 64 * 1024
+	// DefaultBufferSize fits the largest payload so batches sent by telegraf
+	// are never truncated
+	DefaultBufferSize = MaxBufferSize
+	// DefaultReadQueue is the number of packets buffered between the reader
+	// and the parser
+	DefaultReadQueue = 1000
+)
+
 // Server represents a UDP server
 type Server struct {
 	addr       string
 	db         *persistence.Manager
-	conn       *net.UDPConn
+	conns      []*net.UDPConn
+	readers    int
+	parsers    int
 	wg         sync.WaitGroup
 	mu         sync.Mutex
 	isRunning  bool
 	bufferSize int
+	parser     *ingest.Parser
+	batch      ingest.BatchOptions
+	batcher    *ingest.Batcher
+	pool       sync.Pool
+	packets    chan *packet
+	readQueue  int
+	database   string
+	prefix     string
+	clients    *acl.List
+	enrich     *enrich.Set
+	dead       *ingest.DeadLetters
+	dedup      *ingest.Dedup
+	tenants    *persistence.Pool
+	stats      counters
+	// statsInterval is the period of the statistics summary logs. Zero
+	// disables them.
+	statsInterval time.Duration
+	// done stops the statistics summary
+	done chan struct{}
+}
+
+// Stats holds the counters of a UDP listener since it was created
+type Stats struct {
+	PacketsReceived uint64
+	BytesReceived   uint64
+	// PacketsTruncated counts the packets as large as the read buffer,
+	// whose end was most likely cut off
+	PacketsTruncated uint64
+	// PacketsDropped counts the packets that could not be read, came from
+	// a denied source or found the parse queue full
+	PacketsDropped uint64
+	// ParseErrors counts the lines dropped because they could not be
+	// parsed or were rejected by the write validation
+	ParseErrors    uint64
+	PointsReceived uint64
+	// PointsDropped counts the parsed points lost because the ingest
+	// pipeline was full
+	PointsDropped uint64
+}
+
+// lost reports whether anything was dropped or truncated
+func (s Stats) lost() bool {
+	return s.PacketsTruncated > 0 || s.PacketsDropped > 0 || s.ParseErrors > 0 || s.PointsDropped > 0
+}
+
+// sub returns the counters accumulated since prev
+func (s Stats) sub(prev Stats) Stats {
+	return Stats{
+		PacketsReceived:  s.PacketsReceived - prev.PacketsReceived,
+		BytesReceived:    s.BytesReceived - prev.BytesReceived,
+		PacketsTruncated: s.PacketsTruncated - prev.PacketsTruncated,
+		PacketsDropped:   s.PacketsDropped - prev.PacketsDropped,
+		ParseErrors:      s.ParseErrors - prev.ParseErrors,
+		PointsReceived:   s.PointsReceived - prev.PointsReceived,
+		PointsDropped:    s.PointsDropped - prev.PointsDropped,
+	}
 }
 
-// New creates a new UDP server
+// counters are the atomic counters behind Stats
+type counters struct {
+	packetsReceived  atomic.Uint64
+	bytesReceived    atomic.Uint64
+	packetsTruncated atomic.Uint64
+	packetsDropped   atomic.Uint64
+	parseErrors      atomic.Uint64
+	pointsReceived   atomic.Uint64
+	pointsDropped    atomic.Uint64
+}
+
+// packet is a datagram read into a pooled buffer
+type packet struct {
+	buf  []byte
+	n    int
+	from netip.Addr
+}
+
+// Options configures optional UDP server behavior
+type Options struct {
+	// Write controls validation of written points
+	Write ingest.Options
+	// BufferSize is the read buffer size in bytes, at most MaxBufferSize.
+	// Packets larger than the buffer are truncated.
+	BufferSize int
+	// ReadQueue is the number of packets queued for parsing before new
+	// packets are dropped
+	ReadQueue int
+	// Batch controls how parsed points are grouped before being stored
+	Batch ingest.BatchOptions
+	// Database receives the points of this listener. Empty means
+	// persistence.DefaultDatabase.
+	Database string
+	// MeasurementPrefix is prepended to the measurement of every point
+	MeasurementPrefix string
+	// Clients drops the packets from source addresses it does not allow
+	// before they are parsed. Nil accepts every client.
+	Clients *acl.List
+	// Enrichment sets and rewrites the tags of the points received, with
+	// the rules for the address of the listener. Nil leaves them as sent.
+	Enrichment *enrich.Set
+	// DeadLetters records the lines dropped from the packets received.
+	// Nil only logs them.
+	DeadLetters *ingest.DeadLetters
+	// Dedup drops the points received again within its window. Nil
+	// stores every point.
+	Dedup *ingest.Dedup
+	// Tenants stores the points of the tenant databases in the files of
+	// their tenants. Nil stores every point in db.
+	Tenants *persistence.Pool
+	// Readers is the number of sockets opened on the address with
+	// SO_REUSEPORT, each read by its own goroutine, so that ingest scales
+	// past the packet rate of one core. Zero or one reads a single socket.
+	Readers int
+	// Parsers is the number of goroutines parsing the queued packets.
+	// Zero means ingest.AutoWorkers.
+	Parsers int
+	// StatsInterval is the period of the log summarizing the packets and
+	// points received and lost by the listener. Zero disables it.
+	StatsInterval time.Duration
+}
+
+// New creates a new UDP server with default options
 func New(addr string, db *persistence.Manager) *Server {
-	return &Server{
+	return NewWithOptions(addr, db, Options{})
+}
+
+// NewWithOptions creates a new UDP server with the given options
+func NewWithOptions(addr string, db *persistence.Manager, opts Options) *Server {
+	bufferSize := opts.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DefaultBufferSize
+	}
+	if bufferSize > MaxBufferSize {
+		logrus.Warnf("UDP buffer size %d exceeds the maximum, using %d", bufferSize, MaxBufferSize)
+		bufferSize = MaxBufferSize
+	}
+
+	readQueue := opts.ReadQueue
+	if readQueue <= 0 {
+		readQueue = DefaultReadQueue
+	}
+
+	parsers := opts.Parsers
+	if parsers <= 0 {
+		parsers = ingest.AutoWorkers()
+	}
+
+	s := &Server{
 		addr:       addr,
 		db:         db,
-		bufferSize: 1024,
+		bufferSize: bufferSize,
+		parser:     ingest.NewParser(opts.Write),
+		batch:      opts.Batch,
+		readQueue:  readQueue,
+		database:   opts.Database,
+		prefix:     opts.MeasurementPrefix,
+		clients:    opts.Clients,
+		enrich:     opts.Enrichment,
+		dead:       opts.DeadLetters,
+		dedup:      opts.Dedup,
+		tenants:    opts.Tenants,
+		readers:    opts.Readers,
+		parsers:    parsers,
+
+		statsInterval: opts.StatsInterval,
+	}
+	s.pool.New = func() interface{} {
+		return &packet{buf: make([]byte, s.bufferSize)}
 	}
+	return s
 }
 
 // Start starts the UDP server
@@ -43,95 +232,241 @@ func (s *Server) Start(ctx context.Context) (string, error) {
 	s.isRunning = true
 	s.mu.Unlock()
 
-	udpAddr, err := net.ResolveUDPAddr("udp", s.addr)
+	conns, err := s.listen()
 	if err != nil {
-		return "", fmt.Errorf("failed to resolve UDP address: %v", err)
+		s.setRunning(false)
+		return "", err
 	}
+	s.conns = conns
 
-	conn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		return "", fmt.Errorf("failed to start UDP server: %v", err)
+	actualAddr := conns[0].LocalAddr().String()
+	s.packets = make(chan *packet, s.readQueue)
+	var w ingest.Writer = s.db
+	if s.tenants != nil {
+		w = s.tenants
+	}
+	s.batcher = ingest.NewBatcher(w, s.batch)
+	s.batcher.Start()
+	logrus.Infof("Starting UDP server on %s with %d readers, %d parsers and %d batch workers",
+		actualAddr, len(conns), s.parsers, s.batcher.Options().Workers)
+	s.done = make(chan struct{})
+	if s.statsInterval > 0 {
+		go s.logStats(actualAddr, s.Stats(), s.done)
 	}
-	s.conn = conn
 
-	actualAddr := conn.LocalAddr().String()
-	logrus.Infof("Starting UDP server on %s", actualAddr)
+	// The parsers drain the packets queued by the readers, so a slow parse
+	// or storage write never stalls reading from the sockets
+	var parsers sync.WaitGroup
+	for i := 0; i < s.parsers; i++ {
+		parsers.Add(1)
+		go func() {
+			defer parsers.Done()
+			for p := range s.packets {
+				s.handlePacket(p.buf[:p.n], p.from)
+				s.pool.Put(p)
+			}
+		}()
+	}
+
+	var readers sync.WaitGroup
+	for _, conn := range conns {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			s.read(ctx, conn)
+		}()
+	}
 
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
-		buffer := make([]byte, s.bufferSize)
+		readers.Wait()
+		close(s.packets)
+		parsers.Wait()
+	}()
+
+	return actualAddr, nil
+}
+
+// listen opens the sockets of the server: a single one, or Readers
+// sockets sharing the address with SO_REUSEPORT
+func (s *Server) listen() ([]*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve UDP address: %v", err)
+	}
+	if s.readers <= 1 {
+		conn, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start UDP server: %v", err)
+		}
+		return []*net.UDPConn{conn}, nil
+	}
 
-		for {
-			select {
-			case <-ctx.Done():
+	// The first socket picks the port when the address leaves it to the
+	// system, and the others bind to the same one
+	addr := udpAddr.String()
+	conns := make([]*net.UDPConn, 0, s.readers)
+	for i := 0; i < s.readers; i++ {
+		conn, err := listenReusePort(addr)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, fmt.Errorf("failed to start UDP reader %d: %v", i+1, err)
+		}
+		conns = append(conns, conn)
+		addr = conn.LocalAddr().String()
+	}
+	return conns, nil
+}
+
+// read queues the packets received on conn until it is closed or ctx is
+// done
+func (s *Server) read(ctx context.Context, conn *net.UDPConn) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		p := s.pool.Get().(*packet)
+		n, from, err := conn.ReadFromUDPAddrPort(p.buf)
+		if err != nil {
+			s.pool.Put(p)
+			if errors.Is(err, net.ErrClosed) {
 				return
-			default:
-				n, _, err := conn.ReadFromUDP(buffer)
-				if err != nil {
-					if !strings.Contains(err.Error(), "use of closed network connection") {
-						logrus.Errorf("Error reading UDP packet: %v", err)
-					}
-					continue
-				}
-
-				data := string(buffer[:n])
-				lines := strings.Split(strings.TrimSpace(data), "\n")
-				for _, line := range lines {
-					line = strings.TrimSpace(line)
-					if line == "" {
-						continue
-					}
-
-					proto, err := protocol.Parse(line)
-					if err != nil {
-						logrus.Errorf("Error parsing line protocol: %v", err)
-						continue
-					}
-
-					// Save each field as a separate measurement
-					for field, value := range proto.Fields {
-						var floatValue float64
-
-						// Handle different field value types
-						if strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
-							// String value - store as 1.0 (presence)
-							value = strings.Trim(value, "\"")
-							floatValue = 1.0
-						} else if strings.HasSuffix(value, "i") {
-							// Integer value
-							numStr := value[:len(value)-1]
-							if intVal, err := strconv.ParseInt(numStr, 10, 64); err == nil {
-								floatValue = float64(intVal)
-							} else {
-								logrus.Errorf("Invalid integer value: %s", value)
-								continue
-							}
-						} else if strings.ToLower(value) == "true" {
-							floatValue = 1.0
-						} else if strings.ToLower(value) == "false" {
-							floatValue = 0.0
-						} else {
-							// Try to parse as float
-							if val, err := strconv.ParseFloat(value, 64); err == nil {
-								floatValue = val
-							} else {
-								logrus.Errorf("Invalid numeric value: %s", value)
-								continue
-							}
-						}
-
-						err = s.db.SaveMeasurement(proto.Measurement, field, floatValue, proto.Tags, proto.Timestamp)
-						if err != nil {
-							logrus.Errorf("Error saving measurement: %v", err)
-						}
-					}
-				}
 			}
+			s.dropPacket("read")
+			logrus.Errorf("Error reading UDP packet: %v", err)
+			continue
 		}
-	}()
 
-	return actualAddr, nil
+		packetsReceived.Inc()
+		bytesReceived.Add(uint64(n))
+		s.stats.packetsReceived.Add(1)
+		s.stats.bytesReceived.Add(uint64(n))
+		if !s.clients.Allows(from.Addr()) {
+			s.pool.Put(p)
+			s.dropPacket("denied")
+			continue
+		}
+		// The kernel silently cuts datagrams larger than the buffer, so a
+		// full buffer is the only sign of it
+		if n == len(p.buf) {
+			packetsTruncated.Inc()
+			s.stats.packetsTruncated.Add(1)
+		}
+
+		p.n, p.from = n, from.Addr()
+		select {
+		case s.packets <- p:
+		default:
+			s.pool.Put(p)
+			s.dropPacket("queue_full")
+		}
+	}
+}
+
+// handlePacket parses every line of a packet sent from source and queues
+// the points in the ingest pipeline
+func (s *Server) handlePacket(packet []byte, source netip.Addr) {
+	points, err := s.parser.Parse(packet)
+	if err != nil {
+		logrus.Errorf("Error parsing line protocol: %v", err)
+		lines := uint64(1)
+		var partial *ingest.PartialWriteError
+		if errors.As(err, &partial) {
+			lines = uint64(len(partial.Dropped))
+			s.dead.Record(s.database, source, time.Nanosecond, partial)
+		}
+		parseErrors.Add(lines)
+		s.stats.parseErrors.Add(lines)
+	}
+	pointsReceived.Add(uint64(len(points)))
+	s.stats.pointsReceived.Add(uint64(len(points)))
+
+	rules := s.enrich.For(s.addr, source)
+	for i := range points {
+		points[i].Database = s.database
+		points[i].Measurement = s.prefix + points[i].Measurement
+		points[i].Tags = rules.Apply(points[i].Tags)
+	}
+	points = s.dedup.Filter(points)
+
+	if !s.batcher.Add(points) {
+		s.dropPacket("pipeline_full")
+		pointsDropped.Add(uint64(len(points)))
+		s.stats.pointsDropped.Add(uint64(len(points)))
+	}
+}
+
+// dropPacket counts a packet dropped for reason
+func (s *Server) dropPacket(reason string) {
+	packetsDropped.With(reason).Inc()
+	s.stats.packetsDropped.Add(1)
+}
+
+// Stats returns a snapshot of the listener counters
+func (s *Server) Stats() Stats {
+	return Stats{
+		PacketsReceived:  s.stats.packetsReceived.Load(),
+		BytesReceived:    s.stats.bytesReceived.Load(),
+		PacketsTruncated: s.stats.packetsTruncated.Load(),
+		PacketsDropped:   s.stats.packetsDropped.Load(),
+		ParseErrors:      s.stats.parseErrors.Load(),
+		PointsReceived:   s.stats.pointsReceived.Load(),
+		PointsDropped:    s.stats.pointsDropped.Load(),
+	}
+}
+
+// logStats logs what the listener received and lost since prev every
+// statsInterval until done is closed. Quiet periods are not logged, and
+// periods with losses are logged as warnings.
+func (s *Server) logStats(addr string, prev Stats, done <-chan struct{}) {
+	ticker := time.NewTicker(s.statsInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		current := s.Stats()
+		d := current.sub(prev)
+		prev = current
+		if d.PacketsReceived == 0 && !d.lost() {
+			continue
+		}
+		entry := logrus.WithFields(logrus.Fields{
+			"listener":          addr,
+			"packets":           d.PacketsReceived,
+			"bytes":             d.BytesReceived,
+			"points":            d.PointsReceived,
+			"packets_truncated": d.PacketsTruncated,
+			"packets_dropped":   d.PacketsDropped,
+			"parse_errors":      d.ParseErrors,
+			"points_dropped":    d.PointsDropped,
+		})
+		if d.lost() {
+			entry.Warnf("UDP listener lost data in the last %s", s.statsInterval)
+		} else {
+			entry.Infof("UDP listener statistics for the last %s", s.statsInterval)
+		}
+	}
+}
+
+func (s *Server) setRunning(running bool) {
+	s.mu.Lock()
+	s.isRunning = running
+	s.mu.Unlock()
+}
+
+// Database returns the database the listener writes to
+func (s *Server) Database() string {
+	return s.database
 }
 
 // Stop stops the UDP server
@@ -143,14 +478,21 @@ func (s *Server) Stop() error {
 		return nil
 	}
 
-	if s.conn != nil {
-		if err := s.conn.Close(); err != nil {
-			return fmt.Errorf("error closing UDP connection: %v", err)
+	// A socket failing to close still stops its reader, so the shutdown
+	// goes on and the error is reported at the end
+	var errs []error
+	for _, conn := range s.conns {
+		if err := conn.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("error closing UDP connection: %v", err))
 		}
-		s.conn = nil
 	}
+	s.conns = nil
+	close(s.done)
 
+	// The readers stop, the parsers drain the packet queue, after which
+	// the batcher flushes whatever is still pending
 	s.wg.Wait()
+	s.batcher.Stop()
 	s.isRunning = false
-	return nil
+	return errors.Join(errs...)
 }
@@ -2,11 +2,18 @@ package udp
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/gleicon/go-refluxdb/internal/acl"
+	"github.com/gleicon/go-refluxdb/internal/ingest"
 	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -14,7 +21,9 @@ func setupTestServer(t *testing.T) (*Server, *persistence.Manager) {
 	db, err := persistence.New(":memory:")
 	assert.NoError(t, err)
 
-	srv := New(":8089", db)
+	srv := NewWithOptions("127.0.0.1:0", db, Options{
+		Batch: ingest.BatchOptions{Timeout: 10 * time.Millisecond},
+	})
 	return srv, db
 }
 
@@ -96,10 +105,11 @@ func TestUDPServerInvalidData(t *testing.T) {
 	}()
 
 	// Wait for server to start
+	var addr string
 	select {
 	case err := <-errChan:
 		t.Fatalf("Failed to start UDP server: %v", err)
-	case addr := <-addrChan:
+	case addr = <-addrChan:
 		t.Logf("UDP server started on %s", addr)
 	case <-time.After(time.Second):
 		t.Fatal("Timeout waiting for UDP server to start")
@@ -107,7 +117,7 @@ func TestUDPServerInvalidData(t *testing.T) {
 
 	// Test sending invalid data
 	t.Run("send invalid data", func(t *testing.T) {
-		conn, err := net.Dial("udp", ":8089")
+		conn, err := net.Dial("udp", addr)
 		assert.NoError(t, err)
 		defer conn.Close()
 
@@ -120,8 +130,331 @@ func TestUDPServerInvalidData(t *testing.T) {
 		// The server should log the error but continue running
 	})
 
+	// Test that every line is stored as a single point with all its fields
+	t.Run("send multi-field line", func(t *testing.T) {
+		conn, err := net.Dial("udp", addr)
+		assert.NoError(t, err)
+		defer conn.Close()
+
+		data := "memory,host=server1 used=75.5,free=24.5 1556813561098000000\nbroken line\n"
+		_, err = conn.Write([]byte(data))
+		assert.NoError(t, err)
+
+		assert.Eventually(t, func() bool {
+			points, err := db.GetMeasurementRange(persistence.DefaultDatabase, "memory", 0, 1556813561098000000)
+			return err == nil && len(points) == 1
+		}, time.Second, 10*time.Millisecond)
+
+		points, err := db.GetMeasurementRange(persistence.DefaultDatabase, "memory", 0, 1556813561098000000)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]float64{"used": 75.5, "free": 24.5}, points[0].Fields)
+	})
+
 	// Test server shutdown
 	cancel()
-	err := <-errChan
+	assert.NoError(t, srv.Stop())
+}
+
+func TestUDPServerLargePacket(t *testing.T) {
+	srv, db := setupTestServer(t)
+	defer db.Close()
+
+	addr, err := srv.Start(context.Background())
+	assert.NoError(t, err)
+
+	// A telegraf style batch well above the old 1024 byte buffer
+	var sb strings.Builder
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&sb, "cpu,host=server%d usage_user=%d,usage_system=1 1556813561098000000\n", i, i)
+	}
+	assert.Greater(t, sb.Len(), 8*1024)
+
+	conn, err := net.Dial("udp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(sb.String()))
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		points, err := db.GetMeasurementRange(persistence.DefaultDatabase, "cpu", 0, 1556813561098000000)
+		return err == nil && len(points) == 200
+	}, 2*time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, srv.Stop())
+}
+
+func TestUDPServerStopFlushesBatch(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// The batch never fills nor times out on its own
+	srv := NewWithOptions("127.0.0.1:0", db, Options{
+		Batch: ingest.BatchOptions{Size: 1000, Timeout: time.Hour},
+	})
+	addr, err := srv.Start(context.Background())
+	assert.NoError(t, err)
+
+	conn, err := net.Dial("udp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("disk,host=a used=1 1556813561098000000"))
+	assert.NoError(t, err)
+
+	// Let the packet reach the pipeline before stopping
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, srv.Stop())
+
+	points, err := db.GetMeasurementRange(persistence.DefaultDatabase, "disk", 0, 1556813561098000000)
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+}
+
+func TestUDPServerDeniedSources(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	clients, err := acl.New([]string{"10.0.0.0/8"}, nil)
+	assert.NoError(t, err)
+	srv := NewWithOptions("127.0.0.1:0", db, Options{
+		Batch:   ingest.BatchOptions{Timeout: 10 * time.Millisecond},
+		Clients: clients,
+	})
+	addr, err := srv.Start(context.Background())
+	assert.NoError(t, err)
+
+	conn, err := net.Dial("udp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("disk,host=a used=1 1556813561098000000"))
+	assert.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, srv.Stop())
+
+	// Packets from localhost are dropped before reaching the pipeline
+	points, err := db.GetMeasurementRange(persistence.DefaultDatabase, "disk", 0, 1556813561098000000)
+	assert.NoError(t, err)
+	assert.Empty(t, points)
+}
+
+func TestUDPServerStats(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	hook := logtest.NewGlobal()
+	defer logrus.StandardLogger().ReplaceHooks(make(logrus.LevelHooks))
+
+	srv := NewWithOptions("127.0.0.1:0", db, Options{
+		BufferSize:    64,
+		Batch:         ingest.BatchOptions{Timeout: 10 * time.Millisecond},
+		StatsInterval: 50 * time.Millisecond,
+	})
+	addr, err := srv.Start(context.Background())
+	assert.NoError(t, err)
+
+	conn, err := net.Dial("udp", addr)
+	assert.NoError(t, err)
+	defer conn.Close()
+	packets := []string{
+		"cpu value=1 1556813561098000000\ncpu value=2 1556813561099000000",
+		"cpu value=\nmem free=1 1556813561098000000",
+		// Cut at the 64 bytes of the buffer, in the middle of the
+		// timestamp of the second line, which still parses
+		"cpu value=30 1556813561097000000\ncpu value=40 1556813561096000000",
+	}
+	for _, packet := range packets {
+		_, err = conn.Write([]byte(packet))
+		assert.NoError(t, err)
+	}
+
+	assert.Eventually(t, func() bool {
+		return srv.Stats().PacketsReceived == 3
+	}, 2*time.Second, 10*time.Millisecond)
+	// Every packet shows up in a summary, a warning since data was lost
+	assert.Eventually(t, func() bool {
+		var packets uint64
+		for _, e := range hook.AllEntries() {
+			if e.Level == logrus.WarnLevel && strings.Contains(e.Message, "lost data") {
+				assert.Equal(t, addr, e.Data["listener"])
+				packets += e.Data["packets"].(uint64)
+			}
+		}
+		return packets == 3
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.NoError(t, srv.Stop())
+
+	stats := srv.Stats()
+	assert.Equal(t, uint64(1), stats.PacketsTruncated)
+	assert.Equal(t, uint64(1), stats.ParseErrors)
+	assert.Equal(t, uint64(5), stats.PointsReceived)
+	assert.Equal(t, uint64(0), stats.PacketsDropped)
+	assert.Equal(t, uint64(0), stats.PointsDropped)
+	assert.Equal(t, uint64(len(packets[0])+len(packets[1])+64), stats.BytesReceived)
+}
+
+func TestUDPServerReaders(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	srv := NewWithOptions("127.0.0.1:0", db, Options{
+		Batch:   ingest.BatchOptions{Timeout: 10 * time.Millisecond, Pending: 100},
+		Readers: 4,
+	})
+	addr, err := srv.Start(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, srv.conns, 4)
+
+	// Sockets without SO_REUSEPORT cannot join the group
+	_, err = net.ListenPacket("udp", addr)
+	assert.Error(t, err)
+
+	// Each connection has its own source port, which the kernel hashes to
+	// pick the socket receiving its packets
+	for i := 0; i < 8; i++ {
+		conn, err := net.Dial("udp", addr)
+		assert.NoError(t, err)
+		for j := 0; j < 5; j++ {
+			_, err = fmt.Fprintf(conn, "load,host=h%d value=%d 1556813561098000000", i, j)
+			assert.NoError(t, err)
+		}
+		conn.Close()
+	}
+
+	assert.Eventually(t, func() bool {
+		return srv.Stats().PointsReceived == 40
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.NoError(t, srv.Stop())
+	assert.Empty(t, srv.conns)
+	assert.Zero(t, srv.Stats().PointsDropped)
+
+	points, err := db.GetMeasurementRange(persistence.DefaultDatabase, "load", 0, 1556813561098000000)
+	assert.NoError(t, err)
+	assert.Len(t, points, 8)
+}
+
+// BenchmarkUDPReaders sends batches of points from several clients as fast
+// as possible and reports the points parsed per second and the share of
+// the packets sent that were received. Both grow with the readers as long
+// as cores are available; on a single core the readers only compete with
+// the senders.
+func BenchmarkUDPReaders(b *testing.B) {
+	var sb strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&sb, "cpu,host=server-%d,region=us-west usage_user=42.5,usage_system=3i,idle=true 1465839830%d\n", i, 100400200+i)
+	}
+	payload := []byte(sb.String())
+	const senders = 8
+
+	for _, readers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("readers=%d", readers), func(b *testing.B) {
+			level := logrus.GetLevel()
+			defer logrus.SetLevel(level)
+			logrus.SetLevel(logrus.ErrorLevel)
+			db, err := persistence.New(":memory:")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			srv := NewWithOptions("127.0.0.1:0", db, Options{Readers: readers, ReadQueue: 10000})
+			addr, err := srv.Start(context.Background())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer srv.Stop()
+
+			b.SetBytes(int64(len(payload)))
+			b.ResetTimer()
+			start := time.Now()
+			var wg sync.WaitGroup
+			for i := 0; i < senders; i++ {
+				wg.Add(1)
+				go func(n int) {
+					defer wg.Done()
+					conn, err := net.Dial("udp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					defer conn.Close()
+					for j := 0; j < n; j++ {
+						conn.Write(payload)
+					}
+				}(b.N/senders + 1)
+			}
+			wg.Wait()
+
+			// Wait for the readers and parsers to catch up
+			prev := srv.Stats()
+			for {
+				time.Sleep(20 * time.Millisecond)
+				current := srv.Stats()
+				if current == prev {
+					break
+				}
+				prev = current
+			}
+			elapsed := time.Since(start)
+			b.StopTimer()
+
+			sent := float64(senders * (b.N/senders + 1))
+			b.ReportMetric(float64(prev.PointsReceived)/elapsed.Seconds(), "points/s")
+			b.ReportMetric(100*float64(prev.PacketsReceived)/sent, "%received")
+		})
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	assert.Equal(t, DefaultBufferSize, New(":0", nil).bufferSize)
+	assert.Equal(t, 4096, NewWithOptions(":0", nil, Options{BufferSize: 4096}).bufferSize)
+	assert.Equal(t, MaxBufferSize, NewWithOptions(":0", nil, Options{BufferSize: 1 << 20}).bufferSize)
+}
+
+func TestManager(t *testing.T) {
+	db, err := persistence.New(":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	batch := ingest.BatchOptions{Timeout: 10 * time.Millisecond}
+	m := NewManager(db, []Listener{
+		{Addr: "127.0.0.1:0", Options: Options{Database: "telegraf", Batch: batch}},
+		{Addr: "127.0.0.1:0", Options: Options{Database: "collectd", MeasurementPrefix: "collectd_", Batch: batch}},
+	})
+	addrs, err := m.Start(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, addrs, 2)
+	assert.NotEqual(t, addrs[0], addrs[1])
+	assert.Equal(t, "collectd", m.Servers()[1].Database())
+
+	for _, addr := range addrs {
+		conn, err := net.Dial("udp", addr)
+		assert.NoError(t, err)
+		_, err = conn.Write([]byte("load,host=a value=1 1556813561098000000"))
+		assert.NoError(t, err)
+		conn.Close()
+	}
+
+	assert.Eventually(t, func() bool {
+		plain, err1 := db.GetMeasurementRange("telegraf", "load", 0, 1556813561098000000)
+		prefixed, err2 := db.GetMeasurementRange("collectd", "collectd_load", 0, 1556813561098000000)
+		return err1 == nil && err2 == nil && len(plain) == 1 && len(prefixed) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, m.Stop())
+}
+
+func TestManagerStartFailure(t *testing.T) {
+	m := NewManager(nil, []Listener{
+		{Addr: "127.0.0.1:0"},
+		{Addr: "invalid-address"},
+	})
+	_, err := m.Start(context.Background())
+	assert.Error(t, err)
+
+	// The listener that did start was stopped again
+	_, err = m.Servers()[0].Start(context.Background())
 	assert.NoError(t, err)
+	assert.NoError(t, m.Stop())
 }
@@ -0,0 +1,271 @@
+// Package xform rewrites written points with rules declared in the
+// configuration: dropping points or fields, renaming measurements and
+// computing fields. Rules are written with the expressions of InfluxQL,
+// conditions as in WHERE clauses and values as in SELECT clauses:
+//
+//	[[transform]]
+//	name = "fahrenheit"
+//	measurements = ["sensors"]
+//	where = "unit = 'C'"
+//	fields = { temp = "temp * 1.8 + 32" }
+//	drop-fields = ["unit_code"]
+//	measurement = "sensors_f"
+//
+//	[[transform]]
+//	name = "no-test-hosts"
+//	where = "host =~ /^test-/"
+//	drop = true
+//
+// A rule applies to the points of its measurements, every point when none
+// are listed, that satisfy its condition. It either drops the point, or
+// sets its fields to the value of their expression, all evaluated over
+// the fields of the point before the rule, removes its drop fields and
+// renames its measurement, in that order. A point left without fields is
+// dropped. Rules apply in order, each one to the point left by the
+// previous ones.
+package xform
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/expr"
+	"github.com/gleicon/go-refluxdb/internal/metrics"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/predicate"
+)
+
+var (
+	pointsTransformed = metrics.NewCounterVec("refluxdb_ingest_transform_points_total", "Points rewritten by a transform rule", "rule")
+	pointsDropped     = metrics.NewCounterVec("refluxdb_ingest_transform_dropped_total", "Points dropped by a transform rule", "rule")
+	// A field expression has no value when it refers to a missing field
+	// or gives a non-finite result
+	expressionMisses = metrics.NewCounterVec("refluxdb_ingest_transform_misses_total", "Field expressions of a transform rule without a value, which left their field unchanged", "rule")
+)
+
+// Rule describes a transform rule
+type Rule struct {
+	// Name identifies the rule in the metrics and dry runs
+	Name string `json:"name"`
+	// Measurements restricts the rule to the points of these
+	// measurements. Empty matches every point.
+	Measurements []string `json:"measurements,omitempty"`
+	// Where is an InfluxQL condition on the tags and fields of the
+	// points. Empty matches every point.
+	Where string `json:"where,omitempty"`
+	// Drop drops the matching points
+	Drop bool `json:"drop,omitempty"`
+	// Fields maps field names to the InfluxQL expression of their value
+	Fields map[string]string `json:"fields,omitempty"`
+	// DropFields are removed from the points
+	DropFields []string `json:"dropFields,omitempty"`
+	// Measurement renames the measurement of the points when set
+	Measurement string `json:"measurement,omitempty"`
+}
+
+// rule is a validated Rule
+type rule struct {
+	name         string
+	measurements map[string]bool
+	where        predicate.Expr
+	drop         bool
+	// fields are sorted by name, so that dry runs report the misses in a
+	// stable order
+	fields      []field
+	dropFields  []string
+	measurement string
+
+	transformed, dropped, misses *metrics.Counter
+}
+
+type field struct {
+	name string
+	expr expr.Expr
+}
+
+// Set is the list of rules applied to written points
+type Set struct {
+	rules []*rule
+}
+
+// New validates rules. It returns nil when there are none.
+func New(rules []Rule) (*Set, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	s := &Set{}
+	names := make(map[string]bool)
+	for i, r := range rules {
+		if r.Name == "" {
+			return nil, fmt.Errorf("invalid rule %d: missing name", i+1)
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate rule name %q", r.Name)
+		}
+		names[r.Name] = true
+		compiled, err := compile(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %s: %w", r.Name, err)
+		}
+		s.rules = append(s.rules, compiled)
+	}
+	return s, nil
+}
+
+func compile(r Rule) (*rule, error) {
+	if !r.Drop && len(r.Fields) == 0 && len(r.DropFields) == 0 && r.Measurement == "" {
+		return nil, fmt.Errorf("expected drop, fields, drop-fields or measurement")
+	}
+	if r.Drop && (len(r.Fields) > 0 || len(r.DropFields) > 0 || r.Measurement != "") {
+		return nil, fmt.Errorf("a rule dropping points cannot also rewrite them")
+	}
+	c := &rule{
+		name:        r.Name,
+		drop:        r.Drop,
+		dropFields:  r.DropFields,
+		measurement: r.Measurement,
+		transformed: pointsTransformed.With(r.Name),
+		dropped:     pointsDropped.With(r.Name),
+		misses:      expressionMisses.With(r.Name),
+	}
+	if len(r.Measurements) > 0 {
+		c.measurements = make(map[string]bool, len(r.Measurements))
+		for _, m := range r.Measurements {
+			c.measurements[m] = true
+		}
+	}
+	if r.Where != "" {
+		// Conditions on time would compare with the time of the startup
+		where, err := predicate.Parse(r.Where, time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("invalid where: %w", err)
+		}
+		if usesTime(where) {
+			return nil, fmt.Errorf("invalid where: conditions on time are not supported")
+		}
+		c.where = where
+	}
+	for name, text := range r.Fields {
+		if name == "" {
+			return nil, fmt.Errorf("invalid field: empty name")
+		}
+		e, err := expr.Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression of field %s: %w", name, err)
+		}
+		c.fields = append(c.fields, field{name: name, expr: e})
+	}
+	sort.Slice(c.fields, func(i, j int) bool { return c.fields[i].name < c.fields[j].name })
+	return c, nil
+}
+
+// usesTime reports whether a condition compares the time of the points
+func usesTime(e predicate.Expr) bool {
+	switch e := e.(type) {
+	case *predicate.And:
+		return usesTime(e.X) || usesTime(e.Y)
+	case *predicate.Or:
+		return usesTime(e.X) || usesTime(e.Y)
+	case *predicate.Comparison:
+		return e.Kind == predicate.Time
+	}
+	return false
+}
+
+// Apply rewrites point in place with the rules of s and reports whether
+// it is kept
+func (s *Set) Apply(point *persistence.Point) bool {
+	if s == nil {
+		return true
+	}
+	for _, r := range s.rules {
+		if !r.matches(point) {
+			continue
+		}
+		if !r.apply(point, nil) {
+			r.dropped.Inc()
+			return false
+		}
+		r.transformed.Inc()
+	}
+	return true
+}
+
+// Result is the outcome of a dry run on one point
+type Result struct {
+	Point persistence.Point
+	// Rules lists the rules that matched the point, in order
+	Rules []string
+	// Dropped is set when a rule dropped the point
+	Dropped bool
+	// Misses lists the field expressions without a value, as rule.field
+	Misses []string
+}
+
+// Test runs the rules of s on a copy of point without counting it in the
+// metrics, and reports what each rule did
+func (s *Set) Test(point persistence.Point) Result {
+	fields := make(map[string]float64, len(point.Fields))
+	for k, v := range point.Fields {
+		fields[k] = v
+	}
+	point.Fields = fields
+
+	res := Result{Point: point}
+	if s == nil {
+		return res
+	}
+	for _, r := range s.rules {
+		if !r.matches(&res.Point) {
+			continue
+		}
+		res.Rules = append(res.Rules, r.name)
+		if !r.apply(&res.Point, &res.Misses) {
+			res.Dropped = true
+			break
+		}
+	}
+	return res
+}
+
+func (r *rule) matches(point *persistence.Point) bool {
+	if r.measurements != nil && !r.measurements[point.Measurement] {
+		return false
+	}
+	return r.where == nil || r.where.Eval(point.Timestamp, point.Tags, point.Fields)
+}
+
+// apply rewrites a matching point and reports whether it is kept. The
+// field expressions without a value are counted, and added to misses
+// when it is not nil.
+func (r *rule) apply(point *persistence.Point, misses *[]string) bool {
+	if r.drop {
+		return false
+	}
+	if len(r.fields) > 0 {
+		values := make([]float64, len(r.fields))
+		found := make([]bool, len(r.fields))
+		for i, f := range r.fields {
+			values[i], found[i] = f.expr.Eval(point.Fields)
+		}
+		for i, f := range r.fields {
+			if !found[i] {
+				if misses != nil {
+					*misses = append(*misses, r.name+"."+f.name)
+				} else {
+					r.misses.Inc()
+				}
+				continue
+			}
+			point.Fields[f.name] = values[i]
+		}
+	}
+	for _, name := range r.dropFields {
+		delete(point.Fields, name)
+	}
+	if r.measurement != "" {
+		point.Measurement = r.measurement
+	}
+	return len(point.Fields) > 0
+}
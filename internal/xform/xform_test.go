@@ -0,0 +1,92 @@
+package xform
+
+import (
+	"testing"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApply(t *testing.T) {
+	set, err := New([]Rule{
+		{Name: "test-hosts", Where: "host =~ /^test-/", Drop: true},
+		{Name: "fahrenheit", Measurements: []string{"sensors"}, Where: "unit = 'C'", Fields: map[string]string{"temp": "temp * 1.8 + 32", "delta": "temp - base"}, DropFields: []string{"code"}, Measurement: "sensors_f"},
+		{Name: "bytes", Fields: map[string]string{"used": "used / 1024"}},
+		{Name: "no-fields", Measurements: []string{"debug"}, DropFields: []string{"value"}},
+	})
+	assert.NoError(t, err)
+	transformed := pointsTransformed.With("fahrenheit").Value()
+	dropped := pointsDropped.With("test-hosts").Value()
+	misses := expressionMisses.With("fahrenheit").Value()
+
+	p := persistence.Point{Measurement: "sensors", Tags: map[string]string{"unit": "C"}, Fields: map[string]float64{"temp": 100, "code": 7}}
+	assert.True(t, set.Apply(&p))
+	assert.Equal(t, persistence.Point{Measurement: "sensors_f", Tags: map[string]string{"unit": "C"}, Fields: map[string]float64{"temp": 212}}, p)
+	assert.Equal(t, transformed+1, pointsTransformed.With("fahrenheit").Value())
+	assert.Equal(t, misses+1, expressionMisses.With("fahrenheit").Value())
+
+	// Expressions read the fields before the rule
+	p = persistence.Point{Measurement: "sensors", Tags: map[string]string{"unit": "C"}, Fields: map[string]float64{"temp": 10, "base": 4}}
+	assert.True(t, set.Apply(&p))
+	assert.Equal(t, map[string]float64{"temp": 50, "base": 4, "delta": 6}, p.Fields)
+
+	// Unmatched points are kept as they are
+	p = persistence.Point{Measurement: "sensors", Tags: map[string]string{"unit": "F"}, Fields: map[string]float64{"temp": 10}}
+	assert.True(t, set.Apply(&p))
+	assert.Equal(t, "sensors", p.Measurement)
+
+	p = persistence.Point{Measurement: "cpu", Tags: map[string]string{"host": "test-1"}, Fields: map[string]float64{"used": 2048}}
+	assert.False(t, set.Apply(&p))
+	assert.Equal(t, dropped+1, pointsDropped.With("test-hosts").Value())
+	p.Tags["host"] = "web-1"
+	assert.True(t, set.Apply(&p))
+	assert.Equal(t, 2.0, p.Fields["used"])
+
+	p = persistence.Point{Measurement: "debug", Fields: map[string]float64{"value": 1}}
+	assert.False(t, set.Apply(&p))
+
+	var none *Set
+	assert.True(t, none.Apply(&p))
+}
+
+func TestTest(t *testing.T) {
+	set, err := New([]Rule{
+		{Name: "scale", Fields: map[string]string{"value": "value * 10", "ratio": "used / total"}},
+		{Name: "drop-big", Where: "value > 100", Drop: true},
+	})
+	assert.NoError(t, err)
+	transformed := pointsTransformed.With("scale").Value()
+
+	p := persistence.Point{Measurement: "m", Fields: map[string]float64{"value": 5}}
+	res := set.Test(p)
+	assert.Equal(t, []string{"scale"}, res.Rules)
+	assert.False(t, res.Dropped)
+	assert.Equal(t, []string{"scale.ratio"}, res.Misses)
+	assert.Equal(t, 50.0, res.Point.Fields["value"])
+	// The point tested is left unchanged and not counted
+	assert.Equal(t, 5.0, p.Fields["value"])
+	assert.Equal(t, transformed, pointsTransformed.With("scale").Value())
+
+	res = set.Test(persistence.Point{Measurement: "m", Fields: map[string]float64{"value": 50}})
+	assert.Equal(t, []string{"scale", "drop-big"}, res.Rules)
+	assert.True(t, res.Dropped)
+}
+
+func TestNew(t *testing.T) {
+	set, err := New(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, set)
+
+	for _, rules := range [][]Rule{
+		{{Drop: true}},
+		{{Name: "a", Drop: true}, {Name: "a", Drop: true}},
+		{{Name: "a"}},
+		{{Name: "a", Drop: true, Measurement: "b"}},
+		{{Name: "a", Where: "host = ", Drop: true}},
+		{{Name: "a", Where: "time > now() - 1h", Drop: true}},
+		{{Name: "a", Fields: map[string]string{"x": "value *"}}},
+	} {
+		_, err := New(rules)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,332 @@
+// Package client is a small Go client for the refluxdb HTTP API.
+//
+// It covers the endpoints most programs need (writing points, reading a
+// measurement back, running InfluxQL statements and checking the server is
+// up) without the dependencies
+// of the official InfluxDB client:
+//
+//	c := client.New("http://localhost:8086", client.Options{Org: "default"})
+//	err := c.WritePoint(ctx, "metrics", client.Point{
+//		Measurement: "cpu",
+//		Tags:        map[string]string{"host": "a"},
+//		Fields:      map[string]float64{"value": 0.5},
+//		Time:        time.Now(),
+//	})
+//	points, err := c.QueryRange(ctx, "metrics", "cpu", time.Now().Add(-time.Hour), time.Now())
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/protocol"
+)
+
+// DefaultTimeout bounds every request when Options.HTTPClient is nil
+const DefaultTimeout = 10 * time.Second
+
+// Point is a single time series data point. refluxdb stores every field
+// as a float64.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]float64
+	// Time is the point timestamp. The zero time lets the server use its
+	// current time.
+	Time time.Time
+}
+
+// Options configures a Client
+type Options struct {
+	// Org is sent with every v2 request. refluxdb accepts any value.
+	Org string
+	// Token is sent as "Authorization: Token <token>" when set
+	Token string
+	// HTTPClient sends the requests. A client with DefaultTimeout is used
+	// when nil.
+	HTTPClient *http.Client
+}
+
+// Client talks to a refluxdb server
+type Client struct {
+	url  string
+	opts Options
+}
+
+// Error is returned when the server answers with an error status
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("refluxdb: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// New creates a client for the server at serverURL, such as
+// "http://localhost:8086"
+func New(serverURL string, opts Options) *Client {
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: DefaultTimeout}
+	}
+	if opts.Org == "" {
+		opts.Org = "default"
+	}
+	return &Client{url: strings.TrimRight(serverURL, "/"), opts: opts}
+}
+
+// Ping checks that the server is up
+func (c *Client) Ping(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodGet, "/ping", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// WritePoint writes a single point to bucket
+func (c *Client) WritePoint(ctx context.Context, bucket string, p Point) error {
+	return c.WriteBatch(ctx, bucket, []Point{p})
+}
+
+// WriteBatch writes points to bucket in a single request. The bucket is
+// created by the server if it does not exist.
+func (c *Client) WriteBatch(ctx context.Context, bucket string, points []Point) error {
+	var enc protocol.Encoder
+	for _, p := range points {
+		if err := appendPoint(&enc, p); err != nil {
+			return err
+		}
+	}
+
+	params := url.Values{"org": {c.opts.Org}, "bucket": {bucket}, "precision": {"ns"}}
+	resp, err := c.do(ctx, http.MethodPost, "/api/v2/write?"+params.Encode(), bytes.NewReader(enc.Bytes()), http.Header{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// QueryRange returns the points of measurement in bucket between start and
+// end, inclusive, ordered by time. A zero start or end leaves that side of
+// the range unbounded. The v2 query endpoint does not return tags, so the
+// points only carry fields.
+func (c *Client) QueryRange(ctx context.Context, bucket, measurement string, start, end time.Time) ([]Point, error) {
+	startNs, err := rangeNanoseconds(start, math.MinInt64)
+	if err != nil {
+		return nil, err
+	}
+	endNs, err := rangeNanoseconds(end, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{
+		"org":         {c.opts.Org},
+		"bucket":      {bucket},
+		"measurement": {measurement},
+		"start":       {strconv.FormatInt(startNs, 10)},
+		"end":         {strconv.FormatInt(endNs, 10)},
+	}
+	resp, err := c.do(ctx, http.MethodGet, "/api/v2/query?"+params.Encode(), nil, http.Header{
+		"Accept": {"application/json"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Results []struct {
+			Series []struct {
+				Name    string          `json:"name"`
+				Columns []string        `json:"columns"`
+				Values  [][]json.Number `json:"values"`
+			} `json:"series"`
+			Error string `json:"error"`
+		} `json:"results"`
+	}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode query response: %w", err)
+	}
+
+	var points []Point
+	for _, r := range result.Results {
+		if r.Error != "" {
+			return nil, fmt.Errorf("query failed: %s", r.Error)
+		}
+		for _, s := range r.Series {
+			for _, row := range s.Values {
+				p, err := rowPoint(s.Name, s.Columns, row)
+				if err != nil {
+					return nil, err
+				}
+				points = append(points, p)
+			}
+		}
+	}
+	return points, nil
+}
+
+// rangeNanoseconds converts a bound of a query range to a timestamp, the
+// zero time standing for unbounded
+func rangeNanoseconds(t time.Time, unbounded int64) (int64, error) {
+	switch {
+	case t.IsZero():
+		return unbounded, nil
+	case t.Before(time.Unix(0, math.MinInt64)) || t.After(time.Unix(0, math.MaxInt64)):
+		return 0, fmt.Errorf("time %s is outside the range of nanosecond timestamps", t.UTC().Format(time.RFC3339Nano))
+	}
+	return t.UnixNano(), nil
+}
+
+// Series is a series of an InfluxQL result. Values hold json.Number,
+// string, bool or nil cells, and times in nanoseconds.
+type Series struct {
+	Name    string
+	Tags    map[string]string
+	Columns []string
+	Values  [][]interface{}
+}
+
+// Query runs InfluxQL statements against database through the v1 query
+// endpoint and returns the series of every statement. database may be
+// empty for statements that do not need one, such as SHOW DATABASES.
+func (c *Client) Query(ctx context.Context, database, query string) ([]Series, error) {
+	params := url.Values{"q": {query}, "epoch": {"ns"}}
+	if database != "" {
+		params.Set("db", database)
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/query?"+params.Encode(), nil, http.Header{
+		"Accept": {"application/json"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Results []struct {
+			Series []struct {
+				Name    string            `json:"name"`
+				Tags    map[string]string `json:"tags"`
+				Columns []string          `json:"columns"`
+				Values  [][]interface{}   `json:"values"`
+			} `json:"series"`
+			Error string `json:"error"`
+		} `json:"results"`
+		Error string `json:"error"`
+	}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode query response: %w", err)
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("query failed: %s", result.Error)
+	}
+
+	var series []Series
+	for _, r := range result.Results {
+		if r.Error != "" {
+			return nil, fmt.Errorf("query failed: %s", r.Error)
+		}
+		for _, s := range r.Series {
+			series = append(series, Series{Name: s.Name, Tags: s.Tags, Columns: s.Columns, Values: s.Values})
+		}
+	}
+	return series, nil
+}
+
+// rowPoint converts a result row whose first column is the time in
+// nanoseconds. Missing values are null and decode to empty numbers.
+func rowPoint(measurement string, columns []string, row []json.Number) (Point, error) {
+	p := Point{Measurement: measurement, Fields: make(map[string]float64, len(columns))}
+	for i, v := range row {
+		if i >= len(columns) || v == "" {
+			continue
+		}
+		if i == 0 {
+			ns, err := v.Int64()
+			if err != nil {
+				return Point{}, fmt.Errorf("invalid time %q: %w", v, err)
+			}
+			p.Time = time.Unix(0, ns).UTC()
+			continue
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid value %q of %s: %w", v, columns[i], err)
+		}
+		p.Fields[columns[i]] = f
+	}
+	return p, nil
+}
+
+// Snapshot copies a consistent snapshot of the server's database file to
+// w and returns its size. It requires an admin token when authentication
+// is enabled. Large files take longer than DefaultTimeout to download, so
+// Options.HTTPClient should have a longer timeout.
+func (c *Client) Snapshot(ctx context.Context, w io.Writer) (int64, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/api/v2/snapshot", nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return n, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	return n, nil
+}
+
+// do sends a request and turns error statuses into *Error
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if c.opts.Token != "" {
+		req.Header.Set("Authorization", "Token "+c.opts.Token)
+	}
+
+	resp, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		var e struct {
+			Error   string `json:"error"`
+			Message string `json:"message"`
+		}
+		msg := strings.TrimSpace(string(data))
+		if json.Unmarshal(data, &e) == nil {
+			if e.Error != "" {
+				msg = e.Error
+			} else if e.Message != "" {
+				msg = e.Message
+			}
+		}
+		return nil, &Error{StatusCode: resp.StatusCode, Message: msg}
+	}
+	return resp, nil
+}
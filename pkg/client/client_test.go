@@ -0,0 +1,99 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/protocol"
+	"github.com/gleicon/go-refluxdb/pkg/refluxdb"
+	"github.com/stretchr/testify/assert"
+)
+
+func startTestServer(t *testing.T) *Client {
+	storage, err := refluxdb.OpenStorage(":memory:")
+	assert.NoError(t, err)
+	srv, err := refluxdb.NewServer(storage, refluxdb.Options{HTTPAddr: "127.0.0.1:0"})
+	assert.NoError(t, err)
+	assert.NoError(t, srv.Start(context.Background()))
+	t.Cleanup(func() {
+		srv.Shutdown(context.Background())
+		storage.Close()
+	})
+	return New("http://"+srv.HTTPAddr()+"/", Options{})
+}
+
+func TestAppendPoint(t *testing.T) {
+	var enc protocol.Encoder
+	assert.NoError(t, appendPoint(&enc, Point{
+		Measurement: "my cpu",
+		Tags:        map[string]string{"zone": "us,east", "host": "a=b", "path": `C:\`, "empty": ""},
+		Fields:      map[string]float64{"value": 0.5, "count": 3, "bad": math.NaN()},
+		Time:        time.Unix(0, 1556813561098000000),
+	}))
+	assert.Equal(t, "my\\ cpu,host=a\\=b,path=\"C:\\\\\",zone=us\\,east count=3,value=0.5 1556813561098000000\n", string(enc.Bytes()))
+
+	// Invalid points are not written
+	assert.Error(t, appendPoint(&enc, Point{Fields: map[string]float64{"value": 1}}))
+	assert.Error(t, appendPoint(&enc, Point{Measurement: "cpu", Fields: map[string]float64{"value": math.Inf(1)}}))
+	assert.Error(t, appendPoint(&enc, Point{Measurement: "cpu", Tags: map[string]string{"host": "a\nb"}, Fields: map[string]float64{"value": 1}}))
+	assert.Equal(t, 1, bytes.Count(enc.Bytes(), []byte("\n")))
+}
+
+func TestClient(t *testing.T) {
+	c := startTestServer(t)
+	ctx := context.Background()
+	assert.NoError(t, c.Ping(ctx))
+
+	now := time.Now().Truncate(time.Millisecond)
+	assert.NoError(t, c.WritePoint(ctx, "metrics", Point{
+		Measurement: "cpu",
+		Tags:        map[string]string{"host": "a"},
+		Fields:      map[string]float64{"value": 0.5},
+		Time:        now.Add(-time.Minute),
+	}))
+	assert.NoError(t, c.WriteBatch(ctx, "metrics", []Point{
+		{Measurement: "cpu", Tags: map[string]string{"host": "b"}, Fields: map[string]float64{"value": 1.5, "idle": 90}, Time: now},
+		{Measurement: "mem", Fields: map[string]float64{"used": 10}, Time: now},
+	}))
+
+	points, err := c.QueryRange(ctx, "metrics", "cpu", now.Add(-time.Hour), now)
+	assert.NoError(t, err)
+	if assert.Len(t, points, 2) {
+		assert.Equal(t, Point{Measurement: "cpu", Fields: map[string]float64{"value": 0.5}, Time: now.Add(-time.Minute).UTC()}, points[0])
+		assert.Equal(t, map[string]float64{"value": 1.5, "idle": 90}, points[1].Fields)
+	}
+
+	// Zero times leave the range open, times past the timestamps fail
+	points, err = c.QueryRange(ctx, "metrics", "cpu", time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+	_, err = c.QueryRange(ctx, "metrics", "cpu", time.Date(1500, 1, 1, 0, 0, 0, 0, time.UTC), now)
+	assert.Error(t, err)
+
+	var snapshot bytes.Buffer
+	n, err := c.Snapshot(ctx, &snapshot)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(snapshot.Len()), n)
+	assert.True(t, bytes.HasPrefix(snapshot.Bytes(), []byte("SQLite format 3\x00")))
+
+	series, err := c.Query(ctx, "metrics", "SHOW MEASUREMENTS")
+	assert.NoError(t, err)
+	if assert.Len(t, series, 1) {
+		assert.Equal(t, []string{"name"}, series[0].Columns)
+		assert.Equal(t, [][]interface{}{{"cpu"}, {"mem"}}, series[0].Values)
+	}
+	_, err = c.Query(ctx, "", "SHOW SERIES ON missing")
+	assert.ErrorContains(t, err, "database not found: missing")
+
+	// Server errors carry the status and message
+	_, err = c.QueryRange(ctx, "missing", "cpu", now.Add(-time.Hour), now)
+	var apiErr *Error
+	assert.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	assert.Contains(t, apiErr.Message, "missing")
+}
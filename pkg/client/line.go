@@ -0,0 +1,49 @@
+package client
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/gleicon/go-refluxdb/internal/protocol"
+)
+
+// appendPoint adds p to enc as one line of line protocol
+func appendPoint(enc *protocol.Encoder, p Point) error {
+	enc.StartLine(p.Measurement)
+
+	tags := make([]string, 0, len(p.Tags))
+	for k := range p.Tags {
+		if k != "" {
+			tags = append(tags, k)
+		}
+	}
+	sort.Strings(tags)
+	for _, k := range tags {
+		enc.AddTag(k, p.Tags[k])
+	}
+
+	fields := make([]string, 0, len(p.Fields))
+	for k, v := range p.Fields {
+		// Line protocol has no representation for NaN or infinities
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	for _, k := range fields {
+		enc.AddField(k, p.Fields[k])
+	}
+
+	var err error
+	if p.Time.IsZero() {
+		err = enc.EndLine(0)
+	} else {
+		err = enc.EndLineAt(p.Time.UnixNano())
+	}
+	if err != nil {
+		return fmt.Errorf("invalid point %s: %w", p.Measurement, err)
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+// Package refluxdb embeds refluxdb in another program, either as a local
+// metrics store or as a full InfluxDB compatible server.
+//
+// Storage alone is enough to write and read points:
+//
+//	storage, err := refluxdb.OpenStorage("metrics.db")
+//	if err != nil {
+//		return err
+//	}
+//	defer storage.Close()
+//	err = storage.Write(refluxdb.Point{
+//		Measurement: "cpu",
+//		Tags:        map[string]string{"host": "a"},
+//		Fields:      map[string]float64{"value": 0.5},
+//		Timestamp:   time.Now().UnixNano(),
+//	})
+//
+// A Server additionally serves the HTTP and UDP APIs on top of a Storage:
+//
+//	srv, err := refluxdb.NewServer(storage, refluxdb.Options{HTTPAddr: ":8086"})
+//	if err != nil {
+//		return err
+//	}
+//	if err := srv.Start(ctx); err != nil {
+//		return err
+//	}
+//	defer srv.Shutdown(context.Background())
+package refluxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/alerts"
+	"github.com/gleicon/go-refluxdb/internal/enrich"
+	"github.com/gleicon/go-refluxdb/internal/ingest"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/replication"
+	"github.com/gleicon/go-refluxdb/internal/tracing"
+)
+
+// DefaultDatabase receives points written without a database
+const DefaultDatabase = persistence.DefaultDatabase
+
+// Point is a single time series data point
+type Point = persistence.Point
+
+// WriteOptions controls validation of points written through line protocol
+type WriteOptions = ingest.Options
+
+// BatchOptions controls how UDP points are batched before being stored
+type BatchOptions = ingest.BatchOptions
+
+// Check is a threshold check evaluated on a schedule
+type Check = alerts.Check
+
+// AlertEndpoint receives the notifications of checks
+type AlertEndpoint = alerts.Endpoint
+
+// Replication is a remote v2 write API receiving the written points
+type Replication = replication.Target
+
+// EnrichRule sets or rewrites the tags of the points written through the
+// listeners and from the sources it selects
+type EnrichRule = enrich.Rule
+
+// PartialWriteError reports the line protocol lines dropped from a write
+// whose remaining points were stored
+type PartialWriteError = ingest.PartialWriteError
+
+// TracingOptions configures the export of the write and query spans to an
+// OpenTelemetry collector
+type TracingOptions = tracing.Options
+
+// CompactionSchedule configures the compactions releasing the space left
+// by deleted and expired points to the file system
+type CompactionSchedule = persistence.CompactionSchedule
+
+// QuietHours is the daily window of local time during which the storage is
+// compacted
+type QuietHours = persistence.QuietHours
+
+// Tenant stores the points of its databases in a file of its own, set in
+// Options.Tenants
+type Tenant = persistence.Tenant
+
+// TieringOptions moves the blocks of old shards to object storage, set as
+// SQLiteOptions.Tiering
+type TieringOptions = persistence.TieringOptions
+
+// ObjectStore keeps the blocks of tiered shards, such as an S3 bucket
+type ObjectStore = persistence.ObjectStore
+
+// SQLiteOptions tunes the SQLite connection pool and durability settings
+type SQLiteOptions = persistence.Options
+
+// DefaultSQLiteOptions returns the SQLite settings used by OpenStorage:
+// WAL journaling, NORMAL synchronous writes flushed to disk every second
+// and a 5s busy timeout
+func DefaultSQLiteOptions() SQLiteOptions {
+	return persistence.DefaultOptions()
+}
+
+// StorageOptions configures a Storage
+type StorageOptions struct {
+	// Write controls validation of points written through line protocol
+	Write WriteOptions
+	// SQLite tunes the database connection
+	SQLite SQLiteOptions
+}
+
+// Storage is an embedded refluxdb database
+type Storage struct {
+	db     *persistence.Manager
+	parser *ingest.Parser
+	// sqlite opens the files of the tenants of a Server
+	sqlite SQLiteOptions
+}
+
+// OpenStorage opens the database file at path, creating it if needed.
+// ":memory:" opens a database that lives only in memory.
+func OpenStorage(path string) (*Storage, error) {
+	return OpenStorageWithOptions(path, StorageOptions{SQLite: DefaultSQLiteOptions()})
+}
+
+// OpenStorageWithOptions opens the database file at path with opts
+func OpenStorageWithOptions(path string, opts StorageOptions) (*Storage, error) {
+	db, err := persistence.NewWithOptions(path, opts.SQLite)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{db: db, parser: ingest.NewParser(opts.Write), sqlite: opts.SQLite}, nil
+}
+
+// Close closes the database
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+// Write stores points in a single transaction. Points without a database
+// go to DefaultDatabase.
+func (s *Storage) Write(points ...Point) error {
+	return s.db.SaveBatch(points)
+}
+
+// WriteLineProtocol parses a line protocol body and stores its points in
+// database. When some lines are invalid the others are still stored and a
+// *PartialWriteError is returned.
+func (s *Storage) WriteLineProtocol(database string, data []byte) error {
+	points, err := s.parser.Parse(data)
+	var partial *PartialWriteError
+	if err != nil && !errors.As(err, &partial) {
+		return err
+	}
+	for i := range points {
+		points[i].Database = database
+	}
+	if err := s.db.SaveBatch(points); err != nil {
+		return err
+	}
+	if partial != nil {
+		return partial
+	}
+	return nil
+}
+
+// Query returns the points of a measurement between start and end,
+// inclusive, ordered by time. A zero start or end leaves that side of the
+// range unbounded.
+func (s *Storage) Query(database, measurement string, start, end time.Time) ([]Point, error) {
+	return s.QueryContext(context.Background(), database, measurement, start, end)
+}
+
+// QueryContext is Query aborting once ctx is done, in which case the
+// returned error wraps ctx.Err()
+func (s *Storage) QueryContext(ctx context.Context, database, measurement string, start, end time.Time) ([]Point, error) {
+	if database == "" {
+		database = DefaultDatabase
+	}
+	startNs, err := rangeNanoseconds(start, math.MinInt64)
+	if err != nil {
+		return nil, err
+	}
+	endNs, err := rangeNanoseconds(end, math.MaxInt64)
+	if err != nil {
+		return nil, err
+	}
+	return s.db.GetMeasurementRangeContext(ctx, database, measurement, startNs, endNs)
+}
+
+// rangeNanoseconds converts a bound of a query range to a timestamp, the
+// zero time standing for unbounded
+func rangeNanoseconds(t time.Time, unbounded int64) (int64, error) {
+	if t.IsZero() {
+		return unbounded, nil
+	}
+	return persistence.Nanoseconds(t)
+}
+
+// Databases returns the names of every database, sorted
+func (s *Storage) Databases() ([]string, error) {
+	return s.db.ListDatabases()
+}
+
+// Measurements returns the measurements stored in database
+func (s *Storage) Measurements(database string) ([]string, error) {
+	return s.db.ListTimeseries(database)
+}
+
+// CreateDatabase creates an empty database. Creating an existing database
+// is a no-op.
+func (s *Storage) CreateDatabase(name string) error {
+	return s.db.CreateDatabase(name)
+}
+
+// DropDatabase removes a database and every point it holds
+func (s *Storage) DropDatabase(name string) error {
+	return s.db.DropDatabase(name)
+}
+
+// SetRetention sets how long the points of database are kept. Zero keeps
+// them forever. Expired points are deleted by a running Server, or by
+// EnforceRetention.
+func (s *Storage) SetRetention(database string, period time.Duration) error {
+	d, err := s.db.GetDatabase(database)
+	if err != nil {
+		return fmt.Errorf("failed to set retention of %s: %w", database, err)
+	}
+	_, err = s.db.UpdateDatabase(d.ID, persistence.DatabaseUpdate{RetentionPeriod: &period})
+	return err
+}
+
+// EnforceRetention deletes the points that fell out of the retention
+// period of their database and returns how many were deleted
+func (s *Storage) EnforceRetention() (int64, error) {
+	return s.db.EnforceRetention(time.Now())
+}
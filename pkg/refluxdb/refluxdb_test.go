@@ -0,0 +1,161 @@
+package refluxdb
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func openTestStorage(t *testing.T) *Storage {
+	storage, err := OpenStorage(":memory:")
+	assert.NoError(t, err)
+	t.Cleanup(func() { storage.Close() })
+	return storage
+}
+
+func TestStorage(t *testing.T) {
+	storage := openTestStorage(t)
+	now := time.Now()
+
+	assert.NoError(t, storage.Write(Point{
+		Measurement: "cpu",
+		Tags:        map[string]string{"host": "a"},
+		Fields:      map[string]float64{"value": 0.5},
+		Timestamp:   now.UnixNano(),
+	}))
+	points, err := storage.Query("", "cpu", now.Add(-time.Minute), now)
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+	assert.Equal(t, DefaultDatabase, points[0].Database)
+
+	// Zero times leave the range open, times past the timestamps fail
+	points, err = storage.Query("", "cpu", time.Time{}, time.Time{})
+	assert.NoError(t, err)
+	assert.Len(t, points, 1)
+	_, err = storage.Query("", "cpu", time.Date(1500, 1, 1, 0, 0, 0, 0, time.UTC), now)
+	assert.Error(t, err)
+
+	// Invalid lines are reported while the valid ones are stored
+	err = storage.WriteLineProtocol("app", []byte("mem used=1\nmem used=oops\n"))
+	var partial *PartialWriteError
+	assert.True(t, errors.As(err, &partial))
+	measurements, err := storage.Measurements("app")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"mem"}, measurements)
+
+	databases, err := storage.Databases()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"app", DefaultDatabase}, databases)
+
+	// Retention deletes points older than the period
+	assert.NoError(t, storage.Write(Point{Database: "app", Measurement: "mem", Fields: map[string]float64{"used": 2}, Timestamp: now.Add(-2 * time.Hour).UnixNano()}))
+	assert.NoError(t, storage.SetRetention("app", time.Hour))
+	deleted, err := storage.EnforceRetention()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	assert.Error(t, storage.SetRetention("missing", time.Hour))
+
+	assert.NoError(t, storage.DropDatabase("app"))
+	databases, err = storage.Databases()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{DefaultDatabase}, databases)
+}
+
+func TestServer(t *testing.T) {
+	storage := openTestStorage(t)
+	srv, err := NewServer(storage, Options{
+		HTTPAddr:   "127.0.0.1:0",
+		UDP:        []UDPListener{{Addr: "127.0.0.1:0", Database: "udp", Batch: BatchOptions{Timeout: 10 * time.Millisecond}}},
+		DefaultOrg: "my-org",
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, srv.Start(context.Background()))
+
+	resp, err := http.Post("http://"+srv.HTTPAddr()+"/api/v2/write?org=my-org&bucket=http", "text/plain", strings.NewReader("cpu value=1"))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	conn, err := net.Dial("udp", srv.UDPAddrs()[0])
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte("cpu value=2"))
+	assert.NoError(t, err)
+	conn.Close()
+
+	assert.Eventually(t, func() bool {
+		measurements, err := storage.Measurements("udp")
+		return err == nil && len(measurements) == 1
+	}, time.Second, 10*time.Millisecond)
+	measurements, err := storage.Measurements("http")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cpu"}, measurements)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, srv.Shutdown(ctx))
+	_, err = http.Get("http://" + srv.HTTPAddr() + "/ping")
+	assert.Error(t, err)
+}
+
+func TestShutdownWaitsForWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shutdown.db")
+	storage, err := OpenStorage(path)
+	assert.NoError(t, err)
+	srv, err := NewServer(storage, Options{HTTPAddr: "127.0.0.1:0"})
+	assert.NoError(t, err)
+	assert.NoError(t, srv.Start(context.Background()))
+
+	// A write whose body is still being sent when the shutdown starts.
+	// The server answers 100 Continue once the handler reads the body.
+	lines := "cpu value=1 1700000000000000000\ncpu value=2 1700000001000000000\n"
+	conn, err := net.Dial("tcp", srv.HTTPAddr())
+	assert.NoError(t, err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "POST /write?db=db HTTP/1.1\r\nHost: refluxdb\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n", len(lines))
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n", status)
+	_, err = r.ReadString('\n')
+	assert.NoError(t, err)
+	_, err = conn.Write([]byte(lines[:len(lines)/2]))
+	assert.NoError(t, err)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+	assert.Never(t, func() bool { return len(shutdown) > 0 }, 100*time.Millisecond, 10*time.Millisecond)
+
+	_, err = conn.Write([]byte(lines[len(lines)/2:]))
+	assert.NoError(t, err)
+	resp, err := http.ReadResponse(r, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.NoError(t, <-shutdown)
+
+	// The write-ahead log was checkpointed into the file
+	if info, err := os.Stat(path + "-wal"); err == nil {
+		assert.Zero(t, info.Size())
+	}
+	assert.NoError(t, storage.Close())
+
+	storage, err = OpenStorage(path)
+	assert.NoError(t, err)
+	defer storage.Close()
+	points, err := storage.Query("db", "cpu", time.Unix(0, 0), time.Unix(1800000000, 0))
+	assert.NoError(t, err)
+	assert.Len(t, points, 2)
+}
@@ -0,0 +1,486 @@
+package refluxdb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/acl"
+	"github.com/gleicon/go-refluxdb/internal/alerts"
+	"github.com/gleicon/go-refluxdb/internal/enrich"
+	"github.com/gleicon/go-refluxdb/internal/ingest"
+	"github.com/gleicon/go-refluxdb/internal/monitor"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/replication"
+	"github.com/gleicon/go-refluxdb/internal/server"
+	"github.com/gleicon/go-refluxdb/internal/subscriber"
+	"github.com/gleicon/go-refluxdb/internal/tasks"
+	"github.com/gleicon/go-refluxdb/internal/tracing"
+	"github.com/gleicon/go-refluxdb/internal/udp"
+	"github.com/sirupsen/logrus"
+)
+
+// UDPListener configures one UDP line protocol listener
+type UDPListener struct {
+	Addr string
+	// Database receives the points written to this listener
+	Database string
+	// MeasurementPrefix is prepended to every measurement received
+	MeasurementPrefix string
+	// BufferSize is the read buffer size in bytes, at most 65536
+	BufferSize int
+	// ReadQueue is the number of packets buffered for parsing
+	ReadQueue int
+	// Readers is the number of sockets opened on Addr with SO_REUSEPORT,
+	// each read in parallel. Zero or one reads a single socket.
+	Readers int
+	// Parsers is the number of goroutines parsing the packets, GOMAXPROCS
+	// when zero
+	Parsers int
+	// Batch controls how parsed points are grouped into transactions
+	Batch BatchOptions
+	// Write overrides Options.Write for this listener when set
+	Write *WriteOptions
+	// Allow and Deny filter the sources of the packets like Options.Allow
+	// and Options.Deny. Packets from other sources are dropped unparsed.
+	Allow []string
+	Deny  []string
+	// StatsInterval is the period of the log summarizing the packets and
+	// points received and lost. Zero disables it.
+	StatsInterval time.Duration
+}
+
+// Options configures a Server
+type Options struct {
+	// HTTPAddr is the bind address of the HTTP API. Empty disables it.
+	HTTPAddr string
+	// DebugToken must be sent as "Authorization: Token <token>" to reach
+	// the /debug endpoints. Empty only serves them to localhost.
+	DebugToken string
+	// AuthEnabled requires a token with the right scope on every HTTP
+	// endpoint but the health checks, metrics and /debug
+	AuthEnabled bool
+	// Allow and Deny are CIDR prefixes or addresses filtering the HTTP
+	// clients: only the clients matching Allow, or every client when it is
+	// empty, are served, except those matching Deny, which get a 403
+	Allow []string
+	Deny  []string
+	// UDP lists the UDP listeners to start
+	UDP []UDPListener
+	// Write controls validation of written points
+	Write WriteOptions
+	// Enrichment sets and rewrites the tags of the written points, in
+	// order. Rules name the HTTP API "http" and the UDP listeners by
+	// their Addr.
+	Enrichment []EnrichRule
+	// MaxDeadLetters is the number of lines dropped from HTTP and UDP
+	// writes kept in the storage for /api/v2/deadletters, the oldest being
+	// removed first. Zero only logs dropped lines.
+	MaxDeadLetters int
+	// DedupWindow drops the points written again, with the same series,
+	// timestamp and fields, within this window, across HTTP and UDP. Zero
+	// disables deduplication.
+	DedupWindow time.Duration
+	// DedupMaxPoints bounds the points remembered over DedupWindow, the
+	// oldest being forgotten first. Zero means ingest.DefaultDedupEntries.
+	DedupMaxPoints int
+	// Tenants store the points of their databases in files of their own,
+	// opened with the SQLite options of the storage on first use. The
+	// storage keeps the databases, tokens and settings of every tenant.
+	Tenants []Tenant
+	// TenantIdleTimeout closes the files of the tenants unused for this
+	// long. Zero keeps them open.
+	TenantIdleTimeout time.Duration
+	// MemoryBudget bounds the estimated memory of the written points
+	// waiting for storage, in bytes. HTTP writes over it get a 503 and
+	// UDP listeners evict their oldest queued points. Zero uses a quarter
+	// of the GOMEMLIMIT memory limit when one is set; negative disables it.
+	MemoryBudget int64
+	// DefaultOrg is created at startup and owns the buckets created without
+	// an organization. Empty disables it.
+	DefaultOrg string
+	// QueryTimeout aborts HTTP queries running longer than this. Zero
+	// disables it.
+	QueryTimeout time.Duration
+	// MaxConcurrentQueries limits the HTTP queries executed at once. Zero
+	// means unlimited.
+	MaxConcurrentQueries int
+	// MaxQueuedQueries is the number of queries waiting for a slot once
+	// MaxConcurrentQueries are running. Further queries get a 503.
+	MaxQueuedQueries int
+	// QueueTimeout is how long a queued query waits for a slot
+	QueueTimeout time.Duration
+	// SlowQueryThreshold is the duration past which an HTTP query is
+	// logged as slow and kept for /debug/queries. Zero disables it.
+	SlowQueryThreshold time.Duration
+	// SlowQueryBuffer is the number of slow queries kept, 100 when zero
+	SlowQueryBuffer int
+	// SlowQueryLog receives the slow queries. Logger is used when nil.
+	SlowQueryLog *logrus.Logger
+	// RetentionCheckInterval is how often expired points are deleted. Zero
+	// disables retention enforcement.
+	RetentionCheckInterval time.Duration
+	// IntegrityCheckInterval is how often the storage integrity is
+	// verified. Zero disables the periodic checks.
+	IntegrityCheckInterval time.Duration
+	// Compaction compacts the storage during its quiet hours. Nil
+	// disables the scheduled compactions.
+	Compaction *CompactionSchedule
+	// TieringInterval is how often the shards past the tiering age of
+	// SQLiteOptions.Tiering are uploaded. Zero disables the uploads.
+	TieringInterval time.Duration
+	// MonitorInterval is how often the runtime statistics are stored in
+	// MonitorDatabase, "_internal" when empty, like the InfluxDB
+	// self-monitoring. Zero disables it.
+	MonitorInterval time.Duration
+	MonitorDatabase string
+	// Checks are evaluated on their schedule, notifying AlertEndpoints
+	// when their level changes
+	Checks         []Check
+	AlertEndpoints []AlertEndpoint
+	// Replications receive every written point through a durable queue
+	Replications []Replication
+	// Tracing exports the parsing, storage and query stages of the HTTP
+	// writes and queries as spans. Nil disables tracing.
+	Tracing *TracingOptions
+	// Logger receives server logs. A default logrus logger is used when nil.
+	Logger *logrus.Logger
+}
+
+// Server serves the InfluxDB compatible HTTP and UDP APIs on top of a
+// Storage
+type Server struct {
+	storage *Storage
+	opts    Options
+	http    *server.Server
+	udp     *udp.Manager
+	subs    *subscriber.Service
+	alerts  *alerts.Service
+	repl    *replication.Service
+	tasks   *tasks.Service
+	// tenants is nil without Options.Tenants
+	tenants *persistence.Pool
+	// monitor is nil when the self-monitoring is disabled
+	monitor *monitor.Service
+	// tracer is nil when tracing is disabled
+	tracer *tracing.Tracer
+	// queries executes the task queries, through the HTTP server when it
+	// is enabled
+	queries *server.Server
+
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	httpAddr string
+	udpAddrs []string
+}
+
+// NewServer creates a server for storage. The storage stays owned by the
+// caller and must outlive the server.
+func NewServer(storage *Storage, opts Options) (*Server, error) {
+	if opts.DefaultOrg != "" {
+		if _, err := storage.db.SetDefaultOrganization(opts.DefaultOrg); err != nil {
+			return nil, fmt.Errorf("failed to create default organization: %w", err)
+		}
+	}
+
+	checks, err := alerts.New(storage.db, opts.Checks, opts.AlertEndpoints, alerts.Options{Logger: opts.Logger})
+	if err != nil {
+		return nil, fmt.Errorf("invalid checks: %w", err)
+	}
+
+	repl, err := replication.New(storage.db, opts.Replications, replication.Options{Logger: opts.Logger})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start replication: %w", err)
+	}
+
+	clients, err := acl.New(opts.Allow, opts.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP clients: %w", err)
+	}
+
+	rules, err := enrich.New(opts.Enrichment)
+	if err != nil {
+		return nil, fmt.Errorf("invalid enrichment: %w", err)
+	}
+
+	limit := opts.MemoryBudget
+	if limit == 0 {
+		limit = ingest.AutoBudget()
+	}
+	budget := ingest.NewBudget(limit)
+	deadLetters := ingest.NewDeadLetters(storage.db, opts.MaxDeadLetters)
+	dedup := ingest.NewDedup(opts.DedupWindow, opts.DedupMaxPoints)
+
+	s := &Server{storage: storage, opts: opts, alerts: checks, repl: repl}
+	if len(opts.Tenants) > 0 {
+		s.tenants, err = persistence.NewPool(storage.db, persistence.PoolOptions{
+			Tenants:     opts.Tenants,
+			Options:     storage.sqlite,
+			IdleTimeout: opts.TenantIdleTimeout,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.subs = subscriber.New(storage.db, subscriber.Options{Logger: opts.Logger})
+	s.tasks = tasks.New(storage.db, tasks.Options{Logger: opts.Logger})
+	if opts.MonitorInterval > 0 {
+		s.monitor = monitor.New(storage.db, monitor.Options{
+			Database: opts.MonitorDatabase,
+			Interval: opts.MonitorInterval,
+			Logger:   opts.Logger,
+		})
+	}
+	if opts.Tracing != nil {
+		tracingOpts := *opts.Tracing
+		if tracingOpts.ServiceVersion == "" {
+			tracingOpts.ServiceVersion = server.Version
+		}
+		if tracingOpts.Logger == nil {
+			tracingOpts.Logger = opts.Logger
+		}
+		if s.tracer, err = tracing.New(tracingOpts); err != nil {
+			return nil, fmt.Errorf("invalid tracing: %w", err)
+		}
+	}
+	httpOpts := server.Options{
+		Write:                opts.Write,
+		QueryTimeout:         opts.QueryTimeout,
+		MaxConcurrentQueries: opts.MaxConcurrentQueries,
+		MaxQueuedQueries:     opts.MaxQueuedQueries,
+		QueueTimeout:         opts.QueueTimeout,
+		SlowQueryThreshold:   opts.SlowQueryThreshold,
+		SlowQueryBuffer:      opts.SlowQueryBuffer,
+		SlowQueryLog:         opts.SlowQueryLog,
+		Tracer:               s.tracer,
+		DebugToken:           opts.DebugToken,
+		AuthEnabled:          opts.AuthEnabled,
+		Clients:              clients,
+		Enrichment:           rules,
+		DeadLetters:          deadLetters,
+		Dedup:                dedup,
+		Tenants:              s.tenants,
+		Budget:               budget,
+		Subscriber:           s.subs,
+		Alerts:               s.alerts,
+		Tasks:                s.tasks,
+		Logger:               opts.Logger,
+	}
+	if opts.HTTPAddr != "" {
+		s.http = server.NewWithOptions(opts.HTTPAddr, storage.db, httpOpts)
+		s.queries = s.http
+	} else {
+		s.queries = server.NewWithOptions("", storage.db, httpOpts)
+	}
+	listeners := make([]udp.Listener, 0, len(opts.UDP))
+	for _, l := range opts.UDP {
+		write := opts.Write
+		if l.Write != nil {
+			write = *l.Write
+		}
+		sources, err := acl.New(l.Allow, l.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UDP sources of %s: %w", l.Addr, err)
+		}
+		batch := l.Batch
+		batch.Budget = budget
+		listeners = append(listeners, udp.Listener{
+			Addr: l.Addr,
+			Options: udp.Options{
+				Write:             write,
+				BufferSize:        l.BufferSize,
+				ReadQueue:         l.ReadQueue,
+				Readers:           l.Readers,
+				Parsers:           l.Parsers,
+				Batch:             batch,
+				Database:          l.Database,
+				MeasurementPrefix: l.MeasurementPrefix,
+				Clients:           sources,
+				Enrichment:        rules,
+				DeadLetters:       deadLetters,
+				Dedup:             dedup,
+				Tenants:           s.tenants,
+				StatsInterval:     l.StatsInterval,
+			},
+		})
+	}
+	s.udp = udp.NewManager(storage.db, listeners)
+	return s, nil
+}
+
+// Start binds the HTTP and UDP listeners and serves them in the background
+// until ctx is done or Shutdown is called
+func (s *Server) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+
+	var listener net.Listener
+	if s.http != nil {
+		var err error
+		listener, err = net.Listen("tcp", s.opts.HTTPAddr)
+		if err != nil {
+			cancel()
+			return fmt.Errorf("failed to listen on %s: %w", s.opts.HTTPAddr, err)
+		}
+		s.httpAddr = listener.Addr().String()
+	}
+
+	if err := s.subs.Start(); err != nil {
+		cancel()
+		if listener != nil {
+			listener.Close()
+		}
+		return fmt.Errorf("failed to start subscriptions: %w", err)
+	}
+	s.repl.Start()
+	addrs, err := s.udp.Start(ctx)
+	if err != nil {
+		cancel()
+		s.subs.Stop()
+		s.repl.Stop()
+		if listener != nil {
+			listener.Close()
+		}
+		return err
+	}
+	s.udpAddrs = addrs
+	s.cancel = cancel
+
+	if listener != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if err := s.http.StartWithListener(ctx, listener); err != nil {
+				s.logger().Errorf("HTTP server error: %v", err)
+			}
+		}()
+	}
+
+	// Shutdown stops the tracer once the requests being served end, so
+	// their spans are exported too
+	s.tracer.Start(context.WithoutCancel(ctx))
+	s.alerts.Start(ctx)
+	s.tasks.Start(ctx, s.queries.Execute)
+	if s.monitor != nil {
+		if err := s.monitor.Start(ctx); err != nil {
+			s.logger().Errorf("Failed to start self-monitoring: %v", err)
+		}
+	}
+
+	if s.opts.RetentionCheckInterval > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			if s.tenants != nil {
+				s.tenants.RunRetention(ctx, s.opts.RetentionCheckInterval)
+			} else {
+				s.storage.db.RunRetention(ctx, s.opts.RetentionCheckInterval)
+			}
+		}()
+	}
+
+	if s.tenants != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.tenants.RunIdleClose(ctx)
+		}()
+	}
+
+	if s.opts.IntegrityCheckInterval > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.storage.db.RunIntegrityChecks(ctx, s.opts.IntegrityCheckInterval)
+		}()
+	}
+
+	if s.opts.Compaction != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.storage.db.RunCompactions(ctx, *s.opts.Compaction)
+		}()
+	}
+
+	if s.opts.TieringInterval > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.storage.db.RunTiering(ctx, s.opts.TieringInterval)
+		}()
+	}
+	return nil
+}
+
+// HTTPAddr returns the bound HTTP address, or an empty string before
+// Start or when the HTTP API is disabled
+func (s *Server) HTTPAddr() string {
+	return s.httpAddr
+}
+
+// UDPAddrs returns the bound UDP addresses in configuration order
+func (s *Server) UDPAddrs() []string {
+	return s.udpAddrs
+}
+
+// Shutdown stops the server in order: it stops accepting connections and
+// waits for the writes in flight, flushes the points the UDP listeners are
+// still batching and forwards them to subscriptions, waits for the
+// background jobs, and checkpoints the storage, so that it can be closed
+// without losing an acknowledged point. It gives up waiting once ctx is
+// done, and exports the spans left.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.cancel == nil {
+		return nil
+	}
+	var err error
+	if s.http != nil {
+		if herr := s.http.Shutdown(ctx); herr != nil {
+			err = fmt.Errorf("failed to wait for HTTP requests: %w", herr)
+		}
+	}
+	s.cancel()
+	if uerr := s.udp.Stop(); uerr != nil && err == nil {
+		err = uerr
+	}
+	// After the listeners, so the points they flush are forwarded too
+	s.subs.Stop()
+	s.repl.Stop()
+	s.alerts.Stop()
+	s.tasks.Stop()
+	if s.monitor != nil {
+		s.monitor.Stop()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		if err == nil {
+			err = fmt.Errorf("shutdown timed out: %w", ctx.Err())
+		}
+	}
+	if s.tenants != nil {
+		if cerr := s.tenants.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("failed to close tenant files: %w", cerr)
+		}
+	}
+	if cerr := s.storage.db.Checkpoint(); cerr != nil && err == nil {
+		err = fmt.Errorf("failed to flush storage: %w", cerr)
+	}
+	s.tracer.Stop()
+	return err
+}
+
+func (s *Server) logger() *logrus.Logger {
+	if s.opts.Logger != nil {
+		return s.opts.Logger
+	}
+	return logrus.StandardLogger()
+}
@@ -0,0 +1,202 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/pkg/client"
+	"github.com/gleicon/go-refluxdb/pkg/refluxdb"
+	"github.com/stretchr/testify/assert"
+)
+
+// The crash server is the test binary run again with these variables set,
+// so that it can be killed without killing the test
+const (
+	crashDBEnv         = "REFLUXDB_CRASH_DB"
+	crashDurabilityEnv = "REFLUXDB_CRASH_DURABILITY"
+)
+
+// TestCrashServer serves the database of REFLUXDB_CRASH_DB until killed,
+// printing its address on stdout. It only runs as the child process of
+// TestCrashRecovery.
+func TestCrashServer(t *testing.T) {
+	path := os.Getenv(crashDBEnv)
+	if path == "" {
+		t.Skip("only run by TestCrashRecovery")
+	}
+	opts := persistence.DefaultOptions()
+	opts.Durability = os.Getenv(crashDurabilityEnv)
+	storage, err := refluxdb.OpenStorageWithOptions(path, refluxdb.StorageOptions{SQLite: opts})
+	if !assert.NoError(t, err) {
+		return
+	}
+	srv, err := refluxdb.NewServer(storage, refluxdb.Options{HTTPAddr: "127.0.0.1:0"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	if !assert.NoError(t, srv.Start(context.Background())) {
+		return
+	}
+	fmt.Printf("listening on %s\n", srv.HTTPAddr())
+	select {}
+}
+
+// TestCrashRecovery kills a server with SIGKILL while clients write to it,
+// several times over the same file, and checks that every point the server
+// acknowledged is there once the file is opened again. A killed process
+// leaves its writes in the page cache, so both durability modes must keep
+// them; only DurabilityBatch also covers a power loss, which a test cannot
+// cause.
+func TestCrashRecovery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("starts and kills server processes")
+	}
+	for _, durability := range []string{persistence.DurabilityBatch, persistence.DurabilityPeriodic} {
+		t.Run(durability, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "crash.db")
+			acked := make(map[string]bool)
+			for round := 0; round < 3; round++ {
+				for key := range crashRound(t, path, durability, round) {
+					acked[key] = true
+				}
+			}
+			if !assert.NotEmpty(t, acked) {
+				return
+			}
+
+			m, err := persistence.New(path)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer m.Close()
+			points, err := m.GetMeasurementRange("crash", "writes", math.MinInt64, math.MaxInt64)
+			if !assert.NoError(t, err) {
+				return
+			}
+			stored := make(map[string]bool, len(points))
+			for _, p := range points {
+				stored[crashKey(p.Tags["writer"], p.Timestamp)] = true
+			}
+			lost := 0
+			for key := range acked {
+				if !stored[key] {
+					lost++
+				}
+			}
+			assert.Zero(t, lost, "%d of %d acknowledged points lost", lost, len(acked))
+			// Batches sent when the server was killed may be stored too
+			assert.GreaterOrEqual(t, len(stored), len(acked))
+		})
+	}
+}
+
+// crashRound starts a server on path, writes batches to it from several
+// clients and kills it mid-write. It returns the keys of the points
+// acknowledged by the server.
+func crashRound(t *testing.T, path, durability string, round int) map[string]bool {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCrashServer$", "-test.v")
+	cmd.Env = append(os.Environ(), crashDBEnv+"="+path, crashDurabilityEnv+"="+durability)
+	stdout, err := cmd.StdoutPipe()
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	if !assert.NoError(t, cmd.Start()) {
+		return nil
+	}
+	killed := false
+	defer func() {
+		if !killed {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	}()
+
+	addr := ""
+	lines := bufio.NewScanner(stdout)
+	for lines.Scan() {
+		if a, ok := strings.CutPrefix(lines.Text(), "listening on "); ok {
+			addr = a
+			break
+		}
+	}
+	if !assert.NotEmpty(t, addr, "the crash server did not start") {
+		return nil
+	}
+	// Keep draining the output, so that the server never blocks on it
+	go func() {
+		for lines.Scan() {
+		}
+	}()
+
+	c := client.New("http://"+addr, client.Options{})
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	var mu sync.Mutex
+	acked := make(map[string]bool)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		writer := fmt.Sprintf("w%d-%d", round, w)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seq := int64(0); ; seq += 100 {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				batch := make([]client.Point, 100)
+				for i := range batch {
+					batch[i] = client.Point{
+						Measurement: "writes",
+						Tags:        map[string]string{"writer": writer},
+						Fields:      map[string]float64{"seq": float64(seq + int64(i))},
+						Time:        time.Unix(0, base+seq+int64(i)),
+					}
+				}
+				if err := c.WriteBatch(context.Background(), "crash", batch); err != nil {
+					// The server is gone
+					return
+				}
+				mu.Lock()
+				for _, p := range batch {
+					acked[crashKey(writer, p.Time.UnixNano())] = true
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Kill the server once it acknowledged some batches, while the
+	// writers keep sending
+	ok := assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(acked) >= 2000
+	}, 30*time.Second, 10*time.Millisecond)
+	// The writers stop once the server is gone
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+	if !ok || !assert.NoError(t, cmd.Process.Kill()) {
+		return nil
+	}
+	cmd.Wait()
+	killed = true
+	return acked
+}
+
+func crashKey(writer string, ts int64) string {
+	return fmt.Sprintf("%s/%d", writer, ts)
+}
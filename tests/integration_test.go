@@ -13,6 +13,7 @@ import (
 	"github.com/gleicon/go-refluxdb/internal/udp"
 	influxdb2 "github.com/influxdata/influxdb-client-go/v2"
 	"github.com/influxdata/influxdb-client-go/v2/api/write"
+	"github.com/influxdata/influxdb-client-go/v2/domain"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -27,6 +28,8 @@ func setupTestEnvironment(t *testing.T) (*server.Server, *udp.Server, *persisten
 		db.Close()
 		os.Remove(dbPath)
 	})
+	_, err = db.SetDefaultOrganization("my-org")
+	assert.NoError(t, err)
 
 	// Use dynamic port allocation
 	httpServer := server.New(":0", db)
@@ -71,6 +74,17 @@ func TestEndToEnd(t *testing.T) {
 	client := influxdb2.NewClient("http://"+httpAddress, "")
 	writeAPI := client.WriteAPIBlocking("my-org", "my-bucket")
 
+	// Test client health checks
+	t.Run("ping and health", func(t *testing.T) {
+		ok, err := client.Ping(context.Background())
+		assert.NoError(t, err)
+		assert.True(t, ok)
+
+		health, err := client.Health(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, "pass", string(health.Status))
+	})
+
 	// Test HTTP write and query
 	t.Run("http write and query", func(t *testing.T) {
 		// Write data using official client
@@ -87,6 +101,43 @@ func TestEndToEnd(t *testing.T) {
 		assert.Equal(t, http.StatusOK, resp.StatusCode)
 	})
 
+	// Test org lookup and bucket management through the client APIs
+	t.Run("orgs and buckets", func(t *testing.T) {
+		ctx := context.Background()
+		org, err := client.OrganizationsAPI().FindOrganizationByName(ctx, "my-org")
+		assert.NoError(t, err)
+		if !assert.NotNil(t, org) {
+			return
+		}
+
+		bucketsAPI := client.BucketsAPI()
+		bucket, err := bucketsAPI.CreateBucketWithName(ctx, org, "client-bucket", domain.RetentionRule{EverySeconds: 3600})
+		assert.NoError(t, err)
+		if !assert.NotNil(t, bucket) {
+			return
+		}
+		assert.Equal(t, *org.Id, *bucket.OrgID)
+
+		found, err := bucketsAPI.FindBucketByName(ctx, "client-bucket")
+		assert.NoError(t, err)
+		assert.Equal(t, *bucket.Id, *found.Id)
+		assert.Equal(t, int64(3600), found.RetentionRules[0].EverySeconds)
+
+		// Buckets created by writes belong to the default org
+		buckets, err := bucketsAPI.FindBucketsByOrgName(ctx, "my-org")
+		assert.NoError(t, err)
+		assert.Len(t, *buckets, 2)
+
+		found.Name = "renamed-bucket"
+		updated, err := bucketsAPI.UpdateBucket(ctx, found)
+		assert.NoError(t, err)
+		assert.Equal(t, "renamed-bucket", updated.Name)
+
+		assert.NoError(t, bucketsAPI.DeleteBucketWithID(ctx, *bucket.Id))
+		_, err = bucketsAPI.FindBucketByID(ctx, *bucket.Id)
+		assert.Error(t, err)
+	})
+
 	// Test UDP write
 	t.Run("udp write", func(t *testing.T) {
 		// Write data using official client
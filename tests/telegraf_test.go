@@ -0,0 +1,235 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gleicon/go-refluxdb/internal/ingest"
+	"github.com/gleicon/go-refluxdb/internal/persistence"
+	"github.com/gleicon/go-refluxdb/internal/server"
+	"github.com/stretchr/testify/assert"
+)
+
+// startTelegrafTarget starts a server on a free port and returns its
+// base URL
+func startTelegrafTarget(t *testing.T, opts server.Options) string {
+	db, err := persistence.New(filepath.Join(t.TempDir(), "telegraf.db"))
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	t.Cleanup(func() { db.Close() })
+	_, err = db.SetDefaultOrganization("my-org")
+	if !assert.NoError(t, err) {
+		return ""
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go server.NewWithOptions(listener.Addr().String(), db, opts).StartWithListener(ctx, listener)
+	return "http://" + listener.Addr().String()
+}
+
+// replay sends the request captured in testdata/telegraf/name to base.
+// Bodies are stored uncompressed so the fixtures stay readable, and are
+// compressed when the captured request was sent with Content-Encoding: gzip.
+func replay(t *testing.T, base, name string) (int, http.Header, string) {
+	raw, err := os.ReadFile(filepath.Join("testdata", "telegraf", name))
+	if !assert.NoError(t, err) {
+		return 0, nil, ""
+	}
+	captured, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+	if !assert.NoError(t, err) {
+		return 0, nil, ""
+	}
+	body, err := io.ReadAll(captured.Body)
+	if !assert.NoError(t, err) {
+		return 0, nil, ""
+	}
+
+	if captured.Header.Get("Content-Encoding") == "gzip" {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err = gz.Write(body)
+		if !assert.NoError(t, err) {
+			return 0, nil, ""
+		}
+		if !assert.NoError(t, gz.Close()) {
+			return 0, nil, ""
+		}
+		body = buf.Bytes()
+	}
+
+	req, err := http.NewRequest(captured.Method, base+captured.URL.RequestURI(), bytes.NewReader(body))
+	if !assert.NoError(t, err) {
+		return 0, nil, ""
+	}
+	req.Header = captured.Header
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		return 0, nil, ""
+	}
+	defer resp.Body.Close()
+	text, err := io.ReadAll(resp.Body)
+	if !assert.NoError(t, err) {
+		return 0, nil, ""
+	}
+	return resp.StatusCode, resp.Header, string(text)
+}
+
+// influxQL runs q against the telegraf database and returns the rows of
+// its single series
+func influxQL(t *testing.T, base, q string) [][]interface{} {
+	resp, err := http.Get(base + "/query?db=telegraf&epoch=ns&q=" + url.QueryEscape(q))
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer resp.Body.Close()
+	if !assert.Equal(t, http.StatusOK, resp.StatusCode) {
+		return nil
+	}
+
+	var decoded struct {
+		Results []struct {
+			Series []struct {
+				Values [][]interface{} `json:"values"`
+			} `json:"series"`
+			Error string `json:"error"`
+		} `json:"results"`
+	}
+	if !assert.NoError(t, json.NewDecoder(resp.Body).Decode(&decoded)) {
+		return nil
+	}
+	if !assert.Len(t, decoded.Results, 1) {
+		return nil
+	}
+	if !assert.Empty(t, decoded.Results[0].Error, q) {
+		return nil
+	}
+	if len(decoded.Results[0].Series) == 0 {
+		return nil
+	}
+	return decoded.Results[0].Series[0].Values
+}
+
+func TestTelegrafOutputs(t *testing.T) {
+	budget := ingest.NewBudget(1 << 20)
+	base := startTelegrafTarget(t, server.Options{Budget: budget})
+
+	t.Run("influxdb output", func(t *testing.T) {
+		status, _, body := replay(t, base, "v1_create_database.http")
+		assert.Equal(t, http.StatusOK, status, body)
+
+		status, _, body = replay(t, base, "v1_write.http")
+		assert.Equal(t, http.StatusNoContent, status, body)
+
+		rows := influxQL(t, base, `SELECT "used_percent", "total" FROM "mem"`)
+		if assert.Len(t, rows, 1) {
+			assert.Equal(t, 17.756584098040566, rows[0][1])
+			assert.Equal(t, float64(16446619648), rows[0][2])
+		}
+		// String fields such as uptime_format are stored rather than
+		// failing the whole batch
+		rows = influxQL(t, base, `SELECT "uptime" FROM "system"`)
+		if assert.Len(t, rows, 1) {
+			assert.Equal(t, float64(864000), rows[0][1])
+		}
+	})
+
+	t.Run("precision", func(t *testing.T) {
+		status, _, body := replay(t, base, "v1_write_precision.http")
+		assert.Equal(t, http.StatusNoContent, status, body)
+
+		rows := influxQL(t, base, `SELECT "usage_idle" FROM "cpu" WHERE "host" = 'web-2'`)
+		if assert.Len(t, rows, 1) {
+			assert.Equal(t, float64(1700000060*time.Second), rows[0][0])
+		}
+	})
+
+	t.Run("influxdb_v2 output", func(t *testing.T) {
+		status, _, body := replay(t, base, "v2_write.http")
+		assert.Equal(t, http.StatusNoContent, status, body)
+
+		rows := influxQL(t, base, `SELECT "reads" FROM "diskio"`)
+		if assert.Len(t, rows, 1) {
+			assert.Equal(t, float64(256), rows[0][1])
+		}
+	})
+
+	t.Run("retries", func(t *testing.T) {
+		// A full memory budget pushes the agent back with Retry-After, and
+		// the batch it sends again is stored once
+		if !assert.True(t, budget.Reserve(budget.Limit())) {
+			return
+		}
+		status, header, body := replay(t, base, "v1_write.http")
+		assert.Equal(t, http.StatusServiceUnavailable, status, body)
+		assert.Equal(t, "1", header.Get("Retry-After"))
+		budget.Release(budget.Limit())
+
+		for i := 0; i < 2; i++ {
+			status, _, body = replay(t, base, "v1_write.http")
+			assert.Equal(t, http.StatusNoContent, status, body)
+		}
+		assert.Len(t, influxQL(t, base, `SELECT "used_percent" FROM "mem" WHERE "host" = 'web-1'`), 1)
+	})
+}
+
+// TestTelegrafBinary runs the influxdb and influxdb_v2 outputs of a
+// telegraf found in PATH once against the server
+func TestTelegrafBinary(t *testing.T) {
+	bin, err := exec.LookPath("telegraf")
+	if err != nil {
+		t.Skip("telegraf is not installed")
+	}
+	base := startTelegrafTarget(t, server.Options{})
+
+	config := fmt.Sprintf(`
+[agent]
+  omit_hostname = false
+
+[[inputs.mem]]
+
+[[outputs.influxdb]]
+  urls = ["%[1]s"]
+  database = "telegraf"
+  content_encoding = "gzip"
+
+[[outputs.influxdb_v2]]
+  urls = ["%[1]s"]
+  token = "my-token"
+  organization = "my-org"
+  bucket = "telegraf_v2"
+`, base)
+	path := filepath.Join(t.TempDir(), "telegraf.conf")
+	if !assert.NoError(t, os.WriteFile(path, []byte(config), 0o600)) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, bin, "--once", "--config", path).CombinedOutput()
+	if !assert.NoError(t, err, string(out)) {
+		return
+	}
+	assert.NotContains(t, strings.ToLower(string(out)), "error", string(out))
+
+	assert.NotEmpty(t, influxQL(t, base, `SELECT "used_percent" FROM "mem"`))
+}